@@ -1,27 +1,58 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"YALS/internal/agent"
-	"YALS/internal/config"
-	"YALS/internal/logger"
-	"YALS/internal/plugin"
-	"YALS/internal/utils"
-
-	_ "YALS/internal/plugin/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/utils"
+	"github.com/TogawaSakiko363/YALS/pkg/yals"
 )
 
 func main() {
 	serverHost := flag.String("s", "", "Server host or address")
 	serverPort := flag.Int("p", 443, "Server port")
+	var standby []string
+	flag.Func("standby", "Standby server (host[:port]) to fail over to when -s is down; repeat or separate with commas for several", func(value string) error {
+		for _, server := range strings.Split(value, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				standby = append(standby, server)
+			}
+		}
+		return nil
+	})
+	failbackInterval := flag.Int("failback-interval", 0, "Seconds between health checks of -s while connected to a standby server (default 30)")
 	agentUUID := flag.String("u", "", "Agent UUID generated by server")
 	agentToken := flag.String("t", "", "Agent token issued by server")
+	enrollCode := flag.String("enroll", "", "Enroll with this one-time code instead of -u and -t; the issued UUID and token are saved to -credentials")
+	enrollName := flag.String("name", "", "Name to ask for when enrolling (default: host name)")
+	credentials := flag.String("credentials", "", "File keeping the UUID and token of an enrolled agent (default yals_agent_credentials.yaml with -enroll)")
+	autoDetect := flag.Bool("auto-detect", false, "Register default commands for detected tools (ping, traceroute, mtr, nexttrace, dig, ...)")
+	maxPerMinute := flag.Int("max-per-minute", 0, "Most commands this agent starts per minute (0 = unlimited)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Most commands this agent runs at once (0 = unlimited)")
+	listen := flag.String("listen", "", "Wait for the server to connect on this address (e.g. :9443) instead of connecting to it")
+	sshJump := flag.String("ssh-jump", "", "Reach the server through this SSH jump host (user@host[:port])")
+	sshKey := flag.String("ssh-key", "", "Private key file for the SSH jump host")
+	sshKnownHosts := flag.String("ssh-known-hosts", "", "known_hosts file checked for the SSH jump host's key (default ~/.ssh/known_hosts)")
+	keepalive := flag.Int("keepalive", 0, "Seconds between keepalive pings to the server (default 10, at least 5)")
+	keepaliveTimeout := flag.Int("keepalive-timeout", 0, "Seconds to wait for a keepalive answer before reconnecting (default 3)")
+	tcpKeepalive := flag.Int("tcp-keepalive", 0, "TCP keepalive period in seconds (default: system, -1 = off)")
+	dialTimeout := flag.Int("dial-timeout", 0, "Seconds to wait for the TCP connection to the server (default 20)")
+	maxMessageSize := flag.Int("max-message-size", 0, "Largest message in bytes sent to or accepted from the server (default 4 MiB)")
+	writeBufferSize := flag.Int("write-buffer-size", 0, "Bytes buffered before writing to the socket (default 32 KiB)")
+	readBufferSize := flag.Int("read-buffer-size", 0, "Bytes buffered when reading from the socket (default 32 KiB)")
+	compression := flag.String("compression", "", "Compress large command output sent to the server (zstd)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector (host:port) to export execution traces to")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "Export traces over plain HTTP")
 	showVersion := flag.Bool("version", false, "Show version information")
 	flag.Parse()
 
@@ -31,41 +62,74 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *serverHost == "" || *serverPort <= 0 || *agentUUID == "" || *agentToken == "" {
-		logger.Fatalf("Usage: yals_agent -s <server> -p <port> -u <uuid> -t <token>")
+	if *enrollCode != "" && *credentials == "" {
+		*credentials = "yals_agent_credentials.yaml"
+	}
+	identified := (*agentUUID != "" && *agentToken != "") || *credentials != ""
+	if (*listen == "" && (*serverHost == "" || *serverPort <= 0)) || !identified {
+		logger.Fatalf("Usage: yals_agent -s <server> -p <port> -u <uuid> -t <token>\n       yals_agent -s <server> -p <port> -enroll <code> [-name <name>]\n       yals_agent -listen <address> -u <uuid> -t <token>")
 	}
 
-	logger.SetGlobalLevelFromString("info")
-
-	logger.Infof("Server: %s:%d", *serverHost, *serverPort)
-	logger.Infof("UUID: %s", *agentUUID)
+	yals.SetLogLevel("info")
 
-	agentConfig := &config.AgentConfig{}
-	agentConfig.Server.Host = *serverHost
-	agentConfig.Server.Port = *serverPort
-	agentConfig.Server.UUID = *agentUUID
-	agentConfig.Server.Token = *agentToken
-	agentConfig.Log.LogLevel = "info"
+	if *listen != "" {
+		logger.Infof("Listening for the server on %s", *listen)
+	} else {
+		logger.Infof("Server: %s:%d", *serverHost, *serverPort)
+		if len(standby) > 0 {
+			logger.Infof("Standby servers: %s", strings.Join(standby, ", "))
+		}
+	}
+	if *agentUUID != "" {
+		logger.Infof("UUID: %s", *agentUUID)
+	}
 
-	agentClient := agent.NewClientWithConfig(agentConfig)
+	var sshTunnel config.SSHTunnelConfig
+	if *sshJump != "" {
+		user, host, ok := strings.Cut(*sshJump, "@")
+		if !ok {
+			logger.Fatalf("-ssh-jump must be user@host[:port]")
+		}
+		sshTunnel = config.SSHTunnelConfig{Host: host, User: user, Key: *sshKey, KnownHosts: *sshKnownHosts}
+	}
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	agentClient, err := yals.NewAgentClient(yals.AgentOptions{
+		Host:             *serverHost,
+		Port:             *serverPort,
+		UUID:             *agentUUID,
+		Token:            *agentToken,
+		CredentialsFile:  *credentials,
+		EnrollCode:       *enrollCode,
+		EnrollName:       *enrollName,
+		AutoDetect:       *autoDetect,
+		OTLPEndpoint:     *otlpEndpoint,
+		OTLPInsecure:     *otlpInsecure,
+		MaxPerMinute:     *maxPerMinute,
+		MaxConcurrent:    *maxConcurrent,
+		Listen:           *listen,
+		SSHTunnel:        sshTunnel,
+		Standby:          standby,
+		FailbackInterval: time.Duration(*failbackInterval) * time.Second,
+		Connection: config.AgentConnectionConfig{
+			KeepaliveInterval: *keepalive,
+			KeepaliveTimeout:  *keepaliveTimeout,
+			TCPKeepalive:      *tcpKeepalive,
+			DialTimeout:       *dialTimeout,
+			MaxMessageSize:    *maxMessageSize,
+			WriteBufferSize:   *writeBufferSize,
+			ReadBufferSize:    *readBufferSize,
+			Compression:       *compression,
+		},
+	})
+	if err != nil {
+		logger.Fatalf("Failed to initialize agent: %v", err)
+	}
 
-	go func() {
-		for {
-			err := agentClient.ConnectToServer()
-			if err != nil {
-				logger.Errorf("Connection failed: %v", err)
-				logger.Info("Retrying in 10 seconds...")
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			logger.Info("Connection closed, retrying in 5 seconds...")
-			time.Sleep(5 * time.Second)
-		}
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	<-stop
+	if err := agentClient.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Fatalf("Agent stopped: %v", err)
+	}
 	logger.Info("Shutting down agent...")
 }
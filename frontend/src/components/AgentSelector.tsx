@@ -1,6 +1,7 @@
 import React, { useState, useMemo, useCallback } from 'react';
-import { Server, CheckCircle, XCircle, ChevronDown, ChevronUp } from 'lucide-react';
+import { Server, CheckCircle, XCircle, ChevronDown, ChevronUp, Star } from 'lucide-react';
 import { AgentGroupData, Agent } from '../types/yals';
+import { MarkdownNote } from './MarkdownNote';
 
 interface AgentDetailsProps {
   agent: Agent;
@@ -10,25 +11,62 @@ interface AgentDetailsProps {
 const AgentDetails: React.FC<AgentDetailsProps> = React.memo(({ agent, isExpanded }) => {
   if (!isExpanded || !agent.details) return null;
 
+  // e.g. "Example Networks · AS64500 · 10 Gbps"
+  const network = [agent.details.provider, agent.details.asn, agent.details.bandwidth].filter(Boolean).join(' · ');
+  const addresses = [agent.details.ipv4, agent.details.ipv6].filter(Boolean).join(', ');
+
   return (
     <div className="agent-details">
+      {agent.note && <MarkdownNote text={agent.note} className="agent-details-text" />}
       <p className="agent-details-text">
         <span className="font-medium">Test IP:</span> {agent.details.test_ip}
       </p>
       <p className="agent-details-text">
         {agent.details.description}
       </p>
+      {network && (
+        <p className="agent-details-text">{network}</p>
+      )}
+      {addresses && (
+        <p className="agent-details-text">
+          <span className="font-medium">Addresses:</span> {addresses}
+        </p>
+      )}
+      {agent.details.link_url && (
+        <p className="agent-details-text">
+          <a href={agent.details.link_url} target="_blank" rel="noopener noreferrer" className="underline">
+            More about this location
+          </a>
+        </p>
+      )}
     </div>
   );
 });
 
+// AgentLoad marks a node running or queueing commands as busy so users can
+// pick an idle location.
+const AgentLoad: React.FC<{ agent: Agent }> = ({ agent }) => {
+  const active = agent.active_commands || 0;
+  const queued = agent.queued_commands || 0;
+  if (active === 0 && queued === 0) return null;
+
+  const title = queued > 0 ? `${active} running, ${queued} queued` : `${active} running`;
+  return (
+    <span className={`agent-load ${queued > 0 ? 'queued' : ''}`} title={title}>
+      Busy · {active}{queued > 0 ? `+${queued}` : ''}
+    </span>
+  );
+};
+
 interface AgentItemProps {
   agent: Agent;
   isExpanded: boolean;
   isSelected: boolean;
   isOnline: boolean;
   disabled?: boolean;
+  isFavorite?: boolean;
   onToggle: () => void;
+  onToggleFavorite?: () => void;
 }
 
 const AgentItem: React.FC<AgentItemProps> = React.memo(({
@@ -37,7 +75,9 @@ const AgentItem: React.FC<AgentItemProps> = React.memo(({
   isSelected,
   isOnline,
   disabled = false,
-  onToggle
+  isFavorite = false,
+  onToggle,
+  onToggleFavorite
 }) => {
   const StatusIcon = isOnline ? CheckCircle : XCircle;
 
@@ -66,6 +106,20 @@ const AgentItem: React.FC<AgentItemProps> = React.memo(({
             )}
           </div>
         </div>
+        {isOnline && <AgentLoad agent={agent} />}
+        {onToggleFavorite && (
+          <button
+            type="button"
+            className={`agent-favorite ${isFavorite ? 'active' : ''}`}
+            title={isFavorite ? 'Remove from favorites' : 'Add to favorites'}
+            onClick={(e) => {
+              e.stopPropagation();
+              onToggleFavorite();
+            }}
+          >
+            <Star className="w-3.5 h-3.5" />
+          </button>
+        )}
         {isExpanded ? (
           <ChevronUp className="w-4 h-4 u-text-faint ml-2 flex-shrink-0" />
         ) : (
@@ -83,13 +137,18 @@ interface AgentSelectorProps {
   selectedAgent: string | null;
   disabled?: boolean;
   onSelectAgent: (agentName: string) => void;
+  // Favorite agents are listed first and starred (server-side preferences).
+  favorites?: string[];
+  onToggleFavorite?: (agentName: string) => void;
 }
 
 export const AgentSelector: React.FC<AgentSelectorProps> = React.memo(({
   groups,
   selectedAgent,
   disabled = false,
-  onSelectAgent
+  onSelectAgent,
+  favorites,
+  onToggleFavorite
 }) => {
   const [selectedGroup, setSelectedGroup] = useState('all');
   const [expandedAgent, setExpandedAgent] = useState<string | null>(null);
@@ -128,10 +187,22 @@ export const AgentSelector: React.FC<AgentSelectorProps> = React.memo(({
     return groups[selectedGroup] || [];
   }, [groups, selectedGroup]);
 
-  const { onlineAgents, offlineAgents } = useMemo(() => ({
-    onlineAgents: filteredAgents.filter(agent => agent.status === 1),
-    offlineAgents: filteredAgents.filter(agent => agent.status !== 1)
-  }), [filteredAgents]);
+  const groupNote = useMemo(() => {
+    if (selectedGroup === 'all' || !Array.isArray(groups)) return undefined;
+    return groups.find(group => group.name === selectedGroup)?.note;
+  }, [groups, selectedGroup]);
+
+  const { onlineAgents, offlineAgents } = useMemo(() => {
+    const favoriteSet = new Set(favorites || []);
+    const favoritesFirst = (agents: Agent[]) => [
+      ...agents.filter(agent => favoriteSet.has(agent.name)),
+      ...agents.filter(agent => !favoriteSet.has(agent.name))
+    ];
+    return {
+      onlineAgents: favoritesFirst(filteredAgents.filter(agent => agent.status === 1)),
+      offlineAgents: favoritesFirst(filteredAgents.filter(agent => agent.status !== 1))
+    };
+  }, [filteredAgents, favorites]);
 
   const handleAgentToggle = useCallback((agent: Agent) => {
     if (disabled) {
@@ -164,6 +235,8 @@ export const AgentSelector: React.FC<AgentSelectorProps> = React.memo(({
         </select>
       </div>
 
+      {groupNote && <MarkdownNote text={groupNote} className="agent-group-note" />}
+
       {filteredAgents.length === 0 ? (
         <div className="text-center py-6 u-text-muted">
           <p className="text-sm">No nodes available</p>
@@ -178,7 +251,9 @@ export const AgentSelector: React.FC<AgentSelectorProps> = React.memo(({
               isSelected={selectedAgent === agent.name}
               isOnline={true}
               disabled={disabled}
+              isFavorite={favorites?.includes(agent.name)}
               onToggle={() => handleAgentToggle(agent)}
+              onToggleFavorite={onToggleFavorite && (() => onToggleFavorite(agent.name))}
             />
           ))}
 
@@ -195,6 +270,8 @@ export const AgentSelector: React.FC<AgentSelectorProps> = React.memo(({
                   isSelected={selectedAgent === agent.name}
                   isOnline={false}
                   disabled={disabled}
+                  isFavorite={favorites?.includes(agent.name)}
+                  onToggleFavorite={onToggleFavorite && (() => onToggleFavorite(agent.name))}
                   onToggle={() => {
                     if (!disabled) {
                       setExpandedAgent(expandedAgent === agent.name ? null : agent.name);
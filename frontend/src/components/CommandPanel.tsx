@@ -1,6 +1,6 @@
-import React, { useState, useMemo, useCallback } from 'react';
+import React, { useState, useMemo, useCallback, useEffect } from 'react';
 import { Play, Loader2 } from 'lucide-react';
-import { CommandType, CommandConfig, IPVersion } from '../types/yals';
+import { CommandType, CommandConfig, CommandView, IPVersion } from '../types/yals';
 import { AnsiTerminal } from './AnsiTerminal';
 import { getErrorMessage } from '../utils/error';
 
@@ -8,18 +8,46 @@ interface CommandPanelProps {
   selectedAgent: string | null;
   isConnected: boolean;
   activeCommands: Set<string>;
-  onExecuteCommand: (command: CommandType, target: string, ipVersion: IPVersion) => Promise<void>;
+  onExecuteCommand: (command: CommandType, target: string, ipVersion: IPVersion, view?: string) => Promise<void>;
   onStopCommand?: () => void;
   onClearOutput?: () => void;
   latestOutput?: string | null;
+  // GeoJSON export of the last run's route, if it produced one.
+  routeExportUrl?: string | null;
+  // Reports the last run's result as abusive, when there is one.
+  onReport?: () => void;
   streamingOutputs?: Map<string, string>;
   commands: CommandConfig[];
+  defaultCommand?: string;
+  recentTargets?: string[];
+  disclaimers?: Record<string, string>;
 }
 
+// Input hints for the target types the server reports.
+const targetPlaceholders: Record<string, string> = {
+  host: 'Enter an IP address or domain',
+  host_port: 'Enter an IP address or domain, optionally with a port',
+  ip: 'Enter an IP address',
+  domain: 'Enter a domain name',
+  asn: 'Enter an AS number',
+  prefix: 'Enter an IP prefix or address',
+  url: 'Enter an http or https URL',
+  port: 'Enter a port number'
+};
+
 interface CommandOption {
   value: CommandType;
   label: string;
   ignore_target: boolean;
+  target_type?: string;
+  unavailable: boolean;
+  unavailable_reason?: string;
+  example_target?: string;
+  default_target?: string;
+  help_text?: string;
+  category?: string;
+  requires_approval?: boolean;
+  views?: CommandView[];
 }
 
 export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
@@ -29,12 +57,18 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
   onExecuteCommand,
   onStopCommand,
   latestOutput,
+  routeExportUrl,
+  onReport,
   streamingOutputs,
-  commands
+  commands,
+  defaultCommand,
+  recentTargets,
+  disclaimers
 }) => {
-  const [selectedCommand, setSelectedCommand] = useState<CommandType>('ping');
+  const [selectedCommand, setSelectedCommand] = useState<CommandType | null>(null);
   const [target, setTarget] = useState('');
   const [ipVersion, setIpVersion] = useState<IPVersion>('auto');
+  const [selectedView, setSelectedView] = useState('');
   const [queueLimitError, setQueueLimitError] = useState<string | null>(null);
 
   // Convert commands array to CommandOption array (maintains order) - memoized
@@ -42,43 +76,82 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
     (commands || []).map((config) => ({
       value: config.name as CommandType,
       label: config.name.toUpperCase(),
-      ignore_target: config.ignore_target || false
+      ignore_target: config.ignore_target || config.target_type === 'none',
+      target_type: config.target_type,
+      unavailable: config.unavailable || config.available === false,
+      unavailable_reason: config.unavailable_reason,
+      example_target: config.example_target,
+      default_target: config.default_target,
+      help_text: config.help_text,
+      category: config.category,
+      requires_approval: config.requires_approval,
+      views: config.views
     })), [commands]);
 
+  // Commands grouped by their category, groups in order of first appearance.
+  // Uncategorized commands stay ungrouped unless other commands have a category.
+  const commandGroups = useMemo(() => {
+    const groups: { category: string; options: CommandOption[] }[] = [];
+    for (const option of commandOptions) {
+      const category = option.category || '';
+      let group = groups.find(g => g.category === category);
+      if (!group) {
+        group = { category, options: [] };
+        groups.push(group);
+      }
+      group.options.push(option);
+    }
+    return groups;
+  }, [commandOptions]);
+
   // Derive the effective command instead of "fixing up" selectedCommand inside
   // an effect: when the available commands change (e.g. switching agent) and the
-  // current selection is no longer valid, fall back to the first option. The
-  // selectedCommand state still holds the user's explicit choice.
+  // current selection is no longer valid, fall back to the group's default
+  // command (server ui_layout), then to the first runnable option.
+  // The selectedCommand state still holds the user's explicit choice.
   const effectiveCommand = useMemo<CommandType | undefined>(() => {
-    if (commandOptions.some(cmd => cmd.value === selectedCommand)) {
-      return selectedCommand;
+    const runnable = (value: string | null | undefined) =>
+      !!value && commandOptions.some(cmd => cmd.value === value && !cmd.unavailable);
+    if (runnable(selectedCommand)) {
+      return selectedCommand as CommandType;
+    }
+    if (runnable(defaultCommand)) {
+      return defaultCommand as CommandType;
     }
-    return commandOptions[0]?.value;
-  }, [commandOptions, selectedCommand]);
+    return (commandOptions.find(cmd => !cmd.unavailable) ?? commandOptions[0])?.value;
+  }, [commandOptions, selectedCommand, defaultCommand]);
 
   const hasCommands = commandOptions.length > 0;
 
+  // The chosen view applies while the command offers it; otherwise the
+  // command runs as configured.
+  const commandViews = commandOptions.find(cmd => cmd.value === effectiveCommand)?.views ?? [];
+  const effectiveView = commandViews.some(view => view.name === selectedView) ? selectedView : '';
+
   const handleExecute = useCallback(async () => {
     if (!effectiveCommand) return;
     const currentCommand = commandOptions.find(cmd => cmd.value === effectiveCommand);
     const requiresTarget = !currentCommand?.ignore_target;
 
-    if (requiresTarget && !target.trim()) return;
+    if (currentCommand?.unavailable) return;
+    if (requiresTarget && !target.trim() && !currentCommand?.default_target) return;
     if (!selectedAgent || !isConnected) return;
 
     setQueueLimitError(null); // Clear previous error
 
     try {
-      await onExecuteCommand(effectiveCommand, requiresTarget ? target.trim() : '', ipVersion);
+      await onExecuteCommand(effectiveCommand, requiresTarget ? target.trim() : '', ipVersion, effectiveView || undefined);
     } catch (error: unknown) {
       console.error('Command execution failed:', error);
-      // Check if it's a queue limit error
+      // A busy node (queue limit reached) or a node at its own rate limit is
+      // shown as a retry hint
       const message = getErrorMessage(error);
-      if (message.includes('execution limit')) {
+      const code = (error as { code?: string }).code;
+      if (code === 'busy' || code === 'rate_limited' || message.includes('execution limit')) {
         setQueueLimitError(message);
       }
     }
-  }, [commandOptions, effectiveCommand, target, ipVersion, selectedAgent, isConnected, onExecuteCommand]);
+  }, [commandOptions, effectiveCommand, target, ipVersion, effectiveView, selectedAgent, isConnected, onExecuteCommand]);
 
   const handleKeyDown = useCallback((e: React.KeyboardEvent) => {
     if (e.key === 'Enter' && !e.shiftKey) {
@@ -94,10 +167,20 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
   );
   const requiresTarget = !currentCommand?.ignore_target;
 
+  // Prefill the command's default target when switching to it, unless the
+  // user already typed one.
+  const defaultTarget = currentCommand?.default_target;
+  useEffect(() => {
+    if (defaultTarget) {
+      setTarget((prev) => prev.trim() ? prev : defaultTarget);
+    }
+  }, [defaultTarget]);
+
   const commandId = useMemo(() => {
     const sessionId = sessionStorage.getItem('yals_session_id') || '';
-    return `${effectiveCommand ?? ''}-${requiresTarget ? target.trim() : ''}-${selectedAgent}-${sessionId}`;
-  }, [effectiveCommand, requiresTarget, target, selectedAgent]);
+    const effectiveTarget = requiresTarget ? target.trim() || defaultTarget || '' : '';
+    return `${effectiveCommand ?? ''}-${effectiveTarget}-${selectedAgent}-${sessionId}`;
+  }, [effectiveCommand, requiresTarget, target, defaultTarget, selectedAgent]);
   
   const isCommandActive = useMemo(() => 
     activeCommands.has(commandId),
@@ -148,11 +231,24 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
                       className="command-select"
                       disabled={!isConnected || !selectedAgent || isCommandActive}
                     >
-                      {commandOptions.map((cmd) => (
-                        <option key={cmd.value} value={cmd.value}>
-                          {cmd.label}
-                        </option>
-                      ))}
+                      {commandGroups.map((group) => {
+                        const options = group.options.map((cmd) => (
+                          <option
+                            key={cmd.value}
+                            value={cmd.value}
+                            disabled={cmd.unavailable}
+                            title={cmd.unavailable ? cmd.unavailable_reason : cmd.help_text}
+                          >
+                            {cmd.unavailable ? `${cmd.label} (unavailable)` : cmd.label}
+                          </option>
+                        ));
+                        if (commandGroups.length === 1 && !group.category) return options;
+                        return (
+                          <optgroup key={group.category} label={group.category || 'Other'}>
+                            {options}
+                          </optgroup>
+                        );
+                      })}
                     </select>
                   </div>
 
@@ -167,24 +263,55 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
                       <option value="auto">Auto</option>
                       <option value="ipv4">IPv4</option>
                       <option value="ipv6">IPv6</option>
+                      <option value="dual">IPv4 + IPv6</option>
                     </select>
                   </div>
-                </div>
 
-                {/* Target input - takes remaining space */}
-                <div className="command-target-container">
-                  <input
-                    id="target-desktop"
-                    type="text"
-                    value={requiresTarget ? target : ''}
-                    onChange={(e) => requiresTarget && setTarget(e.target.value)}
-                    onKeyDown={requiresTarget ? handleKeyDown : undefined}
-                    placeholder={requiresTarget ? "Enter the target" : "No target required"}
-                    className="command-target-input"
-                    disabled={!requiresTarget || !isConnected || !selectedAgent || isCommandActive}
-                  />
+                  {/* View selector, for commands with several sources or VRFs */}
+                  {commandViews.length > 0 && (
+                    <div className="command-select-container">
+                      <select
+                        value={effectiveView}
+                        onChange={(e) => setSelectedView(e.target.value)}
+                        className="command-select"
+                        title="Where the command runs from"
+                        disabled={!isConnected || !selectedAgent || isCommandActive}
+                      >
+                        <option value="">Default</option>
+                        {commandViews.map(view => (
+                          <option key={view.name} value={view.name}>{view.label || view.name}</option>
+                        ))}
+                      </select>
+                    </div>
+                  )}
                 </div>
 
+                {/* Target input - takes remaining space; hidden for commands
+                    that take no target (ignore_target) */}
+                {requiresTarget && (
+                  <div className="command-target-container">
+                    <input
+                      id="target-desktop"
+                      type="text"
+                      value={target}
+                      onChange={(e) => setTarget(e.target.value)}
+                      onKeyDown={handleKeyDown}
+                      placeholder={defaultTarget
+                        ? `Default: ${defaultTarget}`
+                        : currentCommand?.example_target ? `e.g. ${currentCommand.example_target}`
+                        : targetPlaceholders[currentCommand?.target_type ?? ''] ?? "Enter the target"}
+                      className="command-target-input"
+                      disabled={!isConnected || !selectedAgent || isCommandActive}
+                      list={recentTargets && recentTargets.length > 0 ? 'recent-targets' : undefined}
+                    />
+                    {recentTargets && recentTargets.length > 0 && (
+                      <datalist id="recent-targets">
+                        {recentTargets.map((t) => <option key={t} value={t} />)}
+                      </datalist>
+                    )}
+                  </div>
+                )}
+
                 {/* Execute/Stop button */}
                 <div className="command-button-container">
                   <button
@@ -195,7 +322,7 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
                         handleExecute();
                       }
                     }}
-                    disabled={!isConnected || !selectedAgent || (requiresTarget && !target.trim())}
+                    disabled={!isConnected || !selectedAgent || currentCommand?.unavailable || (requiresTarget && !target.trim() && !defaultTarget)}
                     className={`command-button ${
                       isCommandActive ? 'danger' : 'primary'
                     }`}
@@ -212,6 +339,24 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
             </div>
           )}
 
+          {currentCommand?.help_text && (
+            <div className="command-status">
+              {currentCommand.help_text}
+            </div>
+          )}
+
+          {currentCommand?.requires_approval && (
+            <div className="command-status warning">
+              Each run of this command waits until an operator approves it.
+            </div>
+          )}
+
+          {effectiveCommand && disclaimers?.[effectiveCommand] && (
+            <div className="command-status warning">
+              {disclaimers[effectiveCommand]}
+            </div>
+          )}
+
           {/* Queue limit error message */}
           {queueLimitError && (
             <div className="command-status error">
@@ -230,6 +375,16 @@ export const CommandPanel: React.FC<CommandPanelProps> = React.memo(({
             <div className="terminal-dot yellow"></div>
             <div className="terminal-dot green"></div>
           </div>
+          {routeExportUrl && (
+            <a className="terminal-export" href={routeExportUrl} target="_blank" rel="noopener noreferrer" title="Route as GeoJSON (hops and path)">
+              GeoJSON
+            </a>
+          )}
+          {onReport && (
+            <button type="button" className={`terminal-export${routeExportUrl ? ' terminal-export-next' : ''}`} onClick={onReport} title="Report this result as abusive to the operator">
+              Report
+            </button>
+          )}
         </div>
 
         {/* Terminal Content with ANSI color support */}
@@ -8,8 +8,13 @@ interface LatencyChartProps {
   name: string;
 }
 
-function fmtTime(ts: number): string {
+// fmtTime labels the time axis: the clock, or the date when the chart spans
+// more than two days.
+function fmtTime(ts: number, span: number): string {
   const d = new Date(ts * 1000);
+  if (span > 2 * 86400) {
+    return `${String(d.getMonth() + 1).padStart(2, '0')}-${String(d.getDate()).padStart(2, '0')}`;
+  }
   const hh = String(d.getHours()).padStart(2, '0');
   const mm = String(d.getMinutes()).padStart(2, '0');
   return `${hh}:${mm}`;
@@ -150,7 +155,7 @@ export function LatencyChart({ points, name }: LatencyChartProps) {
     // X positions of lost cycles (recv === 0), for the packet-loss markers.
     const lossXs = points.filter((p) => p.recv === 0).map((p) => xOf(p.ts));
 
-    return { plotL, plotR, plotT, plotB, segments, yTicks, xTicks, ySpan, lossXs, xOf, yOf };
+    return { plotL, plotR, plotT, plotB, segments, yTicks, xTicks, ySpan, tsSpan, lossXs, xOf, yOf };
   }, [stats, width, points, HEIGHT, M_TOP, M_RIGHT, M_BOTTOM, M_LEFT, Y_TICKS, X_TICKS]);
 
   return (
@@ -183,7 +188,7 @@ export function LatencyChart({ points, name }: LatencyChartProps) {
             <g key={`x${i}`}>
               <line x1={t.x} y1={chart.plotB} x2={t.x} y2={chart.plotB + 4} stroke="#d1d5db" strokeWidth={1} />
               <text x={t.x} y={chart.plotB + X_LABEL_DY} textAnchor="middle" className="latency-chart-axis-label">
-                {fmtTime(t.ts)}
+                {fmtTime(t.ts, chart.tsSpan)}
               </text>
             </g>
           ))}
@@ -0,0 +1,58 @@
+import React from 'react';
+
+// MarkdownNote renders an operator's note (server notes) from a small,
+// safe subset of markdown: paragraphs, "-" or "*" lists, **bold**, *italic*,
+// `code` and [links](https://…). Everything else is shown as text; no HTML
+// is ever interpreted.
+
+const INLINE = /(\*\*[^*]+\*\*|`[^`]+`|\[[^\]]+\]\([^)\s]+\)|\*[^*\s][^*]*\*|_[^_\s][^_]*_)/g;
+
+function renderInline(text: string, keyPrefix: string): React.ReactNode[] {
+  return text.split(INLINE).filter(Boolean).map((part, i) => {
+    const key = `${keyPrefix}-${i}`;
+    if (part.startsWith('**') && part.endsWith('**') && part.length > 4) {
+      return <strong key={key}>{part.slice(2, -2)}</strong>;
+    }
+    if (part.startsWith('`') && part.endsWith('`') && part.length > 2) {
+      return <code key={key}>{part.slice(1, -1)}</code>;
+    }
+    const link = /^\[([^\]]+)\]\(([^)\s]+)\)$/.exec(part);
+    if (link) {
+      // Only web links; anything else (javascript:, data:) stays text.
+      if (!/^https?:\/\//i.test(link[2])) return <React.Fragment key={key}>{part}</React.Fragment>;
+      return <a key={key} href={link[2]} target="_blank" rel="noopener noreferrer" className="underline">{link[1]}</a>;
+    }
+    if (((part.startsWith('*') && part.endsWith('*')) || (part.startsWith('_') && part.endsWith('_'))) && part.length > 2) {
+      return <em key={key}>{part.slice(1, -1)}</em>;
+    }
+    return <React.Fragment key={key}>{part}</React.Fragment>;
+  });
+}
+
+export const MarkdownNote: React.FC<{ text: string; className?: string }> = React.memo(({ text, className }) => {
+  const blocks = text.replace(/\r\n/g, '\n').split(/\n\s*\n/).map(block => block.trim()).filter(Boolean);
+  return (
+    <div className={`markdown-note ${className || ''}`}>
+      {blocks.map((block, b) => {
+        const lines = block.split('\n');
+        if (lines.every(line => /^\s*[-*]\s+/.test(line))) {
+          return (
+            <ul key={b}>
+              {lines.map((line, l) => <li key={l}>{renderInline(line.replace(/^\s*[-*]\s+/, ''), `${b}-${l}`)}</li>)}
+            </ul>
+          );
+        }
+        return (
+          <p key={b}>
+            {lines.map((line, l) => (
+              <React.Fragment key={l}>
+                {l > 0 && <br />}
+                {renderInline(line, `${b}-${l}`)}
+              </React.Fragment>
+            ))}
+          </p>
+        );
+      })}
+    </div>
+  );
+});
@@ -1,5 +1,5 @@
-import { useState, useEffect, useCallback, useRef } from 'react';
-import { Agent, AgentCommand, AgentConfigPayload, AgentConfigRecord, CommandResponse, CommandType, CommandHistory, AgentGroupData, CommandConfig, ControlSessionResponse, IPVersion, RuntimeSettings, PluginInfo, StatusItem, ProbeRow, ProbeSeriesPoint, ProbeConfigPayload } from '../types/yals';
+import { useState, useEffect, useCallback, useMemo, useRef } from 'react';
+import { Agent, AgentCommand, AgentConfigPayload, AgentConfigRecord, CommandPreview, CommandResponse, CommandType, CommandHistory, AgentGroupData, CommandConfig, ControlSessionResponse, IPVersion, RuntimeSettings, PluginInfo, StatusItem, StopAllState, ExecutionPause, AbuseReport, PendingApproval, AgentEnrollment, ProbeRow, ProbeSeriesPoint, ProbeConfigPayload, StructuredResult, LegalNotice, ClientPreferences, StoredResult, FeatureFlags, DisplayPreferences } from '../types/yals';
 
 interface UseYalsClientOptions {
   serverUrl?: string;
@@ -35,7 +35,13 @@ const defaultRuntimeSettings: RuntimeSettings = {
   rate_limit: {
     enabled: true,
     max_commands: 10,
-    time_window: 60
+    time_window: 60,
+    shadow: false
+  },
+  legal: {
+    abuse_contact: '',
+    terms_text: '',
+    require_ack: false
   }
 };
 
@@ -45,6 +51,9 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
   const [agents, setAgents] = useState<Agent[]>([]);
   const [selectedAgent, setSelectedAgent] = useState<string | null>(null);
   const [appConfig, setAppConfig] = useState<{ version: string; config: Record<string, string> } | null>(null);
+  const [legalNotice, setLegalNotice] = useState<LegalNotice | null>(null);
+  const [preferences, setPreferences] = useState<ClientPreferences | null>(null);
+  const [features, setFeatures] = useState<FeatureFlags>({});
   const [isConnecting, setIsConnecting] = useState(false);
   const [commands, setCommands] = useState<CommandConfig[]>(() => {
     try {
@@ -94,15 +103,32 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     }
   }, []);
 
-  const buildHeaders = useCallback((headers: Record<string, string> = {}): HeadersInit => headers, []);
+  // A logged-in control session also authenticates the public API, which lifts
+  // the server's anonymous visibility rules (hidden commands/groups).
+  const buildHeaders = useCallback((headers: Record<string, string> = {}): HeadersInit => {
+    const token = sessionStorage.getItem('yals_control_token');
+    return token && !headers.Authorization ? { Authorization: `Bearer ${token}`, ...headers } : headers;
+  }, []);
 
   const mapAgentCommandsToCommandConfigs = useCallback((agentCommands: AgentCommand[]): CommandConfig[] => {
     return agentCommands.map((cmd: AgentCommand) => ({
       name: cmd.name,
       template: cmd.template || '',
       use_plugin: cmd.use_plugin,
-      ignore_target: cmd.ignore_target || false,
-      maxmium_queue: cmd.maxmium_queue
+      ignore_target: cmd.ignore_target || cmd.target_type === 'none',
+      maxmium_queue: cmd.maxmium_queue,
+      maximum_queue: cmd.maximum_queue,
+      target_type: cmd.target_type,
+      weight: cmd.weight,
+      available: cmd.available ?? !cmd.unavailable,
+      unavailable: cmd.unavailable || cmd.available === false,
+      unavailable_reason: cmd.unavailable_reason,
+      example_target: cmd.example_target,
+      default_target: cmd.default_target,
+      help_text: cmd.help_text,
+      category: cmd.category,
+      requires_approval: cmd.requires_approval,
+      views: cmd.views
     }));
   }, []);
 
@@ -127,6 +153,9 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     });
 
     setGroups(data.groups || []);
+    setLegalNotice(data.legal || null);
+    setPreferences(data.preferences || null);
+    setFeatures(data.features || {});
 
     const allAgents: Agent[] = [];
     if (Array.isArray(data.groups)) {
@@ -139,7 +168,10 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     setAgents(allAgents);
 
     if (!selectedAgent && allAgents.length > 0) {
-      const preferredAgent = allAgents.find((agent: Agent) => agent.status === 1) || allAgents[0];
+      // The server suggests the nearest online agent when it geolocates visitors.
+      const preferredAgent = allAgents.find((agent: Agent) => agent.name === data.suggested_agent && agent.status === 1)
+        || allAgents.find((agent: Agent) => agent.status === 1)
+        || allAgents[0];
       setSelectedAgent(preferredAgent.name);
       const agentCommands = preferredAgent.commands as AgentCommand[] | undefined;
       if (agentCommands && Array.isArray(agentCommands)) {
@@ -150,6 +182,22 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     }
   }, [buildHeaders, protocol, serverUrl, selectedAgent, setLocalStorage, mapAgentCommandsToCommandConfigs]);
 
+  // Tells the server the browser's locale and clock, which it uses for the
+  // text it writes itself (footers, summaries, report exports). Best effort:
+  // without it the server keeps its defaults.
+  const sendDisplayPreferences = useCallback((sessionIdParam: string) => {
+    const hour12 = new Intl.DateTimeFormat(undefined, { hour: 'numeric' }).resolvedOptions().hour12;
+    const prefs: DisplayPreferences = { locale: navigator.language };
+    if (hour12 !== undefined) {
+      prefs.time_format = hour12 ? '12h' : '24h';
+    }
+    fetch(`${protocol}//${serverUrl}/api/preferences/display?session_id=${sessionIdParam}`, {
+      method: 'PUT',
+      headers: buildHeaders({ 'Content-Type': 'application/json' }),
+      body: JSON.stringify(prefs)
+    }).catch(() => undefined);
+  }, [protocol, serverUrl, buildHeaders]);
+
   const connect = useCallback(async (): Promise<void> => {
     setIsConnecting(true);
 
@@ -163,6 +211,7 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
 
       setSessionId(currentSessionId);
       await fetchNodesData(currentSessionId);
+      sendDisplayPreferences(currentSessionId);
       setIsConnected(true);
       setIsConnecting(false);
       reconnectAttemptsRef.current = 0;
@@ -184,7 +233,7 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
 
       throw error;
     }
-  }, [fetchNodesData, maxReconnectAttempts, reconnectDelay, sessionId]);
+  }, [fetchNodesData, sendDisplayPreferences, maxReconnectAttempts, reconnectDelay, sessionId]);
 
   // Keep a ref to the latest connect() so the reconnect timer can re-invoke it
   // without the callback depending on (or closing over a stale) version of itself.
@@ -192,6 +241,15 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     connectRef.current = connect;
   }, [connect]);
 
+  // Refresh the node list while connected so the busy indicators stay current.
+  useEffect(() => {
+    if (!isConnected || !sessionId) return;
+    const id = setInterval(() => {
+      fetchNodesData(sessionId).catch((error) => console.error('YALS: Failed to refresh nodes:', error));
+    }, 15000);
+    return () => clearInterval(id);
+  }, [fetchNodesData, isConnected, sessionId]);
+
   useEffect(() => {
     if (selectedAgent) {
       const agent = agents.find((item) => item.name === selectedAgent);
@@ -208,10 +266,105 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     }
   }, [agents, selectedAgent, setLocalStorage, mapAgentCommandsToCommandConfigs]);
 
+  // The server-configured default command of the selected agent's group.
+  const defaultCommand = useMemo(() => {
+    if (!selectedAgent || !Array.isArray(groups)) return undefined;
+    const group = groups.find((g) => g.agents?.some((agent) => agent.name === selectedAgent));
+    return group?.default_command;
+  }, [groups, selectedAgent]);
+
   const clearAllStreamingOutputs = useCallback(() => {
     setStreamingOutputs(new Map());
   }, []);
 
+  // Records that this session accepted the current terms of use; the server
+  // refuses command execution until it has when require_ack is enabled.
+  const acknowledgeTerms = useCallback(async () => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id');
+    if (!currentSessionId || !legalNotice?.terms_version) return;
+
+    const response = await fetch(`${protocol}//${serverUrl}/api/terms/ack?session_id=${currentSessionId}`, {
+      method: 'POST',
+      headers: buildHeaders({ 'Content-Type': 'application/json' }),
+      body: JSON.stringify({ terms_version: legalNotice.terms_version })
+    });
+    if (!response.ok) {
+      throw new Error(`Failed to acknowledge terms: ${response.status}`);
+    }
+    setLegalNotice((prev) => (prev ? { ...prev, acknowledged: true } : prev));
+  }, [sessionId, legalNotice, protocol, serverUrl, buildHeaders]);
+
+  // URL of a stored route result's GeoJSON export. The control panel has no
+  // session of its own, so one is created when missing.
+  const resultGeoJSONUrl = useCallback((resultId: string) => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id') || createSessionId();
+    sessionStorage.setItem('yals_session_id', currentSessionId);
+    return `${protocol}//${serverUrl}/api/results/${encodeURIComponent(resultId)}/geojson?session_id=${currentSessionId}`;
+  }, [sessionId, protocol, serverUrl]);
+
+  // Lists the results this visitor stored, newest first.
+  const listMyResults = useCallback(async (limit = 10): Promise<StoredResult[]> => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id');
+    if (!currentSessionId) return [];
+
+    const response = await fetch(`${protocol}//${serverUrl}/api/results?session_id=${currentSessionId}&limit=${limit}`, {
+      headers: buildHeaders()
+    });
+    if (!response.ok) {
+      throw new Error(`Failed to load results: ${response.status}`);
+    }
+    const data = await response.json();
+    return data.results || [];
+  }, [sessionId, protocol, serverUrl, buildHeaders]);
+
+  // Reports a result as abusive to the operator of this instance.
+  const reportResult = useCallback(async (report: { agent: string; command: string; target: string; result_id?: string; reason: string }) => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id');
+    if (!currentSessionId) return;
+
+    const response = await fetch(`${protocol}//${serverUrl}/api/report?session_id=${currentSessionId}`, {
+      method: 'POST',
+      headers: buildHeaders({ 'Content-Type': 'application/json' }),
+      body: JSON.stringify(report)
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || `Failed to send report: ${response.status}`);
+    }
+  }, [sessionId, protocol, serverUrl, buildHeaders]);
+
+  // Stars or unstars an agent in the server-side preferences.
+  const toggleFavoriteAgent = useCallback(async (agentName: string) => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id');
+    if (!currentSessionId || !preferences) return;
+
+    const favorites = preferences.favorite_agents.includes(agentName)
+      ? preferences.favorite_agents.filter((name) => name !== agentName)
+      : [...preferences.favorite_agents, agentName];
+    const response = await fetch(`${protocol}//${serverUrl}/api/preferences?session_id=${currentSessionId}`, {
+      method: 'PUT',
+      headers: buildHeaders({ 'Content-Type': 'application/json' }),
+      body: JSON.stringify({ favorite_agents: favorites })
+    });
+    if (!response.ok) {
+      throw new Error(`Failed to save favorites: ${response.status}`);
+    }
+    setPreferences(await response.json());
+  }, [sessionId, preferences, protocol, serverUrl, buildHeaders]);
+
+  // Asks the server what a command would run, without running it.
+  const previewCommand = useCallback(async (command: CommandType, target: string, ipVersion: IPVersion = 'auto', view?: string): Promise<CommandPreview> => {
+    const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id') || '';
+    const response = await fetch(`${protocol}//${serverUrl}/api/preview?session_id=${currentSessionId}`, {
+      method: 'POST',
+      headers: buildHeaders({ 'Content-Type': 'application/json' }),
+      body: JSON.stringify({ agent: selectedAgent, command, target: target.trim(), ip_version: ipVersion, view: view || undefined })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()).trim() || `Preview failed: ${response.status}`);
+    }
+    return response.json();
+  }, [sessionId, selectedAgent, protocol, serverUrl, buildHeaders]);
+
   const stopCommand = useCallback(async (commandId: string) => {
     const currentSessionId = sessionId || sessionStorage.getItem('yals_session_id');
     if (!currentSessionId) return;
@@ -241,7 +394,7 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     }
   }, [abortControllers, buildHeaders, protocol, serverUrl, sessionId]);
 
-  const executeCommand = useCallback(async (command: CommandType, target: string, ipVersion: IPVersion = 'auto'): Promise<{ response: CommandResponse; realCommandId: string }> => {
+  const executeCommand = useCallback(async (command: CommandType, target: string, ipVersion: IPVersion = 'auto', view?: string): Promise<{ response: CommandResponse; realCommandId: string }> => {
     if (!isConnected) {
       throw new Error('Not connected to server');
     }
@@ -256,11 +409,19 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
 
     const commandConfig = commands.find((cmd) => cmd.name === command);
     const requiresTarget = !commandConfig?.ignore_target;
-    if (requiresTarget && (!target || target.trim() === '')) {
+    // An empty target falls back to the command's default target.
+    if (requiresTarget && (!target || target.trim() === '') && !commandConfig?.default_target) {
       throw new Error('Target cannot be empty');
     }
 
-    const trimmedTarget = requiresTarget ? target.trim() : '';
+    const trimmedTarget = requiresTarget ? target.trim() || commandConfig?.default_target || '' : '';
+    if (trimmedTarget) {
+      // Mirror the server, which records the target in the preferences.
+      setPreferences((prev) => prev && {
+        ...prev,
+        recent_targets: [trimmedTarget, ...prev.recent_targets.filter((t) => t !== trimmedTarget)].slice(0, 10)
+      });
+    }
     const simpleCommandId = `${command}-${trimmedTarget}-${selectedAgent}-${currentSessionId}`;
     setActiveCommands((prev) => new Set(prev).add(simpleCommandId));
 
@@ -278,6 +439,7 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
 
     return new Promise((resolve, reject) => {
       let accumulatedOutput = '';
+      const structuredData: StructuredResult[] = [];
       const abortController = new AbortController();
       setAbortControllers((prev) => new Map(prev).set(simpleCommandId, abortController));
 
@@ -291,12 +453,15 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
           agent: selectedAgent,
           command,
           target: trimmedTarget,
-          ip_version: ipVersion
+          ip_version: ipVersion,
+          view: view || undefined
         }),
         signal: abortController.signal
       }).then(async (response) => {
         if (!response.ok) {
-          throw new Error(`HTTP error! status: ${response.status}`);
+          // 503 carries a readable reason (e.g. the server's web client limit).
+          const detail = response.status === 503 ? (await response.text()).trim() : '';
+          throw new Error(detail || `HTTP error! status: ${response.status}`);
         }
         if (!response.body) {
           throw new Error('Response body is null');
@@ -338,6 +503,13 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
               } else if (message.type === 'error') {
                 accumulatedOutput = message.error || '';
                 setStreamingOutputs((prev) => new Map(prev).set(simpleCommandId, accumulatedOutput));
+              } else if (message.type === 'pending_approval') {
+                // The run waits for an operator; the output area says so
+                // until its first output arrives.
+                accumulatedOutput = `Waiting for an operator to approve this command (until ${new Date(message.expires_at).toLocaleTimeString()})…`;
+                setStreamingOutputs((prev) => new Map(prev).set(simpleCommandId, accumulatedOutput));
+              } else if (message.type === 'data') {
+                if (message.data) structuredData.push(message.data);
               } else if (message.type === 'complete') {
                 const commandResponse: CommandResponse = {
                   success: message.success,
@@ -347,7 +519,14 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
                   output: accumulatedOutput,
                   error: message.error,
                   timestamp: Date.now(),
-                  stopped: message.stopped || false
+                  stopped: message.stopped || false,
+                  data: structuredData.length > 0 ? structuredData : undefined,
+                  as_path: message.as_path,
+                  result_id: message.result_id,
+                  signature: message.signature,
+                  summary: message.summary,
+                  target_ascii: message.target_unicode ? message.target : undefined,
+                  target_unicode: message.target_unicode
                 };
 
                 setCommandHistory((prev) => {
@@ -375,7 +554,9 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
                 if (message.success || message.stopped) {
                   resolve({ response: commandResponse, realCommandId: simpleCommandId });
                 } else {
-                  reject(new Error(message.error || 'Command execution failed'));
+                  // `code` is set when the node refused the command (e.g. 'busy',
+                  // 'unavailable') so callers can show distinct states.
+                  reject(Object.assign(new Error(message.error || 'Command execution failed'), { code: message.code as string | undefined }));
                 }
                 return;
               }
@@ -636,6 +817,132 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     return data;
   }, [buildHeaders, controlHeaders, protocol, serverUrl]);
 
+  // Reads (GET), fires (POST) or lifts (DELETE) the stop-all kill switch.
+  const controlStopAll = useCallback(async (method: 'GET' | 'POST' | 'DELETE', payload?: { pause: boolean; reason: string }) => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/stop-all`, {
+      method,
+      headers: buildHeaders({
+        'Content-Type': 'application/json',
+        ...controlHeaders()
+      }),
+      body: payload ? JSON.stringify(payload) : undefined
+    });
+
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Stop-all request failed');
+    }
+
+    return await response.json() as StopAllState;
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  // Lists (GET), sets (POST) or lifts (DELETE) an execution pause; every call
+  // returns the resulting list.
+  // Lists abuse reports (status 'all' for every one), or sets the status of
+  // or deletes one.
+  const controlReports = useCallback(async (status: string = 'open'): Promise<AbuseReport[]> => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/reports?status=${encodeURIComponent(status)}`, {
+      method: 'GET',
+      headers: buildHeaders({ Accept: 'application/json', ...controlHeaders() })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to load reports');
+    }
+    const data = await response.json() as { reports: AbuseReport[] };
+    return data.reports || [];
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const updateReport = useCallback(async (id: number, status: AbuseReport['status'] | 'delete') => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/reports/${id}`, {
+      method: status === 'delete' ? 'DELETE' : 'PUT',
+      headers: buildHeaders({ 'Content-Type': 'application/json', ...controlHeaders() }),
+      body: status === 'delete' ? undefined : JSON.stringify({ status })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to update report');
+    }
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const controlApprovals = useCallback(async (): Promise<PendingApproval[]> => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/approvals`, {
+      method: 'GET',
+      headers: buildHeaders({ Accept: 'application/json', ...controlHeaders() })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to load approvals');
+    }
+    const data = await response.json() as { approvals: PendingApproval[] };
+    return data.approvals || [];
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const decideApproval = useCallback(async (id: string, decision: 'approve' | 'deny') => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/approvals/${encodeURIComponent(id)}`, {
+      method: 'PUT',
+      headers: buildHeaders({ 'Content-Type': 'application/json', ...controlHeaders() }),
+      body: JSON.stringify({ decision })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to decide the approval');
+    }
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const controlEnrollments = useCallback(async (): Promise<{ enabled: boolean; enrollments: AgentEnrollment[] }> => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/enrollments`, {
+      method: 'GET',
+      headers: buildHeaders({ Accept: 'application/json', ...controlHeaders() })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to load enrollments');
+    }
+    const data = await response.json() as { enabled: boolean; enrollments: AgentEnrollment[] };
+    return { enabled: data.enabled, enrollments: data.enrollments || [] };
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  // createEnrollment returns the new code, which the server shows only once.
+  const createEnrollment = useCallback(async (options: { label: string; name?: string; group?: string; commands_from?: string }): Promise<string> => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/enrollments`, {
+      method: 'POST',
+      headers: buildHeaders({ 'Content-Type': 'application/json', ...controlHeaders() }),
+      body: JSON.stringify(options)
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to create the enrollment code');
+    }
+    const data = await response.json() as { code: string };
+    return data.code;
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const updateEnrollment = useCallback(async (id: string, decision: 'approve' | 'deny' | 'delete', name?: string) => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/enrollments/${encodeURIComponent(id)}`, {
+      method: decision === 'delete' ? 'DELETE' : 'PUT',
+      headers: buildHeaders({ 'Content-Type': 'application/json', ...controlHeaders() }),
+      body: decision === 'delete' ? undefined : JSON.stringify({ decision, name })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to update the enrollment');
+    }
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const controlPauses = useCallback(async (method: 'GET' | 'POST' | 'DELETE', pause?: ExecutionPause) => {
+    const query = method === 'DELETE' && pause
+      ? `?scope=${encodeURIComponent(pause.scope)}&name=${encodeURIComponent(pause.name || '')}`
+      : '';
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/pauses${query}`, {
+      method,
+      headers: buildHeaders({
+        'Content-Type': 'application/json',
+        ...controlHeaders()
+      }),
+      body: method === 'POST' ? JSON.stringify(pause) : undefined
+    });
+
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Pause request failed');
+    }
+
+    const data = await response.json() as { pauses: ExecutionPause[] };
+    return data.pauses || [];
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
   const saveManagedAgent = useCallback(async (payload: AgentConfigPayload) => {
     const isUpdate = !!payload.uuid;
     const url = isUpdate
@@ -685,6 +992,44 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     await listManagedAgents();
   }, [buildHeaders, controlHeaders, listManagedAgents, protocol, serverUrl]);
 
+  // Deleted agents are kept until purged and can be restored.
+  const listDeletedAgents = useCallback(async (): Promise<AgentConfigRecord[]> => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/agents/deleted`, {
+      method: 'GET',
+      headers: buildHeaders({ Accept: 'application/json', ...controlHeaders() })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to load deleted agents');
+    }
+    return await response.json() as AgentConfigRecord[];
+  }, [buildHeaders, controlHeaders, protocol, serverUrl]);
+
+  const updateDeletedAgent = useCallback(async (uuid: string, action: 'restore' | 'purge') => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/agents/deleted/${uuid}`, {
+      method: action === 'restore' ? 'POST' : 'DELETE',
+      headers: buildHeaders(controlHeaders())
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || `Failed to ${action} agent`);
+    }
+    if (action === 'restore') {
+      await listManagedAgents();
+    }
+  }, [buildHeaders, controlHeaders, listManagedAgents, protocol, serverUrl]);
+
+  // Renames an agent, or with merge adds its history to another agent.
+  const renameAgent = useCallback(async (from: string, to: string, merge: boolean) => {
+    const response = await fetch(`${protocol}//${serverUrl}/api/control/agents/rename`, {
+      method: 'POST',
+      headers: buildHeaders({ 'Content-Type': 'application/json', ...controlHeaders() }),
+      body: JSON.stringify({ from, to, merge })
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()) || 'Failed to rename agent');
+    }
+    await listManagedAgents();
+  }, [buildHeaders, controlHeaders, listManagedAgents, protocol, serverUrl]);
+
   useEffect(() => {
     if (isControlPage) {
       // Only validate a stored control session here. Loading the control-plane
@@ -705,7 +1050,17 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     activeCommands,
     streamingOutputs,
     appConfig,
+    legalNotice,
+    acknowledgeTerms,
     commands,
+    defaultCommand,
+    preferences,
+    features,
+    toggleFavoriteAgent,
+    resultGeoJSONUrl,
+    listMyResults,
+    reportResult,
+    previewCommand,
     commandHistory,
     connect,
     executeCommand,
@@ -731,8 +1086,20 @@ export const useYalsClient = (options: UseYalsClientOptions = {}) => {
     saveProbeTargets,
     fetchRuntimeSettings,
     saveRuntimeSettings,
+    controlStopAll,
+    controlPauses,
+    controlReports,
+    updateReport,
+    controlApprovals,
+    decideApproval,
+    controlEnrollments,
+    createEnrollment,
+    updateEnrollment,
     saveManagedAgent,
     saveAgentOrder,
-    deleteManagedAgent
+    deleteManagedAgent,
+    listDeletedAgents,
+    updateDeletedAgent,
+    renameAgent
   };
 };
@@ -1,8 +1,8 @@
 import { useEffect, useState } from 'react';
-import { Plus, Save, Trash2, Shield, Server, Settings, ChevronUp, ChevronDown, LogOut, Pencil, X, Activity, Home, Download, Copy, Check, Menu, Sun, Moon } from 'lucide-react';
+import { Plus, Save, Trash2, Shield, Server, Settings, ChevronUp, ChevronDown, LogOut, Pencil, X, Activity, Home, Download, Copy, Check, Menu, Sun, Moon, OctagonX, Play, Pause, Flag, ShieldCheck, RotateCcw, GitMerge, UserPlus } from 'lucide-react';
 import { useTheme } from '../hooks/useTheme';
 import { useYalsClient } from '../hooks/useYalsClient';
-import { AgentCommand, AgentConfigPayload, AgentConfigRecord, RuntimeSettings, ProbeTarget } from '../types/yals';
+import { AgentCommand, AgentConfigPayload, CommandView, AgentConfigRecord, RuntimeSettings, ProbeTarget, ExecutionPause, AbuseReport, PendingApproval, AgentEnrollment } from '../types/yals';
 import { getErrorMessage } from '../utils/error';
 
 const createEmptyAgent = (): AgentConfigPayload => ({
@@ -13,7 +13,13 @@ const createEmptyAgent = (): AgentConfigPayload => ({
     location: '',
     datacenter: '',
     test_ip: '',
-    description: ''
+    description: '',
+    provider: '',
+    asn: '',
+    bandwidth: '',
+    ipv4: '',
+    ipv6: '',
+    link_url: ''
   },
   commands: [
     {
@@ -33,6 +39,34 @@ function getCommandMode(command: AgentCommand): 'shell' | 'plugin' {
   return command.use_plugin ? 'plugin' : 'shell';
 }
 
+// parseEnvInput turns the "KEY=value KEY=value" text of the command editor
+// into a template's env map; words without "=" are dropped.
+function parseEnvInput(text: string): Record<string, string> | undefined {
+  const env: Record<string, string> = {};
+  for (const word of text.split(/\s+/)) {
+    const eq = word.indexOf('=');
+    if (eq > 0) env[word.slice(0, eq)] = word.slice(eq + 1);
+  }
+  return Object.keys(env).length > 0 ? env : undefined;
+}
+
+// parseViewsInput turns the "name | label | args | vrf; ..." text of the
+// command editor into a template's views; empty parts are left out.
+function parseViewsInput(text: string): CommandView[] | undefined {
+  const views: CommandView[] = [];
+  for (const entry of text.split(';')) {
+    const [name, label, args, vrf] = entry.split('|').map((part) => part.trim());
+    if (!name) continue;
+    views.push({ name, label: label || undefined, args: args || undefined, vrf: vrf || undefined });
+  }
+  return views.length > 0 ? views : undefined;
+}
+
+// formatViewsInput is the editor text of views (see parseViewsInput).
+function formatViewsInput(views: CommandView[] | undefined): string {
+  return (views || []).map((view) => [view.name, view.label || '', view.args || '', view.vrf || ''].join(' | ').replace(/( \| )+$/, '')).join('; ');
+}
+
 // validateAgentForm mirrors the server-side checks so the operator gets
 // immediate, precise feedback before a save round-trip. Returns an error message
 // or null when the form is valid.
@@ -65,9 +99,19 @@ function validateAgentForm(agent: AgentConfigPayload): string | null {
 // agent host. It pulls install_agent.sh from the repo and runs it with this
 // server's address (derived from the panel's own URL) plus the agent's uuid/token.
 function buildInstallCommand(uuid: string, token: string): string {
+  return `${installCommandPrefix()} --uuid ${uuid} --token ${token}`;
+}
+
+// buildEnrollCommand is the installer of an agent that enrolls with a
+// one-time code instead of a uuid/token.
+function buildEnrollCommand(code: string): string {
+  return `${installCommandPrefix()} --enroll ${code}`;
+}
+
+function installCommandPrefix(): string {
   const host = window.location.hostname || 'example.com';
   const port = window.location.port || (window.location.protocol === 'https:' ? '443' : '80');
-  return `curl -fsSL https://raw.githubusercontent.com/TogawaSakiko363/YALS/refs/heads/main/install_agent.sh | sudo bash -s -- --server-host ${host} --server-port ${port} --uuid ${uuid} --token ${token}`;
+  return `curl -fsSL https://raw.githubusercontent.com/TogawaSakiko363/YALS/refs/heads/main/install_agent.sh | sudo bash -s -- --server-host ${host} --server-port ${port}`;
 }
 
 // copyToClipboard copies text using the async Clipboard API, falling back to a
@@ -112,9 +156,22 @@ export function ControlPanel() {
     saveProbeTargets,
     fetchRuntimeSettings,
     saveRuntimeSettings,
+    controlStopAll,
+    controlPauses,
+    controlReports,
+    updateReport,
+    controlApprovals,
+    decideApproval,
+    controlEnrollments,
+    createEnrollment,
+    updateEnrollment,
+    resultGeoJSONUrl,
     saveManagedAgent,
     saveAgentOrder,
-    deleteManagedAgent
+    deleteManagedAgent,
+    listDeletedAgents,
+    updateDeletedAgent,
+    renameAgent
   } = useYalsClient();
 
   const { resolved: themeResolved, toggle: toggleTheme } = useTheme();
@@ -124,7 +181,7 @@ export function ControlPanel() {
   const [controlMessage, setControlMessage] = useState<string | null>(null);
   const [editingAgent, setEditingAgent] = useState<AgentConfigPayload>(createEmptyAgent());
   const [editingRuntime, setEditingRuntime] = useState<RuntimeSettings>(runtimeSettings);
-  const [controlView, setControlView] = useState<'agents' | 'settings' | 'monitoring'>('agents');
+  const [controlView, setControlView] = useState<'agents' | 'settings' | 'monitoring' | 'reports' | 'approvals' | 'enrollment'>('agents');
   const [drawerOpen, setDrawerOpen] = useState(false);
   const [editingTargets, setEditingTargets] = useState<ProbeTarget[]>([]);
   const [editingInterval, setEditingInterval] = useState(60);
@@ -134,6 +191,15 @@ export function ControlPanel() {
   const [localAgents, setLocalAgents] = useState<AgentConfigRecord[]>([]);
   const [dragIndex, setDragIndex] = useState<number | null>(null);
   const [dragOverIndex, setDragOverIndex] = useState<number | null>(null);
+  const [pauses, setPauses] = useState<ExecutionPause[]>([]);
+  const globalPause = pauses.find((p) => p.scope === 'global');
+  const [reports, setReports] = useState<AbuseReport[]>([]);
+  const [reportFilter, setReportFilter] = useState('open');
+  const [approvals, setApprovals] = useState<PendingApproval[]>([]);
+  const [enrollments, setEnrollments] = useState<AgentEnrollment[]>([]);
+  const [enrollmentEnabled, setEnrollmentEnabled] = useState(true);
+  const [newEnrollCode, setNewEnrollCode] = useState<string | null>(null);
+  const [deletedAgents, setDeletedAgents] = useState<AgentConfigRecord[]>([]);
 
   useEffect(() => {
     setLocalAgents(managedAgents);
@@ -164,7 +230,52 @@ export function ControlPanel() {
       console.error(error);
       setControlError('Failed to load runtime settings');
     });
-  }, [fetchAgentStatuses, fetchProbeTargets, fetchRuntimeSettings, isControlAuthenticated, listManagedAgents, listPlugins]);
+    controlPauses('GET').then(setPauses).catch((error) => console.error(error));
+  }, [controlPauses, fetchAgentStatuses, fetchProbeTargets, fetchRuntimeSettings, isControlAuthenticated, listManagedAgents, listPlugins]);
+
+  // Deleted agents are listed under the agents, reloaded with them.
+  useEffect(() => {
+    if (!isControlAuthenticated || controlView !== 'agents') return;
+    listDeletedAgents().then(setDeletedAgents).catch((error) => console.error(error));
+  }, [controlView, isControlAuthenticated, listDeletedAgents, managedAgents]);
+
+  // Abuse reports are loaded when their view is opened or filtered.
+  useEffect(() => {
+    if (!isControlAuthenticated || controlView !== 'reports') return;
+    controlReports(reportFilter).then(setReports).catch((error) => {
+      console.error(error);
+      setControlError(getErrorMessage(error) || 'Failed to load reports');
+    });
+  }, [controlReports, controlView, isControlAuthenticated, reportFilter]);
+
+  // Runs waiting for approval are polled while their view is open, since the
+  // requesters are waiting on them.
+  useEffect(() => {
+    if (!isControlAuthenticated || controlView !== 'approvals') return;
+    const load = () => controlApprovals().then(setApprovals).catch((error) => {
+      console.error(error);
+      setControlError(getErrorMessage(error) || 'Failed to load approvals');
+    });
+    load();
+    const timer = window.setInterval(load, 5000);
+    return () => window.clearInterval(timer);
+  }, [controlApprovals, controlView, isControlAuthenticated]);
+
+  // Enrolling agents wait on an operator too, so their view is polled the
+  // same way.
+  useEffect(() => {
+    if (!isControlAuthenticated || controlView !== 'enrollment') return;
+    const load = () => controlEnrollments().then((data) => {
+      setEnrollmentEnabled(data.enabled);
+      setEnrollments(data.enrollments);
+    }).catch((error) => {
+      console.error(error);
+      setControlError(getErrorMessage(error) || 'Failed to load enrollments');
+    });
+    load();
+    const timer = window.setInterval(load, 5000);
+    return () => window.clearInterval(timer);
+  }, [controlEnrollments, controlView, isControlAuthenticated]);
 
   useEffect(() => {
     setEditingRuntime(runtimeSettings);
@@ -188,6 +299,90 @@ export function ControlPanel() {
     }
   };
 
+  // The panic button: stops every running command on every agent, and
+  // optionally refuses new executions until they are resumed.
+  const handleStopAll = async () => {
+    const reason = window.prompt('Stop every running command on every agent?\nReason (optional):');
+    if (reason === null) return;
+    const pause = window.confirm('Also pause new executions until you resume them?');
+    try {
+      setControlError(null);
+      const state = await controlStopAll('POST', { pause, reason });
+      setPauses(await controlPauses('GET'));
+      setControlMessage(`Stopped ${state.stopped ?? 0} running command(s) and told ${state.agents ?? 0} agent(s) to stop.`);
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to stop all commands');
+    }
+  };
+
+  const handleUpdateReport = async (report: AbuseReport, status: AbuseReport['status'] | 'delete') => {
+    if (status === 'delete' && !window.confirm(`Delete report #${report.id}?`)) return;
+    try {
+      setControlError(null);
+      await updateReport(report.id, status);
+      setReports(await controlReports(reportFilter));
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to update the report');
+    }
+  };
+
+  const handleDecideApproval = async (approval: PendingApproval, decision: 'approve' | 'deny') => {
+    try {
+      setControlError(null);
+      await decideApproval(approval.id, decision);
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to decide the approval');
+    }
+    setApprovals(await controlApprovals().catch(() => approvals.filter((a) => a.id !== approval.id)));
+  };
+
+  const handleCreateEnrollment = async () => {
+    const label = window.prompt('Create a one-time enrollment code.\nLabel (what the code is for):');
+    if (label === null) return;
+    try {
+      setControlError(null);
+      setNewEnrollCode(await createEnrollment({ label }));
+      setEnrollments((await controlEnrollments()).enrollments);
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to create the enrollment code');
+    }
+  };
+
+  const handleUpdateEnrollment = async (enrollment: AgentEnrollment, decision: 'approve' | 'deny' | 'delete') => {
+    let name: string | undefined;
+    if (decision === 'approve') {
+      const answer = window.prompt('Approve this agent as:', enrollment.name || enrollment.requested_name || '');
+      if (answer === null) return;
+      name = answer;
+    } else if (decision === 'delete' && !window.confirm(`Delete enrollment ${enrollment.label || enrollment.id}?`)) {
+      return;
+    }
+    try {
+      setControlError(null);
+      await updateEnrollment(enrollment.id, decision, name);
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to update the enrollment');
+    }
+    setEnrollments(await controlEnrollments().then((data) => data.enrollments).catch(() => enrollments));
+  };
+
+  // Pauses (or resumes) new executions globally or on one agent; the agent
+  // stays listed and keeps reporting status.
+  const handleTogglePause = async (pause: ExecutionPause, paused: boolean) => {
+    let reason: string | null = '';
+    if (!paused) {
+      reason = window.prompt(`Pause new executions on ${pause.scope === 'global' ? 'all nodes' : pause.name}?\nReason (optional):`);
+      if (reason === null) return;
+    }
+    try {
+      setControlError(null);
+      setPauses(await controlPauses(paused ? 'DELETE' : 'POST', { ...pause, reason }));
+      setControlMessage(paused ? 'Executions resumed.' : 'Executions paused.');
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to change the execution pause');
+    }
+  };
+
   const handleSaveRuntime = async () => {
     try {
       setControlError(null);
@@ -259,7 +454,7 @@ export function ControlPanel() {
       // first plugin and uses its name as the command name (no separate name field).
       const firstPlugin = availablePlugins[0]?.name || '';
       commandsCopy[index] = nextMode === 'plugin'
-        ? { ...current, template: '', use_plugin: firstPlugin, name: firstPlugin }
+        ? { ...current, template: '', use_plugin: firstPlugin, name: firstPlugin, stop_signal: undefined, stop_grace_seconds: undefined, stop_process_group: undefined, work_dir: undefined, env: undefined, env_passthrough: undefined, nice: undefined, io_class: undefined, io_priority: undefined, container: undefined, netns: undefined, views: undefined }
         : { ...current, template: '', use_plugin: '' };
       return { ...prev, commands: commandsCopy };
     });
@@ -321,6 +516,7 @@ export function ControlPanel() {
       name: record.name,
       group: record.group,
       details: record.details,
+      dial_address: record.dial_address,
       commands: record.commands.map((command) => ({
         ...command,
         maxmium_queue: command.maxmium_queue ?? 0
@@ -387,6 +583,30 @@ export function ControlPanel() {
     saveAgentOrder(next.map((a) => a.uuid)).catch((error) => setControlError(getErrorMessage(error)));
   };
 
+  const handleDeletedAgent = async (record: AgentConfigRecord, action: 'restore' | 'purge') => {
+    if (action === 'purge' && !window.confirm(`Permanently delete ${record.name}? It cannot be restored afterwards.`)) return;
+    try {
+      setControlError(null);
+      await updateDeletedAgent(record.uuid, action);
+      setDeletedAgents(await listDeletedAgents());
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || `Failed to ${action} the agent`);
+    }
+  };
+
+  // A replaced PoP's deleted agent hands its history to its successor.
+  const handleMergeAgent = async (record: AgentConfigRecord) => {
+    const target = window.prompt(`Merge the history of ${record.name} into which agent?`)?.trim();
+    if (!target) return;
+    try {
+      setControlError(null);
+      await renameAgent(record.name, target, true);
+      setDeletedAgents(await listDeletedAgents());
+    } catch (error: unknown) {
+      setControlError(getErrorMessage(error) || 'Failed to merge the agent');
+    }
+  };
+
   const handleDeleteAgent = async (uuid?: string) => {
     if (!uuid) return;
     try {
@@ -442,6 +662,15 @@ export function ControlPanel() {
             <button type="button" className={`control-nav-item ${controlView === 'monitoring' ? 'active' : ''}`} onClick={() => setControlView('monitoring')}>
               <Activity className="w-4 h-4" /> Monitoring
             </button>
+            <button type="button" className={`control-nav-item ${controlView === 'reports' ? 'active' : ''}`} onClick={() => setControlView('reports')}>
+              <Flag className="w-4 h-4" /> Reports
+            </button>
+            <button type="button" className={`control-nav-item ${controlView === 'approvals' ? 'active' : ''}`} onClick={() => setControlView('approvals')}>
+              <ShieldCheck className="w-4 h-4" /> Approvals
+            </button>
+            <button type="button" className={`control-nav-item ${controlView === 'enrollment' ? 'active' : ''}`} onClick={() => setControlView('enrollment')}>
+              <UserPlus className="w-4 h-4" /> Enrollment
+            </button>
             <button type="button" className={`control-nav-item ${controlView === 'settings' ? 'active' : ''}`} onClick={() => setControlView('settings')}>
               <Settings className="w-4 h-4" /> Settings
             </button>
@@ -461,10 +690,37 @@ export function ControlPanel() {
 
         <div className="control-content">
           <div className="control-topbar">
-            <h2>{controlView === 'agents' ? 'Agents' : controlView === 'monitoring' ? 'Monitoring' : 'Runtime Settings'}</h2>
+            <h2>{controlView === 'agents' ? 'Agents' : controlView === 'monitoring' ? 'Monitoring' : controlView === 'reports' ? 'Abuse Reports' : controlView === 'approvals' ? 'Pending Approvals' : controlView === 'enrollment' ? 'Agent Enrollment' : 'Runtime Settings'}</h2>
             {controlView === 'agents' && (
-              <button className="command-button primary" onClick={startCreateAgent}>
-                <Plus className="w-4 h-4" /> New Agent
+              <div className="control-row-actions">
+                {globalPause ? (
+                  <button className="command-button" onClick={() => handleTogglePause(globalPause, true)} title={globalPause.reason || undefined}>
+                    <Play className="w-4 h-4" /> Resume Executions
+                  </button>
+                ) : (
+                  <button className="command-button" onClick={() => handleTogglePause({ scope: 'global' }, false)}>
+                    <Pause className="w-4 h-4" /> Pause Executions
+                  </button>
+                )}
+                <button className="command-button danger" onClick={handleStopAll} title="Stop every running command on every agent">
+                  <OctagonX className="w-4 h-4" /> Stop All
+                </button>
+                <button className="command-button primary" onClick={startCreateAgent}>
+                  <Plus className="w-4 h-4" /> New Agent
+                </button>
+              </div>
+            )}
+            {controlView === 'reports' && (
+              <select className="command-select" value={reportFilter} onChange={(e) => setReportFilter(e.target.value)}>
+                <option value="open">Open</option>
+                <option value="resolved">Resolved</option>
+                <option value="dismissed">Dismissed</option>
+                <option value="all">All</option>
+              </select>
+            )}
+            {controlView === 'enrollment' && enrollmentEnabled && (
+              <button className="command-button primary" onClick={handleCreateEnrollment}>
+                <Plus className="w-4 h-4" /> New Code
               </button>
             )}
             {controlView === 'monitoring' && (
@@ -478,6 +734,14 @@ export function ControlPanel() {
             {controlError && !drawerOpen && (
               <div className="command-status error" style={{ marginBottom: '1rem' }}>{controlError}</div>
             )}
+            {controlView === 'agents' && pauses.filter((p) => p.scope !== 'agent').map((p) => (
+              <div key={`${p.scope}:${p.name || ''}`} className="command-status error" style={{ marginBottom: '1rem' }}>
+                Executions are paused on {p.scope === 'global' ? 'all nodes' : `group ${p.name}`}{p.reason ? `: ${p.reason}` : ''}.
+              </div>
+            ))}
+            {controlView === 'agents' && controlMessage && !drawerOpen && (
+              <div className="command-status success" style={{ marginBottom: '1rem' }}>{controlMessage}</div>
+            )}
 
             {controlView === 'agents' ? (
               <div className="control-table-wrap">
@@ -495,6 +759,7 @@ export function ControlPanel() {
                   <tbody>
                     {localAgents.map((record, index) => {
                       const online = nodeStatuses.get(record.name);
+                      const agentPause = pauses.find((p) => p.scope === 'agent' && p.name === record.name);
                       return (
                         <tr
                           key={record.uuid}
@@ -511,9 +776,12 @@ export function ControlPanel() {
                           <td>
                             {online === undefined ? (
                               <span className="u-text-faint">—</span>
+                            ) : !online && record.never_connected ? (
+                              <span className="status-dot offline">Never connected</span>
                             ) : (
                               <span className={`status-dot ${online ? 'online' : 'offline'}`}>{online ? 'Online' : 'Offline'}</span>
                             )}
+                            {agentPause && <span className="u-text-faint" title={agentPause.reason || undefined}> · Paused</span>}
                           </td>
                           <td>{record.commands.length}</td>
                           <td className="u-text-muted">{record.updated_at ? new Date(record.updated_at).toLocaleString() : '—'}</td>
@@ -535,6 +803,15 @@ export function ControlPanel() {
                                   ? <><Check className="w-3.5 h-3.5" /> Copied</>
                                   : <><Download className="w-3.5 h-3.5" /> Install</>}
                               </button>
+                              <button
+                                type="button"
+                                className="control-icon-button"
+                                onClick={() => handleTogglePause(agentPause ?? { scope: 'agent', name: record.name }, !!agentPause)}
+                              >
+                                {agentPause
+                                  ? <><Play className="w-3.5 h-3.5" /> Resume</>
+                                  : <><Pause className="w-3.5 h-3.5" /> Pause</>}
+                              </button>
                               <button type="button" className="control-icon-button" onClick={() => startEditAgent(record)}>
                                 <Pencil className="w-3.5 h-3.5" /> Edit
                               </button>
@@ -553,6 +830,214 @@ export function ControlPanel() {
                     )}
                   </tbody>
                 </table>
+                {deletedAgents.length > 0 && (
+                  <table className="control-table" style={{ marginTop: '1.5rem' }}>
+                    <thead>
+                      <tr>
+                        <th>Deleted agent</th>
+                        <th>Group</th>
+                        <th>Deleted</th>
+                        <th aria-label="Actions"></th>
+                      </tr>
+                    </thead>
+                    <tbody>
+                      {deletedAgents.map((record) => (
+                        <tr key={record.uuid}>
+                          <td className="font-medium u-text">{record.name}</td>
+                          <td>{record.group}</td>
+                          <td className="u-text-muted">{record.deleted_at ? new Date(record.deleted_at).toLocaleString() : '—'}</td>
+                          <td>
+                            <div className="control-row-actions">
+                              <button type="button" className="control-icon-button" onClick={() => handleDeletedAgent(record, 'restore')}>
+                                <RotateCcw className="w-3.5 h-3.5" /> Restore
+                              </button>
+                              <button type="button" className="control-icon-button" onClick={() => handleMergeAgent(record)}>
+                                <GitMerge className="w-3.5 h-3.5" /> Merge
+                              </button>
+                              <button type="button" className="control-icon-button danger" onClick={() => handleDeletedAgent(record, 'purge')}>
+                                <Trash2 className="w-3.5 h-3.5" /> Purge
+                              </button>
+                            </div>
+                          </td>
+                        </tr>
+                      ))}
+                    </tbody>
+                  </table>
+                )}
+              </div>
+            ) : controlView === 'reports' ? (
+              <div className="control-table-wrap">
+                <table className="control-table">
+                  <thead>
+                    <tr>
+                      <th>Reported</th>
+                      <th>Result</th>
+                      <th>Reason</th>
+                      <th>Reporter</th>
+                      <th>Status</th>
+                      <th aria-label="Actions"></th>
+                    </tr>
+                  </thead>
+                  <tbody>
+                    {reports.map((report) => (
+                      <tr key={report.id}>
+                        <td className="u-text-muted">{new Date(report.created_at).toLocaleString()}</td>
+                        <td>
+                          {report.command} on {report.agent}
+                          {report.target && <div className="u-text-faint">{report.target}</div>}
+                          {report.result_id && (
+                            <a href={resultGeoJSONUrl(report.result_id)} target="_blank" rel="noopener noreferrer" className="text-xs">Stored result</a>
+                          )}
+                        </td>
+                        <td className="whitespace-pre-wrap">{report.reason}</td>
+                        <td>{report.reporter_ip}</td>
+                        <td>{report.status}{report.resolved_at && <div className="u-text-faint">{new Date(report.resolved_at).toLocaleString()}</div>}</td>
+                        <td>
+                          <div className="control-row-actions">
+                            {report.status === 'open' ? (
+                              <>
+                                <button type="button" className="control-icon-button" onClick={() => handleUpdateReport(report, 'resolved')}>
+                                  <Check className="w-3.5 h-3.5" /> Resolve
+                                </button>
+                                <button type="button" className="control-icon-button" onClick={() => handleUpdateReport(report, 'dismissed')}>
+                                  <X className="w-3.5 h-3.5" /> Dismiss
+                                </button>
+                              </>
+                            ) : (
+                              <button type="button" className="control-icon-button" onClick={() => handleUpdateReport(report, 'open')}>
+                                Reopen
+                              </button>
+                            )}
+                            <button type="button" className="control-icon-button danger" onClick={() => handleUpdateReport(report, 'delete')}>
+                              <Trash2 className="w-3.5 h-3.5" /> Delete
+                            </button>
+                          </div>
+                        </td>
+                      </tr>
+                    ))}
+                    {reports.length === 0 && (
+                      <tr>
+                        <td colSpan={6} className="control-table-empty">No {reportFilter === 'all' ? '' : `${reportFilter} `}reports.</td>
+                      </tr>
+                    )}
+                  </tbody>
+                </table>
+              </div>
+            ) : controlView === 'approvals' ? (
+              <div className="control-table-wrap">
+                <table className="control-table">
+                  <thead>
+                    <tr>
+                      <th>Requested</th>
+                      <th>Command</th>
+                      <th>Client</th>
+                      <th>Expires</th>
+                      <th aria-label="Actions"></th>
+                    </tr>
+                  </thead>
+                  <tbody>
+                    {approvals.map((approval) => (
+                      <tr key={approval.id}>
+                        <td className="u-text-muted">{new Date(approval.created_at).toLocaleString()}</td>
+                        <td>
+                          {approval.command} on {approval.agent}
+                          {approval.target && <div className="u-text-faint">{approval.target}</div>}
+                        </td>
+                        <td>{approval.client_ip}</td>
+                        <td className="u-text-muted">{new Date(approval.expires_at).toLocaleTimeString()}</td>
+                        <td>
+                          <div className="control-row-actions">
+                            <button type="button" className="control-icon-button" onClick={() => handleDecideApproval(approval, 'approve')}>
+                              <Check className="w-3.5 h-3.5" /> Approve
+                            </button>
+                            <button type="button" className="control-icon-button danger" onClick={() => handleDecideApproval(approval, 'deny')}>
+                              <X className="w-3.5 h-3.5" /> Deny
+                            </button>
+                          </div>
+                        </td>
+                      </tr>
+                    ))}
+                    {approvals.length === 0 && (
+                      <tr>
+                        <td colSpan={5} className="control-table-empty">No runs are waiting for approval.</td>
+                      </tr>
+                    )}
+                  </tbody>
+                </table>
+              </div>
+            ) : controlView === 'enrollment' ? (
+              <div className="space-y-4">
+                {!enrollmentEnabled && (
+                  <div className="command-status error">Enrollment is disabled; set enrollment.enabled in the server's config.yaml to create codes.</div>
+                )}
+                {newEnrollCode && (
+                  <div className="command-status success">
+                    New code <code>{newEnrollCode}</code> (shown once). Install an agent with it:
+                    <div className="control-row-actions" style={{ marginTop: '0.5rem' }}>
+                      <code className="u-text-muted" style={{ wordBreak: 'break-all' }}>{buildEnrollCommand(newEnrollCode)}</code>
+                      <button type="button" className="control-icon-button" onClick={() => copyToClipboard(buildEnrollCommand(newEnrollCode))}>
+                        <Copy className="w-3.5 h-3.5" /> Copy
+                      </button>
+                      <button type="button" className="control-icon-button" onClick={() => setNewEnrollCode(null)}>
+                        <X className="w-3.5 h-3.5" /> Dismiss
+                      </button>
+                    </div>
+                  </div>
+                )}
+                <div className="control-table-wrap">
+                  <table className="control-table">
+                    <thead>
+                      <tr>
+                        <th>Code</th>
+                        <th>Agent</th>
+                        <th>Status</th>
+                        <th>Expires</th>
+                        <th aria-label="Actions"></th>
+                      </tr>
+                    </thead>
+                    <tbody>
+                      {enrollments.map((enrollment) => (
+                        <tr key={enrollment.id}>
+                          <td>
+                            {enrollment.label || enrollment.id}
+                            <div className="u-text-faint">{new Date(enrollment.created_at).toLocaleString()}</div>
+                          </td>
+                          <td>
+                            {enrollment.requested_name || <span className="u-text-faint">not used yet</span>}
+                            {enrollment.remote_ip && <div className="u-text-faint">{enrollment.hostname ? `${enrollment.hostname}, ` : ''}{enrollment.remote_ip}</div>}
+                          </td>
+                          <td title={enrollment.reason || undefined}>
+                            {enrollment.status}
+                            {enrollment.decided_by && <div className="u-text-faint">by {enrollment.decided_by}</div>}
+                          </td>
+                          <td className="u-text-muted">{enrollment.status === 'open' ? new Date(enrollment.expires_at).toLocaleString() : '-'}</td>
+                          <td>
+                            <div className="control-row-actions">
+                              {enrollment.status === 'pending' && (
+                                <>
+                                  <button type="button" className="control-icon-button" onClick={() => handleUpdateEnrollment(enrollment, 'approve')}>
+                                    <Check className="w-3.5 h-3.5" /> Approve
+                                  </button>
+                                  <button type="button" className="control-icon-button danger" onClick={() => handleUpdateEnrollment(enrollment, 'deny')}>
+                                    <X className="w-3.5 h-3.5" /> Deny
+                                  </button>
+                                </>
+                              )}
+                              <button type="button" className="control-icon-button danger" onClick={() => handleUpdateEnrollment(enrollment, 'delete')} title="Delete">
+                                <Trash2 className="w-3.5 h-3.5" />
+                              </button>
+                            </div>
+                          </td>
+                        </tr>
+                      ))}
+                      {enrollments.length === 0 && (
+                        <tr>
+                          <td colSpan={5} className="control-table-empty">No enrollment codes.</td>
+                        </tr>
+                      )}
+                    </tbody>
+                  </table>
+                </div>
               </div>
             ) : controlView === 'monitoring' ? (
               <div className="space-y-4">
@@ -669,6 +1154,24 @@ export function ControlPanel() {
                   <input type="checkbox" checked={editingRuntime.rate_limit.enabled} onChange={(e) => setEditingRuntime({ ...editingRuntime, rate_limit: { ...editingRuntime.rate_limit, enabled: e.target.checked } })} />
                   Enable Rate Limiting
                 </label>
+                <label className="text-sm u-text flex items-center gap-2">
+                  <input type="checkbox" checked={!!editingRuntime.rate_limit.shadow} onChange={(e) => setEditingRuntime({ ...editingRuntime, rate_limit: { ...editingRuntime.rate_limit, shadow: e.target.checked } })} />
+                  Shadow Mode (log and count refusals without enforcing them)
+                </label>
+                <div className="space-y-3">
+                  <div>
+                    <FieldLabel>Abuse Contact</FieldLabel>
+                    <input className="command-target-input" type="text" placeholder="abuse@example.com" value={editingRuntime.legal.abuse_contact} onChange={(e) => setEditingRuntime({ ...editingRuntime, legal: { ...editingRuntime.legal, abuse_contact: e.target.value } })} />
+                  </div>
+                  <div>
+                    <FieldLabel>Terms of Use</FieldLabel>
+                    <textarea className="command-target-input" rows={4} value={editingRuntime.legal.terms_text} onChange={(e) => setEditingRuntime({ ...editingRuntime, legal: { ...editingRuntime.legal, terms_text: e.target.value } })} />
+                  </div>
+                  <label className="text-sm u-text flex items-center gap-2">
+                    <input type="checkbox" checked={editingRuntime.legal.require_ack} onChange={(e) => setEditingRuntime({ ...editingRuntime, legal: { ...editingRuntime.legal, require_ack: e.target.checked } })} />
+                    Require visitors to accept the terms before running commands
+                  </label>
+                </div>
                 {controlMessage && <div className="command-status success">{controlMessage}</div>}
                 <div>
                   <button className="command-button primary" onClick={handleSaveRuntime}>
@@ -717,6 +1220,34 @@ export function ControlPanel() {
                         <FieldLabel>Description</FieldLabel>
                         <input className="command-target-input" placeholder="Description" value={editingAgent.details.description} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, description: e.target.value } }))} />
                       </div>
+                      <div>
+                        <FieldLabel>Provider</FieldLabel>
+                        <input className="command-target-input" placeholder="Provider" value={editingAgent.details.provider || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, provider: e.target.value } }))} />
+                      </div>
+                      <div>
+                        <FieldLabel>ASN</FieldLabel>
+                        <input className="command-target-input" placeholder="AS64500" value={editingAgent.details.asn || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, asn: e.target.value } }))} />
+                      </div>
+                      <div>
+                        <FieldLabel>Bandwidth</FieldLabel>
+                        <input className="command-target-input" placeholder="10 Gbps" value={editingAgent.details.bandwidth || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, bandwidth: e.target.value } }))} />
+                      </div>
+                      <div>
+                        <FieldLabel>IPv4</FieldLabel>
+                        <input className="command-target-input" placeholder="Public IPv4 address" value={editingAgent.details.ipv4 || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, ipv4: e.target.value } }))} />
+                      </div>
+                      <div>
+                        <FieldLabel>IPv6</FieldLabel>
+                        <input className="command-target-input" placeholder="Public IPv6 address" value={editingAgent.details.ipv6 || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, ipv6: e.target.value } }))} />
+                      </div>
+                      <div>
+                        <FieldLabel>Link URL</FieldLabel>
+                        <input className="command-target-input" placeholder="https://www.peeringdb.com/net/…" value={editingAgent.details.link_url || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, details: { ...prev.details, link_url: e.target.value } }))} />
+                      </div>
+                      <div className="md:col-span-2">
+                        <FieldLabel>Dial Address</FieldLabel>
+                        <input className="command-target-input" placeholder="host:port — only for agents started with -listen" value={editingAgent.dial_address || ''} onChange={(e) => setEditingAgent((prev) => ({ ...prev, dial_address: e.target.value }))} />
+                      </div>
                     </div>
 
                     <div className="space-y-2">
@@ -772,12 +1303,70 @@ export function ControlPanel() {
                               </label>
                             )}
                             <label className="command-edit-ignore" title={`Ignore target input${ignoreTargetForced ? ' (set by plugin)' : ''}`}>
-                              <input type="checkbox" checked={ignoreTargetChecked} disabled={ignoreTargetForced} onChange={(e) => updateCommand(index, { ignore_target: e.target.checked })} />
+                              <input type="checkbox" checked={ignoreTargetChecked} disabled={ignoreTargetForced} onChange={(e) => updateCommand(index, e.target.checked ? { ignore_target: true } : { ignore_target: false, cache_seconds: undefined })} />
                               Ignore target
                             </label>
                             <button type="button" className="control-icon-button danger command-edit-remove" onClick={() => removeCommand(index)} title="Remove command">
                               <Trash2 className="w-3.5 h-3.5" />
                             </button>
+                            <div className="command-edit-hints">
+                              <input className="command-target-input command-edit-category" placeholder="Category, e.g. ICMP" value={command.category || ''} onChange={(e) => updateCommand(index, { category: e.target.value })} />
+                              <input className="command-target-input command-edit-example" placeholder="Example target" value={command.example_target || ''} onChange={(e) => updateCommand(index, { example_target: e.target.value })} />
+                              <input className="command-target-input command-edit-example" placeholder="Default target" title="Run when the visitor leaves the target empty" value={command.default_target || ''} onChange={(e) => updateCommand(index, { default_target: e.target.value })} />
+                              <select className="command-select command-edit-target-type" title="Targets the command accepts" disabled={ignoreTargetChecked} value={command.target_type || ''} onChange={(e) => updateCommand(index, { target_type: e.target.value || undefined })}>
+                                <option value="">Host (IP or domain)</option>
+                                <option value="host_port">Host with optional port</option>
+                                <option value="url,host_port">URL or host:port</option>
+                                <option value="ip">IP address</option>
+                                <option value="domain">Domain</option>
+                                <option value="asn">AS number</option>
+                                <option value="prefix">Prefix</option>
+                                <option value="url">URL</option>
+                                <option value="port">Port</option>
+                              </select>
+                              <input className="command-target-input command-edit-weight" type="number" min="1" max="1000" placeholder="Weight (1)" title="Share of the agent's weight budget" value={command.weight ? String(command.weight) : ''} onChange={(e) => updateCommand(index, { weight: Math.max(0, Math.min(1000, Number(e.target.value) || 0)) })} />
+                              {command.ignore_target && (
+                                <input className="command-target-input command-edit-weight" type="number" min="0" max="86400" placeholder="Cache (s)" title="Seconds the agent answers repeated runs with the last result" value={command.cache_seconds ? String(command.cache_seconds) : ''} onChange={(e) => updateCommand(index, { cache_seconds: Math.max(0, Math.min(86400, Number(e.target.value) || 0)) || undefined })} />
+                              )}
+                              {mode === 'shell' && (
+                                <>
+                                  <select className="command-select command-edit-weight" title="Signal sent when a run is stopped" value={command.stop_signal || ''} onChange={(e) => updateCommand(index, { stop_signal: e.target.value || undefined, ...(e.target.value && e.target.value !== 'SIGKILL' ? {} : { stop_grace_seconds: undefined }) })}>
+                                    <option value="">Stop: SIGKILL</option>
+                                    <option value="SIGINT">Stop: SIGINT</option>
+                                    <option value="SIGTERM">Stop: SIGTERM</option>
+                                    <option value="SIGHUP">Stop: SIGHUP</option>
+                                    <option value="SIGQUIT">Stop: SIGQUIT</option>
+                                  </select>
+                                  {command.stop_signal && command.stop_signal !== 'SIGKILL' && (
+                                    <input className="command-target-input command-edit-weight" type="number" min="0" max="300" placeholder="Grace (5s)" title="Seconds a stopped run may take to exit before it is killed" value={command.stop_grace_seconds ? String(command.stop_grace_seconds) : ''} onChange={(e) => updateCommand(index, { stop_grace_seconds: Math.max(0, Math.min(300, Number(e.target.value) || 0)) || undefined })} />
+                                  )}
+                                  <label className="command-edit-ignore" title="Run the command in its own process group and stop the whole group">
+                                    <input type="checkbox" checked={!!command.stop_process_group} onChange={(e) => updateCommand(index, { stop_process_group: e.target.checked || undefined })} />
+                                    Stop group
+                                  </label>
+                                  <input className="command-target-input command-edit-example" placeholder="Working directory" title="Absolute directory the command runs in" value={command.work_dir || ''} onChange={(e) => updateCommand(index, { work_dir: e.target.value || undefined })} />
+                                  <input key={`env-${index}-${command.name}`} className="command-target-input command-edit-example" placeholder="Env, e.g. LC_ALL=C TZ=UTC" title="Environment variables (KEY=value, space separated)" defaultValue={Object.entries(command.env || {}).map(([key, value]) => `${key}=${value}`).join(' ')} onBlur={(e) => updateCommand(index, { env: parseEnvInput(e.target.value) })} />
+                                  <input key={`pass-${index}-${command.name}`} className="command-target-input command-edit-example" placeholder="Pass agent env, e.g. HTTP_PROXY" title="Agent environment variables the command inherits besides PATH, HOME, USER, LANG, TZ and TMPDIR (space separated)" defaultValue={(command.env_passthrough || []).join(' ')} onBlur={(e) => { const names = e.target.value.split(/[\s,]+/).filter(Boolean); updateCommand(index, { env_passthrough: names.length > 0 ? names : undefined }); }} />
+                                  <input className="command-target-input command-edit-weight" type="number" min="0" max="19" placeholder="Nice (0)" title="CPU niceness; higher runs with lower priority" value={command.nice ? String(command.nice) : ''} onChange={(e) => updateCommand(index, { nice: Math.max(0, Math.min(19, Number(e.target.value) || 0)) || undefined })} />
+                                  <select className="command-select command-edit-weight" title="Disk I/O priority" value={command.io_class || ''} onChange={(e) => updateCommand(index, { io_class: e.target.value || undefined, io_priority: undefined })}>
+                                    <option value="">I/O: default</option>
+                                    <option value="best-effort">I/O: best-effort</option>
+                                    <option value="idle">I/O: idle</option>
+                                  </select>
+                                  {command.io_class === 'best-effort' && (
+                                    <input className="command-target-input command-edit-weight" type="number" min="0" max="7" placeholder="I/O level (0)" title="Best-effort level, 0 (highest) to 7 (lowest)" value={command.io_priority ? String(command.io_priority) : ''} onChange={(e) => updateCommand(index, { io_priority: Math.max(0, Math.min(7, Number(e.target.value) || 0)) || undefined })} />
+                                  )}
+                                  <input className="command-target-input command-edit-example" placeholder="Container" title="Run inside this running container (docker exec)" disabled={!!command.netns} value={command.container || ''} onChange={(e) => updateCommand(index, { container: e.target.value.trim() || undefined })} />
+                                  <input className="command-target-input command-edit-example" placeholder="Network namespace" title="Run inside this named network namespace (ip netns exec), e.g. one per VRF" disabled={!!command.container} value={command.netns || ''} onChange={(e) => updateCommand(index, { netns: e.target.value.trim() || undefined })} />
+                                  <input key={`views-${index}-${command.name}`} className="command-target-input command-edit-help" placeholder="Views, e.g. transit-a | Transit A | -I 192.0.2.1; blue | Blue VRF | | blue" title="Views visitors pick from: name | label | args for {view} | VRF, separated by ;" defaultValue={formatViewsInput(command.views)} onBlur={(e) => updateCommand(index, { views: parseViewsInput(e.target.value) })} />
+                                </>
+                              )}
+                              <label className="command-edit-ignore" title="Runs by visitors wait for an operator's approval under Approvals">
+                                <input type="checkbox" checked={!!command.requires_approval} onChange={(e) => updateCommand(index, { requires_approval: e.target.checked || undefined })} />
+                                Needs approval
+                              </label>
+                              <input className="command-target-input command-edit-help" placeholder="Help text shown under the command" value={command.help_text || ''} onChange={(e) => updateCommand(index, { help_text: e.target.value })} />
+                            </div>
                           </div>
                         );
                       })}
@@ -5,13 +5,47 @@ import { PageHeader } from '../components/PageHeader';
 import { PageFooter } from '../components/PageFooter';
 import { CustomConfig } from '../hooks/useCustomConfig';
 import { useYalsClient } from '../hooks/useYalsClient';
-import { CommandType, IPVersion } from '../types/yals';
+import { ASPathSegment, CommandPreview, CommandResponse, CommandType, IPVersion, StoredResult } from '../types/yals';
 import { getErrorMessage } from '../utils/error';
 
 interface LookingGlassProps {
   config: CustomConfig;
 }
 
+// Appends the server's AS-path summary of a trace, e.g.
+// "AS path: AS64500 (2 hops) → AS13335 Cloudflare (3 hops)".
+function appendASPath(output: string, asPath?: ASPathSegment[]): string {
+  if (!asPath || asPath.length === 0) return output;
+  const summary = asPath
+    .map((segment) => `${segment.asn}${segment.owner ? ` ${segment.owner}` : ''} (${segment.hops} ${segment.hops === 1 ? 'hop' : 'hops'})`)
+    .join(' → ');
+  return `${output}\n\nAS path: ${summary}`;
+}
+
+// Appends the server's one-line summary of a throughput test.
+function appendSummary(output: string, summary?: string): string {
+  return summary ? `${output}\n\n${summary}` : output;
+}
+
+// Notes the punycode form an internationalized domain target ran as, e.g.
+// "Target: 例え.jp (xn--r8jz45g.jp)".
+function appendTargetForms(output: string, response: CommandResponse): string {
+  if (!response.target_unicode || !response.target_ascii) return output;
+  return `${output}\n\nTarget: ${response.target_unicode} (${response.target_ascii})`;
+}
+
+// Describes a heavy command's preview for the confirmation prompt.
+function describePreview(preview: CommandPreview): string {
+  const lines = [`${preview.command} on ${preview.agent} is a heavy command (weight ${preview.weight}).`];
+  const target = preview.target_unicode ? `${preview.target_unicode} (${preview.target})` : preview.target;
+  for (const run of preview.runs) {
+    const where = run.address ? `${run.address} (${run.family})` : run.error || target;
+    lines.push(run.command_line ? `${where}: ${run.command_line}` : `Target: ${where || 'none'}`);
+  }
+  lines.push('', 'Run it?');
+  return lines.join('\n');
+}
+
 // The public looking-glass home page: agent picker + command runner. It owns its
 // own client connection, so it is the only place that opens the gRPC-web stream.
 export function LookingGlass({ config }: LookingGlassProps) {
@@ -23,15 +57,41 @@ export function LookingGlass({ config }: LookingGlassProps) {
     activeCommands,
     streamingOutputs,
     commands,
+    defaultCommand,
+    preferences,
+    features,
+    toggleFavoriteAgent,
+    resultGeoJSONUrl,
+    listMyResults,
+    reportResult,
+    previewCommand,
     connect,
     executeCommand,
     setSelectedAgent,
     clearAllStreamingOutputs,
-    stopCommand
+    stopCommand,
+    legalNotice,
+    acknowledgeTerms
   } = useYalsClient();
 
   const isCommandRunning = activeCommands.size > 0;
   const [latestOutput, setLatestOutput] = useState<string | null>(null);
+  const [routeExportUrl, setRouteExportUrl] = useState<string | null>(null);
+  // The last finished run, which the viewer can report as abusive.
+  const [lastRun, setLastRun] = useState<{ agent: string; command: string; target: string; result_id?: string } | null>(null);
+  const [termsError, setTermsError] = useState<string | null>(null);
+  // The visitor's own stored results, for the history panel.
+  const [myResults, setMyResults] = useState<StoredResult[]>([]);
+  const needsTermsAck = !!legalNotice?.require_ack && !legalNotice.acknowledged;
+
+  const handleAcceptTerms = async () => {
+    try {
+      setTermsError(null);
+      await acknowledgeTerms();
+    } catch (error: unknown) {
+      setTermsError(getErrorMessage(error) || 'Failed to accept terms');
+    }
+  };
 
   useEffect(() => {
     if (!isConnected && !isConnecting) {
@@ -42,18 +102,65 @@ export function LookingGlass({ config }: LookingGlassProps) {
     }
   }, [connect, isConnected, isConnecting]);
 
-  const handleExecuteCommand = async (command: CommandType, target: string, ipVersion: IPVersion) => {
+  useEffect(() => {
+    if (isConnected) {
+      listMyResults().then(setMyResults).catch(() => setMyResults([]));
+    }
+  }, [isConnected, listMyResults]);
+
+  const handleExecuteCommand = async (command: CommandType, target: string, ipVersion: IPVersion, view?: string) => {
+    // Heavy commands (weight above 1) are confirmed first, showing what would
+    // run. A failed preview falls through to the run, which reports the error.
+    const weight = commands.find((cmd) => cmd.name === command)?.weight ?? 1;
+    if (weight > 1) {
+      const preview = await previewCommand(command, target, ipVersion, view).catch(() => null);
+      if (preview && !window.confirm(describePreview(preview))) {
+        return;
+      }
+    }
     try {
       setLatestOutput(null);
+      setRouteExportUrl(null);
+      setLastRun(null);
       clearAllStreamingOutputs();
-      const { response } = await executeCommand(command, target, ipVersion);
-      setLatestOutput(response.output || '');
+      const { response } = await executeCommand(command, target, ipVersion, view);
+      // Servers without the structured_results flag predate it and render it.
+      const structured = features.structured_results !== false;
+      const output = structured
+        ? appendSummary(appendASPath(response.output || '', response.as_path), response.summary)
+        : response.output || '';
+      setLatestOutput(appendTargetForms(output, response));
+      setRouteExportUrl(structured && response.result_id ? resultGeoJSONUrl(response.result_id) : null);
+      if (selectedAgent) {
+        setLastRun({ agent: selectedAgent, command, target, result_id: response.result_id });
+      }
+      if (response.result_id) {
+        listMyResults().then(setMyResults).catch(() => undefined);
+      }
     } catch (error: unknown) {
       console.error('Command execution failed:', error);
+      // A busy or rate-limited node is a transient state: let the command
+      // panel show it as a retry hint instead of replacing the output.
+      const code = (error as { code?: string }).code;
+      if (code === 'busy' || code === 'rate_limited') {
+        throw error;
+      }
       setLatestOutput(getErrorMessage(error) || 'Command execution failed');
     }
   };
 
+  const handleReport = async () => {
+    if (!lastRun) return;
+    const reason = window.prompt(`Report this ${lastRun.command} result on ${lastRun.agent} as abusive to the operator?\nReason:`);
+    if (!reason || !reason.trim()) return;
+    try {
+      await reportResult({ ...lastRun, reason: reason.trim() });
+      window.alert('Thank you, the report was sent to the operator.');
+    } catch (error: unknown) {
+      window.alert(getErrorMessage(error) || 'Failed to send the report');
+    }
+  };
+
   const handleStopCommand = () => {
     if (activeCommands.size > 0) {
       const firstActiveCommand = Array.from(activeCommands)[0];
@@ -71,12 +178,32 @@ export function LookingGlass({ config }: LookingGlassProps) {
 
       <main className="main-content">
         <div className="container">
+          {legalNotice && (legalNotice.terms || legalNotice.abuse_contact) && (
+            <div className="u-surface shadow-sm border u-border p-4 rounded-md mb-4 space-y-2">
+              {legalNotice.terms && (
+                <p className="text-sm u-text whitespace-pre-wrap">{legalNotice.terms}</p>
+              )}
+              {legalNotice.abuse_contact && (
+                <p className="text-xs u-text-muted">Abuse contact: {legalNotice.abuse_contact}</p>
+              )}
+              {needsTermsAck && (
+                <button className="command-button primary" onClick={handleAcceptTerms}>
+                  Accept terms of use
+                </button>
+              )}
+              {termsError && <div className="command-status error">{termsError}</div>}
+            </div>
+          )}
           <div className="grid-container">
             <div className="agent-item-container">
               <AgentSelector
                 groups={groups}
                 selectedAgent={selectedAgent}
                 onSelectAgent={setSelectedAgent}
+                favorites={preferences?.favorite_agents}
+                onToggleFavorite={preferences ? (name) => {
+                  toggleFavoriteAgent(name).catch((error) => console.error('Failed to save favorites:', error));
+                } : undefined}
                 disabled={isCommandRunning}
               />
             </div>
@@ -84,20 +211,40 @@ export function LookingGlass({ config }: LookingGlassProps) {
             <div className="command-panel-container">
               <CommandPanel
                 selectedAgent={selectedAgent}
-                isConnected={isConnected}
+                isConnected={isConnected && !needsTermsAck}
                 activeCommands={activeCommands}
                 onExecuteCommand={handleExecuteCommand}
                 onStopCommand={handleStopCommand}
                 onClearOutput={() => {
                   setLatestOutput(null);
+                  setRouteExportUrl(null);
+                  setLastRun(null);
                   clearAllStreamingOutputs();
                 }}
                 latestOutput={latestOutput}
+                routeExportUrl={routeExportUrl}
+                onReport={lastRun ? handleReport : undefined}
                 streamingOutputs={streamingOutputs}
                 commands={commands}
+                defaultCommand={defaultCommand}
+                recentTargets={preferences?.recent_targets}
+                disclaimers={legalNotice?.command_disclaimers}
               />
             </div>
           </div>
+          {myResults.length > 0 && (
+            <div className="u-surface shadow-sm border u-border p-4 rounded-md mt-4">
+              <h2 className="text-sm font-semibold u-text mb-2">My recent results</h2>
+              <ul className="space-y-1">
+                {myResults.map((result) => (
+                  <li key={result.result_id} className="text-xs u-text-muted">
+                    {new Date(result.created_at).toLocaleString()} &middot; {result.command} {result.target} on {result.agent}{' '}
+                    <a href={resultGeoJSONUrl(result.result_id)} target="_blank" rel="noopener noreferrer">GeoJSON</a>
+                  </li>
+                ))}
+              </ul>
+            </div>
+          )}
         </div>
       </main>
 
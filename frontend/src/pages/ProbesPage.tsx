@@ -12,7 +12,7 @@ interface ProbesPageProps {
   config: CustomConfig;
 }
 
-const WINDOWS = ['1h', '6h', '12h', '24h'];
+const WINDOWS = ['1h', '6h', '12h', '24h', '7d', '30d', '1y'];
 
 type SortKey = 'latest' | 'avg' | 'worst' | 'jitter' | 'loss';
 
@@ -52,7 +52,7 @@ function StatusCard({ item }: { item: StatusItem }) {
       </div>
 
       {!item.online || !m ? (
-        <p className="status-card-empty">{item.online ? 'Awaiting metrics…' : 'Offline'}</p>
+        <p className="status-card-empty">{item.online ? 'Awaiting metrics…' : item.never_connected ? 'Provisioned, never connected' : 'Offline'}</p>
       ) : (
         <>
           <MetricBar label="CPU" value={m.cpu_percent} />
@@ -3,6 +3,12 @@ export interface AgentDetails {
   datacenter: string;
   test_ip: string;
   description: string;
+  provider?: string;
+  asn?: string;
+  bandwidth?: string;
+  ipv4?: string;
+  ipv6?: string;
+  link_url?: string;
 }
 
 export interface AgentCommand {
@@ -11,6 +17,51 @@ export interface AgentCommand {
   use_plugin?: string;
   ignore_target?: boolean;
   maxmium_queue?: number;
+  maximum_queue?: number;
+  weight?: number;
+  available?: boolean;
+  unavailable?: boolean;
+  unavailable_reason?: string;
+  example_target?: string;
+  default_target?: string;
+  target_type?: string;
+  help_text?: string;
+  category?: string;
+  // Runs by visitors wait for an operator's approval in the control panel.
+  requires_approval?: boolean;
+  // Seconds the agent reuses the last result (ignore_target commands only).
+  cache_seconds?: number;
+  // How a stopped run of a shell template ends: the signal sent first
+  // (default SIGKILL), seconds before it is killed, and whether the whole
+  // process group is signalled.
+  stop_signal?: string;
+  stop_grace_seconds?: number;
+  stop_process_group?: boolean;
+  // Working directory, environment and CPU/IO priority of a shell template.
+  // A template with env or env_passthrough only inherits PATH, HOME, USER,
+  // LANG, TZ, TMPDIR and the variables named in env_passthrough.
+  work_dir?: string;
+  env?: Record<string, string>;
+  env_passthrough?: string[];
+  nice?: number;
+  io_class?: string;
+  io_priority?: number;
+  // Container (docker exec) or network namespace (ip netns exec) a shell
+  // template runs in on the agent, at most one of the two.
+  container?: string;
+  netns?: string;
+  // Views a visitor may run the command from, e.g. another source address
+  // or VRF; only the control panel sees their args and vrf.
+  views?: CommandView[];
+}
+
+export interface CommandView {
+  name: string;
+  label?: string;
+  // Arguments that replace {view} in the template (or follow its program).
+  args?: string;
+  // VRF the command runs in (ip vrf exec).
+  vrf?: string;
 }
 
 export interface Agent {
@@ -21,6 +72,20 @@ export interface Agent {
   description?: string;
   details?: AgentDetails;
   commands?: AgentCommand[];
+  // Commands running on the node and waiting for its weight budget.
+  active_commands?: number;
+  queued_commands?: number;
+  // Operator's markdown note on the node (server notes).
+  note?: string;
+}
+
+// Proof that a stored result came from the looking glass unchanged; checked
+// with POST /api/results/verify.
+export interface ResultSignature {
+  algorithm: string;
+  key_id: string;
+  value: string;
+  route_sha256: string;
 }
 
 export interface CommandResponse {
@@ -33,8 +98,77 @@ export interface CommandResponse {
   timestamp?: number;
   stopped?: boolean;
   ip_version?: string;
+  data?: StructuredResult[];
+  as_path?: ASPathSegment[];
+  // Id of the stored route, exportable at /api/results/{id}/geojson.
+  result_id?: string;
+  // Signature of the stored route, when the server signs results.
+  signature?: ResultSignature;
+  // One-line summary of a throughput test, in the session's locale and units.
+  summary?: string;
+  // Both forms of an internationalized domain target: what the node ran
+  // (punycode) and how to display it.
+  target_ascii?: string;
+  target_unicode?: string;
 }
 
+export interface RouteHop {
+  ttl: number;
+  ip?: string;
+  hostname?: string;
+  rtt_ms?: number[];
+  asn?: string;
+  country?: string;
+  province?: string;
+  city?: string;
+  owner?: string;
+  isp?: string;
+  lat?: number;
+  lng?: number;
+}
+
+export interface RouteResult {
+  kind: 'route';
+  target: string;
+  hops: RouteHop[];
+}
+
+export interface Iperf3Summary {
+  kind: 'iperf3';
+  protocol: string;
+  reverse?: boolean;
+  duration_sec: number;
+  sender_bps: number;
+  receiver_bps: number;
+  retransmits?: number;
+  jitter_ms?: number;
+  lost_packets?: number;
+  packets?: number;
+  lost_percent?: number;
+}
+
+export interface PingResult {
+  kind: 'ping';
+  target: string;
+  sent: number;
+  received: number;
+  loss_percent: number;
+  min_ms?: number;
+  avg_ms?: number;
+  max_ms?: number;
+  rtt_ms?: number[];
+}
+
+// Run of consecutive trace hops in one AS, sent with the final "complete" event.
+export interface ASPathSegment {
+  asn: string;
+  owner?: string;
+  hops: number;
+}
+
+// Structured results streamed as SSE "data" events; `kind` names the shape.
+export type StructuredResult = RouteResult | Iperf3Summary | PingResult | { kind: string; [key: string]: unknown };
+
 export interface AgentGroup {
   [groupName: string]: Agent[];
 }
@@ -42,6 +176,10 @@ export interface AgentGroup {
 export interface GroupData {
   name: string;
   agents: Agent[];
+  // Command preselected for the group's agents (server ui_layout).
+  default_command?: string;
+  // Operator's markdown note on the group (server notes).
+  note?: string;
 }
 
 export type AgentGroupData = AgentGroup | GroupData[];
@@ -68,6 +206,45 @@ export interface CommandConfig {
   use_plugin?: string;
   ignore_target?: boolean;
   maxmium_queue?: number;
+  // The effective limits and target type reported by the server, with plugin
+  // overrides applied; target_type is "none" for commands without a target.
+  maximum_queue?: number;
+  target_type?: string;
+  weight?: number;
+  available?: boolean;
+  unavailable?: boolean;
+  unavailable_reason?: string;
+  example_target?: string;
+  default_target?: string;
+  help_text?: string;
+  category?: string;
+  requires_approval?: boolean;
+  views?: CommandView[];
+}
+
+// One execution a command preview expects (two for ip_version "dual").
+export interface CommandPreviewRun {
+  ip_version: string;
+  family?: string;
+  address?: string;
+  error?: string;
+  // Only returned to control-panel sessions.
+  command_line?: string;
+}
+
+// What /api/preview says an /api/exec request would run.
+export interface CommandPreview {
+  agent: string;
+  agent_online: boolean;
+  command: string;
+  target: string;
+  target_type: 'ip' | 'domain' | 'none' | 'asn' | 'prefix' | 'url' | 'port';
+  // Display form of an internationalized domain target.
+  target_unicode?: string;
+  ip_version: string;
+  plugin?: string;
+  weight: number;
+  runs: CommandPreviewRun[];
 }
 
 export interface CommandsResponse {
@@ -98,7 +275,55 @@ export interface RuntimeSettings {
     enabled: boolean;
     max_commands: number;
     time_window: number;
+    shadow?: boolean;
   };
+  legal: LegalSettings;
+}
+
+export interface LegalSettings {
+  abuse_contact: string;
+  terms_text: string;
+  require_ack: boolean;
+  command_disclaimers?: Record<string, string>;
+}
+
+// Legal notice delivered with /api/node; acknowledged is per session.
+export interface LegalNotice {
+  abuse_contact?: string;
+  terms?: string;
+  terms_version?: string;
+  require_ack: boolean;
+  acknowledged: boolean;
+  command_disclaimers?: Record<string, string>;
+}
+
+// Server-side favorites and recent targets, keyed by the preferences cookie.
+// Present in /api/node only when the server enables preferences.
+export interface ClientPreferences {
+  favorite_agents: string[];
+  recent_targets: string[];
+}
+
+// How the server writes times, numbers and throughput for this session
+// (/api/preferences/display).
+export interface DisplayPreferences {
+  locale?: string;
+  time_format?: '12h' | '24h';
+  units?: 'bits' | 'bytes';
+}
+
+// Feature flags of the deployment, from /api/node. Frontends check a flag
+// rather than the server version; a missing flag means the server predates it.
+export type FeatureFlags = Record<string, boolean>;
+
+// One of the caller's own stored results (/api/results).
+export interface StoredResult {
+  result_id: string;
+  agent: string;
+  command: string;
+  target?: string;
+  created_at: string;
+  archived?: boolean;
 }
 
 export interface AgentConfigPayload {
@@ -108,15 +333,20 @@ export interface AgentConfigPayload {
   group: string;
   details: AgentDetails;
   commands: AgentCommand[];
+  // host:port the server dials for an agent listening for it (agent -listen).
+  dial_address?: string;
 }
 
 export interface AgentConfigRecord extends AgentConfigPayload {
   uuid: string;
   created_at: string;
   updated_at: string;
+  // Set on deleted agents (/api/control/agents/deleted).
+  deleted_at?: string;
+  never_connected?: boolean;
 }
 
-export type IPVersion = 'auto' | 'ipv4' | 'ipv6';
+export type IPVersion = 'auto' | 'ipv4' | 'ipv6' | 'dual';
 
 export interface PluginInfo {
   name: string;
@@ -146,6 +376,8 @@ export interface StatusItem {
   name: string;
   group: string;
   online: boolean;
+  // Provisioned but not connected yet.
+  never_connected?: boolean;
   metrics?: AgentSystemMetrics;
 }
 
@@ -186,3 +418,73 @@ export interface ProbeConfigPayload {
   interval_sec: number;
   targets: ProbeTarget[];
 }
+
+// A pause of new executions (/api/control/pauses): on every agent, the agents
+// of a group, or one agent; name is the group or agent name.
+export interface ExecutionPause {
+  scope: 'global' | 'group' | 'agent';
+  name?: string;
+  reason?: string;
+  paused_at?: string;
+}
+
+// A viewer's report of a result as abusive (/api/control/reports). permalink
+// is the path of the stored result, when it has one.
+export interface AbuseReport {
+  id: number;
+  result_id?: string;
+  permalink?: string;
+  agent: string;
+  command: string;
+  target: string;
+  reason: string;
+  reporter_ip: string;
+  status: 'open' | 'resolved' | 'dismissed';
+  created_at: string;
+  resolved_at?: string;
+}
+
+// A run of a requires_approval command waiting for an operator
+// (/api/control/approvals).
+export interface PendingApproval {
+  id: string;
+  agent: string;
+  command: string;
+  target: string;
+  client_ip: string;
+  session_id: string;
+  created_at: string;
+  expires_at: string;
+}
+
+// A one-time agent enrollment code and the request of the agent that used it
+// (/api/control/enrollments).
+export interface AgentEnrollment {
+  id: string;
+  label: string;
+  name: string;
+  group: string;
+  commands_from: string;
+  status: 'open' | 'pending' | 'approved' | 'denied';
+  requested_name?: string;
+  hostname?: string;
+  remote_ip?: string;
+  agent_uuid?: string;
+  decided_by?: string;
+  reason?: string;
+  created_at: string;
+  expires_at: string;
+  requested_at?: string;
+  decided_at?: string;
+}
+
+// State of the stop-all kill switch (/api/control/stop-all).
+export interface StopAllState {
+  success: boolean;
+  // Set after a stop-all: commands stopped and agents told to kill theirs.
+  stopped?: number;
+  agents?: number;
+  paused: boolean;
+  reason?: string;
+  since?: string;
+}
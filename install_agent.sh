@@ -127,6 +127,15 @@ build_and_install() {
 
 write_service() {
   mkdir -p "$AGENT_DIR"
+  # 使用注册码时，服务器签发的 UUID/token 保存在凭据文件中，之后的启动直接使用它们
+  if [[ -n "$ENROLL_CODE" ]]; then
+    AGENT_IDENTITY="-enroll $ENROLL_CODE -credentials $AGENT_DIR/credentials.yaml"
+    if [[ -n "$AGENT_NAME" ]]; then
+      AGENT_IDENTITY="$AGENT_IDENTITY -name $AGENT_NAME"
+    fi
+  else
+    AGENT_IDENTITY="-u $AGENT_UUID -t $AGENT_TOKEN"
+  fi
   cat > "$SERVICE_FILE" <<EOF
 [Unit]
 Description=YALS Agent
@@ -134,7 +143,7 @@ After=network.target
 
 [Service]
 Type=simple
-ExecStart=$AGENT_BIN -s $SERVER_HOST -p $SERVER_PORT -u $AGENT_UUID -t $AGENT_TOKEN
+ExecStart=$AGENT_BIN -s $SERVER_HOST -p $SERVER_PORT $AGENT_IDENTITY
 Restart=always
 RestartSec=5s
 User=root
@@ -150,7 +159,7 @@ if [[ "$1" == "update" ]]; then
   shift
 
   # 更新模式只重建二进制并重启，复用已有的 systemd 服务（其中已含原安装参数），
-  # 因此不需要 --server-host/--server-port/--uuid/--token；仅接受可选的构建源参数。
+  # 因此不需要 --server-host/--server-port/--uuid/--token/--enroll；仅接受可选的构建源参数。
   while [[ $# -gt 0 ]]; do
     case "$1" in
       --repo) REPO_URL="$2"; shift 2;;
@@ -184,20 +193,23 @@ while [[ $# -gt 0 ]]; do
     --server-port) SERVER_PORT="$2"; shift 2;;
     --uuid) AGENT_UUID="$2"; shift 2;;
     --token) AGENT_TOKEN="$2"; shift 2;;
+    --enroll) ENROLL_CODE="$2"; shift 2;;
+    --name) AGENT_NAME="$2"; shift 2;;
     --repo) REPO_URL="$2"; shift 2;;
     --ref) REPO_REF="$2"; shift 2;;
     *)
       echo "未知参数: $1"
       echo "用法示例:"
       echo "  sudo ./install_agent.sh --server-host lg.example.com --server-port 443 --uuid <uuid> --token <token>"
+      echo "  sudo ./install_agent.sh --server-host lg.example.com --server-port 443 --enroll <注册码> [--name <名称>]"
       echo "可选: --repo <git地址或本地路径> --ref <分支/标签> (默认 $REPO_URL / $REPO_REF)"
       exit 1
       ;;
   esac
 done
 
-if [[ -z "$SERVER_HOST" || -z "$SERVER_PORT" || -z "$AGENT_UUID" || -z "$AGENT_TOKEN" ]]; then
-  echo "[ERROR] 缺少必要参数: --server-host, --server-port, --uuid, --token"
+if [[ -z "$SERVER_HOST" || -z "$SERVER_PORT" ]] || [[ -z "$ENROLL_CODE" && ( -z "$AGENT_UUID" || -z "$AGENT_TOKEN" ) ]]; then
+  echo "[ERROR] 缺少必要参数: --server-host, --server-port, 以及 --uuid 和 --token (或 --enroll)"
   exit 1
 fi
 
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// commandSeparators split a shell command line into the simple commands it
+// runs. "||" comes before "|" so that it is not taken for two pipes.
+var commandSeparators = []string{"||", "&&", "|", ";"}
+
+// redirection matches a redirection word, with its operand when written
+// together, e.g. "2>&1", ">/dev/null" or a lone ">".
+var redirection = regexp.MustCompile(`^[0-9]*(&>>|&>|>>|>&|>\||<<<|<<|<&|<>|>|<)(.*)$`)
+
+// shellBuiltins are the commands bash runs itself, with no binary on PATH.
+var shellBuiltins = map[string]bool{
+	":": true, ".": true, "[": true, "[[": true, "alias": true, "break": true,
+	"cd": true, "command": true, "continue": true, "echo": true, "eval": true,
+	"exec": true, "exit": true, "export": true, "false": true, "local": true,
+	"printf": true, "pwd": true, "read": true, "return": true, "set": true,
+	"shift": true, "source": true, "test": true, "trap": true, "true": true,
+	"type": true, "ulimit": true, "umask": true, "unset": true, "wait": true,
+}
+
+// splitShellSegments splits a command line on command separators outside
+// quotes into its pipeline/list segments.
+func splitShellSegments(command string) []string {
+	var segments []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(command); i++ {
+		switch ch := command[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		default:
+			for _, op := range commandSeparators {
+				if strings.HasPrefix(command[i:], op) {
+					segments = append(segments, command[start:i])
+					i += len(op) - 1
+					start = i + 1
+					break
+				}
+			}
+		}
+	}
+	return append(segments, command[start:])
+}
+
+// templateBinaries returns the executables a shell template invokes: the first
+// word of every pipeline/list segment. Leading VAR=value assignments and
+// redirections are skipped, and neither shell builtins nor the {target}
+// placeholder are treated as binaries.
+func templateBinaries(template string) []string {
+	segments := splitShellSegments(template)
+
+	var binaries []string
+	seen := make(map[string]bool)
+	for _, seg := range segments {
+		fields := strings.Fields(seg)
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if m := redirection.FindStringSubmatch(field); m != nil {
+				if m[2] == "" {
+					i++ // the operand is the next word, e.g. "> /dev/null"
+				}
+				continue
+			}
+			if strings.Contains(field, "=") && !strings.HasPrefix(field, "=") {
+				continue // environment assignment, e.g. LANG=C ping
+			}
+			if field == targetPlaceholder || shellBuiltins[field] || seen[field] {
+				break
+			}
+			seen[field] = true
+			binaries = append(binaries, field)
+			break
+		}
+	}
+	return binaries
+}
+
+// commandUnavailableReason checks that the command's template passes linting
+// and that every binary it needs exists and is executable on this host. It
+// returns "" when the command can run.
+func commandUnavailableReason(name string, cmdConfig config.CommandTemplate) string {
+	problems, warnings := lintTemplate(cmdConfig)
+	for _, warning := range warnings {
+		logger.Warnf("Command '%s' template: %s", name, warning)
+	}
+	if len(problems) > 0 {
+		return "template rejected: " + strings.Join(problems, "; ")
+	}
+
+	var binaries []string
+	if cmdConfig.UsePlugin != "" {
+		if _, exists := plugin.GetManager().GetPlugin(cmdConfig.UsePlugin); !exists {
+			return fmt.Sprintf("plugin '%s' is not built into this agent", cmdConfig.UsePlugin)
+		}
+		binaries = plugin.GetPluginRequiredBinaries(cmdConfig.UsePlugin)
+	} else {
+		binaries = priorityBinaries(cmdConfig)
+		// A container has its own binaries and directories.
+		if cmdConfig.Container == "" {
+			binaries = append(templateBinaries(cmdConfig.Template), binaries...)
+			if dir := cmdConfig.WorkDir; dir != "" {
+				if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+					return fmt.Sprintf("working directory '%s' does not exist", dir)
+				}
+			}
+		}
+		if ns := cmdConfig.NetNS; ns != "" {
+			if _, err := os.Stat(filepath.Join(netnsDir, ns)); err != nil {
+				return fmt.Sprintf("network namespace '%s' does not exist", ns)
+			}
+		}
+	}
+
+	for _, bin := range binaries {
+		if _, err := exec.LookPath(bin); err != nil {
+			return fmt.Sprintf("'%s' not found or not executable", bin)
+		}
+	}
+	if name := cmdConfig.Container; name != "" && cmdConfig.UsePlugin == "" {
+		return containerUnavailableReason(name)
+	}
+	return ""
+}
+
+// netnsDir is where ip netns keeps the named network namespaces.
+const netnsDir = "/run/netns"
+
+// containerUnavailableReason asks docker whether the container is running.
+func containerUnavailableReason(name string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "--type", "container", "--format", "{{.State.Running}}", name).Output()
+	if err != nil {
+		return fmt.Sprintf("container '%s' not found", name)
+	}
+	if strings.TrimSpace(string(out)) != "true" {
+		return fmt.Sprintf("container '%s' is not running", name)
+	}
+	return ""
+}
+
+// checkCommandAvailability verifies the binaries behind every loaded command and
+// remembers which ones cannot run, so prepareCommand rejects them with a clear
+// reason. The returned list is reported to the server in command order.
+func (c *Client) checkCommandAvailability() []proto.CommandInfo {
+	commands := c.config.GetAvailableCommands()
+	unavailable := make(map[string]string)
+	infos := make([]proto.CommandInfo, 0, len(commands))
+
+	for _, cmd := range commands {
+		info := proto.CommandInfo{Name: cmd.Name}
+		if cmd.AutoDetected {
+			// The server has never seen this command; send its full definition.
+			info.Template = cmd.Template
+			info.UsePlugin = cmd.UsePlugin
+			info.IgnoreTarget = cmd.IgnoreTarget
+			info.MaximumQueue = cmd.MaximumQueue
+			info.Weight = cmd.Weight
+			info.AutoDetected = true
+			info.ExampleTarget = cmd.ExampleTarget
+			info.HelpText = cmd.HelpText
+			info.Category = cmd.Category
+			info.TargetType = cmd.TargetType
+		}
+		if cmdConfig, ok := c.config.GetCommandConfig(cmd.Name); ok {
+			if reason := commandUnavailableReason(cmd.Name, cmdConfig); reason != "" {
+				info.Unavailable = true
+				info.UnavailableReason = reason
+				unavailable[cmd.Name] = reason
+				logger.Warnf("Command '%s' is unavailable on this host: %s", cmd.Name, reason)
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	c.commandsLock.Lock()
+	c.unavailableCommands = unavailable
+	c.commandsLock.Unlock()
+
+	return infos
+}
+
+// unavailableReason returns why a command cannot run on this host, if it can't.
+func (c *Client) unavailableReason(commandName string) (string, bool) {
+	c.commandsLock.RLock()
+	defer c.commandsLock.RUnlock()
+	reason, ok := c.unavailableCommands[commandName]
+	return reason, ok
+}
+
+// registerDetectedCommands probes for the tools behind config.DefaultCommands
+// and registers a default template for each one installed. Commands the server
+// already defines under the same name are left untouched.
+func (c *Client) registerDetectedCommands() {
+	added := 0
+	for _, def := range config.DefaultCommands {
+		if _, err := exec.LookPath(def.Binary); err != nil {
+			continue
+		}
+		tmpl := def.Template
+		tmpl.AutoDetected = true
+		if c.config.AddCommand(def.Name, tmpl) {
+			added++
+		}
+	}
+	if added > 0 {
+		logger.Infof("Auto-detect registered %d default commands", added)
+	}
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTemplateBinaries(t *testing.T) {
+	for _, tt := range []struct {
+		template string
+		want     []string
+	}{
+		{"ping -c 4 {target}", []string{"ping"}},
+		{"LANG=C mtr -r {target}", []string{"mtr"}},
+		{"traceroute {target} 2>&1", []string{"traceroute"}},
+		{"ping {target} >/dev/null && echo up", []string{"ping"}},
+		{"ping {target} > /dev/null || echo down", []string{"ping"}},
+		{"whois {target} 2>/dev/null | head -n 40", []string{"whois", "head"}},
+		{"</dev/null ssh edge ping {target}", []string{"ssh"}},
+		{"cd /tmp; export LANG=C; ./probe {target}", []string{"./probe"}},
+		{"[ -x /usr/bin/mtr ] && mtr {target}", []string{"mtr"}},
+		{"dig {target} | grep -v '^;' | dig +short {target}", []string{"dig", "grep"}},
+		{"mtr -r {target} &> /dev/null; cat /tmp/mtr.log", []string{"mtr", "cat"}},
+		{"{target}", nil},
+	} {
+		if got := templateBinaries(tt.template); !slices.Equal(got, tt.want) {
+			t.Errorf("templateBinaries(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// resultCache holds the last successful result of ignore_target commands
+// with cache_seconds, such as "show node info", so that a burst of curious
+// visitors runs them once. Entries are keyed by the command's name and
+// definition, so an edited command misses its old result.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResult
+}
+
+// cachedResult is a finished run: the output it ended with and its
+// structured results.
+type cachedResult struct {
+	output   string
+	data     [][]byte
+	cachedAt time.Time
+	expires  time.Time
+}
+
+// cacheable reports whether runs of cmd may be answered from the cache.
+func cacheable(cmd config.CommandTemplate) bool {
+	return cmd.CacheSeconds > 0 && cmd.IgnoreTarget
+}
+
+func cacheKey(name string, cmd config.CommandTemplate) string {
+	return name + "\x00" + cmd.Template + "\x00" + cmd.UsePlugin
+}
+
+// get returns the unexpired result of a command.
+func (rc *resultCache) get(name string, cmd config.CommandTemplate) (cachedResult, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	key := cacheKey(name, cmd)
+	entry, ok := rc.entries[key]
+	if !ok {
+		return cachedResult{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(rc.entries, key)
+		return cachedResult{}, false
+	}
+	return entry, true
+}
+
+// put stores the result of a successful run. Expired entries of other
+// commands are dropped on the way.
+func (rc *resultCache) put(name string, cmd config.CommandTemplate, result cachedResult) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	if rc.entries == nil {
+		rc.entries = make(map[string]cachedResult)
+	}
+	for key, entry := range rc.entries {
+		if now.After(entry.expires) {
+			delete(rc.entries, key)
+		}
+	}
+	result.cachedAt = now
+	result.expires = now.Add(time.Duration(cmd.CacheSeconds) * time.Second)
+	rc.entries[cacheKey(name, cmd)] = result
+}
+
+// cacheNote is appended to a result served from the cache, so that viewers
+// know how old it is.
+func cacheNote(entry cachedResult) string {
+	age := time.Since(entry.cachedAt).Truncate(time.Second)
+	return fmt.Sprintf("\n\n(Cached result from %s ago)", age)
+}
+
+// recordingStream passes a command's messages on to the server and keeps
+// its final result, for the cache.
+type recordingStream struct {
+	proto.AgentService_StreamCommandsClient
+	commandID string
+
+	mu     sync.Mutex
+	result cachedResult
+	failed bool
+}
+
+func (s *recordingStream) Send(msg *proto.CommandMessage) error {
+	if msg.CommandID == s.commandID {
+		s.mu.Lock()
+		switch {
+		case msg.IsError || msg.Error != "":
+			s.failed = true
+		case len(msg.Data) > 0:
+			s.result.data = append(s.result.data, append([]byte(nil), msg.Data...))
+		case msg.Output != "":
+			// Like the server's SSE events, each output message carries the
+			// full text so far.
+			s.result.output = msg.Output
+		}
+		s.mu.Unlock()
+	}
+	return s.AgentService_StreamCommandsClient.Send(msg)
+}
+
+// finished returns the result of a run that did not fail.
+func (s *recordingStream) finished() (cachedResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed || (s.result.output == "" && len(s.result.data) == 0) {
+		return cachedResult{}, false
+	}
+	return s.result, true
+}
+
+// serveCachedResult sends a cached result as the run's output.
+func (c *Client) serveCachedResult(stream proto.AgentService_StreamCommandsClient, commandID string, entry cachedResult) {
+	if entry.output != "" {
+		c.sendOutputGRPC(stream, commandID, entry.output+cacheNote(entry), false)
+	}
+	for _, data := range entry.data {
+		msg := &proto.CommandMessage{
+			Type:      "command_output",
+			CommandID: commandID,
+			Data:      data,
+		}
+		if err := c.streamSend(stream, msg); err != nil {
+			logger.Errorf("Failed to send structured result: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+
+	"golang.org/x/net/icmp"
+)
+
+// How the agent's latency probes send ICMP echo requests, from best to last
+// resort: over a raw socket, over an unprivileged datagram socket, or by
+// running the ping binary (which carries its own privilege).
+const (
+	pingModeRaw          = "raw"
+	pingModeUnprivileged = "unprivileged"
+	pingModeExec         = "exec"
+)
+
+// socketCapabilities is what the host lets the agent do with ICMP sockets,
+// detected once at startup.
+type socketCapabilities struct {
+	rawICMP          bool
+	unprivilegedICMP bool
+}
+
+// detectSocketCapabilities opens, and closes at once, a raw and an
+// unprivileged ICMP socket to learn which ones the host allows.
+func detectSocketCapabilities() socketCapabilities {
+	var caps socketCapabilities
+	if conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		_ = conn.Close()
+		caps.rawICMP = true
+	}
+	if conn, err := icmp.ListenPacket("udp4", "0.0.0.0"); err == nil {
+		_ = conn.Close()
+		caps.unprivilegedICMP = true
+	}
+	return caps
+}
+
+func (s socketCapabilities) pingMode() string {
+	switch {
+	case s.rawICMP:
+		return pingModeRaw
+	case s.unprivilegedICMP:
+		return pingModeUnprivileged
+	default:
+		return pingModeExec
+	}
+}
+
+// list returns the capabilities reported in the handshake.
+func (s socketCapabilities) list() []string {
+	var caps []string
+	if s.rawICMP {
+		caps = append(caps, proto.CapabilityRawICMP)
+	}
+	if s.unprivilegedICMP {
+		caps = append(caps, proto.CapabilityUnprivilegedICMP)
+	}
+	return caps
+}
+
+// capabilities returns what the agent reports in its handshake: its socket
+// capabilities, and that it can send structured results.
+func (c *Client) capabilities() []string {
+	return append(c.sockets.list(), proto.CapabilityStructuredResults)
+}
+
+// logGuidance tells the host's operator which ping mode the probes use and
+// how to grant the agent more.
+func (s socketCapabilities) logGuidance() {
+	switch s.pingMode() {
+	case pingModeRaw:
+		logger.Infof("Raw ICMP sockets available; latency probes use raw ICMP")
+	case pingModeUnprivileged:
+		logger.Infof("No raw socket privilege; latency probes use unprivileged ICMP. " +
+			"Run the agent as root or grant it CAP_NET_RAW (setcap cap_net_raw+ep <agent binary>) for raw ICMP")
+	default:
+		logger.Warnf("Neither raw nor unprivileged ICMP sockets are allowed; latency probes run the ping binary. " +
+			"Grant the agent CAP_NET_RAW (setcap cap_net_raw+ep <agent binary>) or allow unprivileged ICMP " +
+			"(sysctl -w net.ipv4.ping_group_range=\"0 2147483647\")")
+	}
+}
+
+var (
+	pingSentRe = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	pingAvgRe  = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+)
+
+// probeExec pings a target with the host's ping binary, for agents that may
+// open no ICMP socket of their own. The summary lines of iputils, BusyBox
+// and BSD ping are understood; anything else counts as 100% loss.
+func probeExec(t proto.ProbeTargetSpec) proto.ProbeResult {
+	res := proto.ProbeResult{Name: t.Name, Sent: probePingCount}
+	ip := net.ParseIP(t.IP)
+	if ip == nil {
+		return res
+	}
+	binary := "ping"
+	if ip.To4() == nil {
+		if _, err := exec.LookPath("ping6"); err == nil {
+			binary = "ping6"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probePingCount*time.Second+probePingTimeout)
+	defer cancel()
+	// ping exits non-zero when replies were lost; its summary still counts.
+	output, _ := exec.CommandContext(ctx, binary, "-n", "-c", strconv.Itoa(probePingCount), ip.String()).Output()
+
+	counts := pingSentRe.FindSubmatch(output)
+	if counts == nil {
+		return res
+	}
+	res.Sent, _ = strconv.Atoi(string(counts[1]))
+	res.Recv, _ = strconv.Atoi(string(counts[2]))
+	if avg := pingAvgRe.FindSubmatch(output); avg != nil && res.Recv > 0 {
+		res.LatencyMs, _ = strconv.ParseFloat(string(avg[1]), 64)
+	}
+	return res
+}
+
+// RecordCapabilities records the capabilities and ping mode agent uuid
+// reported in its handshake. Agents too old to report a ping mode keep none.
+func (m *Manager) RecordCapabilities(uuid string, capabilities []string, pingMode string) {
+	if pingMode == "" {
+		return
+	}
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if !exists || agent == nil {
+		return
+	}
+	agent.statusLock.Lock()
+	agent.capabilities = append([]string{}, capabilities...)
+	agent.pingMode = pingMode
+	agent.statusLock.Unlock()
+}
+
+// snapshotCapabilities adds an agent's capabilities and the ping_mode of its
+// latency probes to its connection info. Agents that never reported them add
+// nothing.
+func (a *Agent) snapshotCapabilities(info map[string]any) {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	if a.pingMode == "" {
+		return
+	}
+	info["capabilities"] = slices.Clone(a.capabilities)
+	info["ping_mode"] = a.pingMode
+}
+
+// hasCapability reports whether the agent reported capability in its last
+// handshake.
+func (a *Agent) hasCapability(capability string) bool {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	return slices.Contains(a.capabilities, capability)
+}
@@ -0,0 +1,28 @@
+package agent
+
+import (
+	"encoding/json"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// reportCatalog hashes the command catalog now in force, auto-detected
+// commands included, and reports it to the server, which pins it. The next
+// handshake carries the hash as well.
+func (c *Client) reportCatalog(stream proto.AgentService_StreamCommandsClient) {
+	hash := config.CatalogHash(c.config.Commands)
+	if hash != c.catalogHash && c.catalogHash != "" {
+		logger.Infof("Command catalog changed: %s", hash)
+	}
+	c.catalogHash = hash
+
+	data, err := json.Marshal(proto.CatalogReport{Hash: hash, Commands: len(c.config.Commands)})
+	if err != nil {
+		return
+	}
+	if err := c.streamSend(stream, &proto.CommandMessage{Type: "catalog", Data: data}); err != nil {
+		logger.Warnf("Failed to report command catalog: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// clockSkewThreshold is the clock offset past which an agent is reported as
+// skewed. Smaller offsets are within what the handshake can measure.
+const clockSkewThreshold = 5 * time.Second
+
+// agentClock is an agent's clock offset as observed at its last handshake.
+// The server never takes times from agents (messages are stamped on receipt,
+// see HandleAgentConnection); the offset is only shown to operators, since a
+// skewed host clock also skews what its commands print.
+type agentClock struct {
+	mu       sync.Mutex
+	offset   time.Duration
+	measured time.Time
+}
+
+// clockOffset is how far agentTime, read by the agent when it sent a
+// message, is ahead of received, the server's time on receipt. The network
+// delay makes agents look behind by up to one trip; the agent itself corrects
+// for it (see logClockSkew).
+func clockOffset(agentTime, received time.Time) time.Duration {
+	return agentTime.Sub(received).Round(time.Millisecond)
+}
+
+// RecordClockOffset records the clock of agent uuid from the time it sent
+// its handshake (unix milliseconds on its clock; 0 for agents too old to send
+// one) and the time the server received it.
+func (m *Manager) RecordClockOffset(uuid string, sentAt int64, received time.Time) {
+	if sentAt <= 0 {
+		return
+	}
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if !exists || agent == nil {
+		return
+	}
+
+	offset := clockOffset(time.UnixMilli(sentAt), received)
+	agent.clock.mu.Lock()
+	agent.clock.offset = offset
+	agent.clock.measured = received
+	agent.clock.mu.Unlock()
+	if offset.Abs() >= clockSkewThreshold {
+		logger.Warnf("Agent %s clock is off by %s; its timestamps are ignored", agent.Name, offset)
+	}
+}
+
+// snapshot adds the offset to an agent's connection info: clock_offset_ms
+// (positive when the agent is ahead), clock_skewed and clock_measured_at.
+// Agents that never reported their clock add nothing.
+func (c *agentClock) snapshot(info map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.measured.IsZero() {
+		return
+	}
+	info["clock_offset_ms"] = c.offset.Milliseconds()
+	info["clock_skewed"] = c.offset.Abs() >= clockSkewThreshold
+	info["clock_measured_at"] = c.measured.Format("2006-01-02 15:04:05")
+}
+
+// logClockSkew is the agent side of the measurement: from the times it sent
+// the handshake and got the answer and the server's time in it, it estimates
+// its own offset, halving out the round trip, and warns when it is skewed.
+func logClockSkew(sent, answered time.Time, serverTime int64) {
+	if serverTime <= 0 {
+		return
+	}
+	midpoint := sent.Add(answered.Sub(sent) / 2)
+	if offset := clockOffset(midpoint, time.UnixMilli(serverTime)); offset.Abs() >= clockSkewThreshold {
+		logger.Warnf("Local clock is off by %s from the server's; please sync it (e.g. with NTP)", offset)
+	}
+}
@@ -0,0 +1,26 @@
+package agent
+
+import "github.com/TogawaSakiko363/YALS/internal/proto"
+
+// compressingStream sends command output zstd-compressed, once the server
+// has accepted that in the handshake (server.connection.compression).
+type compressingStream struct {
+	proto.AgentService_StreamCommandsClient
+}
+
+func (s compressingStream) Send(msg *proto.CommandMessage) error {
+	if msg.Type != "command_output" || msg.Output == "" {
+		return s.AgentService_StreamCommandsClient.Send(msg)
+	}
+	compressed := *msg
+	proto.CompressOutput(&compressed)
+	return s.AgentService_StreamCommandsClient.Send(&compressed)
+}
+
+// compressionOffer lists the encodings the agent offers in its handshake.
+func (c *Client) compressionOffer() []string {
+	if c.bootConnection.Compression == proto.CompressionZstd {
+		return []string{proto.CompressionZstd}
+	}
+	return nil
+}
@@ -1,21 +1,21 @@
 package agent
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"time"
 
-	"YALS/internal/config"
-	"YALS/internal/logger"
-	"YALS/internal/plugin"
-	"YALS/internal/proto"
-	yalstls "YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -33,86 +33,115 @@ import (
 //
 // This dual trust lets one agent work both directly and behind a public proxy.
 func (c *Client) buildTLSConfig(hostname string) (*tls.Config, error) {
-	builtinDER, err := yalstls.BuiltinCertDER()
+	return yalstls.ClientConfig(hostname)
+}
+
+// ConnectToServer connects to the server and handles the gRPC connection
+func (c *Client) ConnectToServer() error {
+	return c.ConnectToServerContext(context.Background())
+}
+
+// ConnectToServerContext is ConnectToServer bounded by ctx: cancelling it
+// closes the stream and returns.
+func (c *Client) ConnectToServerContext(ctx context.Context) error {
+	conn, err := c.dialServer()
 	if err != nil {
-		return nil, fmt.Errorf("load built-in certificate: %w", err)
+		return err
 	}
+	defer conn.Close()
 
-	return &tls.Config{
-		ServerName:         hostname,
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: true, // default chain check off; replaced by the dual check below
-		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-			if len(rawCerts) == 0 {
-				return fmt.Errorf("server presented no certificate")
-			}
-			// 1) Built-in YALS self-signed certificate (direct deployment).
-			if bytes.Equal(rawCerts[0], builtinDER) {
-				return nil
-			}
-			// 2) Otherwise require a publicly-valid certificate for this host
-			//    (server behind a TLS-terminating proxy / CDN with a real cert).
-			leaf, err := x509.ParseCertificate(rawCerts[0])
-			if err != nil {
-				return fmt.Errorf("parse server certificate: %w", err)
-			}
-			intermediates := x509.NewCertPool()
-			for _, der := range rawCerts[1:] {
-				if ic, parseErr := x509.ParseCertificate(der); parseErr == nil {
-					intermediates.AddCert(ic)
-				}
-			}
-			if _, verifyErr := leaf.Verify(x509.VerifyOptions{
-				DNSName:       hostname,
-				Intermediates: intermediates,
-			}); verifyErr != nil {
-				return fmt.Errorf("server certificate is neither the built-in YALS certificate nor a valid certificate for %q: %w", hostname, verifyErr)
-			}
-			return nil
-		},
-	}, nil
+	logger.Infof("Connected to server successfully")
+	return c.serve(ctx, conn)
 }
 
-// ConnectToServer connects to the server and handles the gRPC connection
-func (c *Client) ConnectToServer() error {
+// dialServer opens the gRPC connection to the server, directly or through
+// the SSH jump host.
+func (c *Client) dialServer() (*grpc.ClientConn, error) {
 	serverAddr := fmt.Sprintf("%s:%d", c.config.Server.Host, c.config.Server.Port)
+	if tunnel := c.sshTunnel; tunnel != nil {
+		logger.Infof("Connecting to server at %s through SSH jump host %s", serverAddr, tunnel)
+	} else {
+		logger.Infof("Connecting to server at %s", serverAddr)
+	}
+	return c.dialAddress(c.config.Server.Host, c.config.Server.Port)
+}
+
+// dialAddress opens a gRPC connection to the server at host and port, the
+// way dialServer does, without logging it.
+func (c *Client) dialAddress(host string, port int) (*grpc.ClientConn, error) {
+	serverAddr := fmt.Sprintf("%s:%d", host, port)
 
 	var opts []grpc.DialOption
 
-	hostname := c.config.Server.Host
+	hostname := host
 	if idx := strings.LastIndex(hostname, ":"); idx != -1 {
 		hostname = hostname[:idx]
 	}
 
 	tlsConfig, err := c.buildTLSConfig(hostname)
 	if err != nil {
-		return fmt.Errorf("failed to build TLS config: %w", err)
+		return nil, fmt.Errorf("failed to build TLS config: %w", err)
 	}
 	creds := credentials.NewTLS(tlsConfig)
 	opts = append(opts, grpc.WithTransportCredentials(creds))
-	opts = append(opts, grpc.WithDefaultCallOptions(grpc.CallContentSubtype("json")))
-	opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
-		Time:                10 * time.Second,
-		Timeout:             3 * time.Second,
-		PermitWithoutStream: true,
-	}))
-
-	logger.Infof("Connecting to server at %s", serverAddr)
+	opts = append(opts, c.streamDialOptions()...)
+
+	if tunnel := c.sshTunnel; tunnel != nil {
+		opts = append(opts, grpc.WithContextDialer(tunnel.dial))
+	} else {
+		dialer := c.netDialer()
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}))
+	}
 	conn, err := grpc.Dial(serverAddr, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
-	defer conn.Close()
+	return conn, nil
+}
 
-	logger.Infof("Connected to server successfully")
+// streamDialOptions are the gRPC options of the connection to the server,
+// whichever side opened it (see config.AgentConnectionConfig).
+func (c *Client) streamDialOptions() []grpc.DialOption {
+	tuning := c.bootConnection
+	return []grpc.DialOption{
+		grpc.WithDefaultCallOptions(
+			grpc.CallContentSubtype("json"),
+			grpc.MaxCallRecvMsgSize(tuning.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(tuning.MaxMessageSize),
+		),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(tuning.KeepaliveInterval) * time.Second,
+			Timeout:             time.Duration(tuning.KeepaliveTimeout) * time.Second,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithWriteBufferSize(tuning.WriteBufferSize),
+		grpc.WithReadBufferSize(tuning.ReadBufferSize),
+	}
+}
+
+// netDialer opens the TCP connections to the server or the jump host.
+func (c *Client) netDialer() net.Dialer {
+	return net.Dialer{
+		Timeout:   time.Duration(c.bootConnection.DialTimeout) * time.Second,
+		KeepAlive: time.Duration(c.bootConnection.TCPKeepalive) * time.Second,
+	}
+}
+
+// serve runs the agent over conn: the handshake, then the command stream until
+// it closes or ctx is cancelled.
+func (c *Client) serve(ctx context.Context, conn *grpc.ClientConn) error {
 	client := proto.NewAgentServiceClient(conn)
 
-	handshakeCtx := metadata.AppendToOutgoingContext(context.Background(), "token", c.config.Server.Token)
-	handshakeReq := &proto.HandshakeRequest{UUID: c.config.Server.UUID, Token: c.config.Server.Token}
+	handshakeCtx := metadata.AppendToOutgoingContext(ctx, "token", c.config.Server.Token)
+	handshakeSent := time.Now()
+	handshakeReq := &proto.HandshakeRequest{UUID: c.config.Server.UUID, Token: c.config.Server.Token, CatalogHash: c.catalogHash, SentAt: handshakeSent.UnixMilli(), Compression: c.compressionOffer(), Capabilities: c.capabilities(), PingMode: c.sockets.pingMode()}
 	handshakeResp, err := client.Handshake(handshakeCtx, handshakeReq)
 	if err != nil {
 		return fmt.Errorf("failed to send handshake: %w", err)
 	}
+	logClockSkew(handshakeSent, time.Now(), handshakeResp.ServerTime)
 	if !handshakeResp.Success {
 		return fmt.Errorf("handshake failed: %s", handshakeResp.Message)
 	}
@@ -135,16 +164,39 @@ func (c *Client) ConnectToServer() error {
 	runtimeConfig.Server.UUID = c.bootUUID
 	runtimeConfig.Server.Token = c.bootToken
 	c.config = config.NormalizeAgentConfig(&runtimeConfig, nil)
+	// Targets are checked again here against the length and character limits
+	// the server pushes. The agent takes them as they come; NewPolicy only caps
+	// the length at validator.MaxTargetLength and falls back to the unicode
+	// charset, so a server can loosen them up to that bound.
+	validator.SetPolicy(validator.NewPolicy(runtimeConfig.Limits.MaxTargetLength, runtimeConfig.Limits.TargetCharset))
+	if c.bootAutoDetect {
+		c.registerDetectedCommands()
+	}
 	plugin.GetManager().SetConfig(c.config)
 
 	logger.Infof("Handshake completed successfully for agent %s (%s)", c.config.Agent.Name, c.config.Server.UUID)
 	logger.Infof("Loaded %d allowed commands from server", len(c.config.Commands))
 
-	streamCtx := metadata.AppendToOutgoingContext(context.Background(), "agent-uuid", c.config.Server.UUID, "token", c.config.Server.Token)
+	streamCtx := metadata.AppendToOutgoingContext(ctx, "agent-uuid", c.config.Server.UUID, "token", c.config.Server.Token)
 	stream, err := client.StreamCommands(streamCtx)
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
+	if handshakeResp.Compression == proto.CompressionZstd {
+		logger.Infof("Compressing command output with %s", handshakeResp.Compression)
+		stream = compressingStream{stream}
+	} else if len(handshakeReq.Compression) > 0 {
+		logger.Warnf("Server does not accept compressed output; sending it uncompressed")
+	}
+
+	// Complete the handshake by telling the server which commands cannot run on
+	// this host, so it can grey them out instead of failing at execution time.
+	if data, err := json.Marshal(c.checkCommandAvailability()); err == nil {
+		if err := c.streamSend(stream, &proto.CommandMessage{Type: "command_availability", Data: data}); err != nil {
+			logger.Warnf("Failed to report command availability: %v", err)
+		}
+	}
+	c.reportCatalog(stream)
 
 	// Background reporters live for the lifetime of this connection; cancelling on
 	// return stops them when the stream drops.
@@ -166,12 +218,15 @@ func (c *Client) ConnectToServer() error {
 
 		switch msg.Type {
 		case "execute_command":
-			go c.executeCommandGRPC(stream, msg)
+			go c.executeCommandGRPC(stream.Context(), stream, msg)
 		case "stop_command":
 			c.stopCommand(msg.CommandID)
+		case "stop_all":
+			logger.Warnf("Received stop-all from server")
+			c.stopAllCommands()
 		case "probe_config":
-			var cfg proto.ProbeConfig
-			if err := json.Unmarshal(msg.Data, &cfg); err != nil {
+			cfg, err := proto.UnmarshalData[proto.ProbeConfig](msg)
+			if err != nil {
 				logger.Warnf("Failed to decode probe config: %v", err)
 			} else {
 				logger.Infof("Received probe config: %d targets, interval %ds", len(cfg.Targets), cfg.IntervalSec)
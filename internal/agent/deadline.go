@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrKilledByPolicy is returned for a command the server stopped because it
+// ran longer than the maximum runtime (see SetMaxRuntime).
+var ErrKilledByPolicy = errors.New("killed by server policy")
+
+// SetMaxRuntime sets how long a command may run, timed by the server from its
+// dispatch to the agent. A command still running then is stopped on the agent
+// and fails with ErrKilledByPolicy, whatever the agent's own timeouts and
+// clock do. 0 disables the limit.
+func (m *Manager) SetMaxRuntime(d time.Duration) {
+	m.maxRuntime.Store(int64(max(d, 0)))
+}
+
+// DeadlineKills returns how many commands the maximum runtime stopped.
+func (m *Manager) DeadlineKills() uint64 {
+	return m.deadlineKills.Load()
+}
+
+// runtimeDeadline returns a channel receiving once a command dispatched now
+// reached the maximum runtime, and the function releasing it. The channel is
+// nil, never receiving, without a limit.
+func (m *Manager) runtimeDeadline() (<-chan time.Time, time.Duration, func()) {
+	limit := time.Duration(m.maxRuntime.Load())
+	if limit <= 0 {
+		return nil, 0, func() {}
+	}
+	timer := time.NewTimer(limit)
+	return timer.C, limit, func() { timer.Stop() }
+}
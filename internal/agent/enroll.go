@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// enrollDefaultRetry is how long a pending enrollment waits when the
+	// server does not say.
+	enrollDefaultRetry = 15 * time.Second
+	// enrollFailureRetry is how long it waits after the server could not be
+	// reached.
+	enrollFailureRetry = 10 * time.Second
+	enrollCallTimeout  = 20 * time.Second
+)
+
+// Enroll exchanges an enrollment code for the agent's UUID and token. It asks
+// the server again while the request waits for the verification webhook or
+// an operator, and retries when the server cannot be reached, until ctx is
+// cancelled. A refused code or a denied request ends it with an error.
+func (c *Client) Enroll(ctx context.Context, req *proto.EnrollRequest) (*proto.EnrollResponse, error) {
+	conn, err := c.dialServer()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := proto.NewAgentServiceClient(conn)
+
+	logged := false
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, enrollCallTimeout)
+		resp, err := client.Enroll(callCtx, req)
+		cancel()
+		wait := enrollFailureRetry
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			switch status.Code(err) {
+			case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal:
+				logger.Warnf("Enrollment failed: %v; retrying in %s", err, wait)
+			case codes.Unimplemented:
+				return nil, fmt.Errorf("the server does not accept enrollment codes: %w", err)
+			default:
+				return nil, fmt.Errorf("enrollment refused: %s", status.Convert(err).Message())
+			}
+		case resp.Status == proto.EnrollApproved:
+			if resp.UUID == "" || resp.Token == "" {
+				return nil, fmt.Errorf("enrollment approved without an identity")
+			}
+			return resp, nil
+		default:
+			if resp.RetryAfter > 0 {
+				wait = time.Duration(resp.RetryAfter) * time.Second
+			} else {
+				wait = enrollDefaultRetry
+			}
+			if !logged {
+				logger.Infof("Enrollment requested: %s", resp.Message)
+				logged = true
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// SetIdentity sets the UUID and token the agent connects with, once it
+// enrolled.
+func (c *Client) SetIdentity(uuid, token string) {
+	c.bootUUID, c.bootToken = uuid, token
+	c.config.Server.UUID, c.config.Server.Token = uuid, token
+}
@@ -2,19 +2,27 @@ package agent
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
-	"YALS/internal/config"
-	"YALS/internal/logger"
-	"YALS/internal/plugin"
-	"YALS/internal/proto"
-	"YALS/internal/validator"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/encoding/japanese"
@@ -39,15 +47,27 @@ func (c *Client) convertCommandsToProto() []proto.CommandInfo {
 	return protoCommands
 }
 
-// executeCommandGRPC executes a command and streams the output via gRPC
-func (c *Client) executeCommandGRPC(stream proto.AgentService_StreamCommandsClient, msg *proto.CommandMessage) {
+// executeCommandGRPC executes a command and streams the output via gRPC. The
+// command is stopped when ctx (the server stream) ends, since its output could
+// no longer be delivered.
+func (c *Client) executeCommandGRPC(ctx context.Context, stream proto.AgentService_StreamCommandsClient, msg *proto.CommandMessage) {
 	req := CommandRequest{
-		Type:        msg.Type,
-		CommandName: msg.CommandName,
-		Target:      msg.Target,
-		CommandID:   msg.CommandID,
-		IPVersion:   msg.IPVersion,
-	}
+		Type:          msg.Type,
+		CommandName:   msg.CommandName,
+		Target:        msg.Target,
+		CommandID:     msg.CommandID,
+		IPVersion:     msg.IPVersion,
+		View:          msg.View,
+		RequireFamily: msg.RequireFamily,
+		Structured:    msg.Structured,
+	}
+
+	// The execution span joins the server's trace when it sent a traceparent.
+	_, span := tracing.Tracer(ctx).Start(tracing.Extract(ctx, msg.TraceParent), "agent.execute", trace.WithAttributes(
+		attribute.String("yals.command", req.CommandName),
+		attribute.String("yals.command_id", req.CommandID),
+	))
+	defer span.End()
 
 	// Always signal completion exactly once when the command finishes, no matter
 	// which path it takes (validation/queue/plugin/shell error or success). The
@@ -57,26 +77,81 @@ func (c *Client) executeCommandGRPC(stream proto.AgentService_StreamCommandsClie
 
 	fullCommand, cmd, cmdConfig, err := c.prepareCommand(req)
 	if err != nil {
-		c.sendErrorGRPC(stream, req.CommandID, err.Error())
+		span.SetStatus(codes.Error, err.Error())
+		c.sendRejectionGRPC(stream, req.CommandID, err)
 		return
 	}
 
+	// Commands with cache_seconds answer from their last result while it is
+	// fresh, and otherwise record this run's result.
+	if cacheable(cmdConfig) {
+		if entry, ok := c.results.get(cachedName(req), cmdConfig); ok {
+			logger.Infof("Serving command %s from the cache", req.CommandID)
+			span.SetAttributes(attribute.Bool("yals.cached", true))
+			c.serveCachedResult(stream, req.CommandID, entry)
+			return
+		}
+		recorder := &recordingStream{AgentService_StreamCommandsClient: stream, commandID: req.CommandID}
+		stream = recorder
+		defer func() {
+			if result, ok := recorder.finished(); ok {
+				c.results.put(cachedName(req), cmdConfig, result)
+			}
+		}()
+	}
+
 	if err := c.checkCommandQueueLimit(req.CommandName, cmdConfig); err != nil {
-		c.sendErrorGRPC(stream, req.CommandID, err.Error())
+		span.SetStatus(codes.Error, err.Error())
+		c.sendRejectionGRPC(stream, req.CommandID, err)
+		return
+	}
+
+	if err := c.limits.acquire(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		logger.Warnf("Refused command %s: %v", req.CommandID, err)
+		c.sendRejectionGRPC(stream, req.CommandID, err)
 		return
 	}
+	defer c.limits.release()
 
 	logger.Infof("Executing command: %s", req.CommandID)
 
+	stopOnCancel := context.AfterFunc(ctx, func() {
+		logger.Infof("Server stream ended, stopping command: %s", req.CommandID)
+		c.stopCommand(req.CommandID)
+	})
+	defer stopOnCancel()
+
 	if strings.HasPrefix(fullCommand, "plugin:") {
 		c.executePluginCommandGRPC(stream, req, fullCommand, cmdConfig)
 		return
 	}
 
-	c.storeActiveCommand(req.CommandID, cmd, fullCommand, req.CommandName)
+	exited := make(chan struct{})
+	c.storeActiveCommand(req.CommandID, cmd, fullCommand, req.CommandName, newStopPolicy(cmdConfig), exited)
 	defer c.removeActiveCommand(req.CommandID)
+	defer close(exited)
+
+	// iperf3 -J runs additionally get a normalized bandwidth summary so results
+	// can be graphed and stored numerically. ping and traceroute runs get one
+	// when the server asked for structured results.
+	var onStdout func(string)
+	if isIperf3JSONCommand(fullCommand) {
+		onStdout = func(stdout string) {
+			if summary, ok := parseIperf3Summary(stdout); ok {
+				c.sendDataGRPC(stream, req.CommandID, summary)
+			}
+		}
+	} else if parse := structuredParser(fullCommand); parse != nil && req.Structured {
+		onStdout = func(stdout string) {
+			if result, ok := parse(stdout); ok {
+				c.sendDataGRPC(stream, req.CommandID, result)
+			}
+		}
+	}
 
-	if err := c.runCommandWithStreamingGRPC(stream, req.CommandID, cmd); err != nil {
+	if err := c.runCommandWithStreamingGRPC(stream, req.CommandID, cmd, onStdout); err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		c.sendErrorGRPC(stream, req.CommandID, err.Error())
 		return
 	}
@@ -87,28 +162,56 @@ func (c *Client) executeCommandGRPC(stream proto.AgentService_StreamCommandsClie
 func (c *Client) prepareCommand(req CommandRequest) (string, *exec.Cmd, config.CommandTemplate, error) {
 	if !c.config.IsCommandAllowed(req.CommandName) {
 		logger.Warnf("SECURITY: Blocked unauthorized command '%s' from server", req.CommandName)
-		return "", nil, config.CommandTemplate{}, fmt.Errorf("command '%s' is not allowed", req.CommandName)
+		return "", nil, config.CommandTemplate{}, rejectf(proto.RejectNotAllowed, "command '%s' is not allowed", req.CommandName)
 	}
 
 	cmdConfig, exists := c.config.GetCommandConfig(req.CommandName)
 	if !exists {
-		return "", nil, config.CommandTemplate{}, fmt.Errorf("command configuration not found: %s", req.CommandName)
+		return "", nil, config.CommandTemplate{}, rejectf(proto.RejectNotAllowed, "command configuration not found: %s", req.CommandName)
+	}
+
+	if reason, unavailable := c.unavailableReason(req.CommandName); unavailable {
+		return "", nil, config.CommandTemplate{}, rejectf(proto.RejectUnavailable, "command '%s' is unavailable on this agent: %s", req.CommandName, reason)
+	}
+
+	switch req.IPVersion {
+	case "", "auto", "ipv4", "ipv6":
+	default:
+		return "", nil, config.CommandTemplate{}, rejectf(proto.RejectInvalidOption, "ip_version must be auto, ipv4 or ipv6")
+	}
+	view, err := selectView(cmdConfig, req.View)
+	if err != nil {
+		return "", nil, config.CommandTemplate{}, err
 	}
 
 	// Defense in depth: the server is expected to validate the target, but the
 	// agent must not trust that blindly. When a target is actually used it must
-	// be a well-formed IP address or domain, never something that could smuggle
-	// shell metacharacters into the command line.
+	// pass the command's validator, which never lets through something that
+	// could smuggle shell metacharacters into the command line.
+	target := validator.Target{Type: validator.TargetNone}
 	if req.Target != "" && !cmdConfig.IgnoreTarget {
-		if validator.ValidateInput(req.Target) == validator.InvalidInput {
+		var err error
+		targetType := cmdConfig.TargetType
+		if targetType == "" && cmdConfig.UsePlugin != "" {
+			targetType = plugin.GetPluginTargetType(cmdConfig.UsePlugin)
+		}
+		target, err = validator.Validate(validator.CommandTargetType(targetType, false), req.Target)
+		if err != nil {
 			logger.Warnf("SECURITY: Rejected invalid target for command '%s'", req.CommandName)
-			return "", nil, config.CommandTemplate{}, fmt.Errorf("invalid target")
+			return "", nil, config.CommandTemplate{}, rejectf(proto.RejectInvalidTarget, "invalid target: %v", err)
 		}
 	}
 
-	resolvedTarget := req.Target
-	if req.Target != "" && !cmdConfig.IgnoreTarget {
-		resolvedTarget = c.resolveTargetIfNeeded(req.Target, req.IPVersion)
+	resolvedTarget := target.Value
+	if target.Resolvable() {
+		resolvedTarget = c.resolveTargetIfNeeded(target, req.IPVersion)
+		// An unresolved domain comes back unchanged.
+		if req.RequireFamily && resolvedTarget == target.Value {
+			family := map[string]string{"ipv4": "IPv4", "ipv6": "IPv6"}[req.IPVersion]
+			if family != "" {
+				return "", nil, config.CommandTemplate{}, rejectf(proto.RejectNoAddress, "%s has no %s address", req.Target, family)
+			}
+		}
 	}
 
 	if cmdConfig.UsePlugin != "" {
@@ -129,6 +232,7 @@ func (c *Client) prepareCommand(req CommandRequest) (string, *exec.Cmd, config.C
 	if !cmdConfig.IgnoreTarget {
 		effectiveTarget = resolvedTarget
 	}
+	template = config.ApplyView(template, view)
 	fullCommand := template
 	if strings.Contains(template, targetPlaceholder) {
 		fullCommand = strings.ReplaceAll(template, targetPlaceholder, effectiveTarget)
@@ -140,6 +244,10 @@ func (c *Client) prepareCommand(req CommandRequest) (string, *exec.Cmd, config.C
 	if cmd == nil {
 		return "", nil, config.CommandTemplate{}, fmt.Errorf("empty command")
 	}
+	cmd = applyExecEnvironment(cmd, cmdConfig, view)
+	if cmdConfig.StopProcessGroup {
+		setProcessGroup(cmd)
+	}
 
 	return fullCommand, cmd, cmdConfig, nil
 }
@@ -165,60 +273,43 @@ func (c *Client) checkCommandQueueLimit(commandName string, cmdConfig config.Com
 		}
 	}
 	if count >= maximumQueue {
-		return fmt.Errorf("execution limit reached for command '%s' (%d/%d)", commandName, count, maximumQueue)
+		return rejectf(proto.RejectBusy, "execution limit reached for command '%s' (%d/%d)", commandName, count, maximumQueue)
 	}
 	return nil
 }
 
-// resolveTargetIfNeeded resolves domain name to IP if target is a domain
-func (c *Client) resolveTargetIfNeeded(target, ipVersion string) string {
-	host := target
-	port := ""
-
-	if strings.Contains(target, ":") {
-		parts := strings.Split(target, ":")
-		if len(parts) == 2 {
-			host = parts[0]
-			port = parts[1]
-		}
+// resolveTargetIfNeeded replaces a domain target with one of its addresses,
+// keeping the port. Other targets, and domains that fail to resolve, come back
+// unchanged.
+func (c *Client) resolveTargetIfNeeded(target validator.Target, ipVersion string) string {
+	if !target.Resolvable() {
+		return target.Value
 	}
 
-	inputType := validator.ValidateInput(host)
-	if inputType == validator.Domain {
-		var dnsIPVersion validator.IPVersion
-		switch ipVersion {
-		case "ipv4":
-			dnsIPVersion = validator.IPVersionIPv4
-		case "ipv6":
-			dnsIPVersion = validator.IPVersionIPv6
-		default:
-			dnsIPVersion = validator.IPVersionAuto
-		}
-
-		ips, err := validator.ResolveDomainWithVersion(host, dnsIPVersion)
-		if err != nil {
-			logger.Warnf("Failed to resolve domain %s with IP version %s: %v, using original target", host, ipVersion, err)
-			return target
-		}
-
-		if len(ips) > 0 {
-			resolvedIP := ips[0].String()
-
-			parsedIP := ips[0]
-			isIPv6 := parsedIP.To4() == nil
-
-			if port != "" {
-				if isIPv6 {
-					return "[" + resolvedIP + "]:" + port
-				}
-				return resolvedIP + ":" + port
-			}
+	var dnsIPVersion validator.IPVersion
+	switch ipVersion {
+	case "ipv4":
+		dnsIPVersion = validator.IPVersionIPv4
+	case "ipv6":
+		dnsIPVersion = validator.IPVersionIPv6
+	default:
+		dnsIPVersion = validator.IPVersionAuto
+	}
 
-			return resolvedIP
-		}
+	ips, err := validator.ResolveDomainWithVersion(target.Domain, dnsIPVersion)
+	if err != nil {
+		logger.Warnf("Failed to resolve domain %s with IP version %s: %v, using original target", target.Domain, ipVersion, err)
+		return target.Value
+	}
+	if len(ips) == 0 {
+		return target.Value
 	}
 
-	return target
+	resolvedIP := ips[0].String()
+	if target.Port != "" {
+		return net.JoinHostPort(resolvedIP, target.Port)
+	}
+	return resolvedIP
 }
 
 // preparePluginCommand prepares a plugin-based command for execution
@@ -243,17 +334,27 @@ func (c *Client) createCommand(fullCommand string) *exec.Cmd {
 	return exec.Command(parts[0], parts[1:]...)
 }
 
-// storeActiveCommand stores a command for potential stopping
-func (c *Client) storeActiveCommand(commandID string, cmd *exec.Cmd, fullCommand string, commandName string) {
+// storeActiveCommand stores a command for potential stopping. exited must be
+// closed once the command has exited.
+func (c *Client) storeActiveCommand(commandID string, cmd *exec.Cmd, fullCommand string, commandName string, stop stopPolicy, exited <-chan struct{}) {
 	c.commandsLock.Lock()
 	defer c.commandsLock.Unlock()
 	c.activeCommands[commandID] = &ActiveCommand{
 		Cmd:         cmd,
 		FullCommand: fullCommand,
 		CommandName: commandName,
+		stop:        stop,
+		exited:      exited,
 	}
 }
 
+// ActiveCommandCount returns how many commands the agent is running.
+func (c *Client) ActiveCommandCount() int {
+	c.commandsLock.RLock()
+	defer c.commandsLock.RUnlock()
+	return len(c.activeCommands)
+}
+
 // removeActiveCommand removes a command from active commands
 func (c *Client) removeActiveCommand(commandID string) {
 	c.commandsLock.Lock()
@@ -261,18 +362,31 @@ func (c *Client) removeActiveCommand(commandID string) {
 	delete(c.activeCommands, commandID)
 }
 
-// runCommandWithStreamingGRPC executes a command and streams its output via gRPC
-func (c *Client) runCommandWithStreamingGRPC(stream proto.AgentService_StreamCommandsClient, commandID string, cmd *exec.Cmd) error {
-	stdout, err := cmd.StdoutPipe()
+// runCommandWithStreamingGRPC executes a command and streams its output via gRPC.
+// When onStdout is set it receives the complete stdout after the final output.
+func (c *Client) runCommandWithStreamingGRPC(stream proto.AgentService_StreamCommandsClient, commandID string, cmd *exec.Cmd, onStdout func(stdout string)) error {
+	// The pipes are the agent's own rather than cmd's StdoutPipe, which
+	// Wait closes as soon as the command exits, dropping output the readers
+	// have not read yet. These are read to the end, or closed below once a
+	// background child left holding them has had a moment.
+	stdout, stdoutWriter, err := os.Pipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stdout pipe: %w", err)
 	}
-	stderr, err := cmd.StderrPipe()
+	stderr, stderrWriter, err := os.Pipe()
 	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
 		return fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
 
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
 		return fmt.Errorf("failed to start command: %w", err)
 	}
 
@@ -324,6 +438,7 @@ func (c *Client) runCommandWithStreamingGRPC(stream proto.AgentService_StreamCom
 	var allLines []string
 	allLines = append(allLines, stdoutLines...)
 	allLines = append(allLines, stderrLines...)
+	stdoutText := strings.Join(stdoutLines, "\n")
 	stderrMutex.Unlock()
 	stdoutMutex.Unlock()
 
@@ -337,6 +452,10 @@ func (c *Client) runCommandWithStreamingGRPC(stream proto.AgentService_StreamCom
 		c.sendOutputGRPC(stream, commandID, fmt.Sprintf("Command failed: %v", cmdErr), true)
 	}
 
+	if onStdout != nil && stdoutText != "" {
+		onStdout(stdoutText)
+	}
+
 	time.Sleep(100 * time.Millisecond)
 
 	return nil
@@ -407,6 +526,58 @@ func (c *Client) sendOutputGRPC(stream proto.AgentService_StreamCommandsClient,
 	}
 }
 
+// sendDataGRPC sends a structured command result via gRPC stream
+func (c *Client) sendDataGRPC(stream proto.AgentService_StreamCommandsClient, commandID string, result any) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Errorf("Failed to marshal structured result: %v", err)
+		return
+	}
+	msg := &proto.CommandMessage{
+		Type:      "command_output",
+		CommandID: commandID,
+		Data:      data,
+	}
+	if err := c.streamSend(stream, msg); err != nil {
+		logger.Errorf("Failed to send structured result: %v", err)
+	}
+}
+
+// commandRejection is returned when the agent refuses to run a command at all,
+// as opposed to a command that started and then failed.
+type commandRejection struct {
+	code   string
+	reason string
+}
+
+func (r *commandRejection) Error() string {
+	return r.reason
+}
+
+func rejectf(code, format string, args ...any) error {
+	return &commandRejection{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+// sendRejectionGRPC sends err as a command error, typed with its rejection code
+// when the command was refused
+func (c *Client) sendRejectionGRPC(stream proto.AgentService_StreamCommandsClient, commandID string, err error) {
+	var rejection *commandRejection
+	if !errors.As(err, &rejection) {
+		c.sendErrorGRPC(stream, commandID, err.Error())
+		return
+	}
+	msg := &proto.CommandMessage{
+		Type:      "command_output",
+		CommandID: commandID,
+		Error:     rejection.reason,
+		IsError:   true,
+		Code:      rejection.code,
+	}
+	if err := c.streamSend(stream, msg); err != nil {
+		logger.Errorf("Failed to send rejection: %v", err)
+	}
+}
+
 // sendErrorGRPC sends command error via gRPC stream
 func (c *Client) sendErrorGRPC(stream proto.AgentService_StreamCommandsClient, commandID, errorMsg string) {
 	msg := &proto.CommandMessage{
@@ -450,14 +621,28 @@ func (c *Client) stopCommand(commandID string) {
 	}
 
 	logger.Infof("Stopping command: %s", commandID)
-	if activeCmd.Cmd.Process != nil {
-		if err := activeCmd.Cmd.Process.Kill(); err != nil {
-			logger.Warnf("Failed to kill command %s: %v", commandID, err)
-		}
-	}
+	activeCmd.stop.stop(commandID, activeCmd.Cmd, activeCmd.exited)
 	c.removeActiveCommand(commandID)
 }
 
+// stopAllCommands kills every command the agent is running, for the server's
+// stop-all kill switch.
+func (c *Client) stopAllCommands() {
+	c.commandsLock.RLock()
+	commandIDs := make([]string, 0, len(c.activeCommands))
+	for commandID := range c.activeCommands {
+		commandIDs = append(commandIDs, commandID)
+	}
+	c.commandsLock.RUnlock()
+
+	for _, commandID := range commandIDs {
+		c.stopCommand(commandID)
+	}
+	if stopped := plugin.StopAllPluginCommands(); stopped > 0 {
+		logger.Infof("Stopped %d plugin commands", stopped)
+	}
+}
+
 // isClosedPipeError checks if an error is related to closed pipe/file
 func isClosedPipeError(err error) bool {
 	if err == nil {
@@ -561,17 +746,19 @@ func (c *Client) executePluginCommandGRPC(stream proto.AgentService_StreamComman
 	resolvedTarget := parts[1]
 
 	dummyCmd := exec.Command("echo", "plugin_execution")
-	c.storeActiveCommand(req.CommandID, dummyCmd, fullCommand, req.CommandName)
+	c.storeActiveCommand(req.CommandID, dummyCmd, fullCommand, req.CommandName, newStopPolicy(cmdConfig), nil)
 	defer c.removeActiveCommand(req.CommandID)
 
 	// Completion is sent once by the caller (executeCommandGRPC's deferred
 	// sendCompletionGRPC), so the callback here only streams output/errors.
-	err := plugin.ExecutePluginCommand(pluginName, resolvedTarget, req.CommandID, func(output string, isError bool, isComplete bool) {
+	err := plugin.ExecutePluginCommandWithData(pluginName, resolvedTarget, req.CommandID, func(output string, isError bool, isComplete bool) {
 		if isError {
 			c.sendErrorGRPC(stream, req.CommandID, output)
 		} else {
 			c.sendOutputGRPC(stream, req.CommandID, output, false)
 		}
+	}, func(result any) {
+		c.sendDataGRPC(stream, req.CommandID, result)
 	})
 
 	if err != nil {
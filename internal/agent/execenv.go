@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// ioniceClasses maps io_class to the class numbers of ionice -c.
+var ioniceClasses = map[string]string{"idle": "3", "best-effort": "2"}
+
+// applyExecEnvironment sets up cmd the way its template asks: in work_dir,
+// with its own environment, under ionice and nice, and in its container or
+// network namespace and the VRF of view. It returns the command to run,
+// which is cmd itself unless it had to be wrapped.
+func applyExecEnvironment(cmd *exec.Cmd, cmdConfig config.CommandTemplate, view config.CommandView) *exec.Cmd {
+	if cmdConfig.Container != "" {
+		return containerCommand(cmd, cmdConfig)
+	}
+	prefix := priorityPrefix(cmdConfig)
+	if view.VRF != "" {
+		prefix = append([]string{"ip", "vrf", "exec", view.VRF}, prefix...)
+	}
+	if cmdConfig.NetNS != "" {
+		prefix = append([]string{"ip", "netns", "exec", cmdConfig.NetNS}, prefix...)
+	}
+	if len(prefix) > 0 {
+		args := append(prefix, cmd.Args...)
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Dir = cmdConfig.WorkDir
+	if len(cmdConfig.Env) > 0 || len(cmdConfig.EnvPassthrough) > 0 {
+		cmd.Env = commandEnv(cmdConfig)
+	}
+	return cmd
+}
+
+// containerCommand runs cmd in its template's container with docker exec.
+// work_dir is a directory inside the container, and only the template's env
+// and env_passthrough variables reach it; the docker client itself keeps the
+// agent's environment, e.g. DOCKER_HOST.
+func containerCommand(cmd *exec.Cmd, cmdConfig config.CommandTemplate) *exec.Cmd {
+	args := []string{"exec"}
+	if cmdConfig.WorkDir != "" {
+		args = append(args, "--workdir", cmdConfig.WorkDir)
+	}
+	// "--env NAME" passes the client's value of NAME, which keeps values off
+	// the command line.
+	for _, name := range containerEnvNames(cmdConfig) {
+		args = append(args, "--env", name)
+	}
+	args = append(args, cmdConfig.Container)
+	wrapped := exec.Command("docker", append(args, cmd.Args...)...)
+	if len(cmdConfig.Env) > 0 {
+		wrapped.Env = os.Environ()
+		for _, name := range sortedKeys(cmdConfig.Env) {
+			wrapped.Env = append(wrapped.Env, name+"="+cmdConfig.Env[name])
+		}
+	}
+	return wrapped
+}
+
+// containerEnvNames are the variables a container command receives: those
+// of env_passthrough the agent has, then those of env.
+func containerEnvNames(cmdConfig config.CommandTemplate) []string {
+	var names []string
+	for _, name := range cmdConfig.EnvPassthrough {
+		if _, overridden := cmdConfig.Env[name]; overridden {
+			continue
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			names = append(names, name)
+		}
+	}
+	return append(names, sortedKeys(cmdConfig.Env)...)
+}
+
+func sortedKeys(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// priorityPrefix is the ionice and nice invocation a command runs under.
+// Both exec the command, so it keeps their process ID.
+func priorityPrefix(cmdConfig config.CommandTemplate) []string {
+	var prefix []string
+	if class, ok := ioniceClasses[cmdConfig.IOClass]; ok {
+		prefix = append(prefix, "ionice", "-c", class)
+		if cmdConfig.IOClass == "best-effort" {
+			prefix = append(prefix, "-n", strconv.Itoa(cmdConfig.IOPriority))
+		}
+	}
+	if cmdConfig.Nice > 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(cmdConfig.Nice))
+	}
+	return prefix
+}
+
+// priorityBinaries are the executables of priorityPrefix and of the
+// container or namespace wrapper, which must be installed for the command to
+// run.
+func priorityBinaries(cmdConfig config.CommandTemplate) []string {
+	var binaries []string
+	switch {
+	case cmdConfig.Container != "":
+		return []string{"docker"}
+	case cmdConfig.NetNS != "" || slices.ContainsFunc(cmdConfig.Views, func(v config.CommandView) bool { return v.VRF != "" }):
+		binaries = append(binaries, "ip")
+	}
+	if _, ok := ioniceClasses[cmdConfig.IOClass]; ok {
+		binaries = append(binaries, "ionice")
+	}
+	if cmdConfig.Nice > 0 {
+		binaries = append(binaries, "nice")
+	}
+	return binaries
+}
+
+// commandEnv is the environment of a template with env or env_passthrough:
+// the allowed variables of the agent's environment, then the template's own.
+func commandEnv(cmdConfig config.CommandTemplate) []string {
+	allowed := slices.Concat(config.BaseEnvPassthrough, cmdConfig.EnvPassthrough)
+	env := make([]string, 0, len(allowed)+len(cmdConfig.Env))
+	for _, name := range allowed {
+		if _, overridden := cmdConfig.Env[name]; overridden {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	for _, name := range sortedKeys(cmdConfig.Env) {
+		env = append(env, name+"="+cmdConfig.Env[name])
+	}
+	return env
+}
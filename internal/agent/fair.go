@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"time"
+)
+
+// fairPolicy shares an agent's weight budget between the requesters (see
+// WithRequester) waiting for it. Each requester has a token bucket holding up
+// to burst tokens, refilled one every refill; starting a command takes one.
+// When the budget frees up while several requesters wait, it goes to the
+// requesters with a token first and, among those, to the one that started a
+// command the longest ago, so busy requesters take turns and a requester that
+// only runs a command now and then goes ahead of one flooding the agent. A
+// requester alone on the agent is never held back. burst 0 disables it.
+type fairPolicy struct {
+	burst  int
+	refill time.Duration
+}
+
+const defaultFairRefill = 5 * time.Second
+
+// requesterShare is a requester's bucket on one agent and the commands it has
+// waiting for the agent's budget.
+type requesterShare struct {
+	tokens    float64
+	refilled  time.Time
+	lastStart time.Time
+	queued    []queuedCommand
+}
+
+type queuedCommand struct {
+	priority Priority
+	weight   int
+}
+
+// SetFairShare turns on fair sharing of each agent's weight budget between
+// requesters, letting each start burst commands back to back and earn one
+// more every refill (default 5s). It needs the weight budget; burst 0
+// disables it.
+func (m *Manager) SetFairShare(burst int, refill time.Duration) {
+	if refill <= 0 {
+		refill = defaultFairRefill
+	}
+	m.fairBurst.Store(int64(max(burst, 0)))
+	m.fairRefill.Store(int64(refill))
+}
+
+func (m *Manager) fairPolicy() fairPolicy {
+	return fairPolicy{burst: int(m.fairBurst.Load()), refill: time.Duration(m.fairRefill.Load())}
+}
+
+// share returns the bucket of requester, refilled up to now. Callers hold
+// runningLock.
+func (a *Agent) share(requester string, policy fairPolicy, now time.Time) *requesterShare {
+	if a.requesters == nil {
+		a.requesters = make(map[string]*requesterShare)
+	}
+	s := a.requesters[requester]
+	if s == nil {
+		s = &requesterShare{tokens: float64(policy.burst), refilled: now}
+		a.requesters[requester] = s
+		return s
+	}
+	if elapsed := now.Sub(s.refilled); elapsed > 0 {
+		s.tokens = min(s.tokens+float64(elapsed)/float64(policy.refill), float64(policy.burst))
+		s.refilled = now
+	}
+	return s
+}
+
+// fairTurn reports whether requester may start a command of priority now
+// that free budget is left. Only requesters with a command of the same
+// priority waiting that fits in free compete with it. Callers hold
+// runningLock.
+func (a *Agent) fairTurn(requester string, priority Priority, free int, policy fairPolicy, now time.Time) bool {
+	mine := a.share(requester, policy, now)
+	for name, other := range a.requesters {
+		if name == requester || !other.waitsWithin(priority, free) {
+			continue
+		}
+		other = a.share(name, policy, now)
+		if aheadOf(other, mine) {
+			return false
+		}
+	}
+	return true
+}
+
+// aheadOf reports whether a gets the budget before b: a requester with a
+// token before one without, then the one whose last start is older.
+func aheadOf(a, b *requesterShare) bool {
+	if hasA, hasB := a.tokens >= 1, b.tokens >= 1; hasA != hasB {
+		return hasA
+	}
+	return a.lastStart.Before(b.lastStart)
+}
+
+func (s *requesterShare) waitsWithin(priority Priority, free int) bool {
+	for _, q := range s.queued {
+		if q.priority == priority && q.weight <= free {
+			return true
+		}
+	}
+	return false
+}
+
+// startFair takes a token from requester for a command it starts and drops
+// the buckets of idle requesters that refilled, which behave like new ones.
+// Callers hold runningLock.
+func (a *Agent) startFair(requester string, policy fairPolicy, now time.Time) {
+	s := a.share(requester, policy, now)
+	s.tokens = max(s.tokens-1, 0)
+	s.lastStart = now
+	for name, other := range a.requesters {
+		if name != requester && len(other.queued) == 0 && now.Sub(other.refilled) >= time.Duration(policy.burst)*policy.refill {
+			delete(a.requesters, name)
+		}
+	}
+}
+
+// queueFair counts a command of requester in (waiting) or out of the
+// requester's queue. Callers hold runningLock.
+func (a *Agent) queueFair(requester string, priority Priority, weight int, waiting bool, policy fairPolicy, now time.Time) {
+	s := a.share(requester, policy, now)
+	if waiting {
+		s.queued = append(s.queued, queuedCommand{priority: priority, weight: weight})
+		return
+	}
+	for i, q := range s.queued {
+		if q.priority == priority && q.weight == weight {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return
+		}
+	}
+}
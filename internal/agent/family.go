@@ -0,0 +1,17 @@
+package agent
+
+import "context"
+
+type requireFamilyKey struct{}
+
+// WithRequiredFamily returns ctx under which commands run with ip_version
+// ipv4/ipv6 are refused with proto.RejectNoAddress when their domain target
+// has no address of that family, rather than run against the domain.
+func WithRequiredFamily(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requireFamilyKey{}, true)
+}
+
+func familyRequired(ctx context.Context) bool {
+	required, _ := ctx.Value(requireFamilyKey{}).(bool)
+	return required
+}
@@ -1,10 +1,21 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	"YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // StreamingOutputCallback is called for each chunk of output during command execution
@@ -19,21 +30,44 @@ func (m *Manager) ExecuteCommand(agentName, command string) (string, error) {
 }
 
 // ExecuteCommandStreaming executes a command on an agent with streaming output
-func (m *Manager) ExecuteCommandStreaming(agentName, command string, callback StreamingOutputCallback) error {
+func (m *Manager) ExecuteCommandStreaming(ctx context.Context, agentName, command string, callback StreamingOutputCallback) error {
 	commandID := fmt.Sprintf("%s-%d", agentName, time.Now().UnixNano())
-	return m.ExecuteCommandStreamingWithStopAndID(agentName, command, commandID, "auto", nil, func(output string, isError bool, isComplete bool, isStopped bool) {
+	return m.ExecuteCommandStreamingWithStopAndID(ctx, agentName, command, commandID, "auto", nil, func(output string, isError bool, isComplete bool, isStopped bool) {
 		callback(output, isError, isComplete)
 	})
 }
 
 // ExecuteCommandStreamingWithStop executes a command on an agent with streaming output and stop support
-func (m *Manager) ExecuteCommandStreamingWithStop(agentName, command string, stopChan <-chan bool, callback StreamingOutputCallbackWithStop) error {
+func (m *Manager) ExecuteCommandStreamingWithStop(ctx context.Context, agentName, command string, stopChan <-chan bool, callback StreamingOutputCallbackWithStop) error {
 	commandID := fmt.Sprintf("%s-%d", agentName, time.Now().UnixNano())
-	return m.ExecuteCommandStreamingWithStopAndID(agentName, command, commandID, "auto", stopChan, callback)
+	return m.ExecuteCommandStreamingWithStopAndID(ctx, agentName, command, commandID, "auto", stopChan, callback)
 }
 
+// StructuredResultCallback receives structured results (raw JSON with a "kind"
+// field) emitted alongside a command's text output
+type StructuredResultCallback func(data json.RawMessage)
+
 // ExecuteCommandStreamingWithStopAndID executes a command on an agent with streaming output, stop support and custom command ID
-func (m *Manager) ExecuteCommandStreamingWithStopAndID(agentName, command, commandID, ipVersion string, stopChan <-chan bool, callback StreamingOutputCallbackWithStop) error {
+func (m *Manager) ExecuteCommandStreamingWithStopAndID(ctx context.Context, agentName, command, commandID, ipVersion string, stopChan <-chan bool, callback StreamingOutputCallbackWithStop) error {
+	return m.ExecuteCommandStreamingWithData(ctx, agentName, command, commandID, ipVersion, stopChan, callback, nil)
+}
+
+// ExecuteCommandStreamingWithData is ExecuteCommandStreamingWithStopAndID that
+// additionally delivers structured results to onData. The run is traced as a
+// child of the span in ctx, and the trace context is forwarded to the agent.
+//
+// Cancelling ctx (client gone, deadline, server shutdown) stops the command on
+// the agent and returns ctx.Err(); stopChan remains for explicit user stops.
+func (m *Manager) ExecuteCommandStreamingWithData(ctx context.Context, agentName, command, commandID, ipVersion string, stopChan <-chan bool, callback StreamingOutputCallbackWithStop, onData StructuredResultCallback) (err error) {
+	ctx, span := tracing.Tracer(ctx).Start(ctx, "manager.execute", traceAttributes(agentName, command, commandID))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	m.agentsLock.RLock()
 	agent, exists := m.agents[agentName]
 	m.agentsLock.RUnlock()
@@ -68,28 +102,106 @@ func (m *Manager) ExecuteCommandStreamingWithStopAndID(agentName, command, comma
 		ipVersion = "auto"
 	}
 
-	outputChan := make(chan CommandOutput, 1000)
-	defer close(outputChan)
+	view := viewFrom(ctx)
+	if _, known := config.FindView(cmdConfig.Views, view); view != "" && !known {
+		return &RejectionError{Code: proto.RejectInvalidOption, Reason: fmt.Sprintf("unknown view %q", view)}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	m.registerOutputHandler(commandID, outputChan)
-	defer m.unregisterOutputHandler(commandID)
+	pipeline := m.openOutputPipeline(commandID, agent)
+	defer m.closeOutputPipeline(commandID, pipeline)
 
+	_, dispatch := tracing.Tracer(ctx).Start(ctx, "manager.dispatch")
 	if err := m.reserveCommandSlot(agentName, commandName, cmdConfig.MaximumQueue, cmdConfig.UsePlugin); err != nil {
+		dispatch.SetStatus(codes.Error, err.Error())
+		dispatch.End()
 		return err
 	}
 	defer m.releaseCommandSlot(agentName, commandName)
 
+	// Queue behind the agent's weight budget: heavy commands wait here while
+	// cheaper ones that fit keep being dispatched, higher priorities first and
+	// requesters taking turns (see fair.go).
+	if budget := int(m.weightBudget.Load()); budget > 0 {
+		weight := commandWeight(cmdConfig, budget)
+		err := agent.acquireWeight(ctx, weight, budget, m.fairPolicy(), stopChan, pipeline, func() {
+			dispatch.AddEvent("queued for agent weight budget", trace.WithAttributes(attribute.String("yals.priority", priorityFrom(ctx).String())))
+		})
+		if errors.Is(err, errStoppedWhileQueued) {
+			dispatch.End()
+			callback("", false, false, true)
+			return nil
+		}
+		if err != nil {
+			dispatch.SetStatus(codes.Error, err.Error())
+			dispatch.End()
+			return err
+		}
+		defer agent.releaseWeight(weight)
+	}
+
 	req := &proto.CommandMessage{
-		Type:        "execute_command",
-		CommandName: commandName,
-		Target:      target,
-		CommandID:   commandID,
-		IPVersion:   ipVersion,
+		Type:          "execute_command",
+		CommandName:   commandName,
+		Target:        target,
+		CommandID:     commandID,
+		IPVersion:     ipVersion,
+		View:          view,
+		TraceParent:   tracing.Inject(ctx),
+		RequireFamily: familyRequired(ctx),
+		Structured:    agent.hasCapability(proto.CapabilityStructuredResults),
 	}
 
-	if err := agent.sendLocked(req); err != nil {
+	agent.trackActive(1)
+	defer agent.trackActive(-1)
+	if err := agent.send(req); err != nil {
+		dispatch.SetStatus(codes.Error, err.Error())
+		dispatch.End()
 		return fmt.Errorf("failed to send command: %w", err)
 	}
+	dispatch.End()
+
+	// A command fails either with err or with an error completion from the
+	// agent; CommandFinished reports both.
+	started := time.Now()
+	var failure string
+	var stopped bool
+	requester := requesterFrom(ctx)
+	m.events.Publish(events.Event{Type: events.CommandStarted, AgentUUID: agent.UUID, Agent: agentName, CommandID: commandID, Command: commandName, Target: target, Requester: requester})
+	defer func() {
+		if err != nil {
+			failure = err.Error()
+		}
+		m.events.Publish(events.Event{Type: events.CommandFinished, AgentUUID: agent.UUID, Agent: agentName, CommandID: commandID, Command: commandName, Target: target, Requester: requester, Duration: time.Since(started), Err: failure, Stopped: stopped})
+	}()
+	notify := callback
+	callback = func(output string, isError bool, isComplete bool, isStopped bool) {
+		if isStopped {
+			stopped = true
+		}
+		if isComplete && isError {
+			if failure = output; failure == "" {
+				failure = "command failed"
+			}
+		}
+		notify(output, isError, isComplete, isStopped)
+	}
+
+	// The streaming phase runs from dispatch until completion; the first output
+	// is marked so agent start-up latency is visible.
+	_, streaming := tracing.Tracer(ctx).Start(ctx, "manager.stream")
+	defer streaming.End()
+	firstOutput := true
+	callback = traceOutputs(streaming, &firstOutput, callback)
+	received := outputTimingFrom(ctx)
+
+	// The server times the run itself, so a command the agent fails to end
+	// is still stopped (see deadline.go).
+	deadline, maxRuntime, releaseDeadline := m.runtimeDeadline()
+	defer releaseDeadline()
 
 	for {
 		select {
@@ -98,18 +210,96 @@ func (m *Manager) ExecuteCommandStreamingWithStopAndID(agentName, command, comma
 				Type:      "stop_command",
 				CommandID: commandID,
 			}
-			_ = agent.sendLocked(stopReq)
+			_ = agent.send(stopReq)
 			callback("", false, false, true)
 			return nil
-		case output := <-outputChan:
-			callback(output.Output, output.IsError, output.IsComplete, false)
-			if output.IsComplete {
-				return nil
+		case <-ctx.Done():
+			_ = agent.send(&proto.CommandMessage{
+				Type:      "stop_command",
+				CommandID: commandID,
+			})
+			return ctx.Err()
+		case <-deadline:
+			_ = agent.send(&proto.CommandMessage{
+				Type:      "stop_command",
+				CommandID: commandID,
+			})
+			m.deadlineKills.Add(1)
+			logger.Warnf("Stopped command %s on %s: ran longer than %s", commandID, agentName, maxRuntime)
+			return fmt.Errorf("%w: ran longer than %s", ErrKilledByPolicy, maxRuntime)
+		case <-pipeline.ctx.Done():
+			// Reaped: deliver whatever was already buffered before giving up,
+			// in case the completion raced with the reap.
+			for {
+				select {
+				case output := <-pipeline.ch:
+					if done, err := deliverOutput(output, received, callback, onData); done {
+						return err
+					}
+				default:
+					return errors.New(pipeline.reason)
+				}
+			}
+		case output := <-pipeline.ch:
+			if done, err := deliverOutput(output, received, callback, onData); done {
+				return err
 			}
 		}
 	}
 }
 
+func traceAttributes(agentName, command, commandID string) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("yals.agent", agentName),
+		attribute.String("yals.command", command),
+		attribute.String("yals.command_id", commandID),
+	)
+}
+
+// traceOutputs wraps callback to record the first output and the completion
+// on span.
+func traceOutputs(span trace.Span, first *bool, callback StreamingOutputCallbackWithStop) StreamingOutputCallbackWithStop {
+	return func(output string, isError bool, isComplete bool, isStopped bool) {
+		if *first && (output != "" || isComplete) {
+			*first = false
+			span.AddEvent("first_output")
+		}
+		switch {
+		case isStopped:
+			span.AddEvent("stopped")
+		case isComplete && isError:
+			span.SetStatus(codes.Error, output)
+		case isComplete:
+			span.AddEvent("complete")
+		}
+		callback(output, isError, isComplete, isStopped)
+	}
+}
+
+// deliverOutput hands one pipeline message to the callbacks and reports whether
+// it ended the command. Data-only messages carry no text: passing their empty
+// Output to callback would blank the accumulated output. A rejection ends the
+// command with a *RejectionError instead of going through callback. received,
+// when not nil, gets the message's receipt time first (see WithOutputTiming).
+func deliverOutput(output CommandOutput, received func(time.Time), callback StreamingOutputCallbackWithStop, onData StructuredResultCallback) (bool, error) {
+	if output.Code != "" {
+		return true, &RejectionError{Code: output.Code, Reason: output.Output}
+	}
+	if received != nil && !output.ReceivedAt.IsZero() {
+		received(output.ReceivedAt)
+	}
+	if len(output.Data) > 0 {
+		if onData != nil {
+			onData(output.Data)
+		}
+		if !output.IsComplete && !output.IsError {
+			return false, nil
+		}
+	}
+	callback(output.Output, output.IsError, output.IsComplete, false)
+	return output.IsComplete, nil
+}
+
 // ExecuteCommandWithID executes a command with a specific command ID
 func (m *Manager) ExecuteCommandWithID(agentName, command, commandID, ipVersion string) error {
 	agent := m.getAgent(agentName)
@@ -138,7 +328,7 @@ func (m *Manager) ExecuteCommandWithID(agentName, command, commandID, ipVersion
 		IPVersion:   ipVersion,
 	}
 
-	if err := agent.sendLocked(req); err != nil {
+	if err := agent.send(req); err != nil {
 		return fmt.Errorf("failed to send command: %w", err)
 	}
 
@@ -161,7 +351,7 @@ func (m *Manager) StopCommand(agentName, commandID string) error {
 		CommandID: commandID,
 	}
 
-	if err := agent.sendLocked(req); err != nil {
+	if err := agent.send(req); err != nil {
 		return fmt.Errorf("failed to send stop command: %w", err)
 	}
 
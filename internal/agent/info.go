@@ -1,17 +1,21 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"YALS/internal/config"
-	"YALS/internal/plugin"
-	"YALS/internal/proto"
-	"YALS/internal/validator"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
 )
 
 // Status represents the connection status of an agent
@@ -40,17 +44,32 @@ type Agent struct {
 	runningCommands   map[string]int
 	runningLock       sync.Mutex
 	sendMu            sync.Mutex
-}
-
-// sendLocked serializes server→agent stream writes (command dispatch, reload,
-// disconnect and probe-config push can be issued from different goroutines).
-func (a *Agent) sendLocked(msg *proto.CommandMessage) error {
-	a.sendMu.Lock()
-	defer a.sendMu.Unlock()
-	if a.stream == nil {
-		return fmt.Errorf("agent stream unavailable")
-	}
-	return a.stream.Send(msg)
+	conn              *StreamConn
+
+	// Weight of the running commands, the commands waiting for it per
+	// priority, and the channel closed when either drops (see weight.go).
+	runningWeight  int
+	weightWaiting  [priorityLevels]int
+	weightReleased chan struct{}
+	// Token buckets and queued commands per requester when the budget is
+	// shared fairly (see fair.go).
+	requesters map[string]*requesterShare
+	// Commands dispatched to the agent and not finished yet (see load).
+	activeCommands int
+
+	// Disconnects and heartbeat round trips (see quality.go).
+	quality connQuality
+	// neverConnected is set on a provisioned agent until its first stream.
+	neverConnected bool
+	// Clock offset seen at the last handshake (see clock.go).
+	clock agentClock
+	// dialed is set when the server dialed the agent's current connection
+	// (see reverse.go).
+	dialed bool
+	// Capabilities and ping mode reported at the last handshake (see
+	// capabilities.go).
+	capabilities []string
+	pingMode     string
 }
 
 // AgentRegistration contains server-side metadata used when attaching a live stream.
@@ -60,6 +79,8 @@ type AgentRegistration struct {
 	Group    string
 	Details  config.AgentDetails
 	Commands []config.CommandInfo
+	// NeverConnected marks a provisioned agent that has not connected yet.
+	NeverConnected bool
 }
 
 // CommandOutput represents command output from an agent
@@ -67,6 +88,26 @@ type CommandOutput struct {
 	Output     string
 	IsError    bool
 	IsComplete bool
+	// Data carries a structured result (see proto.RouteResult); messages
+	// carrying Data have no text output.
+	Data json.RawMessage
+	// Code is the agent's rejection code when it refused the command.
+	Code string
+	// ReceivedAt is when the server received the message (see
+	// WithOutputTiming).
+	ReceivedAt time.Time
+}
+
+// RejectionError reports that a command was refused before it ran, by the
+// agent or by the server on its behalf. Code is one of the proto.Reject* codes
+// so callers can tell "unavailable on this node" from "busy, try again".
+type RejectionError struct {
+	Code   string
+	Reason string
+}
+
+func (e *RejectionError) Error() string {
+	return e.Reason
 }
 
 // Manager manages multiple agents
@@ -74,21 +115,65 @@ type Manager struct {
 	agents             map[string]*Agent
 	agentsByUUID       map[string]*Agent
 	agentsLock         sync.RWMutex
-	outputHandlers     map[string]chan CommandOutput
+	outputHandlers     map[string]*outputHandler
 	outputHandlersLock sync.RWMutex
+	orphanedHandlers   uint64
+
+	// Deleted agents by UUID, kept with their history until purged (see
+	// buryLocked).
+	tombstones map[string]*Agent
 
 	// Monitoring report sinks, wired by the HTTP handler to the store.
 	metricsHandler func(uuid string, m proto.SystemMetrics)
 	probeHandler   func(uuid string, batch proto.ProbeBatch)
+	catalogHandler func(uuid string, report proto.CatalogReport)
+
+	visibilityLock sync.RWMutex
+	visibility     Visibility
+
+	// Per-agent concurrent command weight budget; 0 disables it. The fair
+	// share burst (0 = off) and refill period divide it between requesters.
+	weightBudget atomic.Int64
+	fairBurst    atomic.Int64
+	fairRefill   atomic.Int64
+
+	// Longest a command may run (0 = unlimited) and the commands stopped for
+	// running longer (see deadline.go).
+	maxRuntime    atomic.Int64
+	deadlineKills atomic.Uint64
+
+	// Connected agent cap (0 = unlimited) and the connections it refused.
+	maxAgents      atomic.Int64
+	rejectedAgents atomic.Uint64
+
+	// Lifecycle events for decoupled subscribers (see Events).
+	events *events.Bus
 }
 
-// NewManager creates a new agent manager
-func NewManager() *Manager {
-	return &Manager{
+// NewManager creates a new agent manager. Its janitor and the subscribers of
+// its event bus stop when ctx ends.
+func NewManager(ctx context.Context) *Manager {
+	m := &Manager{
 		agents:         make(map[string]*Agent),
 		agentsByUUID:   make(map[string]*Agent),
-		outputHandlers: make(map[string]chan CommandOutput),
+		tombstones:     make(map[string]*Agent),
+		outputHandlers: make(map[string]*outputHandler),
+		events:         events.New(),
 	}
+	go m.runOutputJanitor(ctx)
+	context.AfterFunc(ctx, m.events.Close)
+	return m
+}
+
+// Events returns the bus on which the manager publishes agent and command
+// lifecycle events.
+func (m *Manager) Events() *events.Bus {
+	return m.events
+}
+
+// SetCatalogHandler registers the sink for agents' command catalog reports.
+func (m *Manager) SetCatalogHandler(fn func(uuid string, report proto.CatalogReport)) {
+	m.catalogHandler = fn
 }
 
 // SetReportHandlers registers sinks for agent metrics and probe reports.
@@ -97,31 +182,58 @@ func (m *Manager) SetReportHandlers(metrics func(uuid string, m proto.SystemMetr
 	m.probeHandler = probe
 }
 
-// HandleAgentConnection handles a new agent gRPC stream connection for uuid.
-func (m *Manager) HandleAgentConnection(uuid string, stream proto.AgentService_StreamCommandsServer) error {
+// HandleAgentConnection serves the agent stream of conn for uuid until the
+// connection is closed, and returns why.
+func (m *Manager) HandleAgentConnection(uuid string, conn *StreamConn) error {
+	go m.readAgentStream(uuid, conn)
+	<-conn.Done()
+	return conn.Err()
+}
+
+// readAgentStream is the only reader of conn's stream. The reader that fails
+// closes conn; one blocked when conn is closed elsewhere returns once
+// StreamCommands has ended the stream.
+func (m *Manager) readAgentStream(uuid string, conn *StreamConn) {
 	for {
-		msg, err := stream.Recv()
+		msg, err := conn.stream.Recv()
 		if err != nil {
-			return err
+			conn.Close(err)
+			return
 		}
+		msg.ReceivedAt = time.Now()
 
 		switch msg.Type {
 		case "command_output":
+			if err := proto.DecompressOutput(msg); err != nil {
+				logger.Warnf("Dropping output of command %s from agent %s: %v", msg.CommandID, uuid, err)
+				continue
+			}
 			m.handleCommandOutputProto(msg)
 		case "metrics_report":
 			if m.metricsHandler != nil && len(msg.Data) > 0 {
-				var sm proto.SystemMetrics
-				if err := json.Unmarshal(msg.Data, &sm); err == nil {
+				if sm, err := proto.UnmarshalData[proto.SystemMetrics](msg); err == nil {
 					m.metricsHandler(uuid, sm)
 				}
 			}
 		case "probe_report":
 			if m.probeHandler != nil && len(msg.Data) > 0 {
-				var batch proto.ProbeBatch
-				if err := json.Unmarshal(msg.Data, &batch); err == nil {
+				if batch, err := proto.UnmarshalData[proto.ProbeBatch](msg); err == nil {
+					batch.TS = msg.ReceivedAt.Unix()
 					m.probeHandler(uuid, batch)
 				}
 			}
+		case "heartbeat":
+			m.recordHeartbeatReply(uuid)
+		case "catalog":
+			if m.catalogHandler != nil && len(msg.Data) > 0 {
+				if report, err := proto.UnmarshalData[proto.CatalogReport](msg); err == nil {
+					m.catalogHandler(uuid, report)
+				}
+			}
+		case "command_availability":
+			if infos, err := proto.UnmarshalData[[]proto.CommandInfo](msg); err == nil {
+				m.setCommandAvailability(uuid, infos)
+			}
 		}
 	}
 }
@@ -134,7 +246,7 @@ func (m *Manager) SendToAgent(uuid string, msg *proto.CommandMessage) error {
 	if !exists || agent == nil || agent.stream == nil {
 		return fmt.Errorf("agent not connected: %s", uuid)
 	}
-	return agent.sendLocked(msg)
+	return agent.send(msg)
 }
 
 // OnlineAgentUUIDs returns the UUIDs of all currently connected agents.
@@ -160,12 +272,34 @@ func (m *Manager) NameByUUID(uuid string) string {
 	return ""
 }
 
+// AgentGroup returns the group an agent is listed under ("Default" when it
+// has none), or "" for an unknown agent.
+func (m *Manager) AgentGroup(agentName string) string {
+	m.agentsLock.RLock()
+	defer m.agentsLock.RUnlock()
+	agent, exists := m.agents[agentName]
+	if !exists || agent == nil {
+		return ""
+	}
+	if agent.Group == "" {
+		return "Default"
+	}
+	return agent.Group
+}
+
 // RegisterAgent registers or updates agent metadata from server persistence.
 func (m *Manager) RegisterAgent(reg AgentRegistration, stream proto.AgentService_StreamCommandsServer) {
 	m.agentsLock.Lock()
 	defer m.agentsLock.Unlock()
 
 	agent, exists := m.agentsByUUID[reg.UUID]
+	if !exists {
+		// A restored agent picks up the history it had when deleted.
+		if agent, exists = m.tombstones[reg.UUID]; exists {
+			delete(m.tombstones, reg.UUID)
+			m.agentsByUUID[reg.UUID] = agent
+		}
+	}
 	if exists {
 		if agent.Name != reg.Name {
 			delete(m.agents, agent.Name)
@@ -176,6 +310,9 @@ func (m *Manager) RegisterAgent(reg AgentRegistration, stream proto.AgentService
 		agent.Details = reg.Details
 		agent.lastCheck = time.Now()
 		agent.availableCommands = cloneCommands(reg.Commands)
+		if !reg.NeverConnected {
+			agent.neverConnected = false
+		}
 		if agent.runningCommands == nil {
 			agent.runningCommands = make(map[string]int)
 		}
@@ -186,7 +323,7 @@ func (m *Manager) RegisterAgent(reg AgentRegistration, stream proto.AgentService
 		// "agent stream unavailable". Stream lifecycle is owned solely by
 		// Register/UnregisterAgentStream.
 		if stream != nil {
-			agent.stream = stream
+			agent.setStream(stream)
 			agent.status = StatusConnected
 			agent.lastConnected = time.Now()
 		}
@@ -200,15 +337,16 @@ func (m *Manager) RegisterAgent(reg AgentRegistration, stream proto.AgentService
 		Name:              reg.Name,
 		Group:             reg.Group,
 		Details:           reg.Details,
-		stream:            stream,
 		status:            StatusDisconnected,
 		lastCheck:         now,
 		lastConnected:     now,
 		firstSeen:         now,
 		availableCommands: cloneCommands(reg.Commands),
 		runningCommands:   make(map[string]int),
+		neverConnected:    reg.NeverConnected,
 	}
 	if stream != nil {
+		agent.setStream(stream)
 		agent.status = StatusConnected
 	}
 
@@ -224,10 +362,14 @@ func (m *Manager) ReloadAgent(uuid string) error {
 	if !exists || agent == nil || agent.stream == nil {
 		return nil
 	}
-	return agent.sendLocked(&proto.CommandMessage{Type: "reload_config"})
+	agent.quality.mu.Lock()
+	agent.quality.reloading = true
+	agent.quality.mu.Unlock()
+	return agent.send(&proto.CommandMessage{Type: "reload_config"})
 }
 
-// DisconnectAgent forces an online agent to disconnect and removes it from memory.
+// DisconnectAgent forces an online agent to disconnect and moves it to the
+// tombstones.
 func (m *Manager) DisconnectAgent(uuid string) error {
 	m.agentsLock.Lock()
 	agent, exists := m.agentsByUUID[uuid]
@@ -235,24 +377,38 @@ func (m *Manager) DisconnectAgent(uuid string) error {
 		m.agentsLock.Unlock()
 		return nil
 	}
-
-	name := agent.Name
-	delete(m.agentsByUUID, uuid)
-	delete(m.agents, name)
+	m.buryLocked(agent)
 	m.agentsLock.Unlock()
 
 	if agent.stream != nil {
-		_ = agent.sendLocked(&proto.CommandMessage{Type: "disconnect"})
+		_ = agent.send(&proto.CommandMessage{Type: "disconnect"})
+		agent.closeStream(errAgentDisconnected)
 	}
 
 	return nil
 }
 
-// RemoveAgent removes an agent from in-memory manager state.
+// buryLocked moves agent from the live maps to the tombstones, keeping its
+// connection quality and first-seen time for a restore. Callers hold
+// agentsLock.
+func (m *Manager) buryLocked(agent *Agent) {
+	delete(m.agentsByUUID, agent.UUID)
+	if m.agents[agent.Name] == agent {
+		delete(m.agents, agent.Name)
+	}
+	agent.statusLock.Lock()
+	agent.status = StatusDisconnected
+	agent.statusLock.Unlock()
+	m.tombstones[agent.UUID] = agent
+}
+
+// RemoveAgent removes an agent, live or deleted, from in-memory manager
+// state.
 func (m *Manager) RemoveAgent(uuid string) {
 	m.agentsLock.Lock()
 	defer m.agentsLock.Unlock()
 
+	delete(m.tombstones, uuid)
 	agent, exists := m.agentsByUUID[uuid]
 	if !exists {
 		return
@@ -262,8 +418,9 @@ func (m *Manager) RemoveAgent(uuid string) {
 	delete(m.agents, agent.Name)
 }
 
-// RegisterAgentStream attaches an active stream for the specified UUID.
-func (m *Manager) RegisterAgentStream(uuid string, stream proto.AgentService_StreamCommandsServer) (*Agent, error) {
+// RegisterAgentStream attaches an active stream for the specified UUID and
+// returns its connection, closing the agent's previous one.
+func (m *Manager) RegisterAgentStream(uuid string, stream proto.AgentService_StreamCommandsServer) (*StreamConn, error) {
 	m.agentsLock.Lock()
 	defer m.agentsLock.Unlock()
 
@@ -271,16 +428,24 @@ func (m *Manager) RegisterAgentStream(uuid string, stream proto.AgentService_Str
 	if !exists {
 		return nil, fmt.Errorf("agent not registered: %s", uuid)
 	}
+	if !m.agentSlotAvailable(uuid) {
+		m.rejectedAgents.Add(1)
+		return nil, ErrAgentLimit
+	}
 
-	agent.stream = stream
+	conn := agent.setStream(stream)
 	agent.statusLock.Lock()
 	agent.status = StatusConnected
 	agent.lastConnected = time.Now()
 	agent.lastCheck = time.Now()
+	agent.dialed = stream != nil && dialedStream(stream.Context())
 	agent.statusLock.Unlock()
+	agent.neverConnected = false
 	m.agents[agent.Name] = agent
+	agent.quality.connected()
 
-	return agent, nil
+	m.events.Publish(events.Event{Type: events.AgentConnected, AgentUUID: uuid, Agent: agent.Name})
+	return conn, nil
 }
 
 // UnregisterAgentStream marks an agent as disconnected. The caller passes the
@@ -303,8 +468,95 @@ func (m *Manager) UnregisterAgentStream(uuid string, stream proto.AgentService_S
 
 	agent.statusLock.Lock()
 	agent.status = StatusDisconnected
-	agent.stream = nil
 	agent.statusLock.Unlock()
+	agent.setStream(nil)
+	m.recordDisconnect(agent)
+	// The agent's runs cannot complete any more; end them now rather than
+	// at the janitor's next sweep. The janitor takes agentsLock itself.
+	go m.reapOutputHandlers(time.Now())
+
+	m.events.Publish(events.Event{Type: events.AgentDisconnected, AgentUUID: uuid, Agent: agent.Name})
+}
+
+// StreamState reports whether the agent uuid holds a stream here, and whether
+// it could attach one now under the agent limit.
+func (m *Manager) StreamState(uuid string) (connected, slot bool) {
+	m.agentsLock.RLock()
+	defer m.agentsLock.RUnlock()
+	if agent, exists := m.agentsByUUID[uuid]; exists {
+		connected = agent.Status() == StatusConnected
+	}
+	return connected, m.agentSlotAvailable(uuid)
+}
+
+// ReleaseAgentStream closes the stream of an agent that connected to another
+// server at movedAt, unless its stream here is newer, so that an agent
+// switching servers is not online on both. It reports whether it closed one.
+func (m *Manager) ReleaseAgentStream(uuid string, movedAt time.Time) bool {
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if !exists || agent.Status() != StatusConnected {
+		return false
+	}
+	agent.statusLock.RLock()
+	connectedAt := agent.lastConnected
+	agent.statusLock.RUnlock()
+	if !connectedAt.Before(movedAt) {
+		return false
+	}
+	agent.closeStream(errStreamMoved)
+	return true
+}
+
+// setCommandAvailability applies an agent's command availability report to its
+// command list. Commands not mentioned keep their current state.
+func (m *Manager) setCommandAvailability(uuid string, infos []proto.CommandInfo) {
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if !exists || agent == nil {
+		return
+	}
+
+	byName := make(map[string]proto.CommandInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+
+	agent.commandsLock.Lock()
+	defer agent.commandsLock.Unlock()
+	for i, cmd := range agent.availableCommands {
+		if info, ok := byName[cmd.Name]; ok {
+			agent.availableCommands[i].Unavailable = info.Unavailable
+			agent.availableCommands[i].UnavailableReason = info.UnavailableReason
+			if info.Unavailable {
+				logger.Warnf("Agent %s reports command '%s' unavailable: %s", agent.Name, cmd.Name, info.UnavailableReason)
+			}
+			delete(byName, cmd.Name)
+		}
+	}
+
+	// Whatever is left are default templates the agent registered through
+	// auto-detect; append them in the order the agent reported them.
+	for _, info := range infos {
+		if _, pending := byName[info.Name]; !pending || !info.AutoDetected {
+			continue
+		}
+		agent.availableCommands = append(agent.availableCommands, config.CommandInfo{
+			Name:          info.Name,
+			Template:      info.Template,
+			UsePlugin:     info.UsePlugin,
+			IgnoreTarget:  info.IgnoreTarget,
+			MaximumQueue:  info.MaximumQueue,
+			Weight:        info.Weight,
+			AutoDetected:  true,
+			ExampleTarget: info.ExampleTarget,
+			HelpText:      info.HelpText,
+			Category:      info.Category,
+			TargetType:    info.TargetType,
+		})
+	}
 }
 
 // Status returns the current status of the agent
@@ -338,7 +590,7 @@ func (m *Manager) reserveCommandSlot(agentName, commandName string, maximumQueue
 	}
 	current := agent.runningCommands[commandName]
 	if current >= maximumQueue {
-		return fmt.Errorf("execution limit reached for command '%s' (%d/%d)", commandName, current, maximumQueue)
+		return &RejectionError{Code: proto.RejectBusy, Reason: fmt.Sprintf("execution limit reached for command '%s' (%d/%d)", commandName, current, maximumQueue)}
 	}
 	agent.runningCommands[commandName] = current + 1
 	return nil
@@ -365,6 +617,24 @@ func (m *Manager) releaseCommandSlot(agentName, commandName string) {
 	agent.runningCommands[commandName] = current - 1
 }
 
+// trackActive counts a dispatched command in (delta 1) or out (-1).
+func (a *Agent) trackActive(delta int) {
+	a.runningLock.Lock()
+	a.activeCommands = max(a.activeCommands+delta, 0)
+	a.runningLock.Unlock()
+}
+
+// load returns the number of commands the agent runs and of commands waiting
+// for its weight budget, so users can pick an idle location.
+func (a *Agent) load() (active, queued int) {
+	a.runningLock.Lock()
+	defer a.runningLock.Unlock()
+	for _, n := range a.weightWaiting {
+		queued += n
+	}
+	return a.activeCommands, queued
+}
+
 // GetAgents returns a list of all agents with their status and details.
 func (m *Manager) GetAgents() []map[string]any {
 	names, agents := m.getSortedAgents()
@@ -418,20 +688,62 @@ func (m *Manager) GetAgentCommands(agentName string) []validator.CommandDetail {
 
 	commands := make([]validator.CommandDetail, len(agent.availableCommands))
 	for i, cmd := range agent.availableCommands {
-		commands[i] = validator.CommandDetail{
-			Name:         cmd.Name,
-			IgnoreTarget: cmd.IgnoreTarget,
-		}
+		commands[i] = commandDetail(cmd)
 	}
 	return commands
 }
 
+// commandDetail describes cmd to clients. A plugin can force ignore_target
+// and supply the target type and queue limit the command leaves unset, so the
+// effective values are reported and the frontend gates the target input and
+// Run button correctly.
+func commandDetail(cmd config.CommandInfo) validator.CommandDetail {
+	ignoreTarget, targetType, maximumQueue := cmd.IgnoreTarget, cmd.TargetType, cmd.MaximumQueue
+	if cmd.UsePlugin != "" {
+		if hasOverride, pluginIgnore := plugin.GetPluginIgnoreTarget(cmd.UsePlugin); hasOverride {
+			ignoreTarget = pluginIgnore
+		}
+		if targetType == "" {
+			targetType = plugin.GetPluginTargetType(cmd.UsePlugin)
+		}
+		if maximumQueue <= 0 {
+			if hasOverride, pluginQueue := plugin.GetPluginMaximumQueue(cmd.UsePlugin); hasOverride {
+				maximumQueue = pluginQueue
+			}
+		}
+	}
+	detail := validator.CommandDetail{
+		Name:              cmd.Name,
+		IgnoreTarget:      ignoreTarget,
+		TargetType:        string(validator.CommandTargetType(targetType, ignoreTarget)),
+		MaximumQueue:      max(maximumQueue, 0),
+		Available:         !cmd.Unavailable,
+		Unavailable:       cmd.Unavailable,
+		UnavailableReason: cmd.UnavailableReason,
+		ExampleTarget:     cmd.ExampleTarget,
+		HelpText:          cmd.HelpText,
+		Category:          cmd.Category,
+		Weight:            max(cmd.Weight, 1),
+		RequiresApproval:  cmd.RequiresApproval,
+	}
+	if !ignoreTarget {
+		detail.DefaultTarget = cmd.DefaultTarget
+	}
+	for _, view := range cmd.Views {
+		detail.Views = append(detail.Views, validator.ViewOption{Name: view.Name, Label: view.Label})
+	}
+	return detail
+}
+
 // AgentStatusLite is the minimal per-agent status used by the Status page.
 type AgentStatusLite struct {
-	UUID   string
-	Name   string
-	Group  string
-	Online bool
+	UUID     string
+	Name     string
+	Group    string
+	Location string
+	Online   bool
+	// NeverConnected marks a provisioned agent that has not connected yet.
+	NeverConnected bool
 }
 
 // GetAgentStatusList returns a lightweight status row per agent. It avoids the
@@ -444,10 +756,12 @@ func (m *Manager) GetAgentStatusList() []AgentStatusLite {
 	list := make([]AgentStatusLite, 0, len(m.agents))
 	for name, agent := range m.agents {
 		list = append(list, AgentStatusLite{
-			UUID:   agent.UUID,
-			Name:   name,
-			Group:  agent.Group,
-			Online: agent.Status() == StatusConnected,
+			UUID:           agent.UUID,
+			Name:           name,
+			Group:          agent.Group,
+			Location:       agent.Details.Location,
+			Online:         agent.Status() == StatusConnected,
+			NeverConnected: agent.neverConnected,
 		})
 	}
 	return list
@@ -460,35 +774,49 @@ func (m *Manager) GetAgentStats() map[string]any {
 
 	online := 0
 	offline := 0
+	neverConnected := 0
+	active, queued := 0, 0
 	for _, agent := range m.agents {
 		if agent.Status() == StatusConnected {
 			online++
 		} else {
 			offline++
 		}
+		if agent.neverConnected {
+			neverConnected++
+		}
+		a, q := agent.load()
+		active += a
+		queued += q
 	}
 
 	return map[string]any{
-		"total":   len(m.agents),
-		"online":  online,
-		"offline": offline,
+		"total":           len(m.agents),
+		"online":          online,
+		"offline":         offline,
+		"never_connected": neverConnected,
+		"active":          active,
+		"queued":          queued,
 	}
 }
 
-// CleanupOfflineAgents removes agents that have been offline for more than the specified duration.
+// CleanupOfflineAgents moves agents that have been offline for more than the
+// specified duration to the tombstones; one that connects again is revived.
 func (m *Manager) CleanupOfflineAgents(maxOfflineDuration time.Duration) int {
 	m.agentsLock.Lock()
 	defer m.agentsLock.Unlock()
 
 	cleaned := 0
 	now := time.Now()
-	for name, agent := range m.agents {
+	for _, agent := range m.agents {
 		if agent.Status() == StatusDisconnected && now.Sub(agent.lastConnected) > maxOfflineDuration {
-			delete(m.agentsByUUID, agent.UUID)
-			delete(m.agents, name)
+			m.buryLocked(agent)
 			cleaned++
 		}
 	}
+	if cleaned > 0 {
+		m.events.Publish(events.Event{Type: events.CleanupPerformed, Detail: "offline agents removed", Count: cleaned})
+	}
 	return cleaned
 }
 
@@ -506,42 +834,83 @@ func (m *Manager) buildAgentInfo(name string, agent *Agent) map[string]any {
 	agent.commandsLock.RLock()
 	commands := make([]map[string]any, len(agent.availableCommands))
 	for i, cmd := range agent.availableCommands {
-		// Report the EFFECTIVE ignore_target so the frontend gates the target
-		// input/Run button correctly: a plugin can force ignore_target regardless
-		// of the command's own flag.
-		ignoreTarget := cmd.IgnoreTarget
-		if cmd.UsePlugin != "" {
-			if hasOverride, pluginIgnore := plugin.GetPluginIgnoreTarget(cmd.UsePlugin); hasOverride {
-				ignoreTarget = pluginIgnore
-			}
-		}
+		// The fields of CommandDetail, plus the template and plugin. The queue
+		// limit is also kept under its old misspelled key for older frontends.
+		detail := commandDetail(cmd)
 		commands[i] = map[string]any{
-			"name":          cmd.Name,
+			"name":          detail.Name,
 			"template":      cmd.Template,
 			"use_plugin":    cmd.UsePlugin,
-			"ignore_target": ignoreTarget,
+			"ignore_target": detail.IgnoreTarget,
+			"target_type":   detail.TargetType,
+			"maximum_queue": detail.MaximumQueue,
 			"maxmium_queue": cmd.MaximumQueue,
+			"weight":        detail.Weight,
+			"available":     detail.Available,
+		}
+		if cmd.AutoDetected {
+			commands[i]["auto_detected"] = true
+		}
+		if detail.ExampleTarget != "" {
+			commands[i]["example_target"] = detail.ExampleTarget
+		}
+		if detail.HelpText != "" {
+			commands[i]["help_text"] = detail.HelpText
+		}
+		if detail.Category != "" {
+			commands[i]["category"] = detail.Category
+		}
+		if detail.DefaultTarget != "" {
+			commands[i]["default_target"] = detail.DefaultTarget
+		}
+		if detail.RequiresApproval {
+			commands[i]["requires_approval"] = true
+		}
+		if len(detail.Views) > 0 {
+			commands[i]["views"] = detail.Views
+		}
+		if detail.Unavailable {
+			commands[i]["unavailable"] = true
+			commands[i]["unavailable_reason"] = detail.UnavailableReason
 		}
 	}
 	agent.commandsLock.RUnlock()
+	active, queued := agent.load()
+
+	connection := map[string]any{
+		"first_seen":       agent.firstSeen.Format("2006-01-02 15:04:05"),
+		"last_connected":   agent.lastConnected.Format("2006-01-02 15:04:05"),
+		"offline_duration": m.calculateOfflineDuration(agent),
+		"quality":          agent.quality.snapshot(time.Now()),
+		"direction":        agent.direction(),
+	}
+	if agent.neverConnected {
+		connection["never_connected"] = true
+	}
+	agent.clock.snapshot(connection)
+	agent.snapshotCapabilities(connection)
 
 	return map[string]any{
-		"uuid":     agent.UUID,
-		"name":     name,
-		"status":   frontendStatus,
-		"commands": commands,
+		"uuid":            agent.UUID,
+		"name":            name,
+		"status":          frontendStatus,
+		"commands":        commands,
+		"active_commands": active,
+		"queued_commands": queued,
 		"details": map[string]any{
 			"location":    agent.Details.Location,
 			"datacenter":  agent.Details.Datacenter,
 			"test_ip":     agent.Details.TestIP,
 			"description": agent.Details.Description,
+			"provider":    agent.Details.Provider,
+			"asn":         agent.Details.ASN,
+			"bandwidth":   agent.Details.Bandwidth,
+			"ipv4":        agent.Details.IPv4,
+			"ipv6":        agent.Details.IPv6,
+			"link_url":    agent.Details.LinkURL,
 			"group":       agent.Group,
 		},
-		"connection_info": map[string]any{
-			"first_seen":       agent.firstSeen.Format("2006-01-02 15:04:05"),
-			"last_connected":   agent.lastConnected.Format("2006-01-02 15:04:05"),
-			"offline_duration": m.calculateOfflineDuration(agent),
-		},
+		"connection_info": connection,
 	}
 }
 
@@ -549,6 +918,9 @@ func (m *Manager) calculateOfflineDuration(agent *Agent) string {
 	if agent.Status() == StatusConnected {
 		return ""
 	}
+	if agent.neverConnected {
+		return "Never connected"
+	}
 
 	duration := time.Since(agent.lastConnected)
 	switch {
@@ -583,46 +955,27 @@ func (m *Manager) getSortedAgents() ([]string, []map[string]any) {
 	return names, agents
 }
 
-func (m *Manager) handleCommandOutputProto(msg *proto.CommandMessage) {
-	commandID := msg.CommandID
-	if commandID == "" {
-		return
-	}
-
-	output := msg.Output
-	errorMsg := msg.Error
-	isComplete := msg.IsComplete
-	isError := msg.IsError
-	if errorMsg != "" {
-		output = errorMsg
-		isError = true
+// GetAgent returns one agent's status row. Unlike GetAgents it does not build
+// the whole registry snapshot, so it suits per-request lookups.
+func (m *Manager) GetAgent(name string) (AgentStatusLite, bool) {
+	agent := m.getAgent(name)
+	if agent == nil {
+		return AgentStatusLite{}, false
 	}
-
-	m.outputHandlersLock.RLock()
-	handler, exists := m.outputHandlers[commandID]
-	m.outputHandlersLock.RUnlock()
-	if !exists {
-		return
-	}
-
-	select {
-	case handler <- CommandOutput{Output: output, IsError: isError, IsComplete: isComplete}:
-	case <-time.After(5 * time.Second):
-	}
-}
-
-// registerOutputHandler registers a handler for command output
-func (m *Manager) registerOutputHandler(commandID string, handler chan CommandOutput) {
-	m.outputHandlersLock.Lock()
-	m.outputHandlers[commandID] = handler
-	m.outputHandlersLock.Unlock()
+	return AgentStatusLite{
+		UUID:     agent.UUID,
+		Name:     name,
+		Group:    agent.Group,
+		Location: agent.Details.Location,
+		Online:   agent.Status() == StatusConnected,
+	}, true
 }
 
-// unregisterOutputHandler removes a handler for command output
-func (m *Manager) unregisterOutputHandler(commandID string) {
-	m.outputHandlersLock.Lock()
-	delete(m.outputHandlers, commandID)
-	m.outputHandlersLock.Unlock()
+// IsCommandAvailable reports whether the agent is registered with the command.
+// A command whose binary is missing still counts; see CommandInfo.Unavailable.
+func (m *Manager) IsCommandAvailable(agentName, commandName string) bool {
+	_, ok := m.getCommandConfig(agentName, commandName)
+	return ok
 }
 
 func (m *Manager) getCommandConfig(agentName, commandName string) (config.CommandInfo, bool) {
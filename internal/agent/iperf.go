@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// iperf3Report mirrors the subset of `iperf3 -J` output used for the summary.
+// TCP tests fill sum_sent/sum_received; UDP tests report loss and jitter in sum.
+type iperf3Report struct {
+	Start struct {
+		TestStart struct {
+			Protocol string `json:"protocol"`
+			Reverse  int    `json:"reverse"`
+		} `json:"test_start"`
+	} `json:"start"`
+	End struct {
+		SumSent     iperf3Sum `json:"sum_sent"`
+		SumReceived iperf3Sum `json:"sum_received"`
+		Sum         iperf3Sum `json:"sum"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+type iperf3Sum struct {
+	Seconds       float64 `json:"seconds"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+	Retransmits   int     `json:"retransmits"`
+	JitterMs      float64 `json:"jitter_ms"`
+	LostPackets   int     `json:"lost_packets"`
+	Packets       int     `json:"packets"`
+	LostPercent   float64 `json:"lost_percent"`
+}
+
+// isIperf3JSONCommand reports whether a shell command runs iperf3 with JSON
+// output (-J / --json) in any of its segments.
+func isIperf3JSONCommand(fullCommand string) bool {
+	for _, seg := range splitShellSegments(fullCommand) {
+		fields := strings.Fields(seg)
+		if len(fields) == 0 || !strings.HasSuffix(fields[0], "iperf3") {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if f == "-J" || f == "--json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseIperf3Summary extracts the normalized summary from `iperf3 -J` output.
+// It returns false when the output holds no usable report (e.g. iperf3 failed
+// and only printed its error object).
+func parseIperf3Summary(output string) (proto.Iperf3Summary, bool) {
+	summary := proto.Iperf3Summary{Kind: proto.ResultKindIperf3}
+
+	start := strings.IndexByte(output, '{')
+	end := strings.LastIndexByte(output, '}')
+	if start == -1 || end < start {
+		return summary, false
+	}
+	var report iperf3Report
+	if err := json.Unmarshal([]byte(output[start:end+1]), &report); err != nil {
+		return summary, false
+	}
+	if report.Error != "" {
+		return summary, false
+	}
+
+	summary.Protocol = strings.ToLower(report.Start.TestStart.Protocol)
+	summary.Reverse = report.Start.TestStart.Reverse != 0
+
+	if summary.Protocol == "udp" {
+		sum := report.End.Sum
+		summary.DurationSec = sum.Seconds
+		summary.SenderBps = sum.BitsPerSecond
+		summary.ReceiverBps = sum.BitsPerSecond
+		if report.End.SumReceived.BitsPerSecond > 0 {
+			summary.ReceiverBps = report.End.SumReceived.BitsPerSecond
+		}
+		summary.JitterMs = sum.JitterMs
+		summary.LostPackets = sum.LostPackets
+		summary.Packets = sum.Packets
+		summary.LostPercent = sum.LostPercent
+	} else {
+		summary.DurationSec = report.End.SumSent.Seconds
+		summary.SenderBps = report.End.SumSent.BitsPerSecond
+		summary.ReceiverBps = report.End.SumReceived.BitsPerSecond
+		summary.Retransmits = report.End.SumSent.Retransmits
+	}
+
+	if summary.SenderBps == 0 && summary.ReceiverBps == 0 {
+		return summary, false
+	}
+	return summary, true
+}
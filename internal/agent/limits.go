@@ -0,0 +1,40 @@
+package agent
+
+import "errors"
+
+// ErrAgentLimit is returned by RegisterAgentStream when the server already
+// has its maximum number of agents connected.
+var ErrAgentLimit = errors.New("server agent limit reached")
+
+// SetMaxAgents caps how many agents may be connected at once. An agent that
+// reconnects while its old stream is still attached is never refused. 0
+// disables the cap.
+func (m *Manager) SetMaxAgents(n int) {
+	m.maxAgents.Store(int64(max(n, 0)))
+}
+
+// AgentLimitStats returns the number of connected agents and how many
+// connections the agent cap has refused so far.
+func (m *Manager) AgentLimitStats() (connected int, rejected uint64) {
+	return len(m.OnlineAgentUUIDs()), m.rejectedAgents.Load()
+}
+
+// agentSlotAvailable reports whether the agent uuid may attach a stream.
+// Callers hold agentsLock.
+func (m *Manager) agentSlotAvailable(uuid string) bool {
+	limit := int(m.maxAgents.Load())
+	if limit <= 0 {
+		return true
+	}
+	connected := 0
+	for id, agent := range m.agentsByUUID {
+		if agent.Status() != StatusConnected {
+			continue
+		}
+		if id == uuid {
+			return true
+		}
+		connected++
+	}
+	return connected < limit
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// placeholderPattern matches {name} placeholders. ${VAR} is shell parameter
+// expansion and is skipped by the caller.
+var placeholderPattern = regexp.MustCompile(`\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// substitutionConstructs run arbitrary commands from within a template; a
+// template is a fixed command line and never needs them.
+var substitutionConstructs = []struct{ token, name string }{
+	{"`", "backtick command substitution"},
+	{"$(", "$( command substitution"},
+	{"<(", "<( process substitution"},
+	{">(", ">( process substitution"},
+}
+
+// lintTemplate checks a shell template before the command is advertised.
+// Problems make the command unavailable; warnings are only logged. Plugin
+// commands have no template to check.
+func lintTemplate(cmdConfig config.CommandTemplate) (problems, warnings []string) {
+	if cmdConfig.UsePlugin != "" {
+		return nil, nil
+	}
+	template := cmdConfig.Template
+	if strings.TrimSpace(template) == "" {
+		return []string{"empty template"}, nil
+	}
+	if signal := cmdConfig.StopSignal; signal != "" && !slices.Contains(config.StopSignals, signal) {
+		problems = append(problems, fmt.Sprintf("unknown stop signal %s", signal))
+	}
+	for name := range cmdConfig.Env {
+		if !config.ValidEnvName(name) {
+			problems = append(problems, fmt.Sprintf("invalid environment variable name %q", name))
+		}
+	}
+	if cmdConfig.Nice < 0 || cmdConfig.Nice > 19 {
+		problems = append(problems, "nice out of range 0-19")
+	}
+	if cmdConfig.IOClass != "" && !slices.Contains(config.IOClasses, cmdConfig.IOClass) {
+		problems = append(problems, fmt.Sprintf("unknown io class %s", cmdConfig.IOClass))
+	}
+	if problem := execContextProblem(cmdConfig); problem != "" {
+		problems = append(problems, problem)
+	}
+	problems = append(problems, viewProblems(cmdConfig)...)
+
+	for _, c := range substitutionConstructs {
+		if strings.Contains(template, c.token) {
+			problems = append(problems, "uses "+c.name)
+		}
+	}
+	for _, loc := range placeholderPattern.FindAllStringIndex(template, -1) {
+		name := template[loc[0]:loc[1]]
+		if name == targetPlaceholder || name == config.ViewPlaceholder || (loc[0] > 0 && template[loc[0]-1] == '$') {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("unknown placeholder %s", name))
+	}
+
+	// Templates with shell operators run under bash. The target is validated
+	// as an IP address or domain, so an unquoted {target} is not exploitable
+	// today, but quoting keeps the template safe on its own.
+	if !cmdConfig.IgnoreTarget && isShellTemplate(template) && hasUnquotedTarget(template) {
+		warnings = append(warnings, "{target} is not quoted in a shell template")
+	}
+	return problems, warnings
+}
+
+// execContextProblem checks the container or network namespace of a
+// template, returning "" when there is nothing wrong.
+func execContextProblem(cmdConfig config.CommandTemplate) string {
+	switch {
+	case cmdConfig.Container != "" && cmdConfig.NetNS != "":
+		return "both a container and a network namespace"
+	case cmdConfig.Container != "" && !config.ValidExecContextName(cmdConfig.Container):
+		return fmt.Sprintf("invalid container name %q", cmdConfig.Container)
+	case cmdConfig.Container != "" && (cmdConfig.Nice != 0 || cmdConfig.IOClass != ""):
+		return "nice and io class do not apply inside a container"
+	case cmdConfig.NetNS != "" && !config.ValidExecContextName(cmdConfig.NetNS):
+		return fmt.Sprintf("invalid network namespace name %q", cmdConfig.NetNS)
+	case cmdConfig.NetNS != "" && runtime.GOOS != "linux":
+		return "network namespaces need a Linux agent"
+	}
+	return ""
+}
+
+// viewProblems checks the views of a template.
+func viewProblems(cmdConfig config.CommandTemplate) []string {
+	var problems []string
+	for _, view := range cmdConfig.Views {
+		switch {
+		case !config.ValidExecContextName(view.Name):
+			problems = append(problems, fmt.Sprintf("invalid view name %q", view.Name))
+		case !config.ValidViewArgs(view.Args):
+			problems = append(problems, fmt.Sprintf("view %s: arguments a shell could expand", view.Name))
+		case view.VRF == "":
+		case !config.ValidExecContextName(view.VRF):
+			problems = append(problems, fmt.Sprintf("view %s: invalid VRF name %q", view.Name, view.VRF))
+		case cmdConfig.Container != "":
+			problems = append(problems, fmt.Sprintf("view %s: a VRF does not apply inside a container", view.Name))
+		case runtime.GOOS != "linux":
+			problems = append(problems, fmt.Sprintf("view %s: VRFs need a Linux agent", view.Name))
+		}
+	}
+	return problems
+}
+
+// isShellTemplate reports whether a template is run through bash (see
+// createCommand).
+func isShellTemplate(template string) bool {
+	for _, op := range shellOperators {
+		if strings.Contains(template, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUnquotedTarget reports whether any {target} in template is outside single
+// and double quotes.
+func hasUnquotedTarget(template string) bool {
+	var quote byte
+	for i := 0; i < len(template); i++ {
+		switch ch := template[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case strings.HasPrefix(template[i:], targetPlaceholder):
+			return true
+		}
+	}
+	return false
+}
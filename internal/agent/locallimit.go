@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// localLimits caps executions on the agent host itself, whatever the server
+// sends: at most perMinute started in any 60 seconds and at most concurrent
+// running at once (0 = unlimited). They protect the node when the server is
+// misconfigured or compromised.
+type localLimits struct {
+	mu         sync.Mutex
+	perMinute  int
+	concurrent int
+	starts     []time.Time
+	running    int
+}
+
+// acquire admits one execution, or returns a RejectRateLimited rejection.
+// On nil the caller must call release when the execution ends.
+func (l *localLimits) acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.concurrent > 0 && l.running >= l.concurrent {
+		return rejectf(proto.RejectRateLimited, "limit of %d concurrent commands reached", l.concurrent)
+	}
+	if l.perMinute > 0 {
+		now := time.Now()
+		l.starts = l.starts[len(l.starts)-countSince(l.starts, now.Add(-time.Minute)):]
+		if len(l.starts) >= l.perMinute {
+			return rejectf(proto.RejectRateLimited, "limit of %d commands per minute reached", l.perMinute)
+		}
+		l.starts = append(l.starts, now)
+	}
+	l.running++
+	return nil
+}
+
+func (l *localLimits) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+}
@@ -6,8 +6,8 @@ import (
 	"runtime"
 	"time"
 
-	"YALS/internal/logger"
-	"YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
 
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/disk"
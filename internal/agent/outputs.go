@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+const (
+	// outputHandlerMaxRuntime bounds how long a command may wait for its agent
+	// to complete it. Long-running plugins (speedtest, geekbench6) stay well
+	// below this.
+	outputHandlerMaxRuntime = 30 * time.Minute
+	// outputJanitorInterval is how often handlers are checked for orphaning.
+	outputJanitorInterval = 30 * time.Second
+)
+
+// outputHandler is the output pipeline owned by one running command. It routes
+// the agent's output messages to the goroutine waiting on the command.
+//
+// The channel is never closed: closing it while handleCommandOutputProto may
+// still be sending (it waits up to 5s on a full buffer) would panic. Instead the
+// pipeline is shut down by cancelling ctx; senders select on ctx.Done(), so
+// messages arriving after the command finished are dropped safely and the
+// channel is simply garbage-collected with the handler.
+//
+// The handler also remembers the stream the command was dispatched on: if that
+// stream goes away the agent can never complete the command, so the janitor
+// reaps the handler instead of letting it leak.
+type outputHandler struct {
+	ch        chan CommandOutput
+	ctx       context.Context
+	cancel    context.CancelFunc
+	agentUUID string
+	stream    proto.AgentService_StreamCommandsServer
+	deadline  time.Time
+
+	// reason is set (before ctx is cancelled) when the janitor reaps the handler.
+	reason string
+}
+
+func (m *Manager) handleCommandOutputProto(msg *proto.CommandMessage) {
+	commandID := msg.CommandID
+	if commandID == "" {
+		return
+	}
+
+	output := msg.Output
+	errorMsg := msg.Error
+	isComplete := msg.IsComplete
+	isError := msg.IsError
+	if errorMsg != "" {
+		output = errorMsg
+		isError = true
+	}
+
+	m.outputHandlersLock.RLock()
+	handler, exists := m.outputHandlers[commandID]
+	m.outputHandlersLock.RUnlock()
+	if !exists {
+		return
+	}
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	select {
+	case handler.ch <- CommandOutput{Output: output, IsError: isError, IsComplete: isComplete, Data: msg.Data, Code: msg.Code, ReceivedAt: msg.ReceivedAt}:
+	case <-handler.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// openOutputPipeline registers the output pipeline for a command dispatched to
+// agent on its current stream. The caller owns it and must closeOutputPipeline.
+func (m *Manager) openOutputPipeline(commandID string, agent *Agent) *outputHandler {
+	m.agentsLock.RLock()
+	stream := agent.stream
+	m.agentsLock.RUnlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &outputHandler{
+		ch:        make(chan CommandOutput, 1000),
+		ctx:       ctx,
+		cancel:    cancel,
+		agentUUID: agent.UUID,
+		stream:    stream,
+		deadline:  time.Now().Add(outputHandlerMaxRuntime),
+	}
+	m.outputHandlersLock.Lock()
+	m.outputHandlers[commandID] = handler
+	m.outputHandlersLock.Unlock()
+	return handler
+}
+
+// closeOutputPipeline unregisters a command's pipeline and cancels it, so any
+// sender still blocked on it returns immediately.
+func (m *Manager) closeOutputPipeline(commandID string, handler *outputHandler) {
+	m.outputHandlersLock.Lock()
+	if m.outputHandlers[commandID] == handler {
+		delete(m.outputHandlers, commandID)
+	}
+	m.outputHandlersLock.Unlock()
+	handler.cancel()
+}
+
+// runOutputJanitor periodically reaps orphaned output handlers until ctx ends.
+func (m *Manager) runOutputJanitor(ctx context.Context) {
+	ticker := time.NewTicker(outputJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.reapOutputHandlers(time.Now())
+	}
+}
+
+// reapOutputHandlers removes handlers whose agent stream is gone (agent crashed
+// or reconnected mid-run, so is_complete will never arrive) or whose deadline
+// has passed, and wakes the goroutine waiting on each.
+func (m *Manager) reapOutputHandlers(now time.Time) {
+	type orphan struct {
+		commandID string
+		handler   *outputHandler
+		reason    string
+	}
+	var orphans []orphan
+
+	m.outputHandlersLock.RLock()
+	m.agentsLock.RLock()
+	for commandID, handler := range m.outputHandlers {
+		reason := ""
+		agent, exists := m.agentsByUUID[handler.agentUUID]
+		switch {
+		case !exists || agent.stream == nil || agent.stream != handler.stream:
+			reason = "agent disconnected before the command completed"
+		case now.After(handler.deadline):
+			reason = fmt.Sprintf("command exceeded the maximum runtime of %s", outputHandlerMaxRuntime)
+		}
+		if reason != "" {
+			orphans = append(orphans, orphan{commandID, handler, reason})
+		}
+	}
+	m.agentsLock.RUnlock()
+	m.outputHandlersLock.RUnlock()
+
+	if len(orphans) == 0 {
+		return
+	}
+
+	m.outputHandlersLock.Lock()
+	for _, o := range orphans {
+		if m.outputHandlers[o.commandID] != o.handler {
+			continue // completed or replaced meanwhile
+		}
+		delete(m.outputHandlers, o.commandID)
+		o.handler.reason = o.reason
+		o.handler.cancel()
+		atomic.AddUint64(&m.orphanedHandlers, 1)
+		logger.Warnf("Reaped orphaned output handler %s: %s", o.commandID, o.reason)
+	}
+	m.outputHandlersLock.Unlock()
+
+	m.events.Publish(events.Event{Type: events.CleanupPerformed, Detail: "orphaned output handlers reaped", Count: len(orphans)})
+}
+
+// OutputHandlerStats reports the number of in-flight output handlers and the
+// total number reaped as orphans since start.
+func (m *Manager) OutputHandlerStats() (active int, orphaned uint64) {
+	m.outputHandlersLock.RLock()
+	active = len(m.outputHandlers)
+	m.outputHandlersLock.RUnlock()
+	return active, atomic.LoadUint64(&m.orphanedHandlers)
+}
@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+type outputTimingKey struct{}
+
+// WithOutputTiming returns ctx whose commands call received with the time the
+// server received each agent message, just before the message is handed to the
+// output callbacks. Callers measure the rest of an output's way to a client
+// from it. received may be called from the goroutines of several commands.
+func WithOutputTiming(ctx context.Context, received func(time.Time)) context.Context {
+	return context.WithValue(ctx, outputTimingKey{}, received)
+}
+
+func outputTimingFrom(ctx context.Context) func(time.Time) {
+	received, _ := ctx.Value(outputTimingKey{}).(func(time.Time))
+	return received
+}
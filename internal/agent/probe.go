@@ -9,8 +9,8 @@ import (
 	"sync"
 	"time"
 
-	"YALS/internal/logger"
-	"YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
 
 	probing "github.com/prometheus-community/pro-bing"
 )
@@ -72,7 +72,7 @@ func (c *Client) runProbeCycle(ctx context.Context, stream proto.AgentService_St
 		go func(i int, t proto.ProbeTargetSpec) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			results[i] = probeOne(t)
+			results[i] = probeOne(t, c.sockets.pingMode())
 		}(i, t)
 	}
 	wg.Wait()
@@ -94,16 +94,21 @@ func (c *Client) runProbeCycle(ctx context.Context, stream proto.AgentService_St
 // probeOne measures a single target for one cycle, dispatching on its protocol.
 // TCP measures connect (handshake) RTT; everything else (empty/ICMP/unknown)
 // falls back to ICMP, so existing ICMP-only configs keep working unchanged.
-func probeOne(t proto.ProbeTargetSpec) proto.ProbeResult {
+// ICMP is sent the way pingMode allows (see capabilities.go).
+func probeOne(t proto.ProbeTargetSpec, pingMode string) proto.ProbeResult {
 	if strings.EqualFold(t.Protocol, "TCP") {
 		return probeTCP(t)
 	}
-	return probeICMP(t)
+	if pingMode == pingModeExec {
+		return probeExec(t)
+	}
+	return probeICMP(t, pingMode == pingModeRaw)
 }
 
-// probeICMP ICMP-pings a single target and returns its cycle result. A failure to
-// run (e.g. missing raw-socket privilege) yields zero received packets (100% loss).
-func probeICMP(t proto.ProbeTargetSpec) proto.ProbeResult {
+// probeICMP ICMP-pings a single target over a raw or unprivileged socket and
+// returns its cycle result. A failure to run yields zero received packets
+// (100% loss).
+func probeICMP(t proto.ProbeTargetSpec, privileged bool) proto.ProbeResult {
 	res := proto.ProbeResult{Name: t.Name, Sent: probePingCount}
 
 	pinger, err := probing.NewPinger(t.IP)
@@ -113,7 +118,7 @@ func probeICMP(t proto.ProbeTargetSpec) proto.ProbeResult {
 	pinger.Count = probePingCount
 	pinger.Timeout = probePingTimeout
 	pinger.Interval = 300 * time.Millisecond
-	pinger.SetPrivileged(true) // raw ICMP; the agent already needs privileges for mtr/traceroute
+	pinger.SetPrivileged(privileged)
 
 	if err := pinger.Run(); err != nil {
 		return res
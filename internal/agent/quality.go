@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+const (
+	// qualityWindow is how far back disconnects count towards the score.
+	qualityWindow = 24 * time.Hour
+	// flapWindow and flapThreshold define a flapping agent: at least
+	// flapThreshold unplanned disconnects within flapWindow.
+	flapWindow    = time.Hour
+	flapThreshold = 3
+	// rttSamples heartbeat round-trip times are kept (30 minutes at the
+	// 30 s heartbeat interval).
+	rttSamples = 60
+)
+
+// connQuality is an agent's connection history: recent unplanned
+// disconnects, heartbeat round-trip times and unanswered heartbeats.
+type connQuality struct {
+	mu            sync.Mutex
+	disconnects   []time.Time
+	reloading     bool
+	heartbeatSent time.Time
+	rtts          []time.Duration
+	missed        []time.Time
+	flapping      bool
+}
+
+// connected records a (re)attached stream.
+func (q *connQuality) connected() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heartbeatSent = time.Time{}
+}
+
+// disconnected records a detached stream. Reconnects the server asked for
+// (config reloads) do not count. It reports whether the agent has just
+// started flapping.
+func (q *connQuality) disconnected(now time.Time) (startedFlapping bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heartbeatSent = time.Time{}
+	if q.reloading {
+		q.reloading = false
+		return false
+	}
+	q.disconnects = append(q.disconnects, now)
+	q.trim(now)
+	wasFlapping := q.flapping
+	q.flapping = countSince(q.disconnects, now.Add(-flapWindow)) >= flapThreshold
+	return q.flapping && !wasFlapping
+}
+
+// heartbeatSending records an outgoing heartbeat. One still unanswered
+// counts as missed.
+func (q *connQuality) heartbeatSending(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.heartbeatSent.IsZero() {
+		q.missed = append(q.missed, now)
+	}
+	q.heartbeatSent = now
+	q.trim(now)
+}
+
+// heartbeatAnswered records the agent's heartbeat reply.
+func (q *connQuality) heartbeatAnswered(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.heartbeatSent.IsZero() {
+		return
+	}
+	q.rtts = append(q.rtts, now.Sub(q.heartbeatSent))
+	if len(q.rtts) > rttSamples {
+		q.rtts = q.rtts[len(q.rtts)-rttSamples:]
+	}
+	q.heartbeatSent = time.Time{}
+}
+
+// trim drops events older than qualityWindow. Callers hold mu.
+func (q *connQuality) trim(now time.Time) {
+	cutoff := now.Add(-qualityWindow)
+	q.disconnects = q.disconnects[len(q.disconnects)-countSince(q.disconnects, cutoff):]
+	q.missed = q.missed[len(q.missed)-countSince(q.missed, cutoff):]
+}
+
+// countSince counts the times (in ascending order) at or after since.
+func countSince(times []time.Time, since time.Time) int {
+	for i, t := range times {
+		if !t.Before(since) {
+			return len(times) - i
+		}
+	}
+	return 0
+}
+
+// snapshot summarizes the history for buildAgentInfo. The stability score
+// starts at 100 and loses 10 points per unplanned disconnect and 2 per
+// unanswered heartbeat in the last 24 hours.
+func (q *connQuality) snapshot(now time.Time) map[string]any {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.trim(now)
+	disconnects := len(q.disconnects)
+	hourly := countSince(q.disconnects, now.Add(-flapWindow))
+	flapping := hourly >= flapThreshold
+	q.flapping = flapping
+
+	info := map[string]any{
+		"stability":         max(0, 100-10*disconnects-2*len(q.missed)),
+		"flapping":          flapping,
+		"disconnects_1h":    hourly,
+		"disconnects_24h":   disconnects,
+		"missed_heartbeats": len(q.missed),
+	}
+	if len(q.rtts) > 0 {
+		var sum, peak time.Duration
+		for _, rtt := range q.rtts {
+			sum += rtt
+			peak = max(peak, rtt)
+		}
+		info["rtt_ms"] = durationMs(q.rtts[len(q.rtts)-1])
+		info["rtt_avg_ms"] = durationMs(sum / time.Duration(len(q.rtts)))
+		info["rtt_max_ms"] = durationMs(peak)
+	}
+	return info
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// SendHeartbeat sends an in-stream heartbeat on the agent's connection conn
+// and times its reply. A heartbeat that cannot be written closes conn, so
+// that the agent reconnects instead of staying listed with a dead stream.
+func (m *Manager) SendHeartbeat(uuid string, conn *StreamConn) error {
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if exists && agent != nil && agent.conn == conn {
+		agent.quality.heartbeatSending(time.Now())
+	}
+	if err := conn.send(&proto.CommandMessage{Type: "heartbeat"}); err != nil {
+		conn.Close(fmt.Errorf("heartbeat: %w", err))
+		return err
+	}
+	return nil
+}
+
+// FlappingAgents returns how many agents are currently flapping.
+func (m *Manager) FlappingAgents() int {
+	m.agentsLock.RLock()
+	defer m.agentsLock.RUnlock()
+	now := time.Now()
+	count := 0
+	for _, agent := range m.agentsByUUID {
+		agent.quality.mu.Lock()
+		if countSince(agent.quality.disconnects, now.Add(-flapWindow)) >= flapThreshold {
+			count++
+		}
+		agent.quality.mu.Unlock()
+	}
+	return count
+}
+
+func (m *Manager) recordHeartbeatReply(uuid string) {
+	m.agentsLock.RLock()
+	agent, exists := m.agentsByUUID[uuid]
+	m.agentsLock.RUnlock()
+	if exists && agent != nil {
+		agent.quality.heartbeatAnswered(time.Now())
+	}
+}
+
+func (m *Manager) recordDisconnect(agent *Agent) {
+	if agent.quality.disconnected(time.Now()) {
+		logger.Warnf("Agent %s is flapping: %d or more disconnects within %s", agent.Name, flapThreshold, flapWindow)
+	}
+}
@@ -0,0 +1,17 @@
+package agent
+
+import "context"
+
+type requesterKey struct{}
+
+// WithRequester returns ctx naming who asked for the commands executed with
+// it, e.g. a client IP. The manager reports it in the CommandStarted and
+// CommandFinished events.
+func WithRequester(ctx context.Context, requester string) context.Context {
+	return context.WithValue(ctx, requesterKey{}, requester)
+}
+
+func requesterFrom(ctx context.Context) string {
+	requester, _ := ctx.Value(requesterKey{}).(string)
+	return requester
+}
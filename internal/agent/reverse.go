@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+// Reverse connections serve agents that cannot open connections to the
+// server: the agent listens (agent -listen) and the server dials it. Once the
+// two have authenticated each other, the roles of the connection flip back,
+// the agent runs its usual gRPC client over it and the server serves it like
+// any other agent connection, so the Manager sees no difference.
+//
+// Over TLS with the built-in certificate, the listener greets with
+//
+//	YALS-REVERSE/1 <agent uuid> <nonce>
+//
+// and the server proves it knows the agent's token by answering
+// HMAC-SHA256(token, nonce) in hex. The agent answers OK, or closes the
+// connection. The agent then authenticates to the server as usual with the
+// gRPC handshake.
+const (
+	reverseGreeting = "YALS-REVERSE/1"
+	// reverseAuthTimeout bounds the exchange before the gRPC handshake.
+	reverseAuthTimeout = 10 * time.Second
+	// reverseLineMax is the longest line of the exchange.
+	reverseLineMax = 256
+)
+
+var errReverseConnUsed = errors.New("reverse connection already used")
+
+// reverseProof is the server's answer to nonce.
+func reverseProof(token, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(token)))
+	mac.Write([]byte(reverseGreeting + " " + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readLine reads one line byte by byte, so that nothing the peer sends after
+// it, the start of the gRPC stream, is consumed.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < reverseLineMax {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("line too long")
+}
+
+// DialAgent dials the listener of agent uuid at address and proves the server
+// knows its token. The connection is then ready to be served by the gRPC
+// server (see ReverseListener).
+func DialAgent(ctx context.Context, address, uuid, token string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := yalstls.ClientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticateToAgent(ctx, conn, uuid, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func authenticateToAgent(ctx context.Context, conn net.Conn, uuid, token string) error {
+	deadline := time.Now().Add(reverseAuthTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	greeting, err := readLine(conn)
+	if err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	fields := strings.Fields(greeting)
+	if len(fields) != 3 || fields[0] != reverseGreeting {
+		return errors.New("not a YALS agent listener")
+	}
+	if fields[1] != uuid {
+		return fmt.Errorf("listener belongs to agent %s", fields[1])
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", reverseProof(token, fields[2])); err != nil {
+		return err
+	}
+	answer, err := readLine(conn)
+	if err != nil {
+		return errors.New("agent refused the server (token mismatch?)")
+	}
+	if answer != "OK" {
+		return fmt.Errorf("agent refused the server: %s", answer)
+	}
+	return nil
+}
+
+// ListenForServer accepts connections from the server on address until ctx
+// is cancelled, and runs the agent over the first one that authenticates.
+// Further connections are refused while it is open.
+func (c *Client) ListenForServer(ctx context.Context, address string) error {
+	tlsConfig, err := yalstls.ServerConfig()
+	if err != nil {
+		return err
+	}
+	listenConfig := net.ListenConfig{KeepAlive: c.netDialer().KeepAlive}
+	tcpListener, err := listenConfig.Listen(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	listener := tls.NewListener(tcpListener, tlsConfig)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	logger.Infof("Waiting for the server to connect on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warnf("Accept failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go c.handleServerConn(ctx, conn)
+	}
+}
+
+func (c *Client) handleServerConn(ctx context.Context, conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	if err := c.authenticateServer(conn); err != nil {
+		logger.Warnf("Refused connection from %s: %v", remote, err)
+		conn.Close()
+		return
+	}
+	if !c.serverConnected.CompareAndSwap(false, true) {
+		logger.Warnf("Refused connection from %s: already connected to a server", remote)
+		conn.Close()
+		return
+	}
+	defer c.serverConnected.Store(false)
+
+	logger.Infof("Server connected from %s", remote)
+	if err := c.serveServerConn(ctx, conn); err != nil {
+		logger.Errorf("Connection failed: %v", err)
+	}
+	logger.Infof("Server connection from %s closed", remote)
+}
+
+// authenticateServer checks that the server on conn knows this agent's token.
+func (c *Client) authenticateServer(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(reverseAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(buf)
+	if _, err := fmt.Fprintf(conn, "%s %s %s\n", reverseGreeting, c.bootUUID, nonce); err != nil {
+		return err
+	}
+	proof, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(proof), []byte(reverseProof(c.bootToken, nonce))) != 1 {
+		_, _ = fmt.Fprintf(conn, "invalid token\n")
+		return errors.New("invalid token proof")
+	}
+	_, err = fmt.Fprintf(conn, "OK\n")
+	return err
+}
+
+// serveServerConn runs the agent's gRPC client over conn, an authenticated
+// connection from the server. Its TLS is already in place.
+func (c *Client) serveServerConn(ctx context.Context, conn net.Conn) error {
+	var once sync.Once
+	dial := func(context.Context, string) (net.Conn, error) {
+		err := errReverseConnUsed
+		once.Do(func() { err = nil })
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	opts := append(c.streamDialOptions(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+	)
+	grpcConn, err := grpc.Dial("passthrough:///yals-server", opts...)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer grpcConn.Close()
+	return c.serve(ctx, grpcConn)
+}
+
+// ReverseListener hands the connections the server dialed to its gRPC server
+// as if agents had opened them.
+type ReverseListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewReverseListener returns an open listener.
+func NewReverseListener() *ReverseListener {
+	return &ReverseListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Serve passes conn to Accept. The returned channel is closed once the
+// connection is.
+func (l *ReverseListener) Serve(conn net.Conn) <-chan struct{} {
+	rc := &reverseConn{Conn: conn, done: make(chan struct{})}
+	select {
+	case l.conns <- rc:
+	case <-l.closed:
+		rc.Close()
+	}
+	return rc.done
+}
+
+// Accept implements net.Listener.
+func (l *ReverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.
+func (l *ReverseListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *ReverseListener) Addr() net.Addr {
+	return reverseAddr{}
+}
+
+// reverseConn is a dialed connection; its remote address marks it as such.
+type reverseConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *reverseConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *reverseConn) RemoteAddr() net.Addr {
+	return reverseAddr{c.Conn.RemoteAddr()}
+}
+
+// reverseAddr is the address of an agent the server dialed.
+type reverseAddr struct {
+	remote net.Addr
+}
+
+func (a reverseAddr) Network() string { return "tcp" }
+
+func (a reverseAddr) String() string {
+	if a.remote == nil {
+		return "reverse"
+	}
+	return a.remote.String()
+}
+
+// dialedStream reports whether ctx, a stream's context, belongs to a
+// connection the server dialed.
+func dialedStream(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, dialed := p.Addr.(reverseAddr)
+	return dialed
+}
+
+// direction is how the agent's connection was opened: "dialed" by the server
+// or "inbound" from the agent.
+func (a *Agent) direction() string {
+	a.statusLock.RLock()
+	defer a.statusLock.RUnlock()
+	if a.dialed {
+		return "dialed"
+	}
+	return "inbound"
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshHandshakeTimeout bounds the connection to the jump host and its SSH
+// handshake.
+const sshHandshakeTimeout = 15 * time.Second
+
+// sshTunnel opens the agent's connections to the server through an SSH jump
+// host (see config.SSHTunnelConfig).
+type sshTunnel struct {
+	address string
+	config  *ssh.ClientConfig
+	dialer  net.Dialer
+}
+
+// UseSSHTunnel makes the agent reach the server through the jump host of cfg.
+// The key and known hosts files are read now, so that mistakes show at
+// start-up.
+func (c *Client) UseSSHTunnel(cfg config.SSHTunnelConfig) error {
+	if cfg.Host == "" {
+		return nil
+	}
+	if cfg.User == "" || cfg.Key == "" {
+		return errors.New("ssh tunnel needs a user and a key")
+	}
+	address := cfg.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	keyPEM, err := os.ReadFile(cfg.Key)
+	if err != nil {
+		return fmt.Errorf("ssh tunnel key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("ssh tunnel key %s: %w", cfg.Key, err)
+	}
+	knownHostsFile := cfg.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("ssh tunnel known hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("ssh tunnel known hosts: %w", err)
+	}
+
+	c.sshTunnel = &sshTunnel{
+		address: address,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshHandshakeTimeout,
+		},
+		dialer: c.netDialer(),
+	}
+	return nil
+}
+
+// dial connects to the jump host and, from there, to addr. Closing the
+// returned connection also closes the SSH connection.
+func (t *sshTunnel) dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshHandshakeTimeout)
+	defer cancel()
+	raw, err := t.dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("ssh jump host %s: %w", t.address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = raw.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(raw, t.address, t.config)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("ssh jump host %s: %w", t.address, err)
+	}
+	_ = raw.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ssh jump host %s could not reach %s: %w", t.address, addr, err)
+	}
+	return &sshTunnelConn{Conn: conn, client: client}, nil
+}
+
+// sshTunnelConn is a connection through the jump host.
+type sshTunnelConn struct {
+	net.Conn
+	client *ssh.Client
+	once   sync.Once
+}
+
+func (c *sshTunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.client.Close() })
+	return err
+}
+
+// String names the jump host for the log, e.g. "yals@bastion:22".
+func (t *sshTunnel) String() string {
+	return t.config.User + "@" + t.address
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serverCheckTimeout bounds one health check of a server.
+const serverCheckTimeout = 10 * time.Second
+
+// ServerEndpoint is a server the agent can connect to: its primary, given by
+// -s/-p, or a standby.
+type ServerEndpoint struct {
+	Host string
+	Port int
+}
+
+func (e ServerEndpoint) String() string {
+	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+}
+
+// ParseServerEndpoint parses "host" or "host:port" ("[v6]:port" for an IPv6
+// address), taking defaultPort when the port is left out.
+func ParseServerEndpoint(s string, defaultPort int) (ServerEndpoint, error) {
+	s = strings.TrimSpace(s)
+	host, portText, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port: a host name, an IPv4 address or a bare IPv6 address.
+		host, portText = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ""
+	}
+	if host == "" || strings.ContainsAny(host, " /") {
+		return ServerEndpoint{}, fmt.Errorf("invalid server %q (want host[:port])", s)
+	}
+	port := defaultPort
+	if portText != "" {
+		if port, err = strconv.Atoi(portText); err != nil || port <= 0 || port > 65535 {
+			return ServerEndpoint{}, fmt.Errorf("invalid port in server %q", s)
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return ServerEndpoint{Host: host, Port: port}, nil
+}
+
+// UseServer makes the next connection go to e. The Run loop of a client with
+// standby servers calls it between connections.
+func (c *Client) UseServer(e ServerEndpoint) {
+	c.bootHost, c.bootPort = e.Host, e.Port
+	c.config.Server.Host, c.config.Server.Port = e.Host, e.Port
+}
+
+// CheckServer asks the server at e whether it would take this agent's stream
+// now, without connecting to it. A server too old to answer is taken as
+// healthy once it can be reached.
+func (c *Client) CheckServer(ctx context.Context, e ServerEndpoint) error {
+	conn, err := c.dialAddress(e.Host, e.Port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, serverCheckTimeout)
+	defer cancel()
+	resp, err := proto.NewAgentServiceClient(conn).Health(ctx, &proto.HealthRequest{UUID: c.bootUUID, Token: c.bootToken})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		return nil
+	case err != nil:
+		return err
+	case !resp.Ready:
+		return errors.New(resp.Message)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// stopPolicy is how a stopped run of a shell template ends: the signal it is
+// sent first, how long it may take to exit before it is killed, and whether
+// its whole process group is signalled (stop_signal, stop_grace_seconds and
+// stop_process_group).
+type stopPolicy struct {
+	signal string
+	grace  time.Duration
+	group  bool
+}
+
+func newStopPolicy(cmdConfig config.CommandTemplate) stopPolicy {
+	policy := stopPolicy{signal: cmdConfig.StopSignal, group: cmdConfig.StopProcessGroup}
+	if policy.signal == "" {
+		policy.signal = "SIGKILL"
+	}
+	if policy.signal != "SIGKILL" {
+		policy.grace = config.DefaultStopGraceSeconds * time.Second
+		if seconds := cmdConfig.StopGraceSeconds; seconds > 0 {
+			policy.grace = time.Duration(min(seconds, config.MaxStopGraceSeconds)) * time.Second
+		}
+	}
+	return policy
+}
+
+// stop sends cmd the policy's signal, then kills it unless exited is closed
+// within the grace period. A process group is killed once its leader exits
+// too, so that no child outlives the run.
+func (p stopPolicy) stop(commandID string, cmd *exec.Cmd, exited <-chan struct{}) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := signalCommand(cmd, p.signal, p.group); err != nil {
+		logger.Warnf("Failed to send %s to command %s: %v", p.signal, commandID, err)
+	}
+	if p.signal == "SIGKILL" {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(p.grace)
+		defer timer.Stop()
+		select {
+		case <-exited:
+			if !p.group {
+				return
+			}
+		case <-timer.C:
+			logger.Infof("Command %s did not exit within %s of %s; killing it", commandID, p.grace, p.signal)
+		}
+		_ = signalCommand(cmd, "SIGKILL", p.group)
+	}()
+}
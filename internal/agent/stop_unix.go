@@ -0,0 +1,39 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// setProcessGroup makes cmd the leader of a new process group, which its
+// children join.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalCommand sends the named signal to cmd's process, or to its process
+// group.
+func signalCommand(cmd *exec.Cmd, name string, group bool) error {
+	sig, ok := stopSignals[name]
+	if !ok {
+		return fmt.Errorf("unknown signal %s", name)
+	}
+	if group {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
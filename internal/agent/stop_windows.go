@@ -0,0 +1,11 @@
+package agent
+
+import "os/exec"
+
+// setProcessGroup does nothing: Windows has no process groups to signal.
+func setProcessGroup(*exec.Cmd) {}
+
+// signalCommand kills cmd's process, since Windows has no signals.
+func signalCommand(cmd *exec.Cmd, _ string, _ bool) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+const (
+	// agentOutboxSize bounds the messages queued for one agent stream.
+	agentOutboxSize = 256
+	// agentEnqueueTimeout is how long a caller waits for room in a full
+	// outbox before giving up (backpressure from a slow agent link).
+	agentEnqueueTimeout = 2 * time.Second
+	// agentWriteTimeout is how long a caller waits for its message to be
+	// written to the agent stream.
+	agentWriteTimeout = 10 * time.Second
+)
+
+var (
+	errAgentStreamUnavailable = errors.New("agent stream unavailable")
+	// errStreamReplaced closes a stream superseded by the agent's newer one.
+	errStreamReplaced = errors.New("replaced by a newer stream of the agent")
+	// errStreamMoved closes the stream of an agent that connected to another
+	// server since (see Manager.ReleaseAgentStream).
+	errStreamMoved = errors.New("agent moved to another server")
+	// errAgentDisconnected closes the stream of an agent DisconnectAgent
+	// removed.
+	errAgentDisconnected = errors.New("agent disconnected by the server")
+)
+
+// StreamConn is the server side of one agent stream, and the only owner of
+// its lifecycle. HandleAgentConnection is its single reader and a writer
+// goroutine its single sender, so a stalled agent link blocks only that
+// goroutine; callers wait at most agentEnqueueTimeout + agentWriteTimeout.
+// Whoever notices the stream is done - the reader, the writer, a failed
+// heartbeat, or the Manager replacing or disconnecting the agent - calls
+// Close, which takes effect once and ends StreamCommands.
+type StreamConn struct {
+	stream proto.AgentService_StreamCommandsServer
+	queue  chan outboundMessage
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+type outboundMessage struct {
+	msg    *proto.CommandMessage
+	result chan error
+}
+
+func newStreamConn(stream proto.AgentService_StreamCommandsServer) *StreamConn {
+	c := &StreamConn{
+		stream: stream,
+		queue:  make(chan outboundMessage, agentOutboxSize),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// run writes queued messages until the connection is closed. A failed write
+// leaves the stream unusable, so it closes the connection.
+func (c *StreamConn) run() {
+	ctxDone := c.stream.Context().Done()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ctxDone:
+			c.Close(c.stream.Context().Err())
+			return
+		case out := <-c.queue:
+			err := c.stream.Send(out.msg)
+			out.result <- err
+			if err != nil {
+				c.Close(fmt.Errorf("send to agent: %w", err))
+				return
+			}
+		}
+	}
+}
+
+// Close ends the connection with err as the reason. Only the first call has
+// an effect.
+func (c *StreamConn) Close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Done is closed when the connection is closed.
+func (c *StreamConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was closed, or nil while it is open.
+func (c *StreamConn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// send queues msg and waits for it to be written. A message that times out
+// waiting for the write may still be delivered later.
+func (c *StreamConn) send(msg *proto.CommandMessage) error {
+	out := outboundMessage{msg: msg, result: make(chan error, 1)}
+
+	enqueue := time.NewTimer(agentEnqueueTimeout)
+	defer enqueue.Stop()
+	select {
+	case c.queue <- out:
+	case <-c.done:
+		return errAgentStreamUnavailable
+	case <-enqueue.C:
+		return fmt.Errorf("agent outbound queue full")
+	}
+
+	write := time.NewTimer(agentWriteTimeout)
+	defer write.Stop()
+	select {
+	case err := <-out.result:
+		return err
+	case <-c.done:
+		return errAgentStreamUnavailable
+	case <-write.C:
+		return fmt.Errorf("write to agent timed out after %s", agentWriteTimeout)
+	}
+}
+
+// setStream attaches a (possibly nil) stream to the agent, closing the
+// connection of any previous stream. Callers hold the manager's agentsLock.
+func (a *Agent) setStream(stream proto.AgentService_StreamCommandsServer) *StreamConn {
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+	if a.conn != nil && a.conn.stream == stream {
+		return a.conn
+	}
+	if a.conn != nil {
+		a.conn.Close(errStreamReplaced)
+		a.conn = nil
+	}
+	a.stream = stream
+	if stream != nil {
+		a.conn = newStreamConn(stream)
+	}
+	return a.conn
+}
+
+// closeStream closes the agent's current connection, if any.
+func (a *Agent) closeStream(err error) {
+	a.sendMu.Lock()
+	conn := a.conn
+	a.sendMu.Unlock()
+	if conn != nil {
+		conn.Close(err)
+	}
+}
+
+// send delivers a message to the agent through its connection (command
+// dispatch, reload, disconnect and probe-config push can be issued from
+// different goroutines).
+func (a *Agent) send(msg *proto.CommandMessage) error {
+	a.sendMu.Lock()
+	conn := a.conn
+	a.sendMu.Unlock()
+	if conn == nil {
+		return errAgentStreamUnavailable
+	}
+	return conn.send(msg)
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// structuredParser returns the parser that turns the output of fullCommand
+// into a structured result, or nil when it has none. Only a lone ping or
+// traceroute is parsed: piping it through other tools changes its output.
+func structuredParser(fullCommand string) func(stdout string) (any, bool) {
+	segments := splitShellSegments(fullCommand)
+	if len(segments) != 1 {
+		return nil
+	}
+	fields := strings.Fields(segments[0])
+	if len(fields) == 0 {
+		return nil
+	}
+	switch filepath.Base(fields[0]) {
+	case "ping", "ping6":
+		return func(stdout string) (any, bool) { return parsePingOutput(stdout) }
+	case "traceroute", "traceroute6":
+		return func(stdout string) (any, bool) { return parseTracerouteOutput(stdout) }
+	}
+	return nil
+}
+
+var (
+	pingHeaderRe = regexp.MustCompile(`^PING6?\s+(\S+)`)
+	pingReplyRe  = regexp.MustCompile(`time[=<]([\d.]+) ?ms`)
+	pingRangeRe  = regexp.MustCompile(`= ([\d.]+)/([\d.]+)/([\d.]+)`)
+)
+
+// parsePingOutput reads the replies and summary of iputils, BusyBox and BSD
+// ping. It returns false when the output holds no summary, such as a ping
+// that failed to start.
+func parsePingOutput(output string) (proto.PingResult, bool) {
+	result := proto.PingResult{Kind: proto.ResultKindPing}
+	summary := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := pingHeaderRe.FindStringSubmatch(line); m != nil && result.Target == "" {
+			result.Target = m[1]
+			continue
+		}
+		if m := pingSentRe.FindStringSubmatch(line); m != nil {
+			result.Sent, _ = strconv.Atoi(m[1])
+			result.Received, _ = strconv.Atoi(m[2])
+			summary = true
+			continue
+		}
+		if m := pingRangeRe.FindStringSubmatch(line); m != nil {
+			result.MinMs, _ = strconv.ParseFloat(m[1], 64)
+			result.AvgMs, _ = strconv.ParseFloat(m[2], 64)
+			result.MaxMs, _ = strconv.ParseFloat(m[3], 64)
+			continue
+		}
+		if m := pingReplyRe.FindStringSubmatch(line); m != nil {
+			if rtt, err := strconv.ParseFloat(m[1], 64); err == nil {
+				result.RTTMs = append(result.RTTMs, rtt)
+			}
+		}
+	}
+	if !summary {
+		return result, false
+	}
+	if result.Sent > 0 {
+		result.LossPercent = float64(result.Sent-result.Received) * 100 / float64(result.Sent)
+	}
+	return result, true
+}
+
+var tracerouteHeaderRe = regexp.MustCompile(`^traceroute6? to (\S+)`)
+
+// parseTracerouteOutput reads the hops of a Linux or BSD traceroute, with or
+// without -n. A hop answered from several addresses keeps the first one. It
+// returns false when the output holds no hop.
+func parseTracerouteOutput(output string) (proto.RouteResult, bool) {
+	result := proto.RouteResult{Kind: proto.ResultKindRoute}
+	for _, line := range strings.Split(output, "\n") {
+		if m := tracerouteHeaderRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			result.Target = m[1]
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ttl, err := strconv.Atoi(fields[0])
+		if err != nil || ttl <= 0 {
+			continue
+		}
+		hop := proto.RouteHop{TTL: ttl}
+		for i := 1; i < len(fields); i++ {
+			field := fields[i]
+			switch {
+			case field == "*":
+			case i+1 < len(fields) && fields[i+1] == "ms":
+				if rtt, err := strconv.ParseFloat(field, 64); err == nil {
+					hop.RTTMs = append(hop.RTTMs, rtt)
+				}
+				i++
+			case strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")"):
+				if ip := net.ParseIP(strings.Trim(field, "()")); ip != nil && hop.IP == "" {
+					hop.IP = ip.String()
+					if name := fields[i-1]; name != hop.IP && net.ParseIP(name) == nil {
+						hop.Hostname = name
+					}
+				}
+			default:
+				if ip := net.ParseIP(field); ip != nil && hop.IP == "" {
+					hop.IP = ip.String()
+				}
+			}
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+	return result, len(result.Hops) > 0
+}
@@ -3,10 +3,11 @@ package agent
 import (
 	"os/exec"
 	"sync"
+	"sync/atomic"
 
-	"YALS/internal/config"
-	"YALS/internal/plugin"
-	"YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
 )
 
 // Shell operators that require bash execution
@@ -22,6 +23,11 @@ type ActiveCommand struct {
 	Cmd         *exec.Cmd
 	FullCommand string
 	CommandName string
+
+	// stop is how the command is stopped; exited is closed once it has
+	// exited (see stop.go).
+	stop   stopPolicy
+	exited <-chan struct{}
 }
 
 // Client represents an agent client that connects to the server
@@ -30,6 +36,10 @@ type Client struct {
 	activeCommands map[string]*ActiveCommand
 	commandsLock   sync.RWMutex
 
+	// unavailableCommands maps command name → reason for commands whose binary
+	// is missing on this host (see checkCommandAvailability).
+	unavailableCommands map[string]string
+
 	// Connection identity from the launch arguments (-s/-p/-u/-t). This is the
 	// single source of truth for how the agent reaches and authenticates to the
 	// server; it is NEVER overwritten by server-pushed config (which carries the
@@ -39,6 +49,22 @@ type Client struct {
 	bootUUID  string
 	bootToken string
 
+	// bootAutoDetect enables registering default templates for detected tools.
+	bootAutoDetect bool
+
+	// bootConnection tunes the connection to the server, normalized.
+	bootConnection config.AgentConnectionConfig
+
+	// limits are the launch-time caps on executions (see locallimit.go).
+	limits *localLimits
+
+	// results caches the results of commands with cache_seconds (see
+	// cache.go).
+	results resultCache
+
+	// catalogHash fingerprints the command catalog in force (see catalog.go).
+	catalogHash string
+
 	// sendMu serializes writes to the gRPC stream: command output, metrics and
 	// probe reports are produced by separate goroutines, but a gRPC stream is not
 	// safe for concurrent Send.
@@ -48,6 +74,18 @@ type Client struct {
 	probeMu       sync.Mutex
 	probeCfg      proto.ProbeConfig
 	probeReconfig chan struct{}
+
+	// sshTunnel, when set, carries the connections to the server through a
+	// jump host (see sshtunnel.go).
+	sshTunnel *sshTunnel
+
+	// serverConnected is set while a server connection accepted by
+	// ListenForServer is open (see reverse.go).
+	serverConnected atomic.Bool
+
+	// sockets is what the host lets the agent do with ICMP sockets (see
+	// capabilities.go).
+	sockets socketCapabilities
 }
 
 // CommandRequest represents a command request from the server
@@ -57,6 +95,11 @@ type CommandRequest struct {
 	Target      string `json:"target"`
 	CommandID   string `json:"command_id"`
 	IPVersion   string `json:"ip_version,omitempty"`
+	// View and RequireFamily: see proto.CommandMessage.
+	View          string `json:"view,omitempty"`
+	RequireFamily bool   `json:"require_family,omitempty"`
+	// Structured: see proto.CommandMessage.
+	Structured bool `json:"structured,omitempty"`
 }
 
 // CommandResponse represents a command response to the server
@@ -84,6 +127,11 @@ func NewClient(host string, port int, uuid string, token string) *Client {
 // configure for TLS trust.
 func NewClientWithConfig(agentConfig *config.AgentConfig) *Client {
 	plugin.GetManager().SetConfig(agentConfig)
+	bootConnection := agentConfig.Server.Connection
+	config.NormalizeAgentConnection(&bootConnection)
+
+	sockets := detectSocketCapabilities()
+	sockets.logGuidance()
 
 	return &Client{
 		config:         agentConfig,
@@ -93,5 +141,12 @@ func NewClientWithConfig(agentConfig *config.AgentConfig) *Client {
 		bootPort:       agentConfig.Server.Port,
 		bootUUID:       agentConfig.Server.UUID,
 		bootToken:      agentConfig.Server.Token,
+		bootAutoDetect: agentConfig.Agent.AutoDetect,
+		bootConnection: bootConnection,
+		limits: &localLimits{
+			perMinute:  max(agentConfig.Agent.MaxPerMinute, 0),
+			concurrent: max(agentConfig.Agent.MaxConcurrent, 0),
+		},
+		sockets: sockets,
 	}
 }
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+type viewKey struct{}
+
+// WithView returns ctx under which commands run from the named view of
+// their template (see config.CommandView).
+func WithView(ctx context.Context, view string) context.Context {
+	return context.WithValue(ctx, viewKey{}, view)
+}
+
+func viewFrom(ctx context.Context) string {
+	view, _ := ctx.Value(viewKey{}).(string)
+	return view
+}
+
+// selectView returns the view of cmdConfig a request names. No name is the
+// zero view, which runs the template as written.
+func selectView(cmdConfig config.CommandTemplate, name string) (config.CommandView, error) {
+	if name == "" {
+		return config.CommandView{}, nil
+	}
+	view, ok := config.FindView(cmdConfig.Views, name)
+	if !ok {
+		return view, rejectf(proto.RejectInvalidOption, "unknown view %q", name)
+	}
+	return view, nil
+}
+
+// cachedName is what the result cache keeps a request's result under:
+// every view of a command has a result of its own.
+func cachedName(req CommandRequest) string {
+	if req.View == "" {
+		return req.CommandName
+	}
+	return req.CommandName + "\x00" + req.View
+}
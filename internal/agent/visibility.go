@@ -0,0 +1,119 @@
+package agent
+
+import "github.com/TogawaSakiko363/YALS/internal/validator"
+
+// Visibility lists the commands and agent groups hidden from anonymous
+// viewers. Authenticated viewers (control-panel session) always see everything.
+type Visibility struct {
+	HiddenCommands []string
+	HiddenGroups   []string
+}
+
+// SetVisibility replaces the visibility rules.
+func (m *Manager) SetVisibility(v Visibility) {
+	m.visibilityLock.Lock()
+	m.visibility = v
+	m.visibilityLock.Unlock()
+}
+
+func (m *Manager) commandHidden(name string, authenticated bool) bool {
+	if authenticated {
+		return false
+	}
+	m.visibilityLock.RLock()
+	defer m.visibilityLock.RUnlock()
+	for _, hidden := range m.visibility.HiddenCommands {
+		if hidden == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) groupHidden(group string, authenticated bool) bool {
+	if authenticated {
+		return false
+	}
+	if group == "" {
+		group = "Default"
+	}
+	m.visibilityLock.RLock()
+	defer m.visibilityLock.RUnlock()
+	for _, hidden := range m.visibility.HiddenGroups {
+		if hidden == group {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupVisible reports whether a viewer may see agents of a group.
+func (m *Manager) GroupVisible(group string, authenticated bool) bool {
+	return !m.groupHidden(group, authenticated)
+}
+
+// AgentVisible reports whether a viewer may see (and run commands on) an agent.
+func (m *Manager) AgentVisible(agentName string, authenticated bool) bool {
+	m.agentsLock.RLock()
+	agent, exists := m.agents[agentName]
+	m.agentsLock.RUnlock()
+	if !exists || agent == nil {
+		return false
+	}
+	return !m.groupHidden(agent.Group, authenticated)
+}
+
+// GetAgentGroupsForViewer returns GetAgentGroups with hidden groups and
+// commands removed for anonymous viewers.
+func (m *Manager) GetAgentGroupsForViewer(authenticated bool) []map[string]any {
+	groups := m.GetAgentGroups()
+	if authenticated {
+		return groups
+	}
+
+	result := make([]map[string]any, 0, len(groups))
+	for _, group := range groups {
+		name, _ := group["name"].(string)
+		if m.groupHidden(name, false) {
+			continue
+		}
+		agents, _ := group["agents"].([]map[string]any)
+		for _, agentInfo := range agents {
+			commands, _ := agentInfo["commands"].([]map[string]any)
+			visible := make([]map[string]any, 0, len(commands))
+			for _, cmd := range commands {
+				if cmdName, _ := cmd["name"].(string); !m.commandHidden(cmdName, false) {
+					visible = append(visible, cmd)
+				}
+			}
+			agentInfo["commands"] = visible
+		}
+		result = append(result, group)
+	}
+	return result
+}
+
+// CommandVisible reports whether the viewer may see and run the agent's
+// command, without checking that the agent has it.
+func (m *Manager) CommandVisible(agentName, commandName string, authenticated bool) bool {
+	return m.AgentVisible(agentName, authenticated) && !m.commandHidden(commandName, authenticated)
+}
+
+// GetAgentCommandsForViewer returns GetAgentCommands without the commands
+// hidden from the viewer. An agent in a hidden group has no visible commands.
+func (m *Manager) GetAgentCommandsForViewer(agentName string, authenticated bool) []validator.CommandDetail {
+	if !m.AgentVisible(agentName, authenticated) {
+		return []validator.CommandDetail{}
+	}
+	commands := m.GetAgentCommands(agentName)
+	if authenticated {
+		return commands
+	}
+	visible := make([]validator.CommandDetail, 0, len(commands))
+	for _, cmd := range commands {
+		if !m.commandHidden(cmd.Name, false) {
+			visible = append(visible, cmd)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// Priority orders commands waiting for an agent's weight budget: released
+// budget goes to the highest waiting priority first, and a command never
+// starts ahead of a waiting command of higher priority.
+type Priority int
+
+const (
+	PriorityAnonymous Priority = iota
+	PriorityAuthenticated
+	PriorityAdmin
+
+	priorityLevels = int(PriorityAdmin) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityAdmin:
+		return "admin"
+	case PriorityAuthenticated:
+		return "authenticated"
+	default:
+		return "anonymous"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns ctx carrying the priority of the commands executed
+// with it. Commands without one run as PriorityAnonymous.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return min(max(p, PriorityAnonymous), PriorityAdmin)
+}
+
+// errStoppedWhileQueued is returned by acquireWeight when the user stopped
+// the command before it got its share of the budget.
+var errStoppedWhileQueued = errors.New("stopped while queued")
+
+// SetWeightBudget sets the total weight of the commands one agent may run at
+// once. A command that does not fit waits until enough of the budget is
+// released; cheaper commands that fit keep running meanwhile. 0 disables the
+// budget.
+func (m *Manager) SetWeightBudget(budget int) {
+	m.weightBudget.Store(int64(max(budget, 0)))
+}
+
+// commandWeight is the budget share of cmd, at least 1 and at most the whole
+// budget so that a command heavier than the budget still runs on an idle agent.
+func commandWeight(cmd config.CommandInfo, budget int) int {
+	weight := max(cmd.Weight, 1)
+	return min(weight, budget)
+}
+
+// reserveWeight takes weight out of the agent's budget if it fits, no
+// command of higher priority is waiting and, with fair sharing, it is the
+// requester's turn. Otherwise it returns a channel closed the next time any
+// weight is released.
+func (a *Agent) reserveWeight(weight, budget int, priority Priority, requester string, fair fairPolicy) (bool, <-chan struct{}) {
+	a.runningLock.Lock()
+	defer a.runningLock.Unlock()
+	if a.runningWeight+weight <= budget && !a.higherPriorityWaiting(priority) {
+		now := time.Now()
+		if fair.burst == 0 {
+			a.runningWeight += weight
+			return true, nil
+		}
+		if a.fairTurn(requester, priority, budget-a.runningWeight, fair, now) {
+			a.runningWeight += weight
+			a.startFair(requester, fair, now)
+			return true, nil
+		}
+	}
+	if a.weightReleased == nil {
+		a.weightReleased = make(chan struct{})
+	}
+	return false, a.weightReleased
+}
+
+func (a *Agent) higherPriorityWaiting(priority Priority) bool {
+	for p := int(priority) + 1; p < priorityLevels; p++ {
+		if a.weightWaiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setWaiting counts a command of priority in or out of the agent's queue.
+// Leaving the queue wakes the other waiters, since lower priorities, or other
+// requesters, may now be allowed to start.
+func (a *Agent) setWaiting(priority Priority, weight int, requester string, fair fairPolicy, waiting bool) {
+	a.runningLock.Lock()
+	defer a.runningLock.Unlock()
+	if fair.burst > 0 {
+		a.queueFair(requester, priority, weight, waiting, fair, time.Now())
+	}
+	if waiting {
+		a.weightWaiting[priority]++
+		return
+	}
+	a.weightWaiting[priority]--
+	a.wakeWeightWaiters()
+}
+
+// releaseWeight returns weight to the agent's budget and wakes the waiters.
+func (a *Agent) releaseWeight(weight int) {
+	a.runningLock.Lock()
+	defer a.runningLock.Unlock()
+	a.runningWeight = max(a.runningWeight-weight, 0)
+	a.wakeWeightWaiters()
+}
+
+// wakeWeightWaiters must be called with runningLock held.
+func (a *Agent) wakeWeightWaiters() {
+	if a.weightReleased != nil {
+		close(a.weightReleased)
+		a.weightReleased = nil
+	}
+}
+
+// acquireWeight waits until weight fits in the agent's budget and reserves
+// it, sharing the budget fairly between requesters under fair. onQueued is
+// called once if the command has to wait. The wait ends early when stop fires
+// (errStoppedWhileQueued), ctx is done, or the command's output pipeline is
+// reaped.
+func (a *Agent) acquireWeight(ctx context.Context, weight, budget int, fair fairPolicy, stop <-chan bool, pipeline *outputHandler, onQueued func()) error {
+	priority := priorityFrom(ctx)
+	requester := requesterFrom(ctx)
+	for queued := false; ; queued = true {
+		ok, released := a.reserveWeight(weight, budget, priority, requester, fair)
+		if ok {
+			if queued {
+				a.setWaiting(priority, weight, requester, fair, false)
+			}
+			return nil
+		}
+		if !queued {
+			a.setWaiting(priority, weight, requester, fair, true)
+			onQueued()
+		}
+		var err error
+		select {
+		case <-released:
+			continue
+		case <-stop:
+			err = errStoppedWhileQueued
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-pipeline.ctx.Done():
+			err = errors.New(pipeline.reason)
+		}
+		a.setWaiting(priority, weight, requester, fair, false)
+		return err
+	}
+}
+
+// RunningWeight reports the weight of the commands running on the named agent.
+func (m *Manager) RunningWeight(agentName string) int {
+	agent := m.getAgent(agentName)
+	if agent == nil {
+		return 0
+	}
+	agent.runningLock.Lock()
+	defer agent.runningLock.Unlock()
+	return agent.runningWeight
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -12,13 +15,16 @@ import (
 // AgentBootstrapConfig represents the minimal startup configuration for an agent.
 type AgentBootstrapConfig struct {
 	Server struct {
-		Host  string `yaml:"host"`
-		Port  int    `yaml:"port"`
-		Token string `yaml:"token"`
+		Host       string                `yaml:"host"`
+		Port       int                   `yaml:"port"`
+		Token      string                `yaml:"token"`
+		SSHTunnel  SSHTunnelConfig       `yaml:"ssh_tunnel"`
+		Connection AgentConnectionConfig `yaml:"connection"`
 	} `yaml:"server"`
 
 	Agent struct {
-		UUID string `yaml:"uuid"`
+		UUID       string `yaml:"uuid"`
+		AutoDetect bool   `yaml:"auto_detect"`
 	} `yaml:"agent"`
 
 	Log struct {
@@ -33,31 +39,288 @@ type AgentConfig struct {
 		Port  int    `yaml:"port" json:"port"`
 		UUID  string `yaml:"uuid" json:"uuid"`
 		Token string `yaml:"token,omitempty" json:"token,omitempty"`
+		// SSHTunnel is a local launch option too: it is never sent to or
+		// taken from the server.
+		SSHTunnel SSHTunnelConfig `yaml:"ssh_tunnel,omitempty" json:"-"`
+		// Connection is local too (see AgentConnectionConfig).
+		Connection AgentConnectionConfig `yaml:"connection,omitempty" json:"-"`
 	} `yaml:"server" json:"server"`
 
 	Agent struct {
 		Name    string       `yaml:"name" json:"name"`
 		Group   string       `yaml:"group" json:"group"`
 		Details AgentDetails `yaml:"details" json:"details"`
+		// AutoDetect is a local launch option (never pushed by the server): probe
+		// for common tools and register default templates for those present.
+		AutoDetect bool `yaml:"auto_detect" json:"-"`
+		// MaxPerMinute and MaxConcurrent are local launch options too: caps
+		// on the executions this host starts per minute and runs at once
+		// (0 = unlimited), enforced whatever the server sends.
+		MaxPerMinute  int `yaml:"max_per_minute" json:"-"`
+		MaxConcurrent int `yaml:"max_concurrent" json:"-"`
 	} `yaml:"agent" json:"agent"`
 
 	Log struct {
 		LogLevel string `yaml:"log_level" json:"log_level"`
 	} `yaml:"log" json:"log"`
 
+	// Limits is the server's target input policy; the agent applies it to
+	// every target it is sent (see validator.Policy).
+	Limits struct {
+		MaxTargetLength int    `yaml:"max_target_length,omitempty" json:"max_target_length,omitempty"`
+		TargetCharset   string `yaml:"target_charset,omitempty" json:"target_charset,omitempty"`
+	} `yaml:"limits,omitempty" json:"limits,omitempty"`
+
 	Commands        map[string]CommandTemplate `yaml:"commands" json:"commands"`
 	OrderedCommands []string                   `yaml:"ordered_commands,omitempty" json:"ordered_commands,omitempty"`
 	orderedCommands []string
 }
 
+// SSHTunnelConfig routes the agent's connection to the server through an SSH
+// jump host, for PoPs that reach the server only via a bastion. Host is the
+// jump host ("host" or "host:port", port 22 by default); it is unused when
+// empty. The jump host's key is checked against KnownHosts (default
+// ~/.ssh/known_hosts), and the agent logs in as User with the unencrypted
+// private key in the file Key.
+type SSHTunnelConfig struct {
+	Host       string `yaml:"host,omitempty"`
+	User       string `yaml:"user,omitempty"`
+	Key        string `yaml:"key,omitempty"`
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+}
+
+// AgentConnectionConfig tunes the agent's connection to the server, e.g. for
+// links through WireGuard or other low-MTU tunnels that drop idle flows or
+// large bursts. Durations are in seconds; zero fields take the defaults (see
+// NormalizeAgentConnection).
+type AgentConnectionConfig struct {
+	// KeepaliveInterval is how often the agent pings the server over gRPC,
+	// KeepaliveTimeout how long it waits for the answer before reconnecting.
+	KeepaliveInterval int `yaml:"keepalive_interval,omitempty"`
+	KeepaliveTimeout  int `yaml:"keepalive_timeout,omitempty"`
+	// TCPKeepalive is the TCP keepalive period of the socket; -1 turns TCP
+	// keepalives off.
+	TCPKeepalive int `yaml:"tcp_keepalive,omitempty"`
+	// DialTimeout bounds opening the TCP connection.
+	DialTimeout int `yaml:"dial_timeout,omitempty"`
+	// MaxMessageSize is the largest gRPC message, in bytes, the agent sends
+	// or accepts.
+	MaxMessageSize int `yaml:"max_message_size,omitempty"`
+	// WriteBufferSize and ReadBufferSize are the bytes gRPC buffers before
+	// writing to and reading from the socket.
+	WriteBufferSize int `yaml:"write_buffer_size,omitempty"`
+	ReadBufferSize  int `yaml:"read_buffer_size,omitempty"`
+	// Compression compresses large command output sent to the server:
+	// "zstd", or empty for none. It applies only when the server accepts it
+	// in the handshake.
+	Compression string `yaml:"compression,omitempty"`
+}
+
+// MinAgentKeepaliveInterval is the shortest keepalive interval the server
+// accepts; agents pinging more often are disconnected.
+const MinAgentKeepaliveInterval = 5
+
+// NormalizeAgentConnection fills in the defaults of conn: a keepalive ping
+// every 10 seconds answered within 3, the system TCP keepalive, a 20 second
+// dial timeout, 4 MiB messages and 32 KiB buffers.
+func NormalizeAgentConnection(conn *AgentConnectionConfig) {
+	if conn.KeepaliveInterval <= 0 {
+		conn.KeepaliveInterval = 10
+	}
+	conn.KeepaliveInterval = max(conn.KeepaliveInterval, MinAgentKeepaliveInterval)
+	if conn.KeepaliveTimeout <= 0 {
+		conn.KeepaliveTimeout = 3
+	}
+	if conn.TCPKeepalive < 0 {
+		conn.TCPKeepalive = -1
+	}
+	if conn.DialTimeout <= 0 {
+		conn.DialTimeout = 20
+	}
+	if conn.MaxMessageSize <= 0 {
+		conn.MaxMessageSize = 4 << 20
+	}
+	if conn.WriteBufferSize <= 0 {
+		conn.WriteBufferSize = 32 << 10
+	}
+	if conn.ReadBufferSize <= 0 {
+		conn.ReadBufferSize = 32 << 10
+	}
+	conn.Compression = strings.ToLower(strings.TrimSpace(conn.Compression))
+}
+
 // CommandTemplate represents a command template configuration
 type CommandTemplate struct {
 	Template     string `yaml:"template" json:"template"`
 	UsePlugin    string `yaml:"use_plugin" json:"use_plugin"`
 	IgnoreTarget bool   `yaml:"ignore_target" json:"ignore_target"`
 	MaximumQueue int    `yaml:"maxmium_queue" json:"maxmium_queue"`
+	// Weight is the command's share of the agent's concurrent weight budget
+	// (default 1), e.g. 10 for an iperf3 test against 1 for ping.
+	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
+	// ExampleTarget, HelpText and Category are shown by the web UI: a
+	// placeholder target, an inline usage hint, and the group the command is
+	// listed under (e.g. "ICMP", "Routing", "HTTP").
+	ExampleTarget string `yaml:"example_target,omitempty" json:"example_target,omitempty"`
+	HelpText      string `yaml:"help_text,omitempty" json:"help_text,omitempty"`
+	Category      string `yaml:"category,omitempty" json:"category,omitempty"`
+	// DefaultTarget is run when the client omits the target, e.g. a fixed
+	// ping target for a quick health check. The UI prefills it.
+	DefaultTarget string `yaml:"default_target,omitempty" json:"default_target,omitempty"`
+	// TargetType selects the target validator: host (default: an address or
+	// domain, optionally with a port), ip, domain, asn, prefix, url or port.
+	TargetType string `yaml:"target_type,omitempty" json:"target_type,omitempty"`
+	// RequiresApproval holds runs by users outside the control panel until
+	// an operator approves them. It is enforced by the server.
+	RequiresApproval bool `yaml:"requires_approval,omitempty" json:"requires_approval,omitempty"`
+	// CacheSeconds lets the agent answer repeated runs of an ignore_target
+	// command with its last successful result for that many seconds.
+	CacheSeconds int `yaml:"cache_seconds,omitempty" json:"cache_seconds,omitempty"`
+	// StopSignal is sent to a shell template's process when its run is
+	// stopped (one of StopSignals; default SIGKILL). A process still running
+	// StopGraceSeconds later (default DefaultStopGraceSeconds) is killed.
+	// StopProcessGroup runs the command in a process group of its own and
+	// signals the whole group, so that the children of a pipeline stop too.
+	StopSignal       string `yaml:"stop_signal,omitempty" json:"stop_signal,omitempty"`
+	StopGraceSeconds int    `yaml:"stop_grace_seconds,omitempty" json:"stop_grace_seconds,omitempty"`
+	StopProcessGroup bool   `yaml:"stop_process_group,omitempty" json:"stop_process_group,omitempty"`
+	// WorkDir is the directory a shell template runs in (default: the
+	// agent's). Env sets environment variables for it. A template with Env
+	// or EnvPassthrough does not inherit the agent's whole environment, only
+	// BaseEnvPassthrough and the variables named in EnvPassthrough.
+	WorkDir        string            `yaml:"work_dir,omitempty" json:"work_dir,omitempty"`
+	Env            map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	EnvPassthrough []string          `yaml:"env_passthrough,omitempty" json:"env_passthrough,omitempty"`
+	// Nice (0-19) lowers the CPU priority of a shell template, and IOClass
+	// ("idle" or "best-effort", with IOPriority 0-7) its disk priority, by
+	// running it under nice and ionice.
+	Nice       int    `yaml:"nice,omitempty" json:"nice,omitempty"`
+	IOClass    string `yaml:"io_class,omitempty" json:"io_class,omitempty"`
+	IOPriority int    `yaml:"io_priority,omitempty" json:"io_priority,omitempty"`
+	// Container runs a shell template inside the named running container
+	// (docker exec) and NetNS inside the named network namespace (ip netns
+	// exec), so that one agent can offer measurements from several
+	// containers or VRFs as separate commands. A template sets at most one
+	// of them (see ValidExecContextName).
+	Container string `yaml:"container,omitempty" json:"container,omitempty"`
+	NetNS     string `yaml:"netns,omitempty" json:"netns,omitempty"`
+	// Views are the ways of running a shell template a client may pick
+	// from, such as the source addresses, interfaces or VRFs of a
+	// multi-homed host. Without a view the template runs as written.
+	Views        []CommandView `yaml:"views,omitempty" json:"views,omitempty"`
+	AutoDetected bool          `yaml:"-" json:"-"`
 }
 
+// CommandView is one view of a command template: a name the client picks,
+// a label shown for it, and what running the command from there takes. Args
+// replace the {view} placeholder of the template, or follow its program name
+// when it has none, e.g. "-I 192.0.2.1" for ping or "-b 192.0.2.1" for dig.
+// VRF runs the command in that VRF with ip vrf exec. The client only ever
+// sends the name.
+type CommandView struct {
+	Name  string `yaml:"name" json:"name"`
+	Label string `yaml:"label,omitempty" json:"label,omitempty"`
+	Args  string `yaml:"args,omitempty" json:"args,omitempty"`
+	VRF   string `yaml:"vrf,omitempty" json:"vrf,omitempty"`
+}
+
+// MaxCommandViews bounds the views of a command template.
+const MaxCommandViews = 32
+
+// ViewPlaceholder marks where the arguments of the chosen view go in a
+// template.
+const ViewPlaceholder = "{view}"
+
+// FindView returns the view called name.
+func FindView(views []CommandView, name string) (CommandView, bool) {
+	for _, view := range views {
+		if view.Name == name {
+			return view, true
+		}
+	}
+	return CommandView{}, false
+}
+
+// ApplyView puts the arguments of view in place of the {view} placeholder
+// of template, or right after its program name when it has none.
+func ApplyView(template string, view CommandView) string {
+	if strings.Contains(template, ViewPlaceholder) {
+		if view.Args == "" {
+			template = strings.ReplaceAll(template, " "+ViewPlaceholder, "")
+		}
+		return strings.ReplaceAll(template, ViewPlaceholder, view.Args)
+	}
+	if view.Args == "" {
+		return template
+	}
+	program, rest, _ := strings.Cut(strings.TrimSpace(template), " ")
+	return strings.TrimSpace(program + " " + view.Args + " " + rest)
+}
+
+// ValidViewArgs reports whether args can be the arguments of a view: at
+// most 256 bytes of words made of letters, digits and "_.:/%@=,+-", which
+// covers addresses, interfaces and flags but nothing a shell would expand.
+func ValidViewArgs(args string) bool {
+	if len(args) > 256 {
+		return false
+	}
+	for _, r := range args {
+		if r != ' ' && !strings.ContainsRune("_.:/%@=,+-", r) && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// BaseEnvPassthrough are the agent's environment variables a template with
+// its own environment still inherits.
+var BaseEnvPassthrough = []string{"PATH", "HOME", "USER", "LANG", "TZ", "TMPDIR"}
+
+// IOClasses are the ionice scheduling classes a template may use; realtime
+// is left out since it can starve the host.
+var IOClasses = []string{"idle", "best-effort"}
+
+// ValidEnvName reports whether name can be an environment variable of a
+// command template.
+func ValidEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidExecContextName reports whether name can be the container or network
+// namespace of a command template: up to 128 letters, digits, '_', '.' and
+// '-', starting with a letter or digit. Nothing in it can be read as an
+// option or a path.
+func ValidExecContextName(name string) bool {
+	if name == "" || len(name) > 128 || name[0] == '_' || name[0] == '.' || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && r != '.' && r != '-' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// StopSignals are the signals a command template may be stopped with.
+// Windows has no signals; there a stopped command is always killed.
+var StopSignals = []string{"SIGINT", "SIGTERM", "SIGHUP", "SIGQUIT", "SIGKILL"}
+
+// DefaultStopGraceSeconds is how long a command stopped with a signal other
+// than SIGKILL may take to exit; MaxStopGraceSeconds bounds stop_grace_seconds.
+const (
+	DefaultStopGraceSeconds = 5
+	MaxStopGraceSeconds     = 300
+)
+
 // LoadAgentBootstrapConfig loads the minimal local bootstrap configuration.
 func LoadAgentBootstrapConfig(filename string) (*AgentBootstrapConfig, error) {
 	data, err := os.ReadFile(filename)
@@ -77,6 +340,51 @@ func LoadAgentBootstrapConfig(filename string) (*AgentBootstrapConfig, error) {
 	return &config, nil
 }
 
+// AgentCredentials is the identity an agent keeps in its credentials file:
+// the UUID and token the server issued when it enrolled, and until then the
+// key its enrollment code is bound to.
+type AgentCredentials struct {
+	UUID      string `yaml:"uuid,omitempty"`
+	Token     string `yaml:"token,omitempty"`
+	EnrollKey string `yaml:"enroll_key,omitempty"`
+}
+
+// LoadAgentCredentials reads an agent's credentials file; a missing file
+// holds no credentials.
+func LoadAgentCredentials(filename string) (*AgentCredentials, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &AgentCredentials{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading agent credentials file: %w", err)
+	}
+
+	var creds AgentCredentials
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("error parsing agent credentials file: %w", err)
+	}
+	return &creds, nil
+}
+
+// SaveAgentCredentials replaces an agent's credentials file, readable by its
+// owner only.
+func SaveAgentCredentials(filename string, creds AgentCredentials) error {
+	data, err := yaml.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("error writing agent credentials file: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing agent credentials file: %w", err)
+	}
+	return nil
+}
+
 // LoadAgentConfig loads a full agent configuration from YAML.
 func LoadAgentConfig(filename string) (*AgentConfig, error) {
 	data, err := os.ReadFile(filename)
@@ -92,6 +400,44 @@ func LoadAgentConfig(filename string) (*AgentConfig, error) {
 	return NormalizeAgentConfig(&config, data), nil
 }
 
+// CatalogHash fingerprints a command catalog: what each command runs (name,
+// template, plugin, whether it takes a target and which targets it accepts,
+// the container or network namespace it runs in, and its views). Order and
+// display fields do not change it. Unset target types, containers,
+// namespaces and views are left out so catalogs pinned before they existed
+// keep their hash.
+func CatalogHash(commands map[string]CommandTemplate) string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	sum := sha256.New()
+	for _, name := range names {
+		cmd := commands[name]
+		fields := []string{name, cmd.Template, cmd.UsePlugin, strconv.FormatBool(cmd.IgnoreTarget)}
+		if cmd.TargetType != "" {
+			fields = append(fields, cmd.TargetType)
+		}
+		if cmd.Container != "" {
+			fields = append(fields, "container:"+cmd.Container)
+		}
+		if cmd.NetNS != "" {
+			fields = append(fields, "netns:"+cmd.NetNS)
+		}
+		for _, view := range cmd.Views {
+			fields = append(fields, "view:"+view.Name+"\x00"+view.Args+"\x00"+view.VRF)
+		}
+		for _, field := range fields {
+			sum.Write([]byte(strconv.Quote(field)))
+			sum.Write([]byte{0})
+		}
+		sum.Write([]byte{'\n'})
+	}
+	return "sha256:" + hex.EncodeToString(sum.Sum(nil))
+}
+
 // NormalizeAgentConfig normalizes ordering and defaults for a runtime agent config.
 func NormalizeAgentConfig(config *AgentConfig, rawYAML []byte) *AgentConfig {
 	if config == nil {
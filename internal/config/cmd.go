@@ -7,6 +7,23 @@ type CommandInfo struct {
 	UsePlugin    string `json:"use_plugin"`
 	IgnoreTarget bool   `json:"ignore_target"`
 	MaximumQueue int    `json:"maxmium_queue"`
+	Weight       int    `json:"weight,omitempty"`
+	// Unavailable is reported by the agent after it loads its commands: the
+	// binary the command needs is missing or not executable on that host.
+	Unavailable       bool   `json:"unavailable,omitempty"`
+	UnavailableReason string `json:"unavailable_reason,omitempty"`
+	// AutoDetected marks a default template the agent registered itself.
+	AutoDetected bool `json:"auto_detected,omitempty"`
+	// Usage hints for the web UI (see CommandTemplate).
+	ExampleTarget string `json:"example_target,omitempty"`
+	HelpText      string `json:"help_text,omitempty"`
+	Category      string `json:"category,omitempty"`
+	DefaultTarget string `json:"default_target,omitempty"`
+	TargetType    string `json:"target_type,omitempty"`
+	// RequiresApproval holds runs by non-admin users for an operator.
+	RequiresApproval bool `json:"requires_approval,omitempty"`
+	// Views a client may pick from (see CommandTemplate).
+	Views []CommandView `json:"views,omitempty"`
 }
 
 // GetAvailableCommands returns the list of available commands in the order they appear in the config file
@@ -16,11 +33,20 @@ func (c *AgentConfig) GetAvailableCommands() []CommandInfo {
 	for _, name := range c.orderedCommands {
 		if template, exists := c.Commands[name]; exists {
 			commands = append(commands, CommandInfo{
-				Name:         name,
-				Template:     template.Template,
-				UsePlugin:    template.UsePlugin,
-				IgnoreTarget: template.IgnoreTarget,
-				MaximumQueue: template.MaximumQueue,
+				Name:             name,
+				Template:         template.Template,
+				UsePlugin:        template.UsePlugin,
+				IgnoreTarget:     template.IgnoreTarget,
+				MaximumQueue:     template.MaximumQueue,
+				Weight:           template.Weight,
+				AutoDetected:     template.AutoDetected,
+				ExampleTarget:    template.ExampleTarget,
+				HelpText:         template.HelpText,
+				Category:         template.Category,
+				DefaultTarget:    template.DefaultTarget,
+				TargetType:       template.TargetType,
+				RequiresApproval: template.RequiresApproval,
+				Views:            template.Views,
 			})
 		}
 	}
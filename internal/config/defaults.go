@@ -0,0 +1,53 @@
+package config
+
+// DefaultCommand is a built-in command template the agent can register on its
+// own when auto-detect is enabled and the tool it needs is installed.
+type DefaultCommand struct {
+	Name     string
+	Binary   string
+	Template CommandTemplate
+}
+
+// DefaultCommands lists the templates offered by agent auto-detect, in the order
+// they are appended after the server-defined commands.
+var DefaultCommands = []DefaultCommand{
+	{Name: "ping", Binary: "ping", Template: CommandTemplate{
+		Template: "ping -c 4 {target}", MaximumQueue: 10,
+		Category: "ICMP", ExampleTarget: "1.1.1.1", HelpText: "Send 4 ICMP echo requests to an IPv4 address or hostname.",
+	}},
+	{Name: "ping6", Binary: "ping6", Template: CommandTemplate{
+		Template: "ping6 -c 4 {target}", MaximumQueue: 10,
+		Category: "ICMP", ExampleTarget: "2606:4700:4700::1111", HelpText: "Send 4 ICMPv6 echo requests to an IPv6 address or hostname.",
+	}},
+	{Name: "traceroute", Binary: "traceroute", Template: CommandTemplate{
+		Template: "traceroute -w 2 {target}", MaximumQueue: 5,
+		Category: "Routing", ExampleTarget: "1.1.1.1", HelpText: "Show the hops on the path to the target.",
+	}},
+	{Name: "mtr", Binary: "mtr", Template: CommandTemplate{
+		UsePlugin: "mtr",
+		Category:  "Routing", ExampleTarget: "1.1.1.1", HelpText: "Trace the path and report loss and latency per hop.",
+	}},
+	{Name: "nexttrace", Binary: "nexttrace", Template: CommandTemplate{
+		UsePlugin: "nexttrace",
+		Category:  "Routing", ExampleTarget: "1.1.1.1", HelpText: "Trace the path with ASN and geolocation per hop.",
+	}},
+	{Name: "dig", Binary: "dig", Template: CommandTemplate{
+		Template: "dig {target}", MaximumQueue: 10, TargetType: "domain",
+		Category: "DNS", ExampleTarget: "example.com", HelpText: "Look up the DNS records of a domain.",
+	}},
+}
+
+// AddCommand appends a command after the existing ones. It never replaces a
+// command that is already defined, so server-side definitions always win.
+func (c *AgentConfig) AddCommand(name string, template CommandTemplate) bool {
+	if c.Commands == nil {
+		c.Commands = map[string]CommandTemplate{}
+	}
+	if _, exists := c.Commands[name]; exists {
+		return false
+	}
+	c.Commands[name] = template
+	c.orderedCommands = append(c.orderedCommands, name)
+	c.OrderedCommands = append(c.OrderedCommands, name)
+	return true
+}
@@ -20,11 +20,413 @@ type Config struct {
 		// server sits behind a trusted reverse proxy that sets these headers;
 		// otherwise clients can spoof them to forge logs or bypass rate limits.
 		TrustProxyHeaders bool `yaml:"trust_proxy_headers"`
+		// HandshakeTimeout (seconds, default 10) bounds a new connection's TLS
+		// handshake and HTTP/1 request headers. MaxPendingHandshakes (default
+		// 512) caps connections still handshaking; more are closed at once.
+		HandshakeTimeout     int `yaml:"handshake_timeout"`
+		MaxPendingHandshakes int `yaml:"max_pending_handshakes"`
+		// Profiling serves Go's runtime profiles (net/http/pprof) under
+		// /api/control/debug/pprof/, to the control panel's operators only.
+		Profiling bool `yaml:"profiling"`
 	} `yaml:"server"`
 
 	Database struct {
 		Path string `yaml:"path"`
 	} `yaml:"database"`
+
+	// Security points at plain-text ban/allow list files (one entry per line,
+	// '#' comments). Relative paths are resolved next to the config file. The
+	// files are re-read when they change and on SIGHUP.
+	Security struct {
+		BannedIPs             string `yaml:"banned_ips"`
+		BannedTargets         string `yaml:"banned_targets"`
+		AllowedTargetSuffixes string `yaml:"allowed_target_suffixes"`
+		// Headers are sent with every web and API response. An empty value
+		// keeps the default, "off" drops the header. HSTSMaxAge (seconds) is
+		// off by default: browsers refuse to click through the built-in
+		// self-signed certificate once a host is pinned to HTTPS.
+		Headers struct {
+			ContentSecurityPolicy string `yaml:"content_security_policy"`
+			FrameOptions          string `yaml:"frame_options"`
+			ReferrerPolicy        string `yaml:"referrer_policy"`
+			HSTSMaxAge            int    `yaml:"hsts_max_age"`
+		} `yaml:"headers"`
+	} `yaml:"security"`
+
+	// Reputation checks targets against reputation sources before a command
+	// runs, refusing or flagging executions against known-abusive hosts.
+	// Verdicts are cached for CacheMinutes (default 60); each source gets
+	// TimeoutSeconds (default 3) and one that fails lets the run through.
+	// Control-token holders are never checked.
+	Reputation struct {
+		CacheMinutes   int                `yaml:"cache_minutes"`
+		TimeoutSeconds int                `yaml:"timeout_seconds"`
+		Sources        []ReputationSource `yaml:"sources"`
+	} `yaml:"reputation"`
+
+	// Callbacks enables execution receipts: an /api/exec request carrying a
+	// callback_url gets its final result POSTed there, signed with Secret.
+	Callbacks struct {
+		Secret string `yaml:"secret"`
+	} `yaml:"callbacks"`
+
+	// SMTP is the mail server for emailed incident reports (see
+	// /api/incidents) and notifications. TLS is "auto" (default: implicit
+	// TLS on port 465, elsewhere STARTTLS when the server offers it),
+	// "implicit", "starttls" (required) or "none". Port defaults to 587, or
+	// 465 for implicit TLS. Without Host, no mail is sent.
+	SMTP struct {
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		TLS      string `yaml:"tls"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		From     string `yaml:"from"`
+	} `yaml:"smtp"`
+
+	// Notifications emails operators about agent_offline, approval_pending,
+	// abuse_report, agent_never_connected, agent_details_mismatch (see
+	// Monitoring for these two), enrollment_pending (see Enrollment),
+	// suite_failed and suite_passed (see TestSuites) events. Email maps each event to its recipients; events without
+	// recipients are not sent. Templates override an event's subject and
+	// body. An agent counts as offline once it stayed disconnected for
+	// OfflineGrace seconds (default 60).
+	Notifications struct {
+		Email        map[string][]string             `yaml:"email"`
+		Templates    map[string]NotificationTemplate `yaml:"templates"`
+		OfflineGrace int                             `yaml:"offline_grace"`
+	} `yaml:"notifications"`
+
+	// ChatOps enables the /lg chat adapter. Slack requests are verified with the
+	// app's signing secret; Telegram webhooks must echo TelegramSecretToken
+	// (set as secret_token when registering the webhook).
+	ChatOps struct {
+		SlackSigningSecret  string `yaml:"slack_signing_secret"`
+		TelegramBotToken    string `yaml:"telegram_bot_token"`
+		TelegramSecretToken string `yaml:"telegram_secret_token"`
+	} `yaml:"chatops"`
+
+	// Tracing exports OpenTelemetry spans of the command pipeline over
+	// OTLP/HTTP. An empty endpoint disables export.
+	Tracing struct {
+		Endpoint    string  `yaml:"endpoint"`
+		Insecure    bool    `yaml:"insecure"`
+		ServiceName string  `yaml:"service_name"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing"`
+
+	// Cluster lets several replicas behind one load balancer share their
+	// agents: a command for an agent connected to another replica is forwarded
+	// to it. Peers are the base URLs of the other replicas; every replica must
+	// use the same Secret.
+	Cluster struct {
+		Peers  []string `yaml:"peers"`
+		Secret string   `yaml:"secret"`
+	} `yaml:"cluster"`
+
+	// Inventory is a YAML file of expected agents (see
+	// handler.InitInventory), relative to the config file. Agents it lists
+	// that are not registered yet are created at startup, so that they show
+	// as never connected until they do.
+	Inventory string `yaml:"inventory"`
+
+	// Endpoints are the public URLs of all servers of a multi-region
+	// deployment, this one included, which /api/endpoints advertises so that
+	// frontends connect to the nearest.
+	Endpoints []ServerEndpoint `yaml:"endpoints"`
+
+	// Limits caps concurrent connections: MaxWebClients counts open browser
+	// streams (command output and status feed), MaxAgents connected agents.
+	// 0 leaves either unlimited.
+	// IdleTimeout and EmbeddedIdleTimeout (minutes, 0 = never) close status
+	// feeds of sessions without user activity: IdleTimeout applies to sessions
+	// that ran commands, EmbeddedIdleTimeout to those that never did.
+	Limits struct {
+		MaxWebClients       int `yaml:"max_web_clients"`
+		MaxAgents           int `yaml:"max_agents"`
+		IdleTimeout         int `yaml:"idle_timeout"`
+		EmbeddedIdleTimeout int `yaml:"embedded_idle_timeout"`
+		// MaxRequestBody and MaxHeaderBytes (KiB, default 1024 and 64) bound
+		// web requests; StreamOpensPerMinute (0 = unlimited) caps how often
+		// one IP may open a command/status stream or connect an agent.
+		MaxRequestBody       int `yaml:"max_request_body"`
+		MaxHeaderBytes       int `yaml:"max_header_bytes"`
+		StreamOpensPerMinute int `yaml:"stream_opens_per_minute"`
+		// APIRequestsPerSecond (0 = unlimited) caps one IP's calls to the
+		// public JSON API.
+		APIRequestsPerSecond int `yaml:"api_requests_per_second"`
+		// MaxTargetLength (characters, default 256, at most 1024) and
+		// TargetCharset ("unicode" or "ascii") bound command targets, on the
+		// server and again on the agents.
+		MaxTargetLength int    `yaml:"max_target_length"`
+		TargetCharset   string `yaml:"target_charset"`
+	} `yaml:"limits"`
+
+	// Execution bounds the total weight of the commands running on each agent
+	// at once. Commands declare their weight (default 1); one that does not
+	// fit waits for running commands to finish. 0 disables the budget.
+	// DualStackParallel runs the IPv4 and IPv6 halves of an ip_version "dual"
+	// request at once instead of one after the other. ApprovalTimeout is how
+	// many seconds a run of a requires_approval command waits for an operator
+	// before it expires (default 300). FairBurst shares the budget of a busy
+	// agent between requesters (client addresses, ChatOps users): each may
+	// start FairBurst commands back to back and earns one more every
+	// FairRefillSeconds (default 5), and queued commands go to requesters in
+	// turns. 0 disables fair sharing. MaxRuntimeSeconds is how long a command
+	// may run, timed by the server; a command still running then is stopped
+	// on the agent and fails with "killed by server policy". 0 disables it.
+	Execution struct {
+		WeightBudget      int  `yaml:"weight_budget"`
+		DualStackParallel bool `yaml:"dual_stack_parallel"`
+		ApprovalTimeout   int  `yaml:"approval_timeout"`
+		FairBurst         int  `yaml:"fair_burst"`
+		FairRefillSeconds int  `yaml:"fair_refill_seconds"`
+		MaxRuntimeSeconds int  `yaml:"max_runtime_seconds"`
+	} `yaml:"execution"`
+
+	// Output.Footer is appended to every completed command result, so output
+	// copied elsewhere keeps its provenance. {time}, {agent}, {location},
+	// {group}, {command} and {target} are replaced.
+	Output struct {
+		Footer string `yaml:"footer"`
+	} `yaml:"output"`
+
+	// Monitoring records an event when a scheduled probe's packet loss moves
+	// by at least LossChangePercent points (default 20) between two runs, and
+	// POSTs it to WebhookURL when set.
+	Monitoring struct {
+		LossChangePercent float64 `yaml:"loss_change_percent"`
+		WebhookURL        string  `yaml:"webhook_url"`
+		// CatalogAlerts also POSTs unexpected changes of an agent's command
+		// catalog hash to WebhookURL.
+		CatalogAlerts bool `yaml:"catalog_alerts"`
+		// ProvisioningAlerts also POSTs provisioned agents that have not
+		// connected within ProvisionGraceHours (default 24) of their
+		// creation, and agents connecting from an address other than their
+		// recorded ipv4, ipv6 or test_ip.
+		ProvisioningAlerts  bool `yaml:"provisioning_alerts"`
+		ProvisionGraceHours int  `yaml:"provision_grace_hours"`
+		// SuiteAlerts also POSTs the test suite runs that are notified by
+		// email (see TestSuites).
+		SuiteAlerts bool `yaml:"suite_alerts"`
+	} `yaml:"monitoring"`
+
+	// TestSuites are named lists of checks, e.g. to verify the network after
+	// a maintenance window. A suite runs on demand (/api/control/suites) and,
+	// with IntervalMinutes, on a schedule. Each test runs a command on an
+	// agent and asserts on its result, such as "loss < 2%" or "rtt < 80ms".
+	TestSuites []TestSuite `yaml:"test_suites"`
+
+	// Enrollment lets new agents join with a one-time code created in the
+	// control panel (yals_agent -enroll) instead of a UUID and token set up
+	// beforehand. Each request is POSTed to WebhookURL, whose answer
+	// approves or denies it; without a webhook, or when it does not answer,
+	// an operator decides on the control panel. Only an approved agent is
+	// created and given its token. Codes not used within CodeTTLHours
+	// (default 24) expire.
+	Enrollment struct {
+		Enabled      bool   `yaml:"enabled"`
+		WebhookURL   string `yaml:"webhook_url"`
+		CodeTTLHours int    `yaml:"code_ttl_hours"`
+	} `yaml:"enrollment"`
+
+	// APIKeys identify partners calling /api/exec with an X-API-Key header.
+	// Their executions are counted per UTC day and month and refused past
+	// the quotas.
+	APIKeys []APIKey `yaml:"api_keys"`
+
+	// GroupLimits give agent groups, by name, their own per-client rate
+	// limit and daily/monthly execution quotas shared by all clients, on top
+	// of the global rate limit.
+	GroupLimits map[string]GroupLimit `yaml:"group_limits"`
+
+	// Results keeps finished trace routes exportable as GeoJSON for
+	// RetentionDays (default 7).
+	Results struct {
+		RetentionDays int `yaml:"retention_days"`
+		// Archive, when Endpoint and Bucket are set, moves routes older
+		// than RetentionDays to S3-compatible object storage instead of
+		// deleting them; only their metadata stays in the database.
+		Archive struct {
+			Endpoint    string `yaml:"endpoint"`
+			Region      string `yaml:"region"`
+			Bucket      string `yaml:"bucket"`
+			Prefix      string `yaml:"prefix"`
+			AccessKey   string `yaml:"access_key"`
+			SecretKey   string `yaml:"secret_key"`
+			VirtualHost bool   `yaml:"virtual_host"`
+		} `yaml:"archive"`
+		// Signing signs every stored result so a copy shared outside can be
+		// checked against /api/results/verify. Algorithm is "ed25519" (Key
+		// is a base64 32-byte seed; the public key is published) or
+		// "hmac-sha256" (Key is a secret). KeyID names the key in
+		// signatures, by default derived from it.
+		Signing struct {
+			Algorithm string `yaml:"algorithm"`
+			Key       string `yaml:"key"`
+			KeyID     string `yaml:"key_id"`
+		} `yaml:"signing"`
+	} `yaml:"results"`
+
+	// Retention bounds the history tables so long-running deployments do
+	// not grow without limit. Routes expire after Results.RetentionDays;
+	// archived ones keep their metadata for ArchivedResultsDays (default
+	// 365). Probe events expire after ProbeEventsDays (default 30), hourly
+	// execution counts and the quota counts of past days and months after
+	// UsageDays (default 90). Raw probe results are kept for a day; their
+	// 5-minute rollups for ProbeRollup5mDays (default 30) and hourly ones
+	// for ProbeRollupHourlyDays (default 365). Abuse reports nobody reviewed
+	// expire after OpenReportsDays (default 30). The MaxRows caps delete the
+	// oldest rows first (0 = no cap).
+	Retention struct {
+		ArchivedResultsDays int `yaml:"archived_results_days"`
+		ResultsMaxRows      int `yaml:"results_max_rows"`
+		ProbeEventsDays     int `yaml:"probe_events_days"`
+		ProbeEventsMaxRows  int `yaml:"probe_events_max_rows"`
+		UsageDays           int `yaml:"usage_days"`
+		OpenReportsDays     int `yaml:"open_reports_days"`
+
+		ProbeRollup5mDays     int `yaml:"probe_rollup_5m_days"`
+		ProbeRollupHourlyDays int `yaml:"probe_rollup_hourly_days"`
+	} `yaml:"retention"`
+
+	// Preferences keeps each browser's favorite agents and recent targets on
+	// the server, keyed by a cookie, until RetentionDays after their last
+	// change (default 90).
+	Preferences struct {
+		Enabled       bool `yaml:"enabled"`
+		RetentionDays int  `yaml:"retention_days"`
+	} `yaml:"preferences"`
+
+	// Geolocation suggests each visitor the nearest online agent. Database
+	// is a MaxMind City (or Country) database such as GeoLite2-City.mmdb, in
+	// which the visitor's IP and the agents' test_ip, ipv4 or ipv6 are
+	// looked up.
+	Geolocation struct {
+		Database string `yaml:"database"`
+	} `yaml:"geolocation"`
+
+	// Clients issues signed anonymous client ids (a cookie) that /api/exec
+	// rate-limits on, with the IP limited to IPFactor (default 5) times the
+	// rate limit. Secret keys the signatures; a random one is used when empty.
+	// MaxConcurrent caps running commands per client id (0 = unlimited).
+	Clients struct {
+		Enabled       bool   `yaml:"enabled"`
+		Secret        string `yaml:"secret"`
+		IPFactor      int    `yaml:"ip_factor"`
+		MaxConcurrent int    `yaml:"max_concurrent"`
+	} `yaml:"clients"`
+
+	// UILayout controls how the web UI lists commands, overriding the order
+	// each agent defines them in. Commands missing from CommandOrder follow
+	// the listed ones; Categories assigns or overrides command categories by
+	// name; GroupDefaults picks the preselected command per agent group.
+	UILayout struct {
+		CommandOrder   []string          `yaml:"command_order"`
+		CategoryOrder  []string          `yaml:"category_order"`
+		Categories     map[string]string `yaml:"categories"`
+		DefaultCommand string            `yaml:"default_command"`
+		GroupDefaults  map[string]string `yaml:"group_defaults"`
+	} `yaml:"ui_layout"`
+
+	// Notes attach a markdown note to agents and agent groups, by name, e.g.
+	// "This PoP is behind DDoS scrubbing; expect higher latency". They are
+	// returned with the agents in /api/node for the web UI to render. Notes
+	// set through /api/control/notes take precedence.
+	Notes struct {
+		Agents map[string]string `yaml:"agents"`
+		Groups map[string]string `yaml:"groups"`
+	} `yaml:"notes"`
+
+	// Features are flags frontends read from /api/node to turn newer behaviors
+	// on or off per deployment, e.g. structured_results, compare or speedtest.
+	// Flags set through /api/control/features take precedence.
+	Features map[string]bool `yaml:"features"`
+
+	// Visibility hides commands and agent groups from anonymous web clients.
+	// Clients holding a valid control-panel token still see everything.
+	Visibility struct {
+		HiddenCommands []string `yaml:"hidden_commands"`
+		HiddenGroups   []string `yaml:"hidden_groups"`
+	} `yaml:"visibility"`
+}
+
+// APIKey is one partner API key. A zero quota is unlimited.
+type APIKey struct {
+	Name         string `yaml:"name"`
+	Key          string `yaml:"key"`
+	DailyQuota   int64  `yaml:"daily_quota"`
+	MonthlyQuota int64  `yaml:"monthly_quota"`
+}
+
+// ReputationSource is one target reputation source:
+//
+//	file  - Path lists IPs, CIDRs and domains (with their subdomains), one
+//	        per line, each optionally followed by a reason
+//	dnsbl - IP targets are looked up in the DNS blocklist Zone; with Domains,
+//	        domain targets too (as <domain>.<zone>, like a DBL)
+//	http  - the operator's API at URL is POSTed {"target", "type"} and
+//	        answers {"listed": bool, "reason": "..."}; Token is sent as a
+//	        bearer token
+//
+// Action is "refuse" (default) or "flag", which lets the run through and
+// logs and counts it.
+type ReputationSource struct {
+	Type    string `yaml:"type"`
+	Name    string `yaml:"name"`
+	Action  string `yaml:"action"`
+	Path    string `yaml:"path"`
+	Zone    string `yaml:"zone"`
+	Domains bool   `yaml:"domains"`
+	URL     string `yaml:"url"`
+	Token   string `yaml:"token"`
+}
+
+// ServerEndpoint is one advertised server. Latitude and Longitude place it
+// for the distance estimate of geolocated clients.
+type ServerEndpoint struct {
+	URL       string  `yaml:"url"`
+	Region    string  `yaml:"region"`
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+}
+
+// NotificationTemplate is the subject and body of a notification. {event},
+// {time}, {agent}, {group}, {location}, {command}, {target}, {id} and
+// {detail} are replaced; an empty field keeps the default.
+type NotificationTemplate struct {
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+}
+
+// GroupLimit limits executions on one agent group. MaxCommands per client
+// per TimeWindow seconds (default 60); a limit or quota of 0 is unlimited.
+type GroupLimit struct {
+	MaxCommands  int   `yaml:"max_commands"`
+	TimeWindow   int   `yaml:"time_window"`
+	DailyQuota   int64 `yaml:"daily_quota"`
+	MonthlyQuota int64 `yaml:"monthly_quota"`
+}
+
+// TestSuite is one named list of tests. IntervalMinutes runs it every so
+// many minutes; 0 runs it on demand only.
+type TestSuite struct {
+	Name            string      `yaml:"name"`
+	IntervalMinutes int         `yaml:"interval_minutes"`
+	Tests           []SuiteTest `yaml:"tests"`
+}
+
+// SuiteTest runs Command against Target on Agent. It passes when the command
+// completes and every assertion holds: "<metric> <op> <value>[unit]", e.g.
+// "loss < 2%", "rtt <= 80ms" or "throughput >= 900Mbit/s", or "output
+// contains <text>" and "output excludes <text>". Name defaults to the agent,
+// command and target.
+type SuiteTest struct {
+	Name    string   `yaml:"name"`
+	Agent   string   `yaml:"agent"`
+	Command string   `yaml:"command"`
+	Target  string   `yaml:"target"`
+	Assert  []string `yaml:"assert"`
 }
 
 // RuntimeSettings represents hot-reloadable server runtime options.
@@ -38,7 +440,23 @@ type RuntimeSettings struct {
 		Enabled     bool `json:"enabled"`
 		MaxCommands int  `json:"max_commands"`
 		TimeWindow  int  `json:"time_window"`
+		// Shadow evaluates the rate limit, per-client concurrency and client
+		// bans but only logs and counts what they would refuse.
+		Shadow bool `json:"shadow"`
 	} `json:"rate_limit"`
+
+	Legal LegalSettings `json:"legal"`
+}
+
+// LegalSettings holds the abuse contact and legal notices shown to web users.
+// When RequireAck is set and TermsText is non-empty, a session must acknowledge
+// the current terms before it may execute commands.
+type LegalSettings struct {
+	AbuseContact string `json:"abuse_contact"`
+	TermsText    string `json:"terms_text"`
+	RequireAck   bool   `json:"require_ack"`
+	// CommandDisclaimers maps a command name to a notice shown next to it.
+	CommandDisclaimers map[string]string `json:"command_disclaimers,omitempty"`
 }
 
 // AgentDetails represents additional agent information.
@@ -47,6 +465,16 @@ type AgentDetails struct {
 	Datacenter  string `yaml:"datacenter" json:"datacenter"`
 	TestIP      string `yaml:"test_ip" json:"test_ip"`
 	Description string `yaml:"description" json:"description"`
+	// Provider is the network hosting the agent and ASN its autonomous
+	// system ("AS64500"). Bandwidth is the uplink as shown to users, e.g.
+	// "10 Gbps". IPv4 and IPv6 are the agent's public addresses, LinkURL a
+	// page about the location such as the provider's PeeringDB entry.
+	Provider  string `yaml:"provider" json:"provider"`
+	ASN       string `yaml:"asn" json:"asn"`
+	Bandwidth string `yaml:"bandwidth" json:"bandwidth"`
+	IPv4      string `yaml:"ipv4" json:"ipv4"`
+	IPv6      string `yaml:"ipv6" json:"ipv6"`
+	LinkURL   string `yaml:"link_url" json:"link_url"`
 }
 
 // LoadConfig loads configuration from the specified file.
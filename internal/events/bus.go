@@ -0,0 +1,196 @@
+// Package events is the server's internal event bus. The agent manager
+// publishes lifecycle events (agents connecting and disconnecting, commands
+// starting and finishing, cleanups), and subsystems such as metrics, status
+// broadcasting or notifications subscribe to them instead of hooking into the
+// manager's internals.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type identifies an event.
+type Type string
+
+const (
+	AgentConnected    Type = "agent_connected"
+	AgentDisconnected Type = "agent_disconnected"
+	CommandStarted    Type = "command_started"
+	CommandFinished   Type = "command_finished"
+	// CleanupPerformed reports reaped output handlers or removed offline
+	// agents; Detail says which and Count how many.
+	CleanupPerformed Type = "cleanup_performed"
+	// ProbeChanged reports a scheduled probe whose result changed beyond the
+	// monitoring threshold since its previous run; Target names the probe
+	// target and Detail describes the change.
+	ProbeChanged Type = "probe_changed"
+	// CatalogChanged reports an agent whose command catalog hash differs
+	// from the one pinned for it although its commands were not changed on
+	// the server; Detail holds both hashes.
+	CatalogChanged Type = "catalog_changed"
+	// AgentNeverConnected reports a provisioned agent that has not connected
+	// within the provisioning grace period; Detail says since when it waits.
+	AgentNeverConnected Type = "agent_never_connected"
+	// AgentDetailsMismatch reports an agent connecting from an address that
+	// is not one of its recorded addresses; Detail names both.
+	AgentDetailsMismatch Type = "agent_details_mismatch"
+	// ApprovalRequested reports a run of a requires_approval command waiting
+	// for an operator; ID is the approval id and Detail names the client.
+	ApprovalRequested Type = "approval_requested"
+	// AbuseReported reports a result a viewer reported as abusive; ID is the
+	// report id and Detail the reason.
+	AbuseReported Type = "abuse_reported"
+	// AgentEnrollmentRequested reports an agent that used an enrollment
+	// code and waits for an operator to approve it; ID is the enrollment id,
+	// Agent the name it asked for and Detail where it connected from.
+	AgentEnrollmentRequested Type = "agent_enrollment_requested"
+	// SuiteFailed and SuitePassed report a finished test suite run: every
+	// run started on demand, and a scheduled run only when its outcome
+	// differs from the suite's previous run. Target names the suite, ID is
+	// the run id, Count the number of failed tests and Detail summarizes
+	// them.
+	SuiteFailed Type = "suite_failed"
+	SuitePassed Type = "suite_passed"
+)
+
+// Event is one published event. Fields not relevant to a Type are empty.
+type Event struct {
+	Type      Type
+	Time      time.Time
+	AgentUUID string
+	Agent     string
+	CommandID string
+	Command   string
+	// Err is the failure of a CommandFinished.
+	Err      string
+	Duration time.Duration
+	Count    int
+	Target   string
+	Detail   string
+	// ID identifies the approval request, abuse report, enrollment or test
+	// suite run.
+	ID string
+	// Requester is who asked for a command: the client IP of a web or API
+	// request, or the chat user. Empty for the server's own runs.
+	Requester string
+	// Stopped marks a CommandFinished stopped by a user before it
+	// completed.
+	Stopped bool
+}
+
+// defaultBuffer is the queue length of a subscriber that does not set one.
+const defaultBuffer = 256
+
+type subscriber struct {
+	types map[Type]bool
+	ch    chan Event
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (s *subscriber) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Bus fans events out to subscribers. Each subscriber has its own queue and
+// goroutine, so a slow subscriber never blocks the publisher or its peers;
+// events that do not fit its queue are dropped and counted.
+type Bus struct {
+	mu      sync.RWMutex
+	subs    map[*subscriber]struct{}
+	closed  bool
+	dropped uint64
+}
+
+// New creates an empty bus.
+func New() *Bus {
+	return &Bus{subs: make(map[*subscriber]struct{})}
+}
+
+// Subscribe calls fn for each published event of the given types (all types
+// when none are given), in order, on a dedicated goroutine. The returned
+// function unsubscribes. On a closed bus fn is never called.
+func (b *Bus) Subscribe(buffer int, fn func(Event), types ...Type) func() {
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+	sub := &subscriber{
+		ch:   make(chan Event, buffer),
+		done: make(chan struct{}),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return func() {}
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-sub.done:
+				return
+			case e := <-sub.ch:
+				fn(e)
+			}
+		}
+	}()
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+		sub.stop()
+	}
+}
+
+// Close unsubscribes every subscriber and stops their goroutines. Events
+// published afterwards are discarded.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		sub.stop()
+		delete(b.subs, sub)
+	}
+}
+
+// Publish delivers e to every interested subscriber without blocking. A nil
+// bus discards events.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because a subscriber's queue
+// was full.
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
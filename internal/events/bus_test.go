@@ -0,0 +1,63 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusDeliversInOrder(t *testing.T) {
+	b := New()
+	defer b.Close()
+	got := make(chan Event, 10)
+	b.Subscribe(0, func(e Event) { got <- e }, CommandStarted, CommandFinished)
+
+	b.Publish(Event{Type: CommandStarted, CommandID: "1"})
+	b.Publish(Event{Type: AgentConnected, CommandID: "skipped"})
+	b.Publish(Event{Type: CommandFinished, CommandID: "2"})
+	b.Publish(Event{Type: CommandStarted, CommandID: "3"})
+
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case e := <-got:
+			if e.CommandID != want {
+				t.Fatalf("event %q delivered, want %q", e.CommandID, want)
+			}
+			if e.Time.IsZero() {
+				t.Errorf("event %q has no time", e.CommandID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %q not delivered", want)
+		}
+	}
+	select {
+	case e := <-got:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBusCountsDropped(t *testing.T) {
+	b := New()
+	defer b.Close()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	b.Subscribe(1, func(Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	// Unsubscribed types are neither queued nor counted.
+	b.Subscribe(1, func(Event) {}, AbuseReported)
+
+	b.Publish(Event{Type: CommandStarted})
+	<-started // the subscriber holds the first event, its queue is empty
+	b.Publish(Event{Type: CommandStarted})
+	b.Publish(Event{Type: CommandStarted})
+	b.Publish(Event{Type: CommandStarted})
+	if got := b.Dropped(); got != 2 {
+		t.Errorf("Dropped() = %d, want 2", got)
+	}
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+// Bounds on abuse reports, so that the endpoint cannot be used to fill the
+// database: the open reports of one reporter IP, and the reports filed from
+// one /24 (IPv4) or /48 (IPv6) an hour. Open reports count until an operator
+// resolves, dismisses or deletes them, or they expire (see retention.go).
+const (
+	abuseReportsPerIP         = 10
+	abuseReportsPerPrefixHour = 20
+)
+
+// InitAbuseReports starts limiting the reports filed per reporter prefix.
+func (h *Handler) InitAbuseReports() {
+	h.abuseReports = newWindowLimiter(h.ctx, abuseReportsPerPrefixHour, time.Hour)
+}
+
+// reporterPrefix is the /24 or /48 ip belongs to, or ip itself when it does
+// not parse.
+func reporterPrefix(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// Statuses of an abuse report.
+const (
+	reportOpen      = "open"
+	reportResolved  = "resolved"
+	reportDismissed = "dismissed"
+)
+
+// AbuseReportRequest is the body of POST /api/report.
+type AbuseReportRequest struct {
+	// ResultID is the id of a stored result (see results.go), when the
+	// result has one.
+	ResultID string `json:"result_id,omitempty"`
+	Agent    string `json:"agent"`
+	Command  string `json:"command"`
+	Target   string `json:"target,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// resultPermalink is the public URL path of a stored result, without the
+// session_id it is fetched with.
+func resultPermalink(resultID string) string {
+	if resultID == "" {
+		return ""
+	}
+	return "/api/results/" + resultID + "/geojson"
+}
+
+// abuseReportJSON is a report as /api/control/reports lists it.
+func abuseReportJSON(r serverstore.AbuseReport) map[string]any {
+	report := map[string]any{
+		"id":          r.ID,
+		"agent":       r.Agent,
+		"command":     r.Command,
+		"target":      r.Target,
+		"reason":      r.Reason,
+		"reporter_ip": r.ReporterIP,
+		"status":      r.Status,
+		"created_at":  r.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if r.ResultID != "" {
+		report["result_id"] = r.ResultID
+		report["permalink"] = resultPermalink(r.ResultID)
+	}
+	if !r.ResolvedAt.IsZero() {
+		report["resolved_at"] = r.ResolvedAt.UTC().Format(time.RFC3339)
+	}
+	return report
+}
+
+// handleAbuseReport handles POST /api/report: a viewer reports a result as
+// abusive, e.g. a command run against a third party. The report is stored
+// with the reporter's IP for operators to triage in the control panel.
+func (h *Handler) handleAbuseReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.validateSessionID(r.URL.Query().Get("session_id")) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+
+	var req AbuseReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	report := serverstore.AbuseReport{
+		ResultID:   strings.TrimSpace(req.ResultID),
+		Agent:      strings.TrimSpace(req.Agent),
+		Command:    strings.TrimSpace(req.Command),
+		Target:     strings.TrimSpace(req.Target),
+		Reason:     strings.TrimSpace(req.Reason),
+		ReporterIP: h.getRealIP(r),
+		CreatedAt:  time.Now(),
+	}
+	switch {
+	case report.ResultID != "" && !resultIDPattern.MatchString(report.ResultID):
+		http.Error(w, "Invalid result_id", http.StatusBadRequest)
+		return
+	case report.Agent == "" || report.Command == "":
+		http.Error(w, "agent and command are required", http.StatusBadRequest)
+		return
+	case len(report.Agent) > 64 || len(report.Command) > 64 || len(report.Target) > validator.MaxTargetLength:
+		http.Error(w, "agent, command or target too long", http.StatusBadRequest)
+		return
+	case report.Reason == "":
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	case len(report.Reason) > 500:
+		http.Error(w, "reason must not exceed 500 characters", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.agentManager.GetAgent(report.Agent); !ok {
+		http.Error(w, "Unknown agent", http.StatusBadRequest)
+		return
+	}
+
+	fromIP, err := h.store.CountOpenAbuseReports(report.ReporterIP)
+	if err != nil {
+		logger.Errorf("Failed to count abuse reports: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if fromIP >= abuseReportsPerIP {
+		http.Error(w, "Too many open reports, please contact the operator directly", http.StatusTooManyRequests)
+		return
+	}
+	if prefix := reporterPrefix(report.ReporterIP); h.abuseReports != nil && !h.abuseReports.checkRateLimit(prefix) {
+		retry := int(h.abuseReports.getRemainingTime(prefix).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		http.Error(w, "Too many reports from your network, please contact the operator directly", http.StatusTooManyRequests)
+		return
+	}
+	id, err := h.store.SaveAbuseReport(report)
+	if err != nil {
+		logger.Errorf("Failed to save abuse report: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Warnf("Abuse report #%d from [%s]: %s %s %s: %s", id, report.ReporterIP, report.Agent, report.Command, report.Target, report.Reason)
+	h.agentManager.Events().Publish(events.Event{
+		Type:    events.AbuseReported,
+		Time:    report.CreatedAt,
+		Agent:   report.Agent,
+		Command: report.Command,
+		Target:  report.Target,
+		ID:      strconv.FormatInt(id, 10),
+		Detail:  report.Reason,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": reportOpen})
+}
+
+// handleControlReports handles GET /api/control/reports?status=open|resolved|
+// dismissed|all - the abuse reports, newest first; open ones without ?status=.
+func (h *Handler) handleControlReports(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = reportOpen
+	case "all":
+		status = ""
+	case reportOpen, reportResolved, reportDismissed:
+	default:
+		http.Error(w, "status must be open, resolved, dismissed or all", http.StatusBadRequest)
+		return
+	}
+	reports, err := h.store.ListAbuseReports(status)
+	if err != nil {
+		logger.Errorf("Failed to list abuse reports: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	list := make([]map[string]any, 0, len(reports))
+	for _, report := range reports {
+		list = append(list, abuseReportJSON(report))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"reports": list})
+}
+
+// handleControlReportByID handles /api/control/reports/{id}:
+//
+//	PUT    - set the status {"status": "open" | "resolved" | "dismissed"}
+//	DELETE - remove the report
+func (h *Handler) handleControlReportByID(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/control/reports/"), 10, 64)
+	if err != nil || id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var found bool
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		switch req.Status {
+		case reportOpen, reportResolved, reportDismissed:
+		default:
+			http.Error(w, "status must be open, resolved or dismissed", http.StatusBadRequest)
+			return
+		}
+		found, err = h.store.SetAbuseReportStatus(id, req.Status, time.Now())
+		if found {
+			logger.Infof("Control panel marked abuse report #%d %s", id, req.Status)
+		}
+	case http.MethodDelete:
+		found, err = h.store.DeleteAbuseReport(id)
+		if found {
+			logger.Infof("Control panel deleted abuse report #%d", id)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to update abuse report #%d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "id": id})
+}
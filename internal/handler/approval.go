@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// approvalDefaultTimeout is how long a run waits for an operator without
+// execution.approval_timeout.
+const approvalDefaultTimeout = 5 * time.Minute
+
+// approvalIDLength is the length of an approval request id.
+const approvalIDLength = 16
+
+// Decisions on an approval request.
+const (
+	approvalApprove = "approve"
+	approvalDeny    = "deny"
+)
+
+// approvals holds the runs of requires_approval commands waiting for an
+// operator. They live in memory only: the requester's stream waits on them,
+// so they cannot outlive it.
+type approvals struct {
+	mu      sync.Mutex
+	pending map[string]*approvalRequest
+	timeout time.Duration
+}
+
+// approvalRequest is a run waiting for an operator. decision receives true
+// when it is approved and false when it is denied.
+type approvalRequest struct {
+	id        string
+	agent     string
+	command   string
+	target    string
+	clientIP  string
+	sessionID string
+	created   time.Time
+	expires   time.Time
+	decision  chan bool
+}
+
+// InitApprovals sets how long runs wait for approval.
+func (h *Handler) InitApprovals(cfg *config.Config) {
+	h.approvals.pending = make(map[string]*approvalRequest)
+	h.approvals.timeout = approvalDefaultTimeout
+	if seconds := cfg.Execution.ApprovalTimeout; seconds > 0 {
+		h.approvals.timeout = time.Duration(seconds) * time.Second
+	}
+}
+
+// awaitApproval holds call until an operator approves or denies it, it
+// expires or the client leaves. It reports whether the run may go ahead,
+// after completing the stream otherwise.
+func (h *Handler) awaitApproval(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, call execCall) bool {
+	id, err := GenerateRandomString(approvalIDLength)
+	if err != nil {
+		logger.Errorf("Failed to create approval request: %v", err)
+		h.sendSSEError(w, flusher, "Internal server error")
+		return false
+	}
+	now := time.Now()
+	request := &approvalRequest{
+		id:        id,
+		agent:     call.req.Agent,
+		command:   call.req.Command,
+		target:    call.req.Target,
+		clientIP:  call.clientIP,
+		sessionID: call.sessionID,
+		created:   now,
+		expires:   now.Add(h.approvals.timeout),
+		decision:  make(chan bool, 1),
+	}
+	h.approvals.mu.Lock()
+	h.approvals.pending[id] = request
+	h.approvals.mu.Unlock()
+	defer func() {
+		h.approvals.mu.Lock()
+		delete(h.approvals.pending, id)
+		h.approvals.mu.Unlock()
+	}()
+
+	logger.Warnf("Client [%s] requested approval %s for %s %s on %s", call.clientIP, id, request.command, request.target, request.agent)
+	h.agentManager.Events().Publish(events.Event{
+		Type:    events.ApprovalRequested,
+		Time:    now,
+		Agent:   request.agent,
+		Command: request.command,
+		Target:  request.target,
+		ID:      id,
+		Detail:  "requested by client " + call.clientIP + ", expires at " + request.expires.UTC().Format(time.RFC3339),
+	})
+	h.sendSSEMessage(w, flusher, map[string]any{
+		"type":        "pending_approval",
+		"approval_id": id,
+		"expires_at":  request.expires.UTC().Format(time.RFC3339),
+	})
+
+	timer := time.NewTimer(h.approvals.timeout)
+	defer timer.Stop()
+	select {
+	case approved := <-request.decision:
+		if !approved {
+			h.sendSSEError(w, flusher, "An operator denied this command")
+		}
+		return approved
+	case <-timer.C:
+		logger.Infof("Approval %s expired", id)
+		h.sendSSEError(w, flusher, "No operator approved this command in time")
+		return false
+	case <-ctx.Done():
+		logger.Infof("Approval %s withdrawn: the client left", id)
+		return false
+	}
+}
+
+// approvalJSON is a pending run as /api/control/approvals lists it.
+func approvalJSON(r *approvalRequest) map[string]any {
+	return map[string]any{
+		"id":         r.id,
+		"agent":      r.agent,
+		"command":    r.command,
+		"target":     r.target,
+		"client_ip":  r.clientIP,
+		"session_id": r.sessionID,
+		"created_at": r.created.UTC().Format(time.RFC3339),
+		"expires_at": r.expires.UTC().Format(time.RFC3339),
+	}
+}
+
+// handleControlApprovals handles GET /api/control/approvals - the runs waiting
+// for approval, oldest first.
+func (h *Handler) handleControlApprovals(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.approvals.mu.Lock()
+	pending := make([]*approvalRequest, 0, len(h.approvals.pending))
+	for _, request := range h.approvals.pending {
+		pending = append(pending, request)
+	}
+	h.approvals.mu.Unlock()
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].created.Before(pending[j].created)
+	})
+	list := make([]map[string]any, 0, len(pending))
+	for _, request := range pending {
+		list = append(list, approvalJSON(request))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"approvals": list})
+}
+
+// handleControlApprovalByID handles PUT /api/control/approvals/{id} with
+// {"decision": "approve" | "deny"}.
+func (h *Handler) handleControlApprovalByID(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/control/approvals/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Decision != approvalApprove && req.Decision != approvalDeny {
+		http.Error(w, "decision must be approve or deny", http.StatusBadRequest)
+		return
+	}
+
+	// Taking the request out of the list makes the first decision final.
+	h.approvals.mu.Lock()
+	request, found := h.approvals.pending[id]
+	delete(h.approvals.pending, id)
+	h.approvals.mu.Unlock()
+	if !found {
+		http.Error(w, "Approval request not found or no longer pending", http.StatusNotFound)
+		return
+	}
+	approved := req.Decision == approvalApprove
+	request.decision <- approved
+	verb := "denied"
+	if approved {
+		verb = "approved"
+	}
+	logger.Infof("Control panel %s %s %s on %s for client [%s] (approval %s)", verb, request.command, request.target, request.agent, request.clientIP, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "id": id, "decision": req.Decision})
+}
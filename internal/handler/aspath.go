@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// ASPathSegment is a run of consecutive trace hops in one autonomous system.
+type ASPathSegment struct {
+	ASN   string `json:"asn"`
+	Owner string `json:"owner,omitempty"`
+	Hops  int    `json:"hops"`
+}
+
+// summarizeASPath reduces a structured route result to its AS path, e.g.
+// AS64500 (2 hops) → AS13335 (3 hops). Hops without an ASN (timeouts,
+// private addresses) do not split a segment. It returns nil for anything
+// that is not a route or has no ASN data.
+func summarizeASPath(data json.RawMessage) []ASPathSegment {
+	var route proto.RouteResult
+	if err := json.Unmarshal(data, &route); err != nil || route.Kind != proto.ResultKindRoute {
+		return nil
+	}
+
+	var path []ASPathSegment
+	for _, hop := range route.Hops {
+		asn := normalizeASN(hop.ASN)
+		if asn == "" {
+			continue
+		}
+		if n := len(path); n > 0 && path[n-1].ASN == asn {
+			path[n-1].Hops++
+			if path[n-1].Owner == "" {
+				path[n-1].Owner = hopOwner(hop)
+			}
+			continue
+		}
+		path = append(path, ASPathSegment{ASN: asn, Owner: hopOwner(hop), Hops: 1})
+	}
+	return path
+}
+
+// lastASPath returns the AS path of the last route result in data.
+func lastASPath(data []json.RawMessage) []ASPathSegment {
+	for i := len(data) - 1; i >= 0; i-- {
+		if path := summarizeASPath(data[i]); path != nil {
+			return path
+		}
+	}
+	return nil
+}
+
+// normalizeASN turns "13335" or "as13335" into "AS13335"; anything that is
+// not a number is dropped.
+func normalizeASN(raw string) string {
+	digits := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(raw)), "AS")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" || strings.Trim(digits, "0") == "" {
+		return ""
+	}
+	return "AS" + digits
+}
+
+func hopOwner(hop proto.RouteHop) string {
+	if hop.Owner != "" {
+		return hop.Owner
+	}
+	return hop.ISP
+}
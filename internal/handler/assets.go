@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Vite emits content-hashed file names under /assets/, so a given URL never
+// changes and browsers may keep it for a year without revalidating.
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// precompressedEncodings are the encodings a build may ship next to an asset
+// (app.js.br, app.js.gz), in order of preference.
+var precompressedEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// handleAssets serves /assets/ with a long-lived cache policy and an ETag,
+// preferring a pre-compressed variant of the file when the client accepts it.
+func (h *Handler) handleAssets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean(r.URL.Path)
+	dir := http.Dir(h.webDir)
+	file, err := dir.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", assetCacheControl)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	etagSuffix := ""
+	for _, enc := range precompressedEncodings {
+		if !acceptsEncoding(r, enc.name) {
+			continue
+		}
+		variant, err := dir.Open(name + enc.ext)
+		if err != nil {
+			continue
+		}
+		defer variant.Close()
+		if variantInfo, err := variant.Stat(); err == nil && !variantInfo.IsDir() {
+			file, info, etagSuffix = variant, variantInfo, "-"+enc.name
+			w.Header().Set("Content-Encoding", enc.name)
+			break
+		}
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x%s"`, info.ModTime().UnixNano(), info.Size(), etagSuffix))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding lists
+// encoding without a zero quality.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// serveIndexHTML serves the SPA's index.html. It must never be cached: it is
+// what points the browser at the current build's hashed assets.
+func (h *Handler) serveIndexHTML(w http.ResponseWriter, r *http.Request) {
+	h.setNoCacheHeaders(w)
+	http.ServeFile(w, r, filepath.Join(h.webDir, "index.html"))
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const (
+	// callbackMaxOutput caps the command output carried in a receipt.
+	callbackMaxOutput = 1 << 20
+	callbackTimeout   = 10 * time.Second
+	callbackAttempts  = 3
+)
+
+// ExecutionReceipt is the final result of a command, POSTed to the request's
+// callback_url once the run completes.
+type ExecutionReceipt struct {
+	CommandID  string            `json:"command_id"`
+	Agent      string            `json:"agent"`
+	Command    string            `json:"command"`
+	Target     string            `json:"target,omitempty"`
+	Success    bool              `json:"success"`
+	Stopped    bool              `json:"stopped,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Code       string            `json:"code,omitempty"`
+	Output     string            `json:"output"`
+	Truncated  bool              `json:"truncated,omitempty"`
+	Data       []json.RawMessage `json:"data,omitempty"`
+	ASPath     []ASPathSegment   `json:"as_path,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	DurationMs int64             `json:"duration_ms"`
+}
+
+// receiptRecorder tracks a command's result while it streams to the client.
+// Like the SSE output events, each output message carries the full text so
+// far, so the latest one replaces the previous.
+type receiptRecorder struct {
+	mu      sync.Mutex
+	receipt ExecutionReceipt
+	output  string
+}
+
+func newReceiptRecorder(commandID string, req ExecRequest) *receiptRecorder {
+	return &receiptRecorder{receipt: ExecutionReceipt{
+		CommandID: commandID,
+		Agent:     req.Agent,
+		Command:   req.Command,
+		Target:    req.Target,
+		StartedAt: time.Now().UTC(),
+	}}
+}
+
+// record is called for every output callback of the command.
+func (rr *receiptRecorder) record(output string, isError, isComplete, isStopped bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	switch {
+	case isComplete && isError:
+		rr.receipt.Error = output
+	case isComplete:
+		rr.receipt.Success = true
+		if output != "" {
+			rr.output = output
+		}
+	case output != "":
+		rr.output = output
+	}
+	if isStopped {
+		rr.receipt.Stopped = true
+	}
+}
+
+func (rr *receiptRecorder) recordData(data json.RawMessage) {
+	rr.mu.Lock()
+	rr.receipt.Data = append(rr.receipt.Data, data)
+	rr.mu.Unlock()
+}
+
+// fail marks the run as failed before or outside the output stream.
+func (rr *receiptRecorder) fail(code, reason string) {
+	rr.mu.Lock()
+	rr.receipt.Success = false
+	rr.receipt.Code = code
+	rr.receipt.Error = reason
+	rr.mu.Unlock()
+}
+
+func (rr *receiptRecorder) finish() ExecutionReceipt {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	receipt := rr.receipt
+	receipt.Output = rr.output
+	if len(receipt.Output) > callbackMaxOutput {
+		receipt.Output = receipt.Output[:callbackMaxOutput]
+		receipt.Truncated = true
+	}
+	receipt.ASPath = lastASPath(receipt.Data)
+	receipt.FinishedAt = time.Now().UTC()
+	receipt.DurationMs = receipt.FinishedAt.Sub(receipt.StartedAt).Milliseconds()
+	return receipt
+}
+
+// InitCallbacks sets the HMAC secret used to sign execution receipts. Without
+// a secret, callback_url is refused.
+func (h *Handler) InitCallbacks(cfg *config.Config) {
+	h.callbackSecret = []byte(cfg.Callbacks.Secret)
+	h.callbackClient = &http.Client{
+		Timeout: callbackTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// validateCallbackURL checks that a callback may be sent for this request. A
+// callback makes the server issue an outbound request, so it is limited to
+// clients holding a control token.
+func (h *Handler) validateCallbackURL(raw string, authenticated bool) error {
+	if len(h.callbackSecret) == 0 {
+		return fmt.Errorf("callbacks are not enabled on this server")
+	}
+	if !authenticated {
+		return fmt.Errorf("callback_url requires a control token")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// signReceipt returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func signReceipt(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverReceipt POSTs a receipt to callbackURL, retrying transient failures.
+func (h *Handler) deliverReceipt(callbackURL string, receipt ExecutionReceipt) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		logger.Errorf("Failed to marshal receipt for %s: %v", receipt.CommandID, err)
+		return
+	}
+	h.postSigned(callbackURL, body, "receipt for "+receipt.CommandID, http.Header{"X-YALS-Command-ID": {receipt.CommandID}})
+}
+
+// postSigned POSTs a JSON body, signed with callbacks.secret when one is set,
+// retrying transient failures. what names the payload in log messages.
+func (h *Handler) postSigned(targetURL string, body []byte, what string, header http.Header) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ""
+	if len(h.callbackSecret) > 0 {
+		signature = signReceipt(h.callbackSecret, timestamp, body)
+	}
+
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+		if err != nil {
+			logger.Warnf("Invalid URL for %s: %v", what, err)
+			return
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "YALS-Callback")
+		req.Header.Set("X-YALS-Timestamp", timestamp)
+		if signature != "" {
+			req.Header.Set("X-YALS-Signature", "sha256="+signature)
+		}
+
+		resp, err := h.callbackClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				logger.Debugf("Delivered %s to %s", what, targetURL)
+				return
+			}
+			// A 4xx other than 429 will not improve on retry.
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				logger.Warnf("Delivery of %s rejected with status %d", what, resp.StatusCode)
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		logger.Warnf("Delivery of %s failed (attempt %d/%d): %v", what, attempt, callbackAttempts, err)
+		if attempt < callbackAttempts {
+			time.Sleep(time.Duration(attempt*attempt) * time.Second)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// catalogPins tracks the command catalog hash each agent reports against the
+// one pinned for it.
+type catalogPins struct {
+	// mu serializes pin updates; served is the hash of the catalog each agent
+	// was sent at its last handshake.
+	mu         sync.Mutex
+	served     map[string]string
+	webhookURL string
+	mismatches atomic.Uint64
+}
+
+// InitCatalogPins starts recording agents' catalog reports. With
+// monitoring.catalog_alerts, unexpected changes are also POSTed to
+// monitoring.webhook_url.
+func (h *Handler) InitCatalogPins(cfg *config.Config) {
+	h.catalogs.served = make(map[string]string)
+	h.agentManager.SetCatalogHandler(h.recordCatalog)
+	if url := strings.TrimSpace(cfg.Monitoring.WebhookURL); cfg.Monitoring.CatalogAlerts && url != "" {
+		h.catalogs.webhookURL = url
+		h.agentManager.Events().Subscribe(0, h.notifyCatalogChange, events.CatalogChanged)
+		logger.Infof("Command catalog change notifications enabled")
+	}
+}
+
+// noteServedCatalog records the catalog sent to an agent in its handshake and
+// checks the hash the agent enforced before it (previous) against its pin.
+func (h *Handler) noteServedCatalog(uuid, agentName string, commands map[string]config.CommandTemplate, previous string) {
+	served := config.CatalogHash(commands)
+	h.catalogs.mu.Lock()
+	defer h.catalogs.mu.Unlock()
+	h.catalogs.served[uuid] = served
+	if previous == "" {
+		return
+	}
+	pin, found, err := h.store.GetAgentCatalog(uuid)
+	if err != nil || !found || pin.ServedHash != served {
+		return
+	}
+	if previous != pin.PinnedHash && previous != pin.ReportedHash {
+		h.catalogChanged(uuid, agentName, pin.PinnedHash, previous, "since its last connection")
+	}
+}
+
+// recordCatalog handles an agent's catalog report. The first report is
+// pinned, and so is the first one after the agent's commands were changed on
+// the server. Any other hash that differs from the pin is reported as an
+// unexpected change (once per new hash) until an operator re-pins it.
+func (h *Handler) recordCatalog(uuid string, report proto.CatalogReport) {
+	h.catalogs.mu.Lock()
+	defer h.catalogs.mu.Unlock()
+
+	served := h.catalogs.served[uuid]
+	pin, found, err := h.store.GetAgentCatalog(uuid)
+	if err != nil {
+		logger.Warnf("Failed to load command catalog of agent %s: %v", uuid, err)
+		return
+	}
+	now := time.Now()
+	if !found || (served != "" && pin.ServedHash != served) {
+		pin = serverstore.AgentCatalog{UUID: uuid, PinnedHash: report.Hash, ServedHash: served, PinnedAt: now}
+	} else if report.Hash != pin.PinnedHash && report.Hash != pin.ReportedHash {
+		h.catalogChanged(uuid, h.agentManager.NameByUUID(uuid), pin.PinnedHash, report.Hash, "")
+	}
+	pin.ReportedHash = report.Hash
+	pin.ReportedAt = now
+	if err := h.store.SaveAgentCatalog(pin); err != nil {
+		logger.Warnf("Failed to save command catalog of agent %s: %v", uuid, err)
+	}
+}
+
+func (h *Handler) catalogChanged(uuid, agentName, pinned, reported, when string) {
+	h.catalogs.mismatches.Add(1)
+	detail := fmt.Sprintf("command catalog %s differs from pinned %s", reported, pinned)
+	if when != "" {
+		detail += " " + when
+	}
+	logger.Warnf("Agent %s (%s): %s", agentName, uuid, detail)
+	h.agentManager.Events().Publish(events.Event{
+		Type:      events.CatalogChanged,
+		AgentUUID: uuid,
+		Agent:     agentName,
+		Detail:    detail,
+	})
+}
+
+// notifyCatalogChange POSTs an unexpected catalog change to
+// monitoring.webhook_url, in the same format as probe changes.
+func (h *Handler) notifyCatalogChange(e events.Event) {
+	body, err := json.Marshal(map[string]any{
+		"text":       fmt.Sprintf("[YALS] %s: %s", e.Agent, e.Detail),
+		"type":       string(e.Type),
+		"agent":      e.Agent,
+		"agent_uuid": e.AgentUUID,
+		"detail":     e.Detail,
+		"time":       e.Time.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	go h.postSigned(h.catalogs.webhookURL, body, "catalog change notification", nil)
+}
+
+// handleControlCatalogs handles GET /api/control/catalogs - each agent's
+// pinned and last reported command catalog hash.
+func (h *Handler) handleControlCatalogs(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pins, err := h.store.ListAgentCatalogs()
+	if err != nil {
+		logger.Errorf("Failed to list command catalogs: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	catalogs := make([]map[string]any, 0, len(pins))
+	for _, pin := range pins {
+		catalogs = append(catalogs, map[string]any{
+			"uuid":          pin.UUID,
+			"name":          h.agentManager.NameByUUID(pin.UUID),
+			"pinned_hash":   pin.PinnedHash,
+			"reported_hash": pin.ReportedHash,
+			"matches":       pin.PinnedHash == pin.ReportedHash,
+			"pinned_at":     pin.PinnedAt.UTC().Format(time.RFC3339),
+			"reported_at":   pin.ReportedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"catalogs": catalogs})
+}
+
+// handleControlCatalogPin handles POST /api/control/catalogs/{uuid}/pin -
+// accepts the agent's last reported catalog as its new pin.
+func (h *Handler) handleControlCatalogPin(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uuid, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/control/catalogs/"), "/pin")
+	if !ok || uuid == "" || strings.Contains(uuid, "/") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	h.catalogs.mu.Lock()
+	defer h.catalogs.mu.Unlock()
+	pin, found, err := h.store.GetAgentCatalog(uuid)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No catalog reported by this agent", http.StatusNotFound)
+		return
+	}
+	pin.PinnedHash = pin.ReportedHash
+	pin.PinnedAt = time.Now()
+	if err := h.store.SaveAgentCatalog(pin); err != nil {
+		logger.Errorf("Failed to pin command catalog of agent %s: %v", uuid, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("Pinned command catalog %s for agent %s", pin.PinnedHash, uuid)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "pinned_hash": pin.PinnedHash})
+}
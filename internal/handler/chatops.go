@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// The ChatOps adapter maps "/lg <command> [target] from <node>" messages from a
+// Slack slash command or a Telegram bot webhook onto a normal execution, and
+// replies with the final output. Both platforms authenticate their webhooks:
+// Slack signs each request, Telegram echoes a secret token.
+const (
+	chatMaxBody        = 64 << 10
+	chatMaxReply       = 3500
+	chatSlackMaxSkew   = 5 * time.Minute
+	chatCommandTimeout = 5 * time.Minute
+)
+
+const chatUsage = "Usage: /lg <command> [target] from <node>, e.g. /lg ping 1.1.1.1 from frankfurt"
+
+type chatOps struct {
+	slackSigningSecret  []byte
+	telegramBotToken    string
+	telegramSecretToken string
+	client              *http.Client
+}
+
+// InitChatOps enables the Slack and Telegram webhooks that have credentials
+// configured.
+func (h *Handler) InitChatOps(cfg *config.Config) {
+	h.chat = chatOps{
+		slackSigningSecret:  []byte(cfg.ChatOps.SlackSigningSecret),
+		telegramBotToken:    cfg.ChatOps.TelegramBotToken,
+		telegramSecretToken: cfg.ChatOps.TelegramSecretToken,
+		client:              &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// chatRequest is one parsed "/lg" message.
+type chatRequest struct {
+	command string
+	target  string
+	node    string
+}
+
+// parseChatCommand parses "[/lg] <command> [target] [from <node>]".
+func parseChatCommand(text string) (chatRequest, error) {
+	fields := strings.Fields(text)
+	if len(fields) > 0 && (fields[0] == "/lg" || strings.HasPrefix(fields[0], "/lg@")) {
+		fields = fields[1:]
+	}
+
+	var req chatRequest
+	for i, field := range fields {
+		if strings.EqualFold(field, "from") {
+			req.node = strings.Join(fields[i+1:], " ")
+			fields = fields[:i]
+			break
+		}
+	}
+	if len(fields) == 0 || len(fields) > 2 || strings.EqualFold(fields[0], "help") {
+		return req, errors.New(chatUsage)
+	}
+	req.command = fields[0]
+	if len(fields) == 2 {
+		req.target = fields[1]
+	}
+	return req, nil
+}
+
+// resolveChatNode finds the agent a chat user means: an exact name first, then
+// a case-insensitive match on name, location or datacenter. Only agents visible
+// to anonymous viewers are considered. It also reports whether the agent is
+// connected.
+func (h *Handler) resolveChatNode(query string) (string, bool, error) {
+	if query == "" {
+		return "", false, errors.New("Please name a node with \"from <node>\". " + chatUsage)
+	}
+	needle := strings.ToLower(query)
+
+	var matches []string
+	online := make(map[string]bool)
+	for _, a := range h.agentManager.GetAgents() {
+		name, _ := a["name"].(string)
+		if !h.agentManager.AgentVisible(name, false) {
+			continue
+		}
+		status, _ := a["status"].(int)
+		online[name] = status == 1
+		if strings.EqualFold(name, query) {
+			return name, online[name], nil
+		}
+		details, _ := a["details"].(map[string]any)
+		location, _ := details["location"].(string)
+		datacenter, _ := details["datacenter"].(string)
+		for _, field := range []string{name, location, datacenter} {
+			if field != "" && strings.Contains(strings.ToLower(field), needle) {
+				matches = append(matches, name)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", false, fmt.Errorf("No node matches %q", query)
+	case 1:
+		return matches[0], online[matches[0]], nil
+	default:
+		return "", false, fmt.Errorf("%q matches several nodes: %s", query, strings.Join(matches, ", "))
+	}
+}
+
+// runChatCommand executes a chat request with the same checks as /api/exec
+// (as an anonymous viewer) and returns the reply text. user identifies the chat
+// user for rate limiting, e.g. "slack:U123".
+func (h *Handler) runChatCommand(user, text string) string {
+	req, err := parseChatCommand(text)
+	if err != nil {
+		return err.Error()
+	}
+	agentName, online, err := h.resolveChatNode(req.node)
+	if err != nil {
+		return err.Error()
+	}
+	if !online {
+		return fmt.Sprintf("Node %s is not connected", agentName)
+	}
+	if pause, paused := h.executionPause(agentName); paused {
+		return pauseMessage(pause)
+	}
+
+	var agentCommands []string
+	for _, cmd := range h.agentManager.GetAgentCommandsForViewer(agentName, false) {
+		if cmd.Name == req.command && cmd.Unavailable {
+			return fmt.Sprintf("Command unavailable on %s: %s", agentName, cmd.UnavailableReason)
+		}
+		if cmd.Name == req.command && cmd.RequiresApproval {
+			return fmt.Sprintf("%s needs an operator's approval; run it from the web UI", req.command)
+		}
+		agentCommands = append(agentCommands, cmd.Name)
+	}
+
+	if !slices.Contains(agentCommands, req.command) {
+		return fmt.Sprintf("Unknown command %q on %s. Available: %s", req.command, agentName, strings.Join(agentCommands, ", "))
+	}
+
+	target, err := h.validateTarget(agentName, req.command, req.target)
+	if err != nil {
+		return "Invalid target: " + err.Error()
+	}
+	if h.blockedTarget(target) {
+		return "Target is not allowed on this looking glass"
+	}
+	if msg := h.checkReputation(context.Background(), target, false, user, req.command); msg != "" {
+		return msg
+	}
+	req.target = target.Value
+	cmd := req.command + " " + req.target
+
+	if !h.rateLimiter.checkRateLimit(user) && !h.shadowed(&h.shadow.rateLimited, "rate limit exceeded by chat user %s", user) {
+		remaining := h.rateLimiter.getRemainingTime(user)
+		return fmt.Sprintf("Rate limit exceeded. Please wait %d seconds before trying again.", int(remaining.Seconds())+1)
+	}
+	if msg := h.checkGroupRateLimit(agentName, "chat:"+user); msg != "" {
+		return msg
+	}
+	if msg := h.consumeGroupQuota(agentName); msg != "" {
+		return msg
+	}
+
+	// Chat requests are signed by the workspace, so its members rank with
+	// API key holders.
+	output, failure, err := h.execServerRun(serverRun{
+		agent:     agentName,
+		command:   req.command,
+		target:    req.target,
+		sessionID: fmt.Sprintf("%s-%d", user, time.Now().UnixNano()),
+		requester: user,
+		priority:  agent.PriorityAuthenticated,
+		timeout:   chatCommandTimeout,
+		span:      "chatops.exec",
+	})
+	if err != nil {
+		if msg := runRefusal(agentName, err); msg != "" {
+			return msg
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Sprintf("%s on %s\n%s\nStopped after %s", cmd, agentName, output, chatCommandTimeout)
+		}
+		return "Error: " + err.Error()
+	}
+
+	reply := fmt.Sprintf("%s on %s\n%s", cmd, agentName, output)
+	if failure != "" {
+		return reply + "\n" + failure
+	}
+	return appendFooter(reply, h.resultFooter(agentName, req.command, target, displayPrefs{}))
+}
+
+// truncateChatReply keeps replies within the platforms' message limits.
+func truncateChatReply(reply string) string {
+	if len(reply) <= chatMaxReply {
+		return reply
+	}
+	return strings.ToValidUTF8(reply[:chatMaxReply], "") + "\n… (truncated)"
+}
+
+// readChatBody reads a webhook body with a size cap.
+func readChatBody(r *http.Request) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r.Body, chatMaxBody))
+}
+
+// postChatJSON POSTs a JSON payload to a platform API.
+func (h *Handler) postChatJSON(endpoint string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := h.chat.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The Telegram endpoint embeds the bot token; keep it out of the logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// verifySlackSignature checks Slack's v0 request signature.
+func (h *Handler) verifySlackSignature(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > chatSlackMaxSkew || skew < -chatSlackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.chat.slackSigningSecret)
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// handleChatSlack handles POST /api/chatops/slack - a Slack slash command. The
+// command is acknowledged at once; the result is posted to response_url.
+func (h *Handler) handleChatSlack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(h.chat.slackSigningSecret) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	body, err := readChatBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !h.verifySlackSignature(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	text := form.Get("text")
+	user := "slack:" + form.Get("team_id") + ":" + form.Get("user_id")
+	responseURL := form.Get("response_url")
+	if u, err := url.Parse(responseURL); err != nil || u.Scheme != "https" || (u.Hostname() != "slack.com" && !strings.HasSuffix(u.Hostname(), ".slack.com")) {
+		http.Error(w, "Invalid response_url", http.StatusBadRequest)
+		return
+	}
+
+	go func() {
+		reply := truncateChatReply(h.runChatCommand(user, text))
+		if err := h.postChatJSON(responseURL, map[string]any{
+			"response_type": "in_channel",
+			"text":          "```" + reply + "```",
+		}); err != nil {
+			logger.Warnf("Failed to post Slack reply: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	json.NewEncoder(w).Encode(map[string]any{
+		"response_type": "ephemeral",
+		"text":          "Running /lg " + text + " …",
+	})
+}
+
+// telegramUpdate is the part of a Telegram Bot API update the adapter uses.
+type telegramUpdate struct {
+	Message *struct {
+		Text string `json:"text"`
+		From struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// handleChatTelegram handles POST /api/chatops/telegram - a Telegram bot
+// webhook. Messages starting with /lg are executed and answered in the chat.
+func (h *Handler) handleChatTelegram(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.chat.telegramBotToken == "" || h.chat.telegramSecretToken == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.chat.telegramSecretToken)) != 1 {
+		http.Error(w, "Invalid secret token", http.StatusUnauthorized)
+		return
+	}
+	body, err := readChatBody(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var update telegramUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Always answer 200 so Telegram does not redeliver ignored updates.
+	w.WriteHeader(http.StatusOK)
+	if update.Message == nil || !strings.HasPrefix(update.Message.Text, "/lg") {
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	user := fmt.Sprintf("telegram:%d", update.Message.From.ID)
+	text := update.Message.Text
+	go func() {
+		reply := truncateChatReply(h.runChatCommand(user, text))
+		endpoint := "https://api.telegram.org/bot" + h.chat.telegramBotToken + "/sendMessage"
+		if err := h.postChatJSON(endpoint, map[string]any{
+			"chat_id":    chatID,
+			"text":       "<pre>" + html.EscapeString(reply) + "</pre>",
+			"parse_mode": "HTML",
+		}); err != nil {
+			logger.Warnf("Failed to send Telegram reply: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const (
+	clientCookieName   = "yals_client"
+	clientCookieMaxAge = 365 * 24 * time.Hour
+	// An IP gets at most clientIssuePerHour new ids an hour, so that clearing
+	// the cookie does not buy a fresh rate limit.
+	clientIssuePerHour     = 10
+	defaultClientIPFactor  = 5
+	clientIDLength         = 24
+	clientSignatureByteLen = 16
+)
+
+var clientIDPattern = regexp.MustCompile(`^[a-z0-9]{24}$`)
+
+// clientIDs are signed anonymous visitor ids. /api/exec limits a visitor
+// holding one on its own, with the visitor's IP as a wider ceiling, so
+// visitors behind one NAT do not share a single rate limit.
+type clientIDs struct {
+	enabled       bool
+	secret        []byte
+	ipFactor      int
+	maxConcurrent int
+	issued        *RateLimiter
+
+	mu sync.Mutex
+	// running counts each client's commands in flight. A client's entry goes
+	// when its last command ends, so the map only holds clients with a
+	// command running.
+	running map[string]int
+}
+
+// InitClientIDs enables signed anonymous client ids. Without a configured
+// secret a random one is used, and ids issued before a restart stop being
+// recognized.
+func (h *Handler) InitClientIDs(cfg *config.Config) {
+	// The execution limiter gets a key per client id, or per IP without one;
+	// forget those with nothing left in the window.
+	go pruneLimiter(h.ctx, h.rateLimiter)
+
+	c := cfg.Clients
+	if !c.Enabled {
+		return
+	}
+	h.clientIDs.enabled = true
+	h.clientIDs.secret = []byte(c.Secret)
+	if c.Secret == "" {
+		h.clientIDs.secret = make([]byte, 32)
+		if _, err := rand.Read(h.clientIDs.secret); err != nil {
+			logger.Errorf("Failed to generate client id secret, client ids disabled: %v", err)
+			h.clientIDs.enabled = false
+			return
+		}
+	}
+	h.clientIDs.ipFactor = defaultClientIPFactor
+	if c.IPFactor > 0 {
+		h.clientIDs.ipFactor = c.IPFactor
+	}
+	h.clientIDs.maxConcurrent = max(c.MaxConcurrent, 0)
+	h.clientIDs.issued = newWindowLimiter(h.ctx, clientIssuePerHour, time.Hour)
+	h.clientIDs.running = make(map[string]int)
+}
+
+func (h *Handler) signClientID(id string) string {
+	mac := hmac.New(sha256.New, h.clientIDs.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:clientSignatureByteLen])
+}
+
+// clientID returns the caller's verified client id, or "".
+func (h *Handler) clientID(r *http.Request) string {
+	if !h.clientIDs.enabled {
+		return ""
+	}
+	cookie, err := r.Cookie(clientCookieName)
+	if err != nil {
+		return ""
+	}
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !clientIDPattern.MatchString(id) || !hmac.Equal([]byte(sig), []byte(h.signClientID(id))) {
+		return ""
+	}
+	return id
+}
+
+// issueClientID gives a caller without a valid client id a new one, unless
+// its IP already received its hourly share.
+func (h *Handler) issueClientID(w http.ResponseWriter, r *http.Request) {
+	if !h.clientIDs.enabled || h.clientID(r) != "" {
+		return
+	}
+	if !h.clientIDs.issued.checkRateLimit(h.getRealIP(r)) {
+		return
+	}
+	id, err := GenerateRandomString(clientIDLength)
+	if err != nil {
+		logger.Errorf("Failed to generate client id: %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientCookieName,
+		Value:    id + "." + h.signClientID(id),
+		Path:     "/",
+		MaxAge:   int(clientCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkExecRateLimit applies the execution rate limit. A caller with a client
+// id has its own limit, and its IP a limit ipFactor times as high; anyone
+// else is limited per IP. It returns the wait before the next attempt when
+// the limit is reached.
+func (h *Handler) checkExecRateLimit(id, clientIP string) (bool, time.Duration) {
+	if id == "" {
+		if !h.rateLimiter.checkRateLimit(clientIP) {
+			return false, h.rateLimiter.getRemainingTime(clientIP)
+		}
+		return true, 0
+	}
+	// The client's own limit is checked first: requests it refuses must not
+	// eat into the limit its IP shares with others.
+	if key := "client:" + id; !h.rateLimiter.checkRateLimit(key) {
+		return false, h.rateLimiter.getRemainingTime(key)
+	}
+	if key := "ip:" + clientIP; !h.rateLimiter.allow(key, h.clientIDs.ipFactor) {
+		return false, h.rateLimiter.getRemainingTime(key)
+	}
+	return true, 0
+}
+
+// acquireClientSlot counts a running command of client id against
+// clients.max_concurrent; on true the caller must releaseClientSlot.
+func (h *Handler) acquireClientSlot(id string) bool {
+	if id == "" || h.clientIDs.maxConcurrent == 0 {
+		return true
+	}
+	h.clientIDs.mu.Lock()
+	defer h.clientIDs.mu.Unlock()
+	if h.clientIDs.running[id] >= h.clientIDs.maxConcurrent {
+		return false
+	}
+	h.clientIDs.running[id]++
+	return true
+}
+
+func (h *Handler) releaseClientSlot(id string) {
+	if id == "" || h.clientIDs.maxConcurrent == 0 {
+		return
+	}
+	h.clientIDs.mu.Lock()
+	defer h.clientIDs.mu.Unlock()
+	if h.clientIDs.running[id]--; h.clientIDs.running[id] <= 0 {
+		delete(h.clientIDs.running, id)
+	}
+}
@@ -0,0 +1,455 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// clusterMaxSkew bounds the age of a signed peer request.
+	clusterMaxSkew = time.Minute
+	// clusterMaxBody caps a forwarded exec or stop request.
+	clusterMaxBody = 64 << 10
+)
+
+// clusterPeer is another replica, reached over HTTPS with the same dual trust
+// the agent uses: the built-in certificate or a CA-valid one.
+type clusterPeer struct {
+	baseURL string
+	client  *http.Client
+}
+
+// cluster forwards commands between replicas. Each agent streams to one
+// replica; a replica asked to run a command on an agent it does not hold
+// forwards the request to the peer that does, and relays that peer's SSE
+// stream back to the client unchanged.
+type cluster struct {
+	peers  []clusterPeer
+	secret []byte
+
+	// owners remembers which peer last served each agent, so subsequent
+	// commands go there first instead of probing every peer.
+	mu     sync.Mutex
+	owners map[string]int
+}
+
+// clusterExecRequest is the body of /api/cluster/exec: the client's request
+// plus the identity the forwarding replica already checked.
+type clusterExecRequest struct {
+	ExecRequest
+	SessionID     string         `json:"session_id"`
+	ClientIP      string         `json:"client_ip"`
+	Authenticated bool           `json:"authenticated"`
+	Priority      agent.Priority `json:"priority,omitempty"`
+	Owner         string         `json:"owner,omitempty"`
+	Display       displayPrefs   `json:"display"`
+	// APIKey names the partner key the peer meters the run against.
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// InitCluster configures the peer replicas. Peers without a shared secret are
+// ignored, since the internal endpoints would then accept anyone.
+func (h *Handler) InitCluster(cfg *config.Config) {
+	if len(cfg.Cluster.Peers) == 0 {
+		return
+	}
+	if cfg.Cluster.Secret == "" {
+		logger.Warnf("Cluster peers configured without a secret; forwarding disabled")
+		return
+	}
+
+	h.cluster = cluster{secret: []byte(cfg.Cluster.Secret), owners: make(map[string]int)}
+	for _, raw := range cfg.Cluster.Peers {
+		u, err := url.Parse(strings.TrimRight(raw, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.Warnf("Ignoring invalid cluster peer %q", raw)
+			continue
+		}
+		tlsConfig, err := yalstls.ClientConfig(u.Hostname())
+		if err != nil {
+			logger.Warnf("Ignoring cluster peer %q: %v", raw, err)
+			continue
+		}
+		h.cluster.peers = append(h.cluster.peers, clusterPeer{
+			baseURL: u.String(),
+			client: &http.Client{Transport: &http.Transport{
+				TLSClientConfig:       tlsConfig,
+				ForceAttemptHTTP2:     true,
+				ResponseHeaderTimeout: 10 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			}},
+		})
+	}
+	logger.Infof("Cluster forwarding enabled with %d peer(s)", len(h.cluster.peers))
+}
+
+// peerOrder lists peer indexes, the agent's last known owner first.
+func (c *cluster) peerOrder(agentName string) []int {
+	c.mu.Lock()
+	owner, known := c.owners[agentName]
+	c.mu.Unlock()
+
+	order := make([]int, 0, len(c.peers))
+	if known {
+		order = append(order, owner)
+	}
+	for i := range c.peers {
+		if !known || i != owner {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (c *cluster) setOwner(agentName string, peer int) {
+	c.mu.Lock()
+	c.owners[agentName] = peer
+	c.mu.Unlock()
+}
+
+// newRequest builds a signed POST to a peer's internal endpoint. The
+// signature is the same HMAC scheme as execution receipts.
+func (c *cluster) newRequest(ctx context.Context, peer clusterPeer, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-YALS-Timestamp", timestamp)
+	req.Header.Set("X-YALS-Signature", "sha256="+signReceipt(c.secret, timestamp, body))
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, nil
+}
+
+// verify checks a peer request's signature and freshness.
+func (c *cluster) verify(r *http.Request, body []byte) bool {
+	if len(c.secret) == 0 {
+		return false
+	}
+	timestamp := r.Header.Get("X-YALS-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > clusterMaxSkew || age < -clusterMaxSkew {
+		return false
+	}
+	expected := "sha256=" + signReceipt(c.secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-YALS-Signature")))
+}
+
+// readClusterRequest reads and authenticates an internal request body.
+func (h *Handler) readClusterRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, clusterMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if !h.cluster.verify(r, body) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// forwardExec runs call on the peer holding the agent, relaying its stream to
+// w. It returns false when no peer has the agent connected, leaving w
+// untouched so the caller can report the agent as offline.
+func (h *Handler) forwardExec(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, call execCall) bool {
+	if len(h.cluster.peers) == 0 {
+		return false
+	}
+
+	// The forwarding replica keeps the receipt: the peer only runs the command.
+	forwarded := call.req
+	forwarded.CallbackURL = ""
+	exec := clusterExecRequest{
+		ExecRequest:   forwarded,
+		SessionID:     call.sessionID,
+		ClientIP:      call.clientIP,
+		Authenticated: call.authenticated,
+		Priority:      call.priority,
+		Owner:         call.owner,
+		Display:       call.display,
+	}
+	if call.key != nil {
+		exec.APIKey = call.key.name
+	}
+	body, err := json.Marshal(exec)
+	if err != nil {
+		logger.Errorf("Failed to encode forwarded command: %v", err)
+		return false
+	}
+
+	ctx, span := tracing.Tracer(ctx).Start(ctx, "cluster.forward", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	for _, i := range h.cluster.peerOrder(call.req.Agent) {
+		peer := h.cluster.peers[i]
+		req, err := h.cluster.newRequest(ctx, peer, "/api/cluster/exec", body)
+		if err != nil {
+			logger.Warnf("Failed to build request for peer %s: %v", peer.baseURL, err)
+			continue
+		}
+		resp, err := peer.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return true
+			}
+			logger.Warnf("Cluster peer %s unreachable: %v", peer.baseURL, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				logger.Warnf("Cluster peer %s refused forwarded command: status %d", peer.baseURL, resp.StatusCode)
+			}
+			continue
+		}
+
+		h.cluster.setOwner(call.req.Agent, i)
+		span.SetAttributes(attribute.String("yals.peer", peer.baseURL))
+		h.relayPeerStream(ctx, w, flusher, call, i, resp)
+		return true
+	}
+	return false
+}
+
+// relayPeerStream copies a peer's SSE stream to the client. The command is
+// registered locally too, so /api/stop on this replica reaches the peer.
+func (h *Handler) relayPeerStream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, call execCall, peer int, resp *http.Response) {
+	defer resp.Body.Close()
+	req := call.req
+	// The peer builds its command id from the validated target (see runExec),
+	// which may differ from the client's, e.g. for an internationalized
+	// domain; a stop forwarded to it has to name the same id.
+	if target, err := h.validateTarget(req.Agent, req.Command, req.Target); err == nil {
+		req.Target = target.Value
+	}
+	commandID := h.generateCommandID(req.Command, req.Target, req.Agent, call.sessionID)
+	logger.Infof("Client [%s] executing command: %s (via %s)", call.clientIP, commandID, h.cluster.peers[peer].baseURL)
+
+	stopChan := make(chan bool, 1)
+	h.setActiveCommand(commandID, &activeCommand{
+		stop:     stopChan,
+		agent:    req.Agent,
+		command:  req.Command,
+		target:   req.Target,
+		clientIP: call.clientIP,
+		started:  time.Now(),
+	})
+	defer h.removeActiveCommand(commandID)
+
+	// A stopped command's stream ends without a completion message, as it
+	// does locally; only an unrequested end is reported as an error.
+	var stopped atomic.Bool
+	relayDone := make(chan struct{})
+	defer close(relayDone)
+	go func() {
+		select {
+		case <-stopChan:
+			stopped.Store(true)
+			h.stopOnPeer(peer, commandID)
+		case <-relayDone:
+		}
+	}()
+
+	var receipt *receiptRecorder
+	if req.CallbackURL != "" {
+		receipt = newReceiptRecorder(commandID, req)
+		defer func() { go h.deliverReceipt(req.CallbackURL, receipt.finish()) }()
+	}
+
+	// A route the peer stored is stored here too under the same id, since
+	// the client fetches its export from this replica.
+	var lastRoute json.RawMessage
+	completed := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		payload, isData := strings.CutPrefix(line, "data: ")
+		if !isData {
+			continue
+		}
+		var msg map[string]any
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			continue
+		}
+		switch msg["type"] {
+		case "data":
+			if data, err := json.Marshal(msg["data"]); err == nil && isRouteResult(data) {
+				lastRoute = data
+			}
+		case "complete":
+			completed = true
+			if id, _ := msg["result_id"].(string); lastRoute != nil && resultIDPattern.MatchString(id) {
+				// The copy stored here is the one this replica verifies,
+				// so hand out its signature rather than the peer's.
+				if _, signature := h.saveRouteResult(id, req, call.owner, lastRoute); signature != nil {
+					msg["signature"] = signature
+					if relayed, err := json.Marshal(msg); err == nil {
+						payload = string(relayed)
+					}
+				}
+			}
+		}
+		if receipt != nil {
+			recordRelayedMessage(receipt, msg)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		flusher.Flush()
+	}
+
+	if !completed && !stopped.Load() && ctx.Err() == nil {
+		err := scanner.Err()
+		if err == nil {
+			err = errors.New("stream ended")
+		}
+		if receipt != nil {
+			receipt.fail("", "Lost connection to the replica running the command")
+		}
+		logger.Warnf("Forwarded command %s lost its peer stream: %v", commandID, err)
+		h.sendSSEError(w, flusher, "Lost connection to the replica running the command")
+	}
+}
+
+// recordRelayedMessage feeds one relayed SSE message into a receipt.
+func recordRelayedMessage(receipt *receiptRecorder, msg map[string]any) {
+	str := func(key string) string {
+		v, _ := msg[key].(string)
+		return v
+	}
+	switch msg["type"] {
+	case "output":
+		receipt.record(str("output"), false, false, false)
+	case "error":
+		receipt.record(str("error"), true, false, false)
+	case "data":
+		if data, err := json.Marshal(msg["data"]); err == nil {
+			receipt.recordData(data)
+		}
+	case "complete":
+		if success, _ := msg["success"].(bool); success {
+			receipt.record("", false, true, false)
+		} else {
+			receipt.fail(str("code"), str("error"))
+		}
+	}
+}
+
+// stopOnPeer asks one peer to stop a command it runs.
+func (h *Handler) stopOnPeer(peer int, commandID string) {
+	body, err := json.Marshal(StopRequest{CommandID: commandID})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := h.cluster.peers[peer]
+	req, err := h.cluster.newRequest(ctx, p, "/api/cluster/stop", body)
+	if err != nil {
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logger.Warnf("Failed to forward stop of %s to %s: %v", commandID, p.baseURL, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// forwardStop asks every peer to stop a command this replica does not run;
+// the client's stop request may land on any replica.
+func (h *Handler) forwardStop(commandID string) {
+	for i := range h.cluster.peers {
+		go h.stopOnPeer(i, commandID)
+	}
+}
+
+// handleClusterExec handles POST /api/cluster/exec - runs a command forwarded
+// by a peer replica. It answers 404 when the agent is not connected here, so
+// the peer can try the next replica. It never forwards again.
+func (h *Handler) handleClusterExec(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readClusterRequest(w, r)
+	if !ok {
+		return
+	}
+	var req clusterExecRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, online := h.localAgentState(req.Agent); !online {
+		http.Error(w, "Agent is not connected to this replica", http.StatusNotFound)
+		return
+	}
+
+	// The peer signed the request, so its trace context is trusted.
+	ctx := tracing.ExtractHTTP(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer(ctx).Start(ctx, "POST /api/cluster/exec", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("yals.agent", req.Agent), attribute.String("yals.command", req.Command)))
+	defer span.End()
+
+	flusher, ok := h.startSSE(w)
+	if !ok {
+		return
+	}
+	h.runExec(ctx, w, flusher, execCall{
+		req:           req.ExecRequest,
+		sessionID:     req.SessionID,
+		clientIP:      req.ClientIP,
+		authenticated: req.Authenticated,
+		priority:      req.Priority,
+		key:           h.apiKeyByName(req.APIKey),
+		owner:         req.Owner,
+		display:       req.Display,
+	}, false)
+}
+
+// handleClusterStop handles POST /api/cluster/stop - stops a command running
+// on this replica on behalf of a peer.
+func (h *Handler) handleClusterStop(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readClusterRequest(w, r)
+	if !ok {
+		return
+	}
+	var req StopRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.CommandID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	stopped := h.stopActiveCommand(req.CommandID)
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	json.NewEncoder(w).Encode(map[string]any{"success": stopped})
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+// runRegistry holds the runs in flight by agent, command, target and IP
+// version. A request identical to a running one subscribes to it instead of
+// executing the command a second time, which keeps an incident that sends
+// everyone to the same popular target from queueing the same traceroute
+// dozens of times on the agent.
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*sharedRun
+}
+
+// sharedRun is one execution and the clients following it. Its events are
+// kept so that a client joining late replays the run from the start.
+type sharedRun struct {
+	key string
+
+	mu sync.Mutex
+	// events in the order they were published; nil stands for an output
+	// event. Outputs are cumulative, so only the latest one is kept and a
+	// client skips to it.
+	events  []map[string]any
+	output  string
+	done    bool
+	changed chan struct{}
+	clients int
+	// stop is the run's stop channel, closed when its last client leaves.
+	stop chan bool
+	// outcome is set when the run succeeded; outcomeEvent marks where in
+	// events each client renders it.
+	outcome *runOutcome
+
+	// received is when the server received the agent message being
+	// published; zero for events of the server's own. receivedAt and
+	// outputReceived keep it per event for the output latency (see
+	// latency.go).
+	received       time.Time
+	receivedAt     []time.Time
+	outputReceived time.Time
+}
+
+// outcomeEvent is the type of the event that stands for a run's outcome. It
+// is never sent as such.
+const outcomeEvent = "\x00outcome"
+
+// runOutcome is what the last events of a successful run are made of. Each
+// client renders them itself (see sendRunOutcome), so that the footer and
+// summary follow its own display preferences and the route is stored among
+// its own results.
+type runOutcome struct {
+	req    ExecRequest
+	target validator.Target
+	// output is the last output, without the footer.
+	output string
+	asPath []ASPathSegment
+	iperf3 *proto.Iperf3Summary
+	route  json.RawMessage
+}
+
+// runKey identifies the runs a request may share. Requests with a
+// callback_url get a receipt of their own run and never share one.
+func runKey(req ExecRequest) string {
+	if req.CallbackURL != "" {
+		return ""
+	}
+	ipVersion := req.IPVersion
+	if ipVersion == "" {
+		ipVersion = "auto"
+	}
+	return req.Agent + "\x00" + req.Command + "\x00" + req.Target + "\x00" + ipVersion + "\x00" + req.View
+}
+
+// join subscribes a client to the run in flight for key, or registers a new
+// one. leader is true when the caller got a new run and has to execute it.
+// An empty key always gets a new, unregistered run.
+func (r *runRegistry) join(key string) (run *sharedRun, leader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key != "" {
+		if run, ok := r.runs[key]; ok {
+			run.mu.Lock()
+			run.clients++
+			run.mu.Unlock()
+			return run, false
+		}
+	}
+	run = &sharedRun{key: key, changed: make(chan struct{}), clients: 1, stop: make(chan bool, 1)}
+	if key != "" {
+		if r.runs == nil {
+			r.runs = make(map[string]*sharedRun)
+		}
+		r.runs[key] = run
+	}
+	return run, true
+}
+
+// release unregisters run so that later requests start a run of their own.
+// It is called before the final event is published, when joining would only
+// replay a finished result.
+func (r *runRegistry) release(run *sharedRun) {
+	r.mu.Lock()
+	if run.key != "" && r.runs[run.key] == run {
+		delete(r.runs, run.key)
+	}
+	r.mu.Unlock()
+}
+
+// leave unsubscribes a client that stopped or went away. The last client to
+// leave stops the run; leave then reports true.
+func (r *runRegistry) leave(run *sharedRun) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.clients--
+	if run.clients > 0 || run.done {
+		return false
+	}
+	if run.key != "" && r.runs[run.key] == run {
+		delete(r.runs, run.key)
+	}
+	close(run.stop)
+	return true
+}
+
+// receiving sets the receipt time of the agent message whose events are
+// published next; a zero time marks the following events as the server's.
+func (run *sharedRun) receiving(at time.Time) {
+	run.mu.Lock()
+	run.received = at
+	run.mu.Unlock()
+}
+
+// publish hands an SSE event to every client of the run.
+func (run *sharedRun) publish(event map[string]any) {
+	run.mu.Lock()
+	if event["type"] == "output" {
+		run.output, _ = event["output"].(string)
+		run.outputReceived = run.received
+		event = nil
+	}
+	run.events = append(run.events, event)
+	run.receivedAt = append(run.receivedAt, run.received)
+	close(run.changed)
+	run.changed = make(chan struct{})
+	run.mu.Unlock()
+}
+
+// succeed publishes the outcome of a successful run.
+func (run *sharedRun) succeed(outcome *runOutcome) {
+	run.mu.Lock()
+	run.outcome = outcome
+	run.mu.Unlock()
+	run.publish(map[string]any{"type": outcomeEvent})
+}
+
+// finish marks the run over; its clients return once they sent every event.
+func (run *sharedRun) finish() {
+	run.mu.Lock()
+	run.done = true
+	close(run.changed)
+	run.changed = make(chan struct{})
+	run.mu.Unlock()
+}
+
+// followRun streams run to one client until the run is over. A stop through
+// stopChan (see /api/stop) only unsubscribes the client while others still
+// follow the run; the last one stops it and sees it end as stopped. The
+// events of agent messages received after the client joined count towards
+// the output latency once flushed; a late joiner's replay does not. call is
+// the client's request, which the run's outcome is rendered for.
+func (h *Handler) followRun(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, run *sharedRun, call execCall, stopChan <-chan bool) {
+	joined := time.Now()
+	next := 0
+	for {
+		run.mu.Lock()
+		events := run.events[next:]
+		receivedAt := run.receivedAt[next:]
+		next = len(run.events)
+		output, outputReceived, over, changed := run.output, run.outputReceived, run.done, run.changed
+		outcome := run.outcome
+		run.mu.Unlock()
+
+		last := -1
+		for i, event := range events {
+			if event == nil {
+				last = i
+			}
+		}
+		for i, event := range events {
+			received := receivedAt[i]
+			switch {
+			case i == last:
+				received = outputReceived
+				h.sendSSEMessage(w, flusher, map[string]any{"type": "output", "output": output})
+			case event != nil && event["type"] == outcomeEvent:
+				h.sendRunOutcome(w, flusher, outcome, call)
+			case event != nil:
+				h.sendSSEMessage(w, flusher, event)
+			default:
+				continue
+			}
+			if received.After(joined) {
+				h.outputLatency.observe(time.Since(received))
+			}
+		}
+		if over {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-stopChan:
+			if !h.runs.leave(run) {
+				return
+			}
+			stopChan = nil
+		case <-ctx.Done():
+			h.runs.leave(run)
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// ipVersionDual asks for a dual-stack run: a command against a domain target
+// runs once over IPv4 and once over IPv6, and the output has a labeled
+// section per family. For any other target it runs once as "auto".
+const ipVersionDual = "dual"
+
+// dualStackFamilies are the runs of a dual-stack execution, in output order.
+var dualStackFamilies = []struct{ version, label string }{
+	{"ipv4", "IPv4"},
+	{"ipv6", "IPv6"},
+}
+
+// InitDualStack chooses whether the two families of a dual-stack run execute
+// one after the other (the default) or at once.
+func (h *Handler) InitDualStack(cfg *config.Config) {
+	h.dualStackParallel = cfg.Execution.DualStackParallel
+}
+
+// executeDualStack has the signature of ExecuteCommandStreamingWithData and
+// stands in for it on dual-stack runs. Each family runs as its own command
+// (commandID plus the family) under the shared stop channel, one after the
+// other or, with execution.dual_stack_parallel, at once. Every output update
+// carries the text of all sections so far. A family the target has no
+// address for, or whose run fails, gets the reason in its section; the run
+// fails only when every family did.
+func (h *Handler) executeDualStack(ctx context.Context, agentName, command, commandID, _ string, stopChan <-chan bool, callback agent.StreamingOutputCallbackWithStop, onData agent.StructuredResultCallback) error {
+	ctx = agent.WithRequiredFamily(ctx)
+
+	// mu serializes the callbacks of parallel runs, which write to the same
+	// response.
+	var mu sync.Mutex
+	sections := make([]string, len(dualStackFamilies))
+	started := make([]bool, len(dualStackFamilies))
+	failed := make([]bool, len(dualStackFamilies))
+	stopped := false
+
+	combined := func() string {
+		var b strings.Builder
+		for i, f := range dualStackFamilies {
+			if !started[i] {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString("\n\n")
+			}
+			b.WriteString("=== " + f.label + " ===\n")
+			b.WriteString(strings.TrimRight(sections[i], "\n"))
+		}
+		return b.String()
+	}
+
+	run := func(i int) error {
+		f := dualStackFamilies[i]
+		mu.Lock()
+		started[i] = true
+		mu.Unlock()
+
+		err := h.agentManager.ExecuteCommandStreamingWithData(ctx, agentName, command, commandID+"-"+f.version, f.version, stopChan, func(output string, isError bool, isComplete bool, isStopped bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case isStopped:
+				stopped = true
+			case isComplete && isError:
+				failed[i] = true
+				sections[i] = strings.TrimRight(sections[i], "\n") + "\nError: " + output
+			case isComplete:
+				if output != "" {
+					sections[i] = output
+				}
+			case isError:
+				callback("["+f.label+"] "+output, true, false, false)
+			default:
+				sections[i] = output
+				callback(combined(), false, false, false)
+			}
+		}, func(data json.RawMessage) {
+			mu.Lock()
+			defer mu.Unlock()
+			if onData != nil {
+				onData(data)
+			}
+		})
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		failed[i] = true
+		var rejection *agent.RejectionError
+		if errors.As(err, &rejection) {
+			sections[i] = rejection.Reason
+		} else {
+			sections[i] = "Error: " + err.Error()
+		}
+		callback(combined(), false, false, false)
+		return nil
+	}
+
+	if h.dualStackParallel {
+		var wg sync.WaitGroup
+		errs := make([]error, len(dualStackFamilies))
+		for i := range dualStackFamilies {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = run(i)
+			}(i)
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+	} else {
+		for i := range dualStackFamilies {
+			if err := run(i); err != nil {
+				return err
+			}
+			if stopped {
+				break
+			}
+		}
+	}
+
+	if stopped {
+		callback("", false, false, true)
+		return nil
+	}
+	allFailed := true
+	for _, f := range failed {
+		allFailed = allFailed && f
+	}
+	callback(combined(), allFailed, true, false)
+	return nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// advertisedEndpoint is one server of a multi-region deployment
+// (endpoints).
+type advertisedEndpoint struct {
+	url    string
+	host   string
+	region string
+	point  geoPoint
+}
+
+// endpointInfo is one server in the /api/endpoints response.
+type endpointInfo struct {
+	URL    string `json:"url"`
+	Region string `json:"region,omitempty"`
+	// Self marks the server that answered.
+	Self bool `json:"self,omitempty"`
+	// DistanceKm estimates how far the server is from the caller; it is
+	// left out when either cannot be located.
+	DistanceKm *int `json:"distance_km,omitempty"`
+	// ProbeURL is a small uncached resource the frontend can time to
+	// measure its latency to the server.
+	ProbeURL string `json:"probe_url"`
+}
+
+// InitEndpoints loads the servers advertised by /api/endpoints.
+func (h *Handler) InitEndpoints(cfg *config.Config) {
+	for _, e := range cfg.Endpoints {
+		raw := strings.TrimRight(strings.TrimSpace(e.URL), "/")
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.Warnf("Ignoring invalid endpoint %q", e.URL)
+			continue
+		}
+		endpoint := advertisedEndpoint{url: u.String(), host: strings.ToLower(u.Host), region: e.Region}
+		if e.Latitude != 0 || e.Longitude != 0 {
+			endpoint.point = geoPoint{lat: e.Latitude, lng: e.Longitude, located: true}
+		}
+		h.endpoints = append(h.endpoints, endpoint)
+	}
+	if len(h.endpoints) > 0 {
+		logger.Infof("Advertising %d server endpoint(s)", len(h.endpoints))
+	}
+}
+
+// handleEndpoints handles GET /api/endpoints - the servers of the deployment,
+// nearest to the caller first when it can be geolocated, so that a frontend
+// can connect to the closest one or time each probe_url itself.
+func (h *Handler) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var caller geoPoint
+	if h.geo != nil {
+		caller, _ = h.geo.lookup(h.getRealIP(r))
+	}
+	type ranked struct {
+		info     endpointInfo
+		distance float64
+	}
+	list := make([]ranked, 0, len(h.endpoints))
+	for _, e := range h.endpoints {
+		entry := ranked{
+			info: endpointInfo{
+				URL:      e.url,
+				Region:   e.region,
+				Self:     strings.EqualFold(r.Host, e.host),
+				ProbeURL: e.url + "/api/version",
+			},
+			distance: math.Inf(1),
+		}
+		if caller.located && e.point.located {
+			entry.distance = greatCircleKm(caller, e.point)
+			km := int(math.Round(entry.distance))
+			entry.info.DistanceKm = &km
+		}
+		list = append(list, entry)
+	}
+	// Unlocated servers keep their configured order, after the located ones.
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].distance < list[j].distance
+	})
+	sorted := make([]endpointInfo, len(list))
+	for i, entry := range list {
+		sorted[i] = entry.info
+	}
+
+	response := map[string]any{"endpoints": sorted}
+	if len(sorted) > 0 && sorted[0].DistanceKm != nil {
+		response["nearest"] = sorted[0].URL
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(response)
+}
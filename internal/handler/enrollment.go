@@ -0,0 +1,471 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	enrollmentDefaultCodeTTL = 24 * time.Hour
+	enrollmentCodeLength     = 24
+	enrollmentIDLength       = 12
+	// enrollmentMinKeyLength is the shortest key an agent may bind a code
+	// to.
+	enrollmentMinKeyLength = 16
+	// enrollmentRetryAfter is how often a pending agent asks again.
+	enrollmentRetryAfter = 15
+	// enrollmentMaxWebhookAnswer caps the verification webhook's answer.
+	enrollmentMaxWebhookAnswer = 64 << 10
+)
+
+// Who decided an enrollment.
+const (
+	enrollmentByWebhook  = "webhook"
+	enrollmentByOperator = "operator"
+)
+
+var errEnrollmentNotPending = errors.New("enrollment is not pending")
+
+// enrollment lets agents join with one-time codes (see
+// config.Config.Enrollment). Codes and requests live in the store; the
+// agent polls Enroll until its request is decided.
+type enrollment struct {
+	enabled    bool
+	webhookURL string
+	codeTTL    time.Duration
+
+	// mu makes creating an approved agent and recording the decision one
+	// step, so that an enrollment never creates two agents.
+	mu sync.Mutex
+}
+
+// enrollmentVerdict is the verification webhook's answer. Name and Group,
+// when set, override those of the agent to create.
+type enrollmentVerdict struct {
+	Approve bool   `json:"approve"`
+	Reason  string `json:"reason"`
+	Name    string `json:"name"`
+	Group   string `json:"group"`
+}
+
+// InitEnrollment enables enrollment with codes when enrollment.enabled is
+// set.
+func (h *Handler) InitEnrollment(cfg *config.Config) {
+	e := &h.enrollment
+	e.enabled = cfg.Enrollment.Enabled
+	e.webhookURL = strings.TrimSpace(cfg.Enrollment.WebhookURL)
+	e.codeTTL = enrollmentDefaultCodeTTL
+	if hours := cfg.Enrollment.CodeTTLHours; hours > 0 {
+		e.codeTTL = time.Duration(hours) * time.Hour
+	}
+	if !e.enabled {
+		return
+	}
+	if e.webhookURL != "" {
+		logger.Infof("Agent enrollment enabled, verified by %s", e.webhookURL)
+	} else {
+		logger.Infof("Agent enrollment enabled, approved on the control panel")
+	}
+}
+
+// hashEnrollmentSecret returns the hex SHA-256 under which enrollment codes
+// and agent keys are stored.
+func hashEnrollmentSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Enroll implements the gRPC Enroll method: an agent without a UUID and token
+// exchanges an enrollment code for them. The first call binds the code to
+// the agent's key and starts the verification; later calls with the same
+// key report the decision, and the identity once approved.
+func (h *Handler) Enroll(ctx context.Context, req *proto.EnrollRequest) (*proto.EnrollResponse, error) {
+	if !h.enrollment.enabled {
+		return nil, status.Errorf(codes.Unimplemented, "agent enrollment is disabled on this server")
+	}
+	if !h.allowAgentConnect(ctx) {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many connection attempts, retry later")
+	}
+	if req == nil || strings.TrimSpace(req.Code) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing enrollment code")
+	}
+	if len(req.Key) < enrollmentMinKeyLength {
+		return nil, status.Errorf(codes.InvalidArgument, "enrollment key must have at least %d characters", enrollmentMinKeyLength)
+	}
+	remote, _ := peerIP(ctx)
+
+	e, err := h.store.GetEnrollmentByCode(hashEnrollmentSecret(strings.TrimSpace(req.Code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Warnf("Enrollment attempt from %s with an unknown code", remote)
+		return nil, status.Errorf(codes.PermissionDenied, "invalid enrollment code")
+	}
+	if err != nil {
+		logger.Errorf("Failed to look up enrollment code: %v", err)
+		return nil, status.Errorf(codes.Internal, "internal server error")
+	}
+	keyHash := hashEnrollmentSecret(req.Key)
+
+	if e.Status == serverstore.EnrollmentOpen {
+		requested := strings.TrimSpace(req.Name)
+		if requested == "" {
+			requested = strings.TrimSpace(req.Hostname)
+		}
+		now := time.Now()
+		claimed, err := h.store.ClaimEnrollment(e.ID, keyHash, requested, strings.TrimSpace(req.Hostname), remote, now)
+		if err != nil {
+			logger.Errorf("Failed to claim enrollment %s: %v", e.ID, err)
+			return nil, status.Errorf(codes.Internal, "internal server error")
+		}
+		if !claimed {
+			if !now.Before(e.ExpiresAt) {
+				logger.Warnf("Enrollment attempt from %s with expired code %s", remote, e.ID)
+				return nil, status.Errorf(codes.PermissionDenied, "enrollment code expired")
+			}
+			// Another request used the code first.
+			if e, err = h.store.GetEnrollment(e.ID); err != nil {
+				return nil, status.Errorf(codes.Internal, "internal server error")
+			}
+		} else {
+			e.Status, e.KeyHash, e.RequestedName, e.Hostname, e.RemoteIP, e.RequestedAt = serverstore.EnrollmentPending, keyHash, requested, strings.TrimSpace(req.Hostname), remote, now
+			logger.Infof("Agent %q (%s) used enrollment code %s", requested, remote, e.ID)
+			// The webhook answers within callbackTimeout, so the agent
+			// learns its verdict from this call.
+			h.verifyEnrollment(*e)
+			if e, err = h.store.GetEnrollment(e.ID); err != nil {
+				return nil, status.Errorf(codes.Internal, "internal server error")
+			}
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(e.KeyHash), []byte(keyHash)) != 1 {
+		logger.Warnf("Enrollment attempt from %s with code %s, which another agent used", remote, e.ID)
+		return nil, status.Errorf(codes.PermissionDenied, "enrollment code already used")
+	}
+	switch e.Status {
+	case serverstore.EnrollmentPending:
+		return &proto.EnrollResponse{
+			Status:     proto.EnrollPending,
+			Message:    "waiting for approval",
+			RetryAfter: enrollmentRetryAfter,
+		}, nil
+	case serverstore.EnrollmentApproved:
+		record, err := h.store.GetAgentByUUID(e.AgentUUID)
+		if err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "the enrolled agent was deleted")
+		}
+		logger.Infof("Issued the token of agent %s (%s) to enrollment %s", record.Name, record.UUID, e.ID)
+		return &proto.EnrollResponse{
+			Status:  proto.EnrollApproved,
+			Message: "Enrolled as " + record.Name,
+			UUID:    record.UUID,
+			Token:   record.Token,
+		}, nil
+	default:
+		message := "enrollment was denied"
+		if e.Reason != "" {
+			message += ": " + e.Reason
+		}
+		return nil, status.Error(codes.PermissionDenied, message)
+	}
+}
+
+// verifyEnrollment asks the verification webhook about a new request, or
+// an operator when there is none or it gives no answer.
+func (h *Handler) verifyEnrollment(e serverstore.Enrollment) {
+	if url := h.enrollment.webhookURL; url != "" {
+		verdict, err := h.askEnrollmentWebhook(url, e)
+		if err == nil {
+			decision := "deny"
+			if verdict.Approve {
+				decision = "approve"
+			}
+			if _, err := h.decideEnrollment(e.ID, verdict.Approve, verdict.Name, verdict.Group, verdict.Reason, enrollmentByWebhook); err != nil {
+				logger.Errorf("Failed to %s enrollment %s as the webhook answered: %v; an operator must decide", decision, e.ID, err)
+			} else {
+				return
+			}
+		} else {
+			logger.Warnf("Enrollment webhook gave no answer for %s: %v; an operator must decide", e.ID, err)
+		}
+	}
+	h.agentManager.Events().Publish(events.Event{
+		Type:   events.AgentEnrollmentRequested,
+		Agent:  e.RequestedName,
+		ID:     e.ID,
+		Detail: "from " + e.RemoteIP + " with code " + strconv.Quote(e.Label),
+	})
+}
+
+// askEnrollmentWebhook POSTs a request to the verification webhook, signed
+// like callbacks, and returns its answer. Only a 2xx answer with a JSON
+// verdict counts.
+func (h *Handler) askEnrollmentWebhook(url string, e serverstore.Enrollment) (*enrollmentVerdict, error) {
+	body, err := json.Marshal(map[string]any{
+		"text":           fmt.Sprintf("[YALS] Agent %q asks to enroll from %s", e.RequestedName, e.RemoteIP),
+		"type":           "agent_enrollment",
+		"id":             e.ID,
+		"label":          e.Label,
+		"name":           e.Name,
+		"group":          e.Group,
+		"requested_name": e.RequestedName,
+		"hostname":       e.Hostname,
+		"remote_ip":      e.RemoteIP,
+		"time":           e.RequestedAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "YALS-Callback")
+	req.Header.Set("X-YALS-Timestamp", timestamp)
+	if len(h.callbackSecret) > 0 {
+		req.Header.Set("X-YALS-Signature", "sha256="+signReceipt(h.callbackSecret, timestamp, body))
+	}
+
+	resp, err := h.callbackClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var verdict enrollmentVerdict
+	if err := json.NewDecoder(io.LimitReader(resp.Body, enrollmentMaxWebhookAnswer)).Decode(&verdict); err != nil {
+		return nil, fmt.Errorf("invalid answer: %w", err)
+	}
+	return &verdict, nil
+}
+
+// decideEnrollment approves or denies the pending enrollment id. Approving
+// creates its agent, named name or else as the code or the agent asked for,
+// in group or else the code's. It returns the updated enrollment.
+func (h *Handler) decideEnrollment(id string, approve bool, name, group, reason, by string) (*serverstore.Enrollment, error) {
+	h.enrollment.mu.Lock()
+	defer h.enrollment.mu.Unlock()
+
+	e, err := h.store.GetEnrollment(id)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != serverstore.EnrollmentPending {
+		return nil, errEnrollmentNotPending
+	}
+	now := time.Now()
+	if !approve {
+		if _, err := h.store.DecideEnrollment(id, serverstore.EnrollmentDenied, "", by, strings.TrimSpace(reason), now); err != nil {
+			return nil, err
+		}
+		logger.Infof("Enrollment %s of %q (%s) denied by %s", id, e.RequestedName, e.RemoteIP, by)
+		return h.store.GetEnrollment(id)
+	}
+
+	name = firstNonEmpty(name, e.Name, e.RequestedName)
+	group = firstNonEmpty(group, e.Group)
+	if name == "" {
+		return nil, errors.New("the agent needs a name")
+	}
+	if _, err := h.store.GetAgentByName(name); err == nil {
+		return nil, fmt.Errorf("an agent is already named %q", name)
+	}
+	record, err := h.provisionAgent(inventoryAgent{Name: name, Group: group, CommandsFrom: e.CommandsFrom})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.store.DecideEnrollment(id, serverstore.EnrollmentApproved, record.UUID, by, "", now); err != nil {
+		return nil, err
+	}
+	h.syncStoredAgent(*record)
+	logger.Infof("Enrollment %s approved by %s: created agent %s (%s)", id, by, record.Name, record.UUID)
+	return h.store.GetEnrollment(id)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// handleControlEnrollments handles GET /api/control/enrollments - every
+// enrollment code, newest first - and POST with {"label", "name", "group",
+// "commands_from", "ttl_hours"} to create one. The code is in the POST's
+// response only.
+func (h *Handler) handleControlEnrollments(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := h.store.ListEnrollments()
+		if err != nil {
+			logger.Errorf("Failed to list enrollments: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(map[string]any{"enabled": h.enrollment.enabled, "enrollments": list})
+	case http.MethodPost:
+		h.handleControlCreateEnrollment(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) handleControlCreateEnrollment(w http.ResponseWriter, r *http.Request) {
+	if !h.enrollment.enabled {
+		http.Error(w, "Agent enrollment is disabled (enrollment.enabled)", http.StatusConflict)
+		return
+	}
+	var req struct {
+		Label        string `json:"label"`
+		Name         string `json:"name"`
+		Group        string `json:"group"`
+		CommandsFrom string `json:"commands_from"`
+		TTLHours     int    `json:"ttl_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if from := strings.TrimSpace(req.CommandsFrom); from != "" {
+		if _, err := h.store.GetAgentByName(from); err != nil {
+			http.Error(w, fmt.Sprintf("commands_from: no agent named %q", from), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := h.enrollment.codeTTL
+	if req.TTLHours > 0 {
+		ttl = time.Duration(req.TTLHours) * time.Hour
+	}
+
+	id, err := GenerateRandomString(enrollmentIDLength)
+	if err != nil {
+		logger.Errorf("Failed to create enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	code, err := GenerateRandomString(enrollmentCodeLength)
+	if err != nil {
+		logger.Errorf("Failed to create enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	e := serverstore.Enrollment{
+		ID:           id,
+		CodeHash:     hashEnrollmentSecret(code),
+		Label:        strings.TrimSpace(req.Label),
+		Name:         strings.TrimSpace(req.Name),
+		Group:        strings.TrimSpace(req.Group),
+		CommandsFrom: strings.TrimSpace(req.CommandsFrom),
+		Status:       serverstore.EnrollmentOpen,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+	if err := h.store.CreateEnrollment(e); err != nil {
+		logger.Errorf("Failed to create enrollment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("Control panel created enrollment code %s (%q), valid until %s", id, e.Label, e.ExpiresAt.UTC().Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"enrollment": e, "code": code})
+}
+
+// handleControlEnrollmentByID handles PUT /api/control/enrollments/{id} with
+// {"decision": "approve" | "deny", "name", "group", "reason"} for a pending
+// enrollment, and DELETE, which revokes a code.
+func (h *Handler) handleControlEnrollmentByID(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/control/enrollments/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Decision string `json:"decision"`
+			Name     string `json:"name"`
+			Group    string `json:"group"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Decision != approvalApprove && req.Decision != approvalDeny {
+			http.Error(w, "decision must be approve or deny", http.StatusBadRequest)
+			return
+		}
+		e, err := h.decideEnrollment(id, req.Decision == approvalApprove, req.Name, req.Group, req.Reason, enrollmentByOperator)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Enrollment not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errEnrollmentNotPending):
+			http.Error(w, "Enrollment is not waiting for a decision", http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "enrollment": e})
+	case http.MethodDelete:
+		found, err := h.store.DeleteEnrollment(id)
+		if err != nil {
+			logger.Errorf("Failed to delete enrollment %s: %v", id, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Enrollment not found", http.StatusNotFound)
+			return
+		}
+		logger.Infof("Control panel deleted enrollment %s", id)
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "id": id})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
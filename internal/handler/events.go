@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"sync/atomic"
+
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// subscribeEvents attaches the handler's subsystems to the manager's event
+// bus: command counters and all-time totals for /api/control/metrics, the
+// operators' firehose of executions, the never-connected mark of provisioned
+// agents, and an audit log of agent connections and cleanups. The probe-config
+// push to a newly connected agent is not among them: the bus drops events a
+// full queue cannot take, and an agent must not miss its config (see
+// StreamCommands).
+func (h *Handler) subscribeEvents() {
+	bus := h.agentManager.Events()
+
+	bus.Subscribe(0, func(e events.Event) {
+		switch e.Type {
+		case events.CommandStarted:
+			atomic.AddUint64(&h.commandsStarted, 1)
+		case events.CommandFinished:
+			atomic.AddUint64(&h.commandsFinished, 1)
+			if e.Err != "" {
+				atomic.AddUint64(&h.commandsFailed, 1)
+			}
+			h.countExecution(e.Agent, e.Command, e.Err != "")
+		}
+	}, events.CommandStarted, events.CommandFinished)
+
+	bus.Subscribe(0, h.firehose.record, events.CommandStarted, events.CommandFinished)
+
+	bus.Subscribe(0, func(e events.Event) {
+		switch e.Type {
+		case events.AgentConnected:
+			logger.Infof("Agent stream connected: %s (%s)", e.Agent, e.AgentUUID)
+		case events.AgentDisconnected:
+			logger.Infof("Agent stream disconnected: %s (%s)", e.Agent, e.AgentUUID)
+		case events.CleanupPerformed:
+			logger.Infof("Cleanup: %s (%d)", e.Detail, e.Count)
+		}
+	}, events.AgentConnected, events.AgentDisconnected, events.CleanupPerformed)
+
+	// Peer replicas close older streams of an agent that connected here
+	// (see standby.go).
+	bus.Subscribe(0, func(e events.Event) {
+		h.announceAgentStream(e.AgentUUID, e.Time)
+	}, events.AgentConnected)
+
+	bus.Subscribe(0, func(e events.Event) {
+		if err := h.store.MarkAgentConnected(e.AgentUUID); err != nil {
+			logger.Warnf("Failed to record the connection of agent %s: %v", e.Agent, err)
+		}
+	}, events.AgentConnected)
+
+	// Agent status changes refresh the status feed at once instead of on its
+	// next poll.
+	bus.Subscribe(0, func(events.Event) {
+		h.statusFeed.wakeUp()
+	}, events.AgentConnected, events.AgentDisconnected)
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/utils"
+)
+
+// fallbackAgent is one agent row of the built-in page.
+type fallbackAgent struct {
+	Name     string
+	Group    string
+	Online   bool
+	Commands []fallbackCommand
+}
+
+type fallbackCommand struct {
+	Name          string
+	NoTarget      bool
+	DefaultTarget string
+}
+
+// initFallbackPage prepares the built-in page served when webDir holds no
+// frontend build (see fallbackPageTemplate), so a bare server binary is still
+// usable.
+func (h *Handler) initFallbackPage(webDir string) {
+	if _, err := os.Stat(filepath.Join(webDir, "index.html")); err == nil {
+		return
+	}
+	h.fallbackPage = template.Must(template.New("fallback").Parse(fallbackPageTemplate))
+	logger.Warnf("No web frontend in '%s'; serving the built-in minimal page", webDir)
+}
+
+// serveFallbackPage renders the built-in page: every agent visible to
+// anonymous viewers with its status, and a form that runs commands through
+// /api/exec like the full frontend does.
+func (h *Handler) serveFallbackPage(w http.ResponseWriter) {
+	var agents []fallbackAgent
+	for _, status := range h.agentManager.GetAgentStatusList() {
+		if !h.agentManager.AgentVisible(status.Name, false) {
+			continue
+		}
+		row := fallbackAgent{Name: status.Name, Group: status.Group, Online: status.Online}
+		if row.Group == "" {
+			row.Group = "Default"
+		}
+		for _, cmd := range h.agentManager.GetAgentCommandsForViewer(status.Name, false) {
+			if cmd.Unavailable {
+				continue
+			}
+			row.Commands = append(row.Commands, fallbackCommand{
+				Name:          cmd.Name,
+				NoTarget:      !h.commandRequiresTarget(status.Name, cmd.Name),
+				DefaultTarget: cmd.DefaultTarget,
+			})
+		}
+		agents = append(agents, row)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Group != agents[j].Group {
+			return agents[i].Group < agents[j].Group
+		}
+		return agents[i].Name < agents[j].Name
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	h.setNoCacheHeaders(w)
+	if err := h.fallbackPage.Execute(w, map[string]any{
+		"Agents":  agents,
+		"Version": utils.GetAppVersion(),
+	}); err != nil {
+		logger.Errorf("Failed to render built-in page: %v", err)
+	}
+}
+
+// fallbackPageTemplate is deliberately small: plain HTML, no external assets,
+// and a few lines of script to stream /api/exec output into the page.
+const fallbackPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>YALS Looking Glass</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5rem; }
+th, td { text-align: left; padding: 0.35rem 0.6rem; border-bottom: 1px solid #ddd; }
+.online { color: #15803d; } .offline { color: #b91c1c; }
+form { display: flex; flex-wrap: wrap; gap: 0.5rem; margin-bottom: 1rem; }
+select, input, button { font: inherit; padding: 0.3rem 0.5rem; }
+input[name=target] { flex: 1; min-width: 12rem; }
+pre { background: #111; color: #eee; padding: 1rem; min-height: 6rem; overflow-x: auto; white-space: pre-wrap; }
+footer { color: #777; font-size: 0.85rem; }
+</style>
+</head>
+<body>
+<h1>YALS Looking Glass</h1>
+<table>
+<thead><tr><th>Node</th><th>Group</th><th>Status</th><th>Commands</th></tr></thead>
+<tbody>
+{{range .Agents}}<tr><td>{{.Name}}</td><td>{{.Group}}</td>
+<td>{{if .Online}}<span class="online">online</span>{{else}}<span class="offline">offline</span>{{end}}</td>
+<td>{{range $i, $c := .Commands}}{{if $i}}, {{end}}{{$c.Name}}{{end}}</td></tr>
+{{else}}<tr><td colspan="4">No nodes registered.</td></tr>
+{{end}}</tbody>
+</table>
+<form id="run">
+<select name="command" required>
+{{range .Agents}}{{if .Online}}{{$agent := .Name}}<optgroup label="{{$agent}}">
+{{range .Commands}}<option value="{{$agent}}|{{.Name}}" data-no-target="{{.NoTarget}}" data-default-target="{{.DefaultTarget}}">{{.Name}}</option>
+{{end}}</optgroup>
+{{end}}{{end}}</select>
+<input name="target" placeholder="IP address or domain">
+<select name="ip_version">
+<option value="auto">Auto</option><option value="ipv4">IPv4</option><option value="ipv6">IPv6</option>
+</select>
+<button type="submit">Run</button>
+</form>
+<pre id="output"></pre>
+<footer>YALS {{.Version}} &middot; built-in page, the full web frontend is not installed</footer>
+<script>
+(function () {
+  var form = document.getElementById('run');
+  var out = document.getElementById('output');
+  var sessionId = sessionStorage.getItem('yals_session_id');
+  if (!sessionId) {
+    var bytes = new Uint8Array(12);
+    crypto.getRandomValues(bytes);
+    sessionId = 'session_' + Array.from(bytes, function (b) { return b.toString(16).padStart(2, '0'); }).join('');
+    sessionStorage.setItem('yals_session_id', sessionId);
+  }
+  function syncTarget() {
+    var option = form.command.selectedOptions[0];
+    var noTarget = option && option.dataset.noTarget === 'true';
+    form.target.disabled = noTarget;
+    form.target.placeholder = noTarget ? 'No target required'
+      : (option && option.dataset.defaultTarget ? 'Default: ' + option.dataset.defaultTarget : 'IP address or domain');
+  }
+  form.command.addEventListener('change', syncTarget);
+  syncTarget();
+  form.addEventListener('submit', async function (e) {
+    e.preventDefault();
+    var parts = form.command.value.split('|');
+    var button = form.querySelector('button');
+    button.disabled = true;
+    out.textContent = '';
+    try {
+      var res = await fetch('/api/exec?session_id=' + sessionId, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ agent: parts[0], command: parts[1], target: form.target.disabled ? '' : form.target.value.trim(), ip_version: form.ip_version.value })
+      });
+      if (!res.ok) { out.textContent = await res.text(); return; }
+      var reader = res.body.getReader(), decoder = new TextDecoder(), buffer = '';
+      for (;;) {
+        var chunk = await reader.read();
+        if (chunk.done) break;
+        buffer += decoder.decode(chunk.value, { stream: true });
+        var lines = buffer.split('\n');
+        buffer = lines.pop();
+        lines.forEach(function (line) {
+          if (line.indexOf('data: ') !== 0) return;
+          var msg = JSON.parse(line.slice(6));
+          if (msg.type === 'output') out.textContent = msg.output || '';
+          else if (msg.type === 'error') out.textContent = msg.error || '';
+          else if (msg.type === 'complete' && !msg.success && msg.error) out.textContent += '\n' + msg.error;
+        });
+      }
+    } catch (err) {
+      out.textContent = 'Request failed: ' + err;
+    } finally {
+      button.disabled = false;
+    }
+  });
+})();
+</script>
+</body>
+</html>
+`
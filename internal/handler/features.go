@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// knownFeatures are the flags the bundled web UI understands, with their
+// value when neither the configuration nor the control API sets them. Other
+// names are passed through for custom frontends.
+var knownFeatures = map[string]bool{
+	// Render the parsed part of results (AS path summaries, route exports)
+	// next to the raw output.
+	"structured_results": true,
+	// Run a command on several agents side by side.
+	"compare": false,
+	// Offer the speed test commands.
+	"speedtest": false,
+}
+
+var featureNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// featureFlags are the flags of the features section of the configuration
+// and the ones operators set through /api/control/features, which mirror the
+// stored overrides and take precedence.
+type featureFlags struct {
+	mu         sync.RWMutex
+	configured map[string]bool
+	overrides  map[string]bool
+}
+
+// InitFeatures loads the configured feature flags and the overrides saved
+// before the last restart.
+func (h *Handler) InitFeatures(cfg *config.Config) {
+	configured := make(map[string]bool, len(cfg.Features))
+	for name, enabled := range cfg.Features {
+		if !featureNamePattern.MatchString(name) {
+			logger.Warnf("Ignoring feature flag %q: names are lowercase letters, digits and underscores", name)
+			continue
+		}
+		configured[name] = enabled
+	}
+	overrides, err := h.store.GetFeatureFlags()
+	if err != nil {
+		logger.Errorf("Failed to load feature flags: %v", err)
+		overrides = make(map[string]bool)
+	}
+	h.features.mu.Lock()
+	h.features.configured = configured
+	h.features.overrides = overrides
+	h.features.mu.Unlock()
+}
+
+// enabledFeatures returns the value of every flag, as /api/node lists them
+// for frontends to feature-detect.
+func (h *Handler) enabledFeatures() map[string]bool {
+	h.features.mu.RLock()
+	defer h.features.mu.RUnlock()
+	flags := maps.Clone(knownFeatures)
+	maps.Copy(flags, h.features.configured)
+	maps.Copy(flags, h.features.overrides)
+	return flags
+}
+
+// featureList describes each flag for the control API: its value, its
+// default and where the value comes from ("default", "config" or "api").
+func (h *Handler) featureList() []map[string]any {
+	flags := h.enabledFeatures()
+	h.features.mu.RLock()
+	defer h.features.mu.RUnlock()
+	list := make([]map[string]any, 0, len(flags))
+	for _, name := range slices.Sorted(maps.Keys(flags)) {
+		entry := map[string]any{"name": name, "enabled": flags[name], "source": "default"}
+		if def, known := knownFeatures[name]; known {
+			entry["default"] = def
+		}
+		if _, ok := h.features.configured[name]; ok {
+			entry["source"] = "config"
+		}
+		if _, ok := h.features.overrides[name]; ok {
+			entry["source"] = "api"
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// handleControlFeatures handles /api/control/features:
+//
+//	GET - list every flag
+//	PUT - set flags {"features": {"compare": true, "speedtest": null}};
+//	      null removes the override, back to the configured value
+func (h *Handler) handleControlFeatures(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Features map[string]*bool `json:"features"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for name := range req.Features {
+			if !featureNamePattern.MatchString(name) {
+				http.Error(w, fmt.Sprintf("invalid feature name %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := h.setFeatures(req.Features); err != nil {
+			logger.Errorf("Failed to save feature flags: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"features": h.featureList()})
+}
+
+// setFeatures applies changes to the overrides and saves them.
+func (h *Handler) setFeatures(changes map[string]*bool) error {
+	h.features.mu.Lock()
+	defer h.features.mu.Unlock()
+	overrides := maps.Clone(h.features.overrides)
+	for name, enabled := range changes {
+		if enabled == nil {
+			delete(overrides, name)
+		} else {
+			overrides[name] = *enabled
+		}
+	}
+	if err := h.store.SaveFeatureFlags(overrides); err != nil {
+		return err
+	}
+	h.features.overrides = overrides
+	return nil
+}
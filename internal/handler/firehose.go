@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// The firehose (/api/control/firehose) streams every command start and
+// finish to operators as it happens, with the agent, command, target and
+// requester, for watching a public instance during a suspected abuse wave.
+// New subscribers first get the most recent events.
+const (
+	firehoseBacklog    = 100
+	firehoseBuffer     = 256
+	firehoseMaxClients = 16
+	firehoseKeepalive  = 30 * time.Second
+)
+
+// firehoseEvent is one SSE event of the firehose.
+type firehoseEvent struct {
+	Type       string `json:"type"`
+	Time       string `json:"time"`
+	CommandID  string `json:"command_id"`
+	Agent      string `json:"agent"`
+	Command    string `json:"command"`
+	Target     string `json:"target,omitempty"`
+	Requester  string `json:"requester,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Stopped    bool   `json:"stopped,omitempty"`
+}
+
+// firehoseSub is one subscriber. dropped counts the events that did not fit
+// its queue since it last read.
+type firehoseSub struct {
+	ch      chan firehoseEvent
+	dropped int
+}
+
+type firehose struct {
+	mu     sync.Mutex
+	recent []firehoseEvent
+	subs   map[*firehoseSub]struct{}
+}
+
+// record is subscribed to the command events of the bus (see events.go).
+func (f *firehose) record(e events.Event) {
+	event := firehoseEvent{
+		Type:      string(e.Type),
+		Time:      e.Time.UTC().Format(time.RFC3339Nano),
+		CommandID: e.CommandID,
+		Agent:     e.Agent,
+		Command:   e.Command,
+		Target:    e.Target,
+		Requester: e.Requester,
+	}
+	if e.Type == events.CommandFinished {
+		event.DurationMs = e.Duration.Milliseconds()
+		event.Error = e.Err
+		event.Stopped = e.Stopped
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.recent) == firehoseBacklog {
+		f.recent = append(f.recent[:0], f.recent[1:]...)
+	}
+	f.recent = append(f.recent, event)
+	for sub := range f.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns it with the recent events.
+func (f *firehose) subscribe() (*firehoseSub, []firehoseEvent, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[*firehoseSub]struct{})
+	}
+	if len(f.subs) >= firehoseMaxClients {
+		return nil, nil, false
+	}
+	sub := &firehoseSub{ch: make(chan firehoseEvent, firehoseBuffer)}
+	f.subs[sub] = struct{}{}
+	return sub, append([]firehoseEvent(nil), f.recent...), true
+}
+
+func (f *firehose) unsubscribe(sub *firehoseSub) {
+	f.mu.Lock()
+	delete(f.subs, sub)
+	f.mu.Unlock()
+}
+
+// takeDropped returns and resets the count of events sub missed.
+func (f *firehose) takeDropped(sub *firehoseSub) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := sub.dropped
+	sub.dropped = 0
+	return dropped
+}
+
+// handleControlFirehose handles GET /api/control/firehose - an SSE stream of
+// command_started and command_finished events of all executions. With
+// backlog=0 the recent events are skipped.
+func (h *Handler) handleControlFirehose(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, recent, ok := h.firehose.subscribe()
+	if !ok {
+		http.Error(w, "Too many firehose subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.firehose.unsubscribe(sub)
+	if r.URL.Query().Get("backlog") == "0" {
+		recent = nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(event any) bool {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			logger.Errorf("Failed to marshal firehose event: %v", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			return false
+		}
+		return true
+	}
+	for _, event := range recent {
+		if !send(event) {
+			return
+		}
+	}
+	if !send(map[string]any{"type": "live"}) {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(firehoseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-sub.ch:
+			// A reader too slow for the burst is told how much it missed.
+			if dropped := h.firehose.takeDropped(sub); dropped > 0 {
+				if !send(map[string]any{"type": "dropped", "count": dropped}) {
+					return
+				}
+			}
+			if !send(event) {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+// InitOutputFooter sets the footer appended to completed results
+// (output.footer).
+func (h *Handler) InitOutputFooter(cfg *config.Config) {
+	h.outputFooter = strings.TrimSpace(cfg.Output.Footer)
+	if h.outputFooter != "" {
+		logger.Infof("Output footer enabled")
+	}
+}
+
+// resultFooter renders the output footer for a completed run of command on
+// agentName, with the time as prefs reads it, or returns "" when none is
+// configured. Internationalized domains are shown in their Unicode form.
+func (h *Handler) resultFooter(agentName, command string, target validator.Target, prefs displayPrefs) string {
+	if h.outputFooter == "" {
+		return ""
+	}
+	status, _ := h.agentManager.GetAgent(agentName)
+	shown := target.Value
+	if target.Unicode != "" {
+		shown = target.Unicode
+	}
+	return strings.NewReplacer(
+		"{time}", prefs.formatTime(time.Now(), "2006-01-02 15:04:05 UTC"),
+		"{agent}", agentName,
+		"{location}", status.Location,
+		"{group}", status.Group,
+		"{command}", command,
+		"{target}", shown,
+	).Replace(h.outputFooter)
+}
+
+// appendFooter adds footer to output, separated by a blank line.
+func appendFooter(output, footer string) string {
+	if footer == "" {
+		return output
+	}
+	if output = strings.TrimRight(output, "\n"); output == "" {
+		return footer
+	}
+	return output + "\n\n" + footer
+}
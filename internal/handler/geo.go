@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// earthRadiusKm is the mean radius used for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// geolocator finds where visitors and agents are in a MaxMind database
+// (geolocation.database), to suggest each visitor its nearest agent.
+type geolocator struct {
+	db *maxminddb.Reader
+
+	mu sync.Mutex
+	// agents caches the positions of agent addresses, which rarely change.
+	agents map[string]geoPoint
+}
+
+// geoPoint is a looked-up address. A Country database has no coordinates,
+// so only country is set.
+type geoPoint struct {
+	country  string
+	lat, lng float64
+	located  bool
+}
+
+// geoRecord is the part of a GeoLite2/GeoIP2 City or Country record used.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// InitGeolocation opens the geolocation database (relative to baseDir).
+// Without one no agent is suggested.
+func (h *Handler) InitGeolocation(cfg *config.Config, baseDir string) {
+	path := cfg.Geolocation.Database
+	if path == "" {
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		logger.Errorf("Geolocation disabled: %v", err)
+		return
+	}
+	h.geo = &geolocator{db: db, agents: make(map[string]geoPoint)}
+	logger.Infof("Suggesting the nearest agent to visitors using %s (%s)", path, db.Metadata.DatabaseType)
+}
+
+// lookup returns the position of an address.
+func (g *geolocator) lookup(address string) (geoPoint, bool) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return geoPoint{}, false
+	}
+	var record geoRecord
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return geoPoint{}, false
+	}
+	point := geoPoint{country: record.Country.ISOCode}
+	if record.Location.Latitude != nil && record.Location.Longitude != nil {
+		point.lat, point.lng = *record.Location.Latitude, *record.Location.Longitude
+		point.located = true
+	}
+	return point, point.located || point.country != ""
+}
+
+// agentPosition returns the position of the first of an agent's addresses
+// the database knows.
+func (g *geolocator) agentPosition(addresses ...string) (geoPoint, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		point, cached := g.agents[address]
+		if !cached {
+			point, _ = g.lookup(address)
+			g.agents[address] = point
+		}
+		if point.located || point.country != "" {
+			return point, true
+		}
+	}
+	return geoPoint{}, false
+}
+
+// suggestedAgent returns the online agent among groups nearest to the
+// visitor, or one in the visitor's country when the database has no
+// coordinates. It returns "" when the visitor or no agent can be located.
+func (h *Handler) suggestedAgent(r *http.Request, groups []map[string]any) string {
+	if h.geo == nil {
+		return ""
+	}
+	visitor, ok := h.geo.lookup(h.getRealIP(r))
+	if !ok {
+		return ""
+	}
+
+	var nearest, sameCountry string
+	bestDistance := math.Inf(1)
+	for _, group := range groups {
+		agents, _ := group["agents"].([]map[string]any)
+		for _, agentInfo := range agents {
+			if status, _ := agentInfo["status"].(int); status != 1 {
+				continue
+			}
+			name, _ := agentInfo["name"].(string)
+			details, _ := agentInfo["details"].(map[string]any)
+			testIP, _ := details["test_ip"].(string)
+			ipv4, _ := details["ipv4"].(string)
+			ipv6, _ := details["ipv6"].(string)
+			position, ok := h.geo.agentPosition(testIP, ipv4, ipv6)
+			if !ok {
+				continue
+			}
+			if visitor.located && position.located {
+				if distance := greatCircleKm(visitor, position); distance < bestDistance {
+					nearest, bestDistance = name, distance
+				}
+			}
+			if sameCountry == "" && visitor.country != "" && position.country == visitor.country {
+				sameCountry = name
+			}
+		}
+	}
+	if nearest != "" {
+		return nearest
+	}
+	return sameCountry
+}
+
+// greatCircleKm is the haversine distance between two located points.
+func greatCircleKm(a, b geoPoint) float64 {
+	lat1, lat2 := a.lat*math.Pi/180, b.lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.lng - a.lng) * math.Pi / 180
+	hav := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(hav)))
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// groupLimit is a group's rate limiter and quotas, and the executions it
+// refused.
+type groupLimit struct {
+	name          string
+	limiter       *RateLimiter
+	dailyQuota    int64
+	monthlyQuota  int64
+	rateLimited   atomic.Uint64
+	quotaExceeded atomic.Uint64
+}
+
+// InitGroupLimits loads the per-group rate limits and quotas.
+func (h *Handler) InitGroupLimits(cfg *config.Config) {
+	h.groupLimits = make(map[string]*groupLimit, len(cfg.GroupLimits))
+	for name, l := range cfg.GroupLimits {
+		limit := &groupLimit{
+			name:         name,
+			dailyQuota:   max(l.DailyQuota, 0),
+			monthlyQuota: max(l.MonthlyQuota, 0),
+		}
+		if l.MaxCommands > 0 {
+			var settings config.RuntimeSettings
+			settings.RateLimit.Enabled = true
+			settings.RateLimit.MaxCommands = l.MaxCommands
+			settings.RateLimit.TimeWindow = l.TimeWindow
+			limit.limiter = NewRateLimiter(settings)
+		}
+		h.groupLimits[name] = limit
+	}
+	if len(h.groupLimits) > 0 {
+		logger.Infof("Loaded limits for %d agent groups", len(h.groupLimits))
+	}
+}
+
+// checkGroupRateLimit applies the rate limit of agentName's group to an
+// execution by client (a client id, IP or chat user). It returns "" when the
+// execution may go on, else the message to refuse it with.
+func (h *Handler) checkGroupRateLimit(agentName, client string) string {
+	group := h.agentManager.AgentGroup(agentName)
+	limit, ok := h.groupLimits[group]
+	if !ok || limit.limiter == nil || limit.limiter.checkRateLimit(client) {
+		return ""
+	}
+	limit.rateLimited.Add(1)
+	if h.shadowed(&h.shadow.rateLimited, "group %s rate limit exceeded by %s", group, client) {
+		return ""
+	}
+	remaining := limit.limiter.getRemainingTime(client)
+	return fmt.Sprintf("Rate limit for %s nodes exceeded. Please wait %d seconds before trying again.", group, int(remaining.Seconds())+1)
+}
+
+// consumeGroupQuota counts an execution on agentName against its group's
+// quotas. It is called once the execution passed every other check, so
+// refused ones do not use up the group's budget. It returns "" when the
+// execution may run, else the message to refuse it with.
+func (h *Handler) consumeGroupQuota(agentName string) string {
+	group := h.agentManager.AgentGroup(agentName)
+	limit, ok := h.groupLimits[group]
+	if !ok || (limit.dailyQuota == 0 && limit.monthlyQuota == 0) {
+		return ""
+	}
+	day, month := quotaPeriods(time.Now())
+	_, _, allowed, err := h.store.ConsumeExecution(groupQuotaIdentity(group), day, month, limit.dailyQuota, limit.monthlyQuota)
+	if err != nil {
+		logger.Warnf("Failed to count execution for group %s: %v", group, err)
+		return ""
+	}
+	if !allowed {
+		limit.quotaExceeded.Add(1)
+		return fmt.Sprintf("Execution quota for %s nodes exhausted. Please try again later.", group)
+	}
+	return ""
+}
+
+func groupQuotaIdentity(group string) string {
+	return "group:" + group
+}
+
+// groupUsage lists each limited group's limits, usage and refusals for
+// /api/control/quotas.
+func (h *Handler) groupUsage(day, month string) ([]map[string]any, error) {
+	names := make([]string, 0, len(h.groupLimits))
+	for name := range h.groupLimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		limit := h.groupLimits[name]
+		usedToday, err := h.store.ExecutionUsage(groupQuotaIdentity(name), day)
+		if err != nil {
+			return nil, err
+		}
+		usedMonth, err := h.store.ExecutionUsage(groupQuotaIdentity(name), month)
+		if err != nil {
+			return nil, err
+		}
+		group := map[string]any{
+			"name":            name,
+			"daily_quota":     limit.dailyQuota,
+			"monthly_quota":   limit.monthlyQuota,
+			"used_today":      usedToday,
+			"used_this_month": usedMonth,
+			"rate_limited":    limit.rateLimited.Load(),
+			"quota_exceeded":  limit.quotaExceeded.Load(),
+		}
+		if limit.limiter != nil {
+			group["max_commands"] = limit.limiter.maxCommands
+			group["time_window"] = int(limit.limiter.timeWindow.Seconds())
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const (
+	defaultHandshakeTimeout     = 10 * time.Second
+	defaultMaxPendingHandshakes = 512
+)
+
+// handshakeGuard tracks connections that have not finished their TLS
+// handshake yet. Half-open connections (scanners, stalled agents) are cut off
+// by the handshake deadline, and past maxPending new ones are closed at once,
+// so they cannot pile up.
+type handshakeGuard struct {
+	mu         sync.Mutex
+	pending    map[net.Conn]time.Time
+	maxPending int
+	timeout    time.Duration
+
+	rejected atomic.Uint64
+	slow     atomic.Uint64
+}
+
+// InitHandshakeGuard sets the TLS handshake deadline and the limit of
+// concurrently pending handshakes.
+func (h *Handler) InitHandshakeGuard(cfg *config.Config) {
+	h.handshakes.pending = make(map[net.Conn]time.Time)
+	h.handshakes.timeout = defaultHandshakeTimeout
+	if sec := cfg.Server.HandshakeTimeout; sec > 0 {
+		h.handshakes.timeout = time.Duration(sec) * time.Second
+	}
+	h.handshakes.maxPending = defaultMaxPendingHandshakes
+	if n := cfg.Server.MaxPendingHandshakes; n > 0 {
+		h.handshakes.maxPending = n
+	}
+}
+
+// HandshakeTimeout is the deadline for a new connection's TLS handshake. The
+// HTTPS server applies it as its ReadHeaderTimeout, which also bounds the
+// handshake.
+func (h *Handler) HandshakeTimeout() time.Duration {
+	return h.handshakes.timeout
+}
+
+// TrackConnState is the HTTPS server's ConnState hook. A connection is pending
+// from StateNew until its first other state: active/idle once the handshake
+// succeeded, closed when it failed or timed out.
+func (h *Handler) TrackConnState(conn net.Conn, state http.ConnState) {
+	g := &h.handshakes
+	g.mu.Lock()
+	if state == http.StateNew {
+		if len(g.pending) >= g.maxPending {
+			g.mu.Unlock()
+			if n := g.rejected.Add(1); n%100 == 1 {
+				logger.Warnf("Too many pending TLS handshakes (%d); rejected %d connections so far", g.maxPending, n)
+			}
+			conn.Close()
+			return
+		}
+		g.pending[conn] = time.Now()
+		g.mu.Unlock()
+		return
+	}
+	started, ok := g.pending[conn]
+	delete(g.pending, conn)
+	g.mu.Unlock()
+
+	if ok && state == http.StateClosed && time.Since(started) >= g.timeout {
+		g.slow.Add(1)
+		logger.Debugf("Closed connection from %s that did not finish its handshake within %s", conn.RemoteAddr(), g.timeout)
+	}
+}
+
+// handshakeStats reports pending handshakes and the totals of rejected and
+// timed-out ones.
+func (h *Handler) handshakeStats() (pending int, rejected, slow uint64) {
+	h.handshakes.mu.Lock()
+	pending = len(h.handshakes.pending)
+	h.handshakes.mu.Unlock()
+	return pending, h.handshakes.rejected.Load(), h.handshakes.slow.Load()
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+const idleSweepInterval = time.Minute
+
+// idleClients remembers when each browser session last did something (ran a
+// command), so that long-lived streams of sessions nobody uses any more can
+// be closed. Sessions that never acted are embedded widgets and get their own
+// timeout.
+type idleClients struct {
+	mu                 sync.Mutex
+	lastActive         map[string]time.Time
+	interactiveTimeout time.Duration
+	embeddedTimeout    time.Duration
+	closed             atomic.Uint64
+}
+
+// InitIdleClients sets the idle timeouts of interactive and embedded
+// sessions; with both 0 nothing is tracked.
+func (h *Handler) InitIdleClients(cfg *config.Config) {
+	h.idle.lastActive = make(map[string]time.Time)
+	h.idle.interactiveTimeout = time.Duration(max(cfg.Limits.IdleTimeout, 0)) * time.Minute
+	h.idle.embeddedTimeout = time.Duration(max(cfg.Limits.EmbeddedIdleTimeout, 0)) * time.Minute
+	if h.idle.interactiveTimeout > 0 || h.idle.embeddedTimeout > 0 {
+		go h.runIdleSweeper()
+	}
+}
+
+// touchSession records user activity of sessionID.
+func (h *Handler) touchSession(sessionID string) {
+	if h.idle.interactiveTimeout <= 0 && h.idle.embeddedTimeout <= 0 {
+		return
+	}
+	h.idle.mu.Lock()
+	h.idle.lastActive[sessionID] = time.Now()
+	h.idle.mu.Unlock()
+}
+
+// sessionIdle reports whether a stream of sessionID opened at since has seen
+// no activity for longer than its timeout, and that timeout.
+func (h *Handler) sessionIdle(sessionID string, since time.Time) (bool, time.Duration) {
+	h.idle.mu.Lock()
+	last, interactive := h.idle.lastActive[sessionID]
+	h.idle.mu.Unlock()
+
+	timeout := h.idle.embeddedTimeout
+	if interactive {
+		timeout = h.idle.interactiveTimeout
+		if last.After(since) {
+			since = last
+		}
+	}
+	return timeout > 0 && time.Since(since) >= timeout, timeout
+}
+
+// runIdleSweeper forgets sessions idle for twice the longer timeout. Streams
+// check every keepalive, so theirs have been closed well before.
+func (h *Handler) runIdleSweeper() {
+	retention := 2 * max(h.idle.interactiveTimeout, h.idle.embeddedTimeout)
+	ticker := time.NewTicker(idleSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-retention)
+		h.idle.mu.Lock()
+		for id, last := range h.idle.lastActive {
+			if last.Before(cutoff) {
+				delete(h.idle.lastActive, id)
+			}
+		}
+		h.idle.mu.Unlock()
+	}
+}
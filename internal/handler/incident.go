@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/store/archive"
+)
+
+const (
+	// incidentMaxResults caps the results bundled into one report.
+	incidentMaxResults = 50
+	// incidentMaxRecipients caps the addresses one report is emailed to.
+	incidentMaxRecipients = 10
+	incidentMaxTitle      = 200
+	incidentMaxNotes      = 4000
+)
+
+// IncidentRequest is the body of POST /api/incidents.
+type IncidentRequest struct {
+	ResultIDs []string `json:"result_ids"`
+	Title     string   `json:"title"`
+	Notes     string   `json:"notes"`
+	// Format is "json" (default) or "text".
+	Format string `json:"format"`
+	// Email sends the report to these addresses instead of returning it.
+	Email []string `json:"email"`
+}
+
+// IncidentReport bundles stored results into one evidence packet an operator
+// can hand to an upstream.
+type IncidentReport struct {
+	Title       string           `json:"title,omitempty"`
+	Notes       string           `json:"notes,omitempty"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	RequestedBy string           `json:"requested_by"`
+	Results     []IncidentResult `json:"results"`
+	// Missing lists the requested ids that are unknown or have expired.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// IncidentResult is one stored route of an incident report.
+type IncidentResult struct {
+	ResultID  string           `json:"result_id"`
+	Agent     string           `json:"agent"`
+	Group     string           `json:"group,omitempty"`
+	Location  string           `json:"location,omitempty"`
+	Command   string           `json:"command"`
+	Target    string           `json:"target,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	ASPath    []ASPathSegment  `json:"as_path,omitempty"`
+	Hops      []proto.RouteHop `json:"hops"`
+	// Signature proves the result came from this looking glass (see
+	// signing.go); nil when it was stored unsigned.
+	Signature *resultSignature `json:"signature,omitempty"`
+}
+
+// handleIncidents handles POST /api/incidents - bundles stored results into an
+// incident report, returned as a JSON or plain-text download, or emailed to
+// the listed addresses.
+func (h *Handler) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.validateSessionID(r.URL.Query().Get("session_id")) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+
+	var req IncidentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	req.Notes = strings.TrimSpace(req.Notes)
+	switch {
+	case len(req.ResultIDs) == 0:
+		http.Error(w, "result_ids is required", http.StatusBadRequest)
+		return
+	case len(req.ResultIDs) > incidentMaxResults:
+		http.Error(w, fmt.Sprintf("at most %d result_ids per report", incidentMaxResults), http.StatusBadRequest)
+		return
+	case len(req.Title) > incidentMaxTitle || strings.ContainsAny(req.Title, "\r\n"):
+		http.Error(w, "title must be one line of at most 200 characters", http.StatusBadRequest)
+		return
+	case len(req.Notes) > incidentMaxNotes:
+		http.Error(w, "notes must not exceed 4000 characters", http.StatusBadRequest)
+		return
+	case req.Format != "" && req.Format != "json" && req.Format != "text":
+		http.Error(w, "format must be json or text", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.ResultIDs {
+		if !resultIDPattern.MatchString(id) {
+			http.Error(w, "Invalid result_id "+strconv.Quote(id), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Emailing makes the server send mail, so like callback_url it is
+	// limited to control-token holders.
+	var recipients []string
+	if len(req.Email) > 0 {
+		var err error
+		if recipients, err = h.validateIncidentRecipients(req.Email, h.isAuthenticatedViewer(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, status, err := h.buildIncidentReport(r, req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	text := incidentText(report, h.displayFor(r.URL.Query().Get("session_id")))
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if recipients != nil {
+		attachment := mailAttachment{name: "incident.json", contentType: "application/json", data: body}
+		if err := h.mailer.send(recipients, incidentSubject(report), text, attachment); err != nil {
+			logger.Errorf("Failed to email incident report to %s: %v", strings.Join(recipients, ", "), err)
+			http.Error(w, "Failed to send the email", http.StatusBadGateway)
+			return
+		}
+		logger.Infof("Client [%s] emailed an incident report of %d results to %s", report.RequestedBy, len(report.Results), strings.Join(recipients, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"success": true,
+			"sent_to": recipients,
+			"results": len(report.Results),
+			"missing": report.Missing,
+		})
+		return
+	}
+
+	name := "incident-" + report.GeneratedAt.Format("20060102-150405")
+	h.setNoCacheHeaders(w)
+	if req.Format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.txt"`)
+		_, _ = w.Write([]byte(text))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// validateIncidentRecipients checks that a report may be emailed and returns
+// the bare addresses to send it to.
+func (h *Handler) validateIncidentRecipients(list []string, authenticated bool) ([]string, error) {
+	if h.mailer == nil {
+		return nil, errors.New("email is not enabled on this server")
+	}
+	if !authenticated {
+		return nil, errors.New("email requires a control token")
+	}
+	if len(list) > incidentMaxRecipients {
+		return nil, fmt.Errorf("at most %d email recipients", incidentMaxRecipients)
+	}
+	return parseMailAddresses(list)
+}
+
+// buildIncidentReport loads the requested results, fetching archived ones
+// back from object storage. It fails when none of them exists.
+func (h *Handler) buildIncidentReport(r *http.Request, req IncidentRequest) (IncidentReport, int, error) {
+	report := IncidentReport{
+		Title:       req.Title,
+		Notes:       req.Notes,
+		GeneratedAt: time.Now().UTC(),
+		RequestedBy: h.getRealIP(r),
+		Results:     []IncidentResult{},
+	}
+	seen := make(map[string]bool)
+	for _, id := range req.ResultIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		record, found, err := h.store.GetRouteResult(id)
+		if err != nil {
+			logger.Errorf("Failed to load route result %s: %v", id, err)
+			return report, http.StatusInternalServerError, errors.New("Failed to load results")
+		}
+		if found && record.ArchiveKey != "" {
+			data, err := h.loadArchivedRoute(r.Context(), record.ArchiveKey)
+			switch {
+			case errors.Is(err, archive.ErrNotFound):
+				found = false
+			case err != nil:
+				logger.Errorf("Failed to load archived route result %s: %v", id, err)
+				return report, http.StatusBadGateway, errors.New("Failed to load archived results")
+			default:
+				record.Route = data
+			}
+		}
+		var route proto.RouteResult
+		if found && json.Unmarshal(record.Route, &route) != nil {
+			found = false
+		}
+		if !found {
+			report.Missing = append(report.Missing, id)
+			continue
+		}
+
+		result := IncidentResult{
+			ResultID:  id,
+			Agent:     record.Agent,
+			Command:   record.Command,
+			Target:    route.Target,
+			CreatedAt: record.CreatedAt.UTC(),
+			ASPath:    summarizeASPath(record.Route),
+			Hops:      route.Hops,
+			Signature: h.storedSignature(record),
+		}
+		if status, ok := h.agentManager.GetAgent(record.Agent); ok {
+			result.Group = status.Group
+			result.Location = status.Location
+		}
+		report.Results = append(report.Results, result)
+	}
+	if len(report.Results) == 0 {
+		return report, http.StatusNotFound, errors.New("Results not found or expired")
+	}
+	return report, http.StatusOK, nil
+}
+
+func incidentSubject(report IncidentReport) string {
+	if report.Title != "" {
+		return "Incident report: " + report.Title
+	}
+	return "Incident report " + report.GeneratedAt.Format("2006-01-02 15:04 UTC")
+}
+
+// incidentText renders a report for humans: the metadata, then per result
+// its AS path and a hop table, with times and numbers as prefs reads them.
+func incidentText(report IncidentReport, prefs displayPrefs) string {
+	var b strings.Builder
+	title := report.Title
+	if title == "" {
+		title = "(untitled)"
+	}
+	fmt.Fprintf(&b, "Incident report: %s\n", title)
+	fmt.Fprintf(&b, "Generated:       %s\n", prefs.formatTime(report.GeneratedAt, time.RFC3339))
+	fmt.Fprintf(&b, "Requested by:    %s\n", report.RequestedBy)
+	fmt.Fprintf(&b, "Results:         %d\n", len(report.Results))
+	if len(report.Missing) > 0 {
+		fmt.Fprintf(&b, "Missing:         %s\n", strings.Join(report.Missing, ", "))
+	}
+	if report.Notes != "" {
+		fmt.Fprintf(&b, "\nNotes:\n%s\n", report.Notes)
+	}
+
+	for _, result := range report.Results {
+		fmt.Fprintf(&b, "\n== %s %s from %s ==\n", result.Command, result.Target, result.Agent)
+		fmt.Fprintf(&b, "Result:   %s\n", result.ResultID)
+		if where := strings.Join(nonEmpty(result.Location, result.Group), ", "); where != "" {
+			fmt.Fprintf(&b, "Agent:    %s (%s)\n", result.Agent, where)
+		}
+		fmt.Fprintf(&b, "Run at:   %s\n", prefs.formatTime(result.CreatedAt, time.RFC3339))
+		if len(result.ASPath) > 0 {
+			segments := make([]string, 0, len(result.ASPath))
+			for _, segment := range result.ASPath {
+				s := segment.ASN
+				if segment.Owner != "" {
+					s += " " + segment.Owner
+				}
+				hops := "hops"
+				if segment.Hops == 1 {
+					hops = "hop"
+				}
+				segments = append(segments, fmt.Sprintf("%s (%d %s)", s, segment.Hops, hops))
+			}
+			fmt.Fprintf(&b, "AS path:  %s\n", strings.Join(segments, " -> "))
+		}
+		if sig := result.Signature; sig != nil {
+			fmt.Fprintf(&b, "Signed:   key %s, %s\n", sig.KeyID, sig.Value)
+		}
+		b.WriteString("\n")
+
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TTL\tAddress\tRTT (ms)\tASN\tOwner\tLocation")
+		for _, hop := range result.Hops {
+			address := hop.IP
+			if address == "" {
+				address = "*"
+			}
+			if hop.Hostname != "" && hop.Hostname != hop.IP {
+				address += " (" + hop.Hostname + ")"
+			}
+			rtts := make([]string, 0, len(hop.RTTMs))
+			for _, rtt := range hop.RTTMs {
+				rtts = append(rtts, prefs.formatDecimal(rtt, 1))
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", hop.TTL, address, strings.Join(rtts, " "),
+				normalizeASN(hop.ASN), hopOwner(hop), strings.Join(nonEmpty(hop.City, hop.Province, hop.Country), ", "))
+		}
+		_ = tw.Flush()
+	}
+	return b.String()
+}
+
+func nonEmpty(values ...string) []string {
+	out := values[:0:0]
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
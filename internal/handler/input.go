@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+// maxNameLength bounds the agent and command names of a request. They are
+// only looked up, never run, but end up in logs and error messages.
+const maxNameLength = 128
+
+// execIPVersions are the ip_version values /api/exec and /api/preview take;
+// empty means auto.
+var execIPVersions = []string{"", "auto", "ipv4", "ipv6", ipVersionDual}
+
+// InitInputPolicy applies limits.max_target_length and limits.target_charset.
+// Agents receive the same policy with their runtime config.
+func (h *Handler) InitInputPolicy(cfg *config.Config) {
+	validator.SetPolicy(validator.NewPolicy(cfg.Limits.MaxTargetLength, cfg.Limits.TargetCharset))
+}
+
+// validateExecOptions checks the fields of an exec or preview request other
+// than the target, which goes through the command's validator.
+func validateExecOptions(req ExecRequest) error {
+	for _, field := range []struct{ name, value string }{{"agent", req.Agent}, {"command", req.Command}, {"view", req.View}} {
+		if utf8.RuneCountInString(field.value) > maxNameLength {
+			return &validator.InputError{Field: field.name, Code: validator.CodeTooLong, Limit: maxNameLength,
+				Reason: fmt.Sprintf("%s must not exceed %d characters", field.name, maxNameLength)}
+		}
+	}
+	if !slices.Contains(execIPVersions, req.IPVersion) {
+		return &validator.InputError{Field: "ip_version", Code: validator.CodeInvalid,
+			Reason: "ip_version must be auto, ipv4, ipv6 or dual"}
+	}
+	return nil
+}
+
+// unknownViewError rejects a view the command does not have.
+func unknownViewError(view string) error {
+	return &validator.InputError{Field: "view", Code: validator.CodeInvalid,
+		Reason: fmt.Sprintf("the command has no view %q", view)}
+}
+
+// inputErrorMessage describes a rejected request field for a client: the
+// message, the rejection code (invalid_target or invalid_option), and for an
+// InputError the field, the reason code and the limit that was exceeded.
+func inputErrorMessage(err error) map[string]any {
+	msg := map[string]any{
+		"error": "Invalid target: " + err.Error(),
+		"code":  proto.RejectInvalidTarget,
+	}
+	var inputErr *validator.InputError
+	if !errors.As(err, &inputErr) {
+		return msg
+	}
+	if inputErr.Field != "target" {
+		msg["error"] = "Invalid request: " + inputErr.Reason
+		msg["code"] = proto.RejectInvalidOption
+	}
+	msg["field"] = inputErr.Field
+	msg["reason"] = inputErr.Code
+	if inputErr.Limit > 0 {
+		msg["limit"] = inputErr.Limit
+	}
+	return msg
+}
+
+// sendSSEInputError completes the stream of a request with an invalid field.
+func (h *Handler) sendSSEInputError(w http.ResponseWriter, flusher http.Flusher, err error) {
+	msg := inputErrorMessage(err)
+	msg["type"] = "complete"
+	msg["success"] = false
+	h.sendSSEMessage(w, flusher, msg)
+}
+
+// writeInputError answers a JSON request with an invalid field: 400 and the
+// same fields as sendSSEInputError.
+func (h *Handler) writeInputError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(inputErrorMessage(err))
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// inventoryMaxBody bounds an inventory uploaded to /api/control/agents/import.
+const inventoryMaxBody = 1 << 20
+
+// inventory is an inventory file: the agents expected to connect, such as the
+// PoPs of a rollout. JSON is valid YAML, so either works.
+type inventory struct {
+	Agents []inventoryAgent `yaml:"agents" json:"agents"`
+}
+
+// inventoryAgent is one expected agent. UUID and Token are generated when
+// empty. The commands are copied from the agent named in CommandsFrom, or
+// are the built-in templates (config.DefaultCommands) without one.
+type inventoryAgent struct {
+	UUID         string              `yaml:"uuid" json:"uuid"`
+	Token        string              `yaml:"token" json:"token"`
+	Name         string              `yaml:"name" json:"name"`
+	Group        string              `yaml:"group" json:"group"`
+	Details      config.AgentDetails `yaml:"details" json:"details"`
+	CommandsFrom string              `yaml:"commands_from" json:"commands_from"`
+	DialAddress  string              `yaml:"dial_address" json:"dial_address"`
+}
+
+// inventoryResult reports an import: the agents created, and per name those
+// skipped because they are registered already or failed.
+type inventoryResult struct {
+	Created []AgentConfigResponse `json:"created"`
+	Skipped []string              `json:"skipped"`
+	Errors  map[string]string     `json:"errors,omitempty"`
+}
+
+// InitInventory creates the agents of the inventory file (inventory) that
+// are not registered yet. Registered agents are left as they are, so edits
+// made in the control panel survive restarts.
+func (h *Handler) InitInventory(cfg *config.Config, baseDir string) {
+	path := cfg.Inventory
+	if path == "" {
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Errorf("Failed to read agent inventory: %v", err)
+		return
+	}
+	inv, err := parseInventory(data)
+	if err != nil {
+		logger.Errorf("Failed to load agent inventory %s: %v", path, err)
+		return
+	}
+	result := h.importInventory(inv)
+	for name, msg := range result.Errors {
+		logger.Warnf("Inventory agent %q not imported: %s", name, msg)
+	}
+	if len(result.Created) > 0 {
+		logger.Infof("Provisioned %d agent(s) from %s", len(result.Created), path)
+	}
+}
+
+func parseInventory(data []byte) (inventory, error) {
+	var inv inventory
+	if err := yaml.Unmarshal(data, &inv); err != nil {
+		return inventory{}, fmt.Errorf("invalid inventory: %w", err)
+	}
+	if len(inv.Agents) == 0 {
+		return inventory{}, fmt.Errorf("the inventory lists no agents")
+	}
+	return inv, nil
+}
+
+// importInventory creates the inventory's agents that are not registered
+// yet, matched by UUID or else by name. They show as never connected until
+// their first connection.
+func (h *Handler) importInventory(inv inventory) inventoryResult {
+	result := inventoryResult{Created: []AgentConfigResponse{}, Skipped: []string{}, Errors: map[string]string{}}
+	seen := make(map[string]bool, len(inv.Agents))
+	for i, entry := range inv.Agents {
+		name := strings.TrimSpace(entry.Name)
+		if name == "" {
+			result.Errors[fmt.Sprintf("#%d", i+1)] = "agent name is required"
+			continue
+		}
+		if seen[name] {
+			result.Errors[name] = "listed more than once"
+			continue
+		}
+		seen[name] = true
+
+		if entry.UUID != "" {
+			if _, err := uuid.Parse(entry.UUID); err != nil {
+				result.Errors[name] = "invalid uuid"
+				continue
+			}
+			if _, err := h.store.GetAgentByUUID(entry.UUID); err == nil {
+				result.Skipped = append(result.Skipped, name)
+				continue
+			}
+		}
+		if _, err := h.store.GetAgentByName(name); err == nil {
+			result.Skipped = append(result.Skipped, name)
+			continue
+		}
+
+		record, err := h.provisionAgent(entry)
+		if err != nil {
+			result.Errors[name] = err.Error()
+			continue
+		}
+		h.syncStoredAgent(*record)
+		result.Created = append(result.Created, agentRecordToResponse(*record))
+	}
+	if len(result.Errors) == 0 {
+		result.Errors = nil
+	}
+	return result
+}
+
+// provisionAgent stores one new inventory agent.
+func (h *Handler) provisionAgent(entry inventoryAgent) (*serverstore.AgentRecord, error) {
+	payload := AgentConfigPayload{
+		UUID:        entry.UUID,
+		Token:       entry.Token,
+		Name:        strings.TrimSpace(entry.Name),
+		Group:       strings.TrimSpace(entry.Group),
+		Details:     entry.Details,
+		DialAddress: entry.DialAddress,
+	}
+	if from := strings.TrimSpace(entry.CommandsFrom); from != "" {
+		source, err := h.store.GetAgentByName(from)
+		if err != nil {
+			return nil, fmt.Errorf("commands_from: no agent named %q", from)
+		}
+		payload.Commands = source.Commands
+	} else {
+		for i, cmd := range config.DefaultCommands {
+			payload.Commands = append(payload.Commands, serverstore.CommandRecord{
+				Name:          cmd.Name,
+				Template:      cmd.Template.Template,
+				UsePlugin:     cmd.Template.UsePlugin,
+				MaximumQueue:  cmd.Template.MaximumQueue,
+				OrderIndex:    i,
+				ExampleTarget: cmd.Template.ExampleTarget,
+				HelpText:      cmd.Template.HelpText,
+				Category:      cmd.Template.Category,
+				TargetType:    cmd.Template.TargetType,
+			})
+		}
+	}
+	if err := validateAgentPayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if payload.UUID == "" {
+		payload.UUID = uuid.NewString()
+	}
+	if payload.Token == "" {
+		token, err := GenerateRandomString(32)
+		if err != nil {
+			return nil, fmt.Errorf("generate token: %w", err)
+		}
+		payload.Token = token
+	}
+	return h.store.UpsertAgent(serverstore.AgentUpsertInput{
+		UUID:        payload.UUID,
+		Token:       payload.Token,
+		Name:        payload.Name,
+		Group:       payload.Group,
+		Details:     payload.Details,
+		Commands:    payload.Commands,
+		DialAddress: payload.DialAddress,
+	})
+}
+
+// handleControlAgentsImport handles POST /api/control/agents/import - an
+// inventory (YAML or JSON) whose agents that are not registered yet are
+// created. The response lists the created agents with their tokens.
+func (h *Handler) handleControlAgentsImport(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, inventoryMaxBody+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) > inventoryMaxBody {
+		http.Error(w, "Inventory too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	inv, err := parseInventory(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := h.importInventory(inv)
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -8,19 +8,23 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"YALS/internal/agent"
-	"YALS/internal/config"
-	"YALS/internal/logger"
-	"YALS/internal/plugin"
-	serverstore "YALS/internal/store/server"
-	"YALS/internal/utils"
-	"YALS/internal/validator"
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/utils"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
 
 	"github.com/google/uuid"
 )
@@ -72,18 +76,38 @@ type AppVersion struct {
 }
 
 type NodesResponse struct {
-	Version      string           `json:"version"`
-	TotalNodes   int              `json:"total_nodes"`
-	OnlineNodes  int              `json:"online_nodes"`
-	OfflineNodes int              `json:"offline_nodes"`
-	Groups       []map[string]any `json:"groups"`
+	Version      string `json:"version"`
+	TotalNodes   int    `json:"total_nodes"`
+	OnlineNodes  int    `json:"online_nodes"`
+	OfflineNodes int    `json:"offline_nodes"`
+	// Commands running on and waiting for all agents; each agent in Groups
+	// carries its own active_commands and queued_commands.
+	ActiveCommands int              `json:"active_commands"`
+	QueuedCommands int              `json:"queued_commands"`
+	Groups         []map[string]any `json:"groups"`
+	Legal          *LegalNotice     `json:"legal,omitempty"`
+	// Preferences are the caller's favorites and recent targets, when
+	// server-side preferences are enabled (see preferences.go).
+	Preferences *serverstore.ClientPreferences `json:"preferences,omitempty"`
+	// SuggestedAgent is the online agent nearest to the caller, when
+	// geolocation is enabled and the caller could be located (see geo.go).
+	SuggestedAgent string `json:"suggested_agent,omitempty"`
+	// Features are the feature flags of the deployment, for frontends to
+	// feature-detect rather than compare versions (see features.go).
+	Features map[string]bool `json:"features"`
 }
 
 type ExecRequest struct {
-	Agent     string `json:"agent"`
-	Command   string `json:"command"`
-	Target    string `json:"target"`
+	Agent   string `json:"agent"`
+	Command string `json:"command"`
+	Target  string `json:"target"`
+	// IPVersion is "auto", "ipv4", "ipv6" or "dual" (see dualstack.go).
 	IPVersion string `json:"ip_version"`
+	// View is the view of the command to run from, such as a source
+	// address or VRF, by name; empty runs the command as configured.
+	View string `json:"view,omitempty"`
+	// CallbackURL, if set, receives the signed final result (see callback.go).
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
 type StopRequest struct {
@@ -108,7 +132,9 @@ type RuntimeSettingsResponse struct {
 		Enabled     bool `json:"enabled"`
 		MaxCommands int  `json:"max_commands"`
 		TimeWindow  int  `json:"time_window"`
+		Shadow      bool `json:"shadow"`
 	} `json:"rate_limit"`
+	Legal config.LegalSettings `json:"legal"`
 }
 
 type RuntimeSettingsPayload struct {
@@ -120,7 +146,9 @@ type RuntimeSettingsPayload struct {
 		Enabled     bool `json:"enabled"`
 		MaxCommands int  `json:"max_commands"`
 		TimeWindow  int  `json:"time_window"`
+		Shadow      bool `json:"shadow"`
 	} `json:"rate_limit"`
+	Legal config.LegalSettings `json:"legal"`
 }
 
 type AgentConfigPayload struct {
@@ -130,17 +158,24 @@ type AgentConfigPayload struct {
 	Group    string                      `json:"group"`
 	Details  config.AgentDetails         `json:"details"`
 	Commands []serverstore.CommandRecord `json:"commands"`
+	// DialAddress (host:port) is where the server dials an agent that
+	// listens for it (agent -listen); empty when the agent connects.
+	DialAddress string `json:"dial_address,omitempty"`
 }
 
 type AgentConfigResponse struct {
-	UUID      string                      `json:"uuid"`
-	Token     string                      `json:"token"`
-	Name      string                      `json:"name"`
-	Group     string                      `json:"group"`
-	Details   config.AgentDetails         `json:"details"`
-	Commands  []serverstore.CommandRecord `json:"commands"`
-	CreatedAt string                      `json:"created_at"`
-	UpdatedAt string                      `json:"updated_at"`
+	UUID        string                      `json:"uuid"`
+	Token       string                      `json:"token"`
+	Name        string                      `json:"name"`
+	Group       string                      `json:"group"`
+	Details     config.AgentDetails         `json:"details"`
+	Commands    []serverstore.CommandRecord `json:"commands"`
+	CreatedAt   string                      `json:"created_at"`
+	UpdatedAt   string                      `json:"updated_at"`
+	DialAddress string                      `json:"dial_address,omitempty"`
+	DeletedAt   string                      `json:"deleted_at,omitempty"`
+	// NeverConnected marks a provisioned agent that has not connected yet.
+	NeverConnected bool `json:"never_connected,omitempty"`
 }
 
 func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -151,7 +186,11 @@ func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
 		"/probes", "/probes/", "/probes.html":
 		// Single-page app: every client-side route is served the same
 		// index.html, which dispatches on window.location.pathname.
-		http.ServeFile(w, r, filepath.Join(h.webDir, "index.html"))
+		if h.fallbackPage != nil {
+			h.serveFallbackPage(w)
+			return
+		}
+		h.serveIndexHTML(w, r)
 		return
 	default:
 		filePath := filepath.Join(h.webDir, r.URL.Path[1:])
@@ -162,7 +201,7 @@ func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
 
 		accept := r.Header.Get("Accept")
 		if accept != "" && !strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/xhtml+xml") {
-			http.ServeFile(w, r, filepath.Join(h.webDir, "index.html"))
+			h.serveIndexHTML(w, r)
 			return
 		}
 
@@ -175,7 +214,7 @@ func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
 // because otherwise any client can spoof them to forge logs or bypass per-IP
 // rate limiting. Without that flag we fall back to the connection's RemoteAddr.
 func (h *Handler) getRealIP(r *http.Request) string {
-	if cfg := config.GetConfig(); cfg != nil && cfg.Server.TrustProxyHeaders {
+	if h.trustsProxyHeaders() {
 		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
 			return ip
 		}
@@ -195,6 +234,13 @@ func (h *Handler) getRealIP(r *http.Request) string {
 	return host
 }
 
+// trustsProxyHeaders reports whether the operator enabled trust_proxy_headers,
+// i.e. requests come through a reverse proxy that sets the proxy headers.
+func (h *Handler) trustsProxyHeaders() bool {
+	cfg := config.GetConfig()
+	return cfg != nil && cfg.Server.TrustProxyHeaders
+}
+
 // generateCommandID builds the stable identifier for one command execution. The
 // per-client sessionID is part of the key on purpose: the same command+target on
 // the same agent, issued from different clients (browser tabs), must map to
@@ -205,9 +251,19 @@ func (h *Handler) generateCommandID(command, target, agentName, sessionID string
 	return fmt.Sprintf("%s-%s-%s-%s", command, target, agentName, sessionID)
 }
 
-func (h *Handler) setActiveCommand(commandID string, stopChan chan bool) {
+// activeCommand is one command currently executing on behalf of a web client.
+type activeCommand struct {
+	stop     chan bool
+	agent    string
+	command  string
+	target   string
+	clientIP string
+	started  time.Time
+}
+
+func (h *Handler) setActiveCommand(commandID string, cmd *activeCommand) {
 	h.commandsLock.Lock()
-	h.activeCommands[commandID] = stopChan
+	h.activeCommands[commandID] = cmd
 	h.commandsLock.Unlock()
 }
 
@@ -221,8 +277,8 @@ func (h *Handler) stopActiveCommand(commandID string) bool {
 	h.commandsLock.Lock()
 	defer h.commandsLock.Unlock()
 
-	if stopChan, exists := h.activeCommands[commandID]; exists {
-		close(stopChan)
+	if cmd, exists := h.activeCommands[commandID]; exists {
+		close(cmd.stop)
 		delete(h.activeCommands, commandID)
 		return true
 	}
@@ -230,18 +286,59 @@ func (h *Handler) stopActiveCommand(commandID string) bool {
 }
 
 func (h *Handler) getCommandConfig(agentName, commandName string) (config.CommandInfo, bool) {
-	agents := h.agentManager.GetAgents()
-	for _, a := range agents {
-		if a["name"] == agentName {
-			agentCommands := h.agentManager.GetAgentCommands(agentName)
-			for _, cmd := range agentCommands {
-				if cmd.Name == commandName {
-					return h.agentManager.GetCommandConfigInternal(agentName, commandName)
-				}
-			}
+	return h.agentManager.GetCommandConfigInternal(agentName, commandName)
+}
+
+// commandTargetType returns the validator a command's target goes through,
+// honoring a plugin's ignore_target override over the command's own flag and
+// the plugin's target type when the command sets none.
+func (h *Handler) commandTargetType(agentName, commandName string) validator.TargetType {
+	cmdConfig, exists := h.getCommandConfig(agentName, commandName)
+	if !exists {
+		return validator.TargetHost
+	}
+	ignoreTarget, targetType := cmdConfig.IgnoreTarget, cmdConfig.TargetType
+	if cmdConfig.UsePlugin != "" {
+		if hasOverride, pluginIgnore := plugin.GetPluginIgnoreTarget(cmdConfig.UsePlugin); hasOverride {
+			ignoreTarget = pluginIgnore
+		}
+		if targetType == "" {
+			targetType = plugin.GetPluginTargetType(cmdConfig.UsePlugin)
 		}
 	}
-	return config.CommandInfo{}, false
+	return validator.CommandTargetType(targetType, ignoreTarget)
+}
+
+// commandRequiresTarget reports whether a command takes a target.
+func (h *Handler) commandRequiresTarget(agentName, commandName string) bool {
+	return h.commandTargetType(agentName, commandName) != validator.TargetNone
+}
+
+// validateTarget validates the target a command would run against (see
+// commandTarget) with the command's validator. Commands without a target get
+// a TargetNone result whatever the client sent.
+func (h *Handler) validateTarget(agentName, commandName, target string) (validator.Target, error) {
+	targetType := h.commandTargetType(agentName, commandName)
+	if targetType == validator.TargetNone {
+		return validator.Target{Type: validator.TargetNone}, nil
+	}
+	return validator.Validate(targetType, h.commandTarget(agentName, commandName, target))
+}
+
+// blockedTarget applies the target blocklist to the host a target names;
+// targets without one (AS numbers, ports) are never blocked.
+func (h *Handler) blockedTarget(target validator.Target) bool {
+	return target.Host != "" && h.targetBlocked(target.Host)
+}
+
+// commandTarget returns the target to run a command against: the client's,
+// or the command's default_target when the client omitted it.
+func (h *Handler) commandTarget(agentName, commandName, target string) string {
+	if target = strings.TrimSpace(target); target != "" {
+		return target
+	}
+	cmdConfig, _ := h.getCommandConfig(agentName, commandName)
+	return cmdConfig.DefaultTarget
 }
 
 func (h *Handler) setNoCacheHeaders(w http.ResponseWriter) {
@@ -249,8 +346,6 @@ func (h *Handler) setNoCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
 	w.Header().Set("X-Accel-Buffering", "no")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 }
 
@@ -300,14 +395,18 @@ func (h *Handler) handleGetNodes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats := h.agentManager.GetAgentStats()
 	response := NodesResponse{
-		Version:      utils.GetAppVersion(),
-		TotalNodes:   stats["total"].(int),
-		OnlineNodes:  stats["online"].(int),
-		OfflineNodes: stats["offline"].(int),
-		Groups:       h.agentManager.GetAgentGroups(),
+		Version:  utils.GetAppVersion(),
+		Groups:   h.agentManager.GetAgentGroupsForViewer(h.isAuthenticatedViewer(r)),
+		Legal:    h.legalNotice(sessionID),
+		Features: h.enabledFeatures(),
 	}
+	countNodes(&response)
+	h.applyUILayout(response.Groups)
+	h.applyNotes(response.Groups)
+	response.Preferences = h.clientPreferences(w, r)
+	response.SuggestedAgent = h.suggestedAgent(r, response.Groups)
+	h.issueClientID(w, r)
 
 	w.Header().Set("Content-Type", "application/json")
 	h.setNoCacheHeaders(w)
@@ -317,6 +416,26 @@ func (h *Handler) handleGetNodes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// countNodes fills in the node and command counts of response from its
+// groups, so that they only cover the agents the viewer may see.
+func countNodes(response *NodesResponse) {
+	for _, group := range response.Groups {
+		agents, _ := group["agents"].([]map[string]any)
+		for _, agentInfo := range agents {
+			response.TotalNodes++
+			if status, _ := agentInfo["status"].(int); status == 1 {
+				response.OnlineNodes++
+			} else {
+				response.OfflineNodes++
+			}
+			active, _ := agentInfo["active_commands"].(int)
+			queued, _ := agentInfo["queued_commands"].(int)
+			response.ActiveCommands += active
+			response.QueuedCommands += queued
+		}
+	}
+}
+
 // handleVersion exposes the application version as public, unauthenticated build
 // info so every page's shared footer can render it without a session.
 func (h *Handler) handleVersion(w http.ResponseWriter, r *http.Request) {
@@ -390,6 +509,8 @@ func (h *Handler) handleControlRuntime(w http.ResponseWriter, r *http.Request) {
 		response.RateLimit.Enabled = settings.RateLimit.Enabled
 		response.RateLimit.MaxCommands = settings.RateLimit.MaxCommands
 		response.RateLimit.TimeWindow = settings.RateLimit.TimeWindow
+		response.RateLimit.Shadow = settings.RateLimit.Shadow
+		response.Legal = settings.Legal
 		w.Header().Set("Content-Type", "application/json")
 		h.setNoCacheHeaders(w)
 		_ = json.NewEncoder(w).Encode(response)
@@ -405,6 +526,8 @@ func (h *Handler) handleControlRuntime(w http.ResponseWriter, r *http.Request) {
 		settings.RateLimit.Enabled = payload.RateLimit.Enabled
 		settings.RateLimit.MaxCommands = payload.RateLimit.MaxCommands
 		settings.RateLimit.TimeWindow = payload.RateLimit.TimeWindow
+		settings.RateLimit.Shadow = payload.RateLimit.Shadow
+		settings.Legal = payload.Legal
 		saved, err := h.store.UpsertRuntimeSettings(settings)
 		if err != nil {
 			http.Error(w, "Failed to persist runtime settings", http.StatusInternalServerError)
@@ -417,6 +540,8 @@ func (h *Handler) handleControlRuntime(w http.ResponseWriter, r *http.Request) {
 		response.RateLimit.Enabled = saved.RateLimit.Enabled
 		response.RateLimit.MaxCommands = saved.RateLimit.MaxCommands
 		response.RateLimit.TimeWindow = saved.RateLimit.TimeWindow
+		response.RateLimit.Shadow = saved.RateLimit.Shadow
+		response.Legal = saved.Legal
 		w.Header().Set("Content-Type", "application/json")
 		h.setNoCacheHeaders(w)
 		_ = json.NewEncoder(w).Encode(response)
@@ -438,6 +563,60 @@ type PluginInfo struct {
 	MaximumQueueOverridden bool   `json:"maximum_queue_overridden"`
 }
 
+// handleControlMetrics exposes internal health counters to the control panel.
+func (h *Handler) handleControlMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	active, orphaned := h.agentManager.OutputHandlerStats()
+	pendingHandshakes, rejectedHandshakes, slowHandshakes := h.handshakeStats()
+	connectedAgents, rejectedAgents := h.agentManager.AgentLimitStats()
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"output_handlers_active":   active,
+		"output_handlers_orphaned": orphaned,
+		"commands_killed":          h.agentManager.DeadlineKills(),
+		"reports_dropped":          atomic.LoadUint64(&h.reportsDropped),
+		"commands_started":         atomic.LoadUint64(&h.commandsStarted),
+		"commands_finished":        atomic.LoadUint64(&h.commandsFinished),
+		"commands_failed":          atomic.LoadUint64(&h.commandsFailed),
+		"events_dropped":           h.agentManager.Events().Dropped(),
+		"blocked_ips":              atomic.LoadUint64(&h.access.blockedIPs),
+		"blocked_targets":          atomic.LoadUint64(&h.access.blockedTargets),
+		"reputation":               h.reputation.metrics(),
+		"handshakes_pending":       pendingHandshakes,
+		"handshakes_rejected":      rejectedHandshakes,
+		"handshakes_slow":          slowHandshakes,
+		"web_clients":              h.limits.webClients.Load(),
+		"web_clients_rejected":     h.limits.rejected.Load(),
+		"requests_too_large":       h.requests.tooLarge.Load(),
+		"stream_opens_rejected":    h.requests.opensRejected.Load(),
+		"api_requests_throttled":   h.requests.apiThrottled.Load(),
+		"web_clients_idle_closed":  h.idle.closed.Load(),
+		"agents_connected":         connectedAgents,
+		"agents_rejected":          rejectedAgents,
+		"agents_flapping":          h.agentManager.FlappingAgents(),
+		"agents_never_connected":   h.agentManager.GetAgentStats()["never_connected"],
+		"catalog_mismatches":       h.catalogs.mismatches.Load(),
+		"shadow":                   h.shadowMetrics(),
+		"results_archived":         h.resultsArchived.Load(),
+		"pruned_route_results":     h.retention.prunedResults.Load(),
+		"pruned_probe_events":      h.retention.prunedProbeEvents.Load(),
+		"pruned_usage_hours":       h.retention.prunedUsage.Load(),
+		"pruned_quota_counts":      h.retention.prunedQuotaCounts.Load(),
+		"pruned_probe_rollups":     h.retention.prunedProbeRollups.Load(),
+		"pruned_abuse_reports":     h.retention.prunedReports.Load(),
+		"all_time":                 h.allTimeTotals(),
+		"output_latency":           h.outputLatency.metrics(),
+	})
+}
+
 func (h *Handler) handleControlPlugins(w http.ResponseWriter, r *http.Request) {
 	if !h.requireControlAuth(w, r) {
 		return
@@ -554,14 +733,124 @@ func (h *Handler) handleControlListAgents(w http.ResponseWriter) {
 // the store, so the operator gets a precise error instead of the store silently
 // normalizing away empty or duplicate commands (which could otherwise persist an
 // agent with zero usable commands, or a command that references a plugin that
-// does not exist).
-func validateAgentPayload(payload AgentConfigPayload) error {
+// does not exist). It normalizes the agent's ASN.
+// Limits of a command's environment (see validateCommandEnvironment).
+const (
+	commandMaxEnv      = 32
+	commandMaxEnvValue = 1024
+	commandMaxWorkDir  = 256
+)
+
+// validateCommandEnvironment checks a command's working directory,
+// environment, priority, container and network namespace, which only shell
+// templates may set.
+func validateCommandEnvironment(cmd serverstore.CommandRecord) error {
+	if strings.TrimSpace(cmd.UsePlugin) != "" {
+		if cmd.WorkDir != "" || len(cmd.Env) > 0 || len(cmd.EnvPassthrough) > 0 || cmd.Nice != 0 || cmd.IOClass != "" || cmd.Container != "" || cmd.NetNS != "" {
+			return fmt.Errorf("working directory, environment, priority, container and network namespace apply to shell templates only")
+		}
+		return nil
+	}
+	if dir := cmd.WorkDir; dir != "" {
+		if len(dir) > commandMaxWorkDir || !(path.IsAbs(dir) || filepath.IsAbs(dir)) {
+			return fmt.Errorf("working directory must be an absolute path")
+		}
+	}
+	if len(cmd.Env)+len(cmd.EnvPassthrough) > commandMaxEnv {
+		return fmt.Errorf("at most %d environment variables", commandMaxEnv)
+	}
+	for name, value := range cmd.Env {
+		if !config.ValidEnvName(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		if len(value) > commandMaxEnvValue || strings.ContainsAny(value, "\x00\n") {
+			return fmt.Errorf("environment variable %s: value too long or multi-line", name)
+		}
+	}
+	for _, name := range cmd.EnvPassthrough {
+		if !config.ValidEnvName(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	if cmd.Nice < 0 || cmd.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19")
+	}
+	if cmd.IOClass != "" && !slices.Contains(config.IOClasses, cmd.IOClass) {
+		return fmt.Errorf("io class must be one of %s", strings.Join(config.IOClasses, ", "))
+	}
+	if cmd.IOPriority < 0 || cmd.IOPriority > 7 || (cmd.IOPriority != 0 && cmd.IOClass != "best-effort") {
+		return fmt.Errorf("io priority must be between 0 and 7, with the best-effort class")
+	}
+	if cmd.Container != "" && cmd.NetNS != "" {
+		return fmt.Errorf("a command runs in a container or a network namespace, not both")
+	}
+	if cmd.Container != "" && !config.ValidExecContextName(cmd.Container) {
+		return fmt.Errorf("invalid container name %q", cmd.Container)
+	}
+	if cmd.Container != "" && (cmd.Nice != 0 || cmd.IOClass != "") {
+		return fmt.Errorf("nice and io class do not apply inside a container")
+	}
+	if cmd.NetNS != "" && !config.ValidExecContextName(cmd.NetNS) {
+		return fmt.Errorf("invalid network namespace name %q", cmd.NetNS)
+	}
+	return nil
+}
+
+// validateCommandViews checks the views of a command, which only shell
+// templates may have.
+func validateCommandViews(cmd serverstore.CommandRecord) error {
+	if len(cmd.Views) == 0 {
+		return nil
+	}
+	if strings.TrimSpace(cmd.UsePlugin) != "" {
+		return fmt.Errorf("views apply to shell templates only")
+	}
+	if len(cmd.Views) > config.MaxCommandViews {
+		return fmt.Errorf("at most %d views", config.MaxCommandViews)
+	}
+	seen := make(map[string]bool, len(cmd.Views))
+	for _, view := range cmd.Views {
+		name := strings.TrimSpace(view.Name)
+		if !config.ValidExecContextName(name) {
+			return fmt.Errorf("invalid view name %q", view.Name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate view %q", name)
+		}
+		seen[name] = true
+		if len(view.Label) > 64 {
+			return fmt.Errorf("view %s: label is too long", name)
+		}
+		if !config.ValidViewArgs(view.Args) {
+			return fmt.Errorf("view %s: arguments may only hold letters, digits, spaces and _.:/%%@=,+-", name)
+		}
+		if vrf := strings.TrimSpace(view.VRF); vrf != "" {
+			if !config.ValidExecContextName(vrf) {
+				return fmt.Errorf("view %s: invalid VRF name %q", name, vrf)
+			}
+			if cmd.Container != "" {
+				return fmt.Errorf("view %s: a VRF does not apply inside a container", name)
+			}
+		}
+	}
+	return nil
+}
+
+func validateAgentPayload(payload *AgentConfigPayload) error {
 	if strings.TrimSpace(payload.Name) == "" {
 		return fmt.Errorf("agent name is required")
 	}
 	if len(payload.Commands) == 0 {
 		return fmt.Errorf("at least one command is required")
 	}
+	if addr := strings.TrimSpace(payload.DialAddress); addr != "" {
+		if err := validateDialAddress(addr); err != nil {
+			return fmt.Errorf("dial address: %v", err)
+		}
+	}
+	if err := validateAgentDetails(&payload.Details); err != nil {
+		return fmt.Errorf("details: %v", err)
+	}
 
 	seen := make(map[string]bool, len(payload.Commands))
 	for i, cmd := range payload.Commands {
@@ -584,6 +873,78 @@ func validateAgentPayload(payload AgentConfigPayload) error {
 				return fmt.Errorf("command %q: unknown plugin %q", name, usePlugin)
 			}
 		}
+		if cmd.Weight < 0 || cmd.Weight > 1000 {
+			return fmt.Errorf("command %q: weight must be between 0 and 1000", name)
+		}
+		if cmd.CacheSeconds < 0 || cmd.CacheSeconds > 86400 {
+			return fmt.Errorf("command %q: cache seconds must be between 0 and 86400", name)
+		}
+		if cmd.CacheSeconds > 0 && !cmd.IgnoreTarget {
+			return fmt.Errorf("command %q: only commands that ignore the target can be cached", name)
+		}
+		if signal := cmd.StopSignal; signal != "" && !slices.Contains(config.StopSignals, signal) {
+			return fmt.Errorf("command %q: stop signal must be one of %s", name, strings.Join(config.StopSignals, ", "))
+		}
+		if cmd.StopGraceSeconds < 0 || cmd.StopGraceSeconds > config.MaxStopGraceSeconds {
+			return fmt.Errorf("command %q: stop grace seconds must be between 0 and %d", name, config.MaxStopGraceSeconds)
+		}
+		if usePlugin != "" && (cmd.StopSignal != "" || cmd.StopGraceSeconds != 0 || cmd.StopProcessGroup) {
+			return fmt.Errorf("command %q: stop options apply to shell templates only", name)
+		}
+		if err := validateCommandEnvironment(cmd); err != nil {
+			return fmt.Errorf("command %q: %v", name, err)
+		}
+		if err := validateCommandViews(cmd); err != nil {
+			return fmt.Errorf("command %q: %v", name, err)
+		}
+		if len(cmd.Category) > 32 || len(cmd.ExampleTarget) > 256 || len(cmd.HelpText) > 512 {
+			return fmt.Errorf("command %q: category, example target or help text is too long", name)
+		}
+		if !validator.KnownTargetType(cmd.TargetType) {
+			return fmt.Errorf("command %q: unknown target type %q", name, cmd.TargetType)
+		}
+		if target := strings.TrimSpace(cmd.DefaultTarget); target != "" && !cmd.IgnoreTarget {
+			targetType := cmd.TargetType
+			if targetType == "" && usePlugin != "" {
+				targetType = plugin.GetPluginTargetType(usePlugin)
+			}
+			if _, err := validator.Validate(validator.CommandTargetType(targetType, false), target); err != nil {
+				return fmt.Errorf("command %q: default target: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// agentDetailMaxLength bounds the free-text details of an agent.
+const agentDetailMaxLength = 128
+
+// validateAgentDetails checks the details an agent lists for users and
+// writes its ASN as "AS64500".
+func validateAgentDetails(d *config.AgentDetails) error {
+	if len(d.Provider) > agentDetailMaxLength || len(d.Bandwidth) > agentDetailMaxLength {
+		return fmt.Errorf("provider and bandwidth must not exceed %d characters", agentDetailMaxLength)
+	}
+	if raw := strings.TrimSpace(d.ASN); raw != "" {
+		if d.ASN = normalizeASN(raw); d.ASN == "" {
+			return fmt.Errorf("invalid ASN %q", raw)
+		}
+	}
+	if d.IPv4 = strings.TrimSpace(d.IPv4); d.IPv4 != "" {
+		if ip := net.ParseIP(d.IPv4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", d.IPv4)
+		}
+	}
+	if d.IPv6 = strings.TrimSpace(d.IPv6); d.IPv6 != "" {
+		if ip := net.ParseIP(d.IPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", d.IPv6)
+		}
+	}
+	if d.LinkURL = strings.TrimSpace(d.LinkURL); d.LinkURL != "" {
+		u, err := url.Parse(d.LinkURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("link URL must be an absolute http(s) URL")
+		}
 	}
 	return nil
 }
@@ -595,7 +956,7 @@ func (h *Handler) handleControlCreateAgent(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := validateAgentPayload(payload); err != nil {
+	if err := validateAgentPayload(&payload); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -611,12 +972,13 @@ func (h *Handler) handleControlCreateAgent(w http.ResponseWriter, r *http.Reques
 		payload.Token = generatedToken
 	}
 	record, err := h.store.UpsertAgent(serverstore.AgentUpsertInput{
-		UUID:     payload.UUID,
-		Token:    payload.Token,
-		Name:     payload.Name,
-		Group:    payload.Group,
-		Details:  payload.Details,
-		Commands: payload.Commands,
+		UUID:        payload.UUID,
+		Token:       payload.Token,
+		Name:        payload.Name,
+		Group:       payload.Group,
+		Details:     payload.Details,
+		Commands:    payload.Commands,
+		DialAddress: payload.DialAddress,
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -637,18 +999,28 @@ func (h *Handler) handleControlUpdateAgent(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := validateAgentPayload(payload); err != nil {
+	if err := validateAgentPayload(&payload); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// A new name takes the agent's history along.
+	name := strings.TrimSpace(payload.Name)
+	if existing, err := h.store.GetAgentByUUID(uuidValue); err == nil && existing.Name != name {
+		if _, err := h.renameAgent(existing.Name, name, false); err != nil {
+			h.renameError(w, existing.Name, name, false, err)
+			return
+		}
+	}
+
 	record, err := h.store.UpsertAgent(serverstore.AgentUpsertInput{
-		UUID:     uuidValue,
-		Token:    payload.Token,
-		Name:     payload.Name,
-		Group:    payload.Group,
-		Details:  payload.Details,
-		Commands: payload.Commands,
+		UUID:        uuidValue,
+		Token:       payload.Token,
+		Name:        payload.Name,
+		Group:       payload.Group,
+		Details:     payload.Details,
+		Commands:    payload.Commands,
+		DialAddress: payload.DialAddress,
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -672,12 +1044,93 @@ func (h *Handler) handleControlDeleteAgent(w http.ResponseWriter, uuidValue stri
 	}
 
 	_ = h.agentManager.DisconnectAgent(uuidValue)
-	_ = h.store.DeleteAgentMetrics(uuidValue)
+	h.changes.forgetProbeAgent(uuidValue)
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]any{"success": true})
 }
 
+// handleControlDeletedAgents handles the deleted agents, which are kept with
+// their history until purged:
+//
+//	GET    /api/control/agents/deleted        list them, most recent first
+//	POST   /api/control/agents/deleted/<uuid> restore one
+//	DELETE /api/control/agents/deleted/<uuid> purge one for good
+func (h *Handler) handleControlDeletedAgents(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+
+	uuidValue := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/control/agents/deleted"), "/")
+	switch {
+	case uuidValue == "" && r.Method == http.MethodGet:
+		records, err := h.store.ListDeletedAgents()
+		if err != nil {
+			logger.Errorf("Failed to list deleted agents: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response := make([]AgentConfigResponse, 0, len(records))
+		for _, record := range records {
+			response = append(response, agentRecordToResponse(record))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(response)
+	case uuidValue != "" && r.Method == http.MethodPost:
+		h.handleControlRestoreAgent(w, uuidValue)
+	case uuidValue != "" && r.Method == http.MethodDelete:
+		if err := h.store.PurgeAgent(uuidValue); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Deleted agent not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		h.agentManager.RemoveAgent(uuidValue)
+		_ = h.store.DeleteAgentMetrics(uuidValue)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleControlRestoreAgent brings a deleted agent back, unless another agent
+// took its name meanwhile. The agent can connect again right away.
+func (h *Handler) handleControlRestoreAgent(w http.ResponseWriter, uuidValue string) {
+	deleted, err := h.store.ListDeletedAgents()
+	if err != nil {
+		logger.Errorf("Failed to list deleted agents: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	idx := slices.IndexFunc(deleted, func(record serverstore.AgentRecord) bool { return record.UUID == uuidValue })
+	if idx < 0 {
+		http.Error(w, "Deleted agent not found", http.StatusNotFound)
+		return
+	}
+	if _, err := h.store.GetAgentByName(deleted[idx].Name); err == nil {
+		http.Error(w, fmt.Sprintf("Another agent is named %q; rename it first", deleted[idx].Name), http.StatusConflict)
+		return
+	}
+
+	record, err := h.store.RestoreAgent(uuidValue)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Deleted agent not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.syncStoredAgent(*record)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(agentRecordToResponse(*record))
+}
+
 func (h *Handler) getControlToken(r *http.Request) string {
 	authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
 	if strings.HasPrefix(strings.ToLower(authHeader), "bearer ") {
@@ -705,6 +1158,12 @@ func (h *Handler) validateControlToken(token string) bool {
 	return true
 }
 
+// isAuthenticatedViewer reports whether a public API request carries a valid
+// control-panel token, which lifts the anonymous visibility rules.
+func (h *Handler) isAuthenticatedViewer(r *http.Request) bool {
+	return h.validateControlToken(h.getControlToken(r))
+}
+
 func (h *Handler) requireControlAuth(w http.ResponseWriter, r *http.Request) bool {
 	if !h.validateControlToken(h.getControlToken(r)) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -717,23 +1176,103 @@ func (h *Handler) syncStoredAgent(record serverstore.AgentRecord) {
 	bootstrapCfg := config.GetConfig()
 	runtimeConfig := serverstore.BuildRuntimeConfig(bootstrapCfg.Server.Host, bootstrapCfg.Server.Port, record, bootstrapCfg.Server.LogLevel)
 	h.agentManager.RegisterAgent(agent.AgentRegistration{
-		UUID:     record.UUID,
-		Name:     record.Name,
-		Group:    record.Group,
-		Details:  record.Details,
-		Commands: runtimeConfig.GetAvailableCommands(),
+		UUID:           record.UUID,
+		Name:           record.Name,
+		Group:          record.Group,
+		Details:        record.Details,
+		Commands:       runtimeConfig.GetAvailableCommands(),
+		NeverConnected: record.NeverConnected,
 	}, nil)
 }
 
 func agentRecordToResponse(record serverstore.AgentRecord) AgentConfigResponse {
-	return AgentConfigResponse{
-		UUID:      record.UUID,
-		Token:     record.Token,
-		Name:      record.Name,
-		Group:     record.Group,
-		Details:   record.Details,
-		Commands:  record.Commands,
-		CreatedAt: record.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: record.UpdatedAt.Format(time.RFC3339),
+	response := AgentConfigResponse{
+		UUID:           record.UUID,
+		Token:          record.Token,
+		Name:           record.Name,
+		Group:          record.Group,
+		Details:        record.Details,
+		Commands:       record.Commands,
+		CreatedAt:      record.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:      record.UpdatedAt.Format(time.RFC3339),
+		DialAddress:    record.DialAddress,
+		NeverConnected: record.NeverConnected,
+	}
+	if !record.DeletedAt.IsZero() {
+		response.DeletedAt = record.DeletedAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+// ActiveCommandInfo describes a running command in the admin live view.
+type ActiveCommandInfo struct {
+	CommandID      string `json:"command_id"`
+	Agent          string `json:"agent"`
+	Command        string `json:"command"`
+	Target         string `json:"target"`
+	ClientIP       string `json:"client_ip"`
+	StartedAt      string `json:"started_at"`
+	RuntimeSeconds int64  `json:"runtime_seconds"`
+}
+
+// handleControlCommands handles GET /api/control/commands - lists every command
+// currently running across all agents, oldest first.
+func (h *Handler) handleControlCommands(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+
+	now := time.Now()
+	h.commandsLock.RLock()
+	list := make([]ActiveCommandInfo, 0, len(h.activeCommands))
+	for id, cmd := range h.activeCommands {
+		list = append(list, ActiveCommandInfo{
+			CommandID:      id,
+			Agent:          cmd.agent,
+			Command:        cmd.command,
+			Target:         cmd.target,
+			ClientIP:       cmd.clientIP,
+			StartedAt:      cmd.started.Format(time.RFC3339),
+			RuntimeSeconds: int64(now.Sub(cmd.started).Seconds()),
+		})
+	}
+	h.commandsLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].RuntimeSeconds > list[j].RuntimeSeconds
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// handleControlCommandByID handles DELETE /api/control/commands/{id} - force-stops
+// a running command.
+func (h *Handler) handleControlCommandByID(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commandID := strings.TrimPrefix(r.URL.Path, "/api/control/commands/")
+	if commandID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.stopActiveCommand(commandID) {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+
+	logger.Infof("Control panel force-stopped command: %s", commandID)
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "command_id": commandID})
 }
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// stopAllRequest is the body of POST /api/control/stop-all and of the
+// /api/cluster/stop-all call that repeats it on peer replicas.
+type stopAllRequest struct {
+	// Pause also sets the global execution pause (see pause.go).
+	Pause  bool   `json:"pause"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// stopAllActiveCommands stops every command this replica runs for a client.
+// Each one is stopped like a /api/stop: its stream ends as stopped and the
+// agent is told to kill it.
+func (h *Handler) stopAllActiveCommands() int {
+	h.commandsLock.Lock()
+	defer h.commandsLock.Unlock()
+	stopped := len(h.activeCommands)
+	for commandID, cmd := range h.activeCommands {
+		close(cmd.stop)
+		delete(h.activeCommands, commandID)
+	}
+	return stopped
+}
+
+// stopAll stops every active command and tells every connected agent to kill
+// whatever it still runs, including commands the server lost track of (a
+// client that disconnected mid-run, a peer that died). It returns the number
+// of commands stopped and of agents told.
+func (h *Handler) stopAll(req stopAllRequest) (int, int) {
+	if req.Pause {
+		if err := h.setExecutionPause(serverstore.ExecutionPause{Scope: pauseGlobal, Reason: req.Reason}); err != nil {
+			logger.Errorf("Failed to pause executions: %v", err)
+		}
+	}
+	stopped := h.stopAllActiveCommands()
+	agents := 0
+	for _, uuid := range h.agentManager.OnlineAgentUUIDs() {
+		if err := h.agentManager.SendToAgent(uuid, &proto.CommandMessage{Type: "stop_all"}); err != nil {
+			logger.Warnf("Failed to send stop-all to agent %s: %v", uuid, err)
+			continue
+		}
+		agents++
+	}
+	return stopped, agents
+}
+
+// handleControlStopAll handles /api/control/stop-all, the panic button for a
+// looking glass being abused (e.g. as a DDoS reflector):
+//
+//	GET    - whether executions are paused globally, since when and why
+//	POST   - stop every running command on every agent; {"pause": true,
+//	         "reason": "..."} also pauses executions globally
+//	DELETE - lift the global pause
+//
+// Peer replicas repeat the operation for the agents connected to them.
+func (h *Handler) handleControlStopAll(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+
+	var req stopAllRequest
+	response := map[string]any{"success": true}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if len(req.Reason) > 500 {
+			http.Error(w, "reason must not exceed 500 characters", http.StatusBadRequest)
+			return
+		}
+		stopped, agents := h.stopAll(req)
+		h.forwardStopAll(req)
+		logger.Warnf("Control panel stopped all commands (%d running, %d agents told, pause=%v): %s", stopped, agents, req.Pause, req.Reason)
+		response["stopped"] = stopped
+		response["agents"] = agents
+	case http.MethodDelete:
+		if _, err := h.clearExecutionPause(pauseGlobal, ""); err != nil {
+			logger.Errorf("Failed to resume executions: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		h.forwardPause(pauseRequest{Scope: pauseGlobal, Resume: true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pause, paused := h.globalPause()
+	response["paused"] = paused
+	if paused {
+		response["reason"] = pause.Reason
+		response["since"] = pause.PausedAt.UTC().Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// forwardStopAll repeats a stop-all on every peer replica.
+func (h *Handler) forwardStopAll(req stopAllRequest) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	for _, p := range h.cluster.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			peerReq, err := h.cluster.newRequest(ctx, p, "/api/cluster/stop-all", body)
+			if err != nil {
+				return
+			}
+			resp, err := p.client.Do(peerReq)
+			if err != nil {
+				logger.Warnf("Failed to forward stop-all to %s: %v", p.baseURL, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+}
+
+// handleClusterStopAll handles POST /api/cluster/stop-all - a stop-all
+// repeated by a peer replica. It never forwards again.
+func (h *Handler) handleClusterStopAll(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readClusterRequest(w, r)
+	if !ok {
+		return
+	}
+	var req stopAllRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	stopped, agents := h.stopAll(req)
+	response := map[string]any{"success": true, "stopped": stopped, "agents": agents}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// outputLatencyBounds are the upper bounds, in milliseconds, of the buckets
+// of outputLatency; the last bucket holds everything slower.
+var outputLatencyBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// outputLatency is a histogram of the time an agent's output takes from the
+// server receiving it to its event being flushed to a web client, the
+// server's share of the chunk latency a user sees.
+type outputLatency struct {
+	mu      sync.Mutex
+	buckets [13]uint64 // len(outputLatencyBounds)+1
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+}
+
+// observe records one flushed event.
+func (l *outputLatency) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(outputLatencyBounds) && ms > outputLatencyBounds[i] {
+		i++
+	}
+	l.mu.Lock()
+	l.buckets[i]++
+	l.count++
+	l.sum += d
+	if d > l.max {
+		l.max = d
+	}
+	l.mu.Unlock()
+}
+
+// metrics returns the histogram's summary for /api/control/metrics.
+// Percentiles are the upper bound of the bucket they fall in, capped at the
+// slowest event seen.
+func (l *outputLatency) metrics() map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metrics := map[string]any{"count": l.count}
+	if l.count == 0 {
+		return metrics
+	}
+	maxMs := float64(l.max) / float64(time.Millisecond)
+	percentile := func(p float64) float64 {
+		rank := uint64(p*float64(l.count) + 0.5)
+		if rank < 1 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range l.buckets {
+			if seen += n; seen >= rank && i < len(outputLatencyBounds) {
+				return min(outputLatencyBounds[i], maxMs)
+			}
+		}
+		return maxMs
+	}
+	metrics["avg_ms"] = float64(l.sum) / float64(l.count) / float64(time.Millisecond)
+	metrics["p50_ms"] = percentile(0.50)
+	metrics["p95_ms"] = percentile(0.95)
+	metrics["p99_ms"] = percentile(0.99)
+	metrics["max_ms"] = maxMs
+	return metrics
+}
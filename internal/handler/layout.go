@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"sort"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// uiLayout is the server-defined command menu: order, categories and the
+// preselected command. It is applied to /api/node, so every agent's commands
+// are listed the same way regardless of the order its config defines them in.
+type uiLayout struct {
+	commandRank    map[string]int
+	categoryRank   map[string]int
+	categories     map[string]string
+	defaultCommand string
+	groupDefaults  map[string]string
+}
+
+// InitUILayout loads the ui_layout section of the configuration.
+func (h *Handler) InitUILayout(cfg *config.Config) {
+	layout := cfg.UILayout
+	h.layout = uiLayout{
+		commandRank:    rankOf(layout.CommandOrder),
+		categoryRank:   rankOf(layout.CategoryOrder),
+		categories:     layout.Categories,
+		defaultCommand: layout.DefaultCommand,
+		groupDefaults:  layout.GroupDefaults,
+	}
+}
+
+func rankOf(names []string) map[string]int {
+	ranks := make(map[string]int, len(names))
+	for i, name := range names {
+		if _, dup := ranks[name]; !dup {
+			ranks[name] = i
+		}
+	}
+	return ranks
+}
+
+// applyUILayout reorders and categorizes each agent's commands in groups and
+// sets each group's default_command. Commands keep their agent order among
+// equals; unlisted categories and commands sort after the listed ones.
+func (h *Handler) applyUILayout(groups []map[string]any) {
+	l := h.layout
+	for _, group := range groups {
+		name, _ := group["name"].(string)
+		if def := l.groupDefaults[name]; def != "" {
+			group["default_command"] = def
+		} else if l.defaultCommand != "" {
+			group["default_command"] = l.defaultCommand
+		}
+
+		agents, _ := group["agents"].([]map[string]any)
+		for _, agentInfo := range agents {
+			commands, _ := agentInfo["commands"].([]map[string]any)
+			for _, cmd := range commands {
+				cmdName, _ := cmd["name"].(string)
+				if category := l.categories[cmdName]; category != "" {
+					cmd["category"] = category
+				}
+			}
+			if len(l.commandRank) == 0 && len(l.categoryRank) == 0 {
+				continue
+			}
+			sort.SliceStable(commands, func(i, j int) bool {
+				ci, cj := l.rank(l.categoryRank, commands[i], "category"), l.rank(l.categoryRank, commands[j], "category")
+				if ci != cj {
+					return ci < cj
+				}
+				return l.rank(l.commandRank, commands[i], "name") < l.rank(l.commandRank, commands[j], "name")
+			})
+		}
+	}
+}
+
+// rank returns the position of cmd[key] in ranks, or len(ranks) when unlisted.
+func (l uiLayout) rank(ranks map[string]int, cmd map[string]any, key string) int {
+	value, _ := cmd[key].(string)
+	if r, ok := ranks[value]; ok {
+		return r
+	}
+	return len(ranks)
+}
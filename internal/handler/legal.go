@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const (
+	// termsAckTTL bounds how long a session's acknowledgement is remembered.
+	// Session ids are client-generated and never explicitly closed, so entries
+	// must expire.
+	termsAckTTL = 24 * time.Hour
+	// termsAcksMax bounds the acknowledgements remembered at once; past it
+	// the oldest is forgotten and its session has to acknowledge again.
+	termsAcksMax = 100000
+	// termsAcksPerMinute is how many acknowledgements one IP may send a
+	// minute.
+	termsAcksPerMinute = 10
+	// termsAckSweepEvery is how often expired acknowledgements are removed.
+	termsAckSweepEvery = 10 * time.Minute
+)
+
+// InitTermsAcks starts limiting acknowledgements per IP and removing expired
+// ones.
+func (h *Handler) InitTermsAcks() {
+	h.termsAckLimiter = newWindowLimiter(h.ctx, termsAcksPerMinute, time.Minute)
+	go h.runTermsAckSweeper()
+}
+
+// LegalNotice is the legal/abuse information delivered to web clients with the
+// node list. TermsVersion changes whenever the terms text changes, which
+// invalidates earlier acknowledgements.
+type LegalNotice struct {
+	AbuseContact       string            `json:"abuse_contact,omitempty"`
+	Terms              string            `json:"terms,omitempty"`
+	TermsVersion       string            `json:"terms_version,omitempty"`
+	RequireAck         bool              `json:"require_ack"`
+	Acknowledged       bool              `json:"acknowledged"`
+	CommandDisclaimers map[string]string `json:"command_disclaimers,omitempty"`
+}
+
+// termsAck is the acknowledgement of a session, kept in h.termsOrder.
+type termsAck struct {
+	sessionID string
+	version   string
+	at        time.Time
+}
+
+// TermsAckRequest is the body of POST /api/terms/ack.
+type TermsAckRequest struct {
+	TermsVersion string `json:"terms_version"`
+}
+
+// termsVersion returns a short, stable fingerprint of the terms text.
+func termsVersion(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8])
+}
+
+// legalNotice builds the notice for a session, or nil when nothing is configured.
+func (h *Handler) legalNotice(sessionID string) *LegalNotice {
+	legal := h.GetRuntimeSettings().Legal
+	if legal.AbuseContact == "" && legal.TermsText == "" && len(legal.CommandDisclaimers) == 0 {
+		return nil
+	}
+	version := termsVersion(legal.TermsText)
+	return &LegalNotice{
+		AbuseContact:       legal.AbuseContact,
+		Terms:              legal.TermsText,
+		TermsVersion:       version,
+		RequireAck:         termsAckRequired(legal),
+		Acknowledged:       version != "" && h.hasAcknowledgedTerms(sessionID, version),
+		CommandDisclaimers: legal.CommandDisclaimers,
+	}
+}
+
+func termsAckRequired(legal config.LegalSettings) bool {
+	return legal.RequireAck && termsVersion(legal.TermsText) != ""
+}
+
+// termsSatisfied reports whether a session may execute commands with respect to
+// the terms-of-use acknowledgement requirement.
+func (h *Handler) termsSatisfied(sessionID string) bool {
+	legal := h.GetRuntimeSettings().Legal
+	if !termsAckRequired(legal) {
+		return true
+	}
+	return h.hasAcknowledgedTerms(sessionID, termsVersion(legal.TermsText))
+}
+
+func (h *Handler) hasAcknowledgedTerms(sessionID, version string) bool {
+	h.termsMu.Lock()
+	defer h.termsMu.Unlock()
+	el, ok := h.termsAcks[sessionID]
+	if !ok {
+		return false
+	}
+	ack := el.Value.(*termsAck)
+	return ack.version == version && time.Since(ack.at) < termsAckTTL
+}
+
+// recordTermsAck remembers that a session acknowledged the terms, forgetting
+// the oldest acknowledgement when termsAcksMax are remembered already.
+func (h *Handler) recordTermsAck(sessionID, version string) {
+	h.termsMu.Lock()
+	defer h.termsMu.Unlock()
+	if el, ok := h.termsAcks[sessionID]; ok {
+		ack := el.Value.(*termsAck)
+		ack.version, ack.at = version, time.Now()
+		h.termsOrder.MoveToBack(el)
+		return
+	}
+	if len(h.termsAcks) >= termsAcksMax {
+		h.forgetTermsAck(h.termsOrder.Front())
+	}
+	h.termsAcks[sessionID] = h.termsOrder.PushBack(&termsAck{sessionID: sessionID, version: version, at: time.Now()})
+}
+
+func (h *Handler) forgetTermsAck(el *list.Element) {
+	delete(h.termsAcks, el.Value.(*termsAck).sessionID)
+	h.termsOrder.Remove(el)
+}
+
+// runTermsAckSweeper removes expired acknowledgements, which are the oldest
+// ones, until the server shuts down.
+func (h *Handler) runTermsAckSweeper() {
+	ticker := time.NewTicker(termsAckSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.termsMu.Lock()
+		for el := h.termsOrder.Front(); el != nil && time.Since(el.Value.(*termsAck).at) >= termsAckTTL; el = h.termsOrder.Front() {
+			h.forgetTermsAck(el)
+		}
+		h.termsMu.Unlock()
+	}
+}
+
+// handleTermsAck handles POST /api/terms/ack - records that the session accepted
+// the current terms of use. A stale terms_version is rejected so a client cannot
+// acknowledge text it has not been shown. Each IP may acknowledge
+// termsAcksPerMinute times a minute.
+func (h *Handler) handleTermsAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+	clientIP := h.getRealIP(r)
+	if h.termsAckLimiter != nil && !h.termsAckLimiter.checkRateLimit(clientIP) {
+		retry := int(h.termsAckLimiter.getRemainingTime(clientIP).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var req TermsAckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	version := termsVersion(h.GetRuntimeSettings().Legal.TermsText)
+	if version == "" {
+		http.Error(w, "No terms of use configured", http.StatusNotFound)
+		return
+	}
+	if req.TermsVersion != version {
+		http.Error(w, "Terms of use have changed, please reload", http.StatusConflict)
+		return
+	}
+
+	h.recordTermsAck(sessionID, version)
+	logger.Infof("Client [%s] acknowledged terms of use (%s)", clientIP, version)
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"acknowledged":  true,
+		"terms_version": version,
+	})
+}
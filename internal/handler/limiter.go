@@ -4,7 +4,7 @@ import (
 	"sync"
 	"time"
 
-	"YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/config"
 )
 
 // RateLimiter manages rate limiting for command execution
@@ -12,6 +12,7 @@ type RateLimiter struct {
 	enabled     bool
 	maxCommands int
 	timeWindow  time.Duration
+	shadow      bool
 	sessions    map[string]*SessionRateLimit
 	mu          sync.RWMutex
 }
@@ -28,6 +29,7 @@ func NewRateLimiter(settings config.RuntimeSettings) *RateLimiter {
 		enabled:     settings.RateLimit.Enabled,
 		maxCommands: settings.RateLimit.MaxCommands,
 		timeWindow:  time.Duration(settings.RateLimit.TimeWindow) * time.Second,
+		shadow:      settings.RateLimit.Shadow,
 		sessions:    make(map[string]*SessionRateLimit),
 	}
 }
@@ -40,13 +42,27 @@ func (rl *RateLimiter) Update(settings config.RuntimeSettings) {
 	rl.enabled = settings.RateLimit.Enabled
 	rl.maxCommands = settings.RateLimit.MaxCommands
 	rl.timeWindow = time.Duration(settings.RateLimit.TimeWindow) * time.Second
+	rl.shadow = settings.RateLimit.Shadow
 	if rl.sessions == nil {
 		rl.sessions = make(map[string]*SessionRateLimit)
 	}
 }
 
+// shadowMode reports whether limits are only evaluated, not enforced.
+func (rl *RateLimiter) shadowMode() bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.shadow
+}
+
 // checkRateLimit checks if the given key (client IP) has exceeded the rate limit
 func (rl *RateLimiter) checkRateLimit(key string) bool {
+	return rl.allow(key, 1)
+}
+
+// allow is checkRateLimit for a key allowed factor times the usual number of
+// commands, such as an IP shared by several clients.
+func (rl *RateLimiter) allow(key string, factor int) bool {
 	if !rl.enabled {
 		return true
 	}
@@ -72,7 +88,7 @@ func (rl *RateLimiter) checkRateLimit(key string) bool {
 	}
 	session.timestamps = validTimestamps
 
-	if len(session.timestamps) >= rl.maxCommands {
+	if len(session.timestamps) >= rl.maxCommands*factor {
 		return false
 	}
 
@@ -103,3 +119,16 @@ func (rl *RateLimiter) getRemainingTime(key string) time.Duration {
 	}
 	return remaining
 }
+
+// prune forgets keys with no execution left in the window, so a limiter keyed
+// by client IP does not grow without bound.
+func (rl *RateLimiter) prune() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	for key, session := range rl.sessions {
+		if n := len(session.timestamps); n == 0 || now.Sub(session.timestamps[n-1]) >= rl.timeWindow {
+			delete(rl.sessions, key)
+		}
+	}
+}
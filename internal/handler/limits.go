@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// clientLimits caps the long-lived streams held open by browsers (command
+// output and the status feed), so that a small VPS is not exhausted by open
+// connections.
+type clientLimits struct {
+	maxWebClients int64
+	webClients    atomic.Int64
+	rejected      atomic.Uint64
+}
+
+// InitLimits applies the web client and agent connection caps.
+func (h *Handler) InitLimits(cfg *config.Config) {
+	h.limits.maxWebClients = int64(max(cfg.Limits.MaxWebClients, 0))
+	h.agentManager.SetMaxAgents(cfg.Limits.MaxAgents)
+}
+
+// acquireWebClient takes a web client slot. On false the client was answered
+// with 503 and the caller must return; otherwise it must call
+// releaseWebClient when the stream ends.
+func (h *Handler) acquireWebClient(w http.ResponseWriter) bool {
+	if n := h.limits.webClients.Add(1); h.limits.maxWebClients > 0 && n > h.limits.maxWebClients {
+		h.limits.webClients.Add(-1)
+		h.limits.rejected.Add(1)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Server is at its web client limit, please try again shortly", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) releaseWebClient() {
+	h.limits.webClients.Add(-1)
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+const (
+	// displayPrefsIdle is how long a session's display preferences outlive
+	// its last use.
+	displayPrefsIdle  = 24 * time.Hour
+	displayPrefsSweep = 10 * time.Minute
+	maxDisplayPrefs   = 100000
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8}){0,3}$`)
+
+// displayPrefs are how a session wants the server's human-readable text: the
+// footer's time, incident reports and result summaries. The zero value keeps
+// the server's defaults (ISO dates, 24-hour UTC times, decimal points, bits).
+type displayPrefs struct {
+	// Locale is a BCP 47 tag such as "en-US" or "de"; it picks the date
+	// order, the decimal separator and, unless TimeFormat says, the clock.
+	Locale string `json:"locale,omitempty"`
+	// TimeFormat is "12h" or "24h".
+	TimeFormat string `json:"time_format,omitempty"`
+	// Units of throughput: "bits" (Mbit/s) or "bytes" (MB/s).
+	Units string `json:"units,omitempty"`
+}
+
+type displayEntry struct {
+	prefs displayPrefs
+	used  time.Time
+}
+
+// sessionDisplayPrefs keeps each session's display preferences in memory,
+// like the session itself, which lives in the browser tab.
+type sessionDisplayPrefs struct {
+	mu      sync.Mutex
+	entries map[string]*displayEntry
+	swept   time.Time
+}
+
+// displayFor returns the display preferences of sessionID.
+func (h *Handler) displayFor(sessionID string) displayPrefs {
+	s := &h.displayPrefs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[sessionID]
+	if e == nil {
+		return displayPrefs{}
+	}
+	e.used = time.Now()
+	return e.prefs
+}
+
+// setDisplay stores prefs for sessionID, dropping those of idle sessions.
+func (h *Handler) setDisplay(sessionID string, prefs displayPrefs) {
+	s := &h.displayPrefs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.entries == nil {
+		s.entries = make(map[string]*displayEntry)
+	}
+	if now.Sub(s.swept) >= displayPrefsSweep || len(s.entries) >= maxDisplayPrefs {
+		for id, e := range s.entries {
+			if now.Sub(e.used) >= displayPrefsIdle {
+				delete(s.entries, id)
+			}
+		}
+		s.swept = now
+	}
+	if prefs == (displayPrefs{}) {
+		delete(s.entries, sessionID)
+		return
+	}
+	if _, known := s.entries[sessionID]; !known && len(s.entries) >= maxDisplayPrefs {
+		return
+	}
+	s.entries[sessionID] = &displayEntry{prefs: prefs, used: now}
+}
+
+// normalizeDisplay checks prefs and puts the locale in its usual case
+// ("en-us" becomes "en-US").
+func normalizeDisplay(prefs displayPrefs) (displayPrefs, error) {
+	prefs.Locale = strings.ReplaceAll(strings.TrimSpace(prefs.Locale), "_", "-")
+	if prefs.Locale != "" {
+		if !localePattern.MatchString(prefs.Locale) {
+			return prefs, fmt.Errorf("locale must be a language tag such as en-US")
+		}
+		parts := strings.Split(prefs.Locale, "-")
+		parts[0] = strings.ToLower(parts[0])
+		for i := 1; i < len(parts); i++ {
+			if len(parts[i]) == 2 {
+				parts[i] = strings.ToUpper(parts[i])
+			}
+		}
+		prefs.Locale = strings.Join(parts, "-")
+	}
+	prefs.TimeFormat = strings.ToLower(strings.TrimSpace(prefs.TimeFormat))
+	if prefs.TimeFormat != "" && prefs.TimeFormat != "12h" && prefs.TimeFormat != "24h" {
+		return prefs, fmt.Errorf("time_format must be 12h or 24h")
+	}
+	prefs.Units = strings.ToLower(strings.TrimSpace(prefs.Units))
+	if prefs.Units != "" && prefs.Units != "bits" && prefs.Units != "bytes" {
+		return prefs, fmt.Errorf("units must be bits or bytes")
+	}
+	return prefs, nil
+}
+
+// handleDisplayPreferences handles /api/preferences/display?session_id=…:
+// GET returns the session's display preferences and PUT replaces them
+// ({"locale": "de-DE", "time_format": "24h", "units": "bytes"}; empty fields
+// fall back to the defaults).
+func (h *Handler) handleDisplayPreferences(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req displayPrefs
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		prefs, err := normalizeDisplay(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.setDisplay(sessionID, prefs)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(h.displayFor(sessionID))
+}
+
+// language is the primary subtag of the locale, e.g. "de" for "de-AT".
+func (p displayPrefs) language() string {
+	language, _, _ := strings.Cut(p.Locale, "-")
+	return language
+}
+
+// Date orders by locale, then by language. Locales missing from both keep
+// ISO dates.
+var (
+	localeDateLayouts = map[string]string{
+		"en-US": "01/02/2006",
+		"en-GB": "02/01/2006",
+		"en-AU": "02/01/2006",
+		"en-IN": "02/01/2006",
+		"en-NZ": "02/01/2006",
+	}
+	languageDateLayouts = map[string]string{
+		"cs": "02.01.2006", "de": "02.01.2006", "fi": "02.01.2006", "nb": "02.01.2006",
+		"pl": "02.01.2006", "ru": "02.01.2006", "tr": "02.01.2006", "uk": "02.01.2006",
+		"es": "02/01/2006", "fr": "02/01/2006", "it": "02/01/2006", "pt": "02/01/2006",
+		"vi": "02/01/2006", "id": "02/01/2006",
+		"nl": "02-01-2006", "da": "02-01-2006",
+		"ja": "2006/01/02", "zh": "2006/01/02", "ko": "2006/01/02",
+	}
+	// twelveHourLocales use a 12-hour clock unless TimeFormat says otherwise.
+	twelveHourLocales = map[string]bool{"en-US": true, "en-AU": true, "en-CA": true, "en-IN": true, "en-NZ": true, "en-PH": true}
+	// decimalCommaLanguages write 1,5 for one and a half.
+	decimalCommaLanguages = map[string]bool{
+		"cs": true, "da": true, "de": true, "es": true, "fi": true, "fr": true, "id": true, "it": true,
+		"nb": true, "nl": true, "pl": true, "pt": true, "ru": true, "sv": true, "tr": true, "uk": true, "vi": true,
+	}
+)
+
+// formatTime renders t in UTC the way the session reads times, or as layout
+// without preferences, so that default output does not change.
+func (p displayPrefs) formatTime(t time.Time, layout string) string {
+	if p.Locale == "" && p.TimeFormat == "" {
+		return t.UTC().Format(layout)
+	}
+	date, ok := localeDateLayouts[p.Locale]
+	if !ok {
+		if date, ok = languageDateLayouts[p.language()]; !ok {
+			date = "2006-01-02"
+		}
+	}
+	clock := "15:04:05"
+	if p.TimeFormat == "12h" || (p.TimeFormat == "" && twelveHourLocales[p.Locale]) {
+		clock = "3:04:05 PM"
+	}
+	return t.UTC().Format(date + " " + clock + " UTC")
+}
+
+// formatDecimal renders v with digits decimals and the locale's separator.
+func (p displayPrefs) formatDecimal(v float64, digits int) string {
+	s := strconv.FormatFloat(v, 'f', digits, 64)
+	if decimalCommaLanguages[p.language()] {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// formatRate renders a throughput in bits per second in the session's units,
+// with SI prefixes.
+func (p displayPrefs) formatRate(bps float64) string {
+	value, unit := bps, "bit/s"
+	if p.Units == "bytes" {
+		value, unit = bps/8, "B/s"
+	}
+	prefix := ""
+	for _, next := range []string{"k", "M", "G", "T"} {
+		if math.Abs(value) < 1000 {
+			break
+		}
+		value /= 1000
+		prefix = next
+	}
+	return p.formatDecimal(value, 1) + " " + prefix + unit
+}
+
+// iperf3Text is the one-line summary of an iperf3 run that rides on the
+// complete event, e.g. "Sender 941.2 Mbit/s, receiver 939.8 Mbit/s over
+// 10.0 s, 12 retransmits".
+func (p displayPrefs) iperf3Text(s proto.Iperf3Summary) string {
+	text := fmt.Sprintf("Sender %s, receiver %s over %s s", p.formatRate(s.SenderBps), p.formatRate(s.ReceiverBps), p.formatDecimal(s.DurationSec, 1))
+	if s.Protocol == "udp" {
+		text += fmt.Sprintf(", jitter %s ms, %d/%d packets lost (%s%%)", p.formatDecimal(s.JitterMs, 3), s.LostPackets, s.Packets, p.formatDecimal(s.LostPercent, 1))
+	} else if s.Retransmits > 0 {
+		text += fmt.Sprintf(", %d retransmits", s.Retransmits)
+	}
+	if s.Reverse {
+		text += " (reverse)"
+	}
+	return text
+}
+
+// iperf3Result decodes a structured result when it is an iperf3 summary.
+func iperf3Result(data json.RawMessage) (proto.Iperf3Summary, bool) {
+	var s proto.Iperf3Summary
+	return s, json.Unmarshal(data, &s) == nil && s.Kind == proto.ResultKindIperf3
+}
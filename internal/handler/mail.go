@@ -0,0 +1,253 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const (
+	// smtpTimeout bounds a whole delivery, from dialing to QUIT.
+	smtpTimeout     = 30 * time.Second
+	smtpDefaultPort = 587
+	smtpImplicitTLS = 465
+)
+
+// TLS modes of the SMTP connection (smtp.tls).
+const (
+	// smtpTLSAuto uses implicit TLS on port 465 and STARTTLS elsewhere when
+	// the server offers it.
+	smtpTLSAuto     = "auto"
+	smtpTLSImplicit = "implicit"
+	// smtpTLSStartTLS requires STARTTLS.
+	smtpTLSStartTLS = "starttls"
+	smtpTLSNone     = "none"
+)
+
+// smtpMailer sends mail through the configured SMTP server (smtp), for
+// incident reports and notifications.
+type smtpMailer struct {
+	host     string
+	port     int
+	tls      string
+	username string
+	password string
+	from     *mail.Address
+}
+
+// mailAttachment is a file attached to a message.
+type mailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// InitMail sets the SMTP server mail is sent through. Without smtp.host the
+// server sends no mail.
+func (h *Handler) InitMail(cfg *config.Config) {
+	s := cfg.SMTP
+	if s.Host == "" {
+		return
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		logger.Errorf("Mail disabled: invalid smtp.from %q: %v", s.From, err)
+		return
+	}
+	m := &smtpMailer{
+		host:     s.Host,
+		port:     s.Port,
+		tls:      strings.ToLower(strings.TrimSpace(s.TLS)),
+		username: s.Username,
+		password: s.Password,
+		from:     from,
+	}
+	if m.tls == "" {
+		m.tls = smtpTLSAuto
+	}
+	switch m.tls {
+	case smtpTLSAuto, smtpTLSImplicit, smtpTLSStartTLS, smtpTLSNone:
+	default:
+		logger.Errorf("Mail disabled: smtp.tls must be auto, implicit, starttls or none, not %q", s.TLS)
+		return
+	}
+	if m.port <= 0 {
+		m.port = smtpDefaultPort
+		if m.tls == smtpTLSImplicit {
+			m.port = smtpImplicitTLS
+		}
+	}
+	if m.tls == smtpTLSAuto && m.port == smtpImplicitTLS {
+		m.tls = smtpTLSImplicit
+	}
+	h.mailer = m
+	logger.Infof("Sending mail through %s (tls %s)", m.address(), m.tls)
+}
+
+func (m *smtpMailer) address() string {
+	return net.JoinHostPort(m.host, strconv.Itoa(m.port))
+}
+
+// send mails text to the bare addresses in to, with the attachments.
+func (m *smtpMailer) send(to []string, subject, text string, attachments ...mailAttachment) error {
+	msg, err := m.message(to, subject, text, attachments)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	tlsConfig := &tls.Config{ServerName: m.host, MinVersion: tls.VersionTLS12}
+	var conn net.Conn
+	if m.tls == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.address(), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", m.address())
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.tls == smtpTLSAuto || m.tls == smtpTLSStartTLS {
+		ok, _ := c.Extension("STARTTLS")
+		if ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if m.tls == smtpTLSStartTLS {
+			return errors.New("the server does not offer STARTTLS")
+		}
+	}
+	// PlainAuth refuses to send the password over an unencrypted connection
+	// to anything but localhost.
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("%s: %w", rcpt, err)
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message builds a message with a quoted-printable text body, as a
+// multipart/mixed message when there are attachments.
+func (m *smtpMailer) message(to []string, subject, text string, attachments []mailAttachment) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	textHeader := textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	}
+	if len(attachments) == 0 {
+		for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			fmt.Fprintf(&msg, "%s: %s\r\n", key, textHeader.Get(key))
+		}
+		msg.WriteString("\r\n")
+		if err := writeQuotedPrintable(&msg, text); err != nil {
+			return nil, err
+		}
+		return msg.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(part, text); err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.data)
+		for len(encoded) > 76 {
+			if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+				return nil, err
+			}
+			encoded = encoded[76:]
+		}
+		if _, err := part.Write([]byte(encoded + "\r\n")); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// parseMailAddresses checks a list of addresses and returns their bare
+// forms, e.g. "noc@example.net" for "NOC <noc@example.net>".
+func parseMailAddresses(list []string) ([]string, error) {
+	addresses := make([]string, 0, len(list))
+	for _, raw := range list {
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid email address %q", raw)
+		}
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses, nil
+}
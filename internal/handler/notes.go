@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// Kinds of a note.
+const (
+	noteAgent = "agent"
+	noteGroup = "group"
+)
+
+// maxNoteLength caps a note set through the API, in characters.
+const maxNoteLength = 4000
+
+type noteKey struct{ kind, name string }
+
+// notes are the markdown notes on agents and groups: those of the notes
+// section of the configuration, and the ones operators set through
+// /api/control/notes, which mirror the notes table and take precedence.
+type notes struct {
+	mu         sync.RWMutex
+	configured map[noteKey]string
+	stored     map[noteKey]serverstore.Note
+}
+
+// InitNotes loads the configured notes and the ones saved before the last
+// restart.
+func (h *Handler) InitNotes(cfg *config.Config) {
+	configured := make(map[noteKey]string)
+	for kind, byName := range map[string]map[string]string{noteAgent: cfg.Notes.Agents, noteGroup: cfg.Notes.Groups} {
+		for name, body := range byName {
+			if body = strings.TrimSpace(body); body != "" {
+				configured[noteKey{kind, strings.TrimSpace(name)}] = body
+			}
+		}
+	}
+	h.notes.mu.Lock()
+	h.notes.configured = configured
+	h.notes.stored = make(map[noteKey]serverstore.Note)
+	h.notes.mu.Unlock()
+	h.reloadNotes()
+}
+
+// reloadNotes reads the stored notes again, at start-up and after the store
+// changed them (see rename.go).
+func (h *Handler) reloadNotes() {
+	list, err := h.store.ListNotes()
+	if err != nil {
+		logger.Errorf("Failed to load notes: %v", err)
+		return
+	}
+	stored := make(map[noteKey]serverstore.Note, len(list))
+	for _, n := range list {
+		stored[noteKey{n.Kind, n.Name}] = n
+	}
+	h.notes.mu.Lock()
+	h.notes.stored = stored
+	h.notes.mu.Unlock()
+}
+
+// note returns the note on the agent or group name, or "".
+func (h *Handler) note(kind, name string) string {
+	h.notes.mu.RLock()
+	defer h.notes.mu.RUnlock()
+	if n, ok := h.notes.stored[noteKey{kind, name}]; ok {
+		return n.Body
+	}
+	return h.notes.configured[noteKey{kind, name}]
+}
+
+// applyNotes sets the note of each group and agent in groups, as listed by
+// /api/node.
+func (h *Handler) applyNotes(groups []map[string]any) {
+	for _, group := range groups {
+		name, _ := group["name"].(string)
+		if note := h.note(noteGroup, name); note != "" {
+			group["note"] = note
+		}
+		agents, _ := group["agents"].([]map[string]any)
+		for _, agentInfo := range agents {
+			agentName, _ := agentInfo["name"].(string)
+			if note := h.note(noteAgent, agentName); note != "" {
+				agentInfo["note"] = note
+			}
+		}
+	}
+}
+
+// handleControlNotes lists every note on /api/control/notes, with its
+// source: "config" or "api".
+func (h *Handler) handleControlNotes(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.notes.mu.RLock()
+	keys := slices.Collect(maps.Keys(h.notes.configured))
+	for key := range h.notes.stored {
+		if _, dup := h.notes.configured[key]; !dup {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b noteKey) int {
+		return strings.Compare(a.kind+"\x00"+a.name, b.kind+"\x00"+b.name)
+	})
+	list := make([]map[string]any, 0, len(keys))
+	for _, key := range keys {
+		entry := map[string]any{"kind": key.kind, "name": key.name}
+		if n, ok := h.notes.stored[key]; ok {
+			entry["note"] = n.Body
+			entry["source"] = "api"
+			entry["updated_at"] = n.UpdatedAt.UTC().Format(time.RFC3339)
+		} else {
+			entry["note"] = h.notes.configured[key]
+			entry["source"] = "config"
+		}
+		list = append(list, entry)
+	}
+	h.notes.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"notes": list})
+}
+
+// handleControlNoteByName handles /api/control/notes/{agent|group}/{name}:
+//
+//	PUT    - set the note {"note": "markdown"}; an empty note removes it
+//	DELETE - remove the note set through the API, showing the configured
+//	         one again if any
+func (h *Handler) handleControlNoteByName(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	kind, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/control/notes/"), "/")
+	name = strings.TrimSpace(name)
+	if (kind != noteAgent && kind != noteGroup) || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body string
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Note string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		body = strings.TrimSpace(req.Note)
+		if utf8.RuneCountInString(body) > maxNoteLength {
+			http.Error(w, fmt.Sprintf("note must not exceed %d characters", maxNoteLength), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.setNote(kind, name, body); err != nil {
+		logger.Errorf("Failed to save the note of %s %s: %v", kind, name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "kind": kind, "name": name, "note": h.note(kind, name)})
+}
+
+// setNote saves the note on the agent or group name, or removes the saved
+// one when body is empty.
+func (h *Handler) setNote(kind, name, body string) error {
+	h.notes.mu.Lock()
+	defer h.notes.mu.Unlock()
+	key := noteKey{kind, name}
+	if body == "" {
+		if _, err := h.store.DeleteNote(kind, name); err != nil {
+			return err
+		}
+		delete(h.notes.stored, key)
+		return nil
+	}
+	n := serverstore.Note{Kind: kind, Name: name, Body: body, UpdatedAt: time.Now()}
+	if err := h.store.SaveNote(n); err != nil {
+		return err
+	}
+	h.notes.stored[key] = n
+	return nil
+}
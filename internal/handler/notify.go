@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// Notification events operators can route to email recipients
+// (notifications.email).
+const (
+	notifyAgentOffline    = "agent_offline"
+	notifyApprovalPending = "approval_pending"
+	notifyAbuseReport     = "abuse_report"
+	// Sent when provisioning alerts are on (see provisioning.go).
+	notifyAgentNeverConnected  = "agent_never_connected"
+	notifyAgentDetailsMismatch = "agent_details_mismatch"
+	// Sent when an enrolling agent waits for an operator (see
+	// enrollment.go).
+	notifyEnrollmentPending = "enrollment_pending"
+	// Sent for test suite runs (see suites.go).
+	notifySuiteFailed = "suite_failed"
+	notifySuitePassed = "suite_passed"
+)
+
+// notifyDefaultOfflineGrace is how long an agent stays disconnected before
+// agent_offline is sent, so that restarts and brief network drops stay
+// quiet.
+const notifyDefaultOfflineGrace = time.Minute
+
+// defaultNotificationTemplates are the subjects and bodies of events without
+// notifications.templates.
+var defaultNotificationTemplates = map[string]config.NotificationTemplate{
+	notifyAgentOffline: {
+		Subject: "[YALS] Agent {agent} is offline",
+		Body:    "Agent {agent} of group {group} disconnected at {time} and has not reconnected.\n",
+	},
+	notifyApprovalPending: {
+		Subject: "[YALS] Approval needed: {command} {target} on {agent}",
+		Body: "A run of {command} against {target} on {agent} is waiting for an " +
+			"operator's approval (approval {id}, {detail}).\n\n" +
+			"Approve or deny it on the control panel's Approvals page.\n",
+	},
+	notifyAbuseReport: {
+		Subject: "[YALS] Abuse report #{id}: {command} {target} on {agent}",
+		Body: "A viewer reported {command} {target} on {agent} as abusive at {time}.\n\n" +
+			"Reason: {detail}\n\n" +
+			"Triage it on the control panel's Reports page.\n",
+	},
+	notifyAgentNeverConnected: {
+		Subject: "[YALS] Agent {agent} has never connected",
+		Body: "Agent {agent} of group {group} was {detail}.\n\n" +
+			"Check that it is installed and can reach the server with its UUID and token.\n",
+	},
+	notifyAgentDetailsMismatch: {
+		Subject: "[YALS] Agent {agent} connected from an unexpected address",
+		Body: "At {time}, agent {agent} of group {group} {detail}.\n\n" +
+			"Update its details on the control panel if it moved, or rotate its token if it did not.\n",
+	},
+	notifyEnrollmentPending: {
+		Subject: "[YALS] Agent {agent} asks to enroll",
+		Body: "At {time}, an agent named {agent} asked to enroll {detail} (enrollment {id}).\n\n" +
+			"Approve or deny it on the control panel's Enrollment page.\n",
+	},
+	notifySuiteFailed: {
+		Subject: "[YALS] Test suite {target} failed",
+		Body: "Test suite {target} finished at {time} (run {id}): {detail}\n\n" +
+			"See /api/control/suites/{target} for the result of each test.\n",
+	},
+	notifySuitePassed: {
+		Subject: "[YALS] Test suite {target} passed",
+		Body:    "Test suite {target} finished at {time} (run {id}): {detail}.\n",
+	},
+}
+
+// notifications emails operators about events on the bus.
+type notifications struct {
+	email        map[string][]string
+	templates    map[string]config.NotificationTemplate
+	offlineGrace time.Duration
+
+	mu sync.Mutex
+	// offline holds, per agent UUID, the pending agent_offline of an
+	// agent that disconnected less than offlineGrace ago.
+	offline map[string]*time.Timer
+}
+
+// InitNotifications routes notification events to their email recipients.
+// It must run after InitMail.
+func (h *Handler) InitNotifications(cfg *config.Config) {
+	n := &h.notifications
+	n.email = make(map[string][]string)
+	n.templates = make(map[string]config.NotificationTemplate)
+	n.offline = make(map[string]*time.Timer)
+	n.offlineGrace = notifyDefaultOfflineGrace
+	if seconds := cfg.Notifications.OfflineGrace; seconds > 0 {
+		n.offlineGrace = time.Duration(seconds) * time.Second
+	}
+
+	for event, list := range cfg.Notifications.Email {
+		if _, known := defaultNotificationTemplates[event]; !known {
+			logger.Warnf("Ignoring notifications.email.%s: unknown event", event)
+			continue
+		}
+		recipients, err := parseMailAddresses(list)
+		if err != nil {
+			logger.Errorf("Ignoring notifications.email.%s: %v", event, err)
+			continue
+		}
+		if len(recipients) > 0 {
+			n.email[event] = recipients
+		}
+	}
+	for event, tmpl := range cfg.Notifications.Templates {
+		if _, known := defaultNotificationTemplates[event]; !known {
+			logger.Warnf("Ignoring notifications.templates.%s: unknown event", event)
+			continue
+		}
+		n.templates[event] = tmpl
+	}
+	if len(n.email) == 0 {
+		return
+	}
+	if h.mailer == nil {
+		logger.Errorf("Email notifications disabled: smtp.host is not set")
+		n.email = nil
+		return
+	}
+
+	routed := make([]string, 0, len(n.email))
+	for event := range n.email {
+		routed = append(routed, event)
+	}
+	sort.Strings(routed)
+	logger.Infof("Email notifications enabled for %s", strings.Join(routed, ", "))
+
+	bus := h.agentManager.Events()
+	if n.email[notifyAgentOffline] != nil {
+		bus.Subscribe(0, h.trackAgentOffline, events.AgentConnected, events.AgentDisconnected)
+	}
+	if n.email[notifyApprovalPending] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifyApprovalPending, e)
+		}, events.ApprovalRequested)
+	}
+	if n.email[notifyAbuseReport] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifyAbuseReport, e)
+		}, events.AbuseReported)
+	}
+	if n.email[notifyAgentNeverConnected] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifyAgentNeverConnected, e)
+		}, events.AgentNeverConnected)
+	}
+	if n.email[notifyAgentDetailsMismatch] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifyAgentDetailsMismatch, e)
+		}, events.AgentDetailsMismatch)
+	}
+	if n.email[notifyEnrollmentPending] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifyEnrollmentPending, e)
+		}, events.AgentEnrollmentRequested)
+	}
+	if n.email[notifySuiteFailed] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifySuiteFailed, e)
+		}, events.SuiteFailed)
+	}
+	if n.email[notifySuitePassed] != nil {
+		bus.Subscribe(0, func(e events.Event) {
+			h.notify(notifySuitePassed, e)
+		}, events.SuitePassed)
+	}
+}
+
+// trackAgentOffline sends agent_offline for an agent still disconnected
+// offlineGrace after it dropped. Reconnecting in time cancels it.
+func (h *Handler) trackAgentOffline(e events.Event) {
+	n := &h.notifications
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	timer, pending := n.offline[e.AgentUUID]
+	if e.Type == events.AgentConnected {
+		if pending {
+			timer.Stop()
+			delete(n.offline, e.AgentUUID)
+		}
+		return
+	}
+	if pending {
+		return
+	}
+	n.offline[e.AgentUUID] = time.AfterFunc(n.offlineGrace, func() {
+		n.mu.Lock()
+		delete(n.offline, e.AgentUUID)
+		n.mu.Unlock()
+		// A removed agent is not an outage.
+		if status, ok := h.agentManager.GetAgent(e.Agent); !ok || status.Online {
+			return
+		}
+		h.notify(notifyAgentOffline, e)
+	})
+}
+
+// notify emails event to its recipients, in the background.
+func (h *Handler) notify(event string, e events.Event) {
+	recipients := h.notifications.email[event]
+	if len(recipients) == 0 {
+		return
+	}
+	subject, body := h.renderNotification(event, e)
+	go func() {
+		if err := h.mailer.send(recipients, subject, body); err != nil {
+			logger.Warnf("Failed to email %s notification to %s: %v", event, strings.Join(recipients, ", "), err)
+		}
+	}()
+}
+
+// renderNotification fills in the event's template.
+func (h *Handler) renderNotification(event string, e events.Event) (string, string) {
+	tmpl := defaultNotificationTemplates[event]
+	if custom, ok := h.notifications.templates[event]; ok {
+		if custom.Subject != "" {
+			tmpl.Subject = custom.Subject
+		}
+		if custom.Body != "" {
+			tmpl.Body = custom.Body
+		}
+	}
+
+	var group, location string
+	if status, ok := h.agentManager.GetAgent(e.Agent); ok {
+		group, location = status.Group, status.Location
+	}
+	replacer := strings.NewReplacer(
+		"{event}", event,
+		"{time}", e.Time.UTC().Format(time.RFC3339),
+		"{agent}", e.Agent,
+		"{group}", group,
+		"{location}", location,
+		"{command}", e.Command,
+		"{target}", e.Target,
+		"{id}", e.ID,
+		"{detail}", e.Detail,
+	)
+	subject := strings.Join(strings.Fields(replacer.Replace(tmpl.Subject)), " ")
+	return subject, replacer.Replace(tmpl.Body)
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// Scopes of an execution pause.
+const (
+	pauseGlobal = "global"
+	pauseGroup  = "group"
+	pauseAgent  = "agent"
+)
+
+// executionPauses mirrors the execution_pauses table. Paused agents stay
+// listed and keep reporting status; only new executions are refused.
+type executionPauses struct {
+	mu   sync.RWMutex
+	list []serverstore.ExecutionPause
+}
+
+// pauseRequest is the body of POST /api/control/pauses and of the
+// /api/cluster/pause call that repeats a change on peer replicas.
+type pauseRequest struct {
+	Scope  string `json:"scope"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Resume lifts the pause instead (peers only).
+	Resume bool `json:"resume,omitempty"`
+}
+
+// InitExecutionPauses loads the pauses saved before the last restart.
+func (h *Handler) InitExecutionPauses() {
+	pauses, err := h.store.ListExecutionPauses()
+	if err != nil {
+		logger.Errorf("Failed to load execution pauses: %v", err)
+		return
+	}
+	h.pauses.mu.Lock()
+	h.pauses.list = pauses
+	h.pauses.mu.Unlock()
+	for _, p := range pauses {
+		logger.Warnf("Executions paused (%s): %s", describePause(p), p.Reason)
+	}
+}
+
+// reloadExecutionPauses reads the pauses again after the store changed them
+// (see rename.go).
+func (h *Handler) reloadExecutionPauses() {
+	pauses, err := h.store.ListExecutionPauses()
+	if err != nil {
+		logger.Errorf("Failed to load execution pauses: %v", err)
+		return
+	}
+	h.pauses.mu.Lock()
+	h.pauses.list = pauses
+	h.pauses.mu.Unlock()
+}
+
+// executionPause returns the pause that applies to agentName, if any. A
+// global pause wins over a group pause, which wins over an agent pause.
+func (h *Handler) executionPause(agentName string) (serverstore.ExecutionPause, bool) {
+	group := ""
+	if status, ok := h.agentManager.GetAgent(agentName); ok {
+		group = status.Group
+	}
+	h.pauses.mu.RLock()
+	defer h.pauses.mu.RUnlock()
+	for _, scope := range []struct{ scope, name string }{{pauseGlobal, ""}, {pauseGroup, group}, {pauseAgent, agentName}} {
+		for _, p := range h.pauses.list {
+			if p.Scope == scope.scope && p.Name == scope.name {
+				return p, true
+			}
+		}
+	}
+	return serverstore.ExecutionPause{}, false
+}
+
+// globalPause returns the global pause, if any.
+func (h *Handler) globalPause() (serverstore.ExecutionPause, bool) {
+	h.pauses.mu.RLock()
+	defer h.pauses.mu.RUnlock()
+	for _, p := range h.pauses.list {
+		if p.Scope == pauseGlobal {
+			return p, true
+		}
+	}
+	return serverstore.ExecutionPause{}, false
+}
+
+// describePause names what a pause covers, e.g. "group eu-west".
+func describePause(p serverstore.ExecutionPause) string {
+	switch p.Scope {
+	case pauseGroup:
+		return "group " + p.Name
+	case pauseAgent:
+		return "node " + p.Name
+	default:
+		return "all nodes"
+	}
+}
+
+// pauseMessage is the error a client gets for a command refused by p.
+func pauseMessage(p serverstore.ExecutionPause) string {
+	msg := "Executions are paused by the operator on " + describePause(p)
+	if p.Reason != "" {
+		msg += ": " + p.Reason
+	}
+	return msg
+}
+
+// normalizePause checks the scope and name of req; global pauses have no name.
+func normalizePause(req pauseRequest) (serverstore.ExecutionPause, error) {
+	p := serverstore.ExecutionPause{
+		Scope:  strings.ToLower(strings.TrimSpace(req.Scope)),
+		Name:   strings.TrimSpace(req.Name),
+		Reason: strings.TrimSpace(req.Reason),
+	}
+	switch p.Scope {
+	case pauseGlobal:
+		p.Name = ""
+	case pauseGroup, pauseAgent:
+		if p.Name == "" {
+			return p, fmt.Errorf("name is required for a %s pause", p.Scope)
+		}
+	default:
+		return p, fmt.Errorf("scope must be global, group or agent")
+	}
+	if len(p.Reason) > 500 {
+		return p, fmt.Errorf("reason must not exceed 500 characters")
+	}
+	return p, nil
+}
+
+// setExecutionPause saves p, replacing an earlier pause of the same scope and
+// name.
+func (h *Handler) setExecutionPause(p serverstore.ExecutionPause) error {
+	p.PausedAt = time.Now()
+	h.pauses.mu.Lock()
+	defer h.pauses.mu.Unlock()
+	if err := h.store.SaveExecutionPause(p); err != nil {
+		return err
+	}
+	for i, existing := range h.pauses.list {
+		if existing.Scope == p.Scope && existing.Name == p.Name {
+			h.pauses.list[i] = p
+			return nil
+		}
+	}
+	h.pauses.list = append(h.pauses.list, p)
+	logger.Warnf("Executions paused (%s): %s", describePause(p), p.Reason)
+	return nil
+}
+
+// clearExecutionPause lifts a pause. found is false when there was none.
+func (h *Handler) clearExecutionPause(scope, name string) (bool, error) {
+	h.pauses.mu.Lock()
+	defer h.pauses.mu.Unlock()
+	found, err := h.store.DeleteExecutionPause(scope, name)
+	if err != nil {
+		return false, err
+	}
+	for i, p := range h.pauses.list {
+		if p.Scope == scope && p.Name == name {
+			h.pauses.list = append(h.pauses.list[:i], h.pauses.list[i+1:]...)
+			logger.Infof("Executions resumed (%s)", describePause(p))
+			break
+		}
+	}
+	return found, nil
+}
+
+// handleControlPauses handles /api/control/pauses:
+//
+//	GET    - every pause
+//	POST   - pause {"scope": "global" | "group" | "agent", "name": "…",
+//	         "reason": "…"}; name is the group or agent name
+//	DELETE - lift the pause ?scope=…&name=…
+//
+// Peer replicas repeat changes.
+func (h *Handler) handleControlPauses(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req pauseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		p, err := normalizePause(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.setExecutionPause(p); err != nil {
+			logger.Errorf("Failed to save execution pause: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		h.forwardPause(pauseRequest{Scope: p.Scope, Name: p.Name, Reason: p.Reason})
+	case http.MethodDelete:
+		p, err := normalizePause(pauseRequest{Scope: r.URL.Query().Get("scope"), Name: r.URL.Query().Get("name")})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		found, err := h.clearExecutionPause(p.Scope, p.Name)
+		if err != nil {
+			logger.Errorf("Failed to lift execution pause: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Pause not found", http.StatusNotFound)
+			return
+		}
+		h.forwardPause(pauseRequest{Scope: p.Scope, Name: p.Name, Resume: true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.pauses.mu.RLock()
+	pauses := make([]map[string]any, 0, len(h.pauses.list))
+	for _, p := range h.pauses.list {
+		pauses = append(pauses, map[string]any{
+			"scope":     p.Scope,
+			"name":      p.Name,
+			"reason":    p.Reason,
+			"paused_at": p.PausedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	h.pauses.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"pauses": pauses})
+}
+
+// forwardPause repeats a pause change on every peer replica.
+func (h *Handler) forwardPause(req pauseRequest) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	for _, p := range h.cluster.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			peerReq, err := h.cluster.newRequest(ctx, p, "/api/cluster/pause", body)
+			if err != nil {
+				return
+			}
+			resp, err := p.client.Do(peerReq)
+			if err != nil {
+				logger.Warnf("Failed to forward execution pause to %s: %v", p.baseURL, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+}
+
+// handleClusterPause handles POST /api/cluster/pause - a pause change repeated
+// by a peer replica. It never forwards again.
+func (h *Handler) handleClusterPause(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readClusterRequest(w, r)
+	if !ok {
+		return
+	}
+	var req pauseRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p, err := normalizePause(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Resume {
+		_, err = h.clearExecutionPause(p.Scope, p.Name)
+	} else {
+		err = h.setExecutionPause(p)
+	}
+	if err != nil {
+		logger.Errorf("Failed to apply execution pause from peer: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"success": true})
+}
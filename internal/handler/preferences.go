@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+const (
+	prefsCookieName       = "yals_prefs"
+	prefsDefaultRetention = 90 * 24 * time.Hour
+	prefsPruneInterval    = 6 * time.Hour
+	maxRecentTargets      = 10
+	maxFavoriteAgents     = 50
+)
+
+var prefsIDPattern = regexp.MustCompile(`^[a-z0-9]{32}$`)
+
+// PreferencesRequest is the body of PUT /api/preferences.
+type PreferencesRequest struct {
+	FavoriteAgents []string `json:"favorite_agents"`
+}
+
+// InitPreferences enables cookie-keyed favorites and recent targets and
+// starts the pruner for preferences past their retention.
+func (h *Handler) InitPreferences(cfg *config.Config) {
+	h.prefsEnabled = cfg.Preferences.Enabled
+	if !h.prefsEnabled {
+		return
+	}
+	h.prefsRetention = prefsDefaultRetention
+	if days := cfg.Preferences.RetentionDays; days > 0 {
+		h.prefsRetention = time.Duration(days) * 24 * time.Hour
+	}
+	go h.runPreferencesPruner()
+}
+
+func (h *Handler) runPreferencesPruner() {
+	ticker := time.NewTicker(prefsPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.store.PruneClientPreferences(time.Now().Add(-h.prefsRetention)); err != nil {
+			logger.Warnf("Failed to prune client preferences: %v", err)
+		}
+	}
+}
+
+// preferencesID returns the caller's preferences id from its cookie. With
+// issue set, a caller without one gets a new cookie.
+func (h *Handler) preferencesID(w http.ResponseWriter, r *http.Request, issue bool) string {
+	if cookie, err := r.Cookie(prefsCookieName); err == nil && prefsIDPattern.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+	if !issue {
+		return ""
+	}
+	id, err := GenerateRandomString(32)
+	if err != nil {
+		logger.Errorf("Failed to generate preferences id: %v", err)
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     prefsCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(h.prefsRetention.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// clientPreferences returns the caller's preferences for /api/node, issuing
+// the cookie on first visit. It is nil when preferences are disabled.
+func (h *Handler) clientPreferences(w http.ResponseWriter, r *http.Request) *serverstore.ClientPreferences {
+	if !h.prefsEnabled {
+		return nil
+	}
+	id := h.preferencesID(w, r, true)
+	if id == "" {
+		return nil
+	}
+	prefs, err := h.store.GetClientPreferences(id)
+	if err != nil {
+		logger.Warnf("Failed to load client preferences: %v", err)
+	}
+	return &prefs
+}
+
+// updatePreferences applies fn to the stored preferences of id.
+func (h *Handler) updatePreferences(id string, fn func(*serverstore.ClientPreferences)) (serverstore.ClientPreferences, error) {
+	h.prefsMu.Lock()
+	defer h.prefsMu.Unlock()
+	prefs, err := h.store.GetClientPreferences(id)
+	if err != nil {
+		return prefs, err
+	}
+	fn(&prefs)
+	return prefs, h.store.SaveClientPreferences(id, prefs)
+}
+
+// rememberTarget records target as the caller's most recent one. Only
+// targets the command's validator accepts are kept, in normalized form;
+// commands without a target and omitted targets record nothing.
+func (h *Handler) rememberTarget(r *http.Request, agentName, command, target string) {
+	if !h.prefsEnabled || strings.TrimSpace(target) == "" {
+		return
+	}
+	valid, err := h.validateTarget(agentName, command, target)
+	if err != nil || valid.Type == validator.TargetNone {
+		return
+	}
+	target = valid.Value
+	id := h.preferencesID(nil, r, false)
+	if id == "" {
+		return
+	}
+	_, err = h.updatePreferences(id, func(prefs *serverstore.ClientPreferences) {
+		recent := []string{target}
+		for _, t := range prefs.RecentTargets {
+			if t != target && len(recent) < maxRecentTargets {
+				recent = append(recent, t)
+			}
+		}
+		prefs.RecentTargets = recent
+	})
+	if err != nil {
+		logger.Warnf("Failed to record recent target: %v", err)
+	}
+}
+
+// handlePreferences handles /api/preferences - GET returns the caller's
+// favorites and recent targets, PUT replaces the favorites and DELETE forgets
+// everything stored for the caller.
+func (h *Handler) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+	if !h.prefsEnabled {
+		http.Error(w, "Preferences are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var (
+		prefs serverstore.ClientPreferences
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		prefs, err = h.store.GetClientPreferences(h.preferencesID(w, r, true))
+	case http.MethodPut:
+		var req PreferencesRequest
+		if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); decodeErr != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		favorites := make([]string, 0, len(req.FavoriteAgents))
+		for _, name := range req.FavoriteAgents {
+			name = strings.TrimSpace(name)
+			if name != "" && len(name) <= 128 && !slices.Contains(favorites, name) && len(favorites) < maxFavoriteAgents {
+				favorites = append(favorites, name)
+			}
+		}
+		prefs, err = h.updatePreferences(h.preferencesID(w, r, true), func(p *serverstore.ClientPreferences) {
+			p.FavoriteAgents = favorites
+		})
+	case http.MethodDelete:
+		if id := h.preferencesID(w, r, false); id != "" {
+			err = h.store.DeleteClientPreferences(id)
+		}
+		http.SetCookie(w, &http.Cookie{Name: prefsCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+		prefs = serverstore.ClientPreferences{FavoriteAgents: []string{}, RecentTargets: []string{}}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to access client preferences: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		logger.Errorf("Failed to encode preferences response: %v", err)
+	}
+}
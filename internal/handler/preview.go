@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/dns"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+// previewResolveTimeout bounds the DNS lookups of one preview.
+const previewResolveTimeout = 3 * time.Second
+
+// previewRun is one execution a preview expects: a single one, or one per
+// family for ip_version "dual".
+type previewRun struct {
+	IPVersion string `json:"ip_version"`
+	Family    string `json:"family,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// CommandLine is the resolved template; only control-panel sessions see it
+	// since templates may carry credentials.
+	CommandLine string `json:"command_line,omitempty"`
+}
+
+// handlePreview handles POST /api/preview?session_id=… with an /api/exec body.
+// It runs the checks /api/exec would, including the ban, terms and rate
+// limit, and answers with what would be executed, without executing anything.
+// Domains are resolved here the way the agent would; the agent resolves again
+// when the command really runs, so its view may differ.
+func (h *Handler) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// A preview resolves domains on the server, so it is refused to the same
+	// clients /api/exec refuses and counts against the same rate limit.
+	clientIP := h.getRealIP(r)
+	if h.clientBanned(clientIP) && !h.shadowed(&h.shadow.banned, "banned client [%s], session %s", clientIP, sessionID) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	if !h.termsSatisfied(sessionID) {
+		http.Error(w, "Please accept the terms of use before running commands", http.StatusForbidden)
+		return
+	}
+	if ok, remaining := h.checkExecRateLimit(h.clientID(r), clientIP); !ok &&
+		!h.shadowed(&h.shadow.rateLimited, "rate limit exceeded by client [%s], session %s", clientIP, sessionID) {
+		retry := int(remaining.Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprint(retry))
+		http.Error(w, fmt.Sprintf("Rate limit exceeded. Please wait %d seconds before trying again.", retry), http.StatusTooManyRequests)
+		return
+	}
+	if err := validateExecOptions(req); err != nil {
+		h.writeInputError(w, err)
+		return
+	}
+
+	authenticated := h.isAuthenticatedViewer(r)
+	found, online := h.localAgentState(req.Agent)
+	if !found || !h.agentManager.AgentVisible(req.Agent, authenticated) {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	cmdConfig, ok := h.getCommandConfig(req.Agent, req.Command)
+	if !ok || !h.commandVisible(req.Agent, req.Command, authenticated) {
+		http.Error(w, "Invalid command", http.StatusBadRequest)
+		return
+	}
+
+	view, known := config.FindView(cmdConfig.Views, req.View)
+	if req.View != "" && !known {
+		h.writeInputError(w, unknownViewError(req.View))
+		return
+	}
+
+	valid, err := h.validateTarget(req.Agent, req.Command, req.Target)
+	if err != nil {
+		h.writeInputError(w, err)
+		return
+	}
+	if h.blockedTarget(valid) {
+		http.Error(w, "Target is not allowed on this looking glass", http.StatusForbidden)
+		return
+	}
+	requiresTarget := valid.Type != validator.TargetNone
+	// Host targets are reported as the ip or domain they turned out to be.
+	target, targetType := valid.Value, string(valid.Type)
+	switch {
+	case valid.Resolvable():
+		targetType = "domain"
+	case valid.Type == validator.TargetHost || valid.Type == validator.TargetHostPort:
+		targetType = "ip"
+	}
+
+	ipVersion := req.IPVersion
+	if ipVersion == "" {
+		ipVersion = "auto"
+	}
+	versions := []string{ipVersion}
+	if ipVersion == ipVersionDual {
+		versions = []string{"auto"}
+		if targetType == "domain" {
+			versions = nil
+			for _, f := range dualStackFamilies {
+				versions = append(versions, f.version)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), previewResolveTimeout)
+	defer cancel()
+	runs := make([]previewRun, 0, len(versions))
+	for _, version := range versions {
+		run := previewRun{IPVersion: version}
+		address := target
+		switch targetType {
+		case "ip":
+			run.Family, run.Address = addressFamily(net.ParseIP(valid.Host)), valid.Host
+		case "domain":
+			ips, err := dns.ResolveWithVersion(ctx, valid.Domain, dns.IPVersion(version))
+			if err != nil || len(ips) == 0 {
+				run.Error = fmt.Sprintf("could not resolve %s for %s", valid.Domain, version)
+			} else {
+				run.Family, run.Address = addressFamily(ips[0]), ips[0].String()
+				address = run.Address
+				if valid.Port != "" {
+					address = net.JoinHostPort(run.Address, valid.Port)
+				}
+			}
+		}
+		if authenticated {
+			run.CommandLine = previewCommandLine(cmdConfig, view, address, requiresTarget)
+		}
+		runs = append(runs, run)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	response := map[string]any{
+		"agent":        req.Agent,
+		"agent_online": online,
+		"command":      req.Command,
+		"target":       target,
+		"target_type":  targetType,
+		"ip_version":   ipVersion,
+		"plugin":       cmdConfig.UsePlugin,
+		"weight":       max(cmdConfig.Weight, 1),
+		"runs":         runs,
+	}
+	if req.View != "" {
+		response["view"] = req.View
+	}
+	if valid.Unicode != "" {
+		response["target_unicode"] = valid.Unicode
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// commandVisible reports whether the viewer may run command on agentName.
+func (h *Handler) commandVisible(agentName, command string, authenticated bool) bool {
+	return h.agentManager.IsCommandAvailable(agentName, command) &&
+		h.agentManager.CommandVisible(agentName, command, authenticated)
+}
+
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// previewCommandLine builds the command line the agent would run for target
+// from view, mirroring its template substitution.
+func previewCommandLine(cmdConfig config.CommandInfo, view config.CommandView, target string, requiresTarget bool) string {
+	if !requiresTarget {
+		target = ""
+	}
+	if cmdConfig.UsePlugin != "" {
+		return strings.TrimSpace(fmt.Sprintf("plugin:%s %s", cmdConfig.UsePlugin, target))
+	}
+	template := config.ApplyView(cmdConfig.Template, view)
+	if view.VRF != "" {
+		template = "ip vrf exec " + view.VRF + " " + template
+	}
+	if strings.Contains(template, "{target}") {
+		return strings.ReplaceAll(template, "{target}", target)
+	}
+	return strings.TrimSpace(template + " " + target)
+}
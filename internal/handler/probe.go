@@ -10,10 +10,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"YALS/internal/logger"
-	"YALS/internal/probe"
-	"YALS/internal/proto"
-	serverstore "YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/probe"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
 )
 
 const (
@@ -62,7 +63,13 @@ func (h *Handler) InitProbing(targetsPath string) {
 // runReportWriter is the single goroutine that persists queued agent reports, so
 // the per-agent gRPC receive loops never block on the database.
 func (h *Handler) runReportWriter() {
-	for job := range h.reportQueue {
+	for {
+		var job reportJob
+		select {
+		case <-h.ctx.Done():
+			return
+		case job = <-h.reportQueue:
+		}
 		switch {
 		case job.metrics != nil:
 			h.writeMetricsReport(job.uuid, *job.metrics)
@@ -130,6 +137,7 @@ func (h *Handler) writeProbeReport(uuid string, batch proto.ProbeBatch) {
 	if err := h.store.InsertProbeResults(rows); err != nil {
 		logger.Warnf("Failed to store probe results: %v", err)
 	}
+	h.detectProbeChanges(uuid, name, batch)
 }
 
 // reloadTargets (re)loads targets.yaml, purges orphaned probe data (renamed or
@@ -148,9 +156,11 @@ func (h *Handler) reloadTargets(initial bool) {
 	}
 	h.probeMu.Unlock()
 
-	if err := h.store.PurgeProbeTargets(probe.Names(targets)); err != nil {
+	names := probe.Names(targets)
+	if err := h.store.PurgeProbeTargets(names); err != nil {
 		logger.Warnf("Failed to purge stale probe data: %v", err)
 	}
+	h.changes.forgetProbeTargets(names)
 	if !initial {
 		logger.Infof("Reloaded %d probe targets from %s", len(targets), h.probePath)
 	}
@@ -161,7 +171,12 @@ func (h *Handler) reloadTargets(initial bool) {
 func (h *Handler) watchTargetsFile() {
 	ticker := time.NewTicker(targetsPollInterval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		info, err := os.Stat(h.probePath)
 		if err != nil {
 			continue
@@ -178,7 +193,12 @@ func (h *Handler) watchTargetsFile() {
 func (h *Handler) runProbePruner() {
 	ticker := time.NewTicker(probePruneInterval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		cutoff := time.Now().Add(-probeResultRetention).Unix()
 		if err := h.store.PruneProbeResults(cutoff); err != nil {
 			logger.Warnf("Failed to prune probe results: %v", err)
@@ -228,11 +248,35 @@ func (h *Handler) pushProbeConfigToAgent(uuid string) {
 // ---- HTTP endpoints ----
 
 type statusItem struct {
-	UUID    string                    `json:"uuid"`
-	Name    string                    `json:"name"`
-	Group   string                    `json:"group"`
-	Online  bool                      `json:"online"`
-	Metrics *serverstore.AgentMetrics `json:"metrics,omitempty"`
+	UUID           string                    `json:"uuid"`
+	Name           string                    `json:"name"`
+	Group          string                    `json:"group"`
+	Online         bool                      `json:"online"`
+	NeverConnected bool                      `json:"never_connected,omitempty"`
+	Metrics        *serverstore.AgentMetrics `json:"metrics,omitempty"`
+}
+
+// orderedAgentStatuses returns the agent status list in the operator-defined
+// order (same as the control panel) so the Status page is stable instead of
+// following the agent map's random iteration order. Unknown UUIDs sort last.
+func (h *Handler) orderedAgentStatuses() []agent.AgentStatusLite {
+	statuses := h.agentManager.GetAgentStatusList()
+	if order, err := h.store.ListAgentOrder(); err == nil {
+		idx := make(map[string]int, len(order))
+		for i, uuid := range order {
+			idx[uuid] = i
+		}
+		rank := func(uuid string) int {
+			if i, ok := idx[uuid]; ok {
+				return i
+			}
+			return len(order)
+		}
+		sort.SliceStable(statuses, func(i, j int) bool {
+			return rank(statuses[i].UUID) < rank(statuses[j].UUID)
+		})
+	}
+	return statuses
 }
 
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -252,30 +296,15 @@ func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	statuses := h.agentManager.GetAgentStatusList()
-
-	// Order the cards by the operator-defined order (same as the control panel)
-	// so the Status page is stable instead of following the agent map's random
-	// iteration order. Unknown UUIDs sort last.
-	if order, err := h.store.ListAgentOrder(); err == nil {
-		idx := make(map[string]int, len(order))
-		for i, uuid := range order {
-			idx[uuid] = i
-		}
-		rank := func(uuid string) int {
-			if i, ok := idx[uuid]; ok {
-				return i
-			}
-			return len(order)
-		}
-		sort.SliceStable(statuses, func(i, j int) bool {
-			return rank(statuses[i].UUID) < rank(statuses[j].UUID)
-		})
-	}
+	statuses := h.orderedAgentStatuses()
 
+	authenticated := h.isAuthenticatedViewer(r)
 	items := make([]statusItem, 0, len(statuses))
 	for _, a := range statuses {
-		item := statusItem{UUID: a.UUID, Name: a.Name, Group: a.Group, Online: a.Online}
+		if !h.agentManager.GroupVisible(a.Group, authenticated) {
+			continue
+		}
+		item := statusItem{UUID: a.UUID, Name: a.Name, Group: a.Group, Online: a.Online, NeverConnected: a.NeverConnected}
 		if m, ok := metricsByUUID[a.UUID]; ok {
 			snapshot := m
 			item.Metrics = &snapshot
@@ -306,16 +335,36 @@ type probeRow struct {
 	LossPct   float64 `json:"loss_pct"`
 }
 
+// probeWindows are the time windows of the probe views, in seconds. Those
+// past a day read the probe rollups.
+var probeWindows = map[string]int64{
+	"1h":  3600,
+	"6h":  6 * 3600,
+	"12h": 12 * 3600,
+	"24h": 24 * 3600,
+	"7d":  7 * 86400,
+	"30d": 30 * 86400,
+	"1y":  365 * 86400,
+}
+
 func windowSeconds(window string) int64 {
-	switch window {
-	case "6h":
-		return 6 * 3600
-	case "12h":
-		return 12 * 3600
-	case "24h":
-		return 24 * 3600
+	if seconds, ok := probeWindows[window]; ok {
+		return seconds
+	}
+	return 3600 // 1h
+}
+
+// probeResolution picks the finest probe data still covering a window of the
+// given length: raw results, then the 5-minute and the hourly rollups.
+func (h *Handler) probeResolution(seconds int64) int64 {
+	window := time.Duration(seconds) * time.Second
+	switch {
+	case window <= probeResultRetention:
+		return serverstore.ProbeRaw
+	case window <= h.retention.probe5m:
+		return serverstore.ProbeFiveMinutes
 	default:
-		return 3600 // 1h
+		return serverstore.ProbeHourly
 	}
 }
 
@@ -329,15 +378,16 @@ func (h *Handler) handleProbes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	agentName := strings.TrimSpace(r.URL.Query().Get("agent"))
-	if agentName == "" {
-		agentName = h.firstAgentName()
+	agentName, ok := h.probeAgent(w, r)
+	if !ok {
+		return
 	}
-	sinceTS := time.Now().Add(-time.Duration(windowSeconds(r.URL.Query().Get("window"))) * time.Second).Unix()
+	window := windowSeconds(r.URL.Query().Get("window"))
+	sinceTS := time.Now().Add(-time.Duration(window) * time.Second).Unix()
 
 	aggByName := map[string]serverstore.ProbeAggregate{}
 	if agentName != "" {
-		aggs, err := h.store.QueryProbeAggregates(agentName, sinceTS)
+		aggs, err := h.store.QueryProbeAggregates(agentName, sinceTS, h.probeResolution(window))
 		if err != nil {
 			logger.Errorf("Failed to query probe aggregates: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -376,7 +426,8 @@ func (h *Handler) handleProbes(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleProbesSeries returns one target's per-cycle latency over a window, for
-// the expandable per-row chart on the Probes page.
+// the expandable per-row chart on the Probes page. Windows past a day get a
+// point per rollup bucket.
 func (h *Handler) handleProbesSeries(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -387,16 +438,17 @@ func (h *Handler) handleProbesSeries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	agentName := strings.TrimSpace(r.URL.Query().Get("agent"))
-	if agentName == "" {
-		agentName = h.firstAgentName()
+	agentName, ok := h.probeAgent(w, r)
+	if !ok {
+		return
 	}
 	target := strings.TrimSpace(r.URL.Query().Get("target"))
-	sinceTS := time.Now().Add(-time.Duration(windowSeconds(r.URL.Query().Get("window"))) * time.Second).Unix()
+	window := windowSeconds(r.URL.Query().Get("window"))
+	sinceTS := time.Now().Add(-time.Duration(window) * time.Second).Unix()
 
 	points := []serverstore.ProbeSeriesPoint{}
 	if agentName != "" && target != "" {
-		got, err := h.store.QueryProbeSeries(agentName, target, sinceTS)
+		got, err := h.store.QueryProbeSeries(agentName, target, sinceTS, h.probeResolution(window))
 		if err != nil {
 			logger.Errorf("Failed to query probe series: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -420,17 +472,34 @@ func (h *Handler) handleProbesMeta(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	names := h.agentNames()
+	names := h.agentNames(h.isAuthenticatedViewer(r))
 	w.Header().Set("Content-Type", "application/json")
 	h.setNoCacheHeaders(w)
 	_ = json.NewEncoder(w).Encode(map[string]any{"agents": names})
 }
 
-func (h *Handler) agentNames() []string {
+// probeAgent returns the agent a probe request is for: the one named in the
+// query, or the first the viewer may see. A named agent the viewer may not see
+// gets a 404, as if it did not exist; ok is false then.
+func (h *Handler) probeAgent(w http.ResponseWriter, r *http.Request) (agentName string, ok bool) {
+	authenticated := h.isAuthenticatedViewer(r)
+	agentName = strings.TrimSpace(r.URL.Query().Get("agent"))
+	if agentName == "" {
+		return h.firstAgentName(authenticated), true
+	}
+	if !h.agentManager.AgentVisible(agentName, authenticated) {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return "", false
+	}
+	return agentName, true
+}
+
+// agentNames lists the agents the viewer may see, by name.
+func (h *Handler) agentNames(authenticated bool) []string {
 	agents := h.agentManager.GetAgents()
 	names := make([]string, 0, len(agents))
 	for _, a := range agents {
-		if name, ok := a["name"].(string); ok && name != "" {
+		if name, ok := a["name"].(string); ok && name != "" && h.agentManager.AgentVisible(name, authenticated) {
 			names = append(names, name)
 		}
 	}
@@ -438,8 +507,8 @@ func (h *Handler) agentNames() []string {
 	return names
 }
 
-func (h *Handler) firstAgentName() string {
-	names := h.agentNames()
+func (h *Handler) firstAgentName(authenticated bool) string {
+	names := h.agentNames(authenticated)
 	if len(names) > 0 {
 		return names[0]
 	}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+const (
+	defaultLossChangePercent = 20
+	probeEventsDefaultLimit  = 100
+	probeEventsMaxLimit      = 1000
+	probeEventKindLoss       = "loss"
+)
+
+// probeChanges compares each scheduled probe run with the previous run of the
+// same agent and target. Scheduled probes are latency checks, so only their
+// loss is compared; there are no scheduled traceroutes whose AS paths could
+// be.
+type probeChanges struct {
+	lossThreshold float64
+	webhookURL    string
+
+	mu sync.Mutex
+	// lastLoss is the previous run's loss in percent per agent UUID and
+	// target (see probeChangeKey).
+	lastLoss map[string]float64
+}
+
+func probeChangeKey(uuid, target string) string {
+	return uuid + "\x00" + target
+}
+
+// forgetProbeTargets drops the previous runs of targets not in keep, as
+// reloadTargets purges their stored results.
+func (c *probeChanges) forgetProbeTargets(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.lastLoss {
+		if _, target, _ := strings.Cut(key, "\x00"); !keep[target] {
+			delete(c.lastLoss, key)
+		}
+	}
+}
+
+// forgetProbeAgent drops the previous runs of a deleted agent.
+func (c *probeChanges) forgetProbeAgent(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := probeChangeKey(uuid, "")
+	for key := range c.lastLoss {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.lastLoss, key)
+		}
+	}
+}
+
+// InitProbeChanges sets the change-detection threshold and the optional
+// notification webhook. It must run before InitProbing starts the report
+// writer.
+func (h *Handler) InitProbeChanges(cfg *config.Config) {
+	h.changes.lossThreshold = defaultLossChangePercent
+	h.changes.webhookURL = strings.TrimSpace(cfg.Monitoring.WebhookURL)
+	h.changes.lastLoss = make(map[string]float64)
+	if t := cfg.Monitoring.LossChangePercent; t > 0 {
+		h.changes.lossThreshold = t
+	}
+	if h.changes.webhookURL != "" {
+		h.agentManager.Events().Subscribe(0, h.notifyProbeChange, events.ProbeChanged)
+		logger.Infof("Probe change notifications enabled (loss change >= %.0f%%)", h.changes.lossThreshold)
+	}
+}
+
+// detectProbeChanges records an event for every target whose packet loss
+// moved by at least the threshold since the agent's previous run. Called by
+// the report writer after storing batch.
+func (h *Handler) detectProbeChanges(uuid, agentName string, batch proto.ProbeBatch) {
+	for _, r := range batch.Results {
+		if r.Sent <= 0 {
+			continue
+		}
+		loss := 100 * float64(r.Sent-r.Recv) / float64(r.Sent)
+		key := probeChangeKey(uuid, r.Name)
+		h.changes.mu.Lock()
+		previous, seen := h.changes.lastLoss[key]
+		h.changes.lastLoss[key] = loss
+		h.changes.mu.Unlock()
+		if !seen || math.Abs(loss-previous) < h.changes.lossThreshold {
+			continue
+		}
+		h.recordProbeEvent(serverstore.ProbeEvent{
+			AgentUUID:  uuid,
+			AgentName:  agentName,
+			TargetName: r.Name,
+			Kind:       probeEventKindLoss,
+			Previous:   previous,
+			Current:    loss,
+			TS:         batch.TS,
+		})
+	}
+}
+
+func (h *Handler) recordProbeEvent(e serverstore.ProbeEvent) {
+	id, err := h.store.InsertProbeEvent(e)
+	if err != nil {
+		logger.Warnf("Failed to store probe event: %v", err)
+		return
+	}
+	e.ID = id
+	detail := describeProbeEvent(e)
+	logger.Infof("Probe change on %s: %s", e.AgentName, detail)
+	h.agentManager.Events().Publish(events.Event{
+		Type:      events.ProbeChanged,
+		Time:      time.Unix(e.TS, 0),
+		AgentUUID: e.AgentUUID,
+		Agent:     e.AgentName,
+		Target:    e.TargetName,
+		Detail:    detail,
+	})
+}
+
+func describeProbeEvent(e serverstore.ProbeEvent) string {
+	return fmt.Sprintf("packet loss to %s went from %.0f%% to %.0f%%", e.TargetName, e.Previous, e.Current)
+}
+
+// notifyProbeChange POSTs a probe change to monitoring.webhook_url. The
+// "text" field makes the payload usable as a Slack incoming webhook.
+func (h *Handler) notifyProbeChange(e events.Event) {
+	body, err := json.Marshal(map[string]any{
+		"text":       fmt.Sprintf("[YALS] %s: %s", e.Agent, e.Detail),
+		"type":       string(e.Type),
+		"agent":      e.Agent,
+		"agent_uuid": e.AgentUUID,
+		"target":     e.Target,
+		"detail":     e.Detail,
+		"time":       e.Time.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	go h.postSigned(h.changes.webhookURL, body, "probe change notification", nil)
+}
+
+// handleControlProbeEvents handles GET /api/control/probe-events - the newest
+// recorded probe changes (?limit=, default 100).
+func (h *Handler) handleControlProbeEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := probeEventsDefaultLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, probeEventsMaxLimit)
+	}
+	list, err := h.store.ListProbeEvents(limit)
+	if err != nil {
+		logger.Errorf("Failed to list probe events: %v", err)
+		http.Error(w, "Failed to list probe events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"loss_change_percent": h.changes.lossThreshold,
+		"events":              list,
+	})
+}
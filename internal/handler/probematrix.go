@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// probeMatrix is the agent × target heatmap of /api/control/probe-matrix.
+// Row i of LatencyMs and LossPct is Agents[i], column j is Targets[j]; a cell
+// is null when the agent has no result for the target in the window, and
+// LatencyMs also when every cycle was lost.
+type probeMatrix struct {
+	Window      string       `json:"window"`
+	Since       int64        `json:"since"`
+	GeneratedAt int64        `json:"generated_at"`
+	Agents      []string     `json:"agents"`
+	Targets     []string     `json:"targets"`
+	LatencyMs   [][]*float64 `json:"latency_ms"`
+	LossPct     [][]*float64 `json:"loss_pct"`
+}
+
+// handleControlProbeMatrix returns the average latency and the loss of every
+// agent towards every probe target over ?window= (1h to 24h, 7d, 30d or 1y), for
+// a heatmap of a probe mesh. ?agents=, ?group= and ?targets= (comma-separated
+// names) narrow it down.
+func (h *Handler) handleControlProbeMatrix(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	window := query.Get("window")
+	if _, ok := probeWindows[window]; !ok {
+		window = "1h"
+	}
+	now := time.Now()
+	seconds := windowSeconds(window)
+	sinceTS := now.Add(-time.Duration(seconds) * time.Second).Unix()
+	cells, err := h.store.QueryProbeMatrix(sinceTS, h.probeResolution(seconds))
+	if err != nil {
+		logger.Errorf("Failed to query probe matrix: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	agentFilter, targetFilter := nameSet(query.Get("agents")), nameSet(query.Get("targets"))
+	group := strings.TrimSpace(query.Get("group"))
+	var agents []string
+	for _, a := range h.agentManager.GetAgentStatusList() {
+		if (agentFilter == nil || agentFilter[a.Name]) && (group == "" || a.Group == group) {
+			agents = append(agents, a.Name)
+		}
+	}
+	slices.Sort(agents)
+	var targets []string
+	h.probeMu.RLock()
+	for _, t := range h.probeTargets {
+		if targetFilter == nil || targetFilter[t.Name] {
+			targets = append(targets, t.Name)
+		}
+	}
+	h.probeMu.RUnlock()
+
+	m := probeMatrix{
+		Window:      window,
+		Since:       sinceTS,
+		GeneratedAt: now.Unix(),
+		Agents:      agents,
+		Targets:     targets,
+		LatencyMs:   make([][]*float64, len(agents)),
+		LossPct:     make([][]*float64, len(agents)),
+	}
+	if m.Agents == nil {
+		m.Agents = []string{}
+	}
+	if m.Targets == nil {
+		m.Targets = []string{}
+	}
+	row := make(map[string]int, len(agents))
+	for i, name := range agents {
+		row[name] = i
+		m.LatencyMs[i] = make([]*float64, len(targets))
+		m.LossPct[i] = make([]*float64, len(targets))
+	}
+	column := make(map[string]int, len(targets))
+	for j, name := range targets {
+		column[name] = j
+	}
+	for _, c := range cells {
+		i, okRow := row[c.AgentName]
+		j, okColumn := column[c.TargetName]
+		if !okRow || !okColumn || c.Sent <= 0 {
+			continue
+		}
+		m.LossPct[i][j] = roundedCell(float64(c.Sent-c.Recv) / float64(c.Sent) * 100)
+		if c.AvgMs.Valid {
+			m.LatencyMs[i][j] = roundedCell(c.AvgMs.Float64)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(m)
+}
+
+// nameSet parses a comma-separated list of names, or returns nil for an
+// empty one.
+func nameSet(list string) map[string]bool {
+	var set map[string]bool
+	for name := range strings.SplitSeq(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// roundedCell keeps one decimal of a matrix value, which is all a heatmap
+// shows and keeps large matrices small.
+func roundedCell(v float64) *float64 {
+	v = math.Round(v*10) / 10
+	return &v
+}
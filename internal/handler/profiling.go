@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+)
+
+// InitProfiling enables the runtime profiles of server.profiling.
+func (h *Handler) InitProfiling(cfg *config.Config) {
+	h.profiling = cfg.Server.Profiling
+}
+
+// handleControlProfiling serves net/http/pprof under
+// /api/control/debug/pprof/ to authenticated operators, e.g.
+//
+//	go tool pprof -http : 'https://host/api/control/debug/pprof/profile?seconds=30'
+//
+// with the control token in an Authorization header. It is not found unless
+// server.profiling is set.
+func (h *Handler) handleControlProfiling(w http.ResponseWriter, r *http.Request) {
+	if !h.profiling {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	h.setNoCacheHeaders(w)
+	name := strings.TrimPrefix(r.URL.Path, "/api/control/debug/pprof/")
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		// pprof.Index serves the named profiles by their /debug/pprof/ path.
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/debug/pprof/" + name
+		pprof.Index(w, r2)
+	}
+}
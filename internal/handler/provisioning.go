@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+const (
+	provisionDefaultGrace  = 24 * time.Hour
+	provisionCheckInterval = 5 * time.Minute
+)
+
+// provisioningAlerts watches expected agents: provisioned ones that do not
+// connect in time, and connecting ones whose address is not one of those
+// recorded in their details. Each is reported on the bus, from where it is
+// emailed (notify.go) and POSTed to monitoring.webhook_url.
+type provisioningAlerts struct {
+	enabled    bool
+	grace      time.Duration
+	webhookURL string
+
+	mu sync.Mutex
+	// overdue holds the never-connected agents already reported, so each is
+	// reported once per server run.
+	overdue map[string]bool
+	// mismatched holds, per agent UUID, the unexpected address last
+	// reported, so a reconnect from the same address stays quiet.
+	mismatched map[string]string
+}
+
+// InitProvisioningAlerts starts watching expected agents when their events
+// are emailed or monitoring.provisioning_alerts is set. It must run after
+// InitNotifications.
+func (h *Handler) InitProvisioningAlerts(cfg *config.Config) {
+	p := &h.provisioning
+	p.grace = provisionDefaultGrace
+	if hours := cfg.Monitoring.ProvisionGraceHours; hours > 0 {
+		p.grace = time.Duration(hours) * time.Hour
+	}
+	p.overdue = make(map[string]bool)
+	p.mismatched = make(map[string]string)
+
+	if url := strings.TrimSpace(cfg.Monitoring.WebhookURL); cfg.Monitoring.ProvisioningAlerts && url != "" {
+		p.webhookURL = url
+		h.agentManager.Events().Subscribe(0, h.notifyProvisioningAlert, events.AgentNeverConnected, events.AgentDetailsMismatch)
+	}
+	emailed := h.notifications.email[notifyAgentNeverConnected] != nil || h.notifications.email[notifyAgentDetailsMismatch] != nil
+	if p.webhookURL == "" && !emailed {
+		return
+	}
+	p.enabled = true
+	logger.Infof("Provisioning alerts enabled (agents not connected within %s)", p.grace)
+	go h.runProvisionChecks()
+}
+
+func (h *Handler) runProvisionChecks() {
+	h.checkProvisionedAgents()
+	ticker := time.NewTicker(provisionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.checkProvisionedAgents()
+	}
+}
+
+// checkProvisionedAgents reports the agents still never connected a grace
+// period after they were created.
+func (h *Handler) checkProvisionedAgents() {
+	records, err := h.store.ListAgents()
+	if err != nil {
+		logger.Warnf("Failed to list agents for provisioning alerts: %v", err)
+		return
+	}
+	now := time.Now()
+	p := &h.provisioning
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, record := range records {
+		if !record.NeverConnected {
+			delete(p.overdue, record.UUID)
+			continue
+		}
+		if p.overdue[record.UUID] || now.Sub(record.CreatedAt) < p.grace {
+			continue
+		}
+		p.overdue[record.UUID] = true
+		h.agentManager.Events().Publish(events.Event{
+			Type:      events.AgentNeverConnected,
+			AgentUUID: record.UUID,
+			Agent:     record.Name,
+			Detail:    fmt.Sprintf("provisioned at %s and has not connected since", record.CreatedAt.UTC().Format(time.RFC3339)),
+		})
+	}
+}
+
+// checkAgentAddress reports an agent whose handshake came from an address
+// other than the ipv4, ipv6 and test_ip of its record. Agents without
+// recorded addresses, and connections over loopback (such as SSH tunnels),
+// are not checked.
+func (h *Handler) checkAgentAddress(ctx context.Context, record serverstore.AgentRecord) {
+	p := &h.provisioning
+	if !p.enabled {
+		return
+	}
+	remote, ok := peerIP(ctx)
+	if !ok {
+		return
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || ip.IsLoopback() {
+		return
+	}
+	var recorded []string
+	for _, address := range []string{record.Details.IPv4, record.Details.IPv6, record.Details.TestIP} {
+		expected := net.ParseIP(strings.TrimSpace(address))
+		if expected == nil {
+			continue
+		}
+		if expected.Equal(ip) {
+			p.mu.Lock()
+			delete(p.mismatched, record.UUID)
+			p.mu.Unlock()
+			return
+		}
+		recorded = append(recorded, expected.String())
+	}
+	if len(recorded) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	if p.mismatched[record.UUID] == ip.String() {
+		p.mu.Unlock()
+		return
+	}
+	p.mismatched[record.UUID] = ip.String()
+	p.mu.Unlock()
+
+	detail := fmt.Sprintf("connected from %s, not from its recorded %s", ip, strings.Join(recorded, ", "))
+	logger.Warnf("Agent %s (%s) %s", record.Name, record.UUID, detail)
+	h.agentManager.Events().Publish(events.Event{
+		Type:      events.AgentDetailsMismatch,
+		AgentUUID: record.UUID,
+		Agent:     record.Name,
+		Detail:    detail,
+	})
+}
+
+// notifyProvisioningAlert POSTs a provisioning alert to
+// monitoring.webhook_url, in the same format as probe changes.
+func (h *Handler) notifyProvisioningAlert(e events.Event) {
+	body, err := json.Marshal(map[string]any{
+		"text":       fmt.Sprintf("[YALS] %s: %s", e.Agent, e.Detail),
+		"type":       string(e.Type),
+		"agent":      e.Agent,
+		"agent_uuid": e.AgentUUID,
+		"detail":     e.Detail,
+		"time":       e.Time.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	go h.postSigned(h.provisioning.webhookURL, body, "provisioning alert", nil)
+}
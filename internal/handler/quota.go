@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// apiKey is a configured partner key and its execution quotas.
+type apiKey struct {
+	name         string
+	key          []byte
+	dailyQuota   int64
+	monthlyQuota int64
+}
+
+// InitAPIKeys loads the partner API keys whose executions are metered.
+func (h *Handler) InitAPIKeys(cfg *config.Config) {
+	h.apiKeys = nil
+	for _, k := range cfg.APIKeys {
+		name, key := strings.TrimSpace(k.Name), strings.TrimSpace(k.Key)
+		if name == "" || key == "" {
+			logger.Warnf("Ignoring API key without name or key")
+			continue
+		}
+		h.apiKeys = append(h.apiKeys, apiKey{
+			name:         name,
+			key:          []byte(key),
+			dailyQuota:   max(k.DailyQuota, 0),
+			monthlyQuota: max(k.MonthlyQuota, 0),
+		})
+	}
+	if len(h.apiKeys) > 0 {
+		logger.Infof("Loaded %d API keys with execution quotas", len(h.apiKeys))
+	}
+}
+
+// requestAPIKey returns the key presented in the X-API-Key header. present
+// is false when the header is absent; a present but unknown key returns nil.
+func (h *Handler) requestAPIKey(r *http.Request) (key *apiKey, present bool) {
+	value := strings.TrimSpace(r.Header.Get(apiKeyHeader))
+	if value == "" {
+		return nil, false
+	}
+	for i := range h.apiKeys {
+		if subtle.ConstantTimeCompare(h.apiKeys[i].key, []byte(value)) == 1 {
+			return &h.apiKeys[i], true
+		}
+	}
+	return nil, true
+}
+
+// apiKeyByName returns the key called name, or nil when there is none.
+func (h *Handler) apiKeyByName(name string) *apiKey {
+	for i := range h.apiKeys {
+		if name != "" && h.apiKeys[i].name == name {
+			return &h.apiKeys[i]
+		}
+	}
+	return nil
+}
+
+func quotaIdentity(key *apiKey) string {
+	return "key:" + key.name
+}
+
+func quotaPeriods(now time.Time) (day, month string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01")
+}
+
+// consumeQuota counts one execution against key and reports whether it is
+// still within its daily and monthly quotas. Store errors fail open so a
+// database hiccup does not take partner access down.
+func (h *Handler) consumeQuota(key *apiKey) bool {
+	day, month := quotaPeriods(time.Now())
+	_, _, allowed, err := h.store.ConsumeExecution(quotaIdentity(key), day, month, key.dailyQuota, key.monthlyQuota)
+	if err != nil {
+		logger.Warnf("Failed to count execution for API key %s: %v", key.name, err)
+		return true
+	}
+	return allowed
+}
+
+// refundQuota takes back an execution consumeQuota counted against key for
+// a run that was then refused.
+func (h *Handler) refundQuota(key *apiKey) {
+	day, month := quotaPeriods(time.Now())
+	if err := h.store.RefundExecution(quotaIdentity(key), day, month); err != nil {
+		logger.Warnf("Failed to refund execution for API key %s: %v", key.name, err)
+	}
+}
+
+func (h *Handler) handleControlQuotas(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	day, month := quotaPeriods(time.Now())
+	keys := make([]map[string]any, 0, len(h.apiKeys))
+	for i := range h.apiKeys {
+		key := &h.apiKeys[i]
+		usedToday, err := h.store.ExecutionUsage(quotaIdentity(key), day)
+		if err != nil {
+			http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+			return
+		}
+		usedMonth, err := h.store.ExecutionUsage(quotaIdentity(key), month)
+		if err != nil {
+			http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, map[string]any{
+			"name":            key.name,
+			"daily_quota":     key.dailyQuota,
+			"monthly_quota":   key.monthlyQuota,
+			"used_today":      usedToday,
+			"used_this_month": usedMonth,
+		})
+	}
+
+	groups, err := h.groupUsage(day, month)
+	if err != nil {
+		http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"day":    day,
+		"month":  month,
+		"keys":   keys,
+		"groups": groups,
+	})
+}
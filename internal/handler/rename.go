@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// AgentRenameRequest is the body of POST /api/control/agents/rename.
+type AgentRenameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Merge adds the history of From to the existing agent To, deleting the
+	// agent From if it still exists.
+	Merge bool `json:"merge,omitempty"`
+}
+
+// handleControlAgentRename renames an agent, or merges one into another,
+// taking its history along (see serverstore.RenameAgent). Saving an agent
+// under a new name from the control panel does the same.
+func (h *Handler) handleControlAgentRename(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req AgentRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.From, req.To = strings.TrimSpace(req.From), strings.TrimSpace(req.To)
+	if req.From == "" || req.To == "" || req.From == req.To {
+		http.Error(w, "from and to must be two different agent names", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.renameAgent(req.From, req.To, req.Merge)
+	if err != nil {
+		h.renameError(w, req.From, req.To, req.Merge, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"merged":  result.Merged,
+		"agents":  result.UUIDs,
+		"moved":   result.Moved,
+	})
+}
+
+// renameError answers a failed renameAgent.
+func (h *Handler) renameError(w http.ResponseWriter, from, to string, merge bool, err error) {
+	switch {
+	case errors.Is(err, serverstore.ErrAgentNameTaken):
+		http.Error(w, fmt.Sprintf("Another agent is named %q; merge into it or choose another name", to), http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows) && merge:
+		http.Error(w, fmt.Sprintf("No agent is named %q", to), http.StatusNotFound)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, fmt.Sprintf("No agent is named %q", from), http.StatusNotFound)
+	default:
+		logger.Errorf("Failed to rename agent %s to %s: %v", from, to, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// renameAgent moves the stored agent and history from one name to the
+// other, then the live agents. Execution counts are stored first and held
+// back meanwhile, so that none are left under the old name.
+func (h *Handler) renameAgent(from, to string, merge bool) (*serverstore.AgentRename, error) {
+	h.totals.mu.Lock()
+	defer h.totals.mu.Unlock()
+	h.flushExecutionTotalsLocked()
+
+	result, err := h.store.RenameAgent(from, to, merge)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range result.UUIDs {
+		if result.Merged {
+			_ = h.agentManager.DisconnectAgent(uuid)
+			continue
+		}
+		if record, err := h.store.GetAgentByUUID(uuid); err == nil {
+			h.syncStoredAgent(*record)
+			_ = h.agentManager.ReloadAgent(uuid)
+		}
+	}
+	h.reloadExecutionPauses()
+	h.reloadNotes()
+	if result.Merged {
+		logger.Infof("Merged the history of agent %s into %s", from, to)
+	} else {
+		logger.Infof("Renamed agent %s to %s", from, to)
+	}
+	return result, nil
+}
@@ -0,0 +1,473 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/dns"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+)
+
+const (
+	reputationDefaultCache   = time.Hour
+	reputationDefaultTimeout = 3 * time.Second
+	reputationMaxCached      = 50000
+	// reputationMaxAddresses bounds the addresses of a domain target that
+	// are looked up besides the domain.
+	reputationMaxAddresses = 8
+	reputationActionRefuse = "refuse"
+	reputationActionFlag   = "flag"
+)
+
+// reputationSource looks targets up in one reputation source. A host is an
+// IP address or a lowercase ASCII domain.
+type reputationSource interface {
+	lookup(ctx context.Context, host string) (listed bool, reason string, err error)
+}
+
+// reputationCheck is a configured source with its name and action.
+type reputationCheck struct {
+	name   string
+	action string
+	source reputationSource
+}
+
+// reputationVerdict is the outcome of checking one host against every source.
+type reputationVerdict struct {
+	// refusedBy names the first refusing source that lists the host.
+	refusedBy, reason string
+	// flaggedBy names the flagging sources that list it.
+	flaggedBy []string
+}
+
+type reputationEntry struct {
+	verdict reputationVerdict
+	expires time.Time
+}
+
+// reputation refuses or flags runs against hosts that reputation sources list
+// as abusive (reputation in the configuration).
+type reputation struct {
+	checks  []reputationCheck
+	cache   time.Duration
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cached map[string]reputationEntry
+
+	checked, cacheHits, refused, flagged, errors atomic.Uint64
+}
+
+// InitReputation sets up the reputation sources of cfg. File sources are
+// resolved relative to baseDir.
+func (h *Handler) InitReputation(cfg *config.Config, baseDir string) {
+	rc := cfg.Reputation
+	h.reputation = &reputation{cache: reputationDefaultCache, timeout: reputationDefaultTimeout, cached: make(map[string]reputationEntry)}
+	if rc.CacheMinutes > 0 {
+		h.reputation.cache = time.Duration(rc.CacheMinutes) * time.Minute
+	}
+	if rc.TimeoutSeconds > 0 {
+		h.reputation.timeout = time.Duration(rc.TimeoutSeconds) * time.Second
+	}
+	for i, sc := range rc.Sources {
+		check, err := newReputationCheck(sc, baseDir)
+		if err != nil {
+			logger.Errorf("Ignoring reputation source %d: %v", i+1, err)
+			continue
+		}
+		h.reputation.checks = append(h.reputation.checks, check)
+		logger.Infof("Checking targets against reputation source %s (%s)", check.name, check.action)
+	}
+}
+
+func newReputationCheck(sc config.ReputationSource, baseDir string) (reputationCheck, error) {
+	check := reputationCheck{name: strings.TrimSpace(sc.Name), action: strings.ToLower(strings.TrimSpace(sc.Action))}
+	switch check.action {
+	case "":
+		check.action = reputationActionRefuse
+	case reputationActionRefuse, reputationActionFlag:
+	default:
+		return check, fmt.Errorf("action must be refuse or flag, not %q", sc.Action)
+	}
+	kind := strings.ToLower(strings.TrimSpace(sc.Type))
+	switch kind {
+	case "file":
+		if sc.Path == "" {
+			return check, errors.New("a file source needs a path")
+		}
+		path := sc.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		check.source = &fileReputation{path: path}
+		if check.name == "" {
+			check.name = filepath.Base(path)
+		}
+	case "dnsbl":
+		zone := strings.Trim(strings.ToLower(strings.TrimSpace(sc.Zone)), ".")
+		if zone == "" {
+			return check, errors.New("a dnsbl source needs a zone")
+		}
+		check.source = &dnsblReputation{zone: zone, domains: sc.Domains}
+		if check.name == "" {
+			check.name = zone
+		}
+	case "http":
+		if !strings.HasPrefix(sc.URL, "http://") && !strings.HasPrefix(sc.URL, "https://") {
+			return check, errors.New("an http source needs an http(s) url")
+		}
+		check.source = &httpReputation{url: sc.URL, token: sc.Token, client: &http.Client{}}
+		if check.name == "" {
+			check.name = sc.URL
+		}
+	default:
+		return check, fmt.Errorf("unknown type %q (file, dnsbl or http)", sc.Type)
+	}
+	return check, nil
+}
+
+// checkReputation looks target up in every source, unless the caller holds a
+// control token. A domain is looked up along with the addresses it resolves
+// to, so a name pointed at a listed address is refused too. It returns the
+// message to refuse the run with, or "". Flagged and refused runs are logged.
+// A source that fails or times out counts as not listing the host, and so
+// does a domain that does not resolve.
+func (h *Handler) checkReputation(ctx context.Context, target validator.Target, authenticated bool, clientIP, command string) string {
+	rep := h.reputation
+	if rep == nil || len(rep.checks) == 0 || authenticated || target.Host == "" {
+		return ""
+	}
+	host := target.Host
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.Unmap().String()
+	} else {
+		host = normalizeDomain(host)
+	}
+	hosts := []string{host}
+	if target.Resolvable() {
+		hosts = append(hosts, rep.resolve(ctx, target.Domain)...)
+	}
+
+	flagged := false
+	for _, candidate := range hosts {
+		verdict := rep.verdict(ctx, candidate)
+		listed := host
+		if candidate != host {
+			listed = host + " (" + candidate + ")"
+		}
+		if len(verdict.flaggedBy) > 0 && !flagged {
+			rep.flagged.Add(1)
+			flagged = true
+			logger.Warnf("Client [%s] requested %s against %s, flagged by reputation source %s", clientIP, command, listed, strings.Join(verdict.flaggedBy, ", "))
+		}
+		if verdict.refusedBy != "" {
+			rep.refused.Add(1)
+			logger.Warnf("Client [%s] requested %s against %s, listed by reputation source %s: %s", clientIP, command, listed, verdict.refusedBy, verdict.reason)
+			return "Target is not allowed on this looking glass: it is listed as abusive by " + verdict.refusedBy
+		}
+	}
+	return ""
+}
+
+// resolve returns the IPv4 and IPv6 addresses domain resolves to, as the
+// agent would resolve it (see dns.ResolveWithVersion), at most
+// reputationMaxAddresses of them.
+func (r *reputation) resolve(ctx context.Context, domain string) []string {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	versions := []dns.IPVersion{dns.IPVersionIPv4, dns.IPVersionIPv6}
+	found := make([][]net.IP, len(versions))
+	var wg sync.WaitGroup
+	for i, version := range versions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A family without addresses is not an error here.
+			found[i], _ = dns.ResolveWithVersion(ctx, domain, version)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []string
+	for _, ips := range found {
+		for _, ip := range ips {
+			if len(addrs) == reputationMaxAddresses {
+				return addrs
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap().String())
+			}
+		}
+	}
+	return addrs
+}
+
+// verdict returns the cached verdict on host, or asks every source at once.
+// Verdicts involving a failed source are not cached.
+func (r *reputation) verdict(ctx context.Context, host string) reputationVerdict {
+	r.checked.Add(1)
+	now := time.Now()
+	r.mu.Lock()
+	if e, ok := r.cached[host]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		r.cacheHits.Add(1)
+		return e.verdict
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	type answer struct {
+		listed bool
+		reason string
+		err    error
+	}
+	answers := make([]answer, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listed, reason, err := check.source.lookup(ctx, host)
+			answers[i] = answer{listed, reason, err}
+		}()
+	}
+	wg.Wait()
+
+	var v reputationVerdict
+	failed := false
+	for i, a := range answers {
+		check := r.checks[i]
+		switch {
+		case a.err != nil:
+			failed = true
+			r.errors.Add(1)
+			logger.Warnf("Reputation source %s failed for %s: %v", check.name, host, a.err)
+		case !a.listed:
+		case check.action == reputationActionFlag:
+			v.flaggedBy = append(v.flaggedBy, check.name)
+		case v.refusedBy == "":
+			v.refusedBy, v.reason = check.name, a.reason
+		}
+	}
+	if !failed {
+		r.mu.Lock()
+		if len(r.cached) >= reputationMaxCached {
+			for key, e := range r.cached {
+				if !now.Before(e.expires) {
+					delete(r.cached, key)
+				}
+			}
+			if len(r.cached) >= reputationMaxCached {
+				clear(r.cached)
+			}
+		}
+		r.cached[host] = reputationEntry{verdict: v, expires: now.Add(r.cache)}
+		r.mu.Unlock()
+	}
+	return v
+}
+
+// metrics returns the reputation counters for /api/control/metrics.
+func (r *reputation) metrics() map[string]any {
+	if r == nil {
+		return map[string]any{"sources": 0}
+	}
+	return map[string]any{
+		"sources":    len(r.checks),
+		"checked":    r.checked.Load(),
+		"cache_hits": r.cacheHits.Load(),
+		"refused":    r.refused.Load(),
+		"flagged":    r.flagged.Load(),
+		"errors":     r.errors.Load(),
+	}
+}
+
+// fileReputation is a local blocklist file, read again when it changes.
+type fileReputation struct {
+	path string
+
+	mu            sync.Mutex
+	checked       time.Time
+	modTime       time.Time
+	prefixes      []netip.Prefix
+	prefixReasons []string
+	domains       map[string]string
+}
+
+func (f *fileReputation) lookup(_ context.Context, host string) (bool, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		return false, "", err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		for i, prefix := range f.prefixes {
+			if prefix.Contains(addr) {
+				return true, f.prefixReasons[i], nil
+			}
+		}
+		return false, "", nil
+	}
+	for name := host; name != ""; {
+		if reason, ok := f.domains[name]; ok {
+			return true, reason, nil
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return false, "", nil
+}
+
+// refresh reloads the file when it changed, checking at most every
+// accessListPollInterval. Callers hold mu.
+func (f *fileReputation) refresh() error {
+	if f.domains != nil && time.Since(f.checked) < accessListPollInterval {
+		return nil
+	}
+	f.checked = time.Now()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.domains != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var prefixes []netip.Prefix
+	var reasons []string
+	domains := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		entry, reason, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if entry == "" {
+			continue
+		}
+		reason = strings.TrimSpace(reason)
+		if prefix := parsePrefixes([]string{entry}); len(prefix) == 1 {
+			prefixes = append(prefixes, prefix[0])
+			reasons = append(reasons, reason)
+		} else {
+			domains[normalizeDomain(entry)] = reason
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	f.modTime, f.prefixes, f.prefixReasons, f.domains = info.ModTime(), prefixes, reasons, domains
+	logger.Infof("Loaded %d entries from reputation list %s", len(prefixes)+len(domains), f.path)
+	return nil
+}
+
+// dnsblReputation is a DNS blocklist: a host is listed when its query name
+// resolves to an address in 127.0.0.0/8.
+type dnsblReputation struct {
+	zone    string
+	domains bool
+}
+
+func (d *dnsblReputation) lookup(ctx context.Context, host string) (bool, string, error) {
+	var name string
+	if addr, err := netip.ParseAddr(host); err == nil {
+		name = reverseDNSName(addr) + "." + d.zone
+	} else if d.domains {
+		name = host + "." + d.zone
+	} else {
+		return false, "", nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	for _, addr := range addrs {
+		// Other answers, such as 127.255.255.x, are the list's errors
+		// (refused or rate-limited queries), not listings.
+		if addr.Is4() && addr.As4()[0] == 127 && addr.As4()[1] != 255 {
+			return true, "listed on " + d.zone + " (" + addr.String() + ")", nil
+		}
+	}
+	return false, "", nil
+}
+
+// reverseDNSName is the reversed form of addr used by DNS blocklists:
+// 4.3.2.1 for 1.2.3.4, and reversed nibbles for IPv6.
+func reverseDNSName(addr netip.Addr) string {
+	if addr.Is4() {
+		b := addr.As4()
+		return fmt.Sprintf("%d.%d.%d.%d", b[3], b[2], b[1], b[0])
+	}
+	const hex = "0123456789abcdef"
+	b := addr.As16()
+	labels := make([]string, 0, 32)
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[b[i]&0x0f]), string(hex[b[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// httpReputation asks the operator's own reputation API.
+type httpReputation struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpReputation) lookup(ctx context.Context, host string) (bool, string, error) {
+	kind := "domain"
+	if _, err := netip.ParseAddr(host); err == nil {
+		kind = "ip"
+	}
+	body, _ := json.Marshal(map[string]string{"target": host, "type": kind})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("status %s", resp.Status)
+	}
+	var answer struct {
+		Listed bool   `json:"listed"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&answer); err != nil {
+		return false, "", fmt.Errorf("invalid answer: %w", err)
+	}
+	return answer.Listed, answer.Reason, nil
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultMaxRequestBody = 1 << 20 // bytes
+	defaultMaxHeaderBytes = 64 << 10
+	limiterPruneEvery     = 5 * time.Minute
+)
+
+// requestGuard bounds what a single client can make the server hold: the size
+// of request bodies and headers, how often one IP may open a long-lived
+// stream (command output, status feed, agent connection), and how fast it may
+// call the public API.
+type requestGuard struct {
+	maxBody        int64
+	maxHeaderBytes int
+	// streamOpens counts stream opens per "web:<ip>" / "agent:<ip>" key;
+	// nil when limits.stream_opens_per_minute is 0.
+	streamOpens *RateLimiter
+	// apiRequests counts each IP's calls to the public JSON API over one
+	// second; nil when limits.api_requests_per_second is 0.
+	apiRequests *RateLimiter
+
+	tooLarge      atomic.Uint64
+	opensRejected atomic.Uint64
+	apiThrottled  atomic.Uint64
+}
+
+// InitRequestGuard applies limits.max_request_body, limits.max_header_bytes,
+// limits.stream_opens_per_minute and limits.api_requests_per_second.
+func (h *Handler) InitRequestGuard(cfg *config.Config) {
+	g := &h.requests
+	g.maxBody = defaultMaxRequestBody
+	if kib := cfg.Limits.MaxRequestBody; kib > 0 {
+		g.maxBody = int64(kib) << 10
+	}
+	g.maxHeaderBytes = defaultMaxHeaderBytes
+	if kib := cfg.Limits.MaxHeaderBytes; kib > 0 {
+		g.maxHeaderBytes = kib << 10
+	}
+	g.streamOpens = newWindowLimiter(h.ctx, cfg.Limits.StreamOpensPerMinute, time.Minute)
+	g.apiRequests = newWindowLimiter(h.ctx, cfg.Limits.APIRequestsPerSecond, time.Second)
+}
+
+// newWindowLimiter returns a limiter allowing n events per window and key,
+// pruned in the background until ctx ends, or nil when n is 0.
+func newWindowLimiter(ctx context.Context, n int, window time.Duration) *RateLimiter {
+	if n <= 0 {
+		return nil
+	}
+	var settings config.RuntimeSettings
+	settings.RateLimit.Enabled = true
+	settings.RateLimit.MaxCommands = n
+	settings.RateLimit.TimeWindow = int(window / time.Second)
+	limiter := NewRateLimiter(settings)
+	go pruneLimiter(ctx, limiter)
+	return limiter
+}
+
+// pruneLimiter forgets limiter's idle keys every limiterPruneEvery until ctx
+// ends.
+func pruneLimiter(ctx context.Context, limiter *RateLimiter) {
+	ticker := time.NewTicker(limiterPruneEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		limiter.prune()
+	}
+}
+
+// MaxHeaderBytes is the HTTPS server's limit on request header size; larger
+// requests are answered 431 by net/http.
+func (h *Handler) MaxHeaderBytes() int {
+	return h.requests.maxHeaderBytes
+}
+
+// WithRequestLimits refuses request bodies over limits.max_request_body with
+// 413: up front when the declared length is too large, and by cutting the
+// body off otherwise. It also throttles the public API per client IP.
+func (h *Handler) WithRequestLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.allowAPIRequest(w, r) {
+			return
+		}
+		if r.ContentLength > h.requests.maxBody {
+			h.requests.tooLarge.Add(1)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, h.requests.maxBody)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowStreamOpen counts a browser stream opened by r's client and, past
+// limits.stream_opens_per_minute, answers 429. The caller must return on
+// false.
+func (h *Handler) allowStreamOpen(w http.ResponseWriter, r *http.Request) bool {
+	if h.requests.streamOpens == nil {
+		return true
+	}
+	ip := h.getRealIP(r)
+	if h.requests.streamOpens.checkRateLimit("web:" + ip) {
+		return true
+	}
+	h.rejectStreamOpen("client", ip)
+	retry := int(h.requests.streamOpens.getRemainingTime("web:"+ip).Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(retry))
+	http.Error(w, "Too many requests, please slow down", http.StatusTooManyRequests)
+	return false
+}
+
+// allowAgentConnect is allowStreamOpen for agent handshakes, keyed by the
+// connection's address.
+func (h *Handler) allowAgentConnect(ctx context.Context) bool {
+	if h.requests.streamOpens == nil {
+		return true
+	}
+	ip, ok := peerIP(ctx)
+	if !ok {
+		return true
+	}
+	if h.requests.streamOpens.checkRateLimit("agent:" + ip) {
+		return true
+	}
+	h.rejectStreamOpen("agent", ip)
+	return false
+}
+
+// peerIP returns the address of the agent connection a gRPC call came in on.
+func peerIP(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	ip := p.Addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip, true
+}
+
+// allowAPIRequest applies limits.api_requests_per_second to the public JSON
+// API, where every call takes registry locks and marshals a response (node
+// list polling, previews, preferences, stop). Control, ChatOps and cluster
+// calls are authenticated and not counted. Past the limit the client gets
+// 429 and the caller must return.
+func (h *Handler) allowAPIRequest(w http.ResponseWriter, r *http.Request) bool {
+	if h.requests.apiRequests == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	for _, prefix := range []string{"/api/control/", "/api/chatops/", "/api/cluster/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	if h.requests.apiRequests.checkRateLimit(h.getRealIP(r)) {
+		return true
+	}
+	if n := h.requests.apiThrottled.Add(1); n%100 == 1 {
+		logger.Warnf("Client [%s] over the API request rate; throttled %d requests so far", h.getRealIP(r), n)
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too many requests, please slow down", http.StatusTooManyRequests)
+	return false
+}
+
+func (h *Handler) rejectStreamOpen(kind, ip string) {
+	if n := h.requests.opensRejected.Add(1); n%100 == 1 {
+		logger.Warnf("Too many stream opens from %s %s; rejected %d so far", kind, ip, n)
+	}
+}
@@ -0,0 +1,351 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/store/archive"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+const (
+	resultsDefaultRetention = 7 * 24 * time.Hour
+	resultIDLength          = 24
+	resultsArchiveBatch     = 100
+	resultsArchiveTimeout   = 30 * time.Second
+	resultsDefaultPrefix    = "yals/"
+	resultsDefaultListed    = 20
+	resultsMaxListed        = 100
+)
+
+var resultIDPattern = regexp.MustCompile(`^[a-z0-9]{24}$`)
+
+// InitRouteResults sets how long finished routes stay exportable and where
+// older ones are archived. The retention pruner removes or archives them.
+func (h *Handler) InitRouteResults(cfg *config.Config) {
+	h.resultsRetention = resultsDefaultRetention
+	if days := cfg.Results.RetentionDays; days > 0 {
+		h.resultsRetention = time.Duration(days) * 24 * time.Hour
+	}
+
+	if a := cfg.Results.Archive; a.Endpoint != "" || a.Bucket != "" {
+		client, err := archive.New(archive.Config{
+			Endpoint:    a.Endpoint,
+			Region:      a.Region,
+			Bucket:      a.Bucket,
+			AccessKey:   a.AccessKey,
+			SecretKey:   a.SecretKey,
+			VirtualHost: a.VirtualHost,
+		})
+		if err != nil {
+			logger.Errorf("Result archive disabled: %v", err)
+		} else {
+			h.resultsArchive = client
+			h.resultsArchivePrefix = resultsDefaultPrefix
+			if a.Prefix != "" {
+				h.resultsArchivePrefix = strings.TrimSuffix(a.Prefix, "/") + "/"
+			}
+			logger.Infof("Archiving routes older than %s to bucket %s", h.resultsRetention, a.Bucket)
+		}
+	}
+}
+
+// archiveRouteResults uploads routes stored before cutoff and drops them from
+// the database, keeping their metadata. It stops at the first failed upload
+// and retries on the next run.
+func (h *Handler) archiveRouteResults(cutoff time.Time) {
+	for {
+		records, err := h.store.ListUnarchivedRouteResults(cutoff, resultsArchiveBatch)
+		if err != nil {
+			logger.Warnf("Failed to list routes to archive: %v", err)
+			return
+		}
+		for _, record := range records {
+			key := h.resultsArchivePrefix + "routes/" + record.CreatedAt.UTC().Format("2006/01/02/") + record.ID + ".json"
+			ctx, cancel := context.WithTimeout(context.Background(), resultsArchiveTimeout)
+			err := h.resultsArchive.Put(ctx, key, record.Route, "application/json")
+			cancel()
+			if err != nil {
+				logger.Warnf("Failed to archive route result %s: %v", record.ID, err)
+				return
+			}
+			if err := h.store.MarkRouteResultArchived(record.ID, key); err != nil {
+				logger.Warnf("Failed to archive route result %s: %v", record.ID, err)
+				return
+			}
+			h.resultsArchived.Add(1)
+		}
+		if len(records) < resultsArchiveBatch {
+			return
+		}
+	}
+}
+
+// deleteArchivedRoute deletes an archived route from object storage and
+// reports whether it is gone. Without an archive configured (it was turned
+// off since) the object is left in place.
+func (h *Handler) deleteArchivedRoute(key string) bool {
+	if h.resultsArchive == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resultsArchiveTimeout)
+	defer cancel()
+	if err := h.resultsArchive.Delete(ctx, key); err != nil {
+		logger.Warnf("Failed to delete archived route result %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// loadArchivedRoute fetches an archived route back from object storage.
+func (h *Handler) loadArchivedRoute(ctx context.Context, key string) ([]byte, error) {
+	if h.resultsArchive == nil {
+		return nil, archive.ErrNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, resultsArchiveTimeout)
+	defer cancel()
+	return h.resultsArchive.Get(ctx, key)
+}
+
+// isRouteResult reports whether a structured result is a route.
+func isRouteResult(data json.RawMessage) bool {
+	var head struct {
+		Kind string `json:"kind"`
+	}
+	return json.Unmarshal(data, &head) == nil && head.Kind == proto.ResultKindRoute
+}
+
+// saveRouteResult stores the finished route of req under id, or under a new
+// id when id is empty, owned by owner (see resultOwner). It returns the id,
+// or "" when the route could not be stored, and the result's signature when
+// signing is enabled (see signing.go).
+func (h *Handler) saveRouteResult(id string, req ExecRequest, owner string, route json.RawMessage) (string, *resultSignature) {
+	if id == "" {
+		var err error
+		if id, err = GenerateRandomString(resultIDLength); err != nil {
+			logger.Errorf("Failed to generate result id: %v", err)
+			return "", nil
+		}
+	}
+	record := serverstore.RouteResultRecord{
+		ID:        id,
+		Agent:     req.Agent,
+		Command:   req.Command,
+		Target:    req.Target,
+		Route:     route,
+		CreatedAt: time.Now(),
+		Owner:     owner,
+	}
+	h.signRouteResult(&record)
+	if err := h.store.SaveRouteResult(record); err != nil {
+		logger.Warnf("Failed to store route result: %v", err)
+		return "", nil
+	}
+	return id, h.storedSignature(record)
+}
+
+// resultOwner identifies the caller as the owner of the results it stores:
+// by its API key, else its signed client id, else its preferences cookie,
+// else its session. Only the first two survive the browser's session ending
+// and a cleared cookie. The identity is stored hashed, since the cookie
+// values are bearer secrets.
+func (h *Handler) resultOwner(r *http.Request, sessionID string, key *apiKey) string {
+	var identity string
+	if key != nil {
+		identity = quotaIdentity(key)
+	} else if id := h.clientID(r); id != "" {
+		identity = "client:" + id
+	} else if id := h.preferencesID(nil, r, false); h.prefsEnabled && id != "" {
+		identity = "prefs:" + id
+	} else {
+		identity = "session:" + sessionID
+	}
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:16])
+}
+
+// storedResultInfo is one entry of the /api/results listing.
+type storedResultInfo struct {
+	ResultID  string `json:"result_id"`
+	Agent     string `json:"agent"`
+	Command   string `json:"command"`
+	Target    string `json:"target,omitempty"`
+	CreatedAt string `json:"created_at"`
+	// Archived results load more slowly, from object storage.
+	Archived bool `json:"archived,omitempty"`
+}
+
+// handleMyResults handles GET /api/results - the caller's own stored results,
+// newest first, for a history panel. Other callers' results are never listed.
+func (h *Handler) handleMyResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+	key, present := h.requestAPIKey(r)
+	if present && key == nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	limit := resultsDefaultListed
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, resultsMaxListed)
+	}
+
+	records, err := h.store.ListOwnedRouteResults(h.resultOwner(r, sessionID, key), limit)
+	if err != nil {
+		logger.Errorf("Failed to list route results: %v", err)
+		http.Error(w, "Failed to load results", http.StatusInternalServerError)
+		return
+	}
+	results := make([]storedResultInfo, 0, len(records))
+	for _, record := range records {
+		results = append(results, storedResultInfo{
+			ResultID:  record.ID,
+			Agent:     record.Agent,
+			Command:   record.Command,
+			Target:    record.Target,
+			CreatedAt: record.CreatedAt.UTC().Format(time.RFC3339),
+			Archived:  record.ArchiveKey != "",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// handleResultGeoJSON handles GET /api/results/{id}/geojson - a stored route
+// as a GeoJSON FeatureCollection: one Point per geolocated hop and a
+// LineString along them.
+func (h *Handler) handleResultGeoJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.validateSessionID(r.URL.Query().Get("session_id")) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/results/"), "/geojson")
+	if !ok || !resultIDPattern.MatchString(id) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	record, found, err := h.store.GetRouteResult(id)
+	if err != nil {
+		logger.Errorf("Failed to load route result %s: %v", id, err)
+		http.Error(w, "Failed to load result", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Result not found or expired", http.StatusNotFound)
+		return
+	}
+	if record.ArchiveKey != "" {
+		data, err := h.loadArchivedRoute(r.Context(), record.ArchiveKey)
+		if errors.Is(err, archive.ErrNotFound) {
+			http.Error(w, "Result not found or expired", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Errorf("Failed to load archived route result %s: %v", id, err)
+			http.Error(w, "Failed to load archived result", http.StatusBadGateway)
+			return
+		}
+		record.Route = data
+	}
+	var route proto.RouteResult
+	if err := json.Unmarshal(record.Route, &route); err != nil {
+		http.Error(w, "Failed to load result", http.StatusInternalServerError)
+		return
+	}
+
+	collection := routeGeoJSON(record, route)
+	if signature := h.storedSignature(record); signature != nil {
+		collection["properties"].(map[string]any)["signature"] = signature
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(collection)
+}
+
+// routeGeoJSON converts a route to GeoJSON. Hops without coordinates are
+// left out; coordinates are [longitude, latitude] as GeoJSON requires.
+func routeGeoJSON(record serverstore.RouteResultRecord, route proto.RouteResult) map[string]any {
+	features := []map[string]any{}
+	path := [][]float64{}
+	for _, hop := range route.Hops {
+		if hop.Lat == 0 && hop.Lng == 0 {
+			continue
+		}
+		coords := []float64{hop.Lng, hop.Lat}
+		path = append(path, coords)
+
+		props := map[string]any{"ttl": hop.TTL}
+		for key, value := range map[string]string{
+			"ip":       hop.IP,
+			"hostname": hop.Hostname,
+			"asn":      normalizeASN(hop.ASN),
+			"country":  hop.Country,
+			"province": hop.Province,
+			"city":     hop.City,
+			"owner":    hopOwner(hop),
+		} {
+			if value != "" {
+				props[key] = value
+			}
+		}
+		if len(hop.RTTMs) > 0 {
+			props["rtt_ms"] = hop.RTTMs
+		}
+		features = append(features, map[string]any{
+			"type":       "Feature",
+			"geometry":   map[string]any{"type": "Point", "coordinates": coords},
+			"properties": props,
+		})
+	}
+	if len(path) >= 2 {
+		features = append(features, map[string]any{
+			"type":     "Feature",
+			"geometry": map[string]any{"type": "LineString", "coordinates": path},
+			"properties": map[string]any{
+				"agent":  record.Agent,
+				"target": route.Target,
+			},
+		})
+	}
+
+	return map[string]any{
+		"type":     "FeatureCollection",
+		"features": features,
+		"properties": map[string]any{
+			"result_id":  record.ID,
+			"agent":      record.Agent,
+			"command":    record.Command,
+			"target":     route.Target,
+			"created_at": record.CreatedAt.UTC().Format(time.RFC3339),
+		},
+	}
+}
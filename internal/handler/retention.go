@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+const (
+	retentionPruneInterval          = time.Hour
+	archivedResultsDefaultRetention = 365 * 24 * time.Hour
+	probeEventsDefaultRetention     = 30 * 24 * time.Hour
+	usageDefaultRetention           = 90 * 24 * time.Hour
+	probe5mDefaultRetention         = 30 * 24 * time.Hour
+	probeHourlyDefaultRetention     = 365 * 24 * time.Hour
+	openReportsDefaultRetention     = 30 * 24 * time.Hour
+)
+
+// retentionPolicy bounds the history tables by age and row count, and counts
+// the rows its pruner removed.
+type retentionPolicy struct {
+	archivedResults    time.Duration
+	resultsMaxRows     int
+	probeEvents        time.Duration
+	probeEventsMaxRows int
+	usage              time.Duration
+	// probe5m and probeHourly keep the probe rollups (see probeResolution).
+	probe5m     time.Duration
+	probeHourly time.Duration
+	// openReports is how long an abuse report may stay open.
+	openReports time.Duration
+
+	prunedResults      atomic.Uint64
+	prunedProbeEvents  atomic.Uint64
+	prunedUsage        atomic.Uint64
+	prunedQuotaCounts  atomic.Uint64
+	prunedProbeRollups atomic.Uint64
+	prunedReports      atomic.Uint64
+}
+
+// InitRetention reads the retention limits and starts the pruner. It runs
+// after InitRouteResults, whose retention and archive it applies.
+func (h *Handler) InitRetention(cfg *config.Config) {
+	r := cfg.Retention
+	h.retention.archivedResults = archivedResultsDefaultRetention
+	if r.ArchivedResultsDays > 0 {
+		h.retention.archivedResults = time.Duration(r.ArchivedResultsDays) * 24 * time.Hour
+	}
+	h.retention.probeEvents = probeEventsDefaultRetention
+	if r.ProbeEventsDays > 0 {
+		h.retention.probeEvents = time.Duration(r.ProbeEventsDays) * 24 * time.Hour
+	}
+	h.retention.usage = usageDefaultRetention
+	if r.UsageDays > 0 {
+		h.retention.usage = time.Duration(r.UsageDays) * 24 * time.Hour
+	}
+	h.retention.probe5m = probe5mDefaultRetention
+	if r.ProbeRollup5mDays > 0 {
+		h.retention.probe5m = time.Duration(r.ProbeRollup5mDays) * 24 * time.Hour
+	}
+	h.retention.probeHourly = probeHourlyDefaultRetention
+	if r.ProbeRollupHourlyDays > 0 {
+		h.retention.probeHourly = time.Duration(r.ProbeRollupHourlyDays) * 24 * time.Hour
+	}
+	h.retention.openReports = openReportsDefaultRetention
+	if r.OpenReportsDays > 0 {
+		h.retention.openReports = time.Duration(r.OpenReportsDays) * 24 * time.Hour
+	}
+	h.retention.resultsMaxRows = max(r.ResultsMaxRows, 0)
+	h.retention.probeEventsMaxRows = max(r.ProbeEventsMaxRows, 0)
+	go h.runRetentionPruner()
+}
+
+func (h *Handler) runRetentionPruner() {
+	ticker := time.NewTicker(retentionPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.applyRetention()
+	}
+}
+
+// applyRetention removes (or archives) expired routes, probe events, probe
+// rollups, hourly execution counts, quota counts and unreviewed abuse
+// reports, then trims routes and probe events to their row caps.
+func (h *Handler) applyRetention() {
+	now := time.Now()
+	cutoff := now.Add(-h.resultsRetention)
+	if h.resultsArchive != nil {
+		h.archiveRouteResults(cutoff)
+		before := now.Add(-h.retention.archivedResults)
+		h.removeRouteResults("archived route results", func(limit int) ([]serverstore.RouteResultRecord, error) {
+			return h.store.ListArchivedRouteResults(before, limit)
+		})
+	} else {
+		n, err := h.store.PruneRouteResults(cutoff)
+		h.recordPruned(&h.retention.prunedResults, "route results", n, err)
+	}
+	if h.retention.resultsMaxRows > 0 {
+		h.removeRouteResults("route results", func(limit int) ([]serverstore.RouteResultRecord, error) {
+			return h.store.ListExcessRouteResults(h.retention.resultsMaxRows, limit)
+		})
+	}
+
+	n, err := h.store.PruneProbeEvents(now.Add(-h.retention.probeEvents).Unix())
+	h.recordPruned(&h.retention.prunedProbeEvents, "probe events", n, err)
+	if h.retention.probeEventsMaxRows > 0 {
+		n, err := h.store.TrimProbeEvents(h.retention.probeEventsMaxRows)
+		h.recordPruned(&h.retention.prunedProbeEvents, "probe events", n, err)
+	}
+
+	n, err = h.store.PruneProbeRollups(serverstore.ProbeFiveMinutes, now.Add(-h.retention.probe5m).Unix())
+	h.recordPruned(&h.retention.prunedProbeRollups, "5-minute probe rollups", n, err)
+	n, err = h.store.PruneProbeRollups(serverstore.ProbeHourly, now.Add(-h.retention.probeHourly).Unix())
+	h.recordPruned(&h.retention.prunedProbeRollups, "hourly probe rollups", n, err)
+
+	n, err = h.store.PruneExecutionHistory(now.Add(-h.retention.usage))
+	h.recordPruned(&h.retention.prunedUsage, "hourly execution counts", n, err)
+	n, err = h.store.PruneExecutionUsage(now.Add(-h.retention.usage))
+	h.recordPruned(&h.retention.prunedQuotaCounts, "quota counts", n, err)
+	n, err = h.store.PruneOpenAbuseReports(now.Add(-h.retention.openReports))
+	h.recordPruned(&h.retention.prunedReports, "unreviewed abuse reports", n, err)
+}
+
+// removeRouteResults deletes the routes list returns, a batch at a time,
+// until it returns none. An archived route's object is deleted before its
+// row; a route whose object could not be deleted keeps its row, so the next
+// run retries it.
+func (h *Handler) removeRouteResults(what string, list func(limit int) ([]serverstore.RouteResultRecord, error)) {
+	for {
+		records, err := list(resultsArchiveBatch)
+		if err != nil {
+			h.recordPruned(&h.retention.prunedResults, what, 0, err)
+			return
+		}
+		ids := make([]string, 0, len(records))
+		for _, record := range records {
+			if record.ArchiveKey != "" && !h.deleteArchivedRoute(record.ArchiveKey) {
+				continue
+			}
+			ids = append(ids, record.ID)
+		}
+		n, err := h.store.DeleteRouteResults(ids)
+		h.recordPruned(&h.retention.prunedResults, what, n, err)
+		// A batch that was not removed whole would come back the same.
+		if err != nil || len(ids) < len(records) || len(records) < resultsArchiveBatch {
+			return
+		}
+	}
+}
+
+func (h *Handler) recordPruned(counter *atomic.Uint64, what string, n int64, err error) {
+	if err != nil {
+		logger.Warnf("Failed to prune %s: %v", what, err)
+		return
+	}
+	if n > 0 {
+		counter.Add(uint64(n))
+		logger.Debugf("Pruned %d %s", n, what)
+	}
+}
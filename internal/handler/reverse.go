@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+
+	"google.golang.org/grpc"
+)
+
+// reverseDialInterval is how often the server dials the agents that listen
+// for it and are not connected.
+const reverseDialInterval = 10 * time.Second
+
+// reverseAgents dials the agents that have a dial address, for networks
+// where agents cannot open connections to the server (see agent/reverse.go).
+type reverseAgents struct {
+	listener *agent.ReverseListener
+	mu       sync.Mutex
+	// open holds the agents being dialed or connected; failed the last
+	// error per agent, so that a failing agent is logged once per error.
+	open   map[string]bool
+	failed map[string]string
+}
+
+// validateDialAddress checks an agent's dial address (host:port).
+func validateDialAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("host is required")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// ServeReverseAgents serves the connections the server dials on grpcServer and
+// starts dialing the agents with a dial address.
+func (h *Handler) ServeReverseAgents(grpcServer *grpc.Server) {
+	h.reverse.listener = agent.NewReverseListener()
+	h.reverse.open = make(map[string]bool)
+	h.reverse.failed = make(map[string]string)
+	go func() {
+		if err := grpcServer.Serve(h.reverse.listener); err != nil {
+			logger.Errorf("Dialed agent connections stopped: %v", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(reverseDialInterval)
+		defer ticker.Stop()
+		for {
+			h.dialReverseAgents()
+			select {
+			case <-h.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// dialReverseAgents dials every agent with a dial address that is neither
+// connected nor being dialed.
+func (h *Handler) dialReverseAgents() {
+	records, err := h.store.ListAgents()
+	if err != nil {
+		logger.Warnf("Failed to list agents to dial: %v", err)
+		return
+	}
+	online := make(map[string]bool)
+	for _, uuid := range h.agentManager.OnlineAgentUUIDs() {
+		online[uuid] = true
+	}
+
+	h.reverse.mu.Lock()
+	defer h.reverse.mu.Unlock()
+	for _, record := range records {
+		if record.DialAddress == "" || online[record.UUID] || h.reverse.open[record.UUID] {
+			continue
+		}
+		h.reverse.open[record.UUID] = true
+		go h.dialReverseAgent(record)
+	}
+}
+
+// dialReverseAgent dials one agent and serves the connection until it closes.
+func (h *Handler) dialReverseAgent(record serverstore.AgentRecord) {
+	defer func() {
+		h.reverse.mu.Lock()
+		delete(h.reverse.open, record.UUID)
+		h.reverse.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDialInterval)
+	conn, err := agent.DialAgent(ctx, record.DialAddress, record.UUID, record.Token)
+	cancel()
+
+	h.reverse.mu.Lock()
+	last := h.reverse.failed[record.UUID]
+	if err != nil {
+		h.reverse.failed[record.UUID] = err.Error()
+	} else {
+		delete(h.reverse.failed, record.UUID)
+	}
+	h.reverse.mu.Unlock()
+	if err != nil {
+		if err.Error() != last {
+			logger.Warnf("Failed to dial agent %s at %s: %v", record.Name, record.DialAddress, err)
+		}
+		return
+	}
+
+	logger.Infof("Dialed agent %s at %s", record.Name, record.DialAddress)
+	<-h.reverse.listener.Serve(conn)
+}
@@ -1,20 +1,27 @@
 package handler
 
 import (
+	"container/list"
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"html/template"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"YALS/internal/agent"
-	"YALS/internal/config"
-	"YALS/internal/logger"
-	"YALS/internal/probe"
-	"YALS/internal/proto"
-	serverstore "YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/probe"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/store/archive"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -24,6 +31,9 @@ import (
 
 // Handler handles HTTP requests and implements gRPC service
 type Handler struct {
+	// ctx ends when the server shuts down, and the handler's background
+	// loops with it.
+	ctx             context.Context
 	agentManager    *agent.Manager
 	clients         map[*interface{}]bool
 	clientIPs       map[*interface{}]string
@@ -31,15 +41,163 @@ type Handler struct {
 	sessionConns    map[string]*interface{}
 	commandSessions map[string]string
 	clientsLock     sync.RWMutex
-	activeCommands  map[string]chan bool
+	activeCommands  map[string]*activeCommand
 	commandsLock    sync.RWMutex
 	webDir          string
+	// fallbackPage is the built-in page served when webDir has no frontend
+	// build (see fallback.go).
+	fallbackPage    *template.Template
 	rateLimiter     *RateLimiter
 	store           *serverstore.Store
 	controlSessions sync.Map
 	runtimeMu       sync.RWMutex
 	runtimeSettings config.RuntimeSettings
 
+	// Per-session terms-of-use acknowledgements (see legal.go), each an
+	// element of termsOrder, which holds them oldest first.
+	termsMu         sync.Mutex
+	termsAcks       map[string]*list.Element
+	termsOrder      list.List
+	termsAckLimiter *RateLimiter
+
+	// Shared read-only status feed (see statusfeed.go).
+	statusFeed statusFeed
+
+	// Stream of command starts and finishes for operators (see firehose.go).
+	firehose firehose
+
+	// Nearest-agent suggestions; nil without a database (see geo.go).
+	geo *geolocator
+
+	// Servers advertised to frontends (see endpoints.go).
+	endpoints []advertisedEndpoint
+
+	// File-backed ban/allow lists (see security.go).
+	access accessLists
+
+	// Execution receipt webhooks (see callback.go).
+	callbackSecret []byte
+	callbackClient *http.Client
+
+	// Slack/Telegram chat adapter (see chatops.go).
+	chat chatOps
+
+	// Peer replicas commands are forwarded to (see cluster.go).
+	cluster cluster
+
+	// Server-defined command menu layout (see layout.go).
+	layout uiLayout
+
+	// Web client stream cap (see limits.go).
+	limits clientLimits
+
+	// Last user activity per browser session (see idle.go).
+	idle idleClients
+
+	// Run both families of a dual-stack request at once (see dualstack.go).
+	dualStackParallel bool
+
+	// Signed anonymous visitor ids (see clientid.go).
+	clientIDs clientIDs
+
+	// Pending TLS handshakes of new connections (see handshake.go).
+	handshakes handshakeGuard
+
+	// Change detection between scheduled probe runs (see probechanges.go).
+	changes probeChanges
+
+	// Partner API keys with execution quotas (see quota.go).
+	apiKeys []apiKey
+
+	// Rate limits and quotas per agent group (see grouplimits.go).
+	groupLimits map[string]*groupLimit
+
+	// How long finished routes stay exportable, and where older ones are
+	// archived to (see results.go).
+	resultsRetention     time.Duration
+	resultsArchive       *archive.Client
+	resultsArchivePrefix string
+	resultsArchived      atomic.Uint64
+
+	// Age and row limits of the history tables (see retention.go).
+	retention retentionPolicy
+
+	// Refusals let through in shadow mode (see shadow.go).
+	shadow shadowStats
+
+	// Pinned command catalog hashes (see catalog.go).
+	catalogs catalogPins
+
+	// Global, group and agent execution pauses (see pause.go).
+	pauses executionPauses
+
+	// Markdown notes on agents and groups (see notes.go).
+	notes notes
+
+	// Feature flags delivered to frontends (see features.go).
+	features featureFlags
+
+	// Signs stored results; nil when signing is off (see signing.go).
+	resultSigner *resultSigner
+
+	// Per-session locale and units of server-generated text (see locale.go).
+	displayPrefs sessionDisplayPrefs
+
+	// Target reputation sources checked before a run (see reputation.go).
+	reputation *reputation
+
+	// Provenance footer of completed results (see footer.go).
+	outputFooter string
+
+	// In-flight runs that identical requests share (see coalesce.go).
+	runs runRegistry
+
+	// Time from receiving an agent's output to flushing it (see latency.go).
+	outputLatency outputLatency
+
+	// Serve runtime profiles to operators (see profiling.go).
+	profiling bool
+
+	// Execution counts not yet added to the all-time totals (see totals.go).
+	totals executionTotals
+
+	// Agents the server dials (see reverse.go).
+	reverse reverseAgents
+
+	// Runs waiting for an operator's approval (see approval.go).
+	approvals approvals
+
+	// Config-defined test suites and their latest runs (see suites.go).
+	suites testSuites
+
+	// Agents joining with one-time codes (see enrollment.go).
+	enrollment enrollment
+
+	// SMTP server for incident reports and notifications (see mail.go).
+	mailer *smtpMailer
+
+	// Email notifications of agent outages, approvals and abuse reports
+	// (see notify.go).
+	notifications notifications
+
+	// Alerts about provisioned agents that do not connect or connect from
+	// elsewhere (see provisioning.go).
+	provisioning provisioningAlerts
+
+	// Headers added to every web and API response (see headers.go).
+	headers securityHeaders
+
+	// Request size and stream open limits (see requestguard.go).
+	requests requestGuard
+
+	// Abuse reports filed per reporter prefix and hour (see abuse.go).
+	abuseReports *RateLimiter
+
+	// Cookie-keyed favorites and recent targets (see preferences.go).
+	prefsEnabled   bool
+	prefsRetention time.Duration
+	prefsMu        sync.Mutex
+
 	// Latency-probe state. targets.yaml is the source of truth; the loaded set and
 	// interval are pushed to agents and used to render the Probes/Monitoring APIs.
 	probeMu       sync.RWMutex
@@ -53,24 +211,33 @@ type Handler struct {
 	// never blocks on DB latency. A full queue drops (and counts) to bound memory.
 	reportQueue    chan reportJob
 	reportsDropped uint64
+
+	// Command counters, fed by the manager's event bus (see events.go).
+	commandsStarted  uint64
+	commandsFinished uint64
+	commandsFailed   uint64
 }
 
-// NewHandler creates a new handler
-func NewHandler(agentManager *agent.Manager, store *serverstore.Store, runtimeSettings config.RuntimeSettings) *Handler {
+// NewHandler creates a new handler whose background work stops when ctx ends.
+func NewHandler(ctx context.Context, agentManager *agent.Manager, store *serverstore.Store, runtimeSettings config.RuntimeSettings) *Handler {
 	rateLimiter := NewRateLimiter(runtimeSettings)
 
-	return &Handler{
+	h := &Handler{
+		ctx:             ctx,
 		agentManager:    agentManager,
 		clients:         make(map[*interface{}]bool),
 		clientIPs:       make(map[*interface{}]string),
 		clientSessions:  make(map[*interface{}]string),
 		sessionConns:    make(map[string]*interface{}),
 		commandSessions: make(map[string]string),
-		activeCommands:  make(map[string]chan bool),
+		activeCommands:  make(map[string]*activeCommand),
 		rateLimiter:     rateLimiter,
 		store:           store,
 		runtimeSettings: runtimeSettings,
+		termsAcks:       make(map[string]*list.Element),
 	}
+	h.subscribeEvents()
+	return h
 }
 
 // GetRuntimeSettings returns current hot runtime settings.
@@ -97,6 +264,10 @@ func (h *Handler) UpdateRuntimeSettings(settings config.RuntimeSettings) {
 
 // Handshake implements the gRPC Handshake method
 func (h *Handler) Handshake(ctx context.Context, req *proto.HandshakeRequest) (*proto.HandshakeResponse, error) {
+	received := time.Now()
+	if !h.allowAgentConnect(ctx) {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many connection attempts, retry later")
+	}
 	if req == nil || req.UUID == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "missing agent uuid")
 	}
@@ -116,11 +287,17 @@ func (h *Handler) Handshake(ctx context.Context, req *proto.HandshakeRequest) (*
 
 	bootstrapCfg := config.GetConfig()
 	runtimeConfig := serverstore.BuildRuntimeConfig(bootstrapCfg.Server.Host, bootstrapCfg.Server.Port, *record, bootstrapCfg.Server.LogLevel)
+	policy := validator.CurrentPolicy()
+	runtimeConfig.Limits.MaxTargetLength = policy.MaxLength
+	runtimeConfig.Limits.TargetCharset = policy.Charset
 	configJSON, err := json.Marshal(runtimeConfig)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to encode agent config")
 	}
 
+	h.noteServedCatalog(record.UUID, record.Name, runtimeConfig.Commands, req.CatalogHash)
+	h.checkAgentAddress(ctx, *record)
+
 	h.agentManager.RegisterAgent(agent.AgentRegistration{
 		UUID:     record.UUID,
 		Name:     record.Name,
@@ -128,13 +305,20 @@ func (h *Handler) Handshake(ctx context.Context, req *proto.HandshakeRequest) (*
 		Details:  record.Details,
 		Commands: runtimeConfig.GetAvailableCommands(),
 	}, nil)
+	h.agentManager.RecordClockOffset(record.UUID, req.SentAt, received)
+	h.agentManager.RecordCapabilities(record.UUID, req.Capabilities, req.PingMode)
 
 	logger.Infof("Agent handshake received: %s (%s)", record.Name, record.UUID)
-	return &proto.HandshakeResponse{
-		Success: true,
-		Message: "Agent registered successfully",
-		Config:  configJSON,
-	}, nil
+	resp := &proto.HandshakeResponse{
+		Success:    true,
+		Message:    "Agent registered successfully",
+		Config:     configJSON,
+		ServerTime: time.Now().UnixMilli(),
+	}
+	if slices.Contains(req.Compression, proto.CompressionZstd) {
+		resp.Compression = proto.CompressionZstd
+	}
+	return resp, nil
 }
 
 // StreamCommands implements the gRPC StreamCommands method
@@ -150,39 +334,47 @@ func (h *Handler) StreamCommands(stream proto.AgentService_StreamCommandsServer)
 	}
 
 	uuidValue := uuids[0]
-	agentInfo, err := h.agentManager.RegisterAgentStream(uuidValue, stream)
+	// Registering publishes AgentConnected; the logging subscribes to it (see
+	// events.go).
+	conn, err := h.agentManager.RegisterAgentStream(uuidValue, stream)
 	if err != nil {
+		if errors.Is(err, agent.ErrAgentLimit) {
+			logger.Warnf("Refused stream for agent %s: %v", uuidValue, err)
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
 		return status.Error(codes.NotFound, err.Error())
 	}
 	defer h.agentManager.UnregisterAgentStream(uuidValue, stream)
-
-	logger.Infof("Agent stream connected: %s (%s)", agentInfo.Name, uuidValue)
+	// Pushed here, not from a bus subscriber, which could miss the event.
 	h.pushProbeConfigToAgent(uuidValue)
 
 	// Keep the server→agent direction warm with an in-stream heartbeat. Proxies
 	// like Cloudflare close a proxied stream (524) after ~100s with no in-stream
 	// data from the origin; agent metrics only flow agent→server, so without this
-	// the response direction looks idle. The agent replies in-stream too. ctx is
-	// cancelled when the stream ends, stopping the goroutine.
-	go h.runStreamHeartbeat(ctx, uuidValue)
+	// the response direction looks idle. The agent replies in-stream too. The
+	// goroutine stops with conn; a heartbeat that cannot be written closes it.
+	go h.runStreamHeartbeat(uuidValue, conn)
 
-	return h.agentManager.HandleAgentConnection(uuidValue, stream)
+	// conn is closed by whichever side sees the stream end first (see
+	// agent.StreamConn); returning ends the stream.
+	return h.agentManager.HandleAgentConnection(uuidValue, conn)
 }
 
 // streamHeartbeatInterval must stay comfortably under proxy idle timeouts
 // (Cloudflare ~100s).
 const streamHeartbeatInterval = 30 * time.Second
 
-func (h *Handler) runStreamHeartbeat(ctx context.Context, uuid string) {
+func (h *Handler) runStreamHeartbeat(uuid string, conn *agent.StreamConn) {
 	ticker := time.NewTicker(streamHeartbeatInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ctx.Done():
+		case <-conn.Done():
 			return
 		case <-ticker.C:
-			if err := h.agentManager.SendToAgent(uuid, &proto.CommandMessage{Type: "heartbeat"}); err != nil {
-				return // stream gone
+			if err := h.agentManager.SendHeartbeat(uuid, conn); err != nil {
+				logger.Warnf("Closing stream of agent %s: heartbeat failed: %v", uuid, err)
+				return
 			}
 		}
 	}
@@ -199,27 +391,74 @@ func (h *Handler) lookupAgentToken(uuidValue string) string {
 // SetupRoutes sets up the HTTP routes
 func (h *Handler) SetupRoutes(mux *http.ServeMux, webDir string) {
 	h.webDir = webDir
+	h.initFallbackPage(webDir)
 
 	mux.HandleFunc("/", h.handleIndex)
 	mux.HandleFunc("/api/version", h.handleVersion)
+	mux.HandleFunc("/api/endpoints", h.handleEndpoints)
 	mux.HandleFunc("/api/node", h.handleGetNodes)
 	mux.HandleFunc("/api/exec", h.handleExecCommand)
 	mux.HandleFunc("/api/stop", h.handleStopCommand)
+	mux.HandleFunc("/api/preview", h.handlePreview)
+	mux.HandleFunc("/api/terms/ack", h.handleTermsAck)
+	mux.HandleFunc("/api/report", h.handleAbuseReport)
+	mux.HandleFunc("/api/preferences", h.handlePreferences)
+	mux.HandleFunc("/api/preferences/display", h.handleDisplayPreferences)
+	mux.HandleFunc("/api/results", h.handleMyResults)
+	mux.HandleFunc("/api/results/verify", h.handleVerifyResult)
+	mux.HandleFunc("/api/results/signing-key", h.handleResultSigningKey)
+	mux.HandleFunc("/api/results/", h.handleResultGeoJSON)
+	mux.HandleFunc("/api/incidents", h.handleIncidents)
+	mux.HandleFunc("/api/chatops/slack", h.handleChatSlack)
+	mux.HandleFunc("/api/chatops/telegram", h.handleChatTelegram)
+	mux.HandleFunc("/api/cluster/exec", h.handleClusterExec)
+	mux.HandleFunc("/api/cluster/stop", h.handleClusterStop)
+	mux.HandleFunc("/api/cluster/stop-all", h.handleClusterStopAll)
+	mux.HandleFunc("/api/cluster/pause", h.handleClusterPause)
+	mux.HandleFunc("/api/cluster/release", h.handleClusterRelease)
 	mux.HandleFunc("/api/control/login", h.handleControlLogin)
 	mux.HandleFunc("/api/control/session", h.handleControlSession)
 	mux.HandleFunc("/api/control/agents", h.handleControlAgents)
 	mux.HandleFunc("/api/control/agents/order", h.handleControlAgentsOrder)
+	mux.HandleFunc("/api/control/agents/import", h.handleControlAgentsImport)
+	mux.HandleFunc("/api/control/agents/rename", h.handleControlAgentRename)
+	mux.HandleFunc("/api/control/agents/deleted", h.handleControlDeletedAgents)
+	mux.HandleFunc("/api/control/agents/deleted/", h.handleControlDeletedAgents)
 	mux.HandleFunc("/api/control/agents/", h.handleControlAgentByUUID)
 	mux.HandleFunc("/api/control/runtime", h.handleControlRuntime)
 	mux.HandleFunc("/api/control/plugins", h.handleControlPlugins)
+	mux.HandleFunc("/api/control/metrics", h.handleControlMetrics)
+	mux.HandleFunc("/api/control/debug/pprof/", h.handleControlProfiling)
+	mux.HandleFunc("/api/control/quotas", h.handleControlQuotas)
+	mux.HandleFunc("/api/control/probe-events", h.handleControlProbeEvents)
+	mux.HandleFunc("/api/control/probe-matrix", h.handleControlProbeMatrix)
+	mux.HandleFunc("/api/control/catalogs", h.handleControlCatalogs)
+	mux.HandleFunc("/api/control/catalogs/", h.handleControlCatalogPin)
+	mux.HandleFunc("/api/control/commands", h.handleControlCommands)
+	mux.HandleFunc("/api/control/commands/", h.handleControlCommandByID)
+	mux.HandleFunc("/api/control/stop-all", h.handleControlStopAll)
+	mux.HandleFunc("/api/control/pauses", h.handleControlPauses)
+	mux.HandleFunc("/api/control/notes", h.handleControlNotes)
+	mux.HandleFunc("/api/control/notes/", h.handleControlNoteByName)
+	mux.HandleFunc("/api/control/features", h.handleControlFeatures)
+	mux.HandleFunc("/api/control/usage", h.handleControlUsage)
+	mux.HandleFunc("/api/control/reports", h.handleControlReports)
+	mux.HandleFunc("/api/control/reports/", h.handleControlReportByID)
+	mux.HandleFunc("/api/control/approvals", h.handleControlApprovals)
+	mux.HandleFunc("/api/control/approvals/", h.handleControlApprovalByID)
+	mux.HandleFunc("/api/control/suites", h.handleControlSuites)
+	mux.HandleFunc("/api/control/suites/", h.handleControlSuiteByName)
+	mux.HandleFunc("/api/control/enrollments", h.handleControlEnrollments)
+	mux.HandleFunc("/api/control/enrollments/", h.handleControlEnrollmentByID)
 	mux.HandleFunc("/api/control/targets", h.handleControlTargets)
+	mux.HandleFunc("/api/control/firehose", h.handleControlFirehose)
 	mux.HandleFunc("/api/status", h.handleStatus)
+	mux.HandleFunc("/api/status/stream", h.handleStatusStream)
 	mux.HandleFunc("/api/probes", h.handleProbes)
 	mux.HandleFunc("/api/probes/series", h.handleProbesSeries)
 	mux.HandleFunc("/api/probes/meta", h.handleProbesMeta)
 
-	fs := http.FileServer(http.Dir(webDir))
-	mux.Handle("/assets/", fs)
+	mux.HandleFunc("/assets/", h.handleAssets)
 }
 
 // RegisterGRPCServer registers the gRPC service
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+
+	"golang.org/x/net/idna"
+)
+
+// accessListPollInterval is how often the ban/allow list files are checked for
+// changes; SIGHUP reloads them immediately.
+const accessListPollInterval = 10 * time.Second
+
+// accessLists holds the file-backed ban/allow lists enforced on /api/exec.
+type accessLists struct {
+	mu sync.RWMutex
+
+	bannedIPsPath, bannedTargetsPath, allowedSuffixesPath string
+	modTimes                                              map[string]time.Time
+
+	bannedIPs       []netip.Prefix
+	bannedTargetIPs []netip.Prefix
+	bannedDomains   []string
+	allowedSuffixes []string
+
+	blockedIPs     uint64
+	blockedTargets uint64
+}
+
+// InitAccessLists loads the security lists named in cfg (relative to baseDir)
+// and starts watching them for changes.
+func (h *Handler) InitAccessLists(cfg *config.Config, baseDir string) {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(baseDir, path)
+	}
+
+	h.access.mu.Lock()
+	h.access.bannedIPsPath = resolve(cfg.Security.BannedIPs)
+	h.access.bannedTargetsPath = resolve(cfg.Security.BannedTargets)
+	h.access.allowedSuffixesPath = resolve(cfg.Security.AllowedTargetSuffixes)
+	h.access.modTimes = make(map[string]time.Time)
+	h.access.mu.Unlock()
+
+	h.ReloadAccessLists()
+	if h.access.bannedIPsPath != "" || h.access.bannedTargetsPath != "" || h.access.allowedSuffixesPath != "" {
+		go h.watchAccessLists()
+	}
+}
+
+// ReloadAccessLists re-reads every configured list file. A file that cannot be
+// read keeps its previous entries.
+func (h *Handler) ReloadAccessLists() {
+	a := &h.access
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if lines, ok := a.readList(a.bannedIPsPath); ok {
+		a.bannedIPs = parsePrefixes(lines)
+	}
+	if lines, ok := a.readList(a.bannedTargetsPath); ok {
+		a.bannedTargetIPs = parsePrefixes(lines)
+		a.bannedDomains = a.bannedDomains[:0]
+		for _, line := range lines {
+			if _, err := netip.ParsePrefix(line); err == nil {
+				continue
+			}
+			if _, err := netip.ParseAddr(line); err == nil {
+				continue
+			}
+			a.bannedDomains = append(a.bannedDomains, normalizeDomain(line))
+		}
+	}
+	if lines, ok := a.readList(a.allowedSuffixesPath); ok {
+		a.allowedSuffixes = a.allowedSuffixes[:0]
+		for _, line := range lines {
+			a.allowedSuffixes = append(a.allowedSuffixes, normalizeDomain(line))
+		}
+	}
+}
+
+// readList reads one list file, recording its mtime. Callers hold a.mu.
+func (a *accessLists) readList(path string) ([]string, bool) {
+	if path == "" {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Warnf("Failed to read security list %s: %v", path, err)
+		return nil, false
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil {
+		a.modTimes[path] = info.ModTime()
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	logger.Infof("Loaded %d entries from security list %s", len(lines), path)
+	return lines, true
+}
+
+func (h *Handler) watchAccessLists() {
+	ticker := time.NewTicker(accessListPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed := false
+		h.access.mu.RLock()
+		for _, path := range []string{h.access.bannedIPsPath, h.access.bannedTargetsPath, h.access.allowedSuffixesPath} {
+			if path == "" {
+				continue
+			}
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(h.access.modTimes[path]) {
+				changed = true
+			}
+		}
+		h.access.mu.RUnlock()
+		if changed {
+			h.ReloadAccessLists()
+		}
+	}
+}
+
+// parsePrefixes turns IP and CIDR entries into prefixes, skipping anything else.
+func parsePrefixes(lines []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, line := range lines {
+		if prefix, err := netip.ParsePrefix(line); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(line); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+// normalizeDomain lowercases a blocklist domain and converts an
+// internationalized one to punycode, the form targets are checked in.
+func normalizeDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if ascii, err := idna.Lookup.ToASCII(name); err == nil {
+		return ascii
+	}
+	return name
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientBanned reports (and counts) whether a client IP is banned.
+func (h *Handler) clientBanned(clientIP string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	h.access.mu.RLock()
+	banned := prefixesContain(h.access.bannedIPs, addr)
+	h.access.mu.RUnlock()
+	if banned {
+		atomic.AddUint64(&h.access.blockedIPs, 1)
+	}
+	return banned
+}
+
+// targetBlocked reports (and counts) whether a target is banned, or falls
+// outside the allowed suffixes. Banned domains also cover their subdomains;
+// the suffix allowlist, when set, applies to domain targets only.
+func (h *Handler) targetBlocked(target string) bool {
+	h.access.mu.RLock()
+	defer h.access.mu.RUnlock()
+
+	blocked := false
+	if addr, err := netip.ParseAddr(target); err == nil {
+		blocked = prefixesContain(h.access.bannedTargetIPs, addr)
+	} else {
+		domain := normalizeDomain(target)
+		for _, banned := range h.access.bannedDomains {
+			if domain == banned || strings.HasSuffix(domain, "."+banned) {
+				blocked = true
+				break
+			}
+		}
+		if !blocked && len(h.access.allowedSuffixes) > 0 {
+			blocked = true
+			for _, suffix := range h.access.allowedSuffixes {
+				if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+					blocked = false
+					break
+				}
+			}
+		}
+	}
+	if blocked {
+		atomic.AddUint64(&h.access.blockedTargets, 1)
+	}
+	return blocked
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serverRun is a command the server runs on its own account, for a chat
+// user or a test suite, rather than for an /api/exec request. Its target has
+// been validated.
+type serverRun struct {
+	agent     string
+	command   string
+	target    string
+	sessionID string
+	// requester is who the run is for, as active commands and agent logs
+	// show it.
+	requester string
+	priority  agent.Priority
+	timeout   time.Duration
+	span      string
+	// onData receives the run's structured result, if any.
+	onData func(json.RawMessage)
+}
+
+// execServerRun runs run on its agent and waits for it to end. output is
+// the last output the agent sent, failure the error it reported or "Command
+// stopped". err is set when the run did not complete; runRefusal describes an
+// agent refusing it. The run ends with the server.
+func (h *Handler) execServerRun(run serverRun) (output, failure string, err error) {
+	commandID := h.generateCommandID(run.command, run.target, run.agent, run.sessionID)
+	stopChan := make(chan bool, 1)
+	logger.Infof("[%s] executing command: %s", run.requester, commandID)
+
+	h.setActiveCommand(commandID, &activeCommand{
+		stop:     stopChan,
+		agent:    run.agent,
+		command:  run.command,
+		target:   run.target,
+		clientIP: run.requester,
+		started:  time.Now(),
+	})
+	defer h.removeActiveCommand(commandID)
+	h.countClient(run.agent, run.command)
+
+	ctx, cancel := context.WithTimeout(h.ctx, run.timeout)
+	defer cancel()
+	ctx, span := tracing.Tracer(ctx).Start(ctx, run.span,
+		trace.WithAttributes(attribute.String("yals.agent", run.agent), attribute.String("yals.command", run.command)))
+	defer span.End()
+	ctx = agent.WithRequester(agent.WithPriority(ctx, run.priority), run.requester)
+
+	cmd := run.command + " " + run.target
+	err = h.agentManager.ExecuteCommandStreamingWithData(ctx, run.agent, cmd, commandID, "", stopChan, func(text string, isError, isComplete, isStopped bool) {
+		switch {
+		case isStopped:
+			failure = "Command stopped"
+		case isComplete && isError:
+			failure = text
+		case text != "":
+			output = text
+		}
+	}, run.onData)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return output, failure, err
+}
+
+// runRefusal describes err when it is agentName refusing a run, or returns
+// "".
+func runRefusal(agentName string, err error) string {
+	var rejection *agent.RejectionError
+	if !errors.As(err, &rejection) {
+		return ""
+	}
+	return fmt.Sprintf("%s refused the command (%s): %s", agentName, rejection.Code, rejection.Reason)
+}
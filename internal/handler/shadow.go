@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// shadowStats counts the refusals shadow mode let through, per check.
+type shadowStats struct {
+	rateLimited atomic.Uint64
+	concurrency atomic.Uint64
+	banned      atomic.Uint64
+}
+
+// shadowed is called when a rate limit, concurrency cap or client ban would
+// refuse a request. In shadow mode (rate_limit.shadow) it logs and counts the
+// refusal and returns true so the caller lets the request through.
+func (h *Handler) shadowed(counter *atomic.Uint64, format string, args ...any) bool {
+	if !h.rateLimiter.shadowMode() {
+		return false
+	}
+	counter.Add(1)
+	logger.Infof("Shadow mode, not enforced: %s", fmt.Sprintf(format, args...))
+	return true
+}
+
+// shadowMetrics returns the shadow counters for /api/control/metrics.
+func (h *Handler) shadowMetrics() map[string]any {
+	return map[string]any{
+		"enabled":      h.rateLimiter.shadowMode(),
+		"rate_limited": h.shadow.rateLimited.Load(),
+		"concurrency":  h.shadow.concurrency.Load(),
+		"banned":       h.shadow.banned.Load(),
+	}
+}
@@ -0,0 +1,283 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/store/archive"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// Result signing algorithms (results.signing.algorithm).
+const (
+	signEd25519 = "ed25519"
+	signHMAC    = "hmac-sha256"
+)
+
+// resultSigner signs stored results with the operator's key, so a result
+// shared outside the looking glass can be proven to come from it unchanged.
+type resultSigner struct {
+	algorithm string
+	keyID     string
+	secret    []byte
+	private   ed25519.PrivateKey
+}
+
+// resultSignature accompanies a signed result wherever it is handed out.
+type resultSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Value     string `json:"value"`
+	// RouteSHA256 is the digest of the stored route the signature covers.
+	RouteSHA256 string `json:"route_sha256"`
+}
+
+// InitResultSigning loads the key of results.signing. Without one, results
+// are stored unsigned.
+func (h *Handler) InitResultSigning(cfg *config.Config) {
+	h.resultSigner = nil
+	s := cfg.Results.Signing
+	if s.Algorithm == "" && s.Key == "" {
+		return
+	}
+	signer, err := newResultSigner(s.Algorithm, s.Key, s.KeyID)
+	if err != nil {
+		logger.Errorf("Result signing disabled: %v", err)
+		return
+	}
+	h.resultSigner = signer
+	logger.Infof("Signing stored results with %s key %s", signer.algorithm, signer.keyID)
+}
+
+func newResultSigner(algorithm, key, keyID string) (*resultSigner, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("results.signing.key is required")
+	}
+	signer := &resultSigner{algorithm: strings.ToLower(strings.TrimSpace(algorithm)), keyID: strings.TrimSpace(keyID)}
+	var public []byte
+	switch signer.algorithm {
+	case signEd25519:
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("results.signing.key must be base64: %w", err)
+		}
+		switch len(raw) {
+		case ed25519.SeedSize:
+			signer.private = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			signer.private = ed25519.PrivateKey(raw)
+		default:
+			return nil, fmt.Errorf("an ed25519 results.signing.key holds %d or %d bytes, not %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+		}
+		public = signer.private.Public().(ed25519.PublicKey)
+	case signHMAC:
+		signer.secret = []byte(key)
+		// Derived from the secret, never revealing it.
+		mac := hmac.New(sha256.New, signer.secret)
+		mac.Write([]byte("yals-result-key-id"))
+		public = mac.Sum(nil)
+	default:
+		return nil, fmt.Errorf("unknown results.signing.algorithm %q (ed25519 or hmac-sha256)", algorithm)
+	}
+	if signer.keyID == "" {
+		sum := sha256.Sum256(public)
+		signer.keyID = hex.EncodeToString(sum[:8])
+	}
+	return signer, nil
+}
+
+// signedMessage is what a signature covers: the result's metadata and the
+// digest of its route, one per line.
+func signedMessage(record serverstore.RouteResultRecord, routeDigest string) []byte {
+	return []byte(strings.Join([]string{
+		"yals-result-v1",
+		record.ID,
+		record.Agent,
+		record.Command,
+		record.Target,
+		strconv.FormatInt(record.CreatedAt.Unix(), 10),
+		routeDigest,
+	}, "\n"))
+}
+
+func routeDigest(route []byte) string {
+	sum := sha256.Sum256(route)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign returns the base64 signature of record.
+func (s *resultSigner) sign(record serverstore.RouteResultRecord) string {
+	message := signedMessage(record, routeDigest(record.Route))
+	if s.private != nil {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(s.private, message))
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(message)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether signature is a valid signature of record.
+func (s *resultSigner) verify(record serverstore.RouteResultRecord, signature string) bool {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	if s.private != nil {
+		message := signedMessage(record, routeDigest(record.Route))
+		return ed25519.Verify(s.private.Public().(ed25519.PublicKey), message, raw)
+	}
+	expected, _ := base64.StdEncoding.DecodeString(s.sign(record))
+	return hmac.Equal(expected, raw)
+}
+
+// signRouteResult signs record in place when signing is enabled.
+func (h *Handler) signRouteResult(record *serverstore.RouteResultRecord) {
+	if h.resultSigner == nil {
+		return
+	}
+	record.Signature = h.resultSigner.sign(*record)
+	record.SigningKey = h.resultSigner.keyID
+}
+
+// storedSignature describes the signature of a stored record for clients, or
+// returns nil when it was stored unsigned. record.Route must be loaded.
+func (h *Handler) storedSignature(record serverstore.RouteResultRecord) *resultSignature {
+	if record.Signature == "" {
+		return nil
+	}
+	algorithm := ""
+	if h.resultSigner != nil && h.resultSigner.keyID == record.SigningKey {
+		algorithm = h.resultSigner.algorithm
+	}
+	return &resultSignature{
+		Algorithm:   algorithm,
+		KeyID:       record.SigningKey,
+		Value:       record.Signature,
+		RouteSHA256: routeDigest(record.Route),
+	}
+}
+
+// handleResultSigningKey handles GET /api/results/signing-key - the key
+// results are signed with. An ed25519 public key lets anyone check a
+// signature offline; an HMAC key is only named.
+func (h *Handler) handleResultSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	signer := h.resultSigner
+	if signer == nil {
+		http.Error(w, "Result signing is not enabled", http.StatusNotFound)
+		return
+	}
+	resp := map[string]any{"algorithm": signer.algorithm, "key_id": signer.keyID}
+	if signer.private != nil {
+		resp["public_key"] = base64.StdEncoding.EncodeToString(signer.private.Public().(ed25519.PublicKey))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleVerifyResult handles POST /api/results/verify
+// {"result_id": "...", "signature": "..."}: whether the signature is the one
+// this looking glass gave the result and still matches what it stored. The
+// response carries the signed metadata to compare a shared copy against.
+// Anyone holding a signature may ask, without a session.
+func (h *Handler) handleVerifyResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	signer := h.resultSigner
+	if signer == nil {
+		http.Error(w, "Result signing is not enabled", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		ResultID  string `json:"result_id"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.ResultID, req.Signature = strings.TrimSpace(req.ResultID), strings.TrimSpace(req.Signature)
+	if !resultIDPattern.MatchString(req.ResultID) || req.Signature == "" {
+		http.Error(w, "result_id and signature are required", http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]any{"valid": false, "result_id": req.ResultID}
+	reply := func(reason string) {
+		if reason != "" {
+			resp["reason"] = reason
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+
+	record, found, err := h.store.GetRouteResult(req.ResultID)
+	if err != nil {
+		logger.Errorf("Failed to load route result %s: %v", req.ResultID, err)
+		http.Error(w, "Failed to load result", http.StatusInternalServerError)
+		return
+	}
+	if found && record.ArchiveKey != "" {
+		data, err := h.loadArchivedRoute(r.Context(), record.ArchiveKey)
+		if errors.Is(err, archive.ErrNotFound) {
+			found = false
+		} else if err != nil {
+			logger.Errorf("Failed to load archived route result %s: %v", req.ResultID, err)
+			http.Error(w, "Failed to load archived result", http.StatusBadGateway)
+			return
+		}
+		record.Route = data
+	}
+	switch {
+	case !found:
+		reply("unknown or expired result")
+		return
+	case record.Signature == "":
+		reply("the result was stored unsigned")
+		return
+	case subtle.ConstantTimeCompare([]byte(record.Signature), []byte(req.Signature)) != 1:
+		reply("signature does not match the result")
+		return
+	}
+
+	resp["key_id"] = record.SigningKey
+	resp["result"] = map[string]any{
+		"agent":        record.Agent,
+		"command":      record.Command,
+		"target":       record.Target,
+		"created_at":   record.CreatedAt.UTC().Format(time.RFC3339),
+		"route_sha256": routeDigest(record.Route),
+	}
+	switch {
+	case record.SigningKey != signer.keyID:
+		reply("signed with key " + record.SigningKey + ", which is no longer configured")
+	case !signer.verify(record, record.Signature):
+		logger.Warnf("Stored result %s no longer matches its signature", req.ResultID)
+		reply("the stored result no longer matches its signature")
+	default:
+		resp["valid"] = true
+		resp["algorithm"] = signer.algorithm
+		reply("")
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Health implements the gRPC Health method: whether this server would take
+// the agent's stream now. It checks the agent's token like Handshake but
+// registers nothing, so an agent connected to a standby server can ask its
+// primary as often as it likes before failing back.
+func (h *Handler) Health(ctx context.Context, req *proto.HealthRequest) (*proto.HealthResponse, error) {
+	if !h.allowAgentConnect(ctx) {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many connection attempts, retry later")
+	}
+	if req == nil || req.UUID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing agent uuid")
+	}
+	token := strings.TrimSpace(h.lookupAgentToken(req.UUID))
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(strings.TrimSpace(req.Token))) != 1 {
+		return nil, status.Errorf(codes.Unauthenticated, "unknown agent or invalid token")
+	}
+
+	connected, slot := h.agentManager.StreamState(req.UUID)
+	resp := &proto.HealthResponse{Ready: slot, Connected: connected}
+	if !slot {
+		resp.Message = "the server is at its agent limit"
+	}
+	return resp, nil
+}
+
+// agentMovedRequest is the body of /api/cluster/release: the agent connected
+// to the sending replica at ConnectedAt (unix milliseconds).
+type agentMovedRequest struct {
+	UUID        string `json:"uuid"`
+	ConnectedAt int64  `json:"connected_at"`
+}
+
+// announceAgentStream tells every peer replica that an agent connected here,
+// so that one still holding an older stream of it - the server it failed over
+// from or back from, which may not have noticed the agent leave - closes it
+// instead of showing the agent online twice.
+func (h *Handler) announceAgentStream(uuid string, connectedAt time.Time) {
+	if len(h.cluster.peers) == 0 {
+		return
+	}
+	body, err := json.Marshal(agentMovedRequest{UUID: uuid, ConnectedAt: connectedAt.UnixMilli()})
+	if err != nil {
+		return
+	}
+	for _, p := range h.cluster.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			peerReq, err := h.cluster.newRequest(ctx, p, "/api/cluster/release", body)
+			if err != nil {
+				return
+			}
+			resp, err := p.client.Do(peerReq)
+			if err != nil {
+				logger.Debugf("Failed to announce agent %s to %s: %v", uuid, p.baseURL, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+}
+
+// handleClusterRelease handles POST /api/cluster/release - a peer replica
+// took an agent's stream. A stream of the agent here that is older is closed.
+// It never forwards again.
+func (h *Handler) handleClusterRelease(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readClusterRequest(w, r)
+	if !ok {
+		return
+	}
+	var req agentMovedRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.UUID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	released := h.agentManager.ReleaseAgentStream(req.UUID, time.UnixMilli(req.ConnectedAt))
+	if released {
+		logger.Infof("Agent %s connected to another server; closed its stream here", req.UUID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"released": released})
+}
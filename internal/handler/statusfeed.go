@@ -0,0 +1,339 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// The read-only status feed (/api/status/stream) pushes agent online/group
+// changes to embeddable status widgets. It cannot execute anything, so it gets a
+// far higher subscriber cap than the looking glass. A single poller builds each
+// snapshot once for all subscribers and only pushes when something changed;
+// agent connect/disconnect events wake it early. Each snapshot is encoded once
+// per audience, and every subscriber writes the same bytes.
+//
+// Subscribers that connect with protocol=2 get the full snapshot once, then
+// only agent_status_delta events listing the agents added, updated and
+// removed since the previous snapshot.
+const (
+	statusFeedInterval   = 2 * time.Second
+	statusFeedKeepalive  = 30 * time.Second
+	statusFeedMaxClients = 5000
+	statusFeedDeltaProto = 2
+)
+
+// statusFeedAgent is one agent in a status feed snapshot.
+type statusFeedAgent struct {
+	UUID           string `json:"uuid"`
+	Name           string `json:"name"`
+	Group          string `json:"group"`
+	Online         bool   `json:"online"`
+	NeverConnected bool   `json:"never_connected,omitempty"`
+}
+
+// statusFeedFrame is a snapshot ready to send: public holds the SSE event
+// for anonymous viewers, private the one for control-panel sessions, which
+// also see hidden groups. The delta events describe the change from frame
+// seq-1; they are nil when a full snapshot must be sent instead (first frame,
+// or only the order changed).
+type statusFeedFrame struct {
+	seq          uint64
+	agents       []statusFeedAgent
+	public       []byte
+	private      []byte
+	publicDelta  []byte
+	privateDelta []byte
+}
+
+type statusFeed struct {
+	mu      sync.Mutex
+	subs    map[chan *statusFeedFrame]struct{}
+	latest  *statusFeedFrame
+	started bool
+	// wake asks the poller for an immediate snapshot.
+	wake chan struct{}
+}
+
+// wakeUp triggers an immediate poll; it never blocks.
+func (f *statusFeed) wakeUp() {
+	f.mu.Lock()
+	wake := f.wake
+	f.mu.Unlock()
+	if wake == nil {
+		return
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe registers a subscriber. Each channel holds at most one pending
+// snapshot; a slow reader only ever gets the newest state.
+func (f *statusFeed) subscribe() (chan *statusFeedFrame, *statusFeedFrame, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[chan *statusFeedFrame]struct{})
+	}
+	if len(f.subs) >= statusFeedMaxClients {
+		return nil, nil, false
+	}
+	ch := make(chan *statusFeedFrame, 1)
+	f.subs[ch] = struct{}{}
+	return ch, f.latest, true
+}
+
+func (f *statusFeed) unsubscribe(ch chan *statusFeedFrame) {
+	f.mu.Lock()
+	delete(f.subs, ch)
+	f.mu.Unlock()
+}
+
+func (f *statusFeed) publish(frame *statusFeedFrame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latest = frame
+	for ch := range f.subs {
+		select {
+		case <-ch: // drop the stale pending snapshot
+		default:
+		}
+		ch <- frame
+	}
+}
+
+// startStatusFeed starts the shared poller on first use.
+func (h *Handler) startStatusFeed() {
+	h.statusFeed.mu.Lock()
+	if h.statusFeed.started {
+		h.statusFeed.mu.Unlock()
+		return
+	}
+	h.statusFeed.started = true
+	snapshot := h.statusFeedSnapshot()
+	frame := h.encodeStatusFeed(nil, snapshot)
+	h.statusFeed.latest = frame
+	wake := make(chan struct{}, 1)
+	h.statusFeed.wake = wake
+	h.statusFeed.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(statusFeedInterval)
+		defer ticker.Stop()
+		last, _ := json.Marshal(snapshot)
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-wake:
+			}
+			snapshot := h.statusFeedSnapshot()
+			encoded, err := json.Marshal(snapshot)
+			if err != nil || bytes.Equal(encoded, last) {
+				continue
+			}
+			last = encoded
+			frame = h.encodeStatusFeed(frame, snapshot)
+			h.statusFeed.publish(frame)
+		}
+	}()
+}
+
+// closeIdleFeed tells an idle subscriber why its feed ends. EventSource
+// clients should close() on this event instead of reconnecting.
+func (h *Handler) closeIdleFeed(w http.ResponseWriter, flusher http.Flusher, timeout time.Duration) {
+	h.idle.closed.Add(1)
+	payload, _ := json.Marshal(map[string]any{
+		"type":    "idle",
+		"message": fmt.Sprintf("Closed after %d minutes without activity; reload the page to reconnect.", int(timeout.Minutes())),
+	})
+	fmt.Fprintf(w, "data: %s\n\n", payload)
+	flusher.Flush()
+}
+
+func (h *Handler) statusFeedSnapshot() []statusFeedAgent {
+	statuses := h.orderedAgentStatuses()
+	snapshot := make([]statusFeedAgent, 0, len(statuses))
+	for _, a := range statuses {
+		snapshot = append(snapshot, statusFeedAgent{UUID: a.UUID, Name: a.Name, Group: a.Group, Online: a.Online, NeverConnected: a.NeverConnected})
+	}
+	return snapshot
+}
+
+// encodeStatusFeed renders a snapshot as the SSE events sent to anonymous and
+// to authenticated viewers, with deltas from prev when there is one.
+func (h *Handler) encodeStatusFeed(prev *statusFeedFrame, snapshot []statusFeedAgent) *statusFeedFrame {
+	frame := &statusFeedFrame{seq: 1, agents: snapshot}
+	if prev != nil {
+		frame.seq = prev.seq + 1
+	}
+	for _, authenticated := range []bool{false, true} {
+		visible := h.visibleFeedAgents(snapshot, authenticated)
+		full := statusFeedEvent(map[string]any{"type": "status", "agents": visible})
+		var delta []byte
+		if prev != nil {
+			delta = statusFeedDelta(h.visibleFeedAgents(prev.agents, authenticated), visible)
+		}
+		if authenticated {
+			frame.private, frame.privateDelta = full, delta
+		} else {
+			frame.public, frame.publicDelta = full, delta
+		}
+	}
+	return frame
+}
+
+func (h *Handler) visibleFeedAgents(snapshot []statusFeedAgent, authenticated bool) []statusFeedAgent {
+	visible := make([]statusFeedAgent, 0, len(snapshot))
+	for _, a := range snapshot {
+		if h.agentManager.GroupVisible(a.Group, authenticated) {
+			visible = append(visible, a)
+		}
+	}
+	return visible
+}
+
+// statusFeedDelta encodes the agent_status_delta event from before to after,
+// or returns nil when nothing but the order changed.
+func statusFeedDelta(before, after []statusFeedAgent) []byte {
+	previous := make(map[string]statusFeedAgent, len(before))
+	for _, a := range before {
+		previous[a.UUID] = a
+	}
+	added, updated := []statusFeedAgent{}, []statusFeedAgent{}
+	for _, a := range after {
+		old, ok := previous[a.UUID]
+		switch {
+		case !ok:
+			added = append(added, a)
+		case old != a:
+			updated = append(updated, a)
+		}
+		delete(previous, a.UUID)
+	}
+	removed := make([]string, 0, len(previous))
+	for _, a := range before {
+		if _, gone := previous[a.UUID]; gone {
+			removed = append(removed, a.UUID)
+		}
+	}
+	if len(added) == 0 && len(updated) == 0 && len(removed) == 0 {
+		return nil
+	}
+	return statusFeedEvent(map[string]any{
+		"type":    "agent_status_delta",
+		"added":   added,
+		"updated": updated,
+		"removed": removed,
+	})
+}
+
+func statusFeedEvent(event map[string]any) []byte {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed to marshal status feed: %v", err)
+		return nil
+	}
+	return []byte(fmt.Sprintf("data: %s\n\n", payload))
+}
+
+// handleStatusStream handles GET /api/status/stream - a read-only SSE feed of
+// agent status/group updates.
+func (h *Handler) handleStatusStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session_id")
+	if !h.validateSessionID(sessionID) {
+		http.Error(w, "Invalid or missing session_id", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if !h.allowStreamOpen(w, r) {
+		return
+	}
+	if !h.acquireWebClient(w) {
+		return
+	}
+	defer h.releaseWebClient()
+
+	h.startStatusFeed()
+	ch, current, ok := h.statusFeed.subscribe()
+	if !ok {
+		http.Error(w, "Too many status subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.statusFeed.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	authenticated := h.isAuthenticatedViewer(r)
+	deltas := r.URL.Query().Get("protocol") == strconv.Itoa(statusFeedDeltaProto)
+	var sent uint64
+	send := func(frame *statusFeedFrame) bool {
+		event, delta := frame.public, frame.publicDelta
+		if authenticated {
+			event, delta = frame.private, frame.privateDelta
+		}
+		// A delta only applies on top of the previous frame; a subscriber
+		// that skipped one (slow reader) gets the full snapshot again.
+		if deltas && sent != 0 && frame.seq == sent+1 && delta != nil {
+			event = delta
+		}
+		sent = frame.seq
+		if event == nil {
+			return false
+		}
+		if _, err := w.Write(event); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(current) {
+		return
+	}
+
+	opened := time.Now()
+	keepalive := time.NewTicker(statusFeedKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame := <-ch:
+			if !send(frame) {
+				return
+			}
+		case <-keepalive.C:
+			if idle, timeout := h.sessionIdle(sessionID, opened); idle {
+				h.closeIdleFeed(w, flusher, timeout)
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -1,13 +1,24 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-
-	"YALS/internal/logger"
-	"YALS/internal/plugin"
-	"YALS/internal/validator"
+	"slices"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+	"github.com/TogawaSakiko363/YALS/internal/validator"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // handleExecCommand handles POST /api/exec - executes command and streams output via SSE
@@ -31,46 +42,157 @@ func (h *Handler) handleExecCommand(w http.ResponseWriter, r *http.Request) {
 
 	clientIP := h.getRealIP(r)
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
+	// The request span joins a trace started by the reverse proxy. A client's
+	// own traceparent is ignored, since its sampled flag would bypass
+	// tracing.sample_ratio.
+	ctx := r.Context()
+	if h.trustsProxyHeaders() {
+		ctx = tracing.ExtractHTTP(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	ctx, span := tracing.Tracer(ctx).Start(ctx, "POST /api/exec", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("yals.agent", req.Agent), attribute.String("yals.command", req.Command)))
+	defer span.End()
 
-	flusher, ok := w.(http.Flusher)
+	if !h.allowStreamOpen(w, r) {
+		return
+	}
+	if !h.acquireWebClient(w) {
+		return
+	}
+	defer h.releaseWebClient()
+	h.touchSession(sessionID)
+
+	flusher, ok := h.startSSE(w)
 	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
-	// Rate limit on the real client IP rather than the session id: the session id
-	// is a client-generated correlation token (not authentication), so a session
-	// key would be trivially bypassable.
-	if !h.rateLimiter.checkRateLimit(clientIP) {
-		remaining := h.rateLimiter.getRemainingTime(clientIP)
+	if h.clientBanned(clientIP) && !h.shadowed(&h.shadow.banned, "banned client [%s], session %s", clientIP, sessionID) {
+		h.sendSSEError(w, flusher, "Access denied")
+		logger.Warnf("Client [%s] is banned, refused execution for session: %s", clientIP, sessionID)
+		return
+	}
+
+	if !h.termsSatisfied(sessionID) {
+		h.sendSSEError(w, flusher, "Please accept the terms of use before running commands")
+		logger.Warnf("Client [%s] tried to execute without accepting terms, session: %s", clientIP, sessionID)
+		return
+	}
+
+	// Rate limit on the signed client id and the real client IP rather than the
+	// session id: the session id is a client-generated correlation token (not
+	// authentication), so a session key would be trivially bypassable.
+	clientID := h.clientID(r)
+	if ok, remaining := h.checkExecRateLimit(clientID, clientIP); !ok &&
+		!h.shadowed(&h.shadow.rateLimited, "rate limit exceeded by client [%s], session %s", clientIP, sessionID) {
 		errorMsg := fmt.Sprintf("Rate limit exceeded. Please wait %d seconds before trying again.", int(remaining.Seconds())+1)
 		h.sendSSEError(w, flusher, errorMsg)
 		logger.Warnf("Client [%s] rate limit exceeded for session: %s", clientIP, sessionID)
 		return
 	}
 
-	agents := h.agentManager.GetAgents()
-	var agentCommands []string
-	var requiresTarget bool = true
-	var agentFound bool = false
-	var agentOnline bool = false
-
-	for _, a := range agents {
-		if a["name"] == req.Agent {
-			agentFound = true
-			if statusVal, ok := a["status"].(int); ok && statusVal == 1 {
-				agentOnline = true
-			}
-			break
+	// The agent's group may add its own rate limit, and quotas that runExec
+	// charges.
+	groupClient := clientIP
+	if clientID != "" {
+		groupClient = "client:" + clientID
+	}
+	if msg := h.checkGroupRateLimit(req.Agent, groupClient); msg != "" {
+		h.sendSSEError(w, flusher, msg)
+		logger.Warnf("Client [%s] refused by group limits of agent %s, session: %s", clientIP, req.Agent, sessionID)
+		return
+	}
+
+	// Partner API keys are metered by runExec once the request passed every
+	// check, so refused requests do not eat into the quota.
+	key, present := h.requestAPIKey(r)
+	if present && key == nil {
+		h.sendSSEError(w, flusher, "Invalid API key")
+		logger.Warnf("Client [%s] presented an unknown API key, session: %s", clientIP, sessionID)
+		return
+	}
+
+	authenticated := h.isAuthenticatedViewer(r)
+	priority := agent.PriorityAnonymous
+	switch {
+	case authenticated:
+		priority = agent.PriorityAdmin
+	case key != nil:
+		priority = agent.PriorityAuthenticated
+	}
+	if req.CallbackURL != "" {
+		if err := h.validateCallbackURL(req.CallbackURL, authenticated); err != nil {
+			h.sendSSEError(w, flusher, err.Error())
+			return
 		}
 	}
 
+	if h.acquireClientSlot(clientID) {
+		defer h.releaseClientSlot(clientID)
+	} else if !h.shadowed(&h.shadow.concurrency, "client [%s] over the concurrent command limit, session %s", clientIP, sessionID) {
+		h.sendSSEError(w, flusher, fmt.Sprintf("Too many commands running from this browser (limit %d). Wait for one to finish.", h.clientIDs.maxConcurrent))
+		return
+	}
+
+	h.rememberTarget(r, req.Agent, req.Command, req.Target)
+
+	h.runExec(ctx, w, flusher, execCall{
+		req:           req,
+		sessionID:     sessionID,
+		clientIP:      clientIP,
+		authenticated: authenticated,
+		priority:      priority,
+		key:           key,
+		owner:         h.resultOwner(r, sessionID, key),
+		display:       h.displayFor(sessionID),
+	}, true)
+}
+
+// execCall is an /api/exec request that passed the client-facing checks (ban
+// list, terms, rate limit): what is left depends only on the agent.
+// priority orders it in the agent's queue: control-panel sessions first,
+// then API key holders, then anonymous visitors.
+type execCall struct {
+	req           ExecRequest
+	sessionID     string
+	clientIP      string
+	authenticated bool
+	priority      agent.Priority
+	// key is the partner API key the run counts against, if any (see
+	// quota.go).
+	key *apiKey
+	// owner owns the results the run stores (see resultOwner).
+	owner string
+	// display formats the run's footer and summary (see locale.go), for
+	// each client of a shared run its own.
+	display displayPrefs
+}
+
+// runExec validates call against the agent and streams the command's output.
+// When the agent is not connected here and forward is set, the call is
+// handed to the cluster peer holding the agent's stream (see cluster.go).
+func (h *Handler) runExec(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, call execCall, forward bool) {
+	req, clientIP := call.req, call.clientIP
+
+	if err := validateExecOptions(req); err != nil {
+		h.sendSSEInputError(w, flusher, err)
+		return
+	}
+	if pause, paused := h.executionPause(req.Agent); paused {
+		h.sendSSERejection(w, flusher, proto.RejectPaused, pauseMessage(pause))
+		return
+	}
+
+	var agentCommands []string
+	agentFound, agentOnline := h.localAgentState(req.Agent)
+	if agentFound && !h.agentManager.AgentVisible(req.Agent, call.authenticated) {
+		agentFound = false
+	}
+
+	if !agentOnline && forward && h.forwardExec(ctx, w, flusher, call) {
+		return
+	}
+
 	if !agentFound {
 		h.sendSSEError(w, flusher, "Agent not found")
 		return
@@ -81,8 +203,20 @@ func (h *Handler) handleExecCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmdDetails := h.agentManager.GetAgentCommands(req.Agent)
+	var requiresApproval bool
+	cmdDetails := h.agentManager.GetAgentCommandsForViewer(req.Agent, call.authenticated)
 	for _, cmd := range cmdDetails {
+		if cmd.Name == req.Command {
+			if cmd.Unavailable {
+				h.sendSSERejection(w, flusher, proto.RejectUnavailable, cmd.UnavailableReason)
+				return
+			}
+			if req.View != "" && !slices.ContainsFunc(cmd.Views, func(v validator.ViewOption) bool { return v.Name == req.View }) {
+				h.sendSSEInputError(w, flusher, unknownViewError(req.View))
+				return
+			}
+			requiresApproval = cmd.RequiresApproval
+		}
 		agentCommands = append(agentCommands, cmd.Name)
 	}
 
@@ -91,81 +225,268 @@ func (h *Handler) handleExecCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cmdConfig, exists := h.getCommandConfig(req.Agent, req.Command); exists {
-		if cmdConfig.UsePlugin != "" {
-			if hasOverride, ignoreTarget := plugin.GetPluginIgnoreTarget(cmdConfig.UsePlugin); hasOverride {
-				requiresTarget = !ignoreTarget
-			} else if cmdConfig.IgnoreTarget {
-				requiresTarget = false
-			}
-		} else if cmdConfig.IgnoreTarget {
-			requiresTarget = false
-		}
+	if !slices.Contains(agentCommands, req.Command) {
+		h.sendSSEError(w, flusher, "Invalid command")
+		return
 	}
 
-	if requiresTarget {
-		inputType := validator.ValidateInput(req.Target)
-		if inputType == validator.InvalidInput {
-			h.sendSSEError(w, flusher, "Invalid target: must be an IP address or domain name, and not exceed 256 characters")
-			return
-		}
+	// An omitted target falls back to the command's default_target, which is
+	// validated and checked against the blocklist like any other. Commands
+	// without a target ("show peers", "node info") drop whatever the client
+	// sent, so it never reaches the agent, the command id or the logs.
+	target, err := h.validateTarget(req.Agent, req.Command, req.Target)
+	if err != nil {
+		h.sendSSEInputError(w, flusher, err)
+		return
 	}
+	req.Target = target.Value
 
-	cmd, ok := validator.SanitizeCommand(req.Command, req.Target, agentCommands)
-	if !ok {
-		h.sendSSEError(w, flusher, "Invalid command")
+	if h.blockedTarget(target) {
+		h.sendSSEError(w, flusher, "Target is not allowed on this looking glass")
+		logger.Warnf("Client [%s] requested blocked target: %s", clientIP, req.Target)
+		return
+	}
+	if msg := h.checkReputation(ctx, target, call.authenticated, clientIP, req.Command); msg != "" {
+		h.sendSSEError(w, flusher, msg)
+		return
+	}
+
+	// Commands marked requires_approval wait for an operator unless the
+	// control panel itself runs them (see approval.go).
+	if requiresApproval && !call.authenticated && !h.awaitApproval(ctx, w, flusher, call) {
+		return
+	}
+	if call.key != nil && !h.consumeQuota(call.key) {
+		h.sendSSEError(w, flusher, "Execution quota exceeded for this API key")
+		logger.Warnf("API key %s exceeded its execution quota, client [%s]", call.key.name, clientIP)
+		return
+	}
+	if msg := h.consumeGroupQuota(req.Agent); msg != "" {
+		if call.key != nil {
+			h.refundQuota(call.key)
+		}
+		h.sendSSEError(w, flusher, msg)
+		logger.Warnf("Client [%s] refused by group quota of agent %s, session: %s", clientIP, req.Agent, call.sessionID)
 		return
 	}
 
-	commandID := h.generateCommandID(req.Command, req.Target, req.Agent, sessionID)
+	commandID := h.generateCommandID(req.Command, req.Target, req.Agent, call.sessionID)
 	stopChan := make(chan bool, 1)
 
-	logger.Infof("Client [%s] executing command: %s", clientIP, commandID)
+	// An identical run already in flight is followed rather than repeated
+	// (see coalesce.go).
+	run, leader := h.runs.join(runKey(req))
+	h.countClient(req.Agent, req.Command)
+	if leader {
+		logger.Infof("Client [%s] executing command: %s", clientIP, commandID)
+	} else {
+		logger.Infof("Client [%s] joined the running command for: %s", clientIP, commandID)
+	}
 
-	h.setActiveCommand(commandID, stopChan)
+	h.setActiveCommand(commandID, &activeCommand{
+		stop:     stopChan,
+		agent:    req.Agent,
+		command:  req.Command,
+		target:   req.Target,
+		clientIP: clientIP,
+		started:  time.Now(),
+	})
 	defer h.removeActiveCommand(commandID)
 
-	err := h.agentManager.ExecuteCommandStreamingWithStopAndID(req.Agent, cmd, commandID, req.IPVersion, stopChan, func(output string, isError bool, isComplete bool, isStopped bool) {
+	if leader {
+		// The run outlives its first client when others still follow it.
+		go h.executeRun(agent.WithRequester(context.WithoutCancel(ctx), clientIP), run, call, req, target, commandID)
+	}
+	h.followRun(ctx, w, flusher, run, call, stopChan)
+}
+
+// executeRun executes a validated request as run, publishing its events to
+// the run's clients. The run is stopped when all of them left.
+func (h *Handler) executeRun(ctx context.Context, run *sharedRun, call execCall, req ExecRequest, target validator.Target, commandID string) {
+	defer run.finish()
+	defer h.runs.release(run)
+	span := trace.SpanFromContext(ctx)
+	cmd := req.Command + " " + req.Target
+
+	var receipt *receiptRecorder
+	if req.CallbackURL != "" {
+		receipt = newReceiptRecorder(commandID, req)
+		defer func() { go h.deliverReceipt(req.CallbackURL, receipt.finish()) }()
+	}
+
+	// The AS path of the last route result rides on the final complete event,
+	// along with the id the route is stored under for export.
+	var asPath []ASPathSegment
+	var lastRoute json.RawMessage
+	// An iperf3 run gets a human-readable summary of its throughput.
+	var iperf3 *proto.Iperf3Summary
+	// Outputs are cumulative; the footer goes under the last one.
+	var lastOutput string
+	execute, ipVersion := h.agentManager.ExecuteCommandStreamingWithData, req.IPVersion
+	if ipVersion == ipVersionDual {
+		ipVersion = "auto"
+		if target.Resolvable() {
+			execute = h.executeDualStack
+		}
+	}
+	ctx = agent.WithOutputTiming(ctx, run.receiving)
+	if req.View != "" {
+		ctx = agent.WithView(ctx, req.View)
+	}
+	err := execute(agent.WithPriority(ctx, call.priority), req.Agent, cmd, commandID, ipVersion, run.stop, func(output string, isError bool, isComplete bool, isStopped bool) {
+		if receipt != nil {
+			receipt.record(output, isError, isComplete, isStopped)
+		}
+		if isStopped {
+			// Stopping is the server's doing, not an agent message's.
+			run.receiving(time.Time{})
+		}
 		if isComplete {
+			h.runs.release(run)
 			if isError {
-				h.sendSSEMessage(w, flusher, map[string]any{
+				run.publish(withTargetForms(map[string]any{
 					"type":    "complete",
 					"success": false,
 					"error":   output,
-				})
+				}, target))
 			} else {
-				if output != "" {
-					h.sendSSEMessage(w, flusher, map[string]any{
-						"type":   "output",
-						"output": output,
-					})
+				if output == "" {
+					output = lastOutput
 				}
-				h.sendSSEMessage(w, flusher, map[string]any{
-					"type":    "complete",
-					"success": true,
+				run.succeed(&runOutcome{
+					req:    req,
+					target: target,
+					output: output,
+					asPath: asPath,
+					iperf3: iperf3,
+					route:  lastRoute,
 				})
 			}
 		} else {
 			if isError {
-				h.sendSSEMessage(w, flusher, map[string]any{
+				run.publish(map[string]any{
 					"type":  "error",
 					"error": output,
 				})
 			} else {
-				h.sendSSEMessage(w, flusher, map[string]any{
+				lastOutput = output
+				run.publish(map[string]any{
 					"type":   "output",
 					"output": output,
 				})
 			}
 		}
+	}, func(data json.RawMessage) {
+		if receipt != nil {
+			receipt.recordData(data)
+		}
+		if isRouteResult(data) {
+			lastRoute = data
+			asPath = summarizeASPath(data)
+		} else if summary, ok := iperf3Result(data); ok {
+			iperf3 = &summary
+		}
+		run.publish(map[string]any{
+			"type": "data",
+			"data": data,
+		})
 	})
 
 	if err != nil {
-		h.sendSSEError(w, flusher, err.Error())
-		return
+		run.receiving(time.Time{})
+		span.SetStatus(codes.Error, err.Error())
+		h.runs.release(run)
+		var rejection *agent.RejectionError
+		if errors.As(err, &rejection) {
+			if receipt != nil {
+				receipt.fail(rejection.Code, rejection.Reason)
+			}
+			run.publish(rejectionEvent(rejection.Code, rejection.Reason))
+			return
+		}
+		if receipt != nil {
+			receipt.fail("", err.Error())
+		}
+		run.publish(map[string]any{
+			"type":    "complete",
+			"success": false,
+			"error":   err.Error(),
+		})
 	}
 }
 
+// sendRunOutcome sends the last output, with the footer, and the complete
+// event of a successful run to the client of call. A route is stored among
+// the client's results, so each client of a shared run gets its own copy.
+func (h *Handler) sendRunOutcome(w http.ResponseWriter, flusher http.Flusher, o *runOutcome, call execCall) {
+	footer := h.resultFooter(o.req.Agent, o.req.Command, o.target, call.display)
+	if output := appendFooter(o.output, footer); output != "" {
+		h.sendSSEMessage(w, flusher, map[string]any{
+			"type":   "output",
+			"output": output,
+		})
+	}
+	complete := map[string]any{
+		"type":    "complete",
+		"success": true,
+	}
+	if footer != "" {
+		complete["footer"] = footer
+	}
+	withTargetForms(complete, o.target)
+	if len(o.asPath) > 0 {
+		complete["as_path"] = o.asPath
+	}
+	if o.iperf3 != nil {
+		complete["summary"] = call.display.iperf3Text(*o.iperf3)
+	}
+	if o.route != nil {
+		if id, signature := h.saveRouteResult("", o.req, call.owner, o.route); id != "" {
+			complete["result_id"] = id
+			if signature != nil {
+				complete["signature"] = signature
+			}
+		}
+	}
+	h.sendSSEMessage(w, flusher, complete)
+}
+
+// localAgentState reports whether the named agent is known to this server
+// and whether its stream is connected here.
+func (h *Handler) localAgentState(name string) (found, online bool) {
+	agent, found := h.agentManager.GetAgent(name)
+	return found, agent.Online
+}
+
+// startSSE sets the event-stream headers. It reports false, after answering
+// with an error, when w cannot stream.
+func (h *Handler) startSSE(w http.ResponseWriter) (http.Flusher, bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+	return flusher, true
+}
+
+// withTargetForms adds both forms of an internationalized domain target to a
+// complete event: target is what the agent ran (punycode), target_unicode what
+// to show. Other targets add nothing; the client already has them.
+func withTargetForms(event map[string]any, target validator.Target) map[string]any {
+	if target.Unicode != "" {
+		event["target"] = target.Value
+		event["target_unicode"] = target.Unicode
+	}
+	return event
+}
+
 // sendSSEMessage sends an SSE message
 func (h *Handler) sendSSEMessage(w http.ResponseWriter, flusher http.Flusher, data map[string]any) {
 	jsonData, err := json.Marshal(data)
@@ -186,6 +507,40 @@ func (h *Handler) sendSSEError(w http.ResponseWriter, flusher http.Flusher, erro
 	})
 }
 
+// sendSSERejection completes the stream for a command that was refused before
+// it ran. The code lets the client show distinct states, e.g. "unavailable on
+// this node" versus "node busy, try again".
+func (h *Handler) sendSSERejection(w http.ResponseWriter, flusher http.Flusher, code, reason string) {
+	h.sendSSEMessage(w, flusher, rejectionEvent(code, reason))
+}
+
+// rejectionEvent is the complete event of a command refused with code.
+func rejectionEvent(code, reason string) map[string]any {
+	var msg string
+	switch code {
+	case proto.RejectUnavailable:
+		msg = "Command unavailable on this node: " + reason
+	case proto.RejectBusy:
+		msg = "Node busy, please try again shortly: " + reason
+	case proto.RejectNotAllowed:
+		msg = "Command not allowed on this node: " + reason
+	case proto.RejectInvalidTarget:
+		msg = "Target rejected by the node: " + reason
+	case proto.RejectInvalidOption:
+		msg = "Option rejected by the node: " + reason
+	case proto.RejectRateLimited:
+		msg = "Node rate limit reached, please try again shortly: " + reason
+	default:
+		msg = reason
+	}
+	return map[string]any{
+		"type":    "complete",
+		"success": false,
+		"error":   msg,
+		"code":    code,
+	}
+}
+
 // handleStopCommand handles POST /api/stop - stops a running command
 func (h *Handler) handleStopCommand(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -210,7 +565,10 @@ func (h *Handler) handleStopCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.stopActiveCommand(req.CommandID)
+	if !h.stopActiveCommand(req.CommandID) {
+		// Behind a load balancer the command may run on another replica.
+		h.forwardStop(req.CommandID)
+	}
 
 	response := map[string]any{
 		"success": true,
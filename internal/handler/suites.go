@@ -0,0 +1,692 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/events"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// Test suites are config-defined lists of checks (command, agent, target and
+// assertions on the result) that verify the network, e.g. after a maintenance
+// window. The server runs them itself, one test after the other, on demand or
+// on a schedule, and keeps the latest runs in memory.
+const (
+	suiteTestTimeout = 5 * time.Minute
+	// suiteWaitLimit bounds how long ?wait=true holds a request; a longer
+	// run is answered as it stands, and clients poll for the rest.
+	suiteWaitLimit   = time.Minute
+	suiteHistory     = 20
+	suiteRunIDLength = 12
+)
+
+// Suite run triggers and statuses.
+const (
+	suiteTriggerManual   = "manual"
+	suiteTriggerSchedule = "schedule"
+
+	suiteRunning = "running"
+	suitePassed  = "passed"
+	suiteFailed  = "failed"
+)
+
+// suiteMetrics are the metrics assertions can test, with their units. They
+// are read from the structured result of the run (see resultMetrics).
+var suiteMetrics = map[string]string{
+	"loss":        "%",
+	"rtt":         "ms",
+	"rtt_min":     "ms",
+	"rtt_max":     "ms",
+	"jitter":      "ms",
+	"throughput":  "Mbit/s",
+	"retransmits": "",
+	"hops":        "",
+}
+
+// suiteUnits convert an assertion's value to its metric's unit.
+var suiteUnits = map[string]map[string]float64{
+	"%":      {"%": 1},
+	"ms":     {"ms": 1, "s": 1000},
+	"Mbit/s": {"kbit/s": 0.001, "kbps": 0.001, "mbit/s": 1, "mbps": 1, "gbit/s": 1000, "gbps": 1000},
+}
+
+var (
+	metricAssertionRe = regexp.MustCompile(`^([a-z_]+)\s*(<=|>=|==|!=|<|>)\s*(-?[0-9]+(?:\.[0-9]+)?)\s*(\S*)$`)
+	outputAssertionRe = regexp.MustCompile(`^output\s+(contains|excludes)\s+(.+)$`)
+)
+
+// testSuites are the configured suites by name, in config order.
+type testSuites struct {
+	byName     map[string]*testSuite
+	order      []*testSuite
+	webhookURL string
+}
+
+type testSuite struct {
+	name     string
+	interval time.Duration
+	tests    []suiteTest
+
+	mu      sync.Mutex
+	running bool
+	// runs are the latest runs, newest first.
+	runs []*suiteRun
+	// failing is whether the last finished run failed; scheduled runs are
+	// only notified when that changes.
+	failing bool
+}
+
+type suiteTest struct {
+	name       string
+	agent      string
+	command    string
+	target     string
+	assertions []suiteAssertion
+}
+
+// suiteAssertion is one parsed assertion: a metric compared with value, or
+// the output searched for text.
+type suiteAssertion struct {
+	text   string
+	metric string
+	op     string
+	value  float64
+	// match is contains or excludes for output assertions, which look for
+	// substring.
+	match     string
+	substring string
+}
+
+// suiteRun is one run of a suite as /api/control/suites reports it. Its
+// fields change while Status is running, under the suite's lock.
+type suiteRun struct {
+	ID         string            `json:"id"`
+	Suite      string            `json:"suite"`
+	Trigger    string            `json:"trigger"`
+	Status     string            `json:"status"`
+	StartedAt  string            `json:"started_at"`
+	FinishedAt string            `json:"finished_at,omitempty"`
+	Passed     int               `json:"passed"`
+	Failed     int               `json:"failed"`
+	Tests      []suiteTestResult `json:"tests"`
+
+	// done is closed when the run has finished.
+	done chan struct{}
+}
+
+type suiteTestResult struct {
+	Name    string `json:"name"`
+	Agent   string `json:"agent"`
+	Command string `json:"command"`
+	Target  string `json:"target,omitempty"`
+	Passed  bool   `json:"passed"`
+	// Error is why the command did not complete; its assertions are not
+	// checked then.
+	Error      string                 `json:"error,omitempty"`
+	Metrics    map[string]float64     `json:"metrics,omitempty"`
+	Assertions []suiteAssertionResult `json:"assertions,omitempty"`
+	DurationMs int64                  `json:"duration_ms"`
+}
+
+type suiteAssertionResult struct {
+	Assertion string   `json:"assertion"`
+	Passed    bool     `json:"passed"`
+	Actual    *float64 `json:"actual,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// InitTestSuites loads the test suites and starts the scheduled ones. A suite
+// with an invalid test or assertion is logged and skipped.
+func (h *Handler) InitTestSuites(cfg *config.Config) {
+	h.suites.byName = make(map[string]*testSuite)
+	for _, sc := range cfg.TestSuites {
+		s, err := parseTestSuite(sc)
+		if err == nil && h.suites.byName[s.name] != nil {
+			err = errors.New("duplicate name")
+		}
+		if err != nil {
+			logger.Errorf("Ignoring test suite %q: %v", sc.Name, err)
+			continue
+		}
+		h.suites.byName[s.name] = s
+		h.suites.order = append(h.suites.order, s)
+	}
+	if len(h.suites.order) == 0 {
+		return
+	}
+
+	if url := strings.TrimSpace(cfg.Monitoring.WebhookURL); cfg.Monitoring.SuiteAlerts && url != "" {
+		h.suites.webhookURL = url
+		h.agentManager.Events().Subscribe(0, h.notifySuiteRun, events.SuiteFailed, events.SuitePassed)
+	}
+	scheduled := 0
+	for _, s := range h.suites.order {
+		if s.interval > 0 {
+			scheduled++
+			go h.scheduleTestSuite(s)
+		}
+	}
+	logger.Infof("Loaded %d test suites (%d scheduled)", len(h.suites.order), scheduled)
+}
+
+func parseTestSuite(sc config.TestSuite) (*testSuite, error) {
+	s := &testSuite{
+		name:     strings.TrimSpace(sc.Name),
+		interval: time.Duration(sc.IntervalMinutes) * time.Minute,
+	}
+	if s.name == "" || strings.Contains(s.name, "/") {
+		return nil, errors.New("name must be set and must not contain /")
+	}
+	if len(sc.Tests) == 0 {
+		return nil, errors.New("no tests")
+	}
+	for i, tc := range sc.Tests {
+		t := suiteTest{
+			name:    strings.TrimSpace(tc.Name),
+			agent:   strings.TrimSpace(tc.Agent),
+			command: strings.TrimSpace(tc.Command),
+			target:  strings.TrimSpace(tc.Target),
+		}
+		if t.agent == "" || t.command == "" {
+			return nil, fmt.Errorf("test %d: agent and command are required", i+1)
+		}
+		if t.name == "" {
+			t.name = strings.TrimSpace(strings.Join([]string{t.agent, t.command, t.target}, " "))
+		}
+		for _, text := range tc.Assert {
+			a, err := parseSuiteAssertion(text)
+			if err != nil {
+				return nil, fmt.Errorf("test %s: %w", t.name, err)
+			}
+			t.assertions = append(t.assertions, a)
+		}
+		s.tests = append(s.tests, t)
+	}
+	return s, nil
+}
+
+// parseSuiteAssertion parses "<metric> <op> <value>[unit]" or "output
+// contains|excludes <text>" (the text may be quoted).
+func parseSuiteAssertion(text string) (suiteAssertion, error) {
+	a := suiteAssertion{text: strings.TrimSpace(text)}
+	if m := outputAssertionRe.FindStringSubmatch(a.text); m != nil {
+		a.match = m[1]
+		if unquoted, err := strconv.Unquote(m[2]); err == nil {
+			m[2] = unquoted
+		}
+		a.substring = m[2]
+		return a, nil
+	}
+
+	m := metricAssertionRe.FindStringSubmatch(a.text)
+	if m == nil {
+		return a, fmt.Errorf("invalid assertion %q (want e.g. \"loss < 2%%\" or \"output contains text\")", text)
+	}
+	unit, known := suiteMetrics[m[1]]
+	if !known {
+		return a, fmt.Errorf("unknown metric %q in assertion %q", m[1], text)
+	}
+	a.metric, a.op = m[1], m[2]
+	a.value, _ = strconv.ParseFloat(m[3], 64)
+	if m[4] != "" {
+		scale, ok := suiteUnits[unit][strings.ToLower(m[4])]
+		if !ok {
+			return a, fmt.Errorf("unit %q does not fit %s in assertion %q", m[4], a.metric, text)
+		}
+		a.value *= scale
+	}
+	return a, nil
+}
+
+// check evaluates the assertion against a completed run.
+func (a suiteAssertion) check(output string, metrics map[string]float64) suiteAssertionResult {
+	result := suiteAssertionResult{Assertion: a.text}
+	if a.match != "" {
+		found := strings.Contains(output, a.substring)
+		result.Passed = found == (a.match == "contains")
+		switch {
+		case result.Passed:
+		case found:
+			result.Reason = "the output contains it"
+		default:
+			result.Reason = "the output lacks it"
+		}
+		return result
+	}
+
+	actual, ok := metrics[a.metric]
+	if !ok {
+		result.Reason = "the result has no " + a.metric
+		return result
+	}
+	result.Actual = &actual
+	switch a.op {
+	case "<":
+		result.Passed = actual < a.value
+	case "<=":
+		result.Passed = actual <= a.value
+	case ">":
+		result.Passed = actual > a.value
+	case ">=":
+		result.Passed = actual >= a.value
+	case "==":
+		result.Passed = actual == a.value
+	case "!=":
+		result.Passed = actual != a.value
+	}
+	if !result.Passed {
+		result.Reason = fmt.Sprintf("%s is %s%s", a.metric, strconv.FormatFloat(actual, 'f', -1, 64), suiteMetrics[a.metric])
+	}
+	return result
+}
+
+// resultMetrics adds the metrics of a structured result to metrics: loss and
+// round-trip times of a ping, throughput of an iperf3 run, hops of a trace.
+func resultMetrics(data json.RawMessage, metrics map[string]float64) {
+	var head struct {
+		Kind string `json:"kind"`
+	}
+	if json.Unmarshal(data, &head) != nil {
+		return
+	}
+	switch head.Kind {
+	case proto.ResultKindPing:
+		var p proto.PingResult
+		if json.Unmarshal(data, &p) != nil || p.Sent == 0 {
+			return
+		}
+		metrics["loss"] = roundMetric(p.LossPercent)
+		if p.Received > 0 {
+			metrics["rtt"], metrics["rtt_min"], metrics["rtt_max"] = p.AvgMs, p.MinMs, p.MaxMs
+		}
+		// Jitter is the mean difference between consecutive replies.
+		if len(p.RTTMs) > 1 {
+			var sum float64
+			for i := 1; i < len(p.RTTMs); i++ {
+				sum += math.Abs(p.RTTMs[i] - p.RTTMs[i-1])
+			}
+			metrics["jitter"] = roundMetric(sum / float64(len(p.RTTMs)-1))
+		}
+	case proto.ResultKindIperf3:
+		s, ok := iperf3Result(data)
+		if !ok {
+			return
+		}
+		metrics["throughput"] = roundMetric(s.ReceiverBps / 1e6)
+		if s.Protocol == "udp" {
+			metrics["jitter"], metrics["loss"] = s.JitterMs, s.LostPercent
+		} else {
+			metrics["retransmits"] = float64(s.Retransmits)
+		}
+	case proto.ResultKindRoute:
+		var route proto.RouteResult
+		if json.Unmarshal(data, &route) == nil {
+			metrics["hops"] = float64(len(route.Hops))
+		}
+	}
+}
+
+func roundMetric(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// scheduleTestSuite runs s every interval. A run still in progress when the
+// next is due makes that one skip.
+func (h *Handler) scheduleTestSuite(s *testSuite) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if run := s.start(suiteTriggerSchedule); run != nil {
+			h.executeSuiteRun(s, run, "")
+		}
+	}
+}
+
+// start records a new run of s, or returns nil when one is in progress.
+func (s *testSuite) start(trigger string) *suiteRun {
+	id, err := GenerateRandomString(suiteRunIDLength)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil
+	}
+	s.running = true
+	run := &suiteRun{
+		ID:        id,
+		Suite:     s.name,
+		Trigger:   trigger,
+		Status:    suiteRunning,
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+		Tests:     []suiteTestResult{},
+		done:      make(chan struct{}),
+	}
+	s.runs = append([]*suiteRun{run}, s.runs[:min(len(s.runs), suiteHistory-1)]...)
+	return run
+}
+
+// executeSuiteRun runs the tests of s one after the other, then publishes the
+// outcome. requester is who started a manual run.
+func (h *Handler) executeSuiteRun(s *testSuite, run *suiteRun, requester string) {
+	logger.Infof("Running test suite %s (run %s, %s)", s.name, run.ID, run.Trigger)
+	for i, t := range s.tests {
+		result := h.runSuiteTest(s.name, fmt.Sprintf("%s-%d", run.ID, i), t)
+		s.mu.Lock()
+		run.Tests = append(run.Tests, result)
+		if result.Passed {
+			run.Passed++
+		} else {
+			run.Failed++
+		}
+		s.mu.Unlock()
+	}
+
+	finished := time.Now()
+	s.mu.Lock()
+	failed := run.Failed > 0
+	run.Status = suitePassed
+	if failed {
+		run.Status = suiteFailed
+	}
+	run.FinishedAt = finished.UTC().Format(time.RFC3339)
+	notable := run.Trigger == suiteTriggerManual || failed != s.failing
+	s.failing = failed
+	s.running = false
+	detail := describeSuiteRun(run)
+	s.mu.Unlock()
+	close(run.done)
+
+	if failed {
+		logger.Warnf("Test suite %s failed (run %s): %s", s.name, run.ID, detail)
+	} else {
+		logger.Infof("Test suite %s passed (run %s): %s", s.name, run.ID, detail)
+	}
+	if !notable {
+		return
+	}
+	eventType := events.SuitePassed
+	if failed {
+		eventType = events.SuiteFailed
+	}
+	h.agentManager.Events().Publish(events.Event{
+		Type:      eventType,
+		Time:      finished,
+		Target:    s.name,
+		ID:        run.ID,
+		Count:     run.Failed,
+		Detail:    detail,
+		Requester: requester,
+	})
+}
+
+// describeSuiteRun summarizes a finished run, "all 3 tests passed" or the
+// failed tests with their reasons, one per line.
+func describeSuiteRun(run *suiteRun) string {
+	total := run.Passed + run.Failed
+	switch {
+	case run.Failed == 0 && total == 1:
+		return "the test passed"
+	case run.Failed == 0:
+		return fmt.Sprintf("all %d tests passed", total)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d tests failed:", run.Failed, total)
+	for _, t := range run.Tests {
+		if t.Passed {
+			continue
+		}
+		reason := t.Error
+		if reason == "" {
+			var failed []string
+			for _, a := range t.Assertions {
+				if !a.Passed {
+					failed = append(failed, fmt.Sprintf("%s (%s)", a.Assertion, a.Reason))
+				}
+			}
+			reason = strings.Join(failed, "; ")
+		}
+		fmt.Fprintf(&b, "\n- %s: %s", t.Name, reason)
+	}
+	return b.String()
+}
+
+// runSuiteTest executes one test with the checks of /api/exec for an
+// operator, and evaluates its assertions.
+func (h *Handler) runSuiteTest(suite, sessionID string, t suiteTest) suiteTestResult {
+	started := time.Now()
+	result := suiteTestResult{Name: t.name, Agent: t.agent, Command: t.command, Target: t.target}
+	finish := func(errText string) suiteTestResult {
+		result.Error = errText
+		result.Passed = errText == "" && !slices.ContainsFunc(result.Assertions, func(a suiteAssertionResult) bool { return !a.Passed })
+		result.DurationMs = time.Since(started).Milliseconds()
+		return result
+	}
+
+	found, online := h.localAgentState(t.agent)
+	if !found {
+		return finish("Agent not found")
+	}
+	if !online {
+		return finish("Agent is not connected")
+	}
+	if pause, paused := h.executionPause(t.agent); paused {
+		return finish(pauseMessage(pause))
+	}
+	known := false
+	for _, cmd := range h.agentManager.GetAgentCommandsForViewer(t.agent, true) {
+		if cmd.Name == t.command {
+			if cmd.Unavailable {
+				return finish("Command unavailable: " + cmd.UnavailableReason)
+			}
+			known = true
+		}
+	}
+	if !known {
+		return finish(fmt.Sprintf("Unknown command %q on %s", t.command, t.agent))
+	}
+	target, err := h.validateTarget(t.agent, t.command, t.target)
+	if err != nil {
+		return finish("Invalid target: " + err.Error())
+	}
+	if h.blockedTarget(target) {
+		return finish("Target is not allowed on this looking glass")
+	}
+	result.Target = target.Value
+
+	metrics := make(map[string]float64)
+	// Suites are the operator's own configuration.
+	output, failure, err := h.execServerRun(serverRun{
+		agent:     t.agent,
+		command:   t.command,
+		target:    target.Value,
+		sessionID: sessionID,
+		requester: "suite:" + suite,
+		priority:  agent.PriorityAdmin,
+		timeout:   suiteTestTimeout,
+		span:      "suite.exec",
+		onData: func(data json.RawMessage) {
+			resultMetrics(data, metrics)
+		},
+	})
+	if err != nil {
+		if msg := runRefusal(t.agent, err); msg != "" {
+			return finish(msg)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return finish(fmt.Sprintf("Stopped after %s", suiteTestTimeout))
+		}
+		return finish(err.Error())
+	}
+	if failure != "" {
+		return finish(failure)
+	}
+
+	if len(metrics) > 0 {
+		result.Metrics = metrics
+	}
+	for _, a := range t.assertions {
+		result.Assertions = append(result.Assertions, a.check(output, metrics))
+	}
+	return finish("")
+}
+
+// notifySuiteRun POSTs a notified suite run to monitoring.webhook_url. The
+// "text" field makes the payload usable as a Slack incoming webhook.
+func (h *Handler) notifySuiteRun(e events.Event) {
+	outcome := "passed"
+	if e.Type == events.SuiteFailed {
+		outcome = "failed"
+	}
+	body, err := json.Marshal(map[string]any{
+		"text":   fmt.Sprintf("[YALS] Test suite %s %s: %s", e.Target, outcome, e.Detail),
+		"type":   string(e.Type),
+		"suite":  e.Target,
+		"run_id": e.ID,
+		"failed": e.Count,
+		"detail": e.Detail,
+		"time":   e.Time.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	go h.postSigned(h.suites.webhookURL, body, "test suite notification", nil)
+}
+
+// suiteJSON describes s with its tests and, with runs set, its latest runs,
+// newest first; otherwise only the last one.
+func suiteJSON(s *testSuite, runs bool) map[string]any {
+	tests := make([]map[string]any, 0, len(s.tests))
+	for _, t := range s.tests {
+		assertions := make([]string, 0, len(t.assertions))
+		for _, a := range t.assertions {
+			assertions = append(assertions, a.text)
+		}
+		tests = append(tests, map[string]any{
+			"name":    t.name,
+			"agent":   t.agent,
+			"command": t.command,
+			"target":  t.target,
+			"assert":  assertions,
+		})
+	}
+	out := map[string]any{
+		"name":             s.name,
+		"interval_minutes": int(s.interval / time.Minute),
+		"tests":            tests,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out["running"] = s.running
+	if runs {
+		out["runs"] = copySuiteRuns(s.runs)
+	} else if len(s.runs) > 0 {
+		out["last_run"] = copySuiteRuns(s.runs[:1])[0]
+	}
+	return out
+}
+
+// copySuiteRuns copies runs so they can be encoded without the suite's lock.
+func copySuiteRuns(runs []*suiteRun) []suiteRun {
+	copies := make([]suiteRun, 0, len(runs))
+	for _, run := range runs {
+		c := *run
+		c.Tests = append([]suiteTestResult{}, run.Tests...)
+		copies = append(copies, c)
+	}
+	return copies
+}
+
+// handleControlSuites handles GET /api/control/suites - the test suites with
+// their last run.
+func (h *Handler) handleControlSuites(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := make([]map[string]any, 0, len(h.suites.order))
+	for _, s := range h.suites.order {
+		list = append(list, suiteJSON(s, false))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{"suites": list})
+}
+
+// handleControlSuiteByName handles GET /api/control/suites/{name} - the suite
+// with its latest runs - and POST /api/control/suites/{name}/run, which
+// starts a run and answers 202 with it. With ?wait=true it answers 200 with
+// the finished run, or 202 with the run so far after suiteWaitLimit.
+func (h *Handler) handleControlSuiteByName(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/control/suites/"), "/")
+	s := h.suites.byName[name]
+	if s == nil || (action != "" && action != "run") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		_ = json.NewEncoder(w).Encode(suiteJSON(s, true))
+	case action == "run" && r.Method == http.MethodPost:
+		run := s.start(suiteTriggerManual)
+		if run == nil {
+			http.Error(w, "The suite is already running", http.StatusConflict)
+			return
+		}
+		logger.Infof("Control panel started test suite %s (run %s)", s.name, run.ID)
+		go h.executeSuiteRun(s, run, "control panel")
+		status := http.StatusAccepted
+		if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+			timer := time.NewTimer(suiteWaitLimit)
+			defer timer.Stop()
+			select {
+			case <-run.done:
+				status = http.StatusOK
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		s.mu.Lock()
+		body := copySuiteRuns([]*suiteRun{run})[0]
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		h.setNoCacheHeaders(w)
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+)
+
+// totalsFlushInterval is how often the execution counts are added to the
+// stored all-time totals; a crash loses at most this much.
+const totalsFlushInterval = time.Minute
+
+// executionTotals holds the execution counts not stored yet, by hour, agent
+// and command. Unlike the commands_* counters of /api/control/metrics, the
+// stored totals and their hourly history (see usage.go) survive restarts.
+type executionTotals struct {
+	mu      sync.Mutex
+	pending map[totalKey]*serverstore.ExecutionCount
+}
+
+type totalKey struct {
+	hour           int64
+	agent, command string
+}
+
+// InitExecutionTotals starts adding the execution counts to the stored totals.
+func (h *Handler) InitExecutionTotals() {
+	go func() {
+		ticker := time.NewTicker(totalsFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			h.FlushExecutionTotals()
+		}
+	}()
+}
+
+// countTotal adds to the pending counts of command on agentName in the
+// current hour.
+func (h *Handler) countTotal(agentName, command string, add func(c *serverstore.ExecutionCount)) {
+	if agentName == "" || command == "" {
+		return
+	}
+	hour := time.Now().Truncate(time.Hour)
+	key := totalKey{hour.Unix(), agentName, command}
+	h.totals.mu.Lock()
+	defer h.totals.mu.Unlock()
+	if h.totals.pending == nil {
+		h.totals.pending = make(map[totalKey]*serverstore.ExecutionCount)
+	}
+	c, ok := h.totals.pending[key]
+	if !ok {
+		c = &serverstore.ExecutionCount{Hour: hour, Agent: agentName, Command: command}
+		h.totals.pending[key] = c
+	}
+	add(c)
+}
+
+// countExecution counts a finished execution.
+func (h *Handler) countExecution(agentName, command string, failed bool) {
+	h.countTotal(agentName, command, func(c *serverstore.ExecutionCount) {
+		c.Executions++
+		if failed {
+			c.Failures++
+		}
+	})
+}
+
+// countClient counts a client served a run of command, its own or a shared
+// one (see coalesce.go).
+func (h *Handler) countClient(agentName, command string) {
+	h.countTotal(agentName, command, func(c *serverstore.ExecutionCount) {
+		c.Clients++
+	})
+}
+
+// FlushExecutionTotals adds the pending counts to the stored totals. The
+// server also calls it on shutdown.
+func (h *Handler) FlushExecutionTotals() {
+	h.totals.mu.Lock()
+	defer h.totals.mu.Unlock()
+	h.flushExecutionTotalsLocked()
+}
+
+// flushExecutionTotalsLocked is FlushExecutionTotals for callers holding
+// h.totals.mu.
+func (h *Handler) flushExecutionTotalsLocked() {
+	if len(h.totals.pending) == 0 {
+		return
+	}
+
+	counts := make([]serverstore.ExecutionCount, 0, len(h.totals.pending))
+	for _, c := range h.totals.pending {
+		counts = append(counts, *c)
+	}
+	if err := h.store.AddExecutionCounts(counts, time.Now()); err != nil {
+		// The counts are kept for the next flush.
+		logger.Warnf("Failed to store execution totals: %v", err)
+		return
+	}
+	h.totals.pending = nil
+}
+
+// allTimeTotals returns the stored totals, for /api/control/metrics.
+func (h *Handler) allTimeTotals() map[string]any {
+	h.FlushExecutionTotals()
+	stored, err := h.store.ListExecutionTotals()
+	if err != nil {
+		logger.Warnf("Failed to load execution totals: %v", err)
+	}
+
+	var executions, failures, clients int64
+	var since time.Time
+	commands := make([]map[string]any, 0, len(stored))
+	for _, t := range stored {
+		executions += t.Executions
+		failures += t.Failures
+		clients += t.Clients
+		if since.IsZero() || t.Since.Before(since) {
+			since = t.Since
+		}
+		commands = append(commands, map[string]any{
+			"agent":      t.Agent,
+			"command":    t.Command,
+			"executions": t.Executions,
+			"failures":   t.Failures,
+			"clients":    t.Clients,
+		})
+	}
+	totals := map[string]any{
+		"executions":     executions,
+		"failures":       failures,
+		"clients_served": clients,
+		"commands":       commands,
+	}
+	if !since.IsZero() {
+		totals["since"] = since.UTC().Format(time.RFC3339)
+	}
+	return totals
+}
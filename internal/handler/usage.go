@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+)
+
+// usageDefaultDays is the period /api/control/usage covers without ?days=.
+const usageDefaultDays = 7
+
+// usageBucket is one hour or day of the usage series.
+type usageBucket struct {
+	Start      string `json:"start"`
+	Executions int64  `json:"executions"`
+	Failures   int64  `json:"failures"`
+	Clients    int64  `json:"clients"`
+}
+
+// handleControlUsage handles GET /api/control/usage?days=7&bucket=day|hour:
+// executions, failures and clients served per hour or UTC day over the last
+// days, overall and per agent, from the hourly history of the execution
+// totals (see totals.go). Every bucket of the period is listed, empty ones
+// with zeros, so the series can be charted as is.
+func (h *Handler) handleControlUsage(w http.ResponseWriter, r *http.Request) {
+	if !h.requireControlAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxDays := int(h.retention.usage / (24 * time.Hour))
+	days := min(usageDefaultDays, maxDays)
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDays {
+			http.Error(w, "days must be between 1 and "+strconv.Itoa(maxDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	bucket, width := r.URL.Query().Get("bucket"), 24*time.Hour
+	if bucket == "" {
+		bucket = "day"
+	}
+	switch bucket {
+	case "day":
+	case "hour":
+		width = time.Hour
+	default:
+		http.Error(w, "bucket must be hour or day", http.StatusBadRequest)
+		return
+	}
+
+	// Day buckets are UTC days; the period ends with the current bucket.
+	now := time.Now()
+	count := days * int(24*time.Hour/width)
+	start := now.Truncate(width).Add(-time.Duration(count-1) * width)
+
+	h.FlushExecutionTotals()
+	history, err := h.store.ExecutionHistory(start)
+	if err != nil {
+		logger.Errorf("Failed to load execution history: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	newSeries := func() []usageBucket {
+		series := make([]usageBucket, count)
+		for i := range series {
+			series[i].Start = start.Add(time.Duration(i) * width).UTC().Format(time.RFC3339)
+		}
+		return series
+	}
+	overall := newSeries()
+	byAgent := make(map[string][]usageBucket)
+	for _, c := range history {
+		i := int(c.Hour.Sub(start) / width)
+		if i < 0 || i >= count {
+			continue
+		}
+		series, ok := byAgent[c.Agent]
+		if !ok {
+			series = newSeries()
+			byAgent[c.Agent] = series
+		}
+		for _, b := range []*usageBucket{&overall[i], &series[i]} {
+			b.Executions += c.Executions
+			b.Failures += c.Failures
+			b.Clients += c.Clients
+		}
+	}
+
+	names := make([]string, 0, len(byAgent))
+	for name := range byAgent {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	agents := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		agents = append(agents, map[string]any{"agent": name, "buckets": byAgent[name]})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setNoCacheHeaders(w)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"bucket":  bucket,
+		"days":    days,
+		"since":   start.UTC().Format(time.RFC3339),
+		"overall": overall,
+		"agents":  agents,
+	})
+}
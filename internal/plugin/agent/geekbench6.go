@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"YALS/internal/plugin"
 	"bufio"
 	"bytes"
 	"context"
@@ -11,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
 )
 
 // GeekBench6Plugin implements the GeekBench 6 CPU benchmark plugin
@@ -34,6 +35,9 @@ type GeekBench6Result struct {
 // Global instance to maintain state across requests
 var geekbench6Instance = &GeekBench6Plugin{}
 
+// geekbench6Path is where the install script places the Geekbench 6 binary.
+const geekbench6Path = "/opt/geekbench6/geekbench6"
+
 // GetName returns the plugin name
 func (p *GeekBench6Plugin) GetName() string {
 	return "geekbench6"
@@ -54,6 +58,11 @@ func (p *GeekBench6Plugin) GetMaximumQueue() int {
 	return 1
 }
 
+// GetRequiredBinaries implements PluginWithRequirements interface
+func (p *GeekBench6Plugin) GetRequiredBinaries() []string {
+	return []string{geekbench6Path}
+}
+
 // CheckQueueLimit implements PluginWithQueueControl interface
 func (p *GeekBench6Plugin) CheckQueueLimit() (bool, string) {
 	p.mutex.RLock()
@@ -129,7 +138,7 @@ func (p *GeekBench6Plugin) executeInternal(ctx context.Context, callback plugin.
 		p.mutex.Unlock()
 	}()
 
-	commandPath := "/opt/geekbench6/geekbench6"
+	commandPath := geekbench6Path
 
 	if strings.Contains(commandPath, "..") || !strings.HasPrefix(commandPath, "/") {
 		err := fmt.Errorf("invalid command path")
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"YALS/internal/plugin"
 	"bufio"
 	"context"
 	"fmt"
@@ -11,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
 )
 
 // MTRPlugin implements the MTR network diagnostic plugin
@@ -37,6 +38,11 @@ func (p *MTRPlugin) GetMaximumQueue() int {
 	return 10
 }
 
+// GetRequiredBinaries implements PluginWithRequirements interface
+func (p *MTRPlugin) GetRequiredBinaries() []string {
+	return []string{"mtr"}
+}
+
 // MTRHop represents a single hop in the MTR trace
 type MTRHop struct {
 	TTL      int
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+)
+
+// NextTracePlugin runs NextTrace in JSON mode and turns its report into both a
+// readable hop table and a structured route (geo/ASN per hop) for route maps.
+type NextTracePlugin struct{}
+
+// nextTraceTimeout bounds a single trace; NextTrace itself gives up on silent
+// hops, this only guards against a wedged process.
+const nextTraceTimeout = 2 * time.Minute
+
+// nextTraceReport mirrors the subset of NextTrace's --json output we use. Hops
+// is indexed by TTL-1; each entry holds one attempt per query.
+type nextTraceReport struct {
+	Hops [][]nextTraceAttempt `json:"Hops"`
+}
+
+type nextTraceAttempt struct {
+	Success bool `json:"Success"`
+	Address *struct {
+		IP string `json:"IP"`
+	} `json:"Address"`
+	Hostname string        `json:"Hostname"`
+	TTL      int           `json:"TTL"`
+	RTT      time.Duration `json:"RTT"`
+	Geo      *struct {
+		ASNumber string  `json:"asnumber"`
+		Country  string  `json:"country"`
+		Prov     string  `json:"prov"`
+		City     string  `json:"city"`
+		Owner    string  `json:"owner"`
+		ISP      string  `json:"isp"`
+		Lat      float64 `json:"lat"`
+		Lng      float64 `json:"lng"`
+	} `json:"Geo"`
+}
+
+func init() {
+	plugin.RegisterAgentPlugin("nexttrace", func() plugin.Plugin {
+		return &NextTracePlugin{}
+	})
+}
+
+// GetName returns the plugin name
+func (p *NextTracePlugin) GetName() string {
+	return "nexttrace"
+}
+
+// GetDescription returns the plugin description
+func (p *NextTracePlugin) GetDescription() string {
+	return "NextTrace route trace with geo/ASN per hop"
+}
+
+// GetIgnoreTarget implements PluginWithConfig interface
+func (p *NextTracePlugin) GetIgnoreTarget() bool {
+	return false
+}
+
+// GetMaximumQueue implements PluginWithConfig interface
+func (p *NextTracePlugin) GetMaximumQueue() int {
+	return 5
+}
+
+// GetRequiredBinaries implements PluginWithRequirements interface
+func (p *NextTracePlugin) GetRequiredBinaries() []string {
+	return []string{"nexttrace"}
+}
+
+// Execute runs the trace and returns the formatted hop table
+func (p *NextTracePlugin) Execute(target string) (string, error) {
+	var output string
+	err := p.ExecuteStreaming(target, func(data string, isError bool, isComplete bool) {
+		if !isError {
+			output = data
+		}
+	})
+	return output, err
+}
+
+// ExecuteStreaming runs the trace with streaming output
+func (p *NextTracePlugin) ExecuteStreaming(target string, callback plugin.StreamingCallback) error {
+	return p.ExecuteStreamingWithData(target, "", callback, nil)
+}
+
+// ExecuteStreamingWithID runs the trace with command ID for stop functionality
+func (p *NextTracePlugin) ExecuteStreamingWithID(target, commandID string, callback plugin.StreamingCallback) error {
+	return p.ExecuteStreamingWithData(target, commandID, callback, nil)
+}
+
+// ExecuteStreamingWithData runs the trace and, when it completes, emits the
+// structured route through onData in addition to the text table
+func (p *NextTracePlugin) ExecuteStreamingWithData(target, commandID string, callback plugin.StreamingCallback, onData plugin.DataCallback) error {
+	target = plugin.SanitizeTarget(target)
+	if target == "" {
+		callback("Invalid target", true, true)
+		return fmt.Errorf("invalid target")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nextTraceTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "nexttrace", "--json", target)
+	if commandID != "" {
+		manager := plugin.GetManager()
+		manager.RegisterActiveCommand(commandID, cmd)
+		defer manager.UnregisterActiveCommand(commandID)
+	}
+
+	header := fmt.Sprintf("NextTrace to %s\n", target)
+	callback(header+"Tracing, results are shown when the trace completes...\n", false, false)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		callback(fmt.Sprintf("nexttrace failed: %s\n", msg), true, true)
+		return err
+	}
+
+	route, err := parseNextTraceReport(stdout.Bytes(), target)
+	if err != nil {
+		callback(fmt.Sprintf("Failed to parse nexttrace output: %v\n", err), true, true)
+		return err
+	}
+
+	if onData != nil {
+		onData(route)
+	}
+	callback(header+formatRoute(route), false, true)
+	return nil
+}
+
+// parseNextTraceReport extracts the JSON report (NextTrace may print a banner
+// before it) and converts it into a proto.RouteResult.
+func parseNextTraceReport(out []byte, target string) (proto.RouteResult, error) {
+	route := proto.RouteResult{Kind: proto.ResultKindRoute, Target: target}
+
+	start := bytes.IndexByte(out, '{')
+	if start == -1 {
+		return route, fmt.Errorf("no JSON report in output")
+	}
+	var report nextTraceReport
+	if err := json.Unmarshal(out[start:], &report); err != nil {
+		return route, err
+	}
+
+	for i, attempts := range report.Hops {
+		hop := proto.RouteHop{TTL: i + 1}
+		for _, a := range attempts {
+			if !a.Success || a.Address == nil || a.Address.IP == "" {
+				continue
+			}
+			hop.RTTMs = append(hop.RTTMs, float64(a.RTT)/float64(time.Millisecond))
+			if hop.IP != "" {
+				continue
+			}
+			hop.IP = a.Address.IP
+			hop.Hostname = a.Hostname
+			if a.Geo != nil {
+				hop.ASN = a.Geo.ASNumber
+				hop.Country = a.Geo.Country
+				hop.Province = a.Geo.Prov
+				hop.City = a.Geo.City
+				hop.Owner = a.Geo.Owner
+				hop.ISP = a.Geo.ISP
+				hop.Lat = a.Geo.Lat
+				hop.Lng = a.Geo.Lng
+			}
+		}
+		route.Hops = append(route.Hops, hop)
+	}
+	return route, nil
+}
+
+// formatRoute renders a route as a hop table for the terminal output.
+func formatRoute(route proto.RouteResult) string {
+	var b strings.Builder
+	for _, hop := range route.Hops {
+		if hop.IP == "" {
+			fmt.Fprintf(&b, "%3d  *\n", hop.TTL)
+			continue
+		}
+
+		host := hop.IP
+		if hop.Hostname != "" && hop.Hostname != hop.IP {
+			host = fmt.Sprintf("%s (%s)", hop.Hostname, hop.IP)
+		}
+
+		var geo []string
+		if hop.ASN != "" {
+			geo = append(geo, "AS"+strings.TrimPrefix(hop.ASN, "AS"))
+		}
+		for _, part := range []string{hop.Country, hop.Province, hop.City, hop.Owner} {
+			if part != "" {
+				geo = append(geo, part)
+			}
+		}
+
+		rtts := make([]string, 0, len(hop.RTTMs))
+		for _, rtt := range hop.RTTMs {
+			rtts = append(rtts, fmt.Sprintf("%.2f ms", rtt))
+		}
+
+		fmt.Fprintf(&b, "%3d  %-40s %-40s %s\n", hop.TTL, host, strings.Join(geo, " "), strings.Join(rtts, " / "))
+	}
+	return b.String()
+}
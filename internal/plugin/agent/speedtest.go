@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"YALS/internal/plugin"
 	"context"
 	"crypto/rand"
 	"fmt"
@@ -10,6 +9,8 @@ import (
 	"os/exec"
 	"sync"
 	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
 )
 
 // SpeedTestPlugin implements the speed test plugin with iperf3 and HTTP download
@@ -91,6 +92,11 @@ func (p *SpeedTestPlugin) GetMaximumQueue() int {
 	return 0 // Allow unlimited concurrent tests
 }
 
+// GetRequiredBinaries implements PluginWithRequirements interface
+func (p *SpeedTestPlugin) GetRequiredBinaries() []string {
+	return []string{"iperf3"}
+}
+
 // Execute runs the speed test
 func (p *SpeedTestPlugin) Execute(target string) (string, error) {
 	var output string
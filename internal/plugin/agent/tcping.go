@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"YALS/internal/plugin"
 	"context"
 	"fmt"
 	"net"
@@ -9,6 +8,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
 )
 
 // TCPingPlugin implements the TCP ping plugin
@@ -44,6 +45,12 @@ func (p *TCPingPlugin) GetIgnoreTarget() bool {
 	return false
 }
 
+// GetTargetType returns the target form the plugin expects: host with an
+// optional port
+func (p *TCPingPlugin) GetTargetType() string {
+	return "host_port"
+}
+
 // GetMaximumQueue returns the maximum queue size (0 = unlimited)
 func (p *TCPingPlugin) GetMaximumQueue() int {
 	return 10
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"YALS/internal/plugin"
 	"context"
 	"fmt"
 	"math/rand"
@@ -10,6 +9,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/plugin"
 )
 
 // UDPingPlugin implements the UDP ping plugin
@@ -45,6 +46,12 @@ func (p *UDPingPlugin) GetIgnoreTarget() bool {
 	return false
 }
 
+// GetTargetType returns the target form the plugin expects: host with an
+// optional port
+func (p *UDPingPlugin) GetTargetType() string {
+	return "host_port"
+}
+
 // GetMaximumQueue returns the maximum queue size (0 = unlimited)
 func (p *UDPingPlugin) GetMaximumQueue() int {
 	return 10
@@ -1,7 +1,7 @@
 package plugin
 
 import (
-	"YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/config"
 	"sync"
 )
 
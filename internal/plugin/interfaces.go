@@ -3,6 +3,10 @@ package plugin
 // StreamingCallback is called for each chunk of output during plugin execution
 type StreamingCallback func(output string, isError bool, isComplete bool)
 
+// DataCallback receives a machine-readable result (a JSON-serializable value
+// with a "kind" field, see proto.RouteResult) alongside the text output
+type DataCallback func(data any)
+
 // Plugin represents a command plugin interface
 type Plugin interface {
 	// Execute runs the plugin with the given target and returns formatted output
@@ -30,6 +34,15 @@ type PluginWithConfig interface {
 	GetMaximumQueue() int
 }
 
+// PluginWithTargetType represents a plugin that expects a particular target
+// form, e.g. host:port for a TCP probe
+type PluginWithTargetType interface {
+	Plugin
+	// GetTargetType returns the target type (see validator.TargetType) used
+	// when the command does not set target_type
+	GetTargetType() string
+}
+
 // PluginWithQueueControl represents a plugin that handles its own queue management
 type PluginWithQueueControl interface {
 	Plugin
@@ -38,3 +51,20 @@ type PluginWithQueueControl interface {
 	// If canExecute is false, customMessage will be sent to the client as error
 	CheckQueueLimit() (bool, string)
 }
+
+// PluginWithRequirements represents a plugin that shells out to external tools.
+// The agent checks these at startup so a missing tool is reported up front
+// instead of failing every execution.
+type PluginWithRequirements interface {
+	Plugin
+	// GetRequiredBinaries returns the executables (names looked up in PATH, or
+	// absolute paths) the plugin needs on the agent host
+	GetRequiredBinaries() []string
+}
+
+// PluginWithStructuredOutput represents a plugin that emits structured results
+// in addition to its text output
+type PluginWithStructuredOutput interface {
+	Plugin
+	ExecuteStreamingWithData(target, commandID string, callback StreamingCallback, onData DataCallback) error
+}
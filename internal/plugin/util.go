@@ -85,6 +85,38 @@ func GetPluginMaximumQueue(pluginName string) (bool, int) {
 	return false, 0
 }
 
+// GetPluginTargetType returns the target type a plugin expects, or "" when
+// the plugin has no preference or is unknown
+func GetPluginTargetType(pluginName string) string {
+	manager := GetManager()
+	plugin, exists := manager.GetPlugin(pluginName)
+	if !exists {
+		return ""
+	}
+
+	if typedPlugin, ok := plugin.(PluginWithTargetType); ok {
+		return typedPlugin.GetTargetType()
+	}
+
+	return ""
+}
+
+// GetPluginRequiredBinaries returns the external executables a plugin needs, or
+// nil when the plugin is self-contained or unknown
+func GetPluginRequiredBinaries(pluginName string) []string {
+	manager := GetManager()
+	plugin, exists := manager.GetPlugin(pluginName)
+	if !exists {
+		return nil
+	}
+
+	if reqPlugin, ok := plugin.(PluginWithRequirements); ok {
+		return reqPlugin.GetRequiredBinaries()
+	}
+
+	return nil
+}
+
 // CheckPluginQueueLimit checks if a plugin can accept a new execution
 // Returns (canExecute bool, customMessage string)
 func CheckPluginQueueLimit(pluginName string) (bool, string) {
@@ -103,6 +135,12 @@ func CheckPluginQueueLimit(pluginName string) (bool, string) {
 
 // ExecutePluginCommand executes a plugin command with WebSocket connection
 func ExecutePluginCommand(pluginName, target, commandID string, callback StreamingCallback) error {
+	return ExecutePluginCommandWithData(pluginName, target, commandID, callback, nil)
+}
+
+// ExecutePluginCommandWithData executes a plugin command, also delivering any
+// structured results the plugin produces to onData
+func ExecutePluginCommandWithData(pluginName, target, commandID string, callback StreamingCallback, onData DataCallback) error {
 	canExecute, customMessage := CheckPluginQueueLimit(pluginName)
 	if !canExecute {
 		if callback != nil {
@@ -112,6 +150,13 @@ func ExecutePluginCommand(pluginName, target, commandID string, callback Streami
 	}
 
 	manager := GetManager()
+	if onData != nil {
+		if plugin, exists := manager.GetPlugin(pluginName); exists {
+			if dataPlugin, ok := plugin.(PluginWithStructuredOutput); ok {
+				return dataPlugin.ExecuteStreamingWithData(target, commandID, callback, onData)
+			}
+		}
+	}
 	return manager.ExecutePluginStreamingWithID(pluginName, target, commandID, callback)
 }
 
@@ -149,6 +194,24 @@ func StopPluginCommand(commandID string) bool {
 	return false
 }
 
+// StopAllPluginCommands stops every running plugin command and returns how
+// many there were.
+func StopAllPluginCommands() int {
+	manager := GetManager()
+
+	manager.commandsLock.Lock()
+	defer manager.commandsLock.Unlock()
+
+	stopped := len(manager.activeCommands)
+	for commandID, cmd := range manager.activeCommands {
+		if c, ok := cmd.(*exec.Cmd); ok && c.Process != nil {
+			c.Process.Kill()
+		}
+		delete(manager.activeCommands, commandID)
+	}
+	return stopped
+}
+
 // RegisterActiveCommand registers an active command for stop functionality
 func (m *Manager) RegisterActiveCommand(commandID string, cmd interface{}) {
 	m.commandsLock.Lock()
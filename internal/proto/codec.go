@@ -1,8 +1,11 @@
 package proto
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 
 	"google.golang.org/grpc/encoding"
 )
@@ -11,30 +14,136 @@ func init() {
 	encoding.RegisterCodec(jsonCodec{})
 }
 
+// ErrMalformed is wrapped by every error of decoding a message that is not
+// one: anything but a single JSON object of the message's shape.
+var ErrMalformed = errors.New("malformed message")
+
+// jsonCodec carries the AgentService messages as JSON. Messages are decoded
+// strictly (see UnmarshalCommandMessage) so that a malformed one is refused
+// the same way by the server and the agent.
 type jsonCodec struct{}
 
 func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
-	return json.Marshal(v)
+	switch m := v.(type) {
+	case *CommandMessage:
+		return MarshalCommandMessage(m)
+	default:
+		return json.Marshal(v)
+	}
 }
 
 func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+	switch m := v.(type) {
+	case *CommandMessage:
+		return decodeCommandMessage(data, m)
+	default:
+		return decodeObject(data, v)
+	}
 }
 
 func (jsonCodec) Name() string {
 	return "json"
 }
 
-// CallOption to use JSON codec
-func WithJSONCodec() interface{} {
-	return struct{}{}
+// MarshalCommandMessage encodes a stream message. A message without a type
+// is refused, as the receiving side would refuse it.
+func MarshalCommandMessage(m *CommandMessage) ([]byte, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrMalformed)
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalCommandMessage decodes a stream message. data must hold a single
+// JSON object with a type; unknown fields are ignored, so that newer peers
+// can add some. A null data field decodes as no data.
+func UnmarshalCommandMessage(data []byte) (*CommandMessage, error) {
+	m := new(CommandMessage)
+	if err := decodeCommandMessage(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func decodeCommandMessage(data []byte, m *CommandMessage) error {
+	*m = CommandMessage{}
+	if err := decodeObject(data, m); err != nil {
+		return err
+	}
+	if m.Type == "" {
+		return fmt.Errorf("%w: missing type", ErrMalformed)
+	}
+	if bytes.Equal(m.Data, []byte("null")) {
+		m.Data = nil
+	}
+	return nil
+}
+
+// UnmarshalHandshakeRequest decodes an agent's handshake.
+func UnmarshalHandshakeRequest(data []byte) (*HandshakeRequest, error) {
+	m := new(HandshakeRequest)
+	if err := decodeObject(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-// Helper function to ensure message is JSON serializable
-func EnsureJSONSerializable(v interface{}) error {
-	_, err := json.Marshal(v)
-	if err != nil {
-		return fmt.Errorf("message is not JSON serializable: %w", err)
+// UnmarshalHandshakeResponse decodes the server's answer to a handshake.
+func UnmarshalHandshakeResponse(data []byte) (*HandshakeResponse, error) {
+	m := new(HandshakeResponse)
+	if err := decodeObject(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UnmarshalEnrollRequest decodes an agent's enrollment request.
+func UnmarshalEnrollRequest(data []byte) (*EnrollRequest, error) {
+	m := new(EnrollRequest)
+	if err := decodeObject(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UnmarshalEnrollResponse decodes the server's answer to an enrollment
+// request.
+func UnmarshalEnrollResponse(data []byte) (*EnrollResponse, error) {
+	m := new(EnrollResponse)
+	if err := decodeObject(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UnmarshalData decodes the payload of a stream message, such as the
+// ProbeConfig of a "probe_config" or the SystemMetrics of a
+// "metrics_report". A message without data is an error.
+func UnmarshalData[T any](m *CommandMessage) (T, error) {
+	var v T
+	if len(m.Data) == 0 {
+		return v, fmt.Errorf("%w: %s without data", ErrMalformed, m.Type)
+	}
+	if err := json.Unmarshal(m.Data, &v); err != nil {
+		return v, fmt.Errorf("%w: %s data: %v", ErrMalformed, m.Type, err)
+	}
+	return v, nil
+}
+
+// decodeObject decodes data, which must hold exactly one JSON object, into
+// v. A value of the wrong type for a field fails the whole message instead
+// of leaving that field empty.
+func decodeObject(data []byte, v any) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return fmt.Errorf("%w: not a JSON object", ErrMalformed)
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: data after the object", ErrMalformed)
 	}
 	return nil
 }
@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"errors"
+	"testing"
+)
+
+var commandMessageSeeds = []string{
+	`{"type":"execute_command","command_name":"ping","target":"192.0.2.1","command_id":"c1","ip_version":"4"}`,
+	`{"type":"command_output","command_id":"c1","output":"64 bytes from 192.0.2.1"}`,
+	`{"type":"command_output","command_id":"c1","is_complete":true,"is_error":true,"error":"refused","code":"rate_limited"}`,
+	`{"type":"probe_config","data":{"interval":30}}`,
+	`{"type":"metrics_report","data":null}`,
+	`{"type":"command_output","command_id":"c1","output":"64 by`,
+	`{"type":`,
+	`{"command_id":"c1"}`,
+	`{"type":"ping"} {"type":"ping"}`,
+	`{"type":1}`,
+	`{"type":"ping","is_complete":"yes"}`,
+	`[{"type":"ping"}]`,
+	`null`,
+	``,
+	"\x00",
+}
+
+func FuzzUnmarshalCommandMessage(f *testing.F) {
+	for _, seed := range commandMessageSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := UnmarshalCommandMessage(data)
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("error does not wrap ErrMalformed: %v", err)
+			}
+			return
+		}
+		if m.Type == "" {
+			t.Fatal("decoded a message without a type")
+		}
+		// What was accepted must survive a round trip.
+		encoded, err := MarshalCommandMessage(m)
+		if err != nil {
+			t.Fatalf("re-encoding %q: %v", data, err)
+		}
+		if _, err := UnmarshalCommandMessage(encoded); err != nil {
+			t.Fatalf("decoding re-encoded %q: %v", encoded, err)
+		}
+	})
+}
+
+func FuzzUnmarshalHandshakeRequest(f *testing.F) {
+	for _, seed := range []string{
+		`{"uuid":"703ae79b-e8a5-47b7-9d58-ea30a68f5fb5","token":"secret"}`,
+		`{"uuid":"a","token":"b","catalog_hash":"h","sent_at":1700000000000,"compression":["zstd"],"capabilities":["raw_icmp"],"ping_mode":"raw"}`,
+		`{"uuid":"a","token":"b","sent_at":"now"}`,
+		`{"uuid":"a","token":"b","compression":"zstd"}`,
+		`{"uuid":"a","tok`,
+		`{"uuid":"a"}}`,
+		`{}`,
+		`"uuid"`,
+		`null`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := UnmarshalHandshakeRequest(data); err != nil && !errors.Is(err, ErrMalformed) {
+			t.Fatalf("error does not wrap ErrMalformed: %v", err)
+		}
+	})
+}
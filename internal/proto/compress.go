@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionZstd is the zstd encoding of command output. Agents offer it in
+// HandshakeRequest.Compression and the server accepts it in
+// HandshakeResponse.Compression.
+const CompressionZstd = "zstd"
+
+const (
+	// compressMinOutput is the shortest output worth compressing; shorter
+	// output gains less than the encoding costs.
+	compressMinOutput = 1 << 10
+	// MaxDecompressedOutput bounds the output the server inflates from one
+	// message, so that a small compressed message cannot exhaust its memory.
+	MaxDecompressedOutput = 64 << 20
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxDecompressedOutput))
+)
+
+// CompressOutput moves msg's Output into OutputZstd when that makes the
+// message smaller. OutputZstd travels base64-encoded, so short or
+// incompressible output is left as it is.
+func CompressOutput(msg *CommandMessage) {
+	if len(msg.Output) < compressMinOutput {
+		return
+	}
+	compressed := zstdEncoder.EncodeAll([]byte(msg.Output), nil)
+	if (len(compressed)+2)/3*4 >= len(msg.Output) {
+		return
+	}
+	msg.OutputZstd = compressed
+	msg.Output = ""
+}
+
+// DecompressOutput restores the Output of a message whose output was
+// compressed.
+func DecompressOutput(msg *CommandMessage) error {
+	if len(msg.OutputZstd) == 0 {
+		return nil
+	}
+	output, err := zstdDecoder.DecodeAll(msg.OutputZstd, nil)
+	if err != nil {
+		return fmt.Errorf("invalid zstd output: %w", err)
+	}
+	msg.Output = string(output)
+	msg.OutputZstd = nil
+	return nil
+}
@@ -2,12 +2,28 @@ package proto
 
 import (
 	"encoding/json"
+	"time"
 )
 
 // HandshakeRequest contains agent authentication and identity during connection.
 type HandshakeRequest struct {
 	UUID  string `json:"uuid"`
 	Token string `json:"token"`
+	// CatalogHash is the hash (config.CatalogHash) of the command catalog
+	// the agent enforced on its previous connection; empty after a start.
+	CatalogHash string `json:"catalog_hash,omitempty"`
+	// SentAt is the agent's clock (unix milliseconds) when it sent the
+	// handshake, from which the server estimates its clock offset.
+	SentAt int64 `json:"sent_at,omitempty"`
+	// Compression lists the encodings the agent can compress command output
+	// with (CompressionZstd); empty when it sends output as is.
+	Compression []string `json:"compression,omitempty"`
+	// Capabilities lists what the agent's host lets it do (Capability*).
+	Capabilities []string `json:"capabilities,omitempty"`
+	// PingMode is how the agent's latency probes send ICMP echo requests
+	// given its capabilities: "raw", "unprivileged" or "exec" (running the
+	// ping binary). Empty for agents too old to report it.
+	PingMode string `json:"ping_mode,omitempty"`
 }
 
 // Marshal implements custom marshaling for JSON codec.
@@ -17,14 +33,35 @@ func (m *HandshakeRequest) Marshal() ([]byte, error) {
 
 // Unmarshal implements custom unmarshaling for JSON codec.
 func (m *HandshakeRequest) Unmarshal(data []byte) error {
-	return json.Unmarshal(data, m)
+	*m = HandshakeRequest{}
+	return decodeObject(data, m)
 }
 
+// Capabilities an agent reports in its handshake.
+const (
+	// CapabilityRawICMP: the agent may open raw ICMP sockets (root or
+	// CAP_NET_RAW).
+	CapabilityRawICMP = "raw_icmp"
+	// CapabilityUnprivilegedICMP: the kernel lets the agent send ICMP echo
+	// requests over datagram sockets (net.ipv4.ping_group_range).
+	CapabilityUnprivilegedICMP = "unprivileged_icmp"
+	// CapabilityStructuredResults: the agent parses the text output of ping
+	// and traceroute into structured results (PingResult, RouteResult) when
+	// an "execute_command" sets Structured.
+	CapabilityStructuredResults = "structured_results"
+)
+
 // HandshakeResponse acknowledges the handshake and delivers runtime config.
 type HandshakeResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	Config  []byte `json:"config,omitempty"`
+	// ServerTime is the server's clock (unix milliseconds) when it answered,
+	// so the agent can warn about its own clock.
+	ServerTime int64 `json:"server_time,omitempty"`
+	// Compression is the encoding, out of the agent's offer, in which the
+	// server accepts compressed command output; empty for none.
+	Compression string `json:"compression,omitempty"`
 }
 
 // Marshal implements custom marshaling for JSON codec.
@@ -34,7 +71,99 @@ func (m *HandshakeResponse) Marshal() ([]byte, error) {
 
 // Unmarshal implements custom unmarshaling for JSON codec.
 func (m *HandshakeResponse) Unmarshal(data []byte) error {
-	return json.Unmarshal(data, m)
+	*m = HandshakeResponse{}
+	return decodeObject(data, m)
+}
+
+// EnrollRequest asks for an agent identity in exchange for a one-time
+// enrollment code, before the agent has a UUID and token. Key is a secret the
+// agent chose for this enrollment: the code is bound to the first key it is
+// used with, and only that key is given the token.
+type EnrollRequest struct {
+	Code string `json:"code"`
+	Key  string `json:"key"`
+	// Name is the name the agent asks for, by default its host name; the
+	// code or the verification may give it another.
+	Name     string `json:"name,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// Marshal implements custom marshaling for JSON codec.
+func (m *EnrollRequest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unmarshal implements custom unmarshaling for JSON codec.
+func (m *EnrollRequest) Unmarshal(data []byte) error {
+	*m = EnrollRequest{}
+	return decodeObject(data, m)
+}
+
+// Statuses of an EnrollResponse.
+const (
+	EnrollPending  = "pending"
+	EnrollApproved = "approved"
+)
+
+// EnrollResponse answers an EnrollRequest. While it is pending, the agent
+// asks again after RetryAfter seconds; once approved, UUID and Token are its
+// permanent identity. Invalid codes and denied enrollments are refused with
+// codes.PermissionDenied.
+type EnrollResponse struct {
+	Status     string `json:"status"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	Token      string `json:"token,omitempty"`
+}
+
+// Marshal implements custom marshaling for JSON codec.
+func (m *EnrollResponse) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unmarshal implements custom unmarshaling for JSON codec.
+func (m *EnrollResponse) Unmarshal(data []byte) error {
+	*m = EnrollResponse{}
+	return decodeObject(data, m)
+}
+
+// HealthRequest asks a server whether it would take the agent's stream now,
+// without registering the agent: an agent on a standby server asks its
+// primary before failing back.
+type HealthRequest struct {
+	UUID  string `json:"uuid"`
+	Token string `json:"token"`
+}
+
+// Marshal implements custom marshaling for JSON codec.
+func (m *HealthRequest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unmarshal implements custom unmarshaling for JSON codec.
+func (m *HealthRequest) Unmarshal(data []byte) error {
+	*m = HealthRequest{}
+	return decodeObject(data, m)
+}
+
+// HealthResponse answers a HealthRequest. Message says why a server is not
+// Ready; Connected is set when it holds a stream of the agent already.
+type HealthResponse struct {
+	Ready     bool   `json:"ready"`
+	Message   string `json:"message,omitempty"`
+	Connected bool   `json:"connected,omitempty"`
+}
+
+// Marshal implements custom marshaling for JSON codec.
+func (m *HealthResponse) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Unmarshal implements custom unmarshaling for JSON codec.
+func (m *HealthResponse) Unmarshal(data []byte) error {
+	*m = HealthResponse{}
+	return decodeObject(data, m)
 }
 
 // AgentDetails contains detailed information about the agent.
@@ -43,6 +172,12 @@ type AgentDetails struct {
 	Datacenter  string `json:"datacenter"`
 	TestIP      string `json:"test_ip"`
 	Description string `json:"description"`
+	Provider    string `json:"provider"`
+	ASN         string `json:"asn"`
+	Bandwidth   string `json:"bandwidth"`
+	IPv4        string `json:"ipv4"`
+	IPv6        string `json:"ipv6"`
+	LinkURL     string `json:"link_url"`
 }
 
 // CommandInfo describes an available command.
@@ -52,6 +187,19 @@ type CommandInfo struct {
 	UsePlugin    string `json:"use_plugin,omitempty"`
 	IgnoreTarget bool   `json:"ignore_target"`
 	MaximumQueue int    `json:"maxmium_queue,omitempty"`
+	Weight       int    `json:"weight,omitempty"`
+	// Unavailable marks a command whose binary is missing on the agent host;
+	// UnavailableReason says which one.
+	Unavailable       bool   `json:"unavailable,omitempty"`
+	UnavailableReason string `json:"unavailable_reason,omitempty"`
+	// AutoDetected marks a default template the agent registered itself
+	// because the tool is installed (auto-detect mode).
+	AutoDetected bool `json:"auto_detected,omitempty"`
+	// Usage hints of an auto-detected command.
+	ExampleTarget string `json:"example_target,omitempty"`
+	HelpText      string `json:"help_text,omitempty"`
+	Category      string `json:"category,omitempty"`
+	TargetType    string `json:"target_type,omitempty"`
 }
 
 // CommandMessage is used for bidirectional streaming.
@@ -61,6 +209,9 @@ type CommandInfo struct {
 //   - "metrics_report" (agent→server): Data is a SystemMetrics
 //   - "probe_config"   (server→agent): Data is a ProbeConfig
 //   - "probe_report"   (agent→server): Data is a ProbeBatch
+//   - "command_availability" (agent→server): Data is a []CommandInfo, sent once
+//     right after the stream opens, flagging commands whose binary is missing
+//     and announcing auto-detected default commands
 type CommandMessage struct {
 	Type        string          `json:"type"`
 	CommandName string          `json:"command_name,omitempty"`
@@ -72,8 +223,46 @@ type CommandMessage struct {
 	IsComplete  bool            `json:"is_complete,omitempty"`
 	IsError     bool            `json:"is_error,omitempty"`
 	Data        json.RawMessage `json:"data,omitempty"`
+	// Code is set on a "command_output" error when the agent refused to run the
+	// command at all (see the Reject* codes); Error then holds the reason.
+	Code string `json:"code,omitempty"`
+	// TraceParent carries the W3C trace context of an "execute_command" so the
+	// agent's execution span joins the server's trace.
+	TraceParent string `json:"traceparent,omitempty"`
+	// View names the view of the command an "execute_command" runs from
+	// (see config.CommandView); empty runs the template as written.
+	View string `json:"view,omitempty"`
+	// RequireFamily makes an "execute_command" with ip_version ipv4/ipv6 fail
+	// with RejectNoAddress when the domain target has no address of that
+	// family, instead of running against the domain. Dual-stack runs set it so
+	// that each labeled section really used its family.
+	RequireFamily bool `json:"require_family,omitempty"`
+	// OutputZstd replaces Output of a "command_output" with its zstd
+	// compression when the handshake negotiated it (see CompressOutput). The
+	// server restores Output on receipt.
+	OutputZstd []byte `json:"output_zstd,omitempty"`
+	// Structured asks the agent to send a structured result of an
+	// "execute_command" in Data next to its text output. The server only sets
+	// it for agents that reported CapabilityStructuredResults; any other agent
+	// sends text alone.
+	Structured bool `json:"structured,omitempty"`
+	// ReceivedAt is when the server received the message from an agent. It is
+	// never sent: the server times agent messages by its own clock.
+	ReceivedAt time.Time `json:"-"`
 }
 
+// Rejection codes an agent sends when it refuses a command.
+const (
+	RejectNotAllowed    = "not_allowed"    // command not in the agent's allowlist
+	RejectUnavailable   = "unavailable"    // binary/plugin missing on the agent host
+	RejectBusy          = "busy"           // command's queue limit reached, retry later
+	RejectInvalidTarget = "invalid_target" // target failed agent-side validation
+	RejectInvalidOption = "invalid_option" // an option such as ip_version is not recognized
+	RejectNoAddress     = "no_address"     // domain has no address of the required family
+	RejectRateLimited   = "rate_limited"   // agent's local execution limits reached
+	RejectPaused        = "paused"         // executions are paused on the server
+)
+
 // SystemMetrics is one snapshot of an agent host's resource usage. Bandwidth
 // fields are bytes/sec; total fields are cumulative bytes since the agent started.
 type SystemMetrics struct {
@@ -116,16 +305,88 @@ type ProbeResult struct {
 
 // ProbeBatch is one probe cycle's results reported by an agent.
 type ProbeBatch struct {
-	TS      int64         `json:"ts"` // unix seconds
+	TS      int64         `json:"ts"` // unix seconds; the server replaces it with its receipt time
 	Results []ProbeResult `json:"results"`
 }
 
+// CatalogReport is the data of a "catalog" stream message: the hash of the
+// command catalog the agent now enforces and how many commands it holds.
+// Agents send it after each handshake.
+type CatalogReport struct {
+	Hash     string `json:"hash"`
+	Commands int    `json:"commands"`
+}
+
+// A "command_output" message may carry a machine-readable result in Data next
+// to the human-readable Output. Every structured result is a JSON object whose
+// "kind" field names its shape, so consumers can dispatch without guessing.
+const (
+	ResultKindRoute  = "route"
+	ResultKindIperf3 = "iperf3"
+	ResultKindPing   = "ping"
+)
+
+// RouteHop is one hop of a structured trace, with the geo/ASN data a route map
+// needs. Hops that did not answer carry only TTL (and no RTTs).
+type RouteHop struct {
+	TTL      int       `json:"ttl"`
+	IP       string    `json:"ip,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	RTTMs    []float64 `json:"rtt_ms,omitempty"`
+	ASN      string    `json:"asn,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Province string    `json:"province,omitempty"`
+	City     string    `json:"city,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	ISP      string    `json:"isp,omitempty"`
+	Lat      float64   `json:"lat,omitempty"`
+	Lng      float64   `json:"lng,omitempty"`
+}
+
+// RouteResult is the structured result of a trace (kind "route").
+type RouteResult struct {
+	Kind   string     `json:"kind"`
+	Target string     `json:"target"`
+	Hops   []RouteHop `json:"hops"`
+}
+
+// Iperf3Summary is the normalized summary of an `iperf3 -J` run (kind
+// "iperf3"). Bitrates are bits/sec; UDP-only fields are zero for TCP tests.
+type Iperf3Summary struct {
+	Kind        string  `json:"kind"`
+	Protocol    string  `json:"protocol"`
+	Reverse     bool    `json:"reverse,omitempty"`
+	DurationSec float64 `json:"duration_sec"`
+	SenderBps   float64 `json:"sender_bps"`
+	ReceiverBps float64 `json:"receiver_bps"`
+	Retransmits int     `json:"retransmits,omitempty"`
+	JitterMs    float64 `json:"jitter_ms,omitempty"`
+	LostPackets int     `json:"lost_packets,omitempty"`
+	Packets     int     `json:"packets,omitempty"`
+	LostPercent float64 `json:"lost_percent,omitempty"`
+}
+
+// PingResult is the structured result of a ping run (kind "ping"). RTTMs
+// holds the round-trip time of each reply in the order they arrived; the
+// summary fields are zero when the output had no summary.
+type PingResult struct {
+	Kind        string    `json:"kind"`
+	Target      string    `json:"target"`
+	Sent        int       `json:"sent"`
+	Received    int       `json:"received"`
+	LossPercent float64   `json:"loss_percent"`
+	MinMs       float64   `json:"min_ms,omitempty"`
+	AvgMs       float64   `json:"avg_ms,omitempty"`
+	MaxMs       float64   `json:"max_ms,omitempty"`
+	RTTMs       []float64 `json:"rtt_ms,omitempty"`
+}
+
 // Marshal implements custom marshaling for JSON codec.
 func (m *CommandMessage) Marshal() ([]byte, error) {
-	return json.Marshal(m)
+	return MarshalCommandMessage(m)
 }
 
 // Unmarshal implements custom unmarshaling for JSON codec.
 func (m *CommandMessage) Unmarshal(data []byte) error {
-	return json.Unmarshal(data, m)
+	return decodeCommandMessage(data, m)
 }
@@ -4,7 +4,6 @@ package proto
 import (
 	"context"
 	"crypto/subtle"
-	"encoding/json"
 	"io"
 
 	"google.golang.org/grpc"
@@ -17,12 +16,16 @@ import (
 type AgentServiceServer interface {
 	Handshake(context.Context, *HandshakeRequest) (*HandshakeResponse, error)
 	StreamCommands(AgentService_StreamCommandsServer) error
+	Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error)
+	Health(context.Context, *HealthRequest) (*HealthResponse, error)
 }
 
 // AgentServiceClient is the client API for AgentService
 type AgentServiceClient interface {
 	Handshake(ctx context.Context, in *HandshakeRequest, opts ...grpc.CallOption) (*HandshakeResponse, error)
 	StreamCommands(ctx context.Context, opts ...grpc.CallOption) (AgentService_StreamCommandsClient, error)
+	Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error)
 }
 
 // AgentService_StreamCommandsServer is the server stream for StreamCommands
@@ -57,6 +60,24 @@ func (c *agentServiceClient) Handshake(ctx context.Context, in *HandshakeRequest
 	return out, nil
 }
 
+func (c *agentServiceClient) Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error) {
+	out := new(EnrollResponse)
+	err := c.cc.Invoke(ctx, "/proto.AgentService/Enroll", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error) {
+	out := new(HealthResponse)
+	err := c.cc.Invoke(ctx, "/proto.AgentService/Health", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *agentServiceClient) StreamCommands(ctx context.Context, opts ...grpc.CallOption) (AgentService_StreamCommandsClient, error) {
 	stream, err := c.cc.NewStream(ctx, &_AgentService_serviceDesc.Streams[0], "/proto.AgentService/StreamCommands", opts...)
 	if err != nil {
@@ -105,6 +126,42 @@ func _AgentService_Handshake_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AgentService_Enroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).Enroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.AgentService/Enroll",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).Enroll(ctx, req.(*EnrollRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.AgentService/Health",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _AgentService_StreamCommands_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(AgentServiceServer).StreamCommands(&agentServiceStreamCommandsServer{stream})
 }
@@ -133,6 +190,14 @@ var _AgentService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Handshake",
 			Handler:    _AgentService_Handshake_Handler,
 		},
+		{
+			MethodName: "Enroll",
+			Handler:    _AgentService_Enroll_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _AgentService_Health_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -145,15 +210,15 @@ var _AgentService_serviceDesc = grpc.ServiceDesc{
 	Metadata: "agent.proto",
 }
 
-// JSONCodec is a Codec implementation with json
+// JSONCodec is the codec the service is registered with (see codec.go).
 type JSONCodec struct{}
 
 func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
-	return json.Marshal(v)
+	return jsonCodec{}.Marshal(v)
 }
 
 func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+	return jsonCodec{}.Unmarshal(data, v)
 }
 
 func (JSONCodec) Name() string {
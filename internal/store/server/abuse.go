@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// AbuseReport is a viewer's report of a result as abusive. ResultID is set
+// when the result was stored (see RouteResultRecord); otherwise the agent,
+// command and target identify what ran.
+type AbuseReport struct {
+	ID         int64
+	ResultID   string
+	Agent      string
+	Command    string
+	Target     string
+	Reason     string
+	ReporterIP string
+	// Status is "open", "resolved" or "dismissed".
+	Status     string
+	CreatedAt  time.Time
+	ResolvedAt time.Time
+}
+
+// SaveAbuseReport stores a new open report and returns its id.
+func (s *Store) SaveAbuseReport(report AbuseReport) (int64, error) {
+	result, err := s.dbW.Exec(`
+INSERT INTO abuse_reports (result_id, agent, command, target, reason, reporter_ip, status, created_at)
+VALUES (?, ?, ?, ?, ?, ?, 'open', ?)
+`, report.ResultID, report.Agent, report.Command, report.Target, report.Reason, report.ReporterIP, report.CreatedAt.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("save abuse report: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("save abuse report: %w", err)
+	}
+	return id, nil
+}
+
+// CountOpenAbuseReports returns how many reports from reporterIP are open.
+func (s *Store) CountOpenAbuseReports(reporterIP string) (int, error) {
+	var n int
+	err := s.dbR.QueryRow(`
+SELECT COUNT(*) FROM abuse_reports WHERE status = 'open' AND reporter_ip = ?`, reporterIP).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("count abuse reports: %w", err)
+	}
+	return n, nil
+}
+
+// PruneOpenAbuseReports deletes the reports still open that were filed
+// before cutoff.
+func (s *Store) PruneOpenAbuseReports(cutoff time.Time) (int64, error) {
+	result, err := s.dbW.Exec(`DELETE FROM abuse_reports WHERE status = 'open' AND created_at < ?`, cutoff.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune abuse reports: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ListAbuseReports returns the reports with the given status (every report
+// when status is empty), newest first.
+func (s *Store) ListAbuseReports(status string) ([]AbuseReport, error) {
+	rows, err := s.dbR.Query(`
+SELECT id, result_id, agent, command, target, reason, reporter_ip, status, created_at, resolved_at
+FROM abuse_reports WHERE ? = '' OR status = ? ORDER BY id DESC`, status, status)
+	if err != nil {
+		return nil, fmt.Errorf("list abuse reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []AbuseReport{}
+	for rows.Next() {
+		var r AbuseReport
+		var createdAt, resolvedAt int64
+		if err := rows.Scan(&r.ID, &r.ResultID, &r.Agent, &r.Command, &r.Target, &r.Reason, &r.ReporterIP, &r.Status, &createdAt, &resolvedAt); err != nil {
+			return nil, fmt.Errorf("scan abuse report: %w", err)
+		}
+		r.CreatedAt = time.Unix(createdAt, 0)
+		if resolvedAt > 0 {
+			r.ResolvedAt = time.Unix(resolvedAt, 0)
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// SetAbuseReportStatus changes the status of report id; reopening it clears
+// its resolution time. found is false when there is no such report.
+func (s *Store) SetAbuseReportStatus(id int64, status string, at time.Time) (found bool, err error) {
+	resolvedAt := at.Unix()
+	if status == "open" {
+		resolvedAt = 0
+	}
+	result, err := s.dbW.Exec(`UPDATE abuse_reports SET status = ?, resolved_at = ? WHERE id = ?`, status, resolvedAt, id)
+	if err != nil {
+		return false, fmt.Errorf("update abuse report: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("update abuse report: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteAbuseReport removes report id. found is false when there was none.
+func (s *Store) DeleteAbuseReport(id int64) (found bool, err error) {
+	result, err := s.dbW.Exec(`DELETE FROM abuse_reports WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("delete abuse report: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete abuse report: %w", err)
+	}
+	return n > 0, nil
+}
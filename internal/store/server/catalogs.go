@@ -0,0 +1,82 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AgentCatalog is the command catalog hash pinned for an agent and the one it
+// reported last. ServedHash is the hash of the commands the server sent when
+// the pin was taken; a new ServedHash means the catalog was changed on
+// purpose.
+type AgentCatalog struct {
+	UUID         string
+	PinnedHash   string
+	ServedHash   string
+	ReportedHash string
+	PinnedAt     time.Time
+	ReportedAt   time.Time
+}
+
+// GetAgentCatalog loads the catalog record of uuid. found is false for agents
+// that never reported one.
+func (s *Store) GetAgentCatalog(uuid string) (catalog AgentCatalog, found bool, err error) {
+	var pinnedAt, reportedAt int64
+	err = s.dbR.QueryRow(`
+SELECT uuid, pinned_hash, served_hash, reported_hash, pinned_at, reported_at
+FROM agent_catalogs WHERE uuid = ?`, uuid).
+		Scan(&catalog.UUID, &catalog.PinnedHash, &catalog.ServedHash, &catalog.ReportedHash, &pinnedAt, &reportedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return catalog, false, nil
+	}
+	if err != nil {
+		return catalog, false, fmt.Errorf("get agent catalog: %w", err)
+	}
+	catalog.PinnedAt = time.Unix(pinnedAt, 0)
+	catalog.ReportedAt = time.Unix(reportedAt, 0)
+	return catalog, true, nil
+}
+
+// ListAgentCatalogs returns every agent's catalog record.
+func (s *Store) ListAgentCatalogs() ([]AgentCatalog, error) {
+	rows, err := s.dbR.Query(`
+SELECT uuid, pinned_hash, served_hash, reported_hash, pinned_at, reported_at
+FROM agent_catalogs ORDER BY uuid`)
+	if err != nil {
+		return nil, fmt.Errorf("list agent catalogs: %w", err)
+	}
+	defer rows.Close()
+
+	catalogs := []AgentCatalog{}
+	for rows.Next() {
+		var c AgentCatalog
+		var pinnedAt, reportedAt int64
+		if err := rows.Scan(&c.UUID, &c.PinnedHash, &c.ServedHash, &c.ReportedHash, &pinnedAt, &reportedAt); err != nil {
+			return nil, fmt.Errorf("scan agent catalog: %w", err)
+		}
+		c.PinnedAt = time.Unix(pinnedAt, 0)
+		c.ReportedAt = time.Unix(reportedAt, 0)
+		catalogs = append(catalogs, c)
+	}
+	return catalogs, rows.Err()
+}
+
+// SaveAgentCatalog stores catalog, replacing the agent's earlier record.
+func (s *Store) SaveAgentCatalog(catalog AgentCatalog) error {
+	_, err := s.dbW.Exec(`
+INSERT INTO agent_catalogs (uuid, pinned_hash, served_hash, reported_hash, pinned_at, reported_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(uuid) DO UPDATE SET
+    pinned_hash = excluded.pinned_hash,
+    served_hash = excluded.served_hash,
+    reported_hash = excluded.reported_hash,
+    pinned_at = excluded.pinned_at,
+    reported_at = excluded.reported_at
+`, catalog.UUID, catalog.PinnedHash, catalog.ServedHash, catalog.ReportedHash, catalog.PinnedAt.Unix(), catalog.ReportedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("save agent catalog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Statuses of an Enrollment.
+const (
+	// EnrollmentOpen: the code was created and not used yet.
+	EnrollmentOpen = "open"
+	// EnrollmentPending: an agent used the code and waits for the
+	// verification webhook or an operator.
+	EnrollmentPending = "pending"
+	// EnrollmentApproved: the agent was created (AgentUUID).
+	EnrollmentApproved = "approved"
+	// EnrollmentDenied: the agent will not be created.
+	EnrollmentDenied = "denied"
+)
+
+// Enrollment is a one-time enrollment code and the request of the agent that
+// used it. Only hashes of the code and of the agent's key are stored.
+type Enrollment struct {
+	ID       string `json:"id"`
+	CodeHash string `json:"-"`
+	// Label describes the code for operators. Name, Group and CommandsFrom
+	// preset the agent created on approval; an empty Name takes the name
+	// the agent asked for.
+	Label        string `json:"label"`
+	Name         string `json:"name"`
+	Group        string `json:"group"`
+	CommandsFrom string `json:"commands_from"`
+	Status       string `json:"status"`
+	KeyHash      string `json:"-"`
+	// RequestedName, Hostname and RemoteIP describe the agent that used
+	// the code.
+	RequestedName string `json:"requested_name,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	RemoteIP      string `json:"remote_ip,omitempty"`
+	AgentUUID     string `json:"agent_uuid,omitempty"`
+	// DecidedBy is "webhook" or "operator"; Reason is why it was denied.
+	DecidedBy   string    `json:"decided_by,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RequestedAt time.Time `json:"requested_at,omitzero"`
+	DecidedAt   time.Time `json:"decided_at,omitzero"`
+}
+
+const enrollmentColumns = `id, code_hash, label, name, group_name, commands_from, status, key_hash, requested_name, hostname, remote_ip, agent_uuid, decided_by, reason, created_at, expires_at, requested_at, decided_at`
+
+// CreateEnrollment stores a new open enrollment code.
+func (s *Store) CreateEnrollment(e Enrollment) error {
+	_, err := s.dbW.Exec(`
+INSERT INTO agent_enrollments (id, code_hash, label, name, group_name, commands_from, status, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, 'open', ?, ?)
+`, e.ID, e.CodeHash, e.Label, e.Name, e.Group, e.CommandsFrom, e.CreatedAt.Unix(), e.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("create enrollment: %w", err)
+	}
+	return nil
+}
+
+// GetEnrollment returns enrollment id, or sql.ErrNoRows.
+func (s *Store) GetEnrollment(id string) (*Enrollment, error) {
+	return scanEnrollment(s.dbR.QueryRow(`SELECT `+enrollmentColumns+` FROM agent_enrollments WHERE id = ?`, id))
+}
+
+// GetEnrollmentByCode returns the enrollment of a code hash, or
+// sql.ErrNoRows.
+func (s *Store) GetEnrollmentByCode(codeHash string) (*Enrollment, error) {
+	return scanEnrollment(s.dbR.QueryRow(`SELECT `+enrollmentColumns+` FROM agent_enrollments WHERE code_hash = ?`, codeHash))
+}
+
+// ListEnrollments returns every enrollment, newest first.
+func (s *Store) ListEnrollments() ([]Enrollment, error) {
+	rows, err := s.dbR.Query(`SELECT ` + enrollmentColumns + ` FROM agent_enrollments ORDER BY created_at DESC, id`)
+	if err != nil {
+		return nil, fmt.Errorf("list enrollments: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Enrollment{}
+	for rows.Next() {
+		e, err := scanEnrollment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *e)
+	}
+	return list, rows.Err()
+}
+
+// ClaimEnrollment binds the open, unexpired enrollment id to the agent
+// holding keyHash and makes it pending. claimed is false when another
+// request used the code first or it expired.
+func (s *Store) ClaimEnrollment(id, keyHash, requestedName, hostname, remoteIP string, at time.Time) (claimed bool, err error) {
+	result, err := s.dbW.Exec(`
+UPDATE agent_enrollments
+SET status = 'pending', key_hash = ?, requested_name = ?, hostname = ?, remote_ip = ?, requested_at = ?
+WHERE id = ? AND status = 'open' AND expires_at > ?
+`, keyHash, requestedName, hostname, remoteIP, at.Unix(), id, at.Unix())
+	if err != nil {
+		return false, fmt.Errorf("claim enrollment: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("claim enrollment: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DecideEnrollment approves (with the created agent's UUID) or denies the
+// pending enrollment id. decided is false when it was not pending.
+func (s *Store) DecideEnrollment(id, status, agentUUID, decidedBy, reason string, at time.Time) (decided bool, err error) {
+	if status != EnrollmentApproved && status != EnrollmentDenied {
+		return false, fmt.Errorf("invalid enrollment status %q", status)
+	}
+	result, err := s.dbW.Exec(`
+UPDATE agent_enrollments
+SET status = ?, agent_uuid = ?, decided_by = ?, reason = ?, decided_at = ?
+WHERE id = ? AND status = 'pending'
+`, status, agentUUID, decidedBy, reason, at.Unix(), id)
+	if err != nil {
+		return false, fmt.Errorf("decide enrollment: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("decide enrollment: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteEnrollment removes enrollment id, which revokes an unused code. The
+// agent of an approved one stays. found is false when there was none.
+func (s *Store) DeleteEnrollment(id string) (found bool, err error) {
+	result, err := s.dbW.Exec(`DELETE FROM agent_enrollments WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("delete enrollment: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete enrollment: %w", err)
+	}
+	return n > 0, nil
+}
+
+func scanEnrollment(scanner interface{ Scan(dest ...any) error }) (*Enrollment, error) {
+	var e Enrollment
+	var createdAt, expiresAt, requestedAt, decidedAt int64
+	err := scanner.Scan(&e.ID, &e.CodeHash, &e.Label, &e.Name, &e.Group, &e.CommandsFrom, &e.Status, &e.KeyHash,
+		&e.RequestedName, &e.Hostname, &e.RemoteIP, &e.AgentUUID, &e.DecidedBy, &e.Reason,
+		&createdAt, &expiresAt, &requestedAt, &decidedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan enrollment: %w", err)
+	}
+	e.CreatedAt = time.Unix(createdAt, 0)
+	e.ExpiresAt = time.Unix(expiresAt, 0)
+	if requestedAt > 0 {
+		e.RequestedAt = time.Unix(requestedAt, 0)
+	}
+	if decidedAt > 0 {
+		e.DecidedAt = time.Unix(decidedAt, 0)
+	}
+	return &e, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const featureFlagsKey = "feature_flags"
+
+// GetFeatureFlags returns the feature flags set through the control API,
+// which override the configured ones, or an empty map.
+func (s *Store) GetFeatureFlags() (map[string]bool, error) {
+	flags := make(map[string]bool)
+	row := s.dbR.QueryRow(`SELECT value_json FROM runtime_settings WHERE key = ?`, featureFlagsKey)
+	var payload string
+	if err := row.Scan(&payload); err != nil {
+		if err == sql.ErrNoRows {
+			return flags, nil
+		}
+		return flags, err
+	}
+	if err := json.Unmarshal([]byte(payload), &flags); err != nil {
+		return flags, fmt.Errorf("unmarshal feature flags: %w", err)
+	}
+	return flags, nil
+}
+
+// SaveFeatureFlags replaces the feature flags set through the control API.
+func (s *Store) SaveFeatureFlags(flags map[string]bool) error {
+	payload, err := json.Marshal(flags)
+	if err != nil {
+		return fmt.Errorf("marshal feature flags: %w", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	_, err = s.dbW.Exec(`
+INSERT INTO runtime_settings (key, value_json, updated_at)
+VALUES (?, ?, ?)
+ON CONFLICT(key) DO UPDATE SET value_json = excluded.value_json, updated_at = excluded.updated_at
+`, featureFlagsKey, string(payload), now)
+	if err != nil {
+		return fmt.Errorf("save feature flags: %w", err)
+	}
+	return nil
+}
@@ -92,7 +92,8 @@ type ProbeResultRow struct {
 	Recv       int
 }
 
-// InsertProbeResults appends a batch of probe results in one transaction.
+// InsertProbeResults appends a batch of probe results in one transaction and
+// adds them to their rollups.
 func (s *Store) InsertProbeResults(rows []ProbeResultRow) error {
 	if len(rows) == 0 {
 		return nil
@@ -107,11 +108,21 @@ func (s *Store) InsertProbeResults(rows []ProbeResultRow) error {
 		return fmt.Errorf("prepare probe insert: %w", err)
 	}
 	defer stmt.Close()
+	rollup, err := tx.Prepare(rollupUpsert)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("prepare probe rollup: %w", err)
+	}
+	defer rollup.Close()
 	for _, r := range rows {
 		if _, err := stmt.Exec(r.AgentUUID, r.AgentName, r.TargetName, r.TS, r.LatencyMs, r.Sent, r.Recv); err != nil {
 			_ = tx.Rollback()
 			return fmt.Errorf("insert probe result: %w", err)
 		}
+		if err := addToRollups(rollup, r); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
 	}
 	return tx.Commit()
 }
@@ -125,22 +136,27 @@ func (s *Store) PruneProbeResults(beforeTS int64) error {
 	return nil
 }
 
-// PurgeProbeTargets deletes probe results for any target_name not in keepNames.
-// Called after targets.yaml changes so renamed/removed targets drop their data.
+// PurgeProbeTargets deletes probe results and rollups for any target_name not
+// in keepNames. Called after targets.yaml changes so renamed/removed targets
+// drop their data.
 func (s *Store) PurgeProbeTargets(keepNames map[string]bool) error {
-	if len(keepNames) == 0 {
-		_, err := s.dbW.Exec(`DELETE FROM probe_results`)
-		return err
-	}
-	placeholders := make([]string, 0, len(keepNames))
-	args := make([]any, 0, len(keepNames))
-	for name := range keepNames {
-		placeholders = append(placeholders, "?")
-		args = append(args, name)
-	}
-	query := fmt.Sprintf(`DELETE FROM probe_results WHERE target_name NOT IN (%s)`, strings.Join(placeholders, ","))
-	if _, err := s.dbW.Exec(query, args...); err != nil {
-		return fmt.Errorf("purge probe targets: %w", err)
+	for _, table := range []string{"probe_results", "probe_rollups"} {
+		if len(keepNames) == 0 {
+			if _, err := s.dbW.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+			continue
+		}
+		placeholders := make([]string, 0, len(keepNames))
+		args := make([]any, 0, len(keepNames))
+		for name := range keepNames {
+			placeholders = append(placeholders, "?")
+			args = append(args, name)
+		}
+		query := fmt.Sprintf(`DELETE FROM %s WHERE target_name NOT IN (%s)`, table, strings.Join(placeholders, ","))
+		if _, err := s.dbW.Exec(query, args...); err != nil {
+			return fmt.Errorf("purge probe targets: %w", err)
+		}
 	}
 	return nil
 }
@@ -160,9 +176,10 @@ type ProbeAggregate struct {
 // QueryProbeAggregates returns, for one agent and a time window (ts >= sinceTS),
 // each target's latest latency, average and worst (max) latency over received
 // cycles, and loss inputs (sent/recv totals). Uses window functions to do it in a
-// single pass.
-func (s *Store) QueryProbeAggregates(agentName string, sinceTS int64) ([]ProbeAggregate, error) {
-	rows, err := s.dbR.Query(`
+// single pass. Any resolution but ProbeRaw reads the rollups, whose latest
+// latency is the average of the newest bucket.
+func (s *Store) QueryProbeAggregates(agentName string, sinceTS, resolution int64) ([]ProbeAggregate, error) {
+	query, args := `
 SELECT target_name, latest_ms, latest_recv, avg_ms, worst_ms, avg_sq, total_sent, total_recv FROM (
     SELECT
         target_name,
@@ -180,7 +197,11 @@ SELECT target_name, latest_ms, latest_recv, avg_ms, worst_ms, avg_sq, total_sent
 )
 WHERE rn = 1
 ORDER BY target_name
-`, agentName, sinceTS)
+`, []any{agentName, sinceTS}
+	if resolution != ProbeRaw {
+		query, args = rollupAggregatesQuery, []any{resolution, agentName, bucketStart(sinceTS, resolution)}
+	}
+	rows, err := s.dbR.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query probe aggregates: %w", err)
 	}
@@ -219,13 +240,19 @@ type ProbeSeriesPoint struct {
 }
 
 // QueryProbeSeries returns one target's per-cycle latency over a time window for
-// one agent, oldest first, for the latency chart.
-func (s *Store) QueryProbeSeries(agentName, targetName string, sinceTS int64) ([]ProbeSeriesPoint, error) {
-	rows, err := s.dbR.Query(`
+// one agent, oldest first, for the latency chart. Any resolution but ProbeRaw
+// returns a point per bucket instead: the average latency of its answered
+// cycles and the replies of all of them.
+func (s *Store) QueryProbeSeries(agentName, targetName string, sinceTS, resolution int64) ([]ProbeSeriesPoint, error) {
+	query, args := `
 SELECT ts, latency_ms, recv FROM probe_results
 WHERE agent_name = ? AND target_name = ? AND ts >= ?
 ORDER BY ts ASC
-`, agentName, targetName, sinceTS)
+`, []any{agentName, targetName, sinceTS}
+	if resolution != ProbeRaw {
+		query, args = rollupSeriesQuery, []any{resolution, agentName, targetName, bucketStart(sinceTS, resolution)}
+	}
+	rows, err := s.dbR.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query probe series: %w", err)
 	}
@@ -242,6 +269,47 @@ ORDER BY ts ASC
 	return result, rows.Err()
 }
 
+// ProbeCell is one agent's results for one target over a time window: the
+// average latency of received cycles (AvgMs, Valid only when some were) and
+// the loss inputs.
+type ProbeCell struct {
+	AgentName  string
+	TargetName string
+	AvgMs      sql.NullFloat64
+	Sent       int
+	Recv       int
+}
+
+// QueryProbeMatrix returns a ProbeCell for each agent and target with results
+// since sinceTS, for the agent × target heatmap, from the rollups of the given
+// resolution unless it is ProbeRaw.
+func (s *Store) QueryProbeMatrix(sinceTS, resolution int64) ([]ProbeCell, error) {
+	query, args := `
+SELECT agent_name, target_name, AVG(CASE WHEN recv > 0 THEN latency_ms END), SUM(sent), SUM(recv)
+FROM probe_results
+WHERE ts >= ?
+GROUP BY agent_name, target_name
+`, []any{sinceTS}
+	if resolution != ProbeRaw {
+		query, args = rollupMatrixQuery, []any{resolution, bucketStart(sinceTS, resolution)}
+	}
+	rows, err := s.dbR.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query probe matrix: %w", err)
+	}
+	defer rows.Close()
+
+	var result []ProbeCell
+	for rows.Next() {
+		var c ProbeCell
+		if err := rows.Scan(&c.AgentName, &c.TargetName, &c.AvgMs, &c.Sent, &c.Recv); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
 // ProbeSettings holds hot-reloadable probe configuration (the interval).
 type ProbeSettings struct {
 	IntervalSec int `json:"interval_sec"`
@@ -289,3 +357,75 @@ ON CONFLICT(key) DO UPDATE SET value_json = excluded.value_json, updated_at = ex
 	}
 	return settings, nil
 }
+
+// ProbeEvent records a scheduled probe whose result changed beyond the
+// monitoring threshold between two consecutive runs.
+type ProbeEvent struct {
+	ID         int64   `json:"id"`
+	AgentUUID  string  `json:"agent_uuid"`
+	AgentName  string  `json:"agent_name"`
+	TargetName string  `json:"target_name"`
+	Kind       string  `json:"kind"`
+	Previous   float64 `json:"previous"`
+	Current    float64 `json:"current"`
+	TS         int64   `json:"ts"`
+}
+
+// InsertProbeEvent stores e and returns its id.
+func (s *Store) InsertProbeEvent(e ProbeEvent) (int64, error) {
+	res, err := s.dbW.Exec(`
+INSERT INTO probe_events (agent_uuid, agent_name, target_name, kind, previous, current, ts)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`, e.AgentUUID, e.AgentName, e.TargetName, e.Kind, e.Previous, e.Current, e.TS)
+	if err != nil {
+		return 0, fmt.Errorf("insert probe event: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// ListProbeEvents returns the newest probe events first, at most limit.
+func (s *Store) ListProbeEvents(limit int) ([]ProbeEvent, error) {
+	rows, err := s.dbR.Query(`
+SELECT id, agent_uuid, agent_name, target_name, kind, previous, current, ts
+FROM probe_events
+ORDER BY ts DESC, id DESC
+LIMIT ?
+`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list probe events: %w", err)
+	}
+	defer rows.Close()
+
+	result := []ProbeEvent{}
+	for rows.Next() {
+		var e ProbeEvent
+		if err := rows.Scan(&e.ID, &e.AgentUUID, &e.AgentName, &e.TargetName, &e.Kind, &e.Previous, &e.Current, &e.TS); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// PruneProbeEvents deletes probe events older than the given unix timestamp
+// and returns how many were removed.
+func (s *Store) PruneProbeEvents(beforeTS int64) (int64, error) {
+	res, err := s.dbW.Exec(`DELETE FROM probe_events WHERE ts < ?`, beforeTS)
+	if err != nil {
+		return 0, fmt.Errorf("prune probe events: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// TrimProbeEvents deletes the oldest probe events beyond the newest maxRows
+// and returns how many were removed.
+func (s *Store) TrimProbeEvents(maxRows int) (int64, error) {
+	res, err := s.dbW.Exec(`
+DELETE FROM probe_events WHERE id IN (
+    SELECT id FROM probe_events ORDER BY id DESC LIMIT -1 OFFSET ?
+)`, maxRows)
+	if err != nil {
+		return 0, fmt.Errorf("trim probe events: %w", err)
+	}
+	return res.RowsAffected()
+}
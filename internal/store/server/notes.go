@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Note is a markdown note an operator attached to an agent (Kind "agent",
+// Name is the agent's name) or an agent group (Kind "group").
+type Note struct {
+	Kind      string
+	Name      string
+	Body      string
+	UpdatedAt time.Time
+}
+
+// ListNotes returns every note, by kind and name.
+func (s *Store) ListNotes() ([]Note, error) {
+	rows, err := s.dbR.Query(`SELECT kind, name, body, updated_at FROM notes ORDER BY kind, name`)
+	if err != nil {
+		return nil, fmt.Errorf("list notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		var n Note
+		var updatedAt int64
+		if err := rows.Scan(&n.Kind, &n.Name, &n.Body, &updatedAt); err != nil {
+			return nil, fmt.Errorf("scan note: %w", err)
+		}
+		n.UpdatedAt = time.Unix(updatedAt, 0)
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// SaveNote stores note, replacing the earlier note of the same kind and
+// name.
+func (s *Store) SaveNote(note Note) error {
+	_, err := s.dbW.Exec(`
+INSERT INTO notes (kind, name, body, updated_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT(kind, name) DO UPDATE SET
+    body = excluded.body,
+    updated_at = excluded.updated_at
+`, note.Kind, note.Name, note.Body, note.UpdatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("save note: %w", err)
+	}
+	return nil
+}
+
+// DeleteNote removes a note. found is false when there was none.
+func (s *Store) DeleteNote(kind, name string) (found bool, err error) {
+	result, err := s.dbW.Exec(`DELETE FROM notes WHERE kind = ? AND name = ?`, kind, name)
+	if err != nil {
+		return false, fmt.Errorf("delete note: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete note: %w", err)
+	}
+	return n > 0, nil
+}
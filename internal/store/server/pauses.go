@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExecutionPause stops new executions on every agent (Scope "global"), the
+// agents of one group (Scope "group", Name is the group) or one agent (Scope
+// "agent", Name is the agent's name).
+type ExecutionPause struct {
+	Scope    string
+	Name     string
+	Reason   string
+	PausedAt time.Time
+}
+
+// ListExecutionPauses returns every pause, oldest first.
+func (s *Store) ListExecutionPauses() ([]ExecutionPause, error) {
+	rows, err := s.dbR.Query(`
+SELECT scope, name, reason, paused_at
+FROM execution_pauses ORDER BY paused_at, scope, name`)
+	if err != nil {
+		return nil, fmt.Errorf("list execution pauses: %w", err)
+	}
+	defer rows.Close()
+
+	pauses := []ExecutionPause{}
+	for rows.Next() {
+		var p ExecutionPause
+		var pausedAt int64
+		if err := rows.Scan(&p.Scope, &p.Name, &p.Reason, &pausedAt); err != nil {
+			return nil, fmt.Errorf("scan execution pause: %w", err)
+		}
+		p.PausedAt = time.Unix(pausedAt, 0)
+		pauses = append(pauses, p)
+	}
+	return pauses, rows.Err()
+}
+
+// SaveExecutionPause stores pause, replacing an earlier pause of the same
+// scope and name.
+func (s *Store) SaveExecutionPause(pause ExecutionPause) error {
+	_, err := s.dbW.Exec(`
+INSERT INTO execution_pauses (scope, name, reason, paused_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT(scope, name) DO UPDATE SET
+    reason = excluded.reason,
+    paused_at = excluded.paused_at
+`, pause.Scope, pause.Name, pause.Reason, pause.PausedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("save execution pause: %w", err)
+	}
+	return nil
+}
+
+// DeleteExecutionPause lifts a pause. found is false when there was none.
+func (s *Store) DeleteExecutionPause(scope, name string) (found bool, err error) {
+	result, err := s.dbW.Exec(`DELETE FROM execution_pauses WHERE scope = ? AND name = ?`, scope, name)
+	if err != nil {
+		return false, fmt.Errorf("delete execution pause: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete execution pause: %w", err)
+	}
+	return n > 0, nil
+}
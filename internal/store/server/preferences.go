@@ -0,0 +1,69 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ClientPreferences are one browser's favorite agents and recently used
+// targets, keyed by the id in its preferences cookie.
+type ClientPreferences struct {
+	FavoriteAgents []string `json:"favorite_agents"`
+	RecentTargets  []string `json:"recent_targets"`
+}
+
+// GetClientPreferences loads the preferences stored under id. Unknown ids
+// yield empty preferences.
+func (s *Store) GetClientPreferences(id string) (ClientPreferences, error) {
+	prefs := ClientPreferences{FavoriteAgents: []string{}, RecentTargets: []string{}}
+	var payload string
+	err := s.dbR.QueryRow(`SELECT prefs_json FROM client_preferences WHERE id = ?`, id).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, fmt.Errorf("get client preferences: %w", err)
+	}
+	if err := json.Unmarshal([]byte(payload), &prefs); err != nil {
+		return prefs, fmt.Errorf("unmarshal client preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// SaveClientPreferences stores prefs under id and refreshes its last use.
+func (s *Store) SaveClientPreferences(id string, prefs ClientPreferences) error {
+	payload, err := json.Marshal(prefs)
+	if err != nil {
+		return fmt.Errorf("marshal client preferences: %w", err)
+	}
+	_, err = s.dbW.Exec(`
+INSERT INTO client_preferences (id, prefs_json, updated_at)
+VALUES (?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+    prefs_json = excluded.prefs_json,
+    updated_at = excluded.updated_at
+`, id, string(payload), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("save client preferences: %w", err)
+	}
+	return nil
+}
+
+// DeleteClientPreferences forgets the preferences stored under id.
+func (s *Store) DeleteClientPreferences(id string) error {
+	if _, err := s.dbW.Exec(`DELETE FROM client_preferences WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete client preferences: %w", err)
+	}
+	return nil
+}
+
+// PruneClientPreferences deletes preferences not used since before.
+func (s *Store) PruneClientPreferences(before time.Time) error {
+	if _, err := s.dbW.Exec(`DELETE FROM client_preferences WHERE updated_at < ?`, before.Unix()); err != nil {
+		return fmt.Errorf("prune client preferences: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Probe result resolutions, in seconds. Raw results are the cycles agents
+// report; every result is also added to a 5-minute and an hourly rollup as it
+// is stored, so the rollups outlive the raw rows at a bounded cost: one row
+// per agent, target and bucket.
+const (
+	ProbeRaw         int64 = 0
+	ProbeFiveMinutes int64 = 300
+	ProbeHourly      int64 = 3600
+)
+
+// probeRollupResolutions are the rollups InsertProbeResults maintains.
+var probeRollupResolutions = []int64{ProbeFiveMinutes, ProbeHourly}
+
+// rollupUpsert adds one result to the bucket of a resolution. The latency
+// columns only take answered cycles (latency NULL otherwise); MIN/MAX of a
+// NULL is NULL, hence the COALESCE.
+const rollupUpsert = `
+INSERT INTO probe_rollups (resolution, agent_name, target_name, ts, cycles, answered, sent, recv, latency_sum, latency_sq_sum, latency_max)
+VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(resolution, agent_name, target_name, ts) DO UPDATE SET
+    cycles = cycles + 1,
+    answered = answered + excluded.answered,
+    sent = sent + excluded.sent,
+    recv = recv + excluded.recv,
+    latency_sum = latency_sum + excluded.latency_sum,
+    latency_sq_sum = latency_sq_sum + excluded.latency_sq_sum,
+    latency_max = MAX(COALESCE(latency_max, excluded.latency_max), COALESCE(excluded.latency_max, latency_max))
+`
+
+func addToRollups(stmt *sql.Stmt, r ProbeResultRow) error {
+	answered, latency := 0, sql.NullFloat64{}
+	if r.Recv > 0 {
+		answered, latency = 1, sql.NullFloat64{Float64: r.LatencyMs, Valid: true}
+	}
+	for _, resolution := range probeRollupResolutions {
+		if _, err := stmt.Exec(resolution, r.AgentName, r.TargetName, bucketStart(r.TS, resolution), answered, r.Sent, r.Recv,
+			latency.Float64, latency.Float64*latency.Float64, latency); err != nil {
+			return fmt.Errorf("update probe rollup: %w", err)
+		}
+	}
+	return nil
+}
+
+// bucketStart is the start of the bucket of the given resolution holding ts.
+func bucketStart(ts, resolution int64) int64 {
+	return ts - ts%resolution
+}
+
+// The rollup counterparts of the raw queries in monitoring.go. Averages and
+// the jitter inputs weigh every answered cycle alike, as over raw results.
+const (
+	rollupAggregatesQuery = `
+SELECT target_name, latest_ms, latest_recv, avg_ms, worst_ms, avg_sq, total_sent, total_recv FROM (
+    SELECT
+        target_name,
+        FIRST_VALUE(COALESCE(latency_sum / NULLIF(answered, 0), 0)) OVER w AS latest_ms,
+        FIRST_VALUE(recv) OVER w AS latest_recv,
+        SUM(latency_sum) OVER p / NULLIF(SUM(answered) OVER p, 0) AS avg_ms,
+        MAX(latency_max) OVER p AS worst_ms,
+        SUM(latency_sq_sum) OVER p / NULLIF(SUM(answered) OVER p, 0) AS avg_sq,
+        SUM(sent) OVER p AS total_sent,
+        SUM(recv) OVER p AS total_recv,
+        ROW_NUMBER() OVER w AS rn
+    FROM probe_rollups
+    WHERE resolution = ? AND agent_name = ? AND ts >= ?
+    WINDOW w AS (PARTITION BY target_name ORDER BY ts DESC), p AS (PARTITION BY target_name)
+)
+WHERE rn = 1
+ORDER BY target_name
+`
+	rollupSeriesQuery = `
+SELECT ts, COALESCE(latency_sum / NULLIF(answered, 0), 0), recv FROM probe_rollups
+WHERE resolution = ? AND agent_name = ? AND target_name = ? AND ts >= ?
+ORDER BY ts ASC
+`
+	rollupMatrixQuery = `
+SELECT agent_name, target_name, SUM(latency_sum) / NULLIF(SUM(answered), 0), SUM(sent), SUM(recv)
+FROM probe_rollups
+WHERE resolution = ? AND ts >= ?
+GROUP BY agent_name, target_name
+`
+)
+
+// PruneProbeRollups deletes the buckets of a resolution that start before the
+// given unix timestamp and returns how many were removed.
+func (s *Store) PruneProbeRollups(resolution, beforeTS int64) (int64, error) {
+	res, err := s.dbW.Exec(`DELETE FROM probe_rollups WHERE resolution = ? AND ts < ?`, resolution, beforeTS)
+	if err != nil {
+		return 0, fmt.Errorf("prune probe rollups: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrAgentNameTaken is returned by RenameAgent when another agent already has
+// the new name and the caller did not ask for a merge.
+var ErrAgentNameTaken = errors.New("agent name is taken")
+
+// AgentRename is the outcome of RenameAgent.
+type AgentRename struct {
+	// UUIDs are the agents that were called by the old name: renamed, or
+	// deleted by a merge.
+	UUIDs []string
+	// Merged is set when the history went to an existing agent.
+	Merged bool
+	// Moved counts the rows that changed hands, by table.
+	Moved map[string]int64
+}
+
+// agentNameColumns are the tables holding history by agent name, with the
+// column that names the agent. Rows of tables with a primary key on the name
+// are merged separately (see mergeExecutionCounts).
+var agentNameColumns = []struct{ table, column string }{
+	{"probe_results", "agent_name"},
+	{"probe_events", "agent_name"},
+	{"route_results", "agent"},
+	{"abuse_reports", "agent"},
+}
+
+// RenameAgent moves the agent called from, and everything stored under its
+// name, to the name to, in one transaction: probe results, their rollups and
+// change events, stored routes, abuse reports, execution totals and hourly counts, an
+// execution pause of the agent, its note, and favorites in client
+// preferences.
+//
+// When no agent is called to, the agents called from are renamed. When one
+// is, merge must be set: the history is added to that agent's and the agents
+// called from are deleted, leaving tombstones. A merge also takes the history
+// of an agent that was deleted or purged already. RenameAgent returns
+// sql.ErrNoRows when there is nothing to rename or merge into, and
+// ErrAgentNameTaken when to is taken and merge is not set.
+func (s *Store) RenameAgent(from, to string, merge bool) (*AgentRename, error) {
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	if from == "" || to == "" {
+		return nil, errors.New("both agent names are required")
+	}
+	if from == to {
+		return nil, errors.New("the new name is the old one")
+	}
+
+	tx, err := s.dbW.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin agent rename: %w", err)
+	}
+	defer tx.Rollback()
+
+	sources, err := activeAgentUUIDs(tx, from)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := activeAgentUUIDs(tx, to)
+	if err != nil {
+		return nil, err
+	}
+	result := &AgentRename{UUIDs: sources, Merged: len(targets) > 0, Moved: make(map[string]int64)}
+	switch {
+	case result.Merged && !merge:
+		return nil, ErrAgentNameTaken
+	case !result.Merged && (merge || len(sources) == 0):
+		return nil, sql.ErrNoRows
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if result.Merged {
+		_, err = tx.Exec(`UPDATE agents SET deleted_at = ? WHERE name = ? AND deleted_at = ''`, now, from)
+	} else {
+		_, err = tx.Exec(`UPDATE agents SET name = ?, updated_at = ? WHERE name = ? AND deleted_at = ''`, to, now, from)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rename agent: %w", err)
+	}
+
+	for _, c := range agentNameColumns {
+		moved, err := execCount(tx, fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, c.table, c.column, c.column), to, from)
+		if err != nil {
+			return nil, fmt.Errorf("rename agent in %s: %w", c.table, err)
+		}
+		result.Moved[c.table] = moved
+	}
+	if err := mergeExecutionCounts(tx, from, to, result.Moved); err != nil {
+		return nil, err
+	}
+	if err := mergeProbeRollups(tx, from, to, result.Moved); err != nil {
+		return nil, err
+	}
+	// A pause of the agent called to already wins over the one of from.
+	moved, err := execCount(tx, `UPDATE OR IGNORE execution_pauses SET name = ? WHERE scope = 'agent' AND name = ?`, to, from)
+	if err != nil {
+		return nil, fmt.Errorf("rename agent pause: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM execution_pauses WHERE scope = 'agent' AND name = ?`, from); err != nil {
+		return nil, fmt.Errorf("rename agent pause: %w", err)
+	}
+	result.Moved["execution_pauses"] = moved
+	// So does a note of the agent called to.
+	if moved, err = execCount(tx, `UPDATE OR IGNORE notes SET name = ? WHERE kind = 'agent' AND name = ?`, to, from); err != nil {
+		return nil, fmt.Errorf("rename agent note: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM notes WHERE kind = 'agent' AND name = ?`, from); err != nil {
+		return nil, fmt.Errorf("rename agent note: %w", err)
+	}
+	result.Moved["notes"] = moved
+	if result.Moved["client_preferences"], err = renameFavoriteAgent(tx, from, to); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit agent rename: %w", err)
+	}
+	return result, nil
+}
+
+func activeAgentUUIDs(tx *sql.Tx, name string) ([]string, error) {
+	rows, err := tx.Query(`SELECT uuid FROM agents WHERE name = ? AND deleted_at = '' ORDER BY uuid`, name)
+	if err != nil {
+		return nil, fmt.Errorf("find agent %s: %w", name, err)
+	}
+	defer rows.Close()
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, rows.Err()
+}
+
+func execCount(tx *sql.Tx, query string, args ...any) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// mergeExecutionCounts adds the totals and hourly counts of from to those of
+// to, which are keyed by agent name, and drops the rows of from.
+func mergeExecutionCounts(tx *sql.Tx, from, to string, moved map[string]int64) error {
+	var err error
+	moved["execution_totals"], err = execCount(tx, `
+INSERT INTO execution_totals (agent, command, executions, failures, clients, since, updated_at)
+SELECT ?, command, executions, failures, clients, since, updated_at
+FROM execution_totals WHERE agent = ?
+ON CONFLICT(agent, command) DO UPDATE SET
+    executions = executions + excluded.executions,
+    failures = failures + excluded.failures,
+    clients = clients + excluded.clients,
+    since = MIN(since, excluded.since),
+    updated_at = MAX(updated_at, excluded.updated_at)
+`, to, from)
+	if err != nil {
+		return fmt.Errorf("merge execution totals: %w", err)
+	}
+	moved["execution_hourly"], err = execCount(tx, `
+INSERT INTO execution_hourly (hour, agent, command, executions, failures, clients)
+SELECT hour, ?, command, executions, failures, clients
+FROM execution_hourly WHERE agent = ?
+ON CONFLICT(hour, agent, command) DO UPDATE SET
+    executions = executions + excluded.executions,
+    failures = failures + excluded.failures,
+    clients = clients + excluded.clients
+`, to, from)
+	if err != nil {
+		return fmt.Errorf("merge hourly counts: %w", err)
+	}
+	for _, table := range []string{"execution_totals", "execution_hourly"} {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE agent = ?`, table), from); err != nil {
+			return fmt.Errorf("merge %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// mergeProbeRollups adds the probe rollups of from to those of to, bucket by
+// bucket, and drops the rows of from.
+func mergeProbeRollups(tx *sql.Tx, from, to string, moved map[string]int64) error {
+	var err error
+	moved["probe_rollups"], err = execCount(tx, `
+INSERT INTO probe_rollups (resolution, agent_name, target_name, ts, cycles, answered, sent, recv, latency_sum, latency_sq_sum, latency_max)
+SELECT resolution, ?, target_name, ts, cycles, answered, sent, recv, latency_sum, latency_sq_sum, latency_max
+FROM probe_rollups WHERE agent_name = ?
+ON CONFLICT(resolution, agent_name, target_name, ts) DO UPDATE SET
+    cycles = cycles + excluded.cycles,
+    answered = answered + excluded.answered,
+    sent = sent + excluded.sent,
+    recv = recv + excluded.recv,
+    latency_sum = latency_sum + excluded.latency_sum,
+    latency_sq_sum = latency_sq_sum + excluded.latency_sq_sum,
+    latency_max = MAX(COALESCE(latency_max, excluded.latency_max), COALESCE(excluded.latency_max, latency_max))
+`, to, from)
+	if err != nil {
+		return fmt.Errorf("merge probe rollups: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM probe_rollups WHERE agent_name = ?`, from); err != nil {
+		return fmt.Errorf("merge probe rollups: %w", err)
+	}
+	return nil
+}
+
+// renameFavoriteAgent replaces from with to in the favorite agents of every
+// client preference, keeping one entry when both were favorites. It returns
+// how many preferences changed.
+func renameFavoriteAgent(tx *sql.Tx, from, to string) (int64, error) {
+	quoted, err := json.Marshal(from)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT id, prefs_json FROM client_preferences WHERE instr(prefs_json, ?) > 0`, string(quoted))
+	if err != nil {
+		return 0, fmt.Errorf("find favorite agents: %w", err)
+	}
+	changed := make(map[string]string)
+	for rows.Next() {
+		var id, payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var prefs ClientPreferences
+		if err := json.Unmarshal([]byte(payload), &prefs); err != nil || !slices.Contains(prefs.FavoriteAgents, from) {
+			continue
+		}
+		favorites := make([]string, 0, len(prefs.FavoriteAgents))
+		for _, name := range prefs.FavoriteAgents {
+			if name == from {
+				name = to
+			}
+			if !slices.Contains(favorites, name) {
+				favorites = append(favorites, name)
+			}
+		}
+		prefs.FavoriteAgents = favorites
+		updated, err := json.Marshal(prefs)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		changed[id] = string(updated)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("find favorite agents: %w", err)
+	}
+
+	for id, payload := range changed {
+		if _, err := tx.Exec(`UPDATE client_preferences SET prefs_json = ? WHERE id = ?`, payload, id); err != nil {
+			return 0, fmt.Errorf("rename favorite agent: %w", err)
+		}
+	}
+	return int64(len(changed)), nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RouteResultRecord is a finished trace's structured route, kept so it can be
+// exported (e.g. as GeoJSON) after the run.
+type RouteResultRecord struct {
+	ID        string
+	Agent     string
+	Command   string
+	Target    string
+	Route     []byte // proto.RouteResult JSON; empty once archived
+	CreatedAt time.Time
+	// ArchiveKey is the object-storage key of Route after it was archived.
+	ArchiveKey string
+	// Owner identifies who ran the command (a hash, see the handler's
+	// resultOwner); empty for results stored before owners were recorded.
+	Owner string
+	// Signature is the base64 signature of the result by the key SigningKey
+	// names (see the handler's signing.go); empty when signing was off.
+	Signature  string
+	SigningKey string
+}
+
+// SaveRouteResult stores record under its id, replacing an earlier copy.
+func (s *Store) SaveRouteResult(record RouteResultRecord) error {
+	_, err := s.dbW.Exec(`
+INSERT INTO route_results (id, agent, command, target, route_json, created_at, owner, signature, signing_key)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+    agent = excluded.agent,
+    command = excluded.command,
+    target = excluded.target,
+    route_json = excluded.route_json,
+    created_at = excluded.created_at,
+    archive_key = '',
+    owner = excluded.owner,
+    signature = excluded.signature,
+    signing_key = excluded.signing_key
+`, record.ID, record.Agent, record.Command, record.Target, string(record.Route), record.CreatedAt.Unix(), record.Owner, record.Signature, record.SigningKey)
+	if err != nil {
+		return fmt.Errorf("save route result: %w", err)
+	}
+	return nil
+}
+
+// GetRouteResult loads the route stored under id. found is false for unknown
+// or pruned ids.
+func (s *Store) GetRouteResult(id string) (record RouteResultRecord, found bool, err error) {
+	var route string
+	var createdAt int64
+	err = s.dbR.QueryRow(`SELECT id, agent, command, target, route_json, created_at, archive_key, owner, signature, signing_key FROM route_results WHERE id = ?`, id).
+		Scan(&record.ID, &record.Agent, &record.Command, &record.Target, &route, &createdAt, &record.ArchiveKey, &record.Owner, &record.Signature, &record.SigningKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, fmt.Errorf("get route result: %w", err)
+	}
+	record.Route = []byte(route)
+	record.CreatedAt = time.Unix(createdAt, 0)
+	return record, true, nil
+}
+
+// PruneRouteResults deletes routes stored before before and returns how many
+// were removed.
+func (s *Store) PruneRouteResults(before time.Time) (int64, error) {
+	res, err := s.dbW.Exec(`DELETE FROM route_results WHERE created_at < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune route results: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// ListArchivedRouteResults returns the id and archive key of up to limit
+// archived routes stored before before, oldest first.
+func (s *Store) ListArchivedRouteResults(before time.Time, limit int) ([]RouteResultRecord, error) {
+	return s.listRouteKeys(`
+SELECT id, archive_key FROM route_results
+WHERE created_at < ? AND archive_key != ''
+ORDER BY created_at
+LIMIT ?
+`, before.Unix(), limit)
+}
+
+// ListExcessRouteResults returns the id and archive key of up to limit of
+// the routes beyond the newest maxRows.
+func (s *Store) ListExcessRouteResults(maxRows, limit int) ([]RouteResultRecord, error) {
+	return s.listRouteKeys(`SELECT id, archive_key FROM route_results ORDER BY created_at DESC LIMIT ? OFFSET ?`, limit, maxRows)
+}
+
+func (s *Store) listRouteKeys(query string, args ...any) ([]RouteResultRecord, error) {
+	rows, err := s.dbR.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list route results: %w", err)
+	}
+	defer rows.Close()
+
+	var records []RouteResultRecord
+	for rows.Next() {
+		var record RouteResultRecord
+		if err := rows.Scan(&record.ID, &record.ArchiveKey); err != nil {
+			return nil, fmt.Errorf("scan route result: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// DeleteRouteResults deletes the routes stored under ids and returns how
+// many were removed.
+func (s *Store) DeleteRouteResults(ids []string) (int64, error) {
+	tx, err := s.dbW.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin route delete: %w", err)
+	}
+	defer tx.Rollback()
+	var n int64
+	for _, id := range ids {
+		res, err := tx.Exec(`DELETE FROM route_results WHERE id = ?`, id)
+		if err != nil {
+			return 0, fmt.Errorf("delete route result: %w", err)
+		}
+		deleted, _ := res.RowsAffected()
+		n += deleted
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit route delete: %w", err)
+	}
+	return n, nil
+}
+
+// ListUnarchivedRouteResults returns up to limit routes stored before before
+// that still hold their route in the database, oldest first.
+func (s *Store) ListUnarchivedRouteResults(before time.Time, limit int) ([]RouteResultRecord, error) {
+	rows, err := s.dbR.Query(`
+SELECT id, agent, command, route_json, created_at FROM route_results
+WHERE created_at < ? AND archive_key = ''
+ORDER BY created_at
+LIMIT ?
+`, before.Unix(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("list unarchived route results: %w", err)
+	}
+	defer rows.Close()
+
+	var records []RouteResultRecord
+	for rows.Next() {
+		var record RouteResultRecord
+		var route string
+		var createdAt int64
+		if err := rows.Scan(&record.ID, &record.Agent, &record.Command, &route, &createdAt); err != nil {
+			return nil, fmt.Errorf("scan route result: %w", err)
+		}
+		record.Route = []byte(route)
+		record.CreatedAt = time.Unix(createdAt, 0)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// MarkRouteResultArchived drops the stored route of id, keeping its metadata
+// and the object-storage key it was archived under.
+func (s *Store) MarkRouteResultArchived(id, key string) error {
+	if _, err := s.dbW.Exec(`UPDATE route_results SET route_json = '', archive_key = ? WHERE id = ?`, key, id); err != nil {
+		return fmt.Errorf("mark route result archived: %w", err)
+	}
+	return nil
+}
+
+// ListOwnedRouteResults returns the metadata of owner's newest routes, at most
+// limit of them, newest first. Route is not loaded.
+func (s *Store) ListOwnedRouteResults(owner string, limit int) ([]RouteResultRecord, error) {
+	rows, err := s.dbR.Query(`
+SELECT id, agent, command, target, created_at, archive_key FROM route_results
+WHERE owner = ?
+ORDER BY created_at DESC
+LIMIT ?
+`, owner, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list owned route results: %w", err)
+	}
+	defer rows.Close()
+
+	records := []RouteResultRecord{}
+	for rows.Next() {
+		record := RouteResultRecord{Owner: owner}
+		var createdAt int64
+		if err := rows.Scan(&record.ID, &record.Agent, &record.Command, &record.Target, &createdAt, &record.ArchiveKey); err != nil {
+			return nil, fmt.Errorf("scan route result: %w", err)
+		}
+		record.CreatedAt = time.Unix(createdAt, 0)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
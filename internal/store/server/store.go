@@ -12,7 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/config"
 
 	_ "modernc.org/sqlite"
 )
@@ -24,7 +24,39 @@ type CommandRecord struct {
 	UsePlugin    string `json:"use_plugin"`
 	IgnoreTarget bool   `json:"ignore_target"`
 	MaximumQueue int    `json:"maxmium_queue"`
+	Weight       int    `json:"weight,omitempty"`
 	OrderIndex   int    `json:"order_index"`
+	// Usage hints shown by the web UI (see config.CommandTemplate).
+	ExampleTarget string `json:"example_target,omitempty"`
+	HelpText      string `json:"help_text,omitempty"`
+	Category      string `json:"category,omitempty"`
+	DefaultTarget string `json:"default_target,omitempty"`
+	TargetType    string `json:"target_type,omitempty"`
+	// RequiresApproval holds runs by non-admin users until an operator
+	// approves them (see config.CommandTemplate).
+	RequiresApproval bool `json:"requires_approval,omitempty"`
+	// CacheSeconds is how long the agent reuses the result of an
+	// ignore_target command (see config.CommandTemplate).
+	CacheSeconds int `json:"cache_seconds,omitempty"`
+	// How a stopped run of a shell template is stopped (see
+	// config.CommandTemplate).
+	StopSignal       string `json:"stop_signal,omitempty"`
+	StopGraceSeconds int    `json:"stop_grace_seconds,omitempty"`
+	StopProcessGroup bool   `json:"stop_process_group,omitempty"`
+	// Working directory, environment and priority of a shell template (see
+	// config.CommandTemplate).
+	WorkDir        string            `json:"work_dir,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	EnvPassthrough []string          `json:"env_passthrough,omitempty"`
+	Nice           int               `json:"nice,omitempty"`
+	IOClass        string            `json:"io_class,omitempty"`
+	IOPriority     int               `json:"io_priority,omitempty"`
+	// Container or network namespace a shell template runs in (see
+	// config.CommandTemplate).
+	Container string `json:"container,omitempty"`
+	NetNS     string `json:"netns,omitempty"`
+	// Views a client may pick from (see config.CommandTemplate).
+	Views []config.CommandView `json:"views,omitempty"`
 }
 
 // AgentRecord represents a stored agent registration and runtime config.
@@ -38,6 +70,15 @@ type AgentRecord struct {
 	CreatedAt time.Time           `json:"created_at"`
 	UpdatedAt time.Time           `json:"updated_at"`
 	SortOrder int                 `json:"sort_order"`
+	// DialAddress (host:port) makes the server dial the agent's listener
+	// instead of waiting for the agent to connect (see agent/reverse.go).
+	DialAddress string `json:"dial_address,omitempty"`
+	// DeletedAt is set on deleted agents, which are kept until purged so
+	// that they can be restored (see ListDeletedAgents).
+	DeletedAt time.Time `json:"deleted_at,omitzero"`
+	// NeverConnected marks an agent provisioned (in the control panel or
+	// from an inventory) that has not connected yet.
+	NeverConnected bool `json:"never_connected,omitempty"`
 }
 
 // AgentUpsertInput is used for create/update requests.
@@ -48,6 +89,9 @@ type AgentUpsertInput struct {
 	Group    string              `json:"group"`
 	Details  config.AgentDetails `json:"details"`
 	Commands []CommandRecord     `json:"commands"`
+	// DialAddress is AgentRecord.DialAddress; empty for agents that connect
+	// to the server.
+	DialAddress string `json:"dial_address,omitempty"`
 }
 
 // Store provides SQLite-backed persistence for control-plane data.
@@ -155,6 +199,9 @@ func (s *Store) initSchema() error {
 		`CREATE INDEX IF NOT EXISTS idx_agents_name ON agents(name);`,
 		`ALTER TABLE agents ADD COLUMN token TEXT NOT NULL DEFAULT '';`,
 		`ALTER TABLE agents ADD COLUMN sort_order INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE agents ADD COLUMN dial_address TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE agents ADD COLUMN deleted_at TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE agents ADD COLUMN never_connected INTEGER NOT NULL DEFAULT 0;`,
 		`CREATE TABLE IF NOT EXISTS runtime_settings (
 			key TEXT PRIMARY KEY,
 			value_json TEXT NOT NULL,
@@ -195,6 +242,143 @@ func (s *Store) initSchema() error {
 		`CREATE INDEX IF NOT EXISTS idx_probe_results_ts ON probe_results(ts);`,
 		`DROP INDEX IF EXISTS idx_probe_results_query;`,
 		`DROP INDEX IF EXISTS idx_probe_results_target;`,
+		// Per-bucket sums of probe results, kept long after the raw rows (see
+		// proberollup.go). latency_* cover the cycles that got answers.
+		`CREATE TABLE IF NOT EXISTS probe_rollups (
+			resolution INTEGER NOT NULL,
+			agent_name TEXT NOT NULL,
+			target_name TEXT NOT NULL,
+			ts INTEGER NOT NULL,
+			cycles INTEGER NOT NULL DEFAULT 0,
+			answered INTEGER NOT NULL DEFAULT 0,
+			sent INTEGER NOT NULL DEFAULT 0,
+			recv INTEGER NOT NULL DEFAULT 0,
+			latency_sum REAL NOT NULL DEFAULT 0,
+			latency_sq_sum REAL NOT NULL DEFAULT 0,
+			latency_max REAL,
+			PRIMARY KEY (resolution, agent_name, target_name, ts)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_probe_rollups_ts ON probe_rollups(resolution, ts);`,
+		// Roll up the results stored before the rollups existed.
+		`INSERT OR IGNORE INTO probe_rollups (resolution, agent_name, target_name, ts, cycles, answered, sent, recv, latency_sum, latency_sq_sum, latency_max)
+		SELECT t.resolution, agent_name, target_name, ts - ts % t.resolution, COUNT(*), SUM(recv > 0), SUM(sent), SUM(recv),
+			TOTAL(CASE WHEN recv > 0 THEN latency_ms END),
+			TOTAL(CASE WHEN recv > 0 THEN latency_ms * latency_ms END),
+			MAX(CASE WHEN recv > 0 THEN latency_ms END)
+		FROM probe_results, (SELECT 300 AS resolution UNION ALL SELECT 3600) AS t
+		WHERE NOT EXISTS (SELECT 1 FROM probe_rollups)
+		GROUP BY t.resolution, agent_name, target_name, ts - ts % t.resolution;`,
+		`CREATE TABLE IF NOT EXISTS client_preferences (
+			id TEXT PRIMARY KEY,
+			prefs_json TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_client_preferences_updated ON client_preferences(updated_at);`,
+		`CREATE TABLE IF NOT EXISTS execution_usage (
+			identity TEXT NOT NULL,
+			period TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (identity, period)
+		);`,
+		`CREATE TABLE IF NOT EXISTS route_results (
+			id TEXT PRIMARY KEY,
+			agent TEXT NOT NULL,
+			command TEXT NOT NULL,
+			route_json TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_route_results_created ON route_results(created_at);`,
+		`ALTER TABLE route_results ADD COLUMN archive_key TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE route_results ADD COLUMN target TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE route_results ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS idx_route_results_owner ON route_results(owner, created_at);`,
+		`ALTER TABLE route_results ADD COLUMN signature TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE route_results ADD COLUMN signing_key TEXT NOT NULL DEFAULT '';`,
+		`CREATE TABLE IF NOT EXISTS probe_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_uuid TEXT NOT NULL,
+			agent_name TEXT NOT NULL,
+			target_name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			previous REAL NOT NULL,
+			current REAL NOT NULL,
+			ts INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_probe_events_ts ON probe_events(ts);`,
+		`CREATE TABLE IF NOT EXISTS agent_catalogs (
+			uuid TEXT PRIMARY KEY,
+			pinned_hash TEXT NOT NULL,
+			served_hash TEXT NOT NULL,
+			reported_hash TEXT NOT NULL,
+			pinned_at INTEGER NOT NULL,
+			reported_at INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS execution_pauses (
+			scope TEXT NOT NULL,
+			name TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			paused_at INTEGER NOT NULL,
+			PRIMARY KEY (scope, name)
+		);`,
+		`CREATE TABLE IF NOT EXISTS execution_totals (
+			agent TEXT NOT NULL,
+			command TEXT NOT NULL,
+			executions INTEGER NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0,
+			clients INTEGER NOT NULL DEFAULT 0,
+			since INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (agent, command)
+		);`,
+		`CREATE TABLE IF NOT EXISTS execution_hourly (
+			hour INTEGER NOT NULL,
+			agent TEXT NOT NULL,
+			command TEXT NOT NULL,
+			executions INTEGER NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0,
+			clients INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (hour, agent, command)
+		);`,
+		`CREATE TABLE IF NOT EXISTS abuse_reports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			result_id TEXT NOT NULL DEFAULT '',
+			agent TEXT NOT NULL,
+			command TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL,
+			reporter_ip TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at INTEGER NOT NULL,
+			resolved_at INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_abuse_reports_status ON abuse_reports(status, reporter_ip);`,
+		`CREATE TABLE IF NOT EXISTS notes (
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL,
+			body TEXT NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (kind, name)
+		);`,
+		`CREATE TABLE IF NOT EXISTS agent_enrollments (
+			id TEXT PRIMARY KEY,
+			code_hash TEXT NOT NULL UNIQUE,
+			label TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL DEFAULT '',
+			group_name TEXT NOT NULL DEFAULT '',
+			commands_from TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'open',
+			key_hash TEXT NOT NULL DEFAULT '',
+			requested_name TEXT NOT NULL DEFAULT '',
+			hostname TEXT NOT NULL DEFAULT '',
+			remote_ip TEXT NOT NULL DEFAULT '',
+			agent_uuid TEXT NOT NULL DEFAULT '',
+			decided_by TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			requested_at INTEGER NOT NULL DEFAULT 0,
+			decided_at INTEGER NOT NULL DEFAULT 0
+		);`,
 	}
 
 	for _, stmt := range statements {
@@ -266,6 +450,7 @@ func (s *Store) UpsertAgent(input AgentUpsertInput) (*AgentRecord, error) {
 	input.Name = strings.TrimSpace(input.Name)
 	input.Group = strings.TrimSpace(input.Group)
 	input.Token = strings.TrimSpace(input.Token)
+	input.DialAddress = strings.TrimSpace(input.DialAddress)
 	if input.Name == "" {
 		return nil, errors.New("agent name is required")
 	}
@@ -309,16 +494,18 @@ func (s *Store) UpsertAgent(input AgentUpsertInput) (*AgentRecord, error) {
 	_ = s.dbR.QueryRow(`SELECT COALESCE(MAX(sort_order), 0) + 1 FROM agents`).Scan(&nextOrder)
 
 	_, err = s.dbW.Exec(`
-INSERT INTO agents (uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+INSERT INTO agents (uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order, dial_address, never_connected)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
 ON CONFLICT(uuid) DO UPDATE SET
     token = excluded.token,
     name = excluded.name,
     group_name = excluded.group_name,
     details_json = excluded.details_json,
     commands_json = excluded.commands_json,
-    updated_at = excluded.updated_at
-`, uuidValue, input.Token, input.Name, input.Group, string(detailsJSON), string(commandsJSON), createdAt.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano), nextOrder)
+    updated_at = excluded.updated_at,
+    dial_address = excluded.dial_address,
+    deleted_at = ''
+`, uuidValue, input.Token, input.Name, input.Group, string(detailsJSON), string(commandsJSON), createdAt.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano), nextOrder, input.DialAddress)
 	if err != nil {
 		return nil, fmt.Errorf("upsert agent: %w", err)
 	}
@@ -329,9 +516,9 @@ ON CONFLICT(uuid) DO UPDATE SET
 // GetAgentByUUID returns a stored agent by UUID.
 func (s *Store) GetAgentByUUID(uuid string) (*AgentRecord, error) {
 	row := s.dbR.QueryRow(`
-SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order
+SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order, dial_address, deleted_at, never_connected
 FROM agents
-WHERE uuid = ?
+WHERE uuid = ? AND deleted_at = ''
 `, strings.TrimSpace(uuid))
 
 	return scanAgent(row)
@@ -340,9 +527,9 @@ WHERE uuid = ?
 // GetAgentByName returns a stored agent by name.
 func (s *Store) GetAgentByName(name string) (*AgentRecord, error) {
 	row := s.dbR.QueryRow(`
-SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order
+SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order, dial_address, deleted_at, never_connected
 FROM agents
-WHERE name = ?
+WHERE name = ? AND deleted_at = ''
 `, strings.TrimSpace(name))
 
 	return scanAgent(row)
@@ -352,8 +539,9 @@ WHERE name = ?
 // (sort_order), falling back to group/name for ties or un-ordered rows.
 func (s *Store) ListAgents() ([]AgentRecord, error) {
 	rows, err := s.dbR.Query(`
-SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order
+SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order, dial_address, deleted_at, never_connected
 FROM agents
+WHERE deleted_at = ''
 ORDER BY sort_order ASC, group_name ASC, name ASC
 `)
 	if err != nil {
@@ -377,13 +565,14 @@ ORDER BY sort_order ASC, group_name ASC, name ASC
 	return agents, nil
 }
 
-// DeleteAgent removes an agent from persistence.
+// DeleteAgent deletes an agent, keeping it as a tombstone that RestoreAgent
+// brings back and PurgeAgent removes for good. Its catalog and history stay.
 func (s *Store) DeleteAgent(uuid string) error {
-	result, err := s.dbW.Exec(`DELETE FROM agents WHERE uuid = ?`, strings.TrimSpace(uuid))
+	result, err := s.dbW.Exec(`UPDATE agents SET deleted_at = ? WHERE uuid = ? AND deleted_at = ''`,
+		time.Now().UTC().Format(time.RFC3339Nano), strings.TrimSpace(uuid))
 	if err != nil {
 		return fmt.Errorf("delete agent: %w", err)
 	}
-
 	affected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("delete agent rows affected: %w", err)
@@ -394,10 +583,83 @@ func (s *Store) DeleteAgent(uuid string) error {
 	return nil
 }
 
+// ListDeletedAgents returns the deleted agents, most recently deleted first.
+func (s *Store) ListDeletedAgents() ([]AgentRecord, error) {
+	rows, err := s.dbR.Query(`
+SELECT uuid, token, name, group_name, details_json, commands_json, created_at, updated_at, sort_order, dial_address, deleted_at, never_connected
+FROM agents
+WHERE deleted_at != ''
+ORDER BY deleted_at DESC
+`)
+	if err != nil {
+		return nil, fmt.Errorf("list deleted agents: %w", err)
+	}
+	defer rows.Close()
+
+	var agents []AgentRecord
+	for rows.Next() {
+		agentRecord, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, *agentRecord)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate deleted agents: %w", err)
+	}
+	return agents, nil
+}
+
+// RestoreAgent brings back a deleted agent. It returns sql.ErrNoRows when no
+// deleted agent has the uuid.
+func (s *Store) RestoreAgent(uuid string) (*AgentRecord, error) {
+	result, err := s.dbW.Exec(`UPDATE agents SET deleted_at = '', updated_at = ? WHERE uuid = ? AND deleted_at != ''`,
+		time.Now().UTC().Format(time.RFC3339Nano), strings.TrimSpace(uuid))
+	if err != nil {
+		return nil, fmt.Errorf("restore agent: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("restore agent rows affected: %w", err)
+	}
+	if affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return s.GetAgentByUUID(uuid)
+}
+
+// PurgeAgent removes a deleted agent and its catalog from persistence. It
+// returns sql.ErrNoRows when no deleted agent has the uuid.
+func (s *Store) PurgeAgent(uuid string) error {
+	result, err := s.dbW.Exec(`DELETE FROM agents WHERE uuid = ? AND deleted_at != ''`, strings.TrimSpace(uuid))
+	if err != nil {
+		return fmt.Errorf("purge agent: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("purge agent rows affected: %w", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := s.dbW.Exec(`DELETE FROM agent_catalogs WHERE uuid = ?`, strings.TrimSpace(uuid)); err != nil {
+		return fmt.Errorf("purge agent catalog: %w", err)
+	}
+	return nil
+}
+
+// MarkAgentConnected records that an agent has connected at least once.
+func (s *Store) MarkAgentConnected(uuid string) error {
+	if _, err := s.dbW.Exec(`UPDATE agents SET never_connected = 0 WHERE uuid = ? AND never_connected = 1`, strings.TrimSpace(uuid)); err != nil {
+		return fmt.Errorf("mark agent connected: %w", err)
+	}
+	return nil
+}
+
 // ListAgentOrder returns agent UUIDs in the operator-defined order. It is a cheap
 // query used to order the Status page consistently with the control panel.
 func (s *Store) ListAgentOrder() ([]string, error) {
-	rows, err := s.dbR.Query(`SELECT uuid FROM agents ORDER BY sort_order ASC, group_name ASC, name ASC`)
+	rows, err := s.dbR.Query(`SELECT uuid FROM agents WHERE deleted_at = '' ORDER BY sort_order ASC, group_name ASC, name ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("list agent order: %w", err)
 	}
@@ -450,10 +712,30 @@ func BuildRuntimeConfig(host string, port int, record AgentRecord, logLevel stri
 
 	for _, cmd := range normalizeCommands(record.Commands) {
 		runtimeConfig.Commands[cmd.Name] = config.CommandTemplate{
-			Template:     cmd.Template,
-			UsePlugin:    cmd.UsePlugin,
-			IgnoreTarget: cmd.IgnoreTarget,
-			MaximumQueue: cmd.MaximumQueue,
+			Template:         cmd.Template,
+			UsePlugin:        cmd.UsePlugin,
+			IgnoreTarget:     cmd.IgnoreTarget,
+			MaximumQueue:     cmd.MaximumQueue,
+			Weight:           cmd.Weight,
+			ExampleTarget:    cmd.ExampleTarget,
+			HelpText:         cmd.HelpText,
+			Category:         cmd.Category,
+			DefaultTarget:    cmd.DefaultTarget,
+			TargetType:       cmd.TargetType,
+			RequiresApproval: cmd.RequiresApproval,
+			CacheSeconds:     cmd.CacheSeconds,
+			StopSignal:       cmd.StopSignal,
+			StopGraceSeconds: cmd.StopGraceSeconds,
+			StopProcessGroup: cmd.StopProcessGroup,
+			WorkDir:          cmd.WorkDir,
+			Env:              cmd.Env,
+			EnvPassthrough:   cmd.EnvPassthrough,
+			Nice:             cmd.Nice,
+			IOClass:          cmd.IOClass,
+			IOPriority:       cmd.IOPriority,
+			Container:        cmd.Container,
+			NetNS:            cmd.NetNS,
+			Views:            cmd.Views,
 		}
 		runtimeConfig.OrderedCommands = append(runtimeConfig.OrderedCommands, cmd.Name)
 	}
@@ -469,6 +751,23 @@ func normalizeCommands(commands []CommandRecord) []CommandRecord {
 		cmd.Name = strings.TrimSpace(cmd.Name)
 		cmd.Template = strings.TrimSpace(cmd.Template)
 		cmd.UsePlugin = strings.TrimSpace(cmd.UsePlugin)
+		cmd.ExampleTarget = strings.TrimSpace(cmd.ExampleTarget)
+		cmd.HelpText = strings.TrimSpace(cmd.HelpText)
+		cmd.Category = strings.TrimSpace(cmd.Category)
+		cmd.DefaultTarget = strings.TrimSpace(cmd.DefaultTarget)
+		cmd.TargetType = strings.ToLower(strings.TrimSpace(cmd.TargetType))
+		cmd.Container = strings.TrimSpace(cmd.Container)
+		cmd.NetNS = strings.TrimSpace(cmd.NetNS)
+		views := cmd.Views
+		cmd.Views = nil
+		for _, view := range views {
+			cmd.Views = append(cmd.Views, config.CommandView{
+				Name:  strings.TrimSpace(view.Name),
+				Label: strings.TrimSpace(view.Label),
+				Args:  strings.Join(strings.Fields(view.Args), " "),
+				VRF:   strings.TrimSpace(view.VRF),
+			})
+		}
 		if cmd.Name == "" {
 			continue
 		}
@@ -494,9 +793,10 @@ func scanAgent(scanner interface{ Scan(dest ...any) error }) (*AgentRecord, erro
 		commandsJSON string
 		createdAtRaw string
 		updatedAtRaw string
+		deletedAtRaw string
 	)
 
-	if err := scanner.Scan(&record.UUID, &record.Token, &record.Name, &record.Group, &detailsJSON, &commandsJSON, &createdAtRaw, &updatedAtRaw, &record.SortOrder); err != nil {
+	if err := scanner.Scan(&record.UUID, &record.Token, &record.Name, &record.Group, &detailsJSON, &commandsJSON, &createdAtRaw, &updatedAtRaw, &record.SortOrder, &record.DialAddress, &deletedAtRaw, &record.NeverConnected); err != nil {
 		return nil, err
 	}
 
@@ -516,6 +816,11 @@ func scanAgent(scanner interface{ Scan(dest ...any) error }) (*AgentRecord, erro
 			record.UpdatedAt = parsed
 		}
 	}
+	if deletedAtRaw != "" {
+		if parsed, err := time.Parse(time.RFC3339Nano, deletedAtRaw); err == nil {
+			record.DeletedAt = parsed
+		}
+	}
 
 	record.Commands = normalizeCommands(record.Commands)
 	return &record, nil
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExecutionTotal counts the executions of one command on one agent since
+// Since: Executions ran, Failures of them failed, and Clients were served
+// (more than Executions when identical requests shared a run).
+type ExecutionTotal struct {
+	Agent      string
+	Command    string
+	Executions int64
+	Failures   int64
+	Clients    int64
+	Since      time.Time
+}
+
+// ExecutionCount is an ExecutionTotal for the hour starting at Hour.
+type ExecutionCount struct {
+	Hour       time.Time
+	Agent      string
+	Command    string
+	Executions int64
+	Failures   int64
+	Clients    int64
+}
+
+// AddExecutionCounts adds counts to the all-time totals and to the hourly
+// history. A pair of agent and command seen for the first time starts its
+// total at now.
+func (s *Store) AddExecutionCounts(counts []ExecutionCount, now time.Time) error {
+	tx, err := s.dbW.Begin()
+	if err != nil {
+		return fmt.Errorf("begin totals transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	totals, err := tx.Prepare(`
+INSERT INTO execution_totals (agent, command, executions, failures, clients, since, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(agent, command) DO UPDATE SET
+    executions = executions + excluded.executions,
+    failures = failures + excluded.failures,
+    clients = clients + excluded.clients,
+    updated_at = excluded.updated_at
+`)
+	if err != nil {
+		return fmt.Errorf("prepare totals: %w", err)
+	}
+	defer totals.Close()
+	hourly, err := tx.Prepare(`
+INSERT INTO execution_hourly (hour, agent, command, executions, failures, clients)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(hour, agent, command) DO UPDATE SET
+    executions = executions + excluded.executions,
+    failures = failures + excluded.failures,
+    clients = clients + excluded.clients
+`)
+	if err != nil {
+		return fmt.Errorf("prepare hourly counts: %w", err)
+	}
+	defer hourly.Close()
+
+	for _, c := range counts {
+		if _, err := totals.Exec(c.Agent, c.Command, c.Executions, c.Failures, c.Clients, now.Unix(), now.Unix()); err != nil {
+			return fmt.Errorf("add totals: %w", err)
+		}
+		if _, err := hourly.Exec(c.Hour.Unix(), c.Agent, c.Command, c.Executions, c.Failures, c.Clients); err != nil {
+			return fmt.Errorf("add hourly counts: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit totals: %w", err)
+	}
+	return nil
+}
+
+// ListExecutionTotals returns the stored totals by agent and command.
+func (s *Store) ListExecutionTotals() ([]ExecutionTotal, error) {
+	rows, err := s.dbR.Query(`
+SELECT agent, command, executions, failures, clients, since
+FROM execution_totals ORDER BY agent, command`)
+	if err != nil {
+		return nil, fmt.Errorf("list execution totals: %w", err)
+	}
+	defer rows.Close()
+
+	totals := []ExecutionTotal{}
+	for rows.Next() {
+		var t ExecutionTotal
+		var since int64
+		if err := rows.Scan(&t.Agent, &t.Command, &t.Executions, &t.Failures, &t.Clients, &since); err != nil {
+			return nil, fmt.Errorf("scan execution total: %w", err)
+		}
+		t.Since = time.Unix(since, 0)
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// ExecutionHistory returns the hourly counts from since on, summed over the
+// commands of each agent (Command is empty), oldest first.
+func (s *Store) ExecutionHistory(since time.Time) ([]ExecutionCount, error) {
+	rows, err := s.dbR.Query(`
+SELECT hour, agent, SUM(executions), SUM(failures), SUM(clients)
+FROM execution_hourly WHERE hour >= ?
+GROUP BY hour, agent ORDER BY hour, agent`, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query execution history: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []ExecutionCount{}
+	for rows.Next() {
+		var c ExecutionCount
+		var hour int64
+		if err := rows.Scan(&hour, &c.Agent, &c.Executions, &c.Failures, &c.Clients); err != nil {
+			return nil, fmt.Errorf("scan execution history: %w", err)
+		}
+		c.Hour = time.Unix(hour, 0)
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// PruneExecutionHistory deletes the hourly counts of hours before cutoff.
+// The all-time totals are kept.
+func (s *Store) PruneExecutionHistory(cutoff time.Time) (int64, error) {
+	result, err := s.dbW.Exec(`DELETE FROM execution_hourly WHERE hour < ?`, cutoff.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune execution history: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConsumeExecution counts one execution for identity in the day and month
+// periods unless that would exceed a limit (0 = unlimited). It returns the
+// counts after the call and whether the execution was allowed.
+func (s *Store) ConsumeExecution(identity, day, month string, dailyLimit, monthlyLimit int64) (dayCount, monthCount int64, allowed bool, err error) {
+	tx, err := s.dbW.Begin()
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("begin usage transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	read := func(period string) (int64, error) {
+		var count int64
+		err := tx.QueryRow(`SELECT COALESCE(MAX(count), 0) FROM execution_usage WHERE identity = ? AND period = ?`, identity, period).Scan(&count)
+		return count, err
+	}
+	if dayCount, err = read(day); err != nil {
+		return 0, 0, false, fmt.Errorf("read daily usage: %w", err)
+	}
+	if monthCount, err = read(month); err != nil {
+		return 0, 0, false, fmt.Errorf("read monthly usage: %w", err)
+	}
+	if (dailyLimit > 0 && dayCount >= dailyLimit) || (monthlyLimit > 0 && monthCount >= monthlyLimit) {
+		return dayCount, monthCount, false, nil
+	}
+
+	for _, period := range []string{day, month} {
+		if _, err := tx.Exec(`
+INSERT INTO execution_usage (identity, period, count) VALUES (?, ?, 1)
+ON CONFLICT(identity, period) DO UPDATE SET count = count + 1
+`, identity, period); err != nil {
+			return 0, 0, false, fmt.Errorf("count usage: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, false, fmt.Errorf("commit usage: %w", err)
+	}
+	return dayCount + 1, monthCount + 1, true, nil
+}
+
+// RefundExecution takes back an execution ConsumeExecution counted for
+// identity in the day and month periods.
+func (s *Store) RefundExecution(identity, day, month string) error {
+	_, err := s.dbW.Exec(`UPDATE execution_usage SET count = count - 1 WHERE identity = ? AND period IN (?, ?) AND count > 0`, identity, day, month)
+	if err != nil {
+		return fmt.Errorf("refund usage: %w", err)
+	}
+	return nil
+}
+
+// ExecutionUsage returns identity's execution count in period.
+func (s *Store) ExecutionUsage(identity, period string) (int64, error) {
+	var count int64
+	err := s.dbR.QueryRow(`SELECT COALESCE(MAX(count), 0) FROM execution_usage WHERE identity = ? AND period = ?`, identity, period).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("read usage: %w", err)
+	}
+	return count, nil
+}
+
+// PruneExecutionUsage deletes the daily counts of days before cutoff's and
+// the monthly counts of months before cutoff's.
+func (s *Store) PruneExecutionUsage(cutoff time.Time) (int64, error) {
+	cutoff = cutoff.UTC()
+	result, err := s.dbW.Exec(`
+DELETE FROM execution_usage
+WHERE (length(period) = 10 AND period < ?) OR (length(period) = 7 AND period < ?)
+`, cutoff.Format("2006-01-02"), cutoff.Format("2006-01"))
+	if err != nil {
+		return 0, fmt.Errorf("prune execution usage: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -16,6 +16,9 @@
 package tls
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
 	"encoding/pem"
 	"fmt"
@@ -42,3 +45,61 @@ func BuiltinCertDER() ([]byte, error) {
 	}
 	return block.Bytes, nil
 }
+
+// ClientConfig returns the client TLS configuration used to reach a YALS server
+// at hostname. The server is trusted if its certificate is exactly the built-in
+// one, or if it passes standard CA validation (system roots) for hostname.
+func ClientConfig(hostname string) (*tls.Config, error) {
+	builtinDER, err := BuiltinCertDER()
+	if err != nil {
+		return nil, fmt.Errorf("load built-in certificate: %w", err)
+	}
+
+	return &tls.Config{
+		ServerName:         hostname,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // default chain check off; replaced by the dual check below
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			// 1) Built-in YALS self-signed certificate (direct deployment).
+			if bytes.Equal(rawCerts[0], builtinDER) {
+				return nil
+			}
+			// 2) Otherwise require a publicly-valid certificate for this host
+			//    (server behind a TLS-terminating proxy / CDN with a real cert).
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("parse server certificate: %w", err)
+			}
+			intermediates := x509.NewCertPool()
+			for _, der := range rawCerts[1:] {
+				if ic, parseErr := x509.ParseCertificate(der); parseErr == nil {
+					intermediates.AddCert(ic)
+				}
+			}
+			if _, verifyErr := leaf.Verify(x509.VerifyOptions{
+				DNSName:       hostname,
+				Intermediates: intermediates,
+			}); verifyErr != nil {
+				return fmt.Errorf("server certificate is neither the built-in YALS certificate nor a valid certificate for %q: %w", hostname, verifyErr)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// ServerConfig returns the TLS configuration that serves the built-in
+// certificate. Agents that listen for the server (see agent/reverse.go) serve
+// it too, and the server pins it when dialing them.
+func ServerConfig() (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(builtinCertPEM, builtinKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load built-in certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
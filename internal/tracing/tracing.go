@@ -0,0 +1,117 @@
+// Package tracing wires OpenTelemetry spans for the command pipeline
+// (HTTP request → manager dispatch → agent execution → streaming → completion)
+// and exports them over OTLP/HTTP. Spans go to the provider carried by the
+// context (see WithProvider) and the OpenTelemetry globals are never changed,
+// so a program embedding the server or agent keeps its own. With no endpoint
+// configured a no-op provider is used, so instrumented code costs next to
+// nothing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "YALS"
+
+// Options configures span export.
+type Options struct {
+	// Endpoint is the OTLP/HTTP collector address (host:port). Empty disables
+	// export.
+	Endpoint string
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure bool
+	// ServiceName is reported as service.name.
+	ServiceName string
+	// SampleRatio is the fraction of new traces recorded (0 < r <= 1);
+	// traces started upstream follow the caller's sampling decision (see
+	// ExtractHTTP).
+	SampleRatio float64
+}
+
+var propagator = propagation.TraceContext{}
+
+// NewProvider returns a tracer provider exporting as opts say, without
+// installing it globally. The returned function flushes and stops the
+// exporter; call it on shutdown.
+func NewProvider(opts Options) (trace.TracerProvider, func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	ratio := opts.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		res = resource.Default()
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+type providerKey struct{}
+
+// WithProvider returns ctx carrying tp, which Tracer records the spans of ctx
+// and the contexts derived from it with.
+func WithProvider(ctx context.Context, tp trace.TracerProvider) context.Context {
+	return context.WithValue(ctx, providerKey{}, tp)
+}
+
+// Tracer returns the YALS tracer of the provider ctx carries, or of the global
+// provider when it carries none.
+func Tracer(ctx context.Context) trace.Tracer {
+	if tp, ok := ctx.Value(providerKey{}).(trace.TracerProvider); ok {
+		return tp.Tracer(instrumentationName)
+	}
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject returns the W3C traceparent of the span in ctx, for carrying it to an
+// agent inside a CommandMessage. It is empty when ctx holds no valid span
+// context; an unsampled one is carried with its sampled flag clear, so the
+// agent does not record it either.
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns ctx with the remote span described by traceparent as parent.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// ExtractHTTP returns ctx with any trace context in the request headers. The
+// sampler follows its sampled flag, so only call it for headers set by a
+// trusted party.
+func ExtractHTTP(ctx context.Context, header propagation.HeaderCarrier) context.Context {
+	return propagator.Extract(ctx, header)
+}
@@ -0,0 +1,94 @@
+package validator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// The input policy bounds every raw target before its type validator runs.
+// The server applies the configured policy and pushes it to agents with their
+// runtime config, and each agent checks again before running a command.
+const (
+	// DefaultMaxTargetLength applies when no limit is configured.
+	DefaultMaxTargetLength = 256
+	// MaxTargetLength is the ceiling for a configured limit; an agent never
+	// accepts longer targets whatever the server pushes.
+	MaxTargetLength = 1024
+)
+
+// Target character sets.
+const (
+	// CharsetUnicode allows letters of any script, for internationalized
+	// domains and URL paths.
+	CharsetUnicode = "unicode"
+	// CharsetASCII allows ASCII only: internationalized domains must be typed
+	// in punycode.
+	CharsetASCII = "ascii"
+)
+
+// Both character sets hold letters, digits and the punctuation of addresses,
+// prefixes and URLs. Whitespace, control characters and anything a shell
+// would interpret (& ; | $ ` quotes, parentheses, < >) are never allowed,
+// since templates may run through sh.
+var (
+	unicodeTargetChars = regexp.MustCompile(`^[\p{L}\p{M}\p{N}\-._~:/?=%\[\]]+$`)
+	asciiTargetChars   = regexp.MustCompile(`^[A-Za-z0-9\-._~:/?=%\[\]]+$`)
+)
+
+// Policy is the target input policy.
+type Policy struct {
+	MaxLength int    `json:"max_target_length"`
+	Charset   string `json:"target_charset"`
+}
+
+var policy atomic.Pointer[Policy]
+
+// NewPolicy builds a policy from configured values: a length of 0 means
+// DefaultMaxTargetLength, larger values are capped at MaxTargetLength, and
+// an unknown character set means CharsetUnicode.
+func NewPolicy(maxLength int, charset string) Policy {
+	p := Policy{MaxLength: maxLength, Charset: strings.ToLower(strings.TrimSpace(charset))}
+	if p.MaxLength <= 0 {
+		p.MaxLength = DefaultMaxTargetLength
+	}
+	p.MaxLength = min(p.MaxLength, MaxTargetLength)
+	if p.Charset != CharsetASCII {
+		p.Charset = CharsetUnicode
+	}
+	return p
+}
+
+// SetPolicy replaces the process-wide input policy.
+func SetPolicy(p Policy) {
+	p = NewPolicy(p.MaxLength, p.Charset)
+	policy.Store(&p)
+}
+
+// CurrentPolicy returns the process-wide input policy.
+func CurrentPolicy() Policy {
+	if p := policy.Load(); p != nil {
+		return *p
+	}
+	return NewPolicy(0, "")
+}
+
+// Check applies the policy to a trimmed target. Length is counted in
+// characters, so a Unicode domain is not penalized for its encoding.
+func (p Policy) Check(input string) error {
+	if n := utf8.RuneCountInString(input); n > p.MaxLength {
+		return &InputError{Field: "target", Code: CodeTooLong, Limit: p.MaxLength,
+			Reason: fmt.Sprintf("must not exceed %d characters", p.MaxLength)}
+	}
+	chars, allowed := unicodeTargetChars, "letters, digits and - . _ ~ : / ? = % [ ]"
+	if p.Charset == CharsetASCII {
+		chars, allowed = asciiTargetChars, "ASCII letters, digits and - . _ ~ : / ? = % [ ]"
+	}
+	if !chars.MatchString(input) {
+		return &InputError{Field: "target", Code: CodeInvalidCharacters,
+			Reason: "may only contain " + allowed}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package validator
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/idna"
+)
+
+// TargetType names the validator a command's target goes through. Commands
+// declare it with target_type; an empty value means TargetHost. A comma
+// separated list ("url,host_port") accepts any of the listed forms.
+type TargetType string
+
+const (
+	// TargetHost is a bare IP address or domain name.
+	TargetHost TargetType = "host"
+	// TargetHostPort is an IP address or domain name with an optional port:
+	// example.com:8443, [2001:db8::1]:443.
+	TargetHostPort TargetType = "host_port"
+	// TargetIP is a bare IPv4 or IPv6 address.
+	TargetIP TargetType = "ip"
+	// TargetDomain is a bare domain name.
+	TargetDomain TargetType = "domain"
+	// TargetASN is an AS number, written 13335 or AS13335.
+	TargetASN TargetType = "asn"
+	// TargetPrefix is an IP prefix (192.0.2.0/24) or a single address.
+	TargetPrefix TargetType = "prefix"
+	// TargetURL is an http or https URL.
+	TargetURL TargetType = "url"
+	// TargetPort is a TCP/UDP port number.
+	TargetPort TargetType = "port"
+	// TargetNone takes no target; whatever the client sent is dropped.
+	TargetNone TargetType = "none"
+)
+
+// Target is a validated target.
+type Target struct {
+	Type TargetType `json:"type"`
+	// Value is the normalized target handed to the agent.
+	Value string `json:"value"`
+	// Host and Port are set when the target names a host: the address or
+	// domain, and the port if one was given.
+	Host string `json:"host,omitempty"`
+	Port string `json:"port,omitempty"`
+	// Family is 4 or 6 when Host (or the prefix) is an IP address.
+	Family int `json:"family,omitempty"`
+	// Domain is the ASCII (punycode) form of Host when it is a name.
+	Domain string `json:"domain,omitempty"`
+	// Unicode is the display form of an internationalized Domain
+	// (例え.jp for xn--r8jz45g.jp), whichever form the input used.
+	Unicode string `json:"unicode,omitempty"`
+}
+
+// Input error codes, returned to clients as "reason" next to the field.
+const (
+	CodeRequired          = "required"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeInvalid           = "invalid"
+)
+
+// InputError reports why a request field (the target, or an option such as
+// ip_version) was rejected. Limit is set for CodeTooLong.
+type InputError struct {
+	Field  string
+	Code   string
+	Limit  int
+	Reason string
+}
+
+func (e *InputError) Error() string {
+	return e.Reason
+}
+
+// Resolvable reports whether the target is a domain, optionally with a port,
+// that the agent may replace with one of its addresses. URLs are passed as
+// typed: the name matters for the Host header and TLS.
+func (t Target) Resolvable() bool {
+	return t.Domain != "" && (t.Type == TargetHost || t.Type == TargetHostPort || t.Type == TargetDomain)
+}
+
+// Func validates trimmed, non-empty input for one target type.
+type Func func(input string) (Target, error)
+
+type registeredType struct {
+	// accepts describes valid input, e.g. "an IP address or domain name".
+	accepts string
+	fn      Func
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[TargetType]registeredType{
+		TargetHost:     {"an IP address or domain name", validateHost},
+		TargetHostPort: {"an IP address or domain name with an optional port", validateHostPort},
+		TargetIP:       {"an IP address", validateIP},
+		TargetDomain:   {"a domain name", validateDomain},
+		TargetASN:      {"an AS number", validateASN},
+		TargetPrefix:   {"an IP prefix or address", validatePrefix},
+		TargetURL:      {"an http or https URL", validateURL},
+		TargetPort:     {"a port number", validatePort},
+	}
+)
+
+// Register adds or replaces the validator for a target type. accepts
+// describes valid input for error messages, e.g. "an AS number".
+func Register(targetType TargetType, accepts string, fn Func) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[targetType] = registeredType{accepts: accepts, fn: fn}
+}
+
+// targetForms splits a target type into the forms it accepts: "url,host_port"
+// takes a URL or a host with an optional port, tried in that order.
+func targetForms(targetType TargetType) []TargetType {
+	var forms []TargetType
+	for _, form := range strings.Split(string(targetType), ",") {
+		if form = strings.ToLower(strings.TrimSpace(form)); form != "" {
+			forms = append(forms, TargetType(form))
+		}
+	}
+	return forms
+}
+
+// KnownTargetType reports whether name is empty (the default), none, or a
+// list of registered target types.
+func KnownTargetType(name string) bool {
+	forms := targetForms(TargetType(name))
+	if len(forms) == 0 || (len(forms) == 1 && forms[0] == TargetNone) {
+		return true
+	}
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	for _, form := range forms {
+		if _, ok := registry[form]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CommandTargetType selects a command's target type from its metadata.
+func CommandTargetType(targetType string, ignoreTarget bool) TargetType {
+	if ignoreTarget {
+		return TargetNone
+	}
+	forms := targetForms(TargetType(targetType))
+	if len(forms) == 0 {
+		return TargetHost
+	}
+	parts := make([]string, len(forms))
+	for i, form := range forms {
+		parts[i] = string(form)
+	}
+	return TargetType(strings.Join(parts, ","))
+}
+
+// Validate checks input against the validator for targetType. A list of forms
+// takes the first that accepts the input; the result's Type is that form.
+func Validate(targetType TargetType, input string) (Target, error) {
+	if targetType == TargetNone {
+		return Target{Type: TargetNone}, nil
+	}
+	forms := targetForms(targetType)
+	entries := make([]registeredType, len(forms))
+	registryLock.RLock()
+	for i, form := range forms {
+		entry, ok := registry[form]
+		if !ok {
+			registryLock.RUnlock()
+			return Target{}, invalid(fmt.Sprintf("unknown target type %q", form))
+		}
+		entries[i] = entry
+	}
+	registryLock.RUnlock()
+	if len(entries) == 0 {
+		return Target{}, invalid("unknown target type")
+	}
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return Target{}, &InputError{Field: "target", Code: CodeRequired, Reason: "target is required"}
+	}
+	if err := CurrentPolicy().Check(input); err != nil {
+		return Target{}, err
+	}
+
+	var firstErr error
+	accepts := make([]string, len(entries))
+	for i, entry := range entries {
+		target, err := entry.fn(input)
+		if err == nil {
+			target.Type = forms[i]
+			return target, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		accepts[i] = entry.accepts
+	}
+	if len(entries) == 1 {
+		return Target{}, firstErr
+	}
+	return Target{}, invalid("must be " + strings.Join(accepts, " or "))
+}
+
+func invalid(reason string) error {
+	return &InputError{Field: "target", Code: CodeInvalid, Reason: reason}
+}
+
+// hostTarget classifies host as an IP address or a domain name. Domain
+// names are converted to their ASCII form, so internationalized names reach
+// the agent and the blocklist as punycode.
+func hostTarget(host string) (Target, bool) {
+	if ip := net.ParseIP(host); ip != nil {
+		target := Target{Host: ip.String(), Family: 6}
+		if ip.To4() != nil {
+			target.Family = 4
+		}
+		return target, true
+	}
+	name, err := idna.Lookup.ToASCII(host)
+	if err != nil || !isValidDomain(name) {
+		return Target{}, false
+	}
+	target := Target{Host: name, Domain: name}
+	if display, err := idna.Display.ToUnicode(name); err == nil && display != name {
+		target.Unicode = display
+	}
+	return target, true
+}
+
+// joinHostPort is net.JoinHostPort, leaving out an empty port.
+func joinHostPort(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func validateHost(input string) (Target, error) {
+	target, ok := hostTarget(input)
+	if !ok {
+		if host, port := extractHostPort(input); port != "" {
+			if _, ok := hostTarget(host); ok {
+				return Target{}, invalid("a port is not accepted by this command")
+			}
+		}
+		return Target{}, invalid("must be an IP address or domain name")
+	}
+	target.Value = target.Host
+	return target, nil
+}
+
+// validateHostPort splits host and port safely: IPv6 addresses with a port
+// must be bracketed, and the port must be a number from 1 to 65535.
+func validateHostPort(input string) (Target, error) {
+	host, port := extractHostPort(input)
+	target, ok := hostTarget(host)
+	if !ok {
+		return Target{}, invalid("must be an IP address or domain name, optionally with a port")
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return Target{}, invalid("port must be between 1 and 65535")
+		}
+		target.Port = strconv.Itoa(n)
+	}
+	target.Value = joinHostPort(target.Host, target.Port)
+	return target, nil
+}
+
+func validateIP(input string) (Target, error) {
+	target, ok := hostTarget(input)
+	if !ok || target.Family == 0 {
+		return Target{}, invalid("must be an IP address")
+	}
+	target.Value = target.Host
+	return target, nil
+}
+
+func validateDomain(input string) (Target, error) {
+	target, ok := hostTarget(input)
+	if !ok || target.Domain == "" {
+		return Target{}, invalid("must be a domain name")
+	}
+	target.Value = target.Host
+	return target, nil
+}
+
+func validateASN(input string) (Target, error) {
+	digits := input
+	if len(digits) > 2 && strings.EqualFold(digits[:2], "AS") {
+		digits = digits[2:]
+	}
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || n == 0 {
+		return Target{}, invalid("must be an AS number such as AS13335")
+	}
+	return Target{Value: "AS" + strconv.FormatUint(n, 10)}, nil
+}
+
+func validatePrefix(input string) (Target, error) {
+	if !strings.Contains(input, "/") {
+		target, err := validateIP(input)
+		if err != nil {
+			return Target{}, invalid("must be an IP prefix or address")
+		}
+		return target, nil
+	}
+	prefix, err := netip.ParsePrefix(input)
+	if err != nil {
+		return Target{}, invalid("must be an IP prefix or address")
+	}
+	prefix = prefix.Masked()
+	target := Target{Value: prefix.String(), Host: prefix.Addr().String(), Family: 6}
+	if prefix.Addr().Is4() {
+		target.Family = 4
+	}
+	return target, nil
+}
+
+func validateURL(input string) (Target, error) {
+	// The character policy (see Policy) has already refused anything a shell
+	// would interpret, including & and ; in query strings.
+	u, err := url.Parse(input)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || u.Opaque != "" {
+		return Target{}, invalid("must be an http or https URL")
+	}
+	target, ok := hostTarget(u.Hostname())
+	if !ok {
+		return Target{}, invalid("URL host must be an IP address or domain name")
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return Target{}, invalid("port must be between 1 and 65535")
+		}
+		target.Port = strconv.Itoa(n)
+	}
+	u.Host = target.Host
+	if target.Family == 6 {
+		u.Host = "[" + target.Host + "]"
+	}
+	if target.Port != "" {
+		u.Host += ":" + target.Port
+	}
+	target.Value = u.String()
+	return target, nil
+}
+
+func validatePort(input string) (Target, error) {
+	n, err := strconv.Atoi(input)
+	if err != nil || n < 1 || n > 65535 {
+		return Target{}, invalid("must be a port between 1 and 65535")
+	}
+	port := strconv.Itoa(n)
+	return Target{Value: port, Port: port}, nil
+}
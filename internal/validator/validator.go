@@ -1,12 +1,13 @@
 package validator
 
 import (
-	"YALS/internal/dns"
 	"context"
 	"net"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/dns"
 )
 
 // IPVersion type alias for DNS IP version
@@ -18,66 +19,46 @@ const (
 	IPVersionIPv6 = dns.IPVersionIPv6
 )
 
-// CommandDetail represents a command with its description
+// CommandDetail is the client-facing description of an agent's command.
+// IgnoreTarget, TargetType and MaximumQueue are the effective values, with a
+// plugin's overrides applied.
 type CommandDetail struct {
 	Name         string `json:"name"`
 	Description  string `json:"description"`
 	IgnoreTarget bool   `json:"ignore_target"` // Whether target parameter is ignored
+	// TargetType is the target the command accepts (see TargetType); "none"
+	// when it takes no target.
+	TargetType string `json:"target_type"`
+	// MaximumQueue is how many runs of the command the agent takes at once
+	// (0 = unlimited).
+	MaximumQueue int `json:"maximum_queue"`
+	// Available is false when the agent reported the command's binary
+	// missing; Unavailable and UnavailableReason say so and why.
+	Available         bool   `json:"available"`
+	Unavailable       bool   `json:"unavailable,omitempty"`
+	UnavailableReason string `json:"unavailable_reason,omitempty"`
+	// Usage hints for the UI: a sample target, an inline help line, and the
+	// group the command is listed under.
+	ExampleTarget string `json:"example_target,omitempty"`
+	HelpText      string `json:"help_text,omitempty"`
+	Category      string `json:"category,omitempty"`
+	// DefaultTarget is used when the client omits the target.
+	DefaultTarget string `json:"default_target,omitempty"`
+	// Weight is the command's share of the agent's weight budget; the UI asks
+	// for confirmation before running heavy commands.
+	Weight int `json:"weight,omitempty"`
+	// RequiresApproval is set when runs by non-admin users wait for an
+	// operator to approve them.
+	RequiresApproval bool `json:"requires_approval,omitempty"`
+	// Views are the views a client may run the command from, by name.
+	Views []ViewOption `json:"views,omitempty"`
 }
 
-// InputType represents the type of input
-type InputType int
-
-const (
-	// InvalidInput represents an invalid input
-	InvalidInput InputType = iota
-	// IPAddress represents an IP address
-	IPAddress
-	// Domain represents a domain name
-	Domain
-)
-
-// ValidateInput validates the input and returns its type
-func ValidateInput(input string) InputType {
-
-	// Check if input length exceeds 256 characters
-	if len(input) > 256 {
-		return InvalidInput
-	}
-
-	// Trim whitespace
-	input = strings.TrimSpace(input)
-
-	// Check if input is empty
-	if input == "" {
-		return InvalidInput
-	}
-
-	// Extract host and port
-	host, port := extractHostPort(input)
-	if host == "" {
-		return InvalidInput
-	}
-
-	// Validate port if present
-	if port != "" {
-		matched, err := regexp.MatchString(`^\d+$`, port)
-		if err != nil || !matched {
-			return InvalidInput
-		}
-	}
-
-	// Check if host is an IP address (IPv4 or IPv6)
-	if net.ParseIP(host) != nil {
-		return IPAddress
-	}
-
-	// Check if host is a valid domain name
-	if isValidDomain(host) {
-		return Domain
-	}
-
-	return InvalidInput
+// ViewOption is a view of a command as clients see it: its name and label,
+// but not how the agent runs it.
+type ViewOption struct {
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"`
 }
 
 // ResolveDomain resolves a domain name to IP addresses using the DNS resolver
@@ -150,29 +131,9 @@ func extractHostPort(input string) (host, port string) {
 func isValidDomain(domain string) bool {
 	// Domain name validation regex
 	// This is a simplified version, real domain validation is more complex
-	pattern := `^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,}$`
+	// The top-level label is alphabetic, or punycode for an IDN TLD (xn--p1ai).
+	pattern := `^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)+([a-zA-Z]{2,}|xn--[a-zA-Z0-9\-]{1,59})$`
 
 	matched, err := regexp.MatchString(pattern, domain)
 	return err == nil && matched
 }
-
-// SanitizeCommand ensures the command is safe to execute
-func SanitizeCommand(command, target string, allowedCommands []string) (string, bool) {
-	// Check if command is allowed
-	if !contains(allowedCommands, command) {
-		return "", false
-	}
-
-	// Return the command name and target separately for the new architecture
-	return command + " " + target, true
-}
-
-// contains checks if a slice contains a specific string
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
-			return true
-		}
-	}
-	return false
-}
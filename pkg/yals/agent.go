@@ -0,0 +1,324 @@
+package yals
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/internal/proto"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AgentOptions configures NewAgentClient. Host, UUID and Token come from the
+// server's control panel, or UUID and Token from enrolling with an
+// EnrollCode; everything else (name, group, commands) is pushed by the server
+// at handshake.
+type AgentOptions struct {
+	Host  string
+	Port  int // default 443
+	UUID  string
+	Token string
+	// CredentialsFile keeps the UUID and token of an enrolled agent. Without
+	// UUID and Token, the agent uses those it holds.
+	CredentialsFile string
+	// EnrollCode, when the agent has no UUID and token yet, is exchanged
+	// for them with the server (see config.Config.Enrollment), which may
+	// wait for an operator. EnrollName is the name the agent asks for,
+	// by default its host name. Enrolling needs a CredentialsFile.
+	EnrollCode string
+	EnrollName string
+	// AutoDetect registers default commands for tools installed on this host.
+	AutoDetect bool
+	// OTLPEndpoint, when set, exports execution spans to this OTLP/HTTP
+	// collector (host:port); OTLPInsecure sends them over plain HTTP.
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// TracerProvider, when set, records the execution spans instead, and
+	// OTLPEndpoint is ignored. The OpenTelemetry globals are left alone
+	// either way.
+	TracerProvider trace.TracerProvider
+	// MaxPerMinute and MaxConcurrent cap the commands this agent starts per
+	// minute and runs at once, whatever the server sends (0 = unlimited).
+	MaxPerMinute  int
+	MaxConcurrent int
+	// Listen (e.g. ":9443") makes the agent wait for the server to dial it
+	// there instead of connecting to Host, for networks where the agent
+	// cannot open connections. The server needs the agent's dial address.
+	Listen string
+	// SSHTunnel, with a Host, makes the agent reach the server through an
+	// SSH jump host.
+	SSHTunnel config.SSHTunnelConfig
+	// Connection tunes keepalives, timeouts, message and buffer sizes and
+	// output compression of the connection to the server; zero fields take
+	// the defaults.
+	Connection config.AgentConnectionConfig
+	// Standby lists warm standby servers ("host" or "host:port", Port by
+	// default), tried in order when Host cannot be reached. While on a
+	// standby, the agent checks Host every FailbackInterval (default 30s)
+	// and returns to it once it is healthy again.
+	Standby          []string
+	FailbackInterval time.Duration
+}
+
+const (
+	// failoverAttempts is how many connections in a row must fail before
+	// the agent moves on to the next server.
+	failoverAttempts = 2
+	// failbackChecks is how many health checks in a row the primary must
+	// pass before the agent returns to it.
+	failbackChecks          = 3
+	defaultFailbackInterval = 30 * time.Second
+)
+
+// AgentClient is a YALS agent: it keeps a connection to the server and runs
+// the commands the server dispatches.
+type AgentClient struct {
+	client          *agent.Client
+	listen          string
+	tracerProvider  trace.TracerProvider
+	shutdownTracing func(context.Context) error
+
+	// servers are the primary server and the standbys, in order.
+	servers          []agent.ServerEndpoint
+	failbackInterval time.Duration
+
+	// enroll is set until the agent enrolled.
+	enroll *enrollment
+}
+
+// enrollment is an agent's pending enrollment (see AgentOptions.EnrollCode).
+type enrollment struct {
+	code            string
+	name            string
+	credentialsFile string
+}
+
+// NewAgentClient validates opts and prepares an agent. Call Run to connect.
+func NewAgentClient(opts AgentOptions) (*AgentClient, error) {
+	if opts.Port == 0 {
+		opts.Port = 443
+	}
+	if opts.Listen == "" && (opts.Host == "" || opts.Port < 0) {
+		return nil, errors.New("agent needs a server host and port, or a listen address")
+	}
+	var enroll *enrollment
+	if (opts.UUID == "" || opts.Token == "") && opts.CredentialsFile != "" {
+		creds, err := config.LoadAgentCredentials(opts.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.UUID, opts.Token = creds.UUID, creds.Token
+	}
+	if opts.UUID == "" || opts.Token == "" {
+		switch {
+		case opts.EnrollCode == "":
+			return nil, errors.New("agent needs a UUID and token, or an enrollment code")
+		case opts.CredentialsFile == "":
+			return nil, errors.New("enrolling needs a credentials file to keep the issued token in")
+		case opts.Listen != "":
+			return nil, errors.New("an agent that listens for the server cannot enroll")
+		}
+		enroll = &enrollment{code: opts.EnrollCode, name: opts.EnrollName, credentialsFile: opts.CredentialsFile}
+	}
+	if opts.Listen != "" && opts.SSHTunnel.Host != "" {
+		return nil, errors.New("an agent that listens for the server cannot use an SSH tunnel")
+	}
+	servers := []agent.ServerEndpoint{{Host: opts.Host, Port: opts.Port}}
+	for _, standby := range opts.Standby {
+		if opts.Listen != "" {
+			return nil, errors.New("an agent that listens for the server cannot have standby servers")
+		}
+		e, err := agent.ParseServerEndpoint(standby, opts.Port)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, e)
+	}
+	if opts.FailbackInterval <= 0 {
+		opts.FailbackInterval = defaultFailbackInterval
+	}
+	switch strings.ToLower(strings.TrimSpace(opts.Connection.Compression)) {
+	case "", proto.CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unknown compression %q (want zstd)", opts.Connection.Compression)
+	}
+
+	tracerProvider, shutdownTracing := opts.TracerProvider, func(context.Context) error { return nil }
+	if tracerProvider == nil {
+		var err error
+		tracerProvider, shutdownTracing, err = tracing.NewProvider(tracing.Options{
+			Endpoint:    opts.OTLPEndpoint,
+			Insecure:    opts.OTLPInsecure,
+			ServiceName: "yals-agent",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	agentConfig := &config.AgentConfig{}
+	agentConfig.Server.Host = opts.Host
+	agentConfig.Server.Port = opts.Port
+	agentConfig.Server.UUID = opts.UUID
+	agentConfig.Server.Token = opts.Token
+	agentConfig.Agent.AutoDetect = opts.AutoDetect
+	agentConfig.Agent.MaxPerMinute = opts.MaxPerMinute
+	agentConfig.Agent.MaxConcurrent = opts.MaxConcurrent
+	agentConfig.Server.Connection = opts.Connection
+	agentConfig.Log.LogLevel = "info"
+
+	client := agent.NewClientWithConfig(agentConfig)
+	if err := client.UseSSHTunnel(opts.SSHTunnel); err != nil {
+		shutdownTracing(context.Background())
+		return nil, err
+	}
+	return &AgentClient{
+		client:           client,
+		listen:           opts.Listen,
+		tracerProvider:   tracerProvider,
+		shutdownTracing:  shutdownTracing,
+		servers:          servers,
+		failbackInterval: opts.FailbackInterval,
+		enroll:           enroll,
+	}, nil
+}
+
+// Run connects to the server and reconnects after failures until ctx is
+// cancelled, or with a listen address, serves the server's connections until
+// then. An agent with an enrollment code enrolls first. With standby servers,
+// it moves on to the next server after failoverAttempts failed connections,
+// and from a standby back to the primary once that passes failbackChecks
+// health checks while no command runs. It returns ctx.Err(), or why the
+// agent could not listen or enroll.
+func (a *AgentClient) Run(ctx context.Context) error {
+	defer a.shutdownTracing(context.Background())
+	ctx = tracing.WithProvider(ctx, a.tracerProvider)
+	if a.enroll != nil {
+		if err := a.enrollAgent(ctx); err != nil {
+			return err
+		}
+	}
+	if a.listen != "" {
+		return a.client.ListenForServer(ctx, a.listen)
+	}
+	current, failures := 0, 0
+	for {
+		connCtx, failBack := ctx, context.CancelFunc(func() {})
+		if current > 0 {
+			connCtx, failBack = context.WithCancel(ctx)
+			go a.watchPrimary(connCtx, failBack)
+		}
+		a.client.UseServer(a.servers[current])
+		err := a.client.ConnectToServerContext(connCtx)
+		failedBack := connCtx.Err() != nil
+		failBack()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if failedBack {
+			logger.Infof("Failing back to the primary server %s", a.servers[0])
+			current, failures = 0, 0
+			continue
+		}
+		retry := 5 * time.Second
+		if err != nil {
+			logger.Errorf("Connection failed: %v", err)
+			failures++
+			if len(a.servers) > 1 && failures >= failoverAttempts {
+				current, failures = (current+1)%len(a.servers), 0
+				logger.Warnf("Failing over to server %s", a.servers[current])
+				continue
+			}
+			logger.Info("Retrying in 10 seconds...")
+			retry = 10 * time.Second
+		} else {
+			failures = 0
+			logger.Info("Connection closed, retrying in 5 seconds...")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// watchPrimary health-checks the primary server while the agent is connected
+// to a standby, and calls failBack once the primary passed failbackChecks
+// checks in a row and no command runs, so that none is cut off.
+func (a *AgentClient) watchPrimary(ctx context.Context, failBack context.CancelFunc) {
+	ticker := time.NewTicker(a.failbackInterval)
+	defer ticker.Stop()
+	healthy := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.client.CheckServer(ctx, a.servers[0]); err != nil {
+			if healthy > 0 {
+				logger.Infof("Primary server %s failed its health check: %v", a.servers[0], err)
+			}
+			healthy = 0
+			continue
+		}
+		healthy++
+		if healthy >= failbackChecks && a.client.ActiveCommandCount() == 0 {
+			logger.Infof("Primary server %s is healthy again", a.servers[0])
+			failBack()
+			return
+		}
+	}
+}
+
+// enrollAgent exchanges the enrollment code for the agent's UUID and token
+// and saves them to the credentials file. The key the code is bound to is
+// saved first, so that a restarted agent can still pick up its token.
+func (a *AgentClient) enrollAgent(ctx context.Context) error {
+	e := a.enroll
+	creds, err := config.LoadAgentCredentials(e.credentialsFile)
+	if err != nil {
+		return err
+	}
+	if creds.EnrollKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("generate enrollment key: %w", err)
+		}
+		creds.EnrollKey = hex.EncodeToString(key)
+		if err := config.SaveAgentCredentials(e.credentialsFile, *creds); err != nil {
+			return err
+		}
+	}
+	hostname, _ := os.Hostname()
+	logger.Infof("Enrolling with the server as %q", cmp.Or(e.name, hostname))
+
+	resp, err := a.client.Enroll(ctx, &proto.EnrollRequest{Code: e.code, Key: creds.EnrollKey, Name: e.name, Hostname: hostname})
+	if err != nil {
+		return err
+	}
+	if err := config.SaveAgentCredentials(e.credentialsFile, config.AgentCredentials{UUID: resp.UUID, Token: resp.Token}); err != nil {
+		return fmt.Errorf("enrolled as %s but could not save the token: %w", resp.UUID, err)
+	}
+	a.client.SetIdentity(resp.UUID, resp.Token)
+	a.enroll = nil
+	logger.Infof("%s; UUID %s, credentials saved to %s", resp.Message, resp.UUID, e.credentialsFile)
+	return nil
+}
+
+// ActiveCommands returns how many commands the agent is running.
+func (a *AgentClient) ActiveCommands() int {
+	return a.client.ActiveCommandCount()
+}
@@ -0,0 +1,366 @@
+// Package yals embeds a YALS looking-glass server or agent in another Go
+// program. cmd/server and cmd/agent are thin wrappers around it.
+//
+//	srv, err := yals.NewServer(yals.ServerOptions{ConfigPath: "config.yaml"})
+//	if err != nil { ... }
+//	go srv.ListenAndServe()
+//	...
+//	srv.Shutdown(ctx)
+package yals
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/agent"
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/handler"
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/internal/tracing"
+
+	// Register agent plugin metadata so the control API can enumerate plugins and
+	// server-side target validation can see each plugin's ignore_target /
+	// maximum_queue overrides. Plugins only execute on agents; this import only
+	// registers their metadata, it does not run them.
+	_ "github.com/TogawaSakiko363/YALS/internal/plugin/agent"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// ServerConfig is the server's YAML bootstrap configuration.
+type ServerConfig = config.Config
+
+// LoadServerConfig reads a server configuration file.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	return config.LoadConfig(path)
+}
+
+// SetLogLevel sets the process-wide log level (debug, info, warn, error).
+func SetLogLevel(level string) {
+	logger.SetGlobalLevelFromString(level)
+}
+
+// ServerOptions configures NewServer.
+type ServerOptions struct {
+	// Config is the server configuration. When nil it is loaded from
+	// ConfigPath.
+	Config *ServerConfig
+	// ConfigPath is the YAML configuration file (default "config.yaml").
+	ConfigPath string
+	// ConfigDir holds targets.yaml and relative security list paths. It
+	// defaults to the directory of ConfigPath.
+	ConfigDir string
+	// WebDir is the built web frontend (default "./web").
+	WebDir string
+	// TracerProvider records the server's spans. When nil, the server
+	// exports them as the tracing section of Config says, through a
+	// provider of its own. The OpenTelemetry globals are left alone either
+	// way.
+	TracerProvider trace.TracerProvider
+}
+
+// Server is a YALS server: the looking-glass web UI and API plus the gRPC
+// endpoint agents connect to, on one HTTPS listener.
+type Server struct {
+	cfg             *ServerConfig
+	store           *serverstore.Store
+	handler         *handler.Handler
+	grpcServer      *grpc.Server
+	httpServer      *http.Server
+	cancelBase      context.CancelFunc
+	shutdownTracing func(context.Context) error
+}
+
+// NewServer opens the database and wires the server. It does not listen yet;
+// call ListenAndServe, or mount Handler on your own server.
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.ConfigPath == "" {
+		opts.ConfigPath = "config.yaml"
+	}
+	if opts.ConfigDir == "" {
+		opts.ConfigDir = filepath.Dir(opts.ConfigPath)
+	}
+	if opts.WebDir == "" {
+		opts.WebDir = "./web"
+	}
+
+	cfg := opts.Config
+	if cfg == nil {
+		loaded, err := config.LoadConfig(opts.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg = loaded
+	}
+
+	store, err := serverstore.NewStore(cfg.Database.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize SQLite store: %w", err)
+	}
+
+	runtimeSettings, err := store.EnsureRuntimeSettings(cfg.DefaultRuntimeSettings())
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to initialize runtime settings: %w", err)
+	}
+
+	// Without a frontend build the handler serves a built-in page instead
+	// (see handler/fallback.go) and warns about it.
+	if _, err := os.Stat(opts.WebDir); err == nil {
+		logger.Infof("Using web directory: %s", opts.WebDir)
+	}
+
+	tracerProvider, shutdownTracing := opts.TracerProvider, func(context.Context) error { return nil }
+	if tracerProvider == nil {
+		serviceName := cfg.Tracing.ServiceName
+		if serviceName == "" {
+			serviceName = "yals-server"
+		}
+		tracerProvider, shutdownTracing, err = tracing.NewProvider(tracing.Options{
+			Endpoint:    cfg.Tracing.Endpoint,
+			Insecure:    cfg.Tracing.Insecure,
+			ServiceName: serviceName,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("failed to initialize tracing: %w", err)
+		}
+		if cfg.Tracing.Endpoint != "" {
+			logger.Infof("Exporting traces to %s", cfg.Tracing.Endpoint)
+		}
+	}
+
+	// Every request context and background loop derives from baseCtx, so
+	// cancelling it on shutdown stops running commands on their agents, ends
+	// open streams and stops the handler's periodic work. It carries the
+	// tracer provider its spans are recorded with.
+	baseCtx, cancelBase := context.WithCancel(tracing.WithProvider(context.Background(), tracerProvider))
+
+	agentManager := agent.NewManager(baseCtx)
+	agentManager.SetVisibility(agent.Visibility{
+		HiddenCommands: cfg.Visibility.HiddenCommands,
+		HiddenGroups:   cfg.Visibility.HiddenGroups,
+	})
+	agentManager.SetWeightBudget(cfg.Execution.WeightBudget)
+	agentManager.SetFairShare(cfg.Execution.FairBurst, time.Duration(cfg.Execution.FairRefillSeconds)*time.Second)
+	agentManager.SetMaxRuntime(time.Duration(cfg.Execution.MaxRuntimeSeconds) * time.Second)
+	if cfg.Execution.FairBurst > 0 && cfg.Execution.WeightBudget <= 0 {
+		logger.Warnf("execution.fair_burst has no effect without execution.weight_budget")
+	}
+	seedStoredAgents(agentManager, store, cfg)
+
+	h := handler.NewHandler(baseCtx, agentManager, store, *runtimeSettings)
+
+	// Probe change detection is read by the report writer InitProbing starts.
+	h.InitProbeChanges(cfg)
+
+	// Load latency-probe targets, wire agent metrics/probe reports to the store,
+	// and start the targets hot-reload watcher + retention pruner. targets.yaml
+	// lives next to the config file (e.g. /etc/yals/targets.yaml) rather than
+	// depending on the process working directory.
+	h.InitProbing(filepath.Join(opts.ConfigDir, "targets.yaml"))
+	h.InitAccessLists(cfg, opts.ConfigDir)
+	h.InitReputation(cfg, opts.ConfigDir)
+	h.InitCallbacks(cfg)
+	h.InitEnrollment(cfg)
+	h.InitChatOps(cfg)
+	h.InitCluster(cfg)
+	h.InitUILayout(cfg)
+	h.InitPreferences(cfg)
+	h.InitGeolocation(cfg, opts.ConfigDir)
+	h.InitEndpoints(cfg)
+	h.InitInventory(cfg, opts.ConfigDir)
+	h.InitAPIKeys(cfg)
+	h.InitGroupLimits(cfg)
+	h.InitCatalogPins(cfg)
+	h.InitRouteResults(cfg)
+	h.InitResultSigning(cfg)
+	h.InitMail(cfg)
+	h.InitNotifications(cfg)
+	h.InitProvisioningAlerts(cfg)
+	h.InitTestSuites(cfg)
+	h.InitRetention(cfg)
+	h.InitHandshakeGuard(cfg)
+	h.InitLimits(cfg)
+	h.InitIdleClients(cfg)
+	h.InitDualStack(cfg)
+	h.InitApprovals(cfg)
+	h.InitClientIDs(cfg)
+	h.InitSecurityHeaders(cfg)
+	h.InitRequestGuard(cfg)
+	h.InitInputPolicy(cfg)
+	h.InitExecutionPauses()
+	h.InitAbuseReports()
+	h.InitTermsAcks()
+	h.InitNotes(cfg)
+	h.InitFeatures(cfg)
+	h.InitOutputFooter(cfg)
+	h.InitProfiling(cfg)
+	h.InitExecutionTotals()
+
+	// Serve the built-in self-signed certificate. Agents trust it out of the box
+	// (they pin it), so a direct agent↔server link needs no certificate setup. For
+	// a browser-trusted UI or public deployment, terminate TLS at a reverse proxy /
+	// CDN with a real certificate — the agent also accepts that via CA validation.
+	serverCert, err := tls.X509KeyPair(yalstls.BuiltinCertPEM(), yalstls.BuiltinKeyPEM())
+	if err != nil {
+		cancelBase()
+		store.Close()
+		return nil, fmt.Errorf("failed to load built-in TLS certificate: %w", err)
+	}
+
+	grpcServer := newGRPCServer(*runtimeSettings)
+	h.RegisterGRPCServer(grpcServer)
+	h.ServeReverseAgents(grpcServer)
+	mux := http.NewServeMux()
+	h.SetupRoutes(mux, opts.WebDir)
+	web := h.WithSecurityHeaders(h.WithRequestLimits(mux))
+
+	httpServer := &http.Server{
+		Addr:        fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				grpcServer.ServeHTTP(w, r)
+			} else {
+				web.ServeHTTP(w, r)
+			}
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		// Half-open connections would otherwise wait forever in the TLS
+		// handshake; the guard also caps how many may be handshaking at once.
+		ReadHeaderTimeout: h.HandshakeTimeout(),
+		MaxHeaderBytes:    h.MaxHeaderBytes(),
+		ConnState:         h.TrackConnState,
+		// Drop the stdlib's benign "TLS handshake error" lines (see
+		// httpErrorLogFilter); they are expected with the built-in self-signed
+		// certificate and would otherwise flood the log on every browser hit.
+		ErrorLog: log.New(httpErrorLogFilter{}, "", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+
+	return &Server{
+		cfg:             cfg,
+		store:           store,
+		handler:         h,
+		grpcServer:      grpcServer,
+		httpServer:      httpServer,
+		cancelBase:      cancelBase,
+		shutdownTracing: shutdownTracing,
+	}, nil
+}
+
+// Addr is the configured listen address.
+func (s *Server) Addr() string {
+	return s.httpServer.Addr
+}
+
+// Handler serves both the web/API routes and the agents' gRPC stream. Agents
+// need HTTP/2 over TLS to reach it.
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// ListenAndServe serves HTTPS (web UI, API and agent gRPC) on the configured
+// address with the built-in certificate. After Shutdown it returns
+// http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	logger.Infof("Using built-in TLS certificate (agents trust it directly, or a real cert via a TLS-terminating proxy)")
+	logger.Warnf("Browsers will warn on the self-signed certificate; front YALS with a TLS-terminating proxy holding a real certificate for a trusted web UI")
+	logger.Infof("Starting unified HTTPS server (gRPC + HTTP) on %s", s.httpServer.Addr)
+	// Empty cert/key paths make ListenAndServeTLS use TLSConfig.Certificates.
+	return s.httpServer.ListenAndServeTLS("", "")
+}
+
+// ReloadAccessLists re-reads the security ban/allow list files.
+func (s *Server) ReloadAccessLists() {
+	s.handler.ReloadAccessLists()
+}
+
+// Shutdown stops running commands, closes agent streams and the listener,
+// stops the server's background work, stores the execution totals, flushes
+// traces and closes the database. No goroutine of the server outlives it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancelBase()
+	s.handler.FlushExecutionTotals()
+	// Agent streams are served through ServeHTTP, whose transports cannot be
+	// drained: GracefulStop would panic. Their contexts derive from baseCtx,
+	// so they have already ended.
+	s.grpcServer.Stop()
+	err := s.httpServer.Shutdown(ctx)
+	if tracingErr := s.shutdownTracing(ctx); tracingErr != nil {
+		err = errors.Join(err, tracingErr)
+	}
+	if storeErr := s.store.Close(); storeErr != nil {
+		err = errors.Join(err, storeErr)
+	}
+	return err
+}
+
+// httpErrorLogFilter is the writer behind the HTTPS server's ErrorLog. It drops
+// the stdlib's benign "TLS handshake error" lines — emitted whenever a client
+// rejects the built-in self-signed certificate (every browser does, since it is
+// untrusted by design) or a port scanner opens and immediately drops the
+// connection. These are expected noise, not actionable faults. Every other line
+// is forwarded to stdout unchanged, matching the rest of the server's logging.
+type httpErrorLogFilter struct{}
+
+func (httpErrorLogFilter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("http: TLS handshake error")) {
+		return len(p), nil
+	}
+	return os.Stdout.Write(p)
+}
+
+func newGRPCServer(settings config.RuntimeSettings) *grpc.Server {
+	config.NormalizeRuntimeSettings(&settings)
+	return grpc.NewServer(
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    time.Duration(settings.GRPC.PingInterval) * time.Second,
+			Timeout: time.Duration(settings.GRPC.PongWait) * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             5 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+}
+
+func seedStoredAgents(agentManager *agent.Manager, store *serverstore.Store, cfg *config.Config) {
+	records, err := store.ListAgents()
+	if err != nil {
+		logger.Warnf("Failed to preload stored agents: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		runtimeConfig := serverstore.BuildRuntimeConfig(cfg.Server.Host, cfg.Server.Port, record, cfg.Server.LogLevel)
+		agentManager.RegisterAgent(agent.AgentRegistration{
+			UUID:           record.UUID,
+			Name:           record.Name,
+			Group:          record.Group,
+			Details:        record.Details,
+			Commands:       runtimeConfig.GetAvailableCommands(),
+			NeverConnected: record.NeverConnected,
+		}, nil)
+	}
+
+	logger.Infof("Preloaded %d stored agent definitions", len(records))
+}
@@ -0,0 +1,128 @@
+// Package wire is the reference implementation of YALS's two protocols, for
+// third-party agents and clients:
+//
+//   - the agent protocol: JSON messages on the gRPC service
+//     proto.AgentService (a Handshake call, then a bidirectional
+//     StreamCommands stream of CommandMessage, and the Enroll call of agents
+//     joining with an enrollment code), with the content subtype "json";
+//   - the client protocol: the server-sent events of POST /api/exec.
+//
+// Decoding is strict and never panics: anything but a well-formed message is
+// refused with an error wrapping ErrMalformed, the same way the server and
+// the agent refuse it.
+package wire
+
+import "github.com/TogawaSakiko363/YALS/internal/proto"
+
+// Messages of the agent protocol.
+type (
+	HandshakeRequest  = proto.HandshakeRequest
+	HandshakeResponse = proto.HandshakeResponse
+	EnrollRequest     = proto.EnrollRequest
+	EnrollResponse    = proto.EnrollResponse
+	CommandMessage    = proto.CommandMessage
+	CommandInfo       = proto.CommandInfo
+	CatalogReport     = proto.CatalogReport
+	SystemMetrics     = proto.SystemMetrics
+	ProbeConfig       = proto.ProbeConfig
+	ProbeTargetSpec   = proto.ProbeTargetSpec
+	ProbeBatch        = proto.ProbeBatch
+	ProbeResult       = proto.ProbeResult
+	RouteResult       = proto.RouteResult
+	RouteHop          = proto.RouteHop
+	PingResult        = proto.PingResult
+	Iperf3Summary     = proto.Iperf3Summary
+)
+
+// ErrMalformed is wrapped by every decoding error of a malformed message.
+var ErrMalformed = proto.ErrMalformed
+
+// Types of a CommandMessage, with the direction they travel in and the
+// payload in Data.
+const (
+	MessageExecuteCommand      = "execute_command"      // server→agent
+	MessageStopCommand         = "stop_command"         // server→agent
+	MessageStopAll             = "stop_all"             // server→agent
+	MessageProbeConfig         = "probe_config"         // server→agent, ProbeConfig
+	MessageReloadConfig        = "reload_config"        // server→agent
+	MessageDisconnect          = "disconnect"           // server→agent
+	MessageHeartbeat           = "heartbeat"            // both ways
+	MessageCommandOutput       = "command_output"       // agent→server, a result in Data
+	MessageCommandAvailability = "command_availability" // agent→server, []CommandInfo
+	MessageCatalog             = "catalog"              // agent→server, CatalogReport
+	MessageMetricsReport       = "metrics_report"       // agent→server, SystemMetrics
+	MessageProbeReport         = "probe_report"         // agent→server, ProbeBatch
+)
+
+// Values negotiated in the handshake, kinds of structured results, and the
+// codes an agent refuses a command with (see proto).
+const (
+	CompressionZstd             = proto.CompressionZstd
+	CapabilityRawICMP           = proto.CapabilityRawICMP
+	CapabilityUnprivilegedICMP  = proto.CapabilityUnprivilegedICMP
+	CapabilityStructuredResults = proto.CapabilityStructuredResults
+
+	EnrollPending  = proto.EnrollPending
+	EnrollApproved = proto.EnrollApproved
+
+	ResultKindRoute  = proto.ResultKindRoute
+	ResultKindIperf3 = proto.ResultKindIperf3
+	ResultKindPing   = proto.ResultKindPing
+
+	RejectNotAllowed    = proto.RejectNotAllowed
+	RejectUnavailable   = proto.RejectUnavailable
+	RejectBusy          = proto.RejectBusy
+	RejectInvalidTarget = proto.RejectInvalidTarget
+	RejectInvalidOption = proto.RejectInvalidOption
+	RejectNoAddress     = proto.RejectNoAddress
+	RejectRateLimited   = proto.RejectRateLimited
+	RejectPaused        = proto.RejectPaused
+)
+
+// MarshalCommandMessage encodes a stream message; one without a type is
+// refused.
+func MarshalCommandMessage(m *CommandMessage) ([]byte, error) {
+	return proto.MarshalCommandMessage(m)
+}
+
+// UnmarshalCommandMessage decodes a stream message: a single JSON object
+// with a type. Unknown fields are ignored, and receivers ignore unknown
+// types, so that newer peers can add both.
+func UnmarshalCommandMessage(data []byte) (*CommandMessage, error) {
+	return proto.UnmarshalCommandMessage(data)
+}
+
+// UnmarshalHandshakeRequest decodes an agent's handshake.
+func UnmarshalHandshakeRequest(data []byte) (*HandshakeRequest, error) {
+	return proto.UnmarshalHandshakeRequest(data)
+}
+
+// UnmarshalHandshakeResponse decodes the server's answer to a handshake.
+func UnmarshalHandshakeResponse(data []byte) (*HandshakeResponse, error) {
+	return proto.UnmarshalHandshakeResponse(data)
+}
+
+// UnmarshalEnrollRequest decodes an agent's enrollment request.
+func UnmarshalEnrollRequest(data []byte) (*EnrollRequest, error) {
+	return proto.UnmarshalEnrollRequest(data)
+}
+
+// UnmarshalEnrollResponse decodes the server's answer to an enrollment
+// request.
+func UnmarshalEnrollResponse(data []byte) (*EnrollResponse, error) {
+	return proto.UnmarshalEnrollResponse(data)
+}
+
+// UnmarshalData decodes the payload of a stream message, e.g.
+// UnmarshalData[ProbeConfig](m) for a MessageProbeConfig.
+func UnmarshalData[T any](m *CommandMessage) (T, error) {
+	return proto.UnmarshalData[T](m)
+}
+
+// CompressOutput and DecompressOutput convert the Output of a
+// MessageCommandOutput to and from OutputZstd, once the handshake
+// negotiated CompressionZstd.
+var (
+	CompressOutput   = proto.CompressOutput
+	DecompressOutput = proto.DecompressOutput
+)
@@ -0,0 +1,121 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Types of an ExecEvent.
+const (
+	// EventOutput carries the whole output so far, not a chunk.
+	EventOutput = "output"
+	// EventData carries a structured result (RouteResult, PingResult,
+	// Iperf3Summary, ...) whose "kind" names its shape.
+	EventData = "data"
+	// EventError reports an error while the command still runs.
+	EventError = "error"
+	// EventPendingApproval: the command waits for an operator's approval.
+	EventPendingApproval = "pending_approval"
+	// EventComplete ends the run.
+	EventComplete = "complete"
+)
+
+// ExecEvent is one server-sent event of POST /api/exec. Fields other than
+// Type are set on the events they belong to.
+type ExecEvent struct {
+	Type   string          `json:"type"`
+	Output string          `json:"output,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+
+	// Success, Error and Code end the run; Code is one of the Reject*
+	// codes when the command was refused.
+	Success bool   `json:"success,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+	// Field, Reason and Limit explain a refused request field.
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+
+	// Of a successful complete event.
+	Footer        string          `json:"footer,omitempty"`
+	Target        string          `json:"target,omitempty"`
+	TargetUnicode string          `json:"target_unicode,omitempty"`
+	ASPath        []ASPathSegment `json:"as_path,omitempty"`
+	ResultID      string          `json:"result_id,omitempty"`
+
+	// Of a pending_approval event.
+	ApprovalID string `json:"approval_id,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+}
+
+// ASPathSegment is a run of consecutive trace hops in one AS.
+type ASPathSegment struct {
+	ASN   string `json:"asn"`
+	Owner string `json:"owner,omitempty"`
+	Hops  int    `json:"hops"`
+}
+
+// MarshalExecEvent encodes e as a server-sent event: a "data:" line and a
+// blank line.
+func MarshalExecEvent(e ExecEvent) ([]byte, error) {
+	if e.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrMalformed)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte("data: "), data...), '\n', '\n'), nil
+}
+
+// UnmarshalExecEvent decodes the JSON of an event's "data:" line.
+func UnmarshalExecEvent(data []byte) (ExecEvent, error) {
+	var e ExecEvent
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return ExecEvent{}, fmt.Errorf("%w: not a JSON object", ErrMalformed)
+	}
+	if err := json.Unmarshal(trimmed, &e); err != nil {
+		return ExecEvent{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if e.Type == "" {
+		return ExecEvent{}, fmt.Errorf("%w: missing type", ErrMalformed)
+	}
+	return e, nil
+}
+
+// maxEventLine bounds one event line; the output event of a long run holds
+// all of its output.
+const maxEventLine = 16 << 20
+
+// EventReader reads the events of an /api/exec response body.
+type EventReader struct {
+	scanner *bufio.Scanner
+}
+
+// NewEventReader reads events from r.
+func NewEventReader(r io.Reader) *EventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxEventLine)
+	return &EventReader{scanner: scanner}
+}
+
+// Next returns the next event, or io.EOF at the end of the stream. Lines
+// other than "data:" lines, such as comments, are skipped.
+func (r *EventReader) Next() (ExecEvent, error) {
+	for r.scanner.Scan() {
+		data, ok := bytes.CutPrefix(r.scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		return UnmarshalExecEvent(data)
+	}
+	if err := r.scanner.Err(); err != nil {
+		return ExecEvent{}, err
+	}
+	return ExecEvent{}, io.EOF
+}
@@ -0,0 +1,59 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func FuzzEventReader(f *testing.F) {
+	var stream []byte
+	for _, e := range []ExecEvent{
+		{Type: EventOutput, Output: "PING 192.0.2.1"},
+		{Type: EventData, Data: []byte(`{"kind":"ping","loss":0}`)},
+		{Type: EventComplete, Success: true, Footer: "done", Target: "192.0.2.1"},
+	} {
+		event, err := MarshalExecEvent(e)
+		if err != nil {
+			f.Fatal(err)
+		}
+		stream = append(stream, event...)
+	}
+	f.Add(stream)
+	f.Add(stream[:len(stream)/2])
+	f.Add(append([]byte(": keep-alive\n\n"), stream...))
+	for _, seed := range []string{
+		"data: {\"type\":\"output\",\"output\":\"par",
+		"data: {\"output\":\"no type\"}\n\n",
+		"data: null\n\n",
+		"data: [1,2]\n\n",
+		"data:\n\n",
+		"data: {\"type\":\"complete\",\"success\":\"yes\"}\n\n",
+		"event: x\nid: 1\n\n",
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewEventReader(bytes.NewReader(data))
+		// Every call consumes at least one line, so the stream ends
+		// after at most one call per line.
+		for range bytes.Count(data, []byte("\n")) + 2 {
+			e, err := r.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("error does not wrap ErrMalformed: %v", err)
+				}
+				continue
+			}
+			if e.Type == "" {
+				t.Fatal("read an event without a type")
+			}
+		}
+		t.Fatal("reader did not reach the end of the stream")
+	})
+}
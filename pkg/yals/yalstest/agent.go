@@ -0,0 +1,93 @@
+package yalstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/TogawaSakiko363/YALS/pkg/yals"
+)
+
+// Agent is a test agent: a real agent client connecting to the test server.
+type Agent struct {
+	Name  string
+	UUID  string
+	Token string
+
+	env *Env
+
+	mu     sync.Mutex
+	client *yals.AgentClient
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// Start connects the agent. An agent already running is left as it is.
+func (a *Agent) Start() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancel != nil {
+		return nil
+	}
+	host, portText, err := net.SplitHostPort(a.env.httpServer.Listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portText)
+	client, err := yals.NewAgentClient(yals.AgentOptions{
+		Host:       host,
+		Port:       port,
+		UUID:       a.UUID,
+		Token:      a.Token,
+		Connection: a.env.connection,
+	})
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", a.Name, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+	a.client, a.cancel, a.done = client, cancel, done
+	return nil
+}
+
+// Stop disconnects the agent, stopping the commands it runs, and returns once
+// it has. It returns the error the agent stopped with other than its
+// cancellation.
+func (a *Agent) Stop() error {
+	a.mu.Lock()
+	cancel, done := a.cancel, a.done
+	a.cancel, a.done = nil, nil
+	a.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// Restart disconnects the agent and connects it again, as after a network
+// failure or an agent restart.
+func (a *Agent) Restart() error {
+	if err := a.Stop(); err != nil {
+		return err
+	}
+	return a.Start()
+}
+
+// ActiveCommands returns how many commands the agent is running; 0 while it
+// is stopped.
+func (a *Agent) ActiveCommands() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		return 0
+	}
+	return a.client.ActiveCommands()
+}
@@ -0,0 +1,176 @@
+package yalstest_test
+
+// The benchmarks measure the output path of a command, from the agent
+// through the server's manager and /api/exec to a web client. Besides the
+// time per run, each reports the server's output latency (see
+// output_latency in /api/control/metrics). Compare runs with benchstat:
+//
+//	go test ./pkg/yals/yalstest -run '^$' -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/TogawaSakiko363/YALS/pkg/yals/yalstest"
+)
+
+var (
+	benchLines   = flag.Int("lines", 20000, "lines of output of the large benchmarks")
+	benchClients = flag.Int("clients", 8, "clients following one run in the fanout benchmark")
+)
+
+// largeScript prints n lines shaped like ping's, about 70 bytes each.
+func largeScript(n int) (string, int) {
+	script := fmt.Sprintf(`awk 'BEGIN { for (i = 0; i < %d; i++) printf "%%06d 64 bytes from 192.0.2.1: icmp_seq=%%d ttl=57 time=12.3 ms\n", i, i }'`, n)
+	// Every line has the same length when i stays below 10^6, except for
+	// icmp_seq's digits; the byte count is for MB/s only.
+	return script, n * 70
+}
+
+// newBenchEnv starts a server with one agent, "edge", running the given commands,
+// and waits for it to connect. The benchmark's timer is stopped meanwhile.
+func newBenchEnv(b *testing.B, commands ...yalstest.Command) *yalstest.Env {
+	b.StopTimer()
+	defer b.StartTimer()
+	env := yalstest.New(b, yalstest.Options{Agents: []yalstest.AgentSpec{{Name: "edge", Commands: commands}}})
+	env.WaitOnline(b, "edge")
+	return env
+}
+
+// exec runs command to completion as client.
+func exec(client *yalstest.Client, command, target string) error {
+	run, err := client.Exec(context.Background(), "edge", command, target)
+	if err != nil {
+		return fmt.Errorf("exec %s: %w", command, err)
+	}
+	result, err := run.Wait()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w", command, err)
+	}
+	if result.Complete == nil || !result.Complete.Success {
+		return fmt.Errorf("exec %s: did not complete: %+v", command, result.Complete)
+	}
+	return nil
+}
+
+// reportLatency adds the server's output latency to b's result.
+func reportLatency(b *testing.B, env *yalstest.Env) {
+	b.StopTimer()
+	client := env.Client(b)
+	if err := client.Login(context.Background()); err != nil {
+		b.Fatalf("login: %v", err)
+	}
+	var metrics struct {
+		OutputLatency struct {
+			Count uint64  `json:"count"`
+			P50   float64 `json:"p50_ms"`
+			P95   float64 `json:"p95_ms"`
+			Max   float64 `json:"max_ms"`
+		} `json:"output_latency"`
+	}
+	if err := client.Do(context.Background(), http.MethodGet, "/api/control/metrics", nil, &metrics); err != nil {
+		b.Fatalf("metrics: %v", err)
+	}
+	if latency := metrics.OutputLatency; latency.Count > 0 {
+		b.ReportMetric(latency.P50, "p50-latency-ms")
+		b.ReportMetric(latency.P95, "p95-latency-ms")
+		b.ReportMetric(latency.Max, "max-latency-ms")
+	}
+}
+
+// BenchmarkSmall runs a command with one line of output: the fixed cost of a run.
+func BenchmarkSmall(b *testing.B) {
+	b.ReportAllocs()
+	env := newBenchEnv(b, yalstest.Command{Name: "ping", Script: `echo "64 bytes from $1: icmp_seq=1 ttl=57 time=12.3 ms"`})
+	client := env.Client(b)
+	for i := 0; i < b.N; i++ {
+		if err := exec(client, "ping", "192.0.2.1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportLatency(b, env)
+}
+
+// BenchmarkLarge runs a command with -lines lines of output, as a long
+// traceroute or mtr report has.
+func BenchmarkLarge(b *testing.B) {
+	b.ReportAllocs()
+	script, size := largeScript(*benchLines)
+	env := newBenchEnv(b, yalstest.Command{Name: "large", Script: script})
+	client := env.Client(b)
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		if err := exec(client, "large", "192.0.2.1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportLatency(b, env)
+}
+
+// BenchmarkParallel runs large commands from GOMAXPROCS clients at once, each
+// against a target of its own so that their runs are not shared.
+func BenchmarkParallel(b *testing.B) {
+	b.ReportAllocs()
+	script, size := largeScript(*benchLines / 10)
+	env := newBenchEnv(b, yalstest.Command{Name: "large", Script: script, MaximumQueue: 1000})
+	b.SetBytes(int64(size))
+	var next atomic.Int32
+	b.RunParallel(func(pb *testing.PB) {
+		client := env.Client(b)
+		target := fmt.Sprintf("192.0.2.%d", next.Add(1)%250+1)
+		for pb.Next() {
+			if err := exec(client, "large", target); err != nil {
+				// Only the benchmark's goroutine may stop it.
+				b.Error(err)
+				return
+			}
+		}
+	})
+	reportLatency(b, env)
+}
+
+// BenchmarkFanout runs a large command followed by -clients clients, which share
+// the run (see the handler's run registry): the cost of streaming one output
+// to many.
+func BenchmarkFanout(b *testing.B) {
+	b.ReportAllocs()
+	script, size := largeScript(*benchLines / 10)
+	// The stub waits for the clients to join before it prints.
+	env := newBenchEnv(b, yalstest.Command{Name: "large", Script: "sleep 0.2\n" + script})
+	followers := make([]*yalstest.Client, *benchClients)
+	for i := range followers {
+		followers[i] = env.Client(b)
+	}
+	b.SetBytes(int64(size * *benchClients))
+	for i := 0; i < b.N; i++ {
+		runs := make([]*yalstest.Run, len(followers))
+		for j, client := range followers {
+			run, err := client.Exec(context.Background(), "edge", "large", "192.0.2.1")
+			if err != nil {
+				b.Fatalf("exec: %v", err)
+			}
+			runs[j] = run
+		}
+		errs := make(chan error, len(runs))
+		for _, run := range runs {
+			go func() {
+				result, err := run.Wait()
+				if err == nil && result.Complete == nil {
+					err = fmt.Errorf("run did not complete")
+				}
+				errs <- err
+			}()
+		}
+		for range runs {
+			if err := <-errs; err != nil {
+				b.Fatalf("fanout: %v", err)
+			}
+		}
+	}
+	reportLatency(b, env)
+}
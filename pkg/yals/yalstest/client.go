@@ -0,0 +1,208 @@
+package yalstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/TogawaSakiko363/YALS/internal/handler"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/pkg/yals/wire"
+)
+
+// Client is a scripted web client with a session of its own, talking to
+// the API as the web UI does.
+type Client struct {
+	SessionID string
+
+	env   *Env
+	http  *http.Client
+	token string
+}
+
+// Client returns a new client of the test server.
+func (e *Env) Client(t testing.TB) *Client {
+	t.Helper()
+	suffix, err := handler.GenerateRandomString(16)
+	if err != nil {
+		t.Fatalf("yalstest: %v", err)
+	}
+	tlsConfig, err := yalstls.ClientConfig("127.0.0.1")
+	if err != nil {
+		t.Fatalf("yalstest: %v", err)
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &Client{
+		SessionID: "session_" + suffix,
+		env:       e,
+		http:      &http.Client{Transport: transport},
+	}
+}
+
+// Login logs the client in to the control API; later calls carry its
+// control token, as the control panel's do.
+func (c *Client) Login(ctx context.Context) error {
+	var resp handler.ControlSessionResponse
+	if err := c.Do(ctx, http.MethodPost, "/api/control/login", handler.ControlLoginRequest{Password: c.env.Password}, &resp); err != nil {
+		return err
+	}
+	c.token = resp.Token
+	return nil
+}
+
+// Do sends body (when not nil) as JSON to path, with the client's session,
+// and decodes the JSON response into out (when not nil). A status other than
+// 2xx is an error holding the response body.
+func (c *Client) Do(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.env.URL+path+separator+"session_id="+c.SessionID, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// AgentOnline reports whether the server lists agent name as connected.
+func (c *Client) AgentOnline(ctx context.Context, name string) (bool, error) {
+	var nodes struct {
+		Groups []struct {
+			Agents []struct {
+				Name   string `json:"name"`
+				Status int    `json:"status"` // 1 when connected
+			} `json:"agents"`
+		} `json:"groups"`
+	}
+	if err := c.Do(ctx, http.MethodGet, "/api/node", nil, &nodes); err != nil {
+		return false, err
+	}
+	for _, group := range nodes.Groups {
+		for _, a := range group.Agents {
+			if a.Name == name {
+				return a.Status == 1, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("agent %s is not listed", name)
+}
+
+// Run is a command started with Exec, whose events are read with Next or
+// Wait.
+type Run struct {
+	// CommandID stops the run (see Client.Stop).
+	CommandID string
+
+	body   io.ReadCloser
+	events *wire.EventReader
+}
+
+// Exec starts command on agent against target. Pass an empty target for
+// commands that ignore theirs, so that CommandID matches the server's.
+// Cancelling ctx disconnects the client, as closing the browser tab does.
+func (c *Client) Exec(ctx context.Context, agentName, command, target string) (*Run, error) {
+	resp, err := c.send(ctx, http.MethodPost, "/api/exec", handler.ExecRequest{Agent: agentName, Command: command, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return &Run{
+		CommandID: fmt.Sprintf("%s-%s-%s-%s", command, target, agentName, c.SessionID),
+		body:      resp.Body,
+		events:    wire.NewEventReader(resp.Body),
+	}, nil
+}
+
+// Next returns the run's next event, or io.EOF once the server ended the
+// stream.
+func (r *Run) Next() (wire.ExecEvent, error) {
+	return r.events.Next()
+}
+
+// Result is what a run streamed until it ended.
+type Result struct {
+	// Output is the last output event's.
+	Output string
+	Data   []json.RawMessage
+	Events []wire.ExecEvent
+	// Complete is the final event; nil when the stream ended without one,
+	// as it does for a stopped run.
+	Complete *wire.ExecEvent
+}
+
+// Wait reads the run's events until its stream ends.
+func (r *Run) Wait() (Result, error) {
+	defer r.Close()
+	var result Result
+	for {
+		event, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Events = append(result.Events, event)
+		switch event.Type {
+		case wire.EventOutput:
+			result.Output = event.Output
+		case wire.EventData:
+			result.Data = append(result.Data, event.Data)
+		case wire.EventComplete:
+			result.Complete = &event
+		}
+	}
+}
+
+// Close disconnects from the run without waiting for it to end.
+func (r *Run) Close() error {
+	return r.body.Close()
+}
+
+// Stop asks the server to stop run, as the Stop button does.
+func (c *Client) Stop(ctx context.Context, run *Run) error {
+	return c.Do(ctx, http.MethodPost, "/api/stop", handler.StopRequest{CommandID: run.CommandID}, nil)
+}
@@ -0,0 +1,282 @@
+// Package yalstest runs a YALS server and its agents in one process for
+// end-to-end tests. The server is served by an httptest server over HTTP/2
+// with the built-in certificate, agents are real agent clients whose commands
+// are shell-script stubs, and Client drives the API the way the web UI does.
+//
+//	env := yalstest.New(t, yalstest.Options{Agents: []yalstest.AgentSpec{{
+//		Name:     "edge",
+//		Commands: []yalstest.Command{{Name: "ping", Script: `echo "pong $1"`}},
+//	}}})
+//	env.WaitOnline(t, "edge")
+//	run, err := env.Client(t).Exec(ctx, "edge", "ping", "192.0.2.1")
+//	...
+//	result, err := run.Wait()
+//
+// Stubs run with /bin/sh, so the package does not work on Windows hosts.
+package yalstest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/config"
+	"github.com/TogawaSakiko363/YALS/internal/handler"
+	serverstore "github.com/TogawaSakiko363/YALS/internal/store/server"
+	yalstls "github.com/TogawaSakiko363/YALS/internal/tls"
+	"github.com/TogawaSakiko363/YALS/pkg/yals"
+
+	"github.com/google/uuid"
+)
+
+// WaitTimeout bounds the Wait* helpers.
+const WaitTimeout = 15 * time.Second
+
+// Command is a command of a test agent, run from a stub script.
+type Command struct {
+	Name string
+	// Script is the body of a /bin/sh script. It gets the target as $1,
+	// except with IgnoreTarget.
+	Script       string
+	IgnoreTarget bool
+	MaximumQueue int
+}
+
+// AgentSpec is a test agent stored before the server starts.
+type AgentSpec struct {
+	Name     string
+	Group    string // default "Default"
+	Commands []Command
+}
+
+// Options configures New.
+type Options struct {
+	Agents []AgentSpec
+	// Config is YAML appended to the server configuration, for any section
+	// but server and database, which the harness writes.
+	Config string
+	// Connection tunes the agents' connection, e.g. short keepalives for
+	// tests of dropped connections.
+	Connection config.AgentConnectionConfig
+	// Manual leaves the agents stopped; start them with Agent.Start.
+	Manual bool
+}
+
+// Env is a running server with its agents. New closes it when the test
+// ends.
+type Env struct {
+	// URL is the server's base URL, e.g. "https://127.0.0.1:40123".
+	URL string
+	// Password logs a Client in to the control API (see Client.Login).
+	Password string
+	Server   *yals.Server
+
+	httpServer *httptest.Server
+	dir        string
+	connection config.AgentConnectionConfig
+
+	mu     sync.Mutex
+	agents map[string]*Agent
+	closed bool
+}
+
+// New stores the agents of opts, starts the server and, unless opts.Manual,
+// the agents. It fails t when any of it cannot be set up.
+func New(t testing.TB, opts Options) *Env {
+	t.Helper()
+	dir := t.TempDir()
+	password, err := handler.GenerateRandomString(24)
+	if err != nil {
+		t.Fatalf("yalstest: %v", err)
+	}
+	env := &Env{
+		Password:   password,
+		dir:        dir,
+		connection: opts.Connection,
+		agents:     make(map[string]*Agent),
+	}
+
+	// The listener exists before the server starts, so the configuration
+	// can name its port.
+	env.httpServer = httptest.NewUnstartedServer(nil)
+	port := env.httpServer.Listener.Addr().(*net.TCPAddr).Port
+	configPath := filepath.Join(dir, "config.yaml")
+	databasePath := filepath.Join(dir, "yals.db")
+	yaml := fmt.Sprintf("server:\n  host: \"127.0.0.1\"\n  port: %d\n  password: %q\n  log_level: \"warn\"\ndatabase:\n  path: %q\n%s\n",
+		port, password, databasePath, opts.Config)
+	if err := os.WriteFile(configPath, []byte(yaml), 0o600); err != nil {
+		t.Fatalf("yalstest: write config: %v", err)
+	}
+	if err := env.storeAgents(databasePath, opts.Agents); err != nil {
+		t.Fatalf("yalstest: %v", err)
+	}
+
+	srv, err := yals.NewServer(yals.ServerOptions{ConfigPath: configPath, WebDir: filepath.Join(dir, "web")})
+	if err != nil {
+		t.Fatalf("yalstest: start server: %v", err)
+	}
+	env.Server = srv
+	cert, err := tls.X509KeyPair(yalstls.BuiltinCertPEM(), yalstls.BuiltinKeyPEM())
+	if err != nil {
+		t.Fatalf("yalstest: %v", err)
+	}
+	env.httpServer.Config.Handler = srv.Handler()
+	env.httpServer.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	env.httpServer.EnableHTTP2 = true
+	env.httpServer.StartTLS()
+	env.URL = env.httpServer.URL
+	t.Cleanup(env.Close)
+
+	if !opts.Manual {
+		for _, spec := range opts.Agents {
+			if err := env.Agent(spec.Name).Start(); err != nil {
+				t.Fatalf("yalstest: %v", err)
+			}
+		}
+	}
+	return env
+}
+
+// storeAgents writes the agents' stub scripts and stores their records in
+// the database the server then opens.
+func (e *Env) storeAgents(databasePath string, specs []AgentSpec) error {
+	store, err := serverstore.NewStore(databasePath)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer store.Close()
+
+	for _, spec := range specs {
+		token, err := handler.GenerateRandomString(32)
+		if err != nil {
+			return err
+		}
+		a := &Agent{env: e, Name: spec.Name, UUID: uuid.NewString(), Token: token}
+		commands := make([]serverstore.CommandRecord, 0, len(spec.Commands))
+		for i, command := range spec.Commands {
+			script := filepath.Join(e.dir, "bin", spec.Name, command.Name)
+			if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(script, []byte("#!/bin/sh\n"+command.Script+"\n"), 0o755); err != nil {
+				return fmt.Errorf("write stub %s: %w", command.Name, err)
+			}
+			template := script + " {target}"
+			if command.IgnoreTarget {
+				template = script
+			}
+			commands = append(commands, serverstore.CommandRecord{
+				Name:         command.Name,
+				Template:     template,
+				IgnoreTarget: command.IgnoreTarget,
+				MaximumQueue: command.MaximumQueue,
+				OrderIndex:   i,
+			})
+		}
+		if _, err := store.UpsertAgent(serverstore.AgentUpsertInput{
+			UUID:     a.UUID,
+			Token:    a.Token,
+			Name:     spec.Name,
+			Group:    spec.Group,
+			Commands: commands,
+		}); err != nil {
+			return fmt.Errorf("store agent %s: %w", spec.Name, err)
+		}
+		e.agents[spec.Name] = a
+	}
+	return nil
+}
+
+// Agent returns the test agent called name, or nil when there is none.
+func (e *Env) Agent(name string) *Agent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.agents[name]
+}
+
+// WaitOnline waits until the server lists agent name as connected.
+func (e *Env) WaitOnline(t testing.TB, name string) {
+	t.Helper()
+	e.waitStatus(t, name, true)
+}
+
+// WaitOffline waits until the server lists agent name as not connected.
+func (e *Env) WaitOffline(t testing.TB, name string) {
+	t.Helper()
+	e.waitStatus(t, name, false)
+}
+
+func (e *Env) waitStatus(t testing.TB, name string, online bool) {
+	t.Helper()
+	client := e.Client(t)
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	var last error
+	for {
+		if got, err := client.AgentOnline(ctx, name); err == nil && got == online {
+			return
+		} else if err != nil {
+			last = err
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("yalstest: agent %s not online=%t after %s (last error: %v)", name, online, WaitTimeout, last)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// WaitIdle waits until no agent runs a command any more, so a test can
+// check that stopped and abandoned runs were cleaned up.
+func (e *Env) WaitIdle(t testing.TB) {
+	t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		var busy []string
+		e.mu.Lock()
+		for name, a := range e.agents {
+			if n := a.ActiveCommands(); n > 0 {
+				busy = append(busy, fmt.Sprintf("%s (%d)", name, n))
+			}
+		}
+		e.mu.Unlock()
+		if len(busy) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("yalstest: agents still running commands after %s: %s", WaitTimeout, strings.Join(busy, ", "))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Close stops the agents and the server. It is safe to call more than once.
+func (e *Env) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	agents := make([]*Agent, 0, len(e.agents))
+	for _, a := range e.agents {
+		agents = append(agents, a)
+	}
+	e.mu.Unlock()
+
+	for _, a := range agents {
+		a.Stop()
+	}
+	e.httpServer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = e.Server.Shutdown(ctx)
+}
@@ -0,0 +1,323 @@
+package yalstest_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TogawaSakiko363/YALS/internal/logger"
+	"github.com/TogawaSakiko363/YALS/pkg/yals/wire"
+	"github.com/TogawaSakiko363/YALS/pkg/yals/yalstest"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		// Agents log the sends they lose when an environment is torn
+		// down, which would bury the benchmarks' results.
+		logger.SetGlobalOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func newEnv(t *testing.T, opts yalstest.Options) *yalstest.Env {
+	t.Helper()
+	if len(opts.Agents) == 0 {
+		opts.Agents = []yalstest.AgentSpec{{
+			Name: "edge",
+			Commands: []yalstest.Command{
+				{Name: "ping", Script: `echo "64 bytes from $1"; echo "done"`},
+				{Name: "sleep", Script: "echo start; sleep 30", IgnoreTarget: true},
+			},
+		}}
+	}
+	return yalstest.New(t, opts)
+}
+
+func TestExec(t *testing.T) {
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	run, err := env.Client(t).Exec(ctx, "edge", "ping", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	result, err := run.Wait()
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if result.Complete == nil || !result.Complete.Success {
+		t.Fatalf("run did not complete successfully: %+v", result.Complete)
+	}
+	if !strings.Contains(result.Output, "64 bytes from 192.0.2.1") || !strings.Contains(result.Output, "done") {
+		t.Errorf("output = %q, want both lines of the stub", result.Output)
+	}
+	if last := result.Events[len(result.Events)-1]; last.Type != wire.EventComplete {
+		t.Errorf("last event = %q, want %q", last.Type, wire.EventComplete)
+	}
+	env.WaitIdle(t)
+}
+
+func TestExecStreams(t *testing.T) {
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	// The first output arrives while the command still runs.
+	run, err := env.Client(t).Exec(ctx, "edge", "sleep", "")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	defer run.Close()
+	event := nextOutput(t, run)
+	if !strings.Contains(event.Output, "start") {
+		t.Errorf("output = %q, want %q", event.Output, "start")
+	}
+	if n := env.Agent("edge").ActiveCommands(); n != 1 {
+		t.Errorf("agent runs %d commands, want 1", n)
+	}
+}
+
+func TestStop(t *testing.T) {
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	client := env.Client(t)
+	run, err := client.Exec(ctx, "edge", "sleep", "")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	nextOutput(t, run)
+	if err := client.Stop(ctx, run); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := run.Wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	env.WaitIdle(t)
+}
+
+func TestSharedRunFooter(t *testing.T) {
+	env := newEnv(t, yalstest.Options{
+		Agents: []yalstest.AgentSpec{{
+			Name:     "edge",
+			Commands: []yalstest.Command{{Name: "slow", Script: `echo "start $1"; sleep 1; echo done`}},
+		}},
+		Config: "output:\n  footer: \"Run at {time}\"\n",
+	})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	leader, follower := env.Client(t), env.Client(t)
+	if err := follower.Do(ctx, http.MethodPut, "/api/preferences/display", map[string]string{"time_format": "12h"}, nil); err != nil {
+		t.Fatalf("display preferences: %v", err)
+	}
+	first, err := leader.Exec(ctx, "edge", "slow", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	nextOutput(t, first)
+	second, err := follower.Exec(ctx, "edge", "slow", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		run      *yalstest.Run
+		twelveHr bool
+	}{{"leader", first, false}, {"follower", second, true}} {
+		result, err := c.run.Wait()
+		if err != nil {
+			t.Fatalf("%s: wait: %v", c.name, err)
+		}
+		if result.Complete == nil || !result.Complete.Success {
+			t.Fatalf("%s: run did not complete successfully: %+v", c.name, result.Complete)
+		}
+		footer := result.Complete.Footer
+		if got := strings.HasSuffix(footer, "M UTC"); got != c.twelveHr {
+			t.Errorf("%s: footer = %q, 12-hour clock = %v, want %v", c.name, footer, got, c.twelveHr)
+		}
+		if !strings.HasSuffix(result.Output, footer) {
+			t.Errorf("%s: output = %q, want it to end with the footer %q", c.name, result.Output, footer)
+		}
+	}
+}
+
+func TestHiddenGroup(t *testing.T) {
+	env := newEnv(t, yalstest.Options{
+		Agents: []yalstest.AgentSpec{
+			{Name: "edge", Commands: []yalstest.Command{{Name: "ping", Script: `echo "64 bytes from $1"`}}},
+			{Name: "core", Group: "Private", Commands: []yalstest.Command{{Name: "ping", Script: `echo "64 bytes from $1"`}}},
+		},
+		Config: "visibility:\n  hidden_groups: [Private]\n",
+	})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	anonymous, operator := env.Client(t), env.Client(t)
+	if err := operator.Login(ctx); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	for _, c := range []struct {
+		name   string
+		client *yalstest.Client
+		agents []string
+	}{{"anonymous", anonymous, []string{"edge"}}, {"operator", operator, []string{"core", "edge"}}} {
+		var meta struct {
+			Agents []string `json:"agents"`
+		}
+		if err := c.client.Do(ctx, http.MethodGet, "/api/probes/meta", nil, &meta); err != nil {
+			t.Fatalf("%s: probes meta: %v", c.name, err)
+		}
+		if strings.Join(meta.Agents, ",") != strings.Join(c.agents, ",") {
+			t.Errorf("%s: probe agents = %v, want %v", c.name, meta.Agents, c.agents)
+		}
+		var nodes struct {
+			TotalNodes int `json:"total_nodes"`
+		}
+		if err := c.client.Do(ctx, http.MethodGet, "/api/node", nil, &nodes); err != nil {
+			t.Fatalf("%s: nodes: %v", c.name, err)
+		}
+		if nodes.TotalNodes != len(c.agents) {
+			t.Errorf("%s: total_nodes = %d, want %d", c.name, nodes.TotalNodes, len(c.agents))
+		}
+	}
+	for _, path := range []string{"/api/probes?agent=core", "/api/probes/series?agent=core&target=x"} {
+		if err := anonymous.Do(ctx, http.MethodGet, path, nil, nil); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("anonymous %s: err = %v, want 404", path, err)
+		}
+		if err := operator.Do(ctx, http.MethodGet, path, nil, nil); err != nil {
+			t.Errorf("operator %s: %v", path, err)
+		}
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+
+	// Leaving the page stops a run that nobody else follows.
+	ctx, cancel := context.WithCancel(context.Background())
+	run, err := env.Client(t).Exec(ctx, "edge", "sleep", "")
+	if err != nil {
+		cancel()
+		t.Fatalf("exec: %v", err)
+	}
+	nextOutput(t, run)
+	cancel()
+	env.WaitIdle(t)
+}
+
+func TestReconnect(t *testing.T) {
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+	ctx, cancel := context.WithTimeout(context.Background(), yalstest.WaitTimeout)
+	defer cancel()
+
+	// A run in progress when the connection drops is cleaned up.
+	client := env.Client(t)
+	run, err := client.Exec(ctx, "edge", "sleep", "")
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	nextOutput(t, run)
+	agent := env.Agent("edge")
+	if err := agent.Stop(); err != nil {
+		t.Fatalf("stop agent: %v", err)
+	}
+	env.WaitOffline(t, "edge")
+	if _, err := run.Wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	if err := agent.Restart(); err != nil {
+		t.Fatalf("restart agent: %v", err)
+	}
+	env.WaitOnline(t, "edge")
+	run, err = client.Exec(ctx, "edge", "ping", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("exec after reconnect: %v", err)
+	}
+	result, err := run.Wait()
+	if err != nil {
+		t.Fatalf("wait after reconnect: %v", err)
+	}
+	if result.Complete == nil || !result.Complete.Success {
+		t.Fatalf("run after reconnect did not complete successfully: %+v", result.Complete)
+	}
+	env.WaitIdle(t)
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	env := newEnv(t, yalstest.Options{Manual: true})
+	agent := env.Agent("edge")
+	agent.Token = "not-the-token"
+	if err := agent.Start(); err != nil {
+		t.Fatalf("start agent: %v", err)
+	}
+	defer agent.Stop()
+
+	client := env.Client(t)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		online, err := client.AgentOnline(context.Background(), "edge")
+		if err != nil {
+			t.Fatalf("agent status: %v", err)
+		}
+		if online {
+			t.Fatal("agent with a wrong token was let in")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// nextOutput reads run's events up to its first output event.
+func nextOutput(t *testing.T, run *yalstest.Run) wire.ExecEvent {
+	t.Helper()
+	for {
+		event, err := run.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatal("stream ended before any output")
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		switch event.Type {
+		case wire.EventOutput:
+			return event
+		case wire.EventComplete:
+			t.Fatalf("run ended before any output: %+v", event)
+		}
+	}
+}
+
+func TestCloseStopsBackgroundWork(t *testing.T) {
+	before := runtime.NumGoroutine()
+	env := newEnv(t, yalstest.Options{})
+	env.WaitOnline(t, "edge")
+	env.Close()
+
+	deadline := time.Now().Add(yalstest.WaitTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left after Close, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}